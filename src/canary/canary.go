@@ -0,0 +1,162 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+type canaryStats struct {
+	success             gostats.Counter
+	failure             gostats.Counter
+	latency             gostats.Timer
+	consecutiveFailures gostats.Gauge
+}
+
+func newCanaryStats(scope gostats.Scope) canaryStats {
+	ret := canaryStats{}
+	ret.success = scope.NewCounter("success")
+	ret.failure = scope.NewCounter("failure")
+	ret.latency = scope.NewTimer("latency")
+	ret.consecutiveFailures = scope.NewGauge("consecutive_failures")
+	return ret
+}
+
+// Canary periodically issues ShouldRateLimit against a reserved domain and validates
+// the decision and its latency. After a configurable number of consecutive failures
+// the canary health component is failed, taking the whole service out of rotation.
+type Canary struct {
+	service             pb.RateLimitServiceServer
+	health              *server.HealthChecker
+	request             *pb.RateLimitRequest
+	interval            time.Duration
+	latencyThreshold    time.Duration
+	failureThreshold    int
+	consecutiveFailures int
+	stats               canaryStats
+	mu                  sync.Mutex
+	stop                chan struct{}
+	stopOnce            sync.Once
+}
+
+// NewCanary creates a new Canary. The canary registers its own health component,
+// which starts healthy so that a service without traffic is not failed at startup.
+func NewCanary(service pb.RateLimitServiceServer, health *server.HealthChecker, scope gostats.Scope, s settings.Settings) *Canary {
+	health.AddComponent(server.CanaryHealthComponentName)
+	return &Canary{
+		service: service,
+		health:  health,
+		request: &pb.RateLimitRequest{
+			Domain: s.CanaryDomain,
+			Descriptors: []*pb_struct.RateLimitDescriptor{{
+				Entries: []*pb_struct.RateLimitDescriptor_Entry{{
+					Key:   s.CanaryDescriptorKey,
+					Value: s.CanaryDescriptorValue,
+				}},
+			}},
+		},
+		interval:         s.CanaryInterval,
+		latencyThreshold: s.CanaryLatencyThreshold,
+		failureThreshold: s.CanaryFailureThreshold,
+		stats:            newCanaryStats(scope),
+		stop:             make(chan struct{}),
+	}
+}
+
+// Start runs the canary probe loop in the background until Stop is called.
+func (c *Canary) Start() {
+	logger.Infof("Starting canary for domain '%s' every %s", c.request.Domain, c.interval)
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Probe()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the probe loop.
+func (c *Canary) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Probe issues a single canary request, records its outcome and updates the health
+// component. It returns the validation error, if any.
+func (c *Canary) Probe() error {
+	ctx := context.Background()
+	if c.latencyThreshold > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.latencyThreshold)
+		defer cancel()
+	}
+
+	start := time.Now()
+	resp, err := c.service.ShouldRateLimit(ctx, c.request)
+	elapsed := time.Since(start)
+	c.stats.latency.AddValue(float64(elapsed.Milliseconds()))
+
+	if err == nil {
+		err = c.validate(resp, elapsed)
+	}
+	c.record(err)
+	return err
+}
+
+func (c *Canary) validate(resp *pb.RateLimitResponse, elapsed time.Duration) error {
+	if resp == nil {
+		return errors.New("nil response")
+	}
+	if resp.OverallCode == pb.RateLimitResponse_UNKNOWN {
+		return errors.New("response code is UNKNOWN")
+	}
+	if len(resp.Statuses) != len(c.request.Descriptors) {
+		return fmt.Errorf("expected %d descriptor statuses, got %d", len(c.request.Descriptors), len(resp.Statuses))
+	}
+	if c.latencyThreshold > 0 && elapsed > c.latencyThreshold {
+		return fmt.Errorf("latency %s exceeds threshold %s", elapsed, c.latencyThreshold)
+	}
+	return nil
+}
+
+func (c *Canary) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.stats.success.Inc()
+		if c.consecutiveFailures >= c.failureThreshold {
+			logger.Warnf("Canary recovered after %d consecutive failures", c.consecutiveFailures)
+		}
+		c.consecutiveFailures = 0
+		c.stats.consecutiveFailures.Set(0)
+		if healthErr := c.health.Ok(server.CanaryHealthComponentName); healthErr != nil {
+			logger.Errorf("Unable to update health status: %s", healthErr)
+		}
+		return
+	}
+
+	c.stats.failure.Inc()
+	c.consecutiveFailures++
+	c.stats.consecutiveFailures.Set(uint64(c.consecutiveFailures))
+	logger.Warnf("Canary probe failed (%d consecutive): %s", c.consecutiveFailures, err)
+	if c.consecutiveFailures >= c.failureThreshold {
+		if healthErr := c.health.Fail(server.CanaryHealthComponentName); healthErr != nil {
+			logger.Errorf("Unable to update health status: %s", healthErr)
+		}
+	}
+}
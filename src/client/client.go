@@ -0,0 +1,160 @@
+// Package client is a client of the rate limit service for Go services, which only depends on the
+// protos of the service and on gRPC.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// FailureMode is the answer of Allow when the service can't answer.
+type FailureMode int
+
+const (
+	// FailOpen allows the requests when the service can't answer.
+	FailOpen FailureMode = iota
+	// FailClosed limits the requests when the service can't answer.
+	FailClosed
+)
+
+const (
+	defaultTimeout      = 100 * time.Millisecond
+	defaultRetryBackoff = 10 * time.Millisecond
+)
+
+type Options struct {
+	// Timeout is the deadline of each attempt, 100ms by default.
+	Timeout time.Duration
+	// MaxRetries is the number of attempts after the first one of a request whose attempt failed with
+	// Unavailable, 0 for none.
+	MaxRetries int
+	// RetryTimeouts also retries the attempts which timed out. The service may have counted the hits of
+	// such an attempt, which are then counted again by the retry.
+	RetryTimeouts bool
+	// RetryBackoff is the delay before the first retry, doubled for each next retry, 10ms by default.
+	RetryBackoff time.Duration
+	// FailureMode is the answer of Allow when the service can't answer, FailOpen by default.
+	FailureMode FailureMode
+	// Fallback, if set, answers Allow instead of FailureMode when the service can't answer, e.g. with a
+	// local limit of the instance.
+	Fallback func(request *pb.RateLimitRequest, err error) bool
+	// OnError, if set, is called with the error of each request of the middleware and interceptors the
+	// service couldn't answer, e.g. to log it, the request being answered by Fallback or FailureMode.
+	OnError func(request *pb.RateLimitRequest, err error)
+	// TransportCredentials secure the connections created by New, insecure by default.
+	TransportCredentials credentials.TransportCredentials
+	// DialOptions are added to the options of the connections created by New, e.g. interceptors.
+	DialOptions []grpc.DialOption
+}
+
+// Client sends the requests of a Go service to the rate limit service.
+type Client struct {
+	conn    *grpc.ClientConn
+	service pb.RateLimitServiceClient
+	options Options
+}
+
+// New returns a client connected to target, e.g. ratelimit:8081 or dns:///ratelimit:8081. The connection
+// is established on the first request and reconnects on its own, the client being closed by Close.
+func New(target string, options Options) (*Client, error) {
+	transportCredentials := options.TransportCredentials
+	if transportCredentials == nil {
+		transportCredentials = insecure.NewCredentials()
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(transportCredentials)}, options.DialOptions...)
+	conn, err := grpc.NewClient(target, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the connection to %s: %w", target, err)
+	}
+	ret := NewWithConn(conn, options)
+	ret.conn = conn
+	return ret, nil
+}
+
+// NewWithConn returns a client using a connection managed by the caller, which isn't closed by Close.
+func NewWithConn(conn grpc.ClientConnInterface, options Options) *Client {
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultRetryBackoff
+	}
+	return &Client{service: pb.NewRateLimitServiceClient(conn), options: options}
+}
+
+// Close closes the connection created by New.
+func (this *Client) Close() error {
+	if this.conn == nil {
+		return nil
+	}
+	return this.conn.Close()
+}
+
+// ShouldRateLimit sends a request, retried according to the options. The error is the one of the last
+// attempt, or the one of ctx if it is done first.
+func (this *Client) ShouldRateLimit(ctx context.Context, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+	backoff := this.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, this.options.Timeout)
+		response, err := this.service.ShouldRateLimit(attemptCtx, request)
+		cancel()
+		if err == nil || attempt >= this.options.MaxRetries || !this.isRetryable(err) || ctx.Err() != nil {
+			return response, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Allow returns whether a hit of the descriptors is within their limits. When the service can't answer,
+// the answer is the one of the Fallback, or the hit is allowed with FailOpen and limited with FailClosed,
+// the error being returned either way.
+func (this *Client) Allow(ctx context.Context, domain string, descriptors ...*pb_struct.RateLimitDescriptor) (bool, error) {
+	allowed, _, err := this.decide(ctx, NewRequest(domain, 1, descriptors...))
+	return allowed, err
+}
+
+// decide returns whether the request is allowed with the response of the service, nil if it couldn't answer.
+func (this *Client) decide(ctx context.Context, request *pb.RateLimitRequest) (bool, *pb.RateLimitResponse, error) {
+	response, err := this.ShouldRateLimit(ctx, request)
+	if err != nil {
+		if this.options.Fallback != nil {
+			return this.options.Fallback(request, err), nil, err
+		}
+		return this.options.FailureMode == FailOpen, nil, err
+	}
+	return response.OverallCode != pb.RateLimitResponse_OVER_LIMIT, response, nil
+}
+
+// isRetryable returns whether an attempt failed because the service couldn't be reached, or timed out
+// with RetryTimeouts.
+func (this *Client) isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return this.options.RetryTimeouts
+	}
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		return this.options.RetryTimeouts
+	default:
+		return false
+	}
+}
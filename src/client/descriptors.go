@@ -0,0 +1,59 @@
+package client
+
+import (
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	pb_type "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// NewRequest returns the request of hitsAddend hits of the descriptors of a domain.
+func NewRequest(domain string, hitsAddend uint32, descriptors ...*pb_struct.RateLimitDescriptor) *pb.RateLimitRequest {
+	return &pb.RateLimitRequest{Domain: domain, Descriptors: descriptors, HitsAddend: hitsAddend}
+}
+
+// Descriptor returns the descriptor of keys and values alternating, e.g. Descriptor("route", "/login",
+// "user_id", "alice"). It panics if a key has no value.
+func Descriptor(keysAndValues ...string) *pb_struct.RateLimitDescriptor {
+	if len(keysAndValues)%2 != 0 {
+		panic("client.Descriptor: a key has no value")
+	}
+	entries := make([]*pb_struct.RateLimitDescriptor_Entry, 0, len(keysAndValues)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		entries = append(entries, &pb_struct.RateLimitDescriptor_Entry{Key: keysAndValues[i], Value: keysAndValues[i+1]})
+	}
+	return &pb_struct.RateLimitDescriptor{Entries: entries}
+}
+
+// DescriptorBuilder builds a descriptor entry by entry, e.g. from the optional attributes of a request.
+type DescriptorBuilder struct {
+	descriptor *pb_struct.RateLimitDescriptor
+}
+
+func NewDescriptorBuilder() *DescriptorBuilder {
+	return &DescriptorBuilder{descriptor: &pb_struct.RateLimitDescriptor{}}
+}
+
+// Add appends an entry.
+func (this *DescriptorBuilder) Add(key string, value string) *DescriptorBuilder {
+	this.descriptor.Entries = append(this.descriptor.Entries, &pb_struct.RateLimitDescriptor_Entry{Key: key, Value: value})
+	return this
+}
+
+// AddIfSet appends an entry if its value isn't empty.
+func (this *DescriptorBuilder) AddIfSet(key string, value string) *DescriptorBuilder {
+	if value != "" {
+		this.Add(key, value)
+	}
+	return this
+}
+
+// WithLimit overrides the limit of the descriptor with requestsPerUnit per unit.
+func (this *DescriptorBuilder) WithLimit(requestsPerUnit uint32, unit pb_type.RateLimitUnit) *DescriptorBuilder {
+	this.descriptor.Limit = &pb_struct.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: requestsPerUnit, Unit: unit}
+	return this
+}
+
+// Build returns the descriptor, which is shared with the builder.
+func (this *DescriptorBuilder) Build() *pb_struct.RateLimitDescriptor {
+	return this.descriptor
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// HTTPDescriptors returns the descriptors of an HTTP request, none to let the request through unchecked.
+type HTTPDescriptors func(request *http.Request) []*pb_struct.RateLimitDescriptor
+
+// GRPCDescriptors returns the descriptors of a gRPC call by its full method, e.g. /package.Service/Method,
+// none to let the call through unchecked.
+type GRPCDescriptors func(ctx context.Context, fullMethod string) []*pb_struct.RateLimitDescriptor
+
+// DefaultHTTPDescriptors are the descriptor of the method and route pattern of a request, e.g. method=GET
+// and pattern=GET /users/{id} when the middleware wraps a handler of an http.ServeMux, the method alone
+// otherwise, and the descriptor of its remote address. The path isn't used, its values being unbounded
+// when it holds ids.
+func DefaultHTTPDescriptors(request *http.Request) []*pb_struct.RateLimitDescriptor {
+	route := Descriptor("method", request.Method)
+	if request.Pattern != "" {
+		route = Descriptor("method", request.Method, "pattern", request.Pattern)
+	}
+	return []*pb_struct.RateLimitDescriptor{
+		route,
+		Descriptor("remote_address", remoteHost(request.RemoteAddr)),
+	}
+}
+
+// DefaultGRPCDescriptors are the descriptor of the service and method of a call, e.g.
+// service=package.Service and method=Method, and the descriptor of the address of its peer if known.
+func DefaultGRPCDescriptors(ctx context.Context, fullMethod string) []*pb_struct.RateLimitDescriptor {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	ret := []*pb_struct.RateLimitDescriptor{Descriptor("service", service, "method", method)}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ret = append(ret, Descriptor("remote_address", remoteHost(p.Addr.String())))
+	}
+	return ret
+}
+
+// HTTPMiddleware returns a middleware checking the descriptors of each request against the limits of a
+// domain, answering 429 Too Many Requests with a Retry-After header to the limited requests. The headers
+// of the response of the service, e.g. the x-ratelimit headers, are added to the responses.
+// descriptors is DefaultHTTPDescriptors if nil.
+func (this *Client) HTTPMiddleware(domain string, descriptors HTTPDescriptors) func(http.Handler) http.Handler {
+	if descriptors == nil {
+		descriptors = DefaultHTTPDescriptors
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			requestDescriptors := descriptors(request)
+			if len(requestDescriptors) == 0 {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			allowed, response := this.decideMiddleware(request.Context(), NewRequest(domain, 1, requestDescriptors...))
+			for _, header := range response.GetResponseHeadersToAdd() {
+				writer.Header().Add(header.Key, header.Value)
+			}
+			if !allowed {
+				if retryAfter := retryAfterSeconds(response); retryAfter > 0 {
+					writer.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+				}
+				http.Error(writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor checking the descriptors of each call against the limits
+// of a domain, failing the limited calls with ResourceExhausted. The headers of the response of the
+// service are sent as the header metadata of the calls. descriptors is DefaultGRPCDescriptors if nil.
+func (this *Client) UnaryServerInterceptor(domain string, descriptors GRPCDescriptors) grpc.UnaryServerInterceptor {
+	if descriptors == nil {
+		descriptors = DefaultGRPCDescriptors
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := this.checkCall(ctx, domain, descriptors(ctx, info.FullMethod)); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the UnaryServerInterceptor of the streams, checked once when they start.
+func (this *Client) StreamServerInterceptor(domain string, descriptors GRPCDescriptors) grpc.StreamServerInterceptor {
+	if descriptors == nil {
+		descriptors = DefaultGRPCDescriptors
+	}
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := this.checkCall(stream.Context(), domain, descriptors(stream.Context(), info.FullMethod)); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// checkCall returns the error of a limited call.
+func (this *Client) checkCall(ctx context.Context, domain string, descriptors []*pb_struct.RateLimitDescriptor) error {
+	if len(descriptors) == 0 {
+		return nil
+	}
+	allowed, response := this.decideMiddleware(ctx, NewRequest(domain, 1, descriptors...))
+	if headers := response.GetResponseHeadersToAdd(); len(headers) > 0 {
+		md := metadata.MD{}
+		for _, header := range headers {
+			md.Append(header.Key, header.Value)
+		}
+		// SetHeader only fails outside of a gRPC server, e.g. when the interceptor is called directly
+		_ = grpc.SetHeader(ctx, md)
+	}
+	if !allowed {
+		return status.Error(codes.ResourceExhausted, "rate limited")
+	}
+	return nil
+}
+
+// decideMiddleware is decide for the middleware and interceptors, passing the error to OnError.
+func (this *Client) decideMiddleware(ctx context.Context, request *pb.RateLimitRequest) (bool, *pb.RateLimitResponse) {
+	allowed, response, err := this.decide(ctx, request)
+	if err != nil && this.options.OnError != nil {
+		this.options.OnError(request, err)
+	}
+	return allowed, response
+}
+
+// retryAfterSeconds returns the seconds until the reset of the limits that were exceeded, rounded up,
+// 0 if unknown.
+func retryAfterSeconds(response *pb.RateLimitResponse) int64 {
+	var ret int64
+	for _, limitStatus := range response.GetStatuses() {
+		if limitStatus.Code != pb.RateLimitResponse_OVER_LIMIT || limitStatus.DurationUntilReset == nil {
+			continue
+		}
+		duration := limitStatus.DurationUntilReset.AsDuration()
+		seconds := int64(duration.Seconds())
+		if duration > 0 && duration%time.Second != 0 {
+			seconds++
+		}
+		ret = max(ret, seconds)
+	}
+	return ret
+}
+
+// remoteHost returns the host of an address, or the address if it has no port.
+func remoteHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -1,11 +1,15 @@
 package config
 
 import (
+	"time"
+
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"golang.org/x/net/context"
 
+	"github.com/envoyproxy/ratelimit/src/settings"
 	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/src/utils"
 )
 
 // Errors that may be raised during config parsing.
@@ -28,6 +32,169 @@ type RateLimit struct {
 	// ShareThresholdKeyPattern is a slice of wildcard patterns for descriptor entries
 	// The slice index corresponds to the descriptor entry index.
 	ShareThresholdKeyPattern []string
+	// KeySetKeys are the first keys of the key sets replacing the keys of the descriptor entries
+	// matched through another key of their set, by entry index, empty for the other entries.
+	KeySetKeys []string
+	// ValueNormalizers transform the values of the descriptor entries in the cache key, by entry
+	// index, nil for the entries whose values are kept.
+	ValueNormalizers []*ValueNormalizer
+	// Backend is the named Redis pool of the limit's domain, empty for the default pool.
+	Backend string
+	// Metadata is copied into the DynamicMetadata of the response when the limit applies.
+	Metadata map[string]string
+	// CacheKeyHash is the hash replacing the descriptor entries in the cache keys, empty to keep them.
+	CacheKeyHash string
+	// UnitMultiplier is the number of units of the window of the limit, 0 or 1 for a single unit.
+	UnitMultiplier uint32
+	// Quota is the long window limit checked along with the limit, nil for none.
+	Quota *RateLimit
+	// IsQuota is set on the quota of a limit, whose cache keys are distinct from those of the limit.
+	IsQuota bool
+	// Cost multiplies the hits addend of the requests matching the limit, 0 or 1 to count them once.
+	Cost uint32
+	// Schedules replace the limit during their windows of the week, the first one containing the
+	// time of the request applies.
+	Schedules []*Schedule
+	// ActiveSchedule is the name of the schedule whose limit applies, empty for the limit itself.
+	ActiveSchedule string
+	// Penalty places the descriptors over the limit too often in a penalty box, nil for none.
+	Penalty *Penalty
+	// ExpirationJitter overrides the maximum jitter added to the expiration of the cache keys of
+	// the limit, nil for the jitter of the settings.
+	ExpirationJitter *time.Duration
+	// RequestAligned starts the window of a descriptor at its first request instead of aligning it
+	// on the wall clock, so that the windows of the descriptors don't all reset at once.
+	RequestAligned bool
+	// CacheKeyVersion is added to the cache keys of the limit, so that changing it starts the counters
+	// over, empty for none.
+	CacheKeyVersion string
+	// LeakyBucket counts the limit in a leaky bucket draining RequestsPerUnit per window instead of
+	// a window counter, nil for a window counter.
+	LeakyBucket *LeakyBucket
+	// Concurrency caps the leases held at once on a descriptor instead of its rate, nil for a rate
+	// limit. The concurrency limits are not checked by ShouldRateLimit.
+	Concurrency *Concurrency
+	// Spillover are the shared pools admitting in turn the requests over the limit, the status of a
+	// descriptor admitted by a tier being the status of the tier.
+	Spillover []*RateLimit
+	// SpilloverKey is the descriptor entry whose value keys the pool of a spillover tier, empty for a
+	// pool shared by every descriptor.
+	SpilloverKey string
+	// SpillsOver is set on the limits whose requests over the limit are checked against a next
+	// spillover tier, unless in shadow mode. Their over limit is only recorded once no tier admits
+	// the request.
+	SpillsOver bool
+	// CarryOverPercent is the maximum of the requests left unused by a window which are admitted over
+	// the limit in the next window, in percent of the limit, 0 for none.
+	CarryOverPercent uint32
+	// ShardCount is the number of buckets the value of the last descriptor entry is hashed into in the
+	// cache key, each bucket being limited on its own, 0 to keep the value.
+	ShardCount uint32
+}
+
+// Concurrency admits a lease on a descriptor as long as fewer than MaxInFlight leases are held on
+// it, a lease expiring after LeaseTtl unless it is renewed or released before.
+type Concurrency struct {
+	MaxInFlight uint32
+	LeaseTtl    time.Duration
+}
+
+// LeakyBucket admits the requests as long as they fit in a bucket of BucketSize hits, which drains
+// at the rate of the limit, smoothing the requests instead of resetting a counter every window.
+type LeakyBucket struct {
+	BucketSize uint32
+}
+
+// Penalty rejects a descriptor for Duration once it was over the limit OverLimits times within
+// Window, whatever its counter.
+type Penalty struct {
+	OverLimits uint32
+	Window     time.Duration
+	Duration   time.Duration
+}
+
+// The hashes of the descriptor entries in the cache keys, CacheKeyHashNone keeps the entries of a
+// rule when a hash is configured globally.
+const (
+	CacheKeyHashNone   = "none"
+	CacheKeyHashXxhash = "xxhash"
+	CacheKeyHashSha256 = "sha256"
+)
+
+// CacheKeyVersionAuto versions the cache keys of a rule with the hash of its limit, so that changing
+// the limit, unit or unit_multiplier of the rule starts its counters over.
+const CacheKeyVersionAuto = "auto"
+
+// The alignments of the windows of a rule, WindowAlignmentClock by default.
+const (
+	WindowAlignmentClock   = "clock"
+	WindowAlignmentRequest = "request"
+)
+
+func IsValidCacheKeyHash(hash string) bool {
+	switch hash {
+	case "", CacheKeyHashNone, CacheKeyHashXxhash, CacheKeyHashSha256:
+		return true
+	}
+	return false
+}
+
+// DomainDump is the loaded descriptor tree of a domain, returned by RateLimitConfig.DumpTree.
+type DomainDump struct {
+	Domain      string            `json:"domain"`
+	Backend     string            `json:"backend,omitempty"`
+	Descriptors []*DescriptorDump `json:"descriptors,omitempty"`
+}
+
+type DescriptorDump struct {
+	Key         string            `json:"key"`
+	Keys        []string          `json:"keys,omitempty"`
+	Value       string            `json:"value,omitempty"`
+	Normalize   *ValueNormalizer  `json:"normalize,omitempty"`
+	RateLimit   *RateLimitDump    `json:"rate_limit,omitempty"`
+	Descriptors []*DescriptorDump `json:"descriptors,omitempty"`
+}
+
+type RateLimitDump struct {
+	RequestsPerUnit  uint32            `json:"requests_per_unit"`
+	Unit             string            `json:"unit"`
+	UnitMultiplier   uint32            `json:"unit_multiplier,omitempty"`
+	Unlimited        bool              `json:"unlimited"`
+	ShadowMode       bool              `json:"shadow_mode"`
+	Name             string            `json:"name,omitempty"`
+	Replaces         []string          `json:"replaces,omitempty"`
+	DetailedMetric   bool              `json:"detailed_metric"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	Quota            *RateLimitDump    `json:"quota,omitempty"`
+	Cost             uint32            `json:"cost,omitempty"`
+	Schedules        []*ScheduleDump   `json:"schedules,omitempty"`
+	Penalty          *PenaltyDump      `json:"penalty,omitempty"`
+	ExpirationJitter string            `json:"expiration_jitter,omitempty"`
+	RequestAligned   bool              `json:"request_aligned,omitempty"`
+	CacheKeyVersion  string            `json:"cache_key_version,omitempty"`
+	LeakyBucket      *LeakyBucketDump  `json:"leaky_bucket,omitempty"`
+	Concurrency      *ConcurrencyDump  `json:"concurrency,omitempty"`
+	Spillover        []*RateLimitDump  `json:"spillover,omitempty"`
+	SpilloverKey     string            `json:"spillover_key,omitempty"`
+	CarryOverPercent uint32            `json:"carry_over_percent,omitempty"`
+	ShardCount       uint32            `json:"shard_count,omitempty"`
+	// StatsKey is the prefix of the stats of the rule.
+	StatsKey string `json:"stats_key"`
+}
+
+type LeakyBucketDump struct {
+	BucketSize uint32 `json:"bucket_size"`
+}
+
+type ConcurrencyDump struct {
+	MaxInFlight uint32 `json:"max_in_flight"`
+	LeaseTtl    string `json:"lease_ttl"`
+}
+
+type PenaltyDump struct {
+	OverLimits uint32 `json:"over_limits"`
+	Window     string `json:"window"`
+	Duration   string `json:"duration"`
 }
 
 // Interface for interacting with a loaded rate limit config.
@@ -35,6 +202,9 @@ type RateLimitConfig interface {
 	// Dump the configuration into string form for debugging.
 	Dump() string
 
+	// DumpTree returns the loaded descriptor tree of each domain, sorted by domain and key.
+	DumpTree() []*DomainDump
+
 	// Get the configured limit for a rate limit descriptor.
 	// @param ctx supplies the calling context.
 	// @param domain supplies the domain to lookup the descriptor in.
@@ -46,12 +216,86 @@ type RateLimitConfig interface {
 	IsEmptyDomains() bool
 }
 
+// The policies of the domains defined by several config files: a load error, the descriptors of the
+// files merged into the domain, or the domain of the last file only.
+const (
+	DomainConflictError    = "error"
+	DomainConflictMerge    = "merge"
+	DomainConflictLastWins = "last_wins"
+)
+
+// IsDomainConflictPolicy returns whether policy is one of the policies of the domains defined by several files.
+func IsDomainConflictPolicy(policy string) bool {
+	return policy == DomainConflictError || policy == DomainConflictMerge || policy == DomainConflictLastWins
+}
+
 // Information for a config file to load into the aggregate config.
 type RateLimitConfigToLoad struct {
 	Name       string
 	ConfigYaml *YamlRoot
 }
 
+// LoaderOptions are the settings of the configurations created by a loader, passed explicitly rather
+// than read from the environment by the loader, see NewLoaderOptions.
+type LoaderOptions struct {
+	// DuplicateDomainPolicy is how a domain defined by several files is loaded, see DomainConflictError.
+	// Empty for the policy of the mergeDomainConfigs argument of Load.
+	DuplicateDomainPolicy string
+	// CacheKeyHash is the hash of the cache keys of the rules without cache_key_hash, see
+	// CacheKeyHashXxhash, empty to keep the descriptor entries.
+	CacheKeyHash string
+	// Strict rejects the config files with fields unknown at their level, duplicate fields or
+	// overlapping wildcard values.
+	Strict bool
+	// Backends are the names the domains can select with backend, nil to accept any name, e.g. for
+	// the backends routing the domains themselves.
+	Backends []string
+	// UnsupportedFields are the rate_limit fields the backend doesn't implement, e.g. leaky_bucket,
+	// whose rules are rejected.
+	UnsupportedFields []string
+	// TimeSource is the clock selecting the active schedules of the rate limits, nil for the system
+	// clock.
+	TimeSource utils.TimeSource
+}
+
+// NewLoaderOptions returns the loader options of the settings.
+func NewLoaderOptions(s settings.Settings) LoaderOptions {
+	return LoaderOptions{
+		DuplicateDomainPolicy: s.DuplicateDomainPolicy,
+		CacheKeyHash:          s.CacheKeyHash,
+		Strict:                s.ConfigStrict,
+		Backends:              backendNames(s),
+		UnsupportedFields:     unsupportedFields(s),
+		TimeSource:            utils.NewTimeSourceImpl(),
+	}
+}
+
+// unsupportedFields returns the rate_limit fields the builtin backend doesn't implement.
+func unsupportedFields(s settings.Settings) []string {
+	if s.BackendType == "memcache" {
+		return []string{"leaky_bucket", "carry_over_percent", "penalty"}
+	}
+	return nil
+}
+
+// backendNames returns the named pools of the builtin backends, nil for the other backends.
+func backendNames(s settings.Settings) []string {
+	switch s.BackendType {
+	case "redis", "":
+		// the invalid pools fail the creation of the backend
+		pools, _ := settings.ParseRedisPools(s.RedisPools)
+		names := make([]string, 0, len(pools))
+		for name := range pools {
+			names = append(names, name)
+		}
+		return names
+	case "memcache":
+		return []string{}
+	default:
+		return nil
+	}
+}
+
 // Interface for loading a configuration from a list of YAML files.
 type RateLimitConfigLoader interface {
 	// Load a new configuration from a list of YAML files.
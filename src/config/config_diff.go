@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigDiff is the difference between two configurations. The rules are the descriptors with a limit,
+// named by their path, e.g. domain.key_value.subkey.
+type ConfigDiff struct {
+	DomainsAdded   []string `json:"domains_added,omitempty"`
+	DomainsRemoved []string `json:"domains_removed,omitempty"`
+	RulesAdded     []string `json:"rules_added,omitempty"`
+	RulesRemoved   []string `json:"rules_removed,omitempty"`
+	// LimitsChanged are the rules whose requests per unit, unit or unlimited flag changed.
+	LimitsChanged []*LimitChange `json:"limits_changed,omitempty"`
+	// RulesChanged are the rules whose other settings changed, e.g. their shadow mode.
+	RulesChanged []string `json:"rules_changed,omitempty"`
+}
+
+type LimitChange struct {
+	Rule string `json:"rule"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DiffConfigs returns the difference from previous to next, sorted by domain and rule.
+// Either configuration may be nil.
+func DiffConfigs(previous RateLimitConfig, next RateLimitConfig) *ConfigDiff {
+	previousDomains, previousRules := flattenConfig(previous)
+	nextDomains, nextRules := flattenConfig(next)
+
+	ret := &ConfigDiff{}
+	for domain := range nextDomains {
+		if !previousDomains[domain] {
+			ret.DomainsAdded = append(ret.DomainsAdded, domain)
+		}
+	}
+	for domain := range previousDomains {
+		if !nextDomains[domain] {
+			ret.DomainsRemoved = append(ret.DomainsRemoved, domain)
+		}
+	}
+	for rule, limit := range nextRules {
+		previousLimit, ok := previousRules[rule]
+		switch {
+		case !ok:
+			ret.RulesAdded = append(ret.RulesAdded, rule)
+		case limitText(previousLimit) != limitText(limit):
+			ret.LimitsChanged = append(ret.LimitsChanged,
+				&LimitChange{Rule: rule, From: limitText(previousLimit), To: limitText(limit)})
+		case !reflect.DeepEqual(previousLimit, limit):
+			ret.RulesChanged = append(ret.RulesChanged, rule)
+		}
+	}
+	for rule := range previousRules {
+		if _, ok := nextRules[rule]; !ok {
+			ret.RulesRemoved = append(ret.RulesRemoved, rule)
+		}
+	}
+
+	sort.Strings(ret.DomainsAdded)
+	sort.Strings(ret.DomainsRemoved)
+	sort.Strings(ret.RulesAdded)
+	sort.Strings(ret.RulesRemoved)
+	sort.Strings(ret.RulesChanged)
+	sort.Slice(ret.LimitsChanged, func(i, j int) bool { return ret.LimitsChanged[i].Rule < ret.LimitsChanged[j].Rule })
+	return ret
+}
+
+// IsEmpty returns whether the configurations are the same.
+func (this *ConfigDiff) IsEmpty() bool {
+	return len(this.DomainsAdded) == 0 && len(this.DomainsRemoved) == 0 && len(this.RulesAdded) == 0 &&
+		len(this.RulesRemoved) == 0 && len(this.LimitsChanged) == 0 && len(this.RulesChanged) == 0
+}
+
+// flattenConfig returns the domains of a configuration and its limits by rule path.
+func flattenConfig(rlConfig RateLimitConfig) (map[string]bool, map[string]*RateLimitDump) {
+	domains := map[string]bool{}
+	rules := map[string]*RateLimitDump{}
+	if rlConfig == nil {
+		return domains, rules
+	}
+	for _, domain := range rlConfig.DumpTree() {
+		domains[domain.Domain] = true
+		flattenDescriptors(domain.Domain, domain.Descriptors, rules)
+	}
+	return domains, rules
+}
+
+func flattenDescriptors(path string, descriptors []*DescriptorDump, rules map[string]*RateLimitDump) {
+	for _, descriptor := range descriptors {
+		descriptorPath := path + "." + descriptor.Key
+		if descriptor.Value != "" {
+			descriptorPath += "_" + descriptor.Value
+		}
+		if descriptor.RateLimit != nil {
+			rules[descriptorPath] = descriptor.RateLimit
+		}
+		flattenDescriptors(descriptorPath, descriptor.Descriptors, rules)
+	}
+}
+
+// limitText is the short form of a limit, e.g. 10/minute or 5/2 second.
+func limitText(limit *RateLimitDump) string {
+	if limit.Unlimited {
+		return "unlimited"
+	}
+	unit := strings.ToLower(limit.Unit)
+	if limit.UnitMultiplier > 1 {
+		return fmt.Sprintf("%d/%d %s", limit.RequestsPerUnit, limit.UnitMultiplier, unit)
+	}
+	return fmt.Sprintf("%d/%s", limit.RequestsPerUnit, unit)
+}
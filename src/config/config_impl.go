@@ -2,8 +2,15 @@ package config
 
 import (
 	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	logger "github.com/sirupsen/logrus"
@@ -11,6 +18,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/src/utils"
 )
 
 type yamlReplaces struct {
@@ -20,28 +28,102 @@ type yamlReplaces struct {
 type YamlRateLimit struct {
 	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
 	Unit            string
-	Unlimited       bool `yaml:"unlimited"`
+	UnitMultiplier  uint32 `yaml:"unit_multiplier"`
+	Unlimited       bool   `yaml:"unlimited"`
 	Name            string
 	Replaces        []yamlReplaces
+	Metadata        map[string]string
+	Quota           *YamlQuota
+	Cost            uint32
+	Schedules       []YamlSchedule
+	Penalty         *YamlPenalty
+	// ExpirationJitter overrides the maximum jitter added to the expiration of the cache keys.
+	ExpirationJitter string `yaml:"expiration_jitter"`
+	// WindowAlignment starts the windows on the wall clock, "clock", or at the first request, "request".
+	WindowAlignment string `yaml:"window_alignment"`
+	// CacheKeyVersion is added to the cache keys, "auto" for the hash of the limit.
+	CacheKeyVersion string           `yaml:"cache_key_version"`
+	LeakyBucket     *YamlLeakyBucket `yaml:"leaky_bucket"`
+	Concurrency     *YamlConcurrency `yaml:"concurrency"`
+	Spillover       []YamlSpillover
+	// CarryOverPercent is the maximum of the unused requests of a window carried over to the next one,
+	// in percent of requests_per_unit.
+	CarryOverPercent uint32 `yaml:"carry_over_percent"`
+	// ShardCount is the number of buckets the values of the descriptor are hashed into, each one
+	// limited on its own, 0 to limit each value.
+	ShardCount uint32 `yaml:"shard_count"`
+}
+
+// YamlSpillover is a shared pool admitting the requests over the limit of its rate_limit.
+type YamlSpillover struct {
+	Name string
+	// Key is the descriptor entry whose value keys the pool, empty for a single pool.
+	Key             string
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+	Unit            string
+	UnitMultiplier  uint32 `yaml:"unit_multiplier"`
+}
+
+// YamlConcurrency caps the leases held at once on the descriptors of a rate_limit, instead of their rate.
+type YamlConcurrency struct {
+	MaxInFlight uint32 `yaml:"max_in_flight"`
+	// LeaseTtl is the duration after which a lease which is neither renewed nor released expires.
+	LeaseTtl string `yaml:"lease_ttl"`
+}
+
+// YamlLeakyBucket counts a rate_limit in a leaky bucket draining requests_per_unit per unit.
+type YamlLeakyBucket struct {
+	// BucketSize is the capacity of the bucket, requests_per_unit by default.
+	BucketSize uint32 `yaml:"bucket_size"`
+}
+
+// YamlPenalty places the descriptors of a rate_limit in a penalty box after repeated over-limits.
+type YamlPenalty struct {
+	OverLimits uint32 `yaml:"over_limits"`
+	Window     string
+	Duration   string
+}
+
+// YamlQuota is a long window limit checked along with the rate of its rate_limit.
+type YamlQuota struct {
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+	Unit            string
+	UnitMultiplier  uint32 `yaml:"unit_multiplier"`
 }
 
 type YamlDescriptor struct {
-	Key            string
+	Key string
+	// Keys is the key set of a descriptor matching any of its keys, instead of Key.
+	Keys           []string
 	Value          string
 	RateLimit      *YamlRateLimit `yaml:"rate_limit"`
 	Descriptors    []YamlDescriptor
-	ShadowMode     bool `yaml:"shadow_mode"`
-	DetailedMetric bool `yaml:"detailed_metric"`
-	ValueToMetric  bool `yaml:"value_to_metric"`
-	ShareThreshold bool `yaml:"share_threshold"`
+	ShadowMode     bool   `yaml:"shadow_mode"`
+	DetailedMetric bool   `yaml:"detailed_metric"`
+	ValueToMetric  bool   `yaml:"value_to_metric"`
+	ShareThreshold bool   `yaml:"share_threshold"`
+	CacheKeyHash   string `yaml:"cache_key_hash"`
+	Normalize      *YamlNormalize
+	// Include is the name of the template replacing the descriptor, which has no other field.
+	Include string
 }
 
 type YamlRoot struct {
 	Domain      string
+	Backend     string
 	Descriptors []YamlDescriptor
+	// Templates are the lists of descriptors included by name in the descriptors of any config file.
+	Templates map[string][]YamlDescriptor
 }
 
 type rateLimitDescriptor struct {
+	// key is the first key of a key set, which is also found by its other keys.
+	key string
+	// keys is the key set of the descriptor, nil for a single key.
+	keys []string
+	// normalizer transforms the values of the entries matching the descriptor in the cache keys.
+	normalizer      *ValueNormalizer
+	value           string
 	descriptors     map[string]*rateLimitDescriptor
 	limit           *RateLimit
 	wildcardKeys    []string
@@ -52,29 +134,93 @@ type rateLimitDescriptor struct {
 
 type rateLimitDomain struct {
 	rateLimitDescriptor
+	backend string
 }
 
 type rateLimitConfigImpl struct {
-	domains            map[string]*rateLimitDomain
-	statsManager       stats.Manager
-	mergeDomainConfigs bool
+	domains      map[string]*rateLimitDomain
+	statsManager stats.Manager
+	// domainConflictPolicy is how a domain defined by several files is loaded, see DomainConflictError.
+	domainConflictPolicy string
+	// domainFiles are the files defining each domain.
+	domainFiles map[string][]string
+	// cacheKeyHash is the hash of the cache keys of the rules without cache_key_hash
+	cacheKeyHash string
+	// backends are the names the domains can select, nil for any name.
+	backends []string
+	// unsupportedFields are the rate_limit fields the backend doesn't implement.
+	unsupportedFields []string
+	// timeSource selects the active schedules of the rate limits.
+	timeSource utils.TimeSource
+	// negativeLookups holds the keys of the descriptors without limit, up to maxNegativeLookups.
+	negativeLookups     sync.Map
+	negativeLookupCount atomic.Int64
 }
 
+// maxNegativeLookups bounds the descriptors without limit remembered by a configuration.
+const maxNegativeLookups = 10000
+
 var validKeys = map[string]bool{
-	"domain":            true,
-	"key":               true,
-	"value":             true,
-	"descriptors":       true,
-	"rate_limit":        true,
-	"unit":              true,
-	"requests_per_unit": true,
-	"unlimited":         true,
-	"shadow_mode":       true,
-	"name":              true,
-	"replaces":          true,
-	"detailed_metric":   true,
-	"value_to_metric":   true,
-	"share_threshold":   true,
+	"domain":             true,
+	"key":                true,
+	"keys":               true,
+	"normalize":          true,
+	"lowercase":          true,
+	"trim":               true,
+	"ipv4_prefix":        true,
+	"ipv6_prefix":        true,
+	"value":              true,
+	"descriptors":        true,
+	"rate_limit":         true,
+	"unit":               true,
+	"requests_per_unit":  true,
+	"unlimited":          true,
+	"shadow_mode":        true,
+	"name":               true,
+	"replaces":           true,
+	"detailed_metric":    true,
+	"value_to_metric":    true,
+	"share_threshold":    true,
+	"backend":            true,
+	"metadata":           true,
+	"unit_multiplier":    true,
+	"cache_key_hash":     true,
+	"quota":              true,
+	"cost":               true,
+	"schedules":          true,
+	"days":               true,
+	"start":              true,
+	"end":                true,
+	"timezone":           true,
+	"penalty":            true,
+	"expiration_jitter":  true,
+	"window_alignment":   true,
+	"cache_key_version":  true,
+	"leaky_bucket":       true,
+	"bucket_size":        true,
+	"concurrency":        true,
+	"max_in_flight":      true,
+	"lease_ttl":          true,
+	"spillover":          true,
+	"carry_over_percent": true,
+	"shard_count":        true,
+	"over_limits":        true,
+	"window":             true,
+	"duration":           true,
+	"templates":          true,
+	"include":            true,
+}
+
+// keyLevels restricts the keys valid at a single level to the key of their parent map, "" being the
+// root of a file.
+var keyLevels = map[string]string{
+	"backend":   "",
+	"metadata":  "rate_limit",
+	"schedules": "rate_limit",
+	"days":      "schedules",
+	"start":     "schedules",
+	"end":       "schedules",
+	"timezone":  "schedules",
 }
 
 // Create a new rate limit config entry.
@@ -103,6 +249,132 @@ func NewRateLimit(requestsPerUnit uint32, unit pb.RateLimitResponse_RateLimit_Un
 	}
 }
 
+// reportedUnits are the units a window can be reported in, by increasing duration.
+var reportedUnits = []pb.RateLimitResponse_RateLimit_Unit{
+	pb.RateLimitResponse_RateLimit_SECOND,
+	pb.RateLimitResponse_RateLimit_MINUTE,
+	pb.RateLimitResponse_RateLimit_HOUR,
+	pb.RateLimitResponse_RateLimit_DAY,
+	pb.RateLimitResponse_RateLimit_WEEK,
+	pb.RateLimitResponse_RateLimit_MONTH,
+	pb.RateLimitResponse_RateLimit_YEAR,
+}
+
+// CurrentLimit returns the limit reported in the statuses of the limit, over the window of its
+// unit_multiplier: the window of several units is reported in the shortest unit at least as long,
+// e.g. 60 seconds in a minute and 5 minutes in an hour, so that the clients pacing their requests
+// on the reported limit stay within the limit.
+func (this *RateLimit) CurrentLimit() *pb.RateLimitResponse_RateLimit {
+	if this.UnitMultiplier <= 1 {
+		return this.Limit
+	}
+	window := utils.UnitToDividerWithMultiplier(this.Limit.Unit, this.UnitMultiplier)
+	unit := pb.RateLimitResponse_RateLimit_YEAR
+	for _, reportedUnit := range reportedUnits {
+		if utils.UnitToDivider(reportedUnit) >= window {
+			unit = reportedUnit
+			break
+		}
+	}
+	return &pb.RateLimitResponse_RateLimit{
+		Name:            this.Limit.Name,
+		RequestsPerUnit: this.Limit.RequestsPerUnit,
+		Unit:            unit,
+	}
+}
+
+// newQuota creates the quota of a rate limit, which shares the shadow mode, metadata, cache key
+// hash and cost of the rate limit.
+func newQuota(config RateLimitConfigToLoad, quotaConfig *YamlQuota, rateLimit *RateLimit, quotaStats stats.RateLimitStats) *RateLimit {
+	value, present := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(quotaConfig.Unit)]
+	if !present || value == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
+		panic(newRateLimitConfigError(
+			config.Name,
+			fmt.Sprintf("invalid quota unit '%s'", quotaConfig.Unit)))
+	}
+
+	quota := NewRateLimit(quotaConfig.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(value), quotaStats, false,
+		rateLimit.ShadowMode, "", nil, false)
+	quota.IsQuota = true
+	quota.Metadata = rateLimit.Metadata
+	quota.CacheKeyHash = rateLimit.CacheKeyHash
+	quota.Cost = rateLimit.Cost
+	if quotaConfig.UnitMultiplier > 1 {
+		quota.UnitMultiplier = quotaConfig.UnitMultiplier
+	}
+	return quota
+}
+
+// SpilloverDescriptorKey is the key of the first entry of the descriptors of the spillover tiers,
+// whose value is the name of the tier. It is reserved, the descriptors can't use it.
+const SpilloverDescriptorKey = "ratelimit.spillover"
+
+// newSpillover creates a spillover tier of a rate limit, which shares the shadow mode, metadata and
+// cost of the rate limit. The tiers of the same name share their counters and stats.
+func newSpillover(config RateLimitConfigToLoad, spilloverConfig YamlSpillover, rateLimit *RateLimit,
+	statsManager stats.Manager,
+) *RateLimit {
+	if spilloverConfig.Name == "" {
+		panic(newRateLimitConfigError(config.Name, "spillover name should not be empty"))
+	}
+	if spilloverConfig.RequestsPerUnit == 0 {
+		panic(newRateLimitConfigError(config.Name,
+			fmt.Sprintf("spillover '%s' should not specify requests_per_unit 0", spilloverConfig.Name)))
+	}
+	value, present := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(spilloverConfig.Unit)]
+	if !present || value == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
+		panic(newRateLimitConfigError(
+			config.Name,
+			fmt.Sprintf("invalid spillover unit '%s'", spilloverConfig.Unit)))
+	}
+
+	tier := NewRateLimit(spilloverConfig.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(value),
+		statsManager.NewStats(config.ConfigYaml.Domain+".spillover."+spilloverConfig.Name), false,
+		rateLimit.ShadowMode, spilloverConfig.Name, nil, false)
+	tier.SpilloverKey = spilloverConfig.Key
+	tier.Metadata = rateLimit.Metadata
+	tier.Cost = rateLimit.Cost
+	if spilloverConfig.UnitMultiplier > 1 {
+		tier.UnitMultiplier = spilloverConfig.UnitMultiplier
+	}
+	return tier
+}
+
+// newCacheKeyVersion validates the cache key version of a rate limit, "auto" being replaced by the
+// hash of the limit.
+func newCacheKeyVersion(config RateLimitConfigToLoad, version string, rateLimit *RateLimit) string {
+	if version == CacheKeyVersionAuto {
+		hash := xxhash.Sum64String(fmt.Sprintf("%d/%s/%d", rateLimit.Limit.RequestsPerUnit, rateLimit.Limit.Unit,
+			max(rateLimit.UnitMultiplier, 1)))
+		return fmt.Sprintf("%08x", uint32(hash))
+	}
+	for _, c := range version {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			panic(newRateLimitConfigError(
+				config.Name, fmt.Sprintf("invalid cache_key_version '%s', only letters, digits, '.' and '-'", version)))
+		}
+	}
+	return version
+}
+
+// newPenalty validates the penalty of a rate limit.
+func newPenalty(config RateLimitConfigToLoad, penaltyConfig *YamlPenalty) *Penalty {
+	if penaltyConfig.OverLimits == 0 {
+		panic(newRateLimitConfigError(config.Name, "penalty over_limits must be positive"))
+	}
+	window, err := time.ParseDuration(penaltyConfig.Window)
+	if err != nil || window < time.Second {
+		panic(newRateLimitConfigError(
+			config.Name, fmt.Sprintf("invalid penalty window '%s', at least 1s", penaltyConfig.Window)))
+	}
+	duration, err := time.ParseDuration(penaltyConfig.Duration)
+	if err != nil || duration < time.Second {
+		panic(newRateLimitConfigError(
+			config.Name, fmt.Sprintf("invalid penalty duration '%s', at least 1s", penaltyConfig.Duration)))
+	}
+	return &Penalty{OverLimits: penaltyConfig.OverLimits, Window: window, Duration: duration}
+}
+
 // Dump an individual descriptor for debugging purposes.
 func (this *rateLimitDescriptor) dump() string {
 	ret := ""
@@ -111,8 +383,89 @@ func (this *rateLimitDescriptor) dump() string {
 			"%s: unit=%s requests_per_unit=%d, shadow_mode: %t\n", this.limit.FullKey,
 			this.limit.Limit.Unit.String(), this.limit.Limit.RequestsPerUnit, this.limit.ShadowMode)
 	}
-	for _, descriptor := range this.descriptors {
-		ret += descriptor.dump()
+	for finalKey, descriptor := range this.descriptors {
+		if !descriptor.isAlias(finalKey) {
+			ret += descriptor.dump()
+		}
+	}
+	return ret
+}
+
+// NewRateLimitDump returns the debugging form of a limit.
+func NewRateLimitDump(limit *RateLimit) *RateLimitDump {
+	ret := &RateLimitDump{
+		RequestsPerUnit:  limit.Limit.RequestsPerUnit,
+		Unit:             limit.Limit.Unit.String(),
+		UnitMultiplier:   limit.UnitMultiplier,
+		Unlimited:        limit.Unlimited,
+		ShadowMode:       limit.ShadowMode,
+		Name:             limit.Name,
+		Replaces:         limit.Replaces,
+		DetailedMetric:   limit.DetailedMetric,
+		Metadata:         limit.Metadata,
+		StatsKey:         limit.FullKey,
+		Cost:             limit.Cost,
+		RequestAligned:   limit.RequestAligned,
+		CacheKeyVersion:  limit.CacheKeyVersion,
+		SpilloverKey:     limit.SpilloverKey,
+		CarryOverPercent: limit.CarryOverPercent,
+		ShardCount:       limit.ShardCount,
+	}
+	if limit.Quota != nil {
+		ret.Quota = NewRateLimitDump(limit.Quota)
+	}
+	for _, schedule := range limit.Schedules {
+		ret.Schedules = append(ret.Schedules, newScheduleDump(schedule))
+	}
+	if limit.Penalty != nil {
+		ret.Penalty = &PenaltyDump{
+			OverLimits: limit.Penalty.OverLimits,
+			Window:     limit.Penalty.Window.String(),
+			Duration:   limit.Penalty.Duration.String(),
+		}
+	}
+	if limit.ExpirationJitter != nil {
+		ret.ExpirationJitter = limit.ExpirationJitter.String()
+	}
+	if limit.LeakyBucket != nil {
+		ret.LeakyBucket = &LeakyBucketDump{BucketSize: limit.LeakyBucket.BucketSize}
+	}
+	for _, tier := range limit.Spillover {
+		ret.Spillover = append(ret.Spillover, NewRateLimitDump(tier))
+	}
+	if limit.Concurrency != nil {
+		ret.Concurrency = &ConcurrencyDump{
+			MaxInFlight: limit.Concurrency.MaxInFlight,
+			LeaseTtl:    limit.Concurrency.LeaseTtl.String(),
+		}
+	}
+	return ret
+}
+
+// dumpTree returns the child descriptors sorted by composite key.
+func (this *rateLimitDescriptor) dumpTree() []*DescriptorDump {
+	keys := make([]string, 0, len(this.descriptors))
+	for key, descriptor := range this.descriptors {
+		if !descriptor.isAlias(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var ret []*DescriptorDump
+	for _, key := range keys {
+		descriptor := this.descriptors[key]
+		dump := &DescriptorDump{
+			Key:         descriptor.key,
+			Keys:        descriptor.keys,
+			Value:       descriptor.value,
+			Normalize:   descriptor.normalizer,
+			Descriptors: descriptor.dumpTree(),
+		}
+		if descriptor.limit != nil {
+			dump.RateLimit = NewRateLimitDump(descriptor.limit)
+		}
+		ret = append(ret, dump)
 	}
 	return ret
 }
@@ -129,22 +482,27 @@ func newRateLimitConfigError(name string, err string) RateLimitConfigError {
 // @param parentKey supplies the fully resolved key name that owns this config level.
 // @param descriptors supplies the YAML descriptors to load.
 // @param statsManager that owns the stats.Scope.
-func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, parentKey string, descriptors []YamlDescriptor, statsManager stats.Manager) {
+func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, parentKey string, descriptors []YamlDescriptor, statsManager stats.Manager, defaultCacheKeyHash string) {
 	for _, descriptorConfig := range descriptors {
-		if descriptorConfig.Key == "" {
-			panic(newRateLimitConfigError(config.Name, "descriptor has empty key"))
-		}
+		keys := loadKeySet(config, descriptorConfig)
 
 		// Value is optional, so the final key for the map is either the key only or key_value.
-		finalKey := descriptorConfig.Key
-		if descriptorConfig.Value != "" {
-			finalKey += "_" + descriptorConfig.Value
+		finalKeys := make([]string, len(keys))
+		for i, key := range keys {
+			finalKeys[i] = key
+			if descriptorConfig.Value != "" {
+				finalKeys[i] += "_" + descriptorConfig.Value
+			}
 		}
+		// the descriptors of a key set are named by their first key
+		finalKey := finalKeys[0]
 
 		newParentKey := parentKey + finalKey
-		if _, present := this.descriptors[finalKey]; present {
-			panic(newRateLimitConfigError(
-				config.Name, fmt.Sprintf("duplicate descriptor composite key '%s'", newParentKey)))
+		for _, key := range finalKeys {
+			if _, present := this.descriptors[key]; present {
+				panic(newRateLimitConfigError(
+					config.Name, fmt.Sprintf("duplicate descriptor composite key '%s'", parentKey+key)))
+			}
 		}
 
 		var rateLimit *RateLimit = nil
@@ -155,13 +513,35 @@ func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, p
 			value, present := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(descriptorConfig.RateLimit.Unit)]
 			validUnit := present && value != int32(pb.RateLimitResponse_RateLimit_UNKNOWN)
 
+			concurrency := descriptorConfig.RateLimit.Concurrency
+			if concurrency != nil {
+				if unlimited || validUnit || descriptorConfig.RateLimit.RequestsPerUnit != 0 {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify a rate with concurrency"))
+				}
+				if descriptorConfig.RateLimit.Quota != nil || len(descriptorConfig.RateLimit.Schedules) > 0 ||
+					descriptorConfig.RateLimit.Penalty != nil || descriptorConfig.RateLimit.LeakyBucket != nil ||
+					descriptorConfig.RateLimit.WindowAlignment != "" || len(descriptorConfig.RateLimit.Spillover) > 0 ||
+					descriptorConfig.RateLimit.CarryOverPercent != 0 {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify quota, schedules, penalty, leaky_bucket, window_alignment, spillover or carry_over_percent with concurrency"))
+				}
+				if concurrency.MaxInFlight == 0 {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"concurrency max_in_flight should be positive"))
+				}
+			}
+
 			if unlimited {
 				if validUnit {
 					panic(newRateLimitConfigError(
 						config.Name,
 						"should not specify rate limit unit when unlimited"))
 				}
-			} else if !validUnit {
+			} else if !validUnit && concurrency == nil {
 				panic(newRateLimitConfigError(
 					config.Name,
 					fmt.Sprintf("invalid rate limit unit '%s'", descriptorConfig.RateLimit.Unit)))
@@ -174,12 +554,189 @@ func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, p
 
 			rateLimit = NewRateLimit(
 				descriptorConfig.RateLimit.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(value),
-				statsManager.NewStats(newParentKey), unlimited, descriptorConfig.ShadowMode,
+				statsManager.NewStatsWithRollups(config.ConfigYaml.Domain, newParentKey), unlimited, descriptorConfig.ShadowMode,
 				descriptorConfig.RateLimit.Name, replaces, descriptorConfig.DetailedMetric,
 			)
+			rateLimit.Metadata = descriptorConfig.RateLimit.Metadata
+			if descriptorConfig.RateLimit.UnitMultiplier > 1 {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify unit_multiplier when unlimited"))
+				}
+				rateLimit.UnitMultiplier = descriptorConfig.RateLimit.UnitMultiplier
+			}
+			if descriptorConfig.RateLimit.Cost > 1 {
+				rateLimit.Cost = descriptorConfig.RateLimit.Cost
+			}
+			rateLimit.CacheKeyHash = defaultCacheKeyHash
+			if descriptorConfig.CacheKeyHash != "" {
+				rateLimit.CacheKeyHash = descriptorConfig.CacheKeyHash
+			}
+			if !IsValidCacheKeyHash(rateLimit.CacheKeyHash) {
+				panic(newRateLimitConfigError(
+					config.Name, fmt.Sprintf("invalid cache_key_hash '%s'", rateLimit.CacheKeyHash)))
+			}
+			if rateLimit.CacheKeyHash == CacheKeyHashNone {
+				rateLimit.CacheKeyHash = ""
+			}
+			if descriptorConfig.RateLimit.Quota != nil {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify quota when unlimited"))
+				}
+				rateLimit.Quota = newQuota(config, descriptorConfig.RateLimit.Quota, rateLimit, statsManager.NewStats(newParentKey+".quota"))
+			}
+			for _, spilloverConfig := range descriptorConfig.RateLimit.Spillover {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify spillover when unlimited"))
+				}
+				// the penalty of the requests over the limit would be recorded before a tier admits them
+				if descriptorConfig.RateLimit.Penalty != nil {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify penalty with spillover"))
+				}
+				rateLimit.Spillover = append(rateLimit.Spillover, newSpillover(config, spilloverConfig, rateLimit, statsManager))
+			}
+			// every limit but the last tier spills over to a next tier, the limits in shadow mode
+			// admitting the requests over the limit themselves
+			if len(rateLimit.Spillover) > 0 && !rateLimit.ShadowMode {
+				rateLimit.SpillsOver = true
+				for _, tier := range rateLimit.Spillover[:len(rateLimit.Spillover)-1] {
+					tier.SpillsOver = true
+				}
+			}
+			scheduleNames := map[string]bool{}
+			for _, scheduleConfig := range descriptorConfig.RateLimit.Schedules {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify schedules when unlimited"))
+				}
+				if scheduleNames[scheduleConfig.Name] {
+					panic(newRateLimitConfigError(
+						config.Name, fmt.Sprintf("duplicate schedule '%s'", scheduleConfig.Name)))
+				}
+				scheduleNames[scheduleConfig.Name] = true
+				rateLimit.Schedules = append(rateLimit.Schedules, newSchedule(config, scheduleConfig, rateLimit))
+			}
+			if descriptorConfig.RateLimit.Penalty != nil {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify penalty when unlimited"))
+				}
+				rateLimit.Penalty = newPenalty(config, descriptorConfig.RateLimit.Penalty)
+			}
+			if descriptorConfig.RateLimit.ExpirationJitter != "" {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify expiration_jitter when unlimited"))
+				}
+				jitter, err := time.ParseDuration(descriptorConfig.RateLimit.ExpirationJitter)
+				if err != nil || jitter < 0 {
+					panic(newRateLimitConfigError(
+						config.Name, fmt.Sprintf("invalid expiration_jitter '%s'", descriptorConfig.RateLimit.ExpirationJitter)))
+				}
+				rateLimit.ExpirationJitter = &jitter
+			}
+			switch descriptorConfig.RateLimit.WindowAlignment {
+			case "", WindowAlignmentClock:
+			case WindowAlignmentRequest:
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify window_alignment when unlimited"))
+				}
+				rateLimit.RequestAligned = true
+			default:
+				panic(newRateLimitConfigError(
+					config.Name, fmt.Sprintf("invalid window_alignment '%s'", descriptorConfig.RateLimit.WindowAlignment)))
+			}
+			if version := descriptorConfig.RateLimit.CacheKeyVersion; version != "" {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify cache_key_version when unlimited"))
+				}
+				rateLimit.CacheKeyVersion = newCacheKeyVersion(config, version, rateLimit)
+				if rateLimit.Quota != nil {
+					rateLimit.Quota.CacheKeyVersion = newCacheKeyVersion(config, version, rateLimit.Quota)
+				}
+			}
+			if descriptorConfig.RateLimit.LeakyBucket != nil {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify leaky_bucket when unlimited"))
+				}
+				if rateLimit.RequestAligned {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify window_alignment with leaky_bucket"))
+				}
+				// an empty bucket never drains
+				if rateLimit.Limit.RequestsPerUnit == 0 {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify leaky_bucket with requests_per_unit 0"))
+				}
+				for _, schedule := range rateLimit.Schedules {
+					if schedule.Limit.RequestsPerUnit == 0 {
+						panic(newRateLimitConfigError(
+							config.Name,
+							fmt.Sprintf("should not specify leaky_bucket with requests_per_unit 0 in schedule '%s'", schedule.Name)))
+					}
+				}
+				rateLimit.LeakyBucket = &LeakyBucket{BucketSize: descriptorConfig.RateLimit.LeakyBucket.BucketSize}
+				if rateLimit.LeakyBucket.BucketSize == 0 {
+					rateLimit.LeakyBucket.BucketSize = rateLimit.Limit.RequestsPerUnit
+				}
+			}
+			if carryOverPercent := descriptorConfig.RateLimit.CarryOverPercent; carryOverPercent != 0 {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify carry_over_percent when unlimited"))
+				}
+				if rateLimit.RequestAligned || rateLimit.LeakyBucket != nil {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify carry_over_percent with window_alignment request or leaky_bucket"))
+				}
+				if carryOverPercent > 100 {
+					panic(newRateLimitConfigError(
+						config.Name, fmt.Sprintf("invalid carry_over_percent %d, should be at most 100", carryOverPercent)))
+				}
+				rateLimit.CarryOverPercent = carryOverPercent
+			}
+			if shardCount := descriptorConfig.RateLimit.ShardCount; shardCount != 0 {
+				if unlimited {
+					panic(newRateLimitConfigError(
+						config.Name,
+						"should not specify shard_count when unlimited"))
+				}
+				rateLimit.ShardCount = shardCount
+				if rateLimit.Quota != nil {
+					rateLimit.Quota.ShardCount = shardCount
+				}
+			}
+			if concurrency != nil {
+				leaseTtl, err := time.ParseDuration(concurrency.LeaseTtl)
+				if err != nil || leaseTtl <= 0 {
+					panic(newRateLimitConfigError(
+						config.Name, fmt.Sprintf("invalid concurrency lease_ttl '%s'", concurrency.LeaseTtl)))
+				}
+				rateLimit.Concurrency = &Concurrency{MaxInFlight: concurrency.MaxInFlight, LeaseTtl: leaseTtl}
+			}
 			rateLimitDebugString = fmt.Sprintf(
-				" ratelimit={requests_per_unit=%d, unit=%s, unlimited=%t, shadow_mode=%t}", rateLimit.Limit.RequestsPerUnit,
-				rateLimit.Limit.Unit.String(), rateLimit.Unlimited, rateLimit.ShadowMode)
+				" ratelimit={requests_per_unit=%d, unit=%s, unit_multiplier=%d, unlimited=%t, shadow_mode=%t}", rateLimit.Limit.RequestsPerUnit,
+				rateLimit.Limit.Unit.String(), rateLimit.UnitMultiplier, rateLimit.Unlimited, rateLimit.ShadowMode)
 
 			for _, replaces := range descriptorConfig.RateLimit.Replaces {
 				if replaces.Name == "" {
@@ -208,12 +765,16 @@ func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, p
 
 		// Preload keys ending with "*" symbol.
 		if finalKey[len(finalKey)-1:] == "*" {
-			this.wildcardKeys = append(this.wildcardKeys, finalKey)
+			this.wildcardKeys = append(this.wildcardKeys, finalKeys...)
 		}
 
 		logger.Debugf(
 			"loading descriptor: key=%s%s", newParentKey, rateLimitDebugString)
 		newDescriptor := &rateLimitDescriptor{
+			key:             keys[0],
+			keys:            descriptorConfig.Keys,
+			normalizer:      newValueNormalizer(config, descriptorConfig.Normalize),
+			value:           descriptorConfig.Value,
 			descriptors:     map[string]*rateLimitDescriptor{},
 			limit:           rateLimit,
 			wildcardKeys:    nil,
@@ -221,15 +782,70 @@ func (this *rateLimitDescriptor) loadDescriptors(config RateLimitConfigToLoad, p
 			shareThreshold:  descriptorConfig.ShareThreshold,
 			wildcardPattern: wildcardPattern,
 		}
-		newDescriptor.loadDescriptors(config, newParentKey+".", descriptorConfig.Descriptors, statsManager)
-		this.descriptors[finalKey] = newDescriptor
+		newDescriptor.loadDescriptors(config, newParentKey+".", descriptorConfig.Descriptors, statsManager, defaultCacheKeyHash)
+		for _, key := range finalKeys {
+			this.descriptors[key] = newDescriptor
+		}
+	}
+}
+
+// loadKeySet returns the keys matched by a descriptor, its key or the keys of its key set.
+// @throws RateLimitConfigError if the descriptor has no key, both a key and a key set, or a duplicate key.
+func loadKeySet(config RateLimitConfigToLoad, descriptorConfig YamlDescriptor) []string {
+	if descriptorConfig.Key == SpilloverDescriptorKey {
+		panic(newRateLimitConfigError(config.Name, fmt.Sprintf("descriptor key '%s' is reserved", SpilloverDescriptorKey)))
+	}
+	if len(descriptorConfig.Keys) == 0 {
+		if descriptorConfig.Key == "" {
+			panic(newRateLimitConfigError(config.Name, "descriptor has empty key"))
+		}
+		return []string{descriptorConfig.Key}
+	}
+	if descriptorConfig.Key != "" {
+		panic(newRateLimitConfigError(config.Name, fmt.Sprintf("descriptor '%s' should not specify both key and keys", descriptorConfig.Key)))
+	}
+	seen := make(map[string]bool, len(descriptorConfig.Keys))
+	for _, key := range descriptorConfig.Keys {
+		if key == "" {
+			panic(newRateLimitConfigError(config.Name, "descriptor has empty key in keys"))
+		}
+		if key == SpilloverDescriptorKey {
+			panic(newRateLimitConfigError(config.Name, fmt.Sprintf("descriptor key '%s' is reserved", SpilloverDescriptorKey)))
+		}
+		if seen[key] {
+			panic(newRateLimitConfigError(config.Name, fmt.Sprintf("duplicate key '%s' in keys", key)))
+		}
+		seen[key] = true
+	}
+	return descriptorConfig.Keys
+}
+
+// isAlias returns whether the descriptor is found by finalKey through another key of its key set.
+func (this *rateLimitDescriptor) isAlias(finalKey string) bool {
+	if this.value == "" {
+		return finalKey != this.key
+	}
+	return finalKey != this.key+"_"+this.value
+}
+
+// Validate the keys of a key set, a list of strings.
+func validateYamlKeySet(fileName string, keys interface{}) {
+	list, ok := keys.([]interface{})
+	if !ok {
+		panic(newRateLimitConfigError(fileName, "config error, keys must be a list"))
+	}
+	for _, key := range list {
+		if _, ok := key.(string); !ok {
+			panic(newRateLimitConfigError(fileName, fmt.Sprintf("config error, key of keys is not of type string: %v", key)))
+		}
 	}
 }
 
 // Validate a YAML config file's keys.
 // @param config specifies the file contents to load.
+// @param parent specifies the key of the map, "" for the root of a file.
 // @param any specifies the yaml file and a map.
-func validateYamlKeys(fileName string, config_map map[interface{}]interface{}) {
+func validateYamlKeys(fileName string, parent string, config_map map[interface{}]interface{}) {
 	for k, v := range config_map {
 		if _, ok := k.(string); !ok {
 			errorText := fmt.Sprintf("config error, key is not of type string: %v", k)
@@ -241,6 +857,29 @@ func validateYamlKeys(fileName string, config_map map[interface{}]interface{}) {
 			logger.Debugf(errorText)
 			panic(newRateLimitConfigError(fileName, errorText))
 		}
+		if level, ok := keyLevels[k.(string)]; ok && level != parent {
+			errorText := fmt.Sprintf("config error, key '%s' is only valid in '%s'", k, level)
+			if level == "" {
+				errorText = fmt.Sprintf("config error, key '%s' is only valid at the root of the file", k)
+			}
+			logger.Debugf(errorText)
+			panic(newRateLimitConfigError(fileName, errorText))
+		}
+		// the keys of the metadata are free-form
+		if k.(string) == "metadata" {
+			validateYamlMetadata(fileName, v)
+			continue
+		}
+		// the keys of a key set are a list of strings
+		if k.(string) == "keys" {
+			validateYamlKeySet(fileName, v)
+			continue
+		}
+		// the names of the templates are free-form
+		if k.(string) == "templates" {
+			validateYamlTemplates(fileName, v)
+			continue
+		}
 		switch v := v.(type) {
 		case []interface{}:
 			for _, e := range v {
@@ -250,10 +889,10 @@ func validateYamlKeys(fileName string, config_map map[interface{}]interface{}) {
 					panic(newRateLimitConfigError(fileName, errorText))
 				}
 				element := e.(map[interface{}]interface{})
-				validateYamlKeys(fileName, element)
+				validateYamlKeys(fileName, k.(string), element)
 			}
 		case map[interface{}]interface{}:
-			validateYamlKeys(fileName, v)
+			validateYamlKeys(fileName, k.(string), v)
 		// string is a leaf type in ratelimit config. No need to keep validating.
 		case string:
 		// int is a leaf type in ratelimit config. No need to keep validating.
@@ -271,6 +910,52 @@ func validateYamlKeys(fileName string, config_map map[interface{}]interface{}) {
 	}
 }
 
+// Validate the metadata of a rate limit, a map of strings to scalar values.
+func validateYamlMetadata(fileName string, metadata interface{}) {
+	metadataMap, ok := metadata.(map[interface{}]interface{})
+	if !ok {
+		panic(newRateLimitConfigError(fileName, "config error, metadata must be a map"))
+	}
+	for k, v := range metadataMap {
+		if _, ok := k.(string); !ok {
+			panic(newRateLimitConfigError(fileName, fmt.Sprintf("config error, metadata key is not of type string: %v", k)))
+		}
+		switch v.(type) {
+		case string, int, bool, float64:
+		default:
+			panic(newRateLimitConfigError(fileName, fmt.Sprintf("config error, metadata '%s' must be a scalar", k)))
+		}
+	}
+}
+
+// checkSupported panics if a rate_limit of the descriptors sets a field the backend doesn't implement.
+func (this *rateLimitConfigImpl) checkSupported(fileName string, descriptors []YamlDescriptor) {
+	for _, descriptor := range descriptors {
+		if descriptor.RateLimit != nil {
+			for _, field := range this.unsupportedFields {
+				if descriptor.RateLimit.hasField(field) {
+					panic(newRateLimitConfigError(fileName, fmt.Sprintf("%s is not supported by the backend", field)))
+				}
+			}
+		}
+		this.checkSupported(fileName, descriptor.Descriptors)
+	}
+}
+
+// hasField returns whether the rate_limit sets the field, among those a backend may not implement.
+func (this *YamlRateLimit) hasField(field string) bool {
+	switch field {
+	case "leaky_bucket":
+		return this.LeakyBucket != nil
+	case "carry_over_percent":
+		return this.CarryOverPercent != 0
+	case "penalty":
+		return this.Penalty != nil
+	default:
+		return false
+	}
+}
+
 // Load a single YAML config into the global config.
 // @param config specifies the yamlRoot struct to load.
 func (this *rateLimitConfigImpl) loadConfig(config RateLimitConfigToLoad) {
@@ -280,14 +965,40 @@ func (this *rateLimitConfigImpl) loadConfig(config RateLimitConfigToLoad) {
 		panic(newRateLimitConfigError(config.Name, "config file cannot have empty domain"))
 	}
 
+	if root.Backend != "" && this.backends != nil && !slices.Contains(this.backends, root.Backend) {
+		panic(newRateLimitConfigError(config.Name, fmt.Sprintf("unknown backend '%s' for domain '%s'", root.Backend, root.Domain)))
+	}
+	this.checkSupported(config.Name, root.Descriptors)
+
+	previousFiles := this.domainFiles[root.Domain]
+	this.domainFiles[root.Domain] = append(previousFiles, config.Name)
 	if _, present := this.domains[root.Domain]; present {
-		if !this.mergeDomainConfigs {
-			panic(newRateLimitConfigError(
-				config.Name, fmt.Sprintf("duplicate domain '%s' in config file", root.Domain)))
+		this.statsManager.NewServiceStats().ConfigDomainConflict.Inc()
+		files := strings.Join(this.domainFiles[root.Domain], ", ")
+		switch this.domainConflictPolicy {
+		case DomainConflictLastWins:
+			logger.Warnf("domain '%s' is defined in %s, loading the last file only", root.Domain, files)
+			delete(this.domains, root.Domain)
+		case DomainConflictMerge:
+			logger.Infof("domain '%s' is defined in %s, merging the files", root.Domain, files)
+		default:
+			logger.Warnf("domain '%s' is defined in %s", root.Domain, files)
+			panic(newRateLimitConfigError(config.Name, fmt.Sprintf(
+				"duplicate domain '%s' in config file, also defined in %s", root.Domain, strings.Join(previousFiles, ", "))))
+		}
+	}
+
+	if _, present := this.domains[root.Domain]; present {
+		if root.Backend != "" && root.Backend != this.domains[root.Domain].backend {
+			if this.domains[root.Domain].backend != "" {
+				panic(newRateLimitConfigError(
+					config.Name, fmt.Sprintf("conflicting backend '%s' for domain '%s'", root.Backend, root.Domain)))
+			}
+			this.domains[root.Domain].backend = root.Backend
 		}
 
 		logger.Debugf("patching domain: %s", root.Domain)
-		this.domains[root.Domain].loadDescriptors(config, root.Domain+".", root.Descriptors, this.statsManager)
+		this.domains[root.Domain].loadDescriptors(config, root.Domain+".", root.Descriptors, this.statsManager, this.cacheKeyHash)
 		return
 	}
 
@@ -299,8 +1010,8 @@ func (this *rateLimitConfigImpl) loadConfig(config RateLimitConfigToLoad) {
 		valueToMetric:   false,
 		shareThreshold:  false,
 		wildcardPattern: "",
-	}}
-	newDomain.loadDescriptors(config, root.Domain+".", root.Descriptors, this.statsManager)
+	}, root.Backend}
+	newDomain.loadDescriptors(config, root.Domain+".", root.Descriptors, this.statsManager, this.cacheKeyHash)
 	this.domains[root.Domain] = newDomain
 }
 
@@ -313,16 +1024,59 @@ func (this *rateLimitConfigImpl) Dump() string {
 	return ret
 }
 
+func (this *rateLimitConfigImpl) dumpDomain(domain string) string {
+	if descriptor, ok := this.domains[domain]; ok {
+		return descriptor.dump()
+	}
+	return ""
+}
+
+func (this *rateLimitConfigImpl) DumpTree() []*DomainDump {
+	names := make([]string, 0, len(this.domains))
+	for name := range this.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]*DomainDump, 0, len(names))
+	for _, name := range names {
+		domain := this.domains[name]
+		ret = append(ret, &DomainDump{
+			Domain:      name,
+			Backend:     domain.backend,
+			Descriptors: domain.dumpTree(),
+		})
+	}
+	return ret
+}
+
+type readOnlyLookupKey struct{}
+
+// WithReadOnlyLookup returns a context whose GetLimit lookups have no side effect: they don't count
+// the unknown domains, remember the descriptors without limit nor create the detailed or schedule
+// stats of the limits, e.g. for the debug endpoints inspecting the limits of descriptors.
+func WithReadOnlyLookup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyLookupKey{}, true)
+}
+
+func isReadOnlyLookup(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyLookupKey{}).(bool)
+	return readOnly
+}
+
 func (this *rateLimitConfigImpl) GetLimit(
 	ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor,
 ) *RateLimit {
 	logger.Debugf("starting get limit lookup")
+	readOnly := isReadOnlyLookup(ctx)
 	var rateLimit *RateLimit = nil
 	value := this.domains[domain]
 	if value == nil {
 		logger.Debugf("unknown domain '%s'", domain)
-		domainStats := this.statsManager.NewDomainStats(domain)
-		domainStats.NotFound.Inc()
+		if !readOnly {
+			domainStats := this.statsManager.NewDomainStats(domain)
+			domainStats.NotFound.Inc()
+		}
 		return rateLimit
 	}
 
@@ -333,16 +1087,55 @@ func (this *rateLimitConfigImpl) GetLimit(
 		rateLimit = NewRateLimit(
 			descriptor.GetLimit().GetRequestsPerUnit(),
 			rateLimitOverrideUnit,
-			this.statsManager.NewStats(rateLimitKey),
+			this.statsManager.NewStatsWithRollups(domain, rateLimitKey),
 			false,
 			false,
 			"",
 			[]string{},
 			false,
 		)
+		rateLimit.Backend = value.backend
+		rateLimit.CacheKeyHash = this.cacheKeyHash
+		return rateLimit
+	}
+
+	// The descriptors matching no rule are remembered until the next reload, the configuration
+	// being immutable, so that the clients sending them don't walk the descriptor tree each time.
+	lookupKey := negativeLookupKey(domain, descriptor)
+	if _, found := this.negativeLookups.Load(lookupKey); found {
+		return nil
+	}
+	rateLimit = this.getDescriptorLimit(domain, value, descriptor, readOnly)
+	if rateLimit == nil && !readOnly && this.negativeLookupCount.Load() < maxNegativeLookups {
+		if _, loaded := this.negativeLookups.LoadOrStore(lookupKey, true); !loaded {
+			this.negativeLookupCount.Add(1)
+		}
+	}
+	if rateLimit != nil && len(rateLimit.Schedules) > 0 {
+		rateLimit = this.withSchedule(domain, rateLimit, time.Unix(this.timeSource.UnixNow(), 0), readOnly)
+	}
+	return rateLimit
+}
+
+// withSchedule returns a copy of the rate limit with the limit of its schedule containing now,
+// counted in the stats of the schedule, or the rate limit itself when no schedule does.
+func (this *rateLimitConfigImpl) withSchedule(domain string, rateLimit *RateLimit, now time.Time, readOnly bool) *RateLimit {
+	schedule := rateLimit.activeSchedule(now)
+	if schedule == nil {
 		return rateLimit
 	}
+	ret := this.withStats(rateLimit, domain, rateLimit.FullKey+".schedule_"+schedule.Name, readOnly)
+	ret.Limit = schedule.Limit
+	ret.ActiveSchedule = schedule.Name
+	return ret
+}
 
+// getDescriptorLimit walks the descriptor tree of the domain to find the limit of the descriptor,
+// without creating its stats for a read-only lookup.
+func (this *rateLimitConfigImpl) getDescriptorLimit(
+	domain string, value *rateLimitDomain, descriptor *pb_struct.RateLimitDescriptor, readOnly bool,
+) *RateLimit {
+	var rateLimit *RateLimit = nil
 	descriptorsMap := value.descriptors
 	prevDescriptor := &value.rateLimitDescriptor
 
@@ -358,14 +1151,17 @@ func (this *rateLimitConfigImpl) GetLimit(
 	// This allows share_threshold to work when wildcard has nested descriptors
 	var shareThresholdPatterns map[int]string
 
+	// Track the first keys of the key sets matched through their other keys (using indexes)
+	var keySetKeys map[int]string
+
+	// Track the normalizers of the values of the entries (using indexes)
+	var normalizers map[int]*ValueNormalizer
+
 	for i, entry := range descriptor.Entries {
 		// First see if key_value is in the map. If that isn't in the map we look for just key
 		// to check for a default value.
 		finalKey := entry.Key + "_" + entry.Value
 
-		detailedMetricFullKey.WriteString(".")
-		detailedMetricFullKey.WriteString(finalKey)
-
 		logger.Debugf("looking up key: %s", finalKey)
 		nextDescriptor := descriptorsMap[finalKey]
 		var matchedWildcardKey string
@@ -395,11 +1191,31 @@ func (this *rateLimitConfigImpl) GetLimit(
 				shareThresholdPatterns = make(map[int]string)
 			}
 
-			wildcardValue := strings.TrimPrefix(nextDescriptor.wildcardPattern, entry.Key+"_")
+			wildcardValue := strings.TrimPrefix(nextDescriptor.wildcardPattern, nextDescriptor.key+"_")
 			shareThresholdPatterns[i] = wildcardValue
 			logger.Debugf("tracking share_threshold for entry index %d (key %s), wildcard pattern %s", i, entry.Key, wildcardValue)
 		}
 
+		if nextDescriptor != nil && nextDescriptor.key != entry.Key {
+			if keySetKeys == nil {
+				keySetKeys = make(map[int]string)
+			}
+			keySetKeys[i] = nextDescriptor.key
+		}
+		entryValue := entry.Value
+		if nextDescriptor != nil && nextDescriptor.normalizer != nil {
+			if normalizers == nil {
+				normalizers = make(map[int]*ValueNormalizer)
+			}
+			normalizers[i] = nextDescriptor.normalizer
+			entryValue = nextDescriptor.normalizer.Normalize(entry.Value)
+		}
+
+		detailedMetricFullKey.WriteString(".")
+		detailedMetricFullKey.WriteString(entry.Key)
+		detailedMetricFullKey.WriteString("_")
+		detailedMetricFullKey.WriteString(entryValue)
+
 		// Build value_to_metric metrics path for this level
 		valueToMetricFullKey.WriteString(".")
 		if nextDescriptor != nil {
@@ -414,23 +1230,23 @@ func (this *rateLimitConfigImpl) GetLimit(
 					valueToUse = shareThresholdPatterns[i]
 				} else if nextDescriptor.valueToMetric {
 					// value_to_metric: use actual runtime value
-					valueToUse = entry.Value
+					valueToUse = entryValue
 				} else {
 					// No flags: preserve wildcard pattern
 					valueToUse = strings.TrimPrefix(matchedWildcardKey, entry.Key+"_")
 				}
 			} else if matchedUsingValue {
 				// Matched explicit key+value in config (share_threshold can't apply here)
-				valueToUse = entry.Value
+				valueToUse = entryValue
 			} else {
 				// Matched default key (no value) in config
 				if nextDescriptor.valueToMetric {
-					valueToUse = entry.Value
+					valueToUse = entryValue
 				}
 			}
 
-			// Write key and value (if any)
-			valueToMetricFullKey.WriteString(entry.Key)
+			// Write key and value (if any), the first key for a key set
+			valueToMetricFullKey.WriteString(nextDescriptor.key)
 			if valueToUse != "" {
 				valueToMetricFullKey.WriteString("_")
 				valueToMetricFullKey.WriteString(valueToUse)
@@ -447,14 +1263,31 @@ func (this *rateLimitConfigImpl) GetLimit(
 				// Create a copy of the rate limit to avoid modifying the shared object
 				originalLimit := nextDescriptor.limit
 				rateLimit = &RateLimit{
-					FullKey:        originalLimit.FullKey,
-					Stats:          originalLimit.Stats,
-					Limit:          originalLimit.Limit,
-					Unlimited:      originalLimit.Unlimited,
-					ShadowMode:     originalLimit.ShadowMode,
-					Name:           originalLimit.Name,
-					Replaces:       originalLimit.Replaces,
-					DetailedMetric: originalLimit.DetailedMetric,
+					FullKey:          originalLimit.FullKey,
+					Stats:            originalLimit.Stats,
+					Limit:            originalLimit.Limit,
+					Unlimited:        originalLimit.Unlimited,
+					ShadowMode:       originalLimit.ShadowMode,
+					Name:             originalLimit.Name,
+					Replaces:         originalLimit.Replaces,
+					DetailedMetric:   originalLimit.DetailedMetric,
+					Backend:          value.backend,
+					Metadata:         originalLimit.Metadata,
+					CacheKeyHash:     originalLimit.CacheKeyHash,
+					UnitMultiplier:   originalLimit.UnitMultiplier,
+					Quota:            originalLimit.Quota,
+					Cost:             originalLimit.Cost,
+					Schedules:        originalLimit.Schedules,
+					Penalty:          originalLimit.Penalty,
+					ExpirationJitter: originalLimit.ExpirationJitter,
+					RequestAligned:   originalLimit.RequestAligned,
+					CacheKeyVersion:  originalLimit.CacheKeyVersion,
+					LeakyBucket:      originalLimit.LeakyBucket,
+					Concurrency:      originalLimit.Concurrency,
+					Spillover:        originalLimit.Spillover,
+					SpillsOver:       originalLimit.SpillsOver,
+					CarryOverPercent: originalLimit.CarryOverPercent,
+					ShardCount:       originalLimit.ShardCount,
 					// Initialize ShareThresholdKeyPattern with correct length, empty strings for entries without share_threshold
 					ShareThresholdKeyPattern: nil,
 				}
@@ -469,6 +1302,41 @@ func (this *rateLimitConfigImpl) GetLimit(
 					rateLimit.ShareThresholdKeyPattern[idx] = pattern
 					logger.Debugf("share_threshold enabled for entry index %d, using wildcard pattern %s", idx, pattern)
 				}
+
+				// The entries matched through a key set count with the first key of the set
+				if len(keySetKeys) > 0 {
+					rateLimit.KeySetKeys = make([]string, len(descriptor.Entries))
+					for idx, key := range keySetKeys {
+						rateLimit.KeySetKeys[idx] = key
+					}
+				}
+
+				// The values of the entries are normalized in the cache key
+				if len(normalizers) > 0 {
+					rateLimit.ValueNormalizers = make([]*ValueNormalizer, len(descriptor.Entries))
+					for idx, normalizer := range normalizers {
+						rateLimit.ValueNormalizers[idx] = normalizer
+					}
+				}
+
+				// The quota counts in the same backend and with the same keys as the rate limit
+				if rateLimit.Quota != nil {
+					quota := *rateLimit.Quota
+					quota.Backend = rateLimit.Backend
+					quota.ShareThresholdKeyPattern = rateLimit.ShareThresholdKeyPattern
+					quota.KeySetKeys = rateLimit.KeySetKeys
+					quota.ValueNormalizers = rateLimit.ValueNormalizers
+					rateLimit.Quota = &quota
+				}
+				// The spillover tiers count in the backend of the rate limit
+				if len(rateLimit.Spillover) > 0 && rateLimit.Backend != "" {
+					rateLimit.Spillover = make([]*RateLimit, len(originalLimit.Spillover))
+					for i, tier := range originalLimit.Spillover {
+						tierCopy := *tier
+						tierCopy.Backend = rateLimit.Backend
+						rateLimit.Spillover[i] = &tierCopy
+					}
+				}
 			} else {
 				logger.Debugf("request depth does not match config depth, there are more entries in the request's descriptor")
 			}
@@ -479,10 +1347,7 @@ func (this *rateLimitConfigImpl) GetLimit(
 			descriptorsMap = nextDescriptor.descriptors
 		} else {
 			if rateLimit != nil && rateLimit.DetailedMetric {
-				// Preserve ShareThresholdKeyPattern when recreating rate limit
-				originalShareThresholdKeyPattern := rateLimit.ShareThresholdKeyPattern
-				rateLimit = NewRateLimit(rateLimit.Limit.RequestsPerUnit, rateLimit.Limit.Unit, this.statsManager.NewStats(rateLimit.FullKey), rateLimit.Unlimited, rateLimit.ShadowMode, rateLimit.Name, rateLimit.Replaces, rateLimit.DetailedMetric)
-				rateLimit.ShareThresholdKeyPattern = originalShareThresholdKeyPattern
+				rateLimit = this.withStats(rateLimit, domain, rateLimit.FullKey, readOnly)
 			}
 
 			break
@@ -516,11 +1381,11 @@ func (this *rateLimitConfigImpl) GetLimit(
 			}
 			shareThresholdKey := shareThresholdMetricKey.String()
 			rateLimit.FullKey = shareThresholdKey
-			rateLimit.Stats = this.statsManager.NewStats(shareThresholdKey)
+			rateLimit.Stats = this.limitStats(domain, shareThresholdKey, rateLimit.Stats, readOnly)
 		} else {
 			detailedKey := detailedMetricFullKey.String()
 			rateLimit.FullKey = detailedKey
-			rateLimit.Stats = this.statsManager.NewStats(detailedKey)
+			rateLimit.Stats = this.limitStats(domain, detailedKey, rateLimit.Stats, readOnly)
 		}
 	}
 
@@ -529,20 +1394,61 @@ func (this *rateLimitConfigImpl) GetLimit(
 	if rateLimit != nil && !rateLimit.DetailedMetric {
 		enhancedKey := valueToMetricFullKey.String()
 		if enhancedKey != rateLimit.FullKey {
-			// Recreate to ensure a clean stats struct, then set to enhanced stats
-			originalShareThresholdKeyPattern := rateLimit.ShareThresholdKeyPattern
-			rateLimit = NewRateLimit(rateLimit.Limit.RequestsPerUnit, rateLimit.Limit.Unit, this.statsManager.NewStats(enhancedKey), rateLimit.Unlimited, rateLimit.ShadowMode, rateLimit.Name, rateLimit.Replaces, rateLimit.DetailedMetric)
-			rateLimit.ShareThresholdKeyPattern = originalShareThresholdKeyPattern
+			// Copy to ensure a clean stats struct, then set to enhanced stats
+			rateLimit = this.withStats(rateLimit, domain, enhancedKey, readOnly)
 		}
 	}
 
 	return rateLimit
 }
 
+// withStats returns a copy of the rate limit with the stats of key.
+func (this *rateLimitConfigImpl) withStats(rateLimit *RateLimit, domain string, key string, readOnly bool) *RateLimit {
+	ret := *rateLimit
+	ret.FullKey = key
+	ret.Stats = this.limitStats(domain, key, rateLimit.Stats, readOnly)
+	return &ret
+}
+
+// limitStats returns the stats of key counting the matches of the rule of ruleStats, or ruleStats
+// themselves for a read-only lookup, which doesn't create stats.
+func (this *rateLimitConfigImpl) limitStats(domain string, key string, ruleStats stats.RateLimitStats,
+	readOnly bool,
+) stats.RateLimitStats {
+	if readOnly {
+		return ruleStats
+	}
+	return withRuleMatches(this.statsManager.NewStatsWithRollups(domain, key), ruleStats)
+}
+
+// withRuleMatches returns the stats whose matches are counted by the rule of ruleStats, so that the
+// matches of a rule don't depend on the keys of its detailed, value_to_metric or schedule stats.
+func withRuleMatches(limitStats stats.RateLimitStats, ruleStats stats.RateLimitStats) stats.RateLimitStats {
+	limitStats.Matched = ruleStats.Matched
+	return limitStats
+}
+
 func (this *rateLimitConfigImpl) IsEmptyDomains() bool {
 	return len(this.domains) == 0
 }
 
+// negativeLookupKey identifies the domain and entries of a descriptor, the separators can't be
+// confused with the entries.
+func negativeLookupKey(domain string, descriptor *pb_struct.RateLimitDescriptor) string {
+	var b strings.Builder
+	b.WriteString(domain)
+	for _, entry := range descriptor.Entries {
+		b.WriteByte(0)
+		b.WriteString(strconv.Itoa(len(entry.Key)))
+		b.WriteByte(':')
+		b.WriteString(entry.Key)
+		b.WriteString(strconv.Itoa(len(entry.Value)))
+		b.WriteByte(':')
+		b.WriteString(entry.Value)
+	}
+	return b.String()
+}
+
 func descriptorKey(domain string, descriptor *pb_struct.RateLimitDescriptor) string {
 	rateLimitKey := ""
 	for _, entry := range descriptor.Entries {
@@ -561,6 +1467,16 @@ func descriptorKey(domain string, descriptor *pb_struct.RateLimitDescriptor) str
 // @param fileName specifies the name of the file.
 // @param content specifies the string content of the yaml file.
 func ConfigFileContentToYaml(fileName, content string) *YamlRoot {
+	return ConfigFileContentToYamlWithOptions(fileName, content, LoaderOptions{})
+}
+
+// ConfigFileContentToYamlWithOptions is ConfigFileContentToYaml validating the file in the strict mode
+// of the options.
+func ConfigFileContentToYamlWithOptions(fileName, content string, options LoaderOptions) *YamlRoot {
+	if options.Strict {
+		validateYamlStrict(fileName, content)
+	}
+
 	// validate keys in config with generic map
 	any := map[interface{}]interface{}{}
 	err := yaml.Unmarshal([]byte(content), &any)
@@ -569,7 +1485,7 @@ func ConfigFileContentToYaml(fileName, content string) *YamlRoot {
 		logger.Debugf(errorText)
 		panic(newRateLimitConfigError(fileName, errorText))
 	}
-	validateYamlKeys(fileName, any)
+	validateYamlKeys(fileName, "", any)
 
 	var root YamlRoot
 	err = yaml.Unmarshal([]byte(content), &root)
@@ -578,6 +1494,12 @@ func ConfigFileContentToYaml(fileName, content string) *YamlRoot {
 		logger.Debugf(errorText)
 		panic(newRateLimitConfigError(fileName, errorText))
 	}
+	if options.Strict {
+		validateYamlWildcards(fileName, "descriptors", root.Descriptors)
+		for name, descriptors := range root.Templates {
+			validateYamlWildcards(fileName, joinYamlPath("templates", name), descriptors)
+		}
+	}
 
 	return &root
 }
@@ -590,23 +1512,69 @@ func ConfigFileContentToYaml(fileName, content string) *YamlRoot {
 func NewRateLimitConfigImpl(
 	configs []RateLimitConfigToLoad, statsManager stats.Manager, mergeDomainConfigs bool,
 ) RateLimitConfig {
-	ret := &rateLimitConfigImpl{map[string]*rateLimitDomain{}, statsManager, mergeDomainConfigs}
-	for _, config := range configs {
+	return NewRateLimitConfigImplWithOptions(configs, statsManager, mergeDomainConfigs, LoaderOptions{})
+}
+
+// NewRateLimitConfigImplWithOptions is NewRateLimitConfigImpl with the loader options, whose
+// DuplicateDomainPolicy takes precedence over mergeDomainConfigs when set.
+// @throws RateLimitConfigError if the options or the configuration are invalid.
+func NewRateLimitConfigImplWithOptions(
+	configs []RateLimitConfigToLoad, statsManager stats.Manager, mergeDomainConfigs bool, options LoaderOptions,
+) RateLimitConfig {
+	domainConflictPolicy := options.DuplicateDomainPolicy
+	if domainConflictPolicy == "" {
+		domainConflictPolicy = DomainConflictError
+		if mergeDomainConfigs {
+			domainConflictPolicy = DomainConflictMerge
+		}
+	}
+	if !IsDomainConflictPolicy(domainConflictPolicy) {
+		panic(RateLimitConfigError(fmt.Sprintf("invalid DUPLICATE_DOMAIN_POLICY '%s'", domainConflictPolicy)))
+	}
+	cacheKeyHash := options.CacheKeyHash
+	if !IsValidCacheKeyHash(cacheKeyHash) {
+		panic(RateLimitConfigError(fmt.Sprintf("invalid CACHE_KEY_HASH '%s'", cacheKeyHash)))
+	}
+	if cacheKeyHash == CacheKeyHashNone {
+		cacheKeyHash = ""
+	}
+	timeSource := options.TimeSource
+	if timeSource == nil {
+		timeSource = utils.NewTimeSourceImpl()
+	}
+	ret := &rateLimitConfigImpl{
+		domains:              map[string]*rateLimitDomain{},
+		statsManager:         statsManager,
+		domainConflictPolicy: domainConflictPolicy,
+		domainFiles:          map[string][]string{},
+		cacheKeyHash:         cacheKeyHash,
+		backends:             options.Backends,
+		unsupportedFields:    options.UnsupportedFields,
+		timeSource:           timeSource,
+	}
+	for _, config := range expandTemplates(configs) {
 		ret.loadConfig(config)
 	}
 
 	return ret
 }
 
-type rateLimitConfigLoaderImpl struct{}
+type rateLimitConfigLoaderImpl struct {
+	options LoaderOptions
+}
 
 func (this *rateLimitConfigLoaderImpl) Load(
 	configs []RateLimitConfigToLoad, statsManager stats.Manager, mergeDomainConfigs bool,
 ) RateLimitConfig {
-	return NewRateLimitConfigImpl(configs, statsManager, mergeDomainConfigs)
+	return NewRateLimitConfigImplWithOptions(configs, statsManager, mergeDomainConfigs, this.options)
 }
 
 // @return a new default config loader implementation.
 func NewRateLimitConfigLoaderImpl() RateLimitConfigLoader {
 	return &rateLimitConfigLoaderImpl{}
 }
+
+// @return a new config loader implementation creating the configurations with the options.
+func NewRateLimitConfigLoaderWithOptions(options LoaderOptions) RateLimitConfigLoader {
+	return &rateLimitConfigLoaderImpl{options: options}
+}
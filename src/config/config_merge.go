@@ -0,0 +1,87 @@
+package config
+
+import (
+	"sort"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"golang.org/x/net/context"
+)
+
+// mergedRateLimitConfig serves the domains of primary from primary and the other domains from
+// secondary, so that a domain defined by both configurations is entirely taken from primary.
+type mergedRateLimitConfig struct {
+	primary        RateLimitConfig
+	secondary      RateLimitConfig
+	primaryDomains map[string]bool
+}
+
+// NewMergedRateLimitConfig merges two loaded configurations by domain, primary takes precedence
+// over secondary. Either configuration may be nil.
+func NewMergedRateLimitConfig(primary RateLimitConfig, secondary RateLimitConfig) RateLimitConfig {
+	if primary == nil {
+		return secondary
+	}
+	if secondary == nil {
+		return primary
+	}
+
+	primaryDomains := map[string]bool{}
+	for _, domain := range primary.DumpTree() {
+		primaryDomains[domain.Domain] = true
+	}
+	return &mergedRateLimitConfig{
+		primary:        primary,
+		secondary:      secondary,
+		primaryDomains: primaryDomains,
+	}
+}
+
+// domainDumper dumps the limits of a single domain of a configuration, as Dump does.
+type domainDumper interface {
+	dumpDomain(domain string) string
+}
+
+func (this *mergedRateLimitConfig) Dump() string {
+	ret := this.primary.Dump()
+	for _, domain := range this.secondary.DumpTree() {
+		if !this.primaryDomains[domain.Domain] {
+			ret += this.dumpDomain(domain.Domain)
+		}
+	}
+	return ret
+}
+
+func (this *mergedRateLimitConfig) dumpDomain(domain string) string {
+	config := this.secondary
+	if this.primaryDomains[domain] {
+		config = this.primary
+	}
+	if dumper, ok := config.(domainDumper); ok {
+		return dumper.dumpDomain(domain)
+	}
+	return ""
+}
+
+func (this *mergedRateLimitConfig) DumpTree() []*DomainDump {
+	ret := this.primary.DumpTree()
+	for _, domain := range this.secondary.DumpTree() {
+		if !this.primaryDomains[domain.Domain] {
+			ret = append(ret, domain)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Domain < ret[j].Domain })
+	return ret
+}
+
+func (this *mergedRateLimitConfig) GetLimit(
+	ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor,
+) *RateLimit {
+	if this.primaryDomains[domain] {
+		return this.primary.GetLimit(ctx, domain, descriptor)
+	}
+	return this.secondary.GetLimit(ctx, domain, descriptor)
+}
+
+func (this *mergedRateLimitConfig) IsEmptyDomains() bool {
+	return this.primary.IsEmptyDomains() && this.secondary.IsEmptyDomains()
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+type YamlNormalize struct {
+	Lowercase  bool
+	Trim       bool
+	Ipv4Prefix int `yaml:"ipv4_prefix"`
+	Ipv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+// ValueNormalizer transforms the values of the descriptor entries of a rule before they are written
+// in its cache key, e.g. to aggregate the clients of a subnet.
+type ValueNormalizer struct {
+	Lowercase bool `json:"lowercase,omitempty"`
+	Trim      bool `json:"trim,omitempty"`
+	// IPv4Prefix truncates the IPv4 addresses to their prefix of that length, e.g. 10.1.2.0/24, 0 to keep them.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	// IPv6Prefix truncates the IPv6 addresses to their prefix of that length, e.g. 2001:db8::/64, 0 to keep them.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// newValueNormalizer returns the normalizer of a descriptor, nil if it has none.
+// @throws RateLimitConfigError if a prefix length is out of range.
+func newValueNormalizer(config RateLimitConfigToLoad, normalizeConfig *YamlNormalize) *ValueNormalizer {
+	if normalizeConfig == nil {
+		return nil
+	}
+	if normalizeConfig.Ipv4Prefix < 0 || normalizeConfig.Ipv4Prefix > 32 {
+		panic(newRateLimitConfigError(config.Name,
+			fmt.Sprintf("invalid normalize ipv4_prefix %d, should be between 0 and 32", normalizeConfig.Ipv4Prefix)))
+	}
+	if normalizeConfig.Ipv6Prefix < 0 || normalizeConfig.Ipv6Prefix > 128 {
+		panic(newRateLimitConfigError(config.Name,
+			fmt.Sprintf("invalid normalize ipv6_prefix %d, should be between 0 and 128", normalizeConfig.Ipv6Prefix)))
+	}
+	return &ValueNormalizer{
+		Lowercase:  normalizeConfig.Lowercase,
+		Trim:       normalizeConfig.Trim,
+		IPv4Prefix: normalizeConfig.Ipv4Prefix,
+		IPv6Prefix: normalizeConfig.Ipv6Prefix,
+	}
+}
+
+// Normalize returns the value trimmed, then lowercased, then truncated to its prefix if it is an
+// IP address. The other values are not truncated.
+func (this *ValueNormalizer) Normalize(value string) string {
+	if this.Trim {
+		value = strings.TrimSpace(value)
+	}
+	if this.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if this.IPv4Prefix == 0 && this.IPv6Prefix == 0 {
+		return value
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return value
+	}
+	addr = addr.Unmap()
+	bits := this.IPv6Prefix
+	if addr.Is4() {
+		bits = this.IPv4Prefix
+	}
+	if bits == 0 {
+		return value
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return value
+	}
+	return prefix.String()
+}
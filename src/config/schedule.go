@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+// YamlSchedule is a window of the week during which a rate_limit applies another
+// requests_per_unit, e.g. business hours.
+type YamlSchedule struct {
+	Name            string
+	Days            string
+	Start           string
+	End             string
+	Timezone        string
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+}
+
+// Schedule is a loaded schedule of a rate limit.
+type Schedule struct {
+	Name  string
+	Limit *pb.RateLimitResponse_RateLimit
+	// days are indexed by time.Weekday, start and end are minutes since midnight. A window whose
+	// end is not after its start spans midnight and belongs to the day it starts on.
+	days     [7]bool
+	start    int
+	end      int
+	location *time.Location
+	config   YamlSchedule
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// newSchedule validates a schedule of the rate limit and creates its limit.
+func newSchedule(config RateLimitConfigToLoad, scheduleConfig YamlSchedule, rateLimit *RateLimit) *Schedule {
+	fail := func(format string, args ...interface{}) {
+		panic(newRateLimitConfigError(
+			config.Name, fmt.Sprintf("schedule '%s': ", scheduleConfig.Name)+fmt.Sprintf(format, args...)))
+	}
+	if scheduleConfig.Name == "" {
+		panic(newRateLimitConfigError(config.Name, "schedule has empty name"))
+	}
+
+	schedule := &Schedule{
+		Name: scheduleConfig.Name,
+		Limit: &pb.RateLimitResponse_RateLimit{
+			RequestsPerUnit: scheduleConfig.RequestsPerUnit,
+			Unit:            rateLimit.Limit.Unit,
+			Name:            rateLimit.Limit.Name,
+		},
+		location: time.UTC,
+		config:   scheduleConfig,
+	}
+
+	var err error
+	if schedule.days, err = parseDays(scheduleConfig.Days); err != nil {
+		fail("%s", err)
+	}
+	if schedule.start, err = parseTimeOfDay(scheduleConfig.Start, 0); err != nil {
+		fail("invalid start: %s", err)
+	}
+	if schedule.end, err = parseTimeOfDay(scheduleConfig.End, 24*60); err != nil {
+		fail("invalid end: %s", err)
+	}
+	if schedule.start == schedule.end {
+		fail("start and end are equal")
+	}
+	if scheduleConfig.Timezone != "" {
+		if schedule.location, err = time.LoadLocation(scheduleConfig.Timezone); err != nil {
+			fail("invalid timezone '%s'", scheduleConfig.Timezone)
+		}
+	}
+	return schedule
+}
+
+// parseDays parses a comma separated list of days and ranges of days such as "mon-fri,sun",
+// empty or "*" for every day.
+func parseDays(days string) ([7]bool, error) {
+	var ret [7]bool
+	if days == "" || days == "*" {
+		for i := range ret {
+			ret[i] = true
+		}
+		return ret, nil
+	}
+	for _, part := range strings.Split(days, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, ok := weekdays[strings.ToLower(first)]
+		if !ok {
+			return ret, fmt.Errorf("invalid day '%s'", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[strings.ToLower(last)]; !ok {
+				return ret, fmt.Errorf("invalid day '%s'", last)
+			}
+		}
+		// a range such as fri-mon wraps around the end of the week
+		for day := from; ; day = (day + 1) % 7 {
+			ret[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// parseTimeOfDay parses a HH:MM time of day into minutes since midnight, 24:00 being the end of
+// the day.
+func parseTimeOfDay(value string, defaultMinutes int) (int, error) {
+	if value == "" {
+		return defaultMinutes, nil
+	}
+	var hours, minutes int
+	if n, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || n != 2 || len(value) != 5 {
+		return 0, fmt.Errorf("'%s' is not HH:MM", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("'%s' is not a time of day", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Contains returns whether now falls within the schedule, in the timezone of the schedule.
+func (this *Schedule) Contains(now time.Time) bool {
+	now = now.In(this.location)
+	minutes := now.Hour()*60 + now.Minute()
+	if this.start < this.end {
+		return this.days[now.Weekday()] && minutes >= this.start && minutes < this.end
+	}
+	// the window spans midnight, its end belongs to the day after the day it starts on
+	if this.days[now.Weekday()] && minutes >= this.start {
+		return true
+	}
+	return this.days[(now.Weekday()+6)%7] && minutes < this.end
+}
+
+// activeSchedule returns the first schedule of the rate limit containing now, nil if none does.
+func (this *RateLimit) activeSchedule(now time.Time) *Schedule {
+	for _, schedule := range this.Schedules {
+		if schedule.Contains(now) {
+			return schedule
+		}
+	}
+	return nil
+}
+
+// ScheduleDump is the debugging form of a schedule.
+type ScheduleDump struct {
+	Name            string `json:"name"`
+	Days            string `json:"days,omitempty"`
+	Start           string `json:"start,omitempty"`
+	End             string `json:"end,omitempty"`
+	Timezone        string `json:"timezone,omitempty"`
+	RequestsPerUnit uint32 `json:"requests_per_unit"`
+}
+
+func newScheduleDump(schedule *Schedule) *ScheduleDump {
+	return &ScheduleDump{
+		Name:            schedule.config.Name,
+		Days:            schedule.config.Days,
+		Start:           schedule.config.Start,
+		End:             schedule.config.End,
+		Timezone:        schedule.config.Timezone,
+		RequestsPerUnit: schedule.config.RequestsPerUnit,
+	}
+}
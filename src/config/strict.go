@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// validateYamlStrict checks the fields of a config file against the fields of YamlRoot at each level,
+// rejecting the unknown and duplicate fields with their path, e.g. descriptors[0].rate_limit.
+// @throws RateLimitConfigError if a field is unknown or duplicate.
+func validateYamlStrict(fileName string, content string) {
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(content), &root); err != nil {
+		panic(newRateLimitConfigError(fileName, fmt.Sprintf("error loading config file: %s", err.Error())))
+	}
+	validateStrictValue(fileName, "", root, reflect.TypeOf(YamlRoot{}))
+}
+
+func validateStrictValue(fileName string, path string, value interface{}, valueType reflect.Type) {
+	if value == nil {
+		return
+	}
+	switch valueType.Kind() {
+	case reflect.Ptr:
+		validateStrictValue(fileName, path, value, valueType.Elem())
+	case reflect.Struct:
+		fields := yamlFields(valueType)
+		validateStrictMap(fileName, path, value, func(key string, value interface{}) {
+			fieldType, ok := fields[key]
+			if !ok {
+				panic(newRateLimitConfigError(fileName, strictErrorText(path, unknownFieldText(key, fields))))
+			}
+			validateStrictValue(fileName, joinYamlPath(path, key), value, fieldType)
+		})
+	case reflect.Map:
+		validateStrictMap(fileName, path, value, func(key string, value interface{}) {
+			validateStrictValue(fileName, joinYamlPath(path, key), value, valueType.Elem())
+		})
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			panic(newRateLimitConfigError(fileName, strictErrorText(path, "expected a list")))
+		}
+		for i, element := range list {
+			validateStrictValue(fileName, fmt.Sprintf("%s[%d]", path, i), element, valueType.Elem())
+		}
+	default:
+		// the types of the scalars are checked when the file is decoded
+	}
+}
+
+// validateStrictMap calls validateField for each field of a map, which must be unique.
+func validateStrictMap(fileName string, path string, value interface{}, validateField func(key string, value interface{})) {
+	fields, ok := value.(yaml.MapSlice)
+	if !ok {
+		panic(newRateLimitConfigError(fileName, strictErrorText(path, "expected a map")))
+	}
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		key, ok := field.Key.(string)
+		if !ok {
+			panic(newRateLimitConfigError(fileName, strictErrorText(path, fmt.Sprintf("key is not of type string: %v", field.Key))))
+		}
+		if seen[key] {
+			panic(newRateLimitConfigError(fileName, strictErrorText(path, fmt.Sprintf("duplicate field '%s'", key))))
+		}
+		seen[key] = true
+		validateField(key, field.Value)
+	}
+}
+
+// yamlFields returns the types of the fields of a struct by their YAML name.
+func yamlFields(structType reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownFieldText describes an unknown field, with the closest known field when it is a likely typo.
+func unknownFieldText(key string, fields map[string]reflect.Type) string {
+	closest, closestDistance := "", len(key)/3+1
+	for name := range fields {
+		if distance := editDistance(key, name); distance < closestDistance ||
+			(distance == closestDistance && closest != "" && name < closest) {
+			closest, closestDistance = name, distance
+		}
+	}
+	if closest == "" {
+		return fmt.Sprintf("unknown field '%s'", key)
+	}
+	return fmt.Sprintf("unknown field '%s', did you mean '%s'?", key, closest)
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			current[j] = min(substitution, previous[j]+1, current[j-1]+1)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// validateYamlWildcards rejects the sibling descriptors of the same key whose wildcard values overlap,
+// which match the same values depending on their order. listPath is the path of the descriptors.
+// @throws RateLimitConfigError if wildcard values overlap.
+func validateYamlWildcards(fileName string, listPath string, descriptors []YamlDescriptor) {
+	for i, descriptor := range descriptors {
+		descriptorPath := fmt.Sprintf("%s[%d]", listPath, i)
+		if strings.HasSuffix(descriptor.Value, "*") {
+			prefix := strings.TrimSuffix(descriptor.Value, "*")
+			for j, other := range descriptors[:i] {
+				key := sharedKey(descriptor, other)
+				if key == "" || !strings.HasSuffix(other.Value, "*") {
+					continue
+				}
+				otherPrefix := strings.TrimSuffix(other.Value, "*")
+				if strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix) {
+					panic(newRateLimitConfigError(fileName, strictErrorText(descriptorPath, fmt.Sprintf(
+						"wildcard value '%s' of key '%s' overlaps the value '%s' of %s[%d]",
+						descriptor.Value, key, other.Value, listPath, j))))
+				}
+			}
+		}
+		validateYamlWildcards(fileName, joinYamlPath(descriptorPath, "descriptors"), descriptor.Descriptors)
+	}
+}
+
+// sharedKey returns a key matched by both descriptors, through their key or key set, empty if none.
+func sharedKey(a YamlDescriptor, b YamlDescriptor) string {
+	for _, key := range append([]string{a.Key}, a.Keys...) {
+		if key == "" {
+			continue
+		}
+		if key == b.Key || slices.Contains(b.Keys, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+func joinYamlPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func strictErrorText(path string, text string) string {
+	if path == "" {
+		return "config error, " + text
+	}
+	return fmt.Sprintf("config error at %s, %s", path, text)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxTemplateDepth bounds the nesting of the includes of the templates.
+const maxTemplateDepth = 16
+
+// template is a named list of descriptors, defined under the templates of a config file.
+type template struct {
+	fileName    string
+	descriptors []YamlDescriptor
+}
+
+// Validate the templates of a config file, a map of names to lists of descriptors.
+func validateYamlTemplates(fileName string, templates interface{}) {
+	templatesMap, ok := templates.(map[interface{}]interface{})
+	if !ok {
+		panic(newRateLimitConfigError(fileName, "config error, templates must be a map"))
+	}
+	for name, descriptors := range templatesMap {
+		if _, ok := name.(string); !ok {
+			panic(newRateLimitConfigError(fileName, fmt.Sprintf("config error, template name is not of type string: %v", name)))
+		}
+		validateYamlKeys(fileName, "templates", map[interface{}]interface{}{"descriptors": descriptors})
+	}
+}
+
+// expandTemplates returns the configs whose includes are replaced by the descriptors of their templates,
+// which can be defined in any of the configs. The files defining only templates are not returned.
+// @throws RateLimitConfigError if a template is defined twice, unknown, or includes itself.
+func expandTemplates(configs []RateLimitConfigToLoad) []RateLimitConfigToLoad {
+	templates := map[string]template{}
+	for _, config := range configs {
+		for name, descriptors := range config.ConfigYaml.Templates {
+			if previous, ok := templates[name]; ok {
+				panic(newRateLimitConfigError(config.Name,
+					fmt.Sprintf("duplicate template '%s', also defined in %s", name, previous.fileName)))
+			}
+			templates[name] = template{fileName: config.Name, descriptors: descriptors}
+		}
+	}
+
+	// the templates are expanded where they are defined, so that their errors are reported once
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expandDescriptors(templates[name].fileName, templates, templates[name].descriptors, []string{name})
+	}
+
+	ret := make([]RateLimitConfigToLoad, 0, len(configs))
+	for _, config := range configs {
+		root := *config.ConfigYaml
+		if root.Domain == "" && len(root.Descriptors) == 0 && root.Templates != nil {
+			continue
+		}
+		root.Templates = nil
+		root.Descriptors = expandDescriptors(config.Name, templates, root.Descriptors, nil)
+		ret = append(ret, RateLimitConfigToLoad{Name: config.Name, ConfigYaml: &root})
+	}
+	return ret
+}
+
+// expandDescriptors returns the descriptors whose includes are replaced by the descriptors of their
+// templates, recursively. including is the stack of the templates being expanded.
+func expandDescriptors(fileName string, templates map[string]template, descriptors []YamlDescriptor,
+	including []string,
+) []YamlDescriptor {
+	if descriptors == nil {
+		return nil
+	}
+	ret := make([]YamlDescriptor, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if descriptor.Include == "" {
+			descriptor.Descriptors = expandDescriptors(fileName, templates, descriptor.Descriptors, including)
+			ret = append(ret, descriptor)
+			continue
+		}
+
+		if descriptor.Key != "" || len(descriptor.Keys) > 0 || descriptor.Value != "" || descriptor.RateLimit != nil || descriptor.Descriptors != nil {
+			panic(newRateLimitConfigError(fileName,
+				fmt.Sprintf("include '%s' must be the only field of its descriptor", descriptor.Include)))
+		}
+		template, ok := templates[descriptor.Include]
+		if !ok {
+			panic(newRateLimitConfigError(fileName, fmt.Sprintf("unknown template '%s'", descriptor.Include)))
+		}
+		for _, name := range including {
+			if name == descriptor.Include {
+				panic(newRateLimitConfigError(fileName, fmt.Sprintf("template '%s' includes itself through %s",
+					descriptor.Include, strings.Join(including, " -> "))))
+			}
+		}
+		if len(including) >= maxTemplateDepth {
+			panic(newRateLimitConfigError(fileName,
+				fmt.Sprintf("templates nested deeper than %d through %s", maxTemplateDepth, strings.Join(including, " -> "))))
+		}
+		ret = append(ret, expandDescriptors(fileName, templates, template.descriptors,
+			append(including[:len(including):len(including)], descriptor.Include))...)
+	}
+	return ret
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/envoyproxy/ratelimit/src/config"
 )
 
-func loadConfigs(allConfigs []config.RateLimitConfigToLoad, mergeDomainConfigs bool) {
+func loadConfigs(allConfigs []config.RateLimitConfigToLoad, mergeDomainConfigs bool, s settings.Settings) {
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -22,8 +22,8 @@ func loadConfigs(allConfigs []config.RateLimitConfigToLoad, mergeDomainConfigs b
 			os.Exit(1)
 		}
 	}()
-	statsManager := stats.NewStatManager(gostats.NewStore(gostats.NewNullSink(), false), settings.NewSettings())
-	config.NewRateLimitConfigImpl(allConfigs, statsManager, mergeDomainConfigs)
+	statsManager := stats.NewStatManager(gostats.NewStore(gostats.NewNullSink(), false), s)
+	config.NewRateLimitConfigImplWithOptions(allConfigs, statsManager, mergeDomainConfigs, config.NewLoaderOptions(s))
 }
 
 func main() {
@@ -41,6 +41,7 @@ func main() {
 		os.Exit(1)
 	}
 
+	s := settings.NewSettings()
 	allConfigs := []config.RateLimitConfigToLoad{}
 	for _, file := range files {
 		finalPath := filepath.Join(*configDirectory, file.Name())
@@ -50,10 +51,10 @@ func main() {
 			fmt.Printf("error reading file %s: %s\n", finalPath, err.Error())
 			os.Exit(1)
 		}
-		configYaml := config.ConfigFileContentToYaml(finalPath, string(bytes))
+		configYaml := config.ConfigFileContentToYamlWithOptions(finalPath, string(bytes), config.NewLoaderOptions(s))
 		allConfigs = append(allConfigs, config.RateLimitConfigToLoad{Name: finalPath, ConfigYaml: configYaml})
 	}
 
-	loadConfigs(allConfigs, *mergeDomainConfigs)
+	loadConfigs(allConfigs, *mergeDomainConfigs, s)
 	fmt.Printf("all rate limit configs ok\n")
 }
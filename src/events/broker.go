@@ -0,0 +1,306 @@
+package events
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// EventType is the state a descriptor entered.
+type EventType string
+
+const (
+	// NearLimit is published when the hits of a descriptor go over the near limit ratio of its limit.
+	NearLimit EventType = "NEAR_LIMIT"
+	// OverLimit is published when a descriptor goes over its limit.
+	OverLimit EventType = "OVER_LIMIT"
+)
+
+// Entry is an entry of the descriptor of an Event.
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Event is the transition of a descriptor of a domain to the near limit or over limit state,
+// published once per state and window of its limit.
+type Event struct {
+	Type       EventType `json:"type"`
+	Domain     string    `json:"domain"`
+	Descriptor []Entry   `json:"descriptor"`
+	// LimitName is the name of the limit, empty if the limit isn't named.
+	LimitName       string `json:"limit_name,omitempty"`
+	RequestsPerUnit uint32 `json:"requests_per_unit"`
+	Unit            string `json:"unit"`
+	LimitRemaining  uint32 `json:"limit_remaining"`
+	// Time is the time of the transition, in unix seconds.
+	Time int64 `json:"time"`
+}
+
+// Subscription receives the events of a Broker until it is closed.
+type Subscription struct {
+	broker *Broker
+	domain string
+	events chan Event
+	once   sync.Once
+
+	// mu guards the channel against its close while an event is sent
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Events returns the channel of the events of the subscription, closed when the subscription is.
+func (this *Subscription) Events() <-chan Event {
+	return this.events
+}
+
+// Close stops the subscription. It is safe to call Close several times.
+func (this *Subscription) Close() {
+	this.once.Do(func() {
+		this.broker.unsubscribe(this)
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		this.closed = true
+		close(this.events)
+	})
+}
+
+// send sends an event to the subscription unless its buffer is full, returning whether the event
+// was dropped.
+func (this *Subscription) send(event Event) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.closed {
+		return false
+	}
+	select {
+	case this.events <- event:
+		return false
+	default:
+		return true
+	}
+}
+
+type brokerStats struct {
+	published   gostats.Counter
+	dropped     gostats.Counter
+	subscribers gostats.Gauge
+}
+
+type keyState struct {
+	state EventType
+	// expiration is the end of the window of the state, in unix seconds.
+	expiration int64
+}
+
+// minPruneSize is the number of states of a shard over which its expired states are pruned.
+const minPruneSize = 1024
+
+// stateShardCount is the number of shards of the states of the descriptors, each with its own lock.
+const stateShardCount = 64
+
+type stateShard struct {
+	mu        sync.Mutex
+	states    map[string]keyState
+	pruneSize int
+}
+
+// reset forgets the states of the shard.
+func (this *stateShard) reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.states = make(map[string]keyState)
+	this.pruneSize = minPruneSize
+}
+
+// Broker publishes the near limit and over limit transitions of the descriptors to its
+// subscribers. The state of the descriptors is only tracked while there are subscribers, and
+// the events are dropped for the subscribers whose buffer is full rather than slowing down the
+// rate limit decisions. The publications only lock the shard of the state of their descriptor and
+// the subscriptions they send to.
+type Broker struct {
+	nearLimitRatio atomic.Uint32 // bits of the float32 ratio, see SetNearLimitRatio
+	bufferSize     int
+	timeSource     utils.TimeSource
+	stats          brokerStats
+
+	// subscriptionsMu serializes the changes of the subscribers, which are replaced on each change
+	// so that the publications read them without locking.
+	subscriptionsMu sync.Mutex
+	subscribers     atomic.Pointer[[]*Subscription]
+	shards          [stateShardCount]stateShard
+}
+
+// NewBroker returns a broker publishing the near limit transitions over nearLimitRatio of the limits,
+// with a buffer of bufferSize events per subscriber. Its stats are in scope.
+func NewBroker(nearLimitRatio float32, bufferSize int, timeSource utils.TimeSource, scope gostats.Scope) *Broker {
+	ret := &Broker{
+		bufferSize: bufferSize,
+		timeSource: timeSource,
+		stats: brokerStats{
+			published:   scope.NewCounter("published"),
+			dropped:     scope.NewCounter("dropped"),
+			subscribers: scope.NewGauge("subscribers"),
+		},
+	}
+	ret.SetNearLimitRatio(nearLimitRatio)
+	ret.subscribers.Store(&[]*Subscription{})
+	for i := range ret.shards {
+		ret.shards[i].reset()
+	}
+	return ret
+}
+
+// SetNearLimitRatio changes the near limit ratio of the next publications, it may be called while
+// publications are in flight.
+func (this *Broker) SetNearLimitRatio(ratio float32) {
+	this.nearLimitRatio.Store(math.Float32bits(ratio))
+}
+
+// Subscribe returns a subscription to the events of domain, of every domain if domain is empty.
+func (this *Broker) Subscribe(domain string) *Subscription {
+	subscription := &Subscription{broker: this, domain: domain, events: make(chan Event, this.bufferSize)}
+	this.subscriptionsMu.Lock()
+	defer this.subscriptionsMu.Unlock()
+	subscribers := append(slices.Clone(*this.subscribers.Load()), subscription)
+	this.subscribers.Store(&subscribers)
+	this.stats.subscribers.Set(uint64(len(subscribers)))
+	return subscription
+}
+
+func (this *Broker) unsubscribe(subscription *Subscription) {
+	this.subscriptionsMu.Lock()
+	defer this.subscriptionsMu.Unlock()
+	subscribers := slices.DeleteFunc(slices.Clone(*this.subscribers.Load()), func(other *Subscription) bool {
+		return other == subscription
+	})
+	this.subscribers.Store(&subscribers)
+	this.stats.subscribers.Set(uint64(len(subscribers)))
+	if len(subscribers) == 0 {
+		for i := range this.shards {
+			this.shards[i].reset()
+		}
+	}
+}
+
+// stateOf returns the state of a descriptor from its status, empty if it is under the near limit.
+func (this *Broker) stateOf(status *pb.RateLimitResponse_DescriptorStatus) EventType {
+	if status.Code == pb.RateLimitResponse_OVER_LIMIT {
+		return OverLimit
+	}
+	limit := status.CurrentLimit.RequestsPerUnit
+	if status.LimitRemaining >= limit {
+		return ""
+	}
+	nearLimitRatio := math.Float32frombits(this.nearLimitRatio.Load())
+	threshold := uint32(math.Floor(float64(float32(limit) * nearLimitRatio)))
+	if limit-status.LimitRemaining > threshold {
+		return NearLimit
+	}
+	return ""
+}
+
+// Publish publishes the transition of a descriptor of a domain given the status of its limit, if
+// the descriptor entered the near limit or over limit state in the window of the limit.
+func (this *Broker) Publish(domain string, descriptor *ratelimitv3.RateLimitDescriptor, limit *config.RateLimit,
+	status *pb.RateLimitResponse_DescriptorStatus,
+) {
+	subscribers := *this.subscribers.Load()
+	if len(subscribers) == 0 || limit == nil || status.CurrentLimit == nil {
+		return
+	}
+	state := this.stateOf(status)
+	key := domain + "|" + limit.FullKey + "|" + descriptorKey(descriptor)
+	now := this.timeSource.UnixNow()
+
+	expiration := now + utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+	if status.DurationUntilReset != nil {
+		expiration = now + int64(math.Ceil(status.DurationUntilReset.AsDuration().Seconds()))
+	}
+	if !this.shards[xxhash.Sum64String(key)%stateShardCount].transition(key, state, expiration, now) {
+		return
+	}
+
+	event := Event{
+		Type:            state,
+		Domain:          domain,
+		Descriptor:      make([]Entry, len(descriptor.Entries)),
+		LimitName:       limit.Name,
+		RequestsPerUnit: status.CurrentLimit.RequestsPerUnit,
+		Unit:            status.CurrentLimit.Unit.String(),
+		LimitRemaining:  status.LimitRemaining,
+		Time:            now,
+	}
+	for i, entry := range descriptor.Entries {
+		event.Descriptor[i] = Entry{Key: entry.Key, Value: entry.Value}
+	}
+	this.stats.published.Inc()
+	for _, subscription := range subscribers {
+		if subscription.domain != "" && subscription.domain != domain {
+			continue
+		}
+		if subscription.send(event) {
+			this.stats.dropped.Inc()
+		}
+	}
+}
+
+// transition records the state of a descriptor until expiration, returning whether the descriptor
+// entered the state, an empty state forgetting the descriptor.
+func (this *stateShard) transition(key string, state EventType, expiration int64, now int64) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	previous, ok := this.states[key]
+	if ok && previous.expiration <= now {
+		ok = false
+	}
+	if state == "" {
+		if ok {
+			delete(this.states, key)
+		}
+		return false
+	}
+	if ok && previous.state == state {
+		return false
+	}
+
+	this.states[key] = keyState{state: state, expiration: expiration}
+	if len(this.states) > this.pruneSize {
+		this.prune(now)
+	}
+	return true
+}
+
+// prune removes the expired states, and lets the states grow to twice the remaining ones before
+// pruning them again.
+func (this *stateShard) prune(now int64) {
+	for key, state := range this.states {
+		if state.expiration <= now {
+			delete(this.states, key)
+		}
+	}
+	this.pruneSize = 2 * len(this.states)
+	if this.pruneSize < minPruneSize {
+		this.pruneSize = minPruneSize
+	}
+}
+
+func descriptorKey(descriptor *ratelimitv3.RateLimitDescriptor) string {
+	key := ""
+	for i, entry := range descriptor.Entries {
+		if i > 0 {
+			key += ","
+		}
+		key += entry.Key + "=" + entry.Value
+	}
+	return key
+}
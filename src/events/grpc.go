@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The events are served by the ratelimit.events.v1.RateLimitEvents service, whose messages are well
+// known types so that the clients need no generated code, see api/ratelimit/events/v1/events.proto:
+//
+//	rpc StreamEvents(google.protobuf.StringValue) returns (stream google.protobuf.Struct)
+//
+// The request is the domain of the events, empty for every domain.
+const (
+	ServiceName        = "ratelimit.events.v1.RateLimitEvents"
+	streamEventsMethod = "/" + ServiceName + "/StreamEvents"
+)
+
+// EventsServer is the server of the RateLimitEvents service.
+type EventsServer interface {
+	StreamEvents(request *wrapperspb.StringValue, stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*EventsServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       streamEventsHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "ratelimit/events/v1/events.proto",
+}
+
+func streamEventsHandler(srv interface{}, stream grpc.ServerStream) error {
+	request := &wrapperspb.StringValue{}
+	if err := stream.RecvMsg(request); err != nil {
+		return err
+	}
+	return srv.(EventsServer).StreamEvents(request, stream)
+}
+
+// RegisterEventsServer registers the RateLimitEvents service of server on registrar.
+func RegisterEventsServer(registrar grpc.ServiceRegistrar, server EventsServer) {
+	registrar.RegisterService(&serviceDesc, server)
+}
+
+// StreamEvents streams the events of the domain of the request to a subscriber until it goes away.
+func (this *Broker) StreamEvents(request *wrapperspb.StringValue, stream grpc.ServerStream) error {
+	subscription := this.Subscribe(request.GetValue())
+	defer subscription.Close()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-subscription.Events():
+			if err := stream.SendMsg(event.ToStruct()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ToStruct returns the event as a Struct, with the fields of its JSON encoding.
+func (this Event) ToStruct() *structpb.Struct {
+	descriptor := make([]*structpb.Value, len(this.Descriptor))
+	for i, entry := range this.Descriptor {
+		descriptor[i] = structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"key":   structpb.NewStringValue(entry.Key),
+			"value": structpb.NewStringValue(entry.Value),
+		}})
+	}
+	fields := map[string]*structpb.Value{
+		"type":              structpb.NewStringValue(string(this.Type)),
+		"domain":            structpb.NewStringValue(this.Domain),
+		"descriptor":        structpb.NewListValue(&structpb.ListValue{Values: descriptor}),
+		"requests_per_unit": structpb.NewNumberValue(float64(this.RequestsPerUnit)),
+		"unit":              structpb.NewStringValue(this.Unit),
+		"limit_remaining":   structpb.NewNumberValue(float64(this.LimitRemaining)),
+		"time":              structpb.NewNumberValue(float64(this.Time)),
+	}
+	if this.LimitName != "" {
+		fields["limit_name"] = structpb.NewStringValue(this.LimitName)
+	}
+	return &structpb.Struct{Fields: fields}
+}
+
+// EventsStream receives the events streamed by a RateLimitEvents service.
+type EventsStream interface {
+	Recv() (*structpb.Struct, error)
+	grpc.ClientStream
+}
+
+type eventsStream struct {
+	grpc.ClientStream
+}
+
+func (this *eventsStream) Recv() (*structpb.Struct, error) {
+	event := &structpb.Struct{}
+	if err := this.ClientStream.RecvMsg(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// StreamEvents subscribes to the events of domain, of every domain if domain is empty, on the
+// RateLimitEvents service of conn. The stream ends when ctx is done.
+func StreamEvents(ctx context.Context, conn grpc.ClientConnInterface, domain string, opts ...grpc.CallOption) (EventsStream, error) {
+	stream, err := conn.NewStream(ctx, &serviceDesc.Streams[0], streamEventsMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(wrapperspb.String(domain)); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &eventsStream{stream}, nil
+}
@@ -0,0 +1,90 @@
+package flags
+
+import (
+	"path/filepath"
+
+	"github.com/lyft/goruntime/loader"
+	"github.com/lyft/goruntime/snapshot"
+	gostats "github.com/lyft/gostats"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// The features gated by the flags, only the features changing the behavior of the existing limits
+// are. The features opted into by the configuration, like the leaky buckets, are not gated.
+const (
+	// RedisGetCoalescing shares the GETs of the concurrent requests for the same hot key in the
+	// near limit checks of STOP_CACHE_KEY_INCREMENT_WHEN_OVERLIMIT.
+	RedisGetCoalescing = "redis.get_coalescing"
+)
+
+// Flags gate the features listed above, so that they can be canaried on a percentage of the
+// requests or on some domains without a redeploy.
+type Flags interface {
+	// Enabled tells whether feature is enabled for a request of domain. The feature is enabled
+	// for the percentage of the requests of the runtime key "domains.<domain>.<feature>", else of
+	// the runtime key "<feature>", else of defaultPercentage.
+	Enabled(feature string, domain string, defaultPercentage uint64) bool
+}
+
+type runtimeFlags struct {
+	snapshot func() snapshot.IFace
+}
+
+func (this *runtimeFlags) Enabled(feature string, domain string, defaultPercentage uint64) bool {
+	snapshot := this.snapshot()
+	key := "domains." + domain + "." + feature
+	if snapshot.Get(key) == "" {
+		key = feature
+	}
+	return snapshot.FeatureEnabled(key, defaultPercentage)
+}
+
+// NewRuntimeFlags reads the flags from the snapshots of runtime.
+func NewRuntimeFlags(runtime loader.IFace) Flags {
+	return &runtimeFlags{snapshot: runtime.Snapshot}
+}
+
+// NewStaticFlags returns the flags without runtime, each feature is enabled for its default
+// percentage of the requests.
+func NewStaticFlags() Flags {
+	empty := snapshot.New()
+	return &runtimeFlags{snapshot: func() snapshot.IFace { return empty }}
+}
+
+// NewFlagsFromSettings loads the flags from the FEATURE_FLAGS_DIRECTORY of the runtime, the flags
+// are static when it is not set.
+func NewFlagsFromSettings(s settings.Settings, rootStore gostats.Store) (Flags, error) {
+	if s.FeatureFlagsDirectory == "" {
+		return NewStaticFlags(), nil
+	}
+
+	loaderOpts := []loader.Option{loader.AllowDotFiles}
+	if s.RuntimeIgnoreDotFiles {
+		loaderOpts = []loader.Option{loader.IgnoreDotFiles}
+	}
+	scope := rootStore.ScopeWithTags("feature_flags", s.ExtraTags)
+	var runtime loader.IFace
+	var err error
+	if s.RuntimeWatchRoot {
+		runtime, err = loader.New2(
+			s.RuntimePath,
+			filepath.Join(s.RuntimeSubdirectory, s.FeatureFlagsDirectory),
+			scope,
+			&loader.SymlinkRefresher{RuntimePath: s.RuntimePath},
+			loaderOpts...)
+	} else {
+		directoryRefresher := &loader.DirectoryRefresher{}
+		directoryRefresher.WatchFileSystemOps(loader.Remove, loader.Write, loader.Create, loader.Chmod)
+		runtime, err = loader.New2(
+			filepath.Join(s.RuntimePath, s.RuntimeSubdirectory),
+			s.FeatureFlagsDirectory,
+			scope,
+			directoryRefresher,
+			loaderOpts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewRuntimeFlags(runtime), nil
+}
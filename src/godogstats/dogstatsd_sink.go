@@ -60,6 +60,16 @@ func WithMogrifierFromEnv(keys []string) goDogStatsSinkOption {
 	}
 }
 
+// WithRateLimitTags emits the domain and descriptor key of the rate limit stats as tags instead of
+// in the metric names when enabled. The mogrifiers added before take precedence.
+func WithRateLimitTags(enabled bool) goDogStatsSinkOption {
+	return func(g *godogStatsSink) {
+		if enabled {
+			g.mogrifier = append(g.mogrifier, rateLimitTagsMogrifierMap()...)
+		}
+	}
+}
+
 func NewSink(opts ...goDogStatsSinkOption) (*godogStatsSink, error) {
 	sink := &godogStatsSink{}
 	for _, opt := range opts {
@@ -114,3 +114,29 @@ func (m *mogrifierMap) mogrify(name string) (string, []string) {
 	// no mogrification
 	return name, nil
 }
+
+// rateLimitTagsMogrifierMap turns the domain and descriptor key of the rate limit stats into the
+// domain and key tags, e.g. ratelimit.service.rate_limit.mongo_cps.database_users.total_hits into
+// ratelimit.service.rate_limit.total_hits with the tags domain:mongo_cps and key:database_users.
+func rateLimitTagsMogrifierMap() mogrifierMap {
+	return mogrifierMap{
+		{
+			matcher: regexp.MustCompile(`^ratelimit\.service\.rate_limit\.([^.]+)\.(domain_not_found)$`),
+			handler: func(matches []string) (string, []string) {
+				return "ratelimit.service.rate_limit." + matches[2], []string{"domain:" + matches[1]}
+			},
+		},
+		{
+			matcher: regexp.MustCompile(`^ratelimit\.service\.rate_limit\.([^.]+)\.(.+)\.(total_hits|over_limit|near_limit|over_limit_with_local_cache|within_limit|shadow_mode)$`),
+			handler: func(matches []string) (string, []string) {
+				return "ratelimit.service.rate_limit." + matches[3], []string{"domain:" + matches[1], "key:" + matches[2]}
+			},
+		},
+		{
+			matcher: regexp.MustCompile(`^ratelimit\.service\.domain\.([^.]+)\.([^.]+)$`),
+			handler: func(matches []string) (string, []string) {
+				return "ratelimit.service.domain." + matches[2], []string{"domain:" + matches[1]}
+			},
+		},
+	}
+}
@@ -203,3 +203,44 @@ func TestValidation(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestRateLimitTagsMogrifier(t *testing.T) {
+	m := rateLimitTagsMogrifierMap()
+	tests := []struct {
+		input        string
+		expectOutput string
+		expectedTags []string
+	}{
+		{
+			input:        "ratelimit.service.rate_limit.mongo_cps.database_users.total_hits",
+			expectOutput: "ratelimit.service.rate_limit.total_hits",
+			expectedTags: []string{"domain:mongo_cps", "key:database_users"},
+		},
+		{
+			input:        "ratelimit.service.rate_limit.messaging.message_type_marketing.to_number.over_limit_with_local_cache",
+			expectOutput: "ratelimit.service.rate_limit.over_limit_with_local_cache",
+			expectedTags: []string{"domain:messaging", "key:message_type_marketing.to_number"},
+		},
+		{
+			input:        "ratelimit.service.rate_limit.unknown.domain_not_found",
+			expectOutput: "ratelimit.service.rate_limit.domain_not_found",
+			expectedTags: []string{"domain:unknown"},
+		},
+		{
+			input:        "ratelimit.service.domain.messaging.near_limit",
+			expectOutput: "ratelimit.service.domain.near_limit",
+			expectedTags: []string{"domain:messaging"},
+		},
+		{
+			input:        "ratelimit.service.config_load_success",
+			expectOutput: "ratelimit.service.config_load_success",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			name, tags := m.mogrify(tt.input)
+			assert.Equal(t, tt.expectOutput, name)
+			assert.Equal(t, tt.expectedTags, tags)
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package limiter
 
 import (
+	"bytes"
 	"math"
 	"math/rand"
+	"sync/atomic"
+	"time"
 
 	"github.com/coocood/freecache"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	logger "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	"github.com/envoyproxy/ratelimit/src/assert"
 	"github.com/envoyproxy/ratelimit/src/config"
@@ -20,16 +24,35 @@ type BaseRateLimiter struct {
 	ExpirationJitterMaxSeconds int64
 	cacheKeyGenerator          CacheKeyGenerator
 	localCache                 *freecache.Cache
-	nearLimitRatio             float32
+	nearLimitRatio             atomic.Uint32 // bits of the float32 ratio, see SetNearLimitRatio
 	StatsManager               stats.Manager
+	// Timing times the phases of DoLimit in the caches.
+	Timing           stats.ShouldRateLimitTimingStats
+	localCachePolicy LocalCachePolicy
+	// perSecondCache stores the keys of the one second windows instead of localCache, nil unless
+	// enabled by the local cache policy.
+	perSecondCache *perSecondCache
+	// expirationJitterPolicy overrides ExpirationJitterMaxSeconds per unit, see ExpirationSeconds.
+	expirationJitterPolicy ExpirationJitterPolicy
 }
 
+// nearLimitMarker is the value of the near-the-limit keys of the local cache, the over-the-limit
+// keys having another value.
+var nearLimitMarker = []byte{'n'}
+
 type LimitInfo struct {
 	limit               *config.RateLimit
 	limitBeforeIncrease uint64
 	limitAfterIncrease  uint64
 	nearLimitThreshold  uint64
 	overLimitThreshold  uint64
+	// durationUntilReset is the remaining duration of the window of a request aligned limit, nil to
+	// compute it from the wall clock.
+	durationUntilReset *durationpb.Duration
+	// remaining is the exact remaining duration of the window of a request aligned limit, 0 if unknown.
+	remaining time.Duration
+	// credit is the number of requests carried over from the previous window.
+	credit uint64
 }
 
 func NewRateLimitInfo(limit *config.RateLimit, limitBeforeIncrease uint64, limitAfterIncrease uint64,
@@ -41,40 +64,175 @@ func NewRateLimitInfo(limit *config.RateLimit, limitBeforeIncrease uint64, limit
 	}
 }
 
+// SetCredit sets the number of requests carried over from the previous window, which are admitted
+// over the limit.
+func (this *LimitInfo) SetCredit(credit uint64) {
+	this.credit = credit
+}
+
+// SetDurationUntilReset sets the remaining duration of the window of a request aligned limit, read
+// from the backend.
+func (this *LimitInfo) SetDurationUntilReset(remaining time.Duration) {
+	this.durationUntilReset = &durationpb.Duration{Seconds: int64((remaining + time.Second - 1) / time.Second)}
+	this.remaining = remaining
+}
+
+// SetMaxDurationUntilReset sets a bound of the remaining duration of the window of a request aligned
+// limit, for the backends which don't return the expiration of its key. Its status isn't kept by the
+// local cache, whose entry couldn't expire with the key.
+func (this *LimitInfo) SetMaxDurationUntilReset(max time.Duration) {
+	this.durationUntilReset = &durationpb.Duration{Seconds: int64((max + time.Second - 1) / time.Second)}
+}
+
+// setDurationUntilReset replaces the duration until the reset of the status by the one read from the
+// backend, if any.
+func (this *LimitInfo) setDurationUntilReset(status *pb.RateLimitResponse_DescriptorStatus) {
+	if this.durationUntilReset != nil {
+		status.DurationUntilReset = this.durationUntilReset
+	}
+}
+
 // Generates cache keys for given rate limit request. Each cache key is represented by a concatenation of
 // domain, descriptor and current timestamp.
 func (this *BaseRateLimiter) GenerateCacheKeys(request *pb.RateLimitRequest,
 	limits []*config.RateLimit, hitsAddends []uint64,
+) []CacheKey {
+	cacheKeys := this.generateCacheKeysAt(request, limits, this.timeSource.UnixNow())
+	for i, limit := range limits {
+		// Increase statistics for limits hit by their respective requests.
+		if limit != nil {
+			limit.Stats.TotalHits.Add(hitsAddends[i])
+		}
+	}
+	return cacheKeys
+}
+
+// generateCacheKeysAt generates the cache keys of the windows at now, without counting the hits.
+func (this *BaseRateLimiter) generateCacheKeysAt(request *pb.RateLimitRequest,
+	limits []*config.RateLimit, now int64,
 ) []CacheKey {
 	assert.Assert(len(request.Descriptors) == len(limits))
 	cacheKeys := make([]CacheKey, len(request.Descriptors))
-	now := this.timeSource.UnixNow()
 	for i := 0; i < len(request.Descriptors); i++ {
 		// generateCacheKey() returns an empty string in the key if there is no limit
 		// so that we can keep the arrays all the same size.
 		cacheKeys[i] = this.cacheKeyGenerator.GenerateCacheKey(request.Domain, request.Descriptors[i], limits[i], now)
-		// Increase statistics for limits hit by their respective requests.
-		if limits[i] != nil {
-			limits[i].Stats.TotalHits.Add(hitsAddends[i])
-		}
 	}
 	return cacheKeys
 }
 
+// GetHitsAddends returns the hits addend of each descriptor of the request multiplied by the cost of
+// its limit.
+func GetHitsAddends(request *pb.RateLimitRequest, limits []*config.RateLimit) []uint64 {
+	hitsAddends := utils.GetHitsAddends(request)
+	for i, limit := range limits {
+		if limit != nil && limit.Cost > 1 {
+			hitsAddends[i] *= uint64(limit.Cost)
+		}
+	}
+	return hitsAddends
+}
+
 // Returns `true` in case local cache is enabled and contains value for provided cache key, `false` otherwise.
-func (this *BaseRateLimiter) IsOverLimitWithLocalCache(key string) bool {
+// The lookups count in the local cache hits and misses of the domain.
+func (this *BaseRateLimiter) IsOverLimitWithLocalCache(domain string, key string) bool {
 	if this.localCache != nil {
+		domainStats := this.StatsManager.NewDomainStats(domain)
+		if this.perSecondCache != nil {
+			if _, overLimit := this.perSecondCache.get(key); overLimit {
+				domainStats.LocalCacheHit.Inc()
+				return true
+			}
+		}
 		// Get returns the value or not found error.
-		_, err := this.localCache.Get([]byte(key))
-		if err == nil {
+		value, err := this.localCache.Get([]byte(key))
+		if err == nil && !bytes.Equal(value, nearLimitMarker) {
+			domainStats.LocalCacheHit.Inc()
 			return true
 		}
+		domainStats.LocalCacheMiss.Inc()
 	}
 	return false
 }
 
+// Returns `true` in case the local cache stores the near-the-limit keys and contains the provided cache
+// key, near or over the limit.
+func (this *BaseRateLimiter) IsNearLimitWithLocalCache(key string) bool {
+	if this.localCache == nil || !this.localCachePolicy.NearLimit {
+		return false
+	}
+	if this.perSecondCache != nil {
+		if found, _ := this.perSecondCache.get(key); found {
+			return true
+		}
+	}
+	_, err := this.localCache.Get([]byte(key))
+	return err == nil
+}
+
+// LocalCacheStoresNearLimit returns whether the local cache stores the near-the-limit keys.
+func (this *BaseRateLimiter) LocalCacheStoresNearLimit() bool {
+	return this.localCache != nil && this.localCachePolicy.NearLimit
+}
+
+// SetLocalCachePolicy changes the TTL of the entries of the local cache, whether it stores the
+// near-the-limit keys and where it stores the keys of the one second windows. It must be called
+// before the first request.
+func (this *BaseRateLimiter) SetLocalCachePolicy(policy LocalCachePolicy) {
+	this.localCachePolicy = policy
+	this.perSecondCache = nil
+	if policy.PerSecond {
+		this.perSecondCache = newPerSecondCache(policy.PerSecondMaxKeys)
+	}
+}
+
+// setLocalCache stores the key of the status in the local cache, over or near the limit, the keys
+// of the clock aligned one second windows being stored until the end of their window in the per
+// second cache when enabled.
+func (this *BaseRateLimiter) setLocalCache(key string, limitInfo *LimitInfo,
+	status *pb.RateLimitResponse_DescriptorStatus, overLimit bool,
+) {
+	limit := limitInfo.limit
+	if this.perSecondCache != nil && !limit.RequestAligned &&
+		utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier) == 1 {
+		this.perSecondCache.set(key, status.DurationUntilReset.AsDuration(), overLimit)
+		return
+	}
+	value := nearLimitMarker
+	if overLimit {
+		value = []byte{}
+	}
+	ttl, ok := this.localCacheTtl(limitInfo, status)
+	if !ok {
+		return
+	}
+	if err := this.localCache.Set([]byte(key), value, ttl); err != nil {
+		logger.Errorf("Failing to set local cache key: %s", key)
+	}
+}
+
+// localCacheTtl returns the TTL in seconds of the local cache entry of the status of a descriptor,
+// the remaining duration of its window bounded by the policy, at least 1 second since 0 never expires.
+// The key of a request aligned window is reused by the next window, so that its entry must expire
+// with the key: its TTL is the remaining PTTL of the key rounded down without minimum, false if
+// less than a second is left or the PTTL is unknown.
+func (this *BaseRateLimiter) localCacheTtl(limitInfo *LimitInfo, status *pb.RateLimitResponse_DescriptorStatus) (int, bool) {
+	ttl := status.DurationUntilReset.AsDuration()
+	if limitInfo.limit.RequestAligned {
+		ttl = limitInfo.remaining
+	}
+	if this.localCachePolicy.MaxTtl > 0 && ttl > this.localCachePolicy.MaxTtl {
+		ttl = this.localCachePolicy.MaxTtl
+	}
+	if limitInfo.limit.RequestAligned {
+		return int(ttl / time.Second), ttl >= time.Second
+	}
+	ttl = max(ttl, this.localCachePolicy.MinTtl, time.Second)
+	return int(ttl / time.Second), true
+}
+
 func (this *BaseRateLimiter) IsOverLimitThresholdReached(limitInfo *LimitInfo) bool {
-	limitInfo.overLimitThreshold = uint64(limitInfo.limit.Limit.RequestsPerUnit)
+	limitInfo.overLimitThreshold = uint64(limitInfo.limit.Limit.RequestsPerUnit) + limitInfo.credit
 	return limitInfo.limitAfterIncrease > limitInfo.overLimitThreshold
 }
 
@@ -94,39 +252,51 @@ func (this *BaseRateLimiter) GetResponseDescriptorStatus(key string, limitInfo *
 		limitInfo.limit.Stats.OverLimit.Add(hitsAddend)
 		limitInfo.limit.Stats.OverLimitWithLocalCache.Add(hitsAddend)
 		responseDescriptorStatus = this.generateResponseDescriptorStatus(pb.RateLimitResponse_OVER_LIMIT,
-			limitInfo.limit.Limit, 0)
+			limitInfo.limit, 0)
+		if limitInfo.limit.RequestAligned {
+			// the local cache entry expires with the window of the key
+			if ttl, err := this.localCache.TTL([]byte(key)); err == nil {
+				responseDescriptorStatus.DurationUntilReset = &durationpb.Duration{Seconds: int64(ttl)}
+			}
+		}
 	} else {
-		limitInfo.overLimitThreshold = uint64(limitInfo.limit.Limit.RequestsPerUnit)
+		limitInfo.overLimitThreshold = uint64(limitInfo.limit.Limit.RequestsPerUnit) + limitInfo.credit
 		// The nearLimitThreshold is the number of requests that can be made before hitting the nearLimitRatio.
 		// We need to know it in both the OK and OVER_LIMIT scenarios.
-		limitInfo.nearLimitThreshold = uint64(math.Floor(float64(float32(limitInfo.overLimitThreshold) * this.nearLimitRatio)))
+		limitInfo.nearLimitThreshold = uint64(math.Floor(float64(float32(limitInfo.overLimitThreshold) * this.NearLimitRatio())))
 		logger.Debugf("cache key: %s current: %d", key, limitInfo.limitAfterIncrease)
 		if limitInfo.limitAfterIncrease > limitInfo.overLimitThreshold {
 			isOverLimit = true
 			responseDescriptorStatus = this.generateResponseDescriptorStatus(pb.RateLimitResponse_OVER_LIMIT,
-				limitInfo.limit.Limit, 0)
+				limitInfo.limit, 0)
+			limitInfo.setDurationUntilReset(responseDescriptorStatus)
+
+			// the over limit of a limit spilling over is recorded by the service once no tier admits
+			// the request, and it is not cached as the next tier may admit the next requests
+			if limitInfo.limit.SpillsOver {
+				return responseDescriptorStatus
+			}
 
 			this.checkOverLimitThreshold(limitInfo, hitsAddend)
 
 			if this.localCache != nil {
-				// Set the TTL of the local_cache to be the entire duration.
+				// The TTL of the local_cache is the remaining duration of the window, bounded by the policy.
 				// Since the cache_key gets changed once the time crosses over current time slot, the over-the-limit
-				// cache keys in local_cache lose effectiveness.
+				// cache keys in local_cache lose effectiveness after it anyway.
 				// For example, if we have an hour limit on all mongo connections, the cache key would be
 				// similar to mongo_1h, mongo_2h, etc. In the hour 1 (0h0m - 0h59m), the cache key is mongo_1h, we start
-				// to get ratelimited in the 50th minute, the ttl of local_cache will be set as 1 hour(0h50m-1h49m).
-				// In the time of 1h1m, since the cache key becomes different (mongo_2h), it won't get ratelimited.
-				err := this.localCache.Set([]byte(key), []byte{}, int(utils.UnitToDivider(limitInfo.limit.Limit.Unit)))
-				if err != nil {
-					logger.Errorf("Failing to set local cache key: %s", key)
-				}
+				// to get ratelimited in the 50th minute, the ttl of local_cache will be set as 10 minutes(0h50m-0h59m).
+				this.setLocalCache(key, limitInfo, responseDescriptorStatus, true)
 			}
 		} else {
 			responseDescriptorStatus = this.generateResponseDescriptorStatus(pb.RateLimitResponse_OK,
-				limitInfo.limit.Limit, uint32(limitInfo.overLimitThreshold-limitInfo.limitAfterIncrease))
+				limitInfo.limit, uint32(limitInfo.overLimitThreshold-limitInfo.limitAfterIncrease))
+			limitInfo.setDurationUntilReset(responseDescriptorStatus)
 
 			// The limit is OK but we additionally want to know if we are near the limit.
-			this.checkNearLimitThreshold(limitInfo, hitsAddend)
+			if this.checkNearLimitThreshold(limitInfo, hitsAddend) && this.LocalCacheStoresNearLimit() {
+				this.setLocalCache(key, limitInfo, responseDescriptorStatus, false)
+			}
 			limitInfo.limit.Stats.WithinLimit.Add(uint64(hitsAddend))
 		}
 	}
@@ -142,18 +312,61 @@ func (this *BaseRateLimiter) GetResponseDescriptorStatus(key string, limitInfo *
 	return responseDescriptorStatus
 }
 
+// GetPenaltyDescriptorStatus generates the response descriptor status of a descriptor in the penalty
+// box of its limit, over the limit until the end of the ban whatever its counter.
+func (this *BaseRateLimiter) GetPenaltyDescriptorStatus(limit *config.RateLimit, remaining time.Duration,
+	hitsAddend uint64,
+) *pb.RateLimitResponse_DescriptorStatus {
+	limit.Stats.OverLimit.Add(hitsAddend)
+	responseDescriptorStatus := &pb.RateLimitResponse_DescriptorStatus{
+		Code:               pb.RateLimitResponse_OVER_LIMIT,
+		CurrentLimit:       limit.CurrentLimit(),
+		DurationUntilReset: &durationpb.Duration{Seconds: int64((remaining + time.Second - 1) / time.Second)},
+	}
+	if limit.ShadowMode {
+		logger.Debugf("Limit with key %s, is in shadow_mode", limit.FullKey)
+		responseDescriptorStatus.Code = pb.RateLimitResponse_OK
+		limit.Stats.ShadowMode.Add(hitsAddend)
+	}
+	return responseDescriptorStatus
+}
+
 func NewBaseRateLimit(timeSource utils.TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64,
 	localCache *freecache.Cache, nearLimitRatio float32, cacheKeyPrefix string, statsManager stats.Manager,
 ) *BaseRateLimiter {
-	return &BaseRateLimiter{
+	ret := &BaseRateLimiter{
 		timeSource:                 timeSource,
 		JitterRand:                 jitterRand,
 		ExpirationJitterMaxSeconds: expirationJitterMaxSeconds,
 		cacheKeyGenerator:          NewCacheKeyGenerator(cacheKeyPrefix),
 		localCache:                 localCache,
-		nearLimitRatio:             nearLimitRatio,
 		StatsManager:               statsManager,
+		Timing:                     statsManager.NewShouldRateLimitStats().Timing,
+		localCachePolicy:           LocalCachePolicy{MinTtl: time.Second},
 	}
+	ret.SetNearLimitRatio(nearLimitRatio)
+	return ret
+}
+
+func (this *BaseRateLimiter) NearLimitRatio() float32 {
+	return math.Float32frombits(this.nearLimitRatio.Load())
+}
+
+// SetNearLimitRatio changes the near limit ratio of the next requests, it may be called while
+// requests are in flight.
+func (this *BaseRateLimiter) SetNearLimitRatio(ratio float32) {
+	this.nearLimitRatio.Store(math.Float32bits(ratio))
+}
+
+// SetCacheKeyMaxLength truncates and hashes the descriptor entries of the cache keys longer than
+// maxLength, each compressed key counting in ratelimit.service.cache_key_compressed.
+func (this *BaseRateLimiter) SetCacheKeyMaxLength(maxLength int) {
+	this.cacheKeyGenerator.SetMaxEntriesLength(maxLength, this.StatsManager.NewServiceStats().CacheKeyCompressed)
+}
+
+// DomainPrefix returns the start of the cache keys of a domain.
+func (this *BaseRateLimiter) DomainPrefix(domain string) string {
+	return this.cacheKeyGenerator.DomainPrefix(domain)
 }
 
 func (this *BaseRateLimiter) checkOverLimitThreshold(limitInfo *LimitInfo, hitsAddend uint64) {
@@ -173,7 +386,8 @@ func (this *BaseRateLimiter) checkOverLimitThreshold(limitInfo *LimitInfo, hitsA
 	}
 }
 
-func (this *BaseRateLimiter) checkNearLimitThreshold(limitInfo *LimitInfo, hitsAddend uint64) {
+// checkNearLimitThreshold counts the near limit hits and returns whether the limit is near.
+func (this *BaseRateLimiter) checkNearLimitThreshold(limitInfo *LimitInfo, hitsAddend uint64) bool {
 	if limitInfo.limitAfterIncrease > limitInfo.nearLimitThreshold {
 		// Here we also need to assess which portion of the hitsAddend were in the near limit range.
 		// If all the hits were over the nearLimitThreshold, then all hits are near limit. Otherwise,
@@ -184,7 +398,9 @@ func (this *BaseRateLimiter) checkNearLimitThreshold(limitInfo *LimitInfo, hitsA
 		} else {
 			limitInfo.limit.Stats.NearLimit.Add(limitInfo.limitAfterIncrease - limitInfo.nearLimitThreshold)
 		}
+		return true
 	}
+	return false
 }
 
 func (this *BaseRateLimiter) increaseShadowModeStats(isOverLimitWithLocalCache bool, limitInfo *LimitInfo, hitsAddend uint64) {
@@ -198,19 +414,18 @@ func (this *BaseRateLimiter) increaseShadowModeStats(isOverLimitWithLocalCache b
 }
 
 func (this *BaseRateLimiter) generateResponseDescriptorStatus(responseCode pb.RateLimitResponse_Code,
-	limit *pb.RateLimitResponse_RateLimit, limitRemaining uint32,
+	limit *config.RateLimit, limitRemaining uint32,
 ) *pb.RateLimitResponse_DescriptorStatus {
 	if limit != nil {
 		return &pb.RateLimitResponse_DescriptorStatus{
 			Code:               responseCode,
-			CurrentLimit:       limit,
+			CurrentLimit:       limit.CurrentLimit(),
 			LimitRemaining:     limitRemaining,
-			DurationUntilReset: utils.CalculateReset(&limit.Unit, this.timeSource),
+			DurationUntilReset: utils.CalculateResetWithDivider(utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier), this.timeSource),
 		}
 	} else {
 		return &pb.RateLimitResponse_DescriptorStatus{
 			Code:           responseCode,
-			CurrentLimit:   limit,
 			LimitRemaining: limitRemaining,
 		}
 	}
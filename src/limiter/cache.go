@@ -1,6 +1,8 @@
 package limiter
 
 import (
+	"time"
+
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"golang.org/x/net/context"
 
@@ -27,3 +29,215 @@ type RateLimitCache interface {
 	// since the memcache cache does increments in a background gorountine.
 	Flush()
 }
+
+// BackendProber is implemented by the caches which can check that their backend is reachable, which
+// the readiness of the service waits for.
+type BackendProber interface {
+	// ProbeBackend returns an error if the backend can't be reached.
+	ProbeBackend() error
+}
+
+// CounterValue is the current value of the counter of a limit.
+type CounterValue struct {
+	Key   string
+	Value uint64
+	// Ttl is the time until the counter of a request aligned limit expires, at the end of its window,
+	// 0 if the counter is missing or the backend can't read its expiration.
+	Ttl time.Duration
+}
+
+// CounterReader is implemented by the caches which can read the counters without incrementing them.
+type CounterReader interface {
+	// Read the counters of a set of descriptors and limits, as DoLimit would use them.
+	// @param ctx supplies the request context.
+	// @param request supplies the request whose descriptors are read, its hits addends are ignored.
+	// @param limits supplies the list of associated limits, the counter of a nil limit is not read.
+	// @return the counter of each descriptor/limit pair, with an empty key for a nil limit.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	GetCounters(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []CounterValue
+}
+
+// PenaltyValue is the remaining ban of the penalty box of a limit.
+type PenaltyValue struct {
+	Key       string
+	Remaining time.Duration
+}
+
+// PenaltyBox is implemented by the caches which place the descriptors of the limits with a penalty
+// in a penalty box.
+type PenaltyBox interface {
+	// Read the bans of a set of descriptors and limits.
+	// @param ctx supplies the request context.
+	// @param request supplies the request whose descriptors are read, its hits addends are ignored.
+	// @param limits supplies the list of associated limits, a limit without penalty is not read.
+	// @return the ban of each descriptor/limit pair, with an empty key for a limit without penalty
+	//         and a zero remaining duration for a descriptor which is not banned.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	GetPenalties(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []PenaltyValue
+
+	// Release a set of descriptors from the penalty box and forget their over-limits.
+	// @return the ban each descriptor/limit pair had, as GetPenalties.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	ClearPenalties(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []PenaltyValue
+}
+
+// LeaseValue is the lease of a concurrency limit.
+type LeaseValue struct {
+	Key string
+	// Acquired is also set for a limit in shadow mode at its maximum, which admits the request
+	// without holding the lease.
+	Acquired bool
+	// InFlight is the number of leases held on the descriptor, including the acquired lease.
+	InFlight uint32
+}
+
+// ConcurrencyLimiter is implemented by the caches which hold the leases of the concurrency limits.
+type ConcurrencyLimiter interface {
+	// Acquire a lease on a set of descriptors and limits, or renew it if it is already held. The
+	// lease is acquired on every descriptor or on none, the leases acquired by the call being
+	// released if a descriptor is at its maximum.
+	// @param ctx supplies the request context.
+	// @param request supplies the request whose descriptors are leased, its hits addends are ignored.
+	// @param limits supplies the list of associated limits, a limit without concurrency is not leased.
+	// @param leaseId supplies the identifier of the lease.
+	// @return the lease of each descriptor/limit pair, with an empty key for a limit without
+	//         concurrency. Throws RedisError if there was any error talking to the cache.
+	AcquireLeases(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, leaseId string) []LeaseValue
+
+	// Release a lease on a set of descriptors and limits, releasing a lease which isn't held is a no-op.
+	// @return the lease of each descriptor/limit pair once released, as AcquireLeases.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	ReleaseLeases(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, leaseId string) []LeaseValue
+}
+
+// RefundValue is the counter of a limit once refunded.
+type RefundValue struct {
+	Key   string
+	Value uint64
+	// Refunded is the number of hits removed from the counter, less than the hits addend when the
+	// counter is clamped at zero.
+	Refunded uint64
+}
+
+// Refunder is implemented by the caches which can give back the hits of the requests whose
+// operation was rolled back.
+type Refunder interface {
+	// Remove the hits of a set of descriptors from the counters of their limits, clamping them at
+	// zero. A missing counter is not created.
+	// @param ctx supplies the request context.
+	// @param request supplies the request whose hits addends, with the cost of the limits, are refunded.
+	// @param limits supplies the list of associated limits, a nil limit or a limit without counter,
+	//               such as a leaky bucket or a concurrency limit, is not refunded.
+	// @param countedAt supplies the Unix time the request was counted at, whose windows are refunded.
+	// @return the counter of each descriptor/limit pair once refunded, with an empty key for the
+	//         limits which are not refunded. Throws RedisError if there was any error talking to the cache.
+	RefundHits(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, countedAt int64) []RefundValue
+}
+
+// UsageValue is a counter listed by a CounterScanner.
+type UsageValue struct {
+	Key   string
+	Value uint64
+	// Ttl is the time until the counter expires, at the end of its window.
+	Ttl time.Duration
+}
+
+// CounterScanner is implemented by the caches which can list the counters of a domain.
+type CounterScanner interface {
+	// List the counters of a domain whose cache key continues with a prefix after the domain, the
+	// descriptor entries being written key_value_ in the cache keys, e.g. "user_" for the
+	// descriptors starting with the key user. The hashed descriptor entries can't be matched.
+	// @param ctx supplies the request context.
+	// @param domain supplies the domain of the counters.
+	// @param prefix supplies the start of the descriptor entries of the counters, empty for all.
+	// @param max supplies the maximum number of counters returned.
+	// @param maxScans supplies the maximum number of scans of the keyspace, each one examining a
+	//                 batch of keys, after which the counters found so far are returned.
+	// @return the counters, in no particular order. Throws RedisError if there was any error
+	//         talking to the cache.
+	ScanCounters(ctx context.Context, domain string, prefix string, max int, maxScans int) []UsageValue
+}
+
+// ReservationValue is the hold of a reservation on the counter of a limit.
+type ReservationValue struct {
+	Key string
+	// Held is true if the hold is taken by Reserve, or was still held when committed or cancelled.
+	Held bool
+	// Value is the counter, including the hits held by the reservations.
+	Value uint64
+}
+
+// Reserver is implemented by the caches which can hold hits for a two-phase operation: the hits are
+// reserved, counting against the limit while held, then committed or cancelled before the hold expires.
+type Reserver interface {
+	// Hold the hits of a set of descriptors on the counters of their limits. The hits are held on
+	// every descriptor or on none, the holds taken by the call being cancelled if a descriptor is
+	// over its limit.
+	// @param ctx supplies the request context.
+	// @param request supplies the request whose hits addends, with the cost of the limits, are held.
+	// @param limits supplies the list of associated limits, a nil limit or a limit without counter,
+	//               such as a leaky bucket or a concurrency limit, is not reserved.
+	// @param ttl supplies the time after which the hold expires and its hits are given back.
+	// @return the identifier of the reservation, see NewReservationId, and the hold of each
+	//         descriptor/limit pair, with an empty key for the limits which are not reserved.
+	//         Throws RedisError if there was any error talking to the cache.
+	Reserve(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, ttl time.Duration) (string, []ReservationValue)
+
+	// Commit a reservation, its hits staying counted. The request and the limits are those of Reserve.
+	// @return the hold of each descriptor/limit pair, which is not held if it expired.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	CommitReservation(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, reservationId string) []ReservationValue
+
+	// Cancel a reservation, giving back its hits. The request and the limits are those of Reserve.
+	// @return the hold of each descriptor/limit pair, as CommitReservation.
+	// 				 Throws RedisError if there was any error talking to the cache.
+	CancelReservation(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, reservationId string) []ReservationValue
+}
+
+// NearLimitRatioSetter is implemented by the caches whose near limit ratio can be changed at runtime.
+type NearLimitRatioSetter interface {
+	SetNearLimitRatio(ratio float32)
+}
+
+// CacheKeyMaxLengthSetter is implemented by the caches whose cache keys can be compressed.
+type CacheKeyMaxLengthSetter interface {
+	// @param maxLength supplies the length above which the descriptor entries of a cache key are
+	//                  truncated and hashed, 0 to keep them. Must be called before the first request.
+	SetCacheKeyMaxLength(maxLength int)
+}
+
+// LocalCachePolicy configures the entries of the local cache.
+type LocalCachePolicy struct {
+	// MinTtl and MaxTtl bound the TTL of the entries, the remaining duration of their window. A
+	// MaxTtl of 0 doesn't bound it.
+	MinTtl time.Duration
+	MaxTtl time.Duration
+	// NearLimit also stores the near-the-limit keys, so that the caches reading the counters before
+	// incrementing them only read the keys known to be near the limit.
+	NearLimit bool
+	// PerSecond stores the keys of the limits with a window of one second until the end of their
+	// window, which isn't a whole number of seconds, in a separate cache of at most PerSecondMaxKeys
+	// keys instead of the local cache.
+	PerSecond        bool
+	PerSecondMaxKeys int
+}
+
+// LocalCachePolicySetter is implemented by the caches using the local cache.
+type LocalCachePolicySetter interface {
+	// Must be called before the first request.
+	SetLocalCachePolicy(policy LocalCachePolicy)
+}
+
+// ExpirationJitterPolicySetter is implemented by the caches adding a jitter to the expiration of
+// their keys.
+type ExpirationJitterPolicySetter interface {
+	// Must be called before the first request.
+	SetExpirationJitterPolicy(policy ExpirationJitterPolicy)
+}
+
+// FailureModeSetter is implemented by the caches which answer with a failure mode when the backend
+// is unavailable, so that it can be changed at runtime.
+type FailureModeSetter interface {
+	// @param deny supplies whether to answer OVER_LIMIT, or OK, without the backend.
+	SetFailureModeDeny(deny bool)
+}
@@ -2,11 +2,16 @@ package limiter
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/cespare/xxhash/v2"
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	stats "github.com/lyft/gostats"
 
 	"github.com/envoyproxy/ratelimit/src/config"
 	"github.com/envoyproxy/ratelimit/src/utils"
@@ -14,6 +19,10 @@ import (
 
 type CacheKeyGenerator struct {
 	prefix string
+	// maxEntriesLength is the length above which the descriptor entries are truncated and hashed,
+	// 0 to keep them, and compressed counts the compressed keys.
+	maxEntriesLength int
+	compressed       stats.Counter
 	// bytes.Buffer pool used to efficiently generate cache keys.
 	bufferPool sync.Pool
 }
@@ -29,6 +38,25 @@ func NewCacheKeyGenerator(prefix string) CacheKeyGenerator {
 	}
 }
 
+// SetMaxEntriesLength truncates the descriptor entries of the cache keys longer than maxLength and
+// appends their hash, so that the long descriptor values (paths, JWT subjects...) do not inflate
+// the memory of the backend. It must be called before the first key is generated.
+func (this *CacheKeyGenerator) SetMaxEntriesLength(maxLength int, compressed stats.Counter) {
+	this.maxEntriesLength = maxLength
+	this.compressed = compressed
+}
+
+// requestAlignedSuffix replaces the start of the window in the cache keys of the request aligned
+// limits.
+const requestAlignedSuffix = "request"
+
+// leakyBucketSuffix replaces the start of the window in the keys of the leaky buckets.
+const leakyBucketSuffix = "bucket"
+
+// concurrencySuffix replaces the start of the window in the keys of the leases of the concurrency
+// limits.
+const concurrencySuffix = "leases"
+
 type CacheKey struct {
 	Key string
 	// True if the key corresponds to a limit with a SECOND unit. False otherwise.
@@ -62,27 +90,113 @@ func (this *CacheKeyGenerator) GenerateCacheKey(
 	b.WriteString(this.prefix)
 	b.WriteString(domain)
 	b.WriteByte('_')
+	entriesStart := b.Len()
 
 	for i, entry := range descriptor.Entries {
-		b.WriteString(entry.Key)
+		// the entries matched through a key set count with the first key of the set
+		if i < len(limit.KeySetKeys) && limit.KeySetKeys[i] != "" {
+			b.WriteString(limit.KeySetKeys[i])
+		} else {
+			b.WriteString(entry.Key)
+		}
 		b.WriteByte('_')
 		// If share_threshold is enabled for this entry index, use the wildcard pattern instead of the actual value
 		// Use entry index instead of key name to handle nested descriptors with same key names
 		valueToUse := entry.Value
+		if i < len(limit.ValueNormalizers) && limit.ValueNormalizers[i] != nil {
+			valueToUse = limit.ValueNormalizers[i].Normalize(valueToUse)
+		}
 		if limit != nil && limit.ShareThresholdKeyPattern != nil && i < len(limit.ShareThresholdKeyPattern) {
 			if wildcardPattern := limit.ShareThresholdKeyPattern[i]; wildcardPattern != "" {
 				valueToUse = wildcardPattern
 			}
 		}
+		// the values of a sharded rule are replaced by their bucket
+		if limit.ShardCount > 0 && i == len(descriptor.Entries)-1 {
+			valueToUse = "shard" + strconv.FormatUint(xxhash.Sum64String(valueToUse)%uint64(limit.ShardCount), 10)
+		}
 		b.WriteString(valueToUse)
 		b.WriteByte('_')
 	}
 
-	divider := utils.UnitToDivider(limit.Limit.Unit)
-	b.WriteString(strconv.FormatInt((now/divider)*divider, 10))
+	if limit.CacheKeyHash != "" {
+		// only the descriptor entries are hashed, the prefix and the domain stay readable
+		entriesHash := hashCacheKeyEntries(limit.CacheKeyHash, b.Bytes()[entriesStart:])
+		b.Truncate(entriesStart)
+		b.WriteString(entriesHash)
+		b.WriteByte('_')
+	} else if this.maxEntriesLength > 0 && b.Len()-entriesStart > this.maxEntriesLength {
+		// the truncated entries keep the key readable, the hash of the whole entries keeps it unique
+		entriesHash := hashCacheKeyEntries(config.CacheKeyHashXxhash, b.Bytes()[entriesStart:])
+		b.Truncate(entriesStart + this.maxEntriesLength)
+		b.WriteByte('_')
+		b.WriteString(entriesHash)
+		b.WriteByte('_')
+		this.compressed.Inc()
+	}
+
+	if limit.CacheKeyVersion != "" {
+		b.WriteByte('v')
+		b.WriteString(limit.CacheKeyVersion)
+		b.WriteByte('_')
+	}
+
+	if limit.IsQuota {
+		b.WriteString("quota_")
+	}
+
+	if limit.LeakyBucket != nil {
+		// the bucket drains continuously, it has no window
+		b.WriteString(leakyBucketSuffix)
+	} else if limit.Concurrency != nil {
+		// the leases expire on their own
+		b.WriteString(concurrencySuffix)
+	} else if limit.RequestAligned {
+		// the window starts with the key, which expires at its end
+		b.WriteString(requestAlignedSuffix)
+	} else {
+		divider := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+		b.WriteString(strconv.FormatInt((now/divider)*divider, 10))
+	}
 
 	return CacheKey{
 		Key:       b.String(),
 		PerSecond: isPerSecondLimit(limit.Limit.Unit),
 	}
 }
+
+// DomainPrefix returns the start of the cache keys of a domain, followed by the descriptor entries.
+func (this *CacheKeyGenerator) DomainPrefix(domain string) string {
+	return this.prefix + domain + "_"
+}
+
+// IsCounterKey returns true if a key of the backend is the counter of a window, rather than a leaky
+// bucket, the leases of a concurrency limit or a key of the penalty box.
+func IsCounterKey(key string) bool {
+	suffix := key[strings.LastIndexByte(key, '_')+1:]
+	if suffix == requestAlignedSuffix {
+		return true
+	}
+	_, err := strconv.ParseUint(suffix, 10, 64)
+	return err == nil
+}
+
+// PenaltyKeys returns the keys of the penalty box of the limit of a cache key, the ban and the
+// count of over-limits, which span the windows of the limit.
+func PenaltyKeys(cacheKey string) (ban string, overLimits string) {
+	base := cacheKey[:strings.LastIndexByte(cacheKey, '_')+1]
+	return base + "penalty", base + "penalty_over_limits"
+}
+
+// hashCacheKeyEntries returns the hex encoded hash of the descriptor entries of a cache key. With
+// xxhash, two different descriptors of a domain share a counter with a probability of about
+// n^2/2^65 for n distinct descriptors in a window, sha256 makes the collisions practically impossible.
+func hashCacheKeyEntries(hash string, entries []byte) string {
+	switch hash {
+	case config.CacheKeyHashSha256:
+		sum := sha256.Sum256(entries)
+		return hex.EncodeToString(sum[:])
+	default:
+		return strconv.FormatUint(xxhash.Sum64(entries), 16)
+	}
+}
@@ -0,0 +1,56 @@
+package limiter
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
+	"github.com/envoyproxy/ratelimit/src/assert"
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// GeneratePreviousWindowCacheKeys returns the cache keys of the previous windows of the limits with a
+// carry-over, whose counters give the credit of the current windows. The keys of the other limits
+// are empty.
+func (this *BaseRateLimiter) GeneratePreviousWindowCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []CacheKey {
+	assert.Assert(len(request.Descriptors) == len(limits))
+	cacheKeys := make([]CacheKey, len(request.Descriptors))
+	var now int64
+	for i, limit := range limits {
+		if limit == nil || limit.CarryOverPercent == 0 {
+			continue
+		}
+		if now == 0 {
+			now = this.timeSource.UnixNow()
+		}
+		divider := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+		cacheKeys[i] = this.cacheKeyGenerator.GenerateCacheKey(request.Domain, request.Descriptors[i], limit, now-divider)
+	}
+	return cacheKeys
+}
+
+// CarryOverCredit returns the requests carried over to the current window of a limit, the requests
+// left unused by its previous window bounded by the carry-over percentage of the limit. The credit
+// of a window doesn't carry over.
+func CarryOverCredit(limit *config.RateLimit, previousCount uint64) uint64 {
+	if limit == nil || limit.CarryOverPercent == 0 {
+		return 0
+	}
+	requestsPerUnit := uint64(limit.Limit.RequestsPerUnit)
+	if previousCount >= requestsPerUnit {
+		return 0
+	}
+	return min(requestsPerUnit-previousCount, requestsPerUnit*uint64(limit.CarryOverPercent)/100)
+}
+
+// NeedsCarryOverCredit returns whether the decision on the counter of the current window of a limit
+// depends on the credit carried over from its previous window: a counter within the limit is
+// admitted, and one past the limit and the largest credit rejected, whatever the credit.
+func NeedsCarryOverCredit(limit *config.RateLimit, count uint64) bool {
+	if limit == nil || limit.CarryOverPercent == 0 {
+		return false
+	}
+	requestsPerUnit := uint64(limit.Limit.RequestsPerUnit)
+	return count > requestsPerUnit && count <= requestsPerUnit+requestsPerUnit*uint64(limit.CarryOverPercent)/100
+}
@@ -0,0 +1,204 @@
+package limiter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	stats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+type circuitState uint64
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuitBreakerStats struct {
+	state          stats.Gauge
+	opened         stats.Counter
+	shortCircuited stats.Counter
+	probes         stats.Counter
+}
+
+func newCircuitBreakerStats(scope stats.Scope) circuitBreakerStats {
+	ret := circuitBreakerStats{}
+	ret.state = scope.NewGauge("state")
+	ret.opened = scope.NewCounter("opened")
+	ret.shortCircuited = scope.NewCounter("short_circuited")
+	ret.probes = scope.NewCounter("probes")
+	return ret
+}
+
+// CircuitBreaker stops calling a failing backend: after failureThreshold consecutive failures the
+// circuit opens and the calls are rejected for openDuration. Then a single probe call is let
+// through (half-open), which closes the circuit if it succeeds and opens it again otherwise.
+type CircuitBreaker struct {
+	mu                  sync.Mutex
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	failureThreshold    int
+	openDuration        time.Duration
+	now                 func() time.Time
+	stats               circuitBreakerStats
+}
+
+func NewCircuitBreaker(scope stats.Scope, failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		now:              time.Now,
+		stats:            newCircuitBreakerStats(scope),
+	}
+}
+
+// Allow returns whether a call may be made, and whether it is the probe of a half-open circuit.
+func (b *CircuitBreaker) Allow() (allowed bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true, false
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) >= b.openDuration {
+			b.setState(circuitHalfOpen)
+			b.stats.probes.Inc()
+			return true, true
+		}
+	}
+	// open, or half-open with the probe in flight
+	b.stats.shortCircuited.Inc()
+	return false, false
+}
+
+// Record records the outcome of an allowed call.
+func (b *CircuitBreaker) Record(failed bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.consecutiveFailures = 0
+		if probe {
+			logger.Warnf("backend probe succeeded, closing the circuit breaker")
+			b.setState(circuitClosed)
+		}
+		return
+	}
+
+	b.consecutiveFailures++
+	if probe || (b.state == circuitClosed && b.consecutiveFailures >= b.failureThreshold) {
+		logger.Errorf("backend failed %d consecutive times, opening the circuit breaker for %s", b.consecutiveFailures, b.openDuration)
+		b.openedAt = b.now()
+		b.stats.opened.Inc()
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state circuitState) {
+	b.state = state
+	b.stats.state.Set(uint64(state))
+}
+
+type backendErrorKey struct{}
+
+type backendError struct {
+	failed bool
+}
+
+// ReportBackendError reports an error of the backend which the cache handled without panicking,
+// so that the circuit breaker of the call counts it as a failure.
+func ReportBackendError(ctx context.Context, err error) {
+	if outcome, ok := ctx.Value(backendErrorKey{}).(*backendError); ok && err != nil {
+		outcome.failed = true
+	}
+}
+
+type circuitBreakerCache struct {
+	cache           RateLimitCache
+	breaker         *CircuitBreaker
+	failureModeDeny atomic.Bool
+	fallback        *LocalFallback
+}
+
+// NewCircuitBreakerCache wraps a cache with a circuit breaker. The calls panicking with an error,
+// or reporting one with ReportBackendError, are failures. While the circuit is open the limits
+// are answered without calling the backend: with the local counters of fallback if not nil,
+// otherwise OVER_LIMIT if failureModeDeny and OK if not.
+func NewCircuitBreakerCache(cache RateLimitCache, breaker *CircuitBreaker, failureModeDeny bool, fallback *LocalFallback) RateLimitCache {
+	ret := &circuitBreakerCache{
+		cache:    cache,
+		breaker:  breaker,
+		fallback: fallback,
+	}
+	ret.failureModeDeny.Store(failureModeDeny)
+	return ret
+}
+
+func (this *circuitBreakerCache) DoLimit(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []*pb.RateLimitResponse_DescriptorStatus {
+	allowed, probe := this.breaker.Allow()
+	if !allowed {
+		if this.fallback != nil {
+			return this.fallback.DoLimit(request, limits)
+		}
+		return failureModeStatuses(limits, this.failureModeDeny.Load())
+	}
+
+	outcome := &backendError{}
+	defer func() {
+		if err := recover(); err != nil {
+			_, isError := err.(error)
+			this.breaker.Record(isError, probe)
+			panic(err)
+		}
+		this.breaker.Record(outcome.failed, probe)
+		if probe && !outcome.failed && this.fallback != nil {
+			// the backend recovered
+			go this.fallback.Reconcile(context.Background(), this.cache)
+		}
+	}()
+	return this.cache.DoLimit(context.WithValue(ctx, backendErrorKey{}, outcome), request, limits)
+}
+
+func (this *circuitBreakerCache) SetFailureModeDeny(deny bool) {
+	this.failureModeDeny.Store(deny)
+	if setter, ok := this.cache.(FailureModeSetter); ok {
+		setter.SetFailureModeDeny(deny)
+	}
+}
+
+// failureModeStatuses answers the limits without the backend: OVER_LIMIT if deny, OK otherwise.
+func failureModeStatuses(limits []*config.RateLimit, deny bool) []*pb.RateLimitResponse_DescriptorStatus {
+	statuses := make([]*pb.RateLimitResponse_DescriptorStatus, len(limits))
+	for i, limit := range limits {
+		if limit == nil {
+			statuses[i] = &pb.RateLimitResponse_DescriptorStatus{Code: pb.RateLimitResponse_OK}
+			continue
+		}
+		code := pb.RateLimitResponse_OK
+		if deny && !limit.Unlimited && !limit.ShadowMode {
+			code = pb.RateLimitResponse_OVER_LIMIT
+		}
+		statuses[i] = &pb.RateLimitResponse_DescriptorStatus{
+			Code:         code,
+			CurrentLimit: limit.CurrentLimit(),
+		}
+	}
+	return statuses
+}
+
+func (this *circuitBreakerCache) Flush() {
+	this.cache.Flush()
+}
@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	stats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+type deadlineCache struct {
+	cache            RateLimitCache
+	margin           time.Duration
+	failureModeDeny  atomic.Bool
+	deadlineExceeded stats.Counter
+}
+
+// NewDeadlineCache wraps a cache so that the backend calls are aborted margin before the deadline
+// of the caller. A request arriving within margin of its deadline, or whose backend call is
+// aborted, is answered with the failure mode: OVER_LIMIT if failureModeDeny, OK otherwise.
+func NewDeadlineCache(cache RateLimitCache, scope stats.Scope, margin time.Duration, failureModeDeny bool) RateLimitCache {
+	ret := &deadlineCache{
+		cache:            cache,
+		margin:           margin,
+		deadlineExceeded: scope.NewCounter("deadline_exceeded"),
+	}
+	ret.failureModeDeny.Store(failureModeDeny)
+	return ret
+}
+
+func (this *deadlineCache) DoLimit(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) (statuses []*pb.RateLimitResponse_DescriptorStatus) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return this.cache.DoLimit(ctx, request, limits)
+	}
+	if time.Until(deadline) <= this.margin {
+		this.deadlineExceeded.Inc()
+		return failureModeStatuses(limits, this.failureModeDeny.Load())
+	}
+
+	backendCtx, cancel := context.WithDeadline(ctx, deadline.Add(-this.margin))
+	defer cancel()
+	defer func() {
+		if backendCtx.Err() == nil {
+			return
+		}
+		err := recover()
+		if err == nil {
+			return
+		}
+		if !isContextError(err) {
+			// a failure of the backend unrelated to the deadline goes through
+			panic(err)
+		}
+		logger.Warnf("backend call aborted at the deadline of the request: %v", err)
+		this.deadlineExceeded.Inc()
+		statuses = failureModeStatuses(limits, this.failureModeDeny.Load())
+	}()
+	return this.cache.DoLimit(backendCtx, request, limits)
+}
+
+// isContextError returns whether a panic of a cache is the abort of its backend call by the
+// deadline or the cancellation of its context. The caches panic with the message of the error of
+// their client, e.g. a RedisError, which doesn't wrap it.
+func isContextError(panicValue interface{}) bool {
+	if err, ok := panicValue.(error); ok && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+		return true
+	}
+	message := fmt.Sprint(panicValue)
+	return strings.Contains(message, context.DeadlineExceeded.Error()) || strings.Contains(message, context.Canceled.Error())
+}
+
+// SetFailureModeDeny changes the failure mode of this cache and of the wrapped caches.
+func (this *deadlineCache) SetFailureModeDeny(deny bool) {
+	this.failureModeDeny.Store(deny)
+	if setter, ok := this.cache.(FailureModeSetter); ok {
+		setter.SetFailureModeDeny(deny)
+	}
+}
+
+func (this *deadlineCache) Flush() {
+	this.cache.Flush()
+}
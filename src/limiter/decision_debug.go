@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+)
+
+// DecisionDebug collects the cache keys checked for a request, for the clients debugging the
+// decisions of the service.
+type DecisionDebug struct {
+	mu        sync.Mutex
+	recorded  bool
+	cacheKeys []string
+}
+
+type decisionDebugKey struct{}
+
+// WithDecisionDebug returns a context collecting the cache keys checked by the caches.
+func WithDecisionDebug(ctx context.Context) (context.Context, *DecisionDebug) {
+	debug := &DecisionDebug{}
+	return context.WithValue(ctx, decisionDebugKey{}, debug), debug
+}
+
+// DecisionDebugFromContext returns the collector of the context, nil if the decisions of the request
+// are not debugged.
+func DecisionDebugFromContext(ctx context.Context) *DecisionDebug {
+	debug, _ := ctx.Value(decisionDebugKey{}).(*DecisionDebug)
+	return debug
+}
+
+// AddCacheKeys records the cache keys checked by a cache, one per descriptor, empty for the
+// descriptors without limit. Only the first call is recorded, the one checking the descriptors of
+// the request, the later ones checking their quotas or spillover tiers. A nil collector records
+// nothing.
+func (this *DecisionDebug) AddCacheKeys(cacheKeys []CacheKey) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.recorded {
+		return
+	}
+	this.recorded = true
+	for _, cacheKey := range cacheKeys {
+		this.cacheKeys = append(this.cacheKeys, cacheKey.Key)
+	}
+}
+
+// CacheKeys returns the cache keys recorded for the first count descriptors, empty for the
+// descriptors without limit or not checked by a cache.
+func (this *DecisionDebug) CacheKeys(count int) []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret := make([]string, count)
+	copy(ret, this.cacheKeys)
+	return ret
+}
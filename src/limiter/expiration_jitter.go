@@ -0,0 +1,79 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// ExpirationJitterPolicy configures the random jitter added to the expiration of the cache keys,
+// which spreads the expirations of the keys created in the same window.
+type ExpirationJitterPolicy struct {
+	// PerUnit is the maximum jitter of the limits of a unit, 0 for no jitter.
+	PerUnit map[pb.RateLimitResponse_RateLimit_Unit]time.Duration
+	// Percent is the maximum jitter of the other units as a percentage of their window, 0 to use
+	// EXPIRATION_JITTER_MAX_SECONDS.
+	Percent float64
+}
+
+// NewExpirationJitterPolicy creates a policy from the maximum jitters keyed by unit name, such as
+// "second" or "DAY", and the percentage of the window of the other units.
+func NewExpirationJitterPolicy(perUnit map[string]time.Duration, percent float64) (ExpirationJitterPolicy, error) {
+	if percent < 0 {
+		return ExpirationJitterPolicy{}, fmt.Errorf("invalid expiration jitter percent %v", percent)
+	}
+	policy := ExpirationJitterPolicy{Percent: percent}
+	if len(perUnit) > 0 {
+		policy.PerUnit = make(map[pb.RateLimitResponse_RateLimit_Unit]time.Duration, len(perUnit))
+	}
+	for name, jitter := range perUnit {
+		unit, ok := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(name)]
+		if !ok || unit == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
+			return ExpirationJitterPolicy{}, fmt.Errorf("invalid rate limit unit %q in expiration jitter", name)
+		}
+		if jitter < 0 {
+			return ExpirationJitterPolicy{}, fmt.Errorf("invalid expiration jitter %v of unit %s", jitter, name)
+		}
+		policy.PerUnit[pb.RateLimitResponse_RateLimit_Unit(unit)] = jitter
+	}
+	return policy, nil
+}
+
+// SetExpirationJitterPolicy changes the jitter of the limits without an expiration_jitter. Must be
+// called before the first request.
+func (this *BaseRateLimiter) SetExpirationJitterPolicy(policy ExpirationJitterPolicy) {
+	this.expirationJitterPolicy = policy
+}
+
+// ExpirationSeconds returns the expiration of a new cache key of the limit, its window plus a random
+// jitter. The maximum jitter is the expiration_jitter of the limit, else the jitter of its unit in
+// the policy, else the percentage of its window in the policy, else ExpirationJitterMaxSeconds. The
+// keys of the request aligned limits expire at the end of their window, without jitter.
+func (this *BaseRateLimiter) ExpirationSeconds(limit *config.RateLimit) int64 {
+	expirationSeconds := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+	if limit.RequestAligned {
+		// the expiration of the key is the end of its window
+		return expirationSeconds
+	}
+	maxJitterSeconds := this.ExpirationJitterMaxSeconds
+	if limit.ExpirationJitter != nil {
+		maxJitterSeconds = int64(*limit.ExpirationJitter / time.Second)
+	} else if jitter, ok := this.expirationJitterPolicy.PerUnit[limit.Limit.Unit]; ok {
+		maxJitterSeconds = int64(jitter / time.Second)
+	} else if this.expirationJitterPolicy.Percent > 0 {
+		maxJitterSeconds = int64(float64(expirationSeconds) * this.expirationJitterPolicy.Percent / 100)
+	}
+	if maxJitterSeconds > 0 && this.JitterRand != nil {
+		expirationSeconds += this.JitterRand.Int63n(maxJitterSeconds)
+	}
+	if limit.CarryOverPercent > 0 {
+		// the counter gives the credit of the next window
+		expirationSeconds += utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+	}
+	return expirationSeconds
+}
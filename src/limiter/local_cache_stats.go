@@ -15,9 +15,16 @@ type localCacheStats struct {
 	missCount         stats.Gauge
 	lookupCount       stats.Gauge
 	overwriteCount    stats.Gauge
+	memoryBytes       stats.Gauge
+	sizeInBytes       int
 }
 
-func NewLocalCacheStats(localCache *freecache.Cache, scope stats.Scope) stats.StatGenerator {
+// freecacheMinSize is the size freecache allocates for the smaller caches.
+const freecacheMinSize = 512 * 1024
+
+// NewLocalCacheStats returns the generator of the gauges of the local cache of sizeInBytes, the
+// size it was created with.
+func NewLocalCacheStats(localCache *freecache.Cache, sizeInBytes int, scope stats.Scope) stats.StatGenerator {
 	return localCacheStats{
 		cache:             localCache,
 		evacuateCount:     scope.NewGauge("evacuateCount"),
@@ -28,6 +35,8 @@ func NewLocalCacheStats(localCache *freecache.Cache, scope stats.Scope) stats.St
 		missCount:         scope.NewGauge("missCount"),
 		lookupCount:       scope.NewGauge("lookupCount"),
 		overwriteCount:    scope.NewGauge("overwriteCount"),
+		memoryBytes:       scope.NewGauge("memoryBytes"),
+		sizeInBytes:       max(sizeInBytes, freecacheMinSize),
 	}
 }
 
@@ -40,4 +49,6 @@ func (stats localCacheStats) GenerateStats() {
 	stats.missCount.Set(uint64(stats.cache.MissCount()))
 	stats.lookupCount.Set(uint64(stats.cache.LookupCount()))
 	stats.overwriteCount.Set(uint64(stats.cache.OverwriteCount()))
+	// freecache allocates its whole ring buffer upfront, the evacuations tell when it is full
+	stats.memoryBytes.Set(uint64(stats.sizeInBytes))
 }
@@ -0,0 +1,167 @@
+package limiter
+
+import (
+	"sync"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	stats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// maxFallbackCounters bounds the counters kept during an outage, the expired counters are pruned
+// when it is reached.
+const maxFallbackCounters = 100000
+
+type localFallbackStats struct {
+	requests   stats.Counter
+	overLimit  stats.Counter
+	reconciled stats.Counter
+}
+
+func newLocalFallbackStats(scope stats.Scope) localFallbackStats {
+	ret := localFallbackStats{}
+	ret.requests = scope.NewCounter("requests")
+	ret.overLimit = scope.NewCounter("over_limit")
+	ret.reconciled = scope.NewCounter("reconciled")
+	return ret
+}
+
+type fallbackCounter struct {
+	domain     string
+	descriptor *pb_struct.RateLimitDescriptor
+	limit      *config.RateLimit
+	hits       uint64
+	windowEnd  int64
+}
+
+// LocalFallback counts the hits in memory while the backend is unreachable. Each instance enforces
+// its share of the global limit, i.e. the limit divided by the number of instances. When the
+// backend recovers the hits counted locally in the current windows are added to the backend.
+type LocalFallback struct {
+	mu                sync.Mutex
+	counters          map[string]*fallbackCounter
+	cacheKeyGenerator CacheKeyGenerator
+	timeSource        utils.TimeSource
+	instanceCount     uint64
+	stats             localFallbackStats
+}
+
+func NewLocalFallback(scope stats.Scope, timeSource utils.TimeSource, cacheKeyPrefix string, instanceCount int) *LocalFallback {
+	if instanceCount < 1 {
+		instanceCount = 1
+	}
+	return &LocalFallback{
+		counters:          make(map[string]*fallbackCounter),
+		cacheKeyGenerator: NewCacheKeyGenerator(cacheKeyPrefix),
+		timeSource:        timeSource,
+		instanceCount:     uint64(instanceCount),
+		stats:             newLocalFallbackStats(scope),
+	}
+}
+
+// DoLimit applies the limits with the local counters.
+func (this *LocalFallback) DoLimit(request *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+	hitsAddends := GetHitsAddends(request, limits)
+	now := this.timeSource.UnixNow()
+	statuses := make([]*pb.RateLimitResponse_DescriptorStatus, len(limits))
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stats.requests.Inc()
+	if len(this.counters) >= maxFallbackCounters {
+		this.prune(now)
+	}
+	for i, limit := range limits {
+		if limit == nil {
+			statuses[i] = &pb.RateLimitResponse_DescriptorStatus{Code: pb.RateLimitResponse_OK}
+			continue
+		}
+
+		key := this.cacheKeyGenerator.GenerateCacheKey(request.Domain, request.Descriptors[i], limit, now).Key
+		counter, ok := this.counters[key]
+		if !ok || counter.windowEnd <= now {
+			divider := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+			counter = &fallbackCounter{
+				domain: request.Domain,
+				// the hits are reconciled with the request hits_addend
+				descriptor: &pb_struct.RateLimitDescriptor{Entries: request.Descriptors[i].Entries, Limit: request.Descriptors[i].Limit},
+				limit:      limit,
+				windowEnd:  (now/divider + 1) * divider,
+			}
+			if limit.RequestAligned {
+				counter.windowEnd = now + divider
+			}
+			this.counters[key] = counter
+		}
+		counter.hits += hitsAddends[i]
+
+		// the share of the instance is rounded up to err on the side of allowing
+		instanceLimit := (uint64(limit.Limit.RequestsPerUnit) + this.instanceCount - 1) / this.instanceCount
+		if counter.hits > instanceLimit && !limit.ShadowMode {
+			this.stats.overLimit.Inc()
+			statuses[i] = &pb.RateLimitResponse_DescriptorStatus{
+				Code:         pb.RateLimitResponse_OVER_LIMIT,
+				CurrentLimit: limit.CurrentLimit(),
+			}
+			continue
+		}
+		remaining := uint64(0)
+		if counter.hits < instanceLimit {
+			remaining = instanceLimit - counter.hits
+		}
+		statuses[i] = &pb.RateLimitResponse_DescriptorStatus{
+			Code:           pb.RateLimitResponse_OK,
+			CurrentLimit:   limit.CurrentLimit(),
+			LimitRemaining: uint32(remaining),
+		}
+	}
+	return statuses
+}
+
+func (this *LocalFallback) prune(now int64) {
+	for key, counter := range this.counters {
+		if counter.windowEnd <= now {
+			delete(this.counters, key)
+		}
+	}
+}
+
+// Reconcile adds the hits counted locally in the current windows to the backend and resets
+// the local counters.
+func (this *LocalFallback) Reconcile(ctx context.Context, cache RateLimitCache) {
+	this.mu.Lock()
+	counters := this.counters
+	this.counters = make(map[string]*fallbackCounter)
+	this.mu.Unlock()
+
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("failed to reconcile the local fallback counters: %v", err)
+		}
+	}()
+
+	now := this.timeSource.UnixNow()
+	for _, counter := range counters {
+		if counter.windowEnd <= now || counter.hits == 0 {
+			continue
+		}
+		// the cost of the limit is applied again by the cache
+		hits := counter.hits
+		if counter.limit.Cost > 1 {
+			hits /= uint64(counter.limit.Cost)
+		}
+		request := &pb.RateLimitRequest{
+			Domain:      counter.domain,
+			Descriptors: []*pb_struct.RateLimitDescriptor{counter.descriptor},
+			HitsAddend:  uint32(hits),
+		}
+		cache.DoLimit(ctx, request, []*config.RateLimit{counter.limit})
+		this.stats.reconciled.Inc()
+	}
+}
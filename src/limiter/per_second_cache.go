@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// perSecondCache stores the keys of the limits with a window of one second until the end of their
+// window. The entries of the local cache expire on whole seconds, so these keys, a new one every
+// second, would otherwise churn the local cache and outlive their window.
+type perSecondCache struct {
+	mu      sync.Mutex
+	maxKeys int
+	entries map[string]perSecondEntry
+	// purged is the second of the last purge of the expired entries, done at most once a second
+	purged time.Time
+	now    func() time.Time
+}
+
+type perSecondEntry struct {
+	expiry    time.Time
+	overLimit bool
+}
+
+func newPerSecondCache(maxKeys int) *perSecondCache {
+	return &perSecondCache{
+		maxKeys: maxKeys,
+		entries: make(map[string]perSecondEntry),
+		now:     time.Now,
+	}
+}
+
+// get returns whether the key is stored and whether it is over the limit.
+func (this *perSecondCache) get(key string) (found bool, overLimit bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	entry, ok := this.entries[key]
+	if !ok {
+		return false, false
+	}
+	if !this.now().Before(entry.expiry) {
+		delete(this.entries, key)
+		return false, false
+	}
+	return true, entry.overLimit
+}
+
+// set stores the key until the end of its window, untilReset after the start of the current second
+// of the wall clock. When the cache is full the expired keys are purged, and if it is still full the
+// key is not stored.
+func (this *perSecondCache) set(key string, untilReset time.Duration, overLimit bool) {
+	now := this.now()
+	expiry := now.Truncate(time.Second).Add(untilReset)
+	if !now.Before(expiry) {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.entries[key]; !ok && len(this.entries) >= this.maxKeys {
+		if !now.Truncate(time.Second).After(this.purged) {
+			return
+		}
+		this.purged = now.Truncate(time.Second)
+		for k, entry := range this.entries {
+			if !now.Before(entry.expiry) {
+				delete(this.entries, k)
+			}
+		}
+		if len(this.entries) >= this.maxKeys {
+			return
+		}
+	}
+	this.entries[key] = perSecondEntry{expiry: expiry, overLimit: overLimit}
+}
+
+// del removes the key.
+func (this *perSecondCache) del(key string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.entries, key)
+}
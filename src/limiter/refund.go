@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+// RefundStats count the refunds of the caches.
+type RefundStats struct {
+	// Refunds counts the counters refunded, and RefundedHits the hits removed from them.
+	Refunds      gostats.Counter
+	RefundedHits gostats.Counter
+	// Clamped counts the refunds of more hits than their counter held, including the missing counters.
+	Clamped gostats.Counter
+}
+
+func NewRefundStats(scope gostats.Scope) RefundStats {
+	return RefundStats{
+		Refunds:      scope.NewCounter("refunds"),
+		RefundedHits: scope.NewCounter("refunded_hits"),
+		Clamped:      scope.NewCounter("clamped"),
+	}
+}
+
+// Record counts the refund of hitsAddend hits of which refunded were removed from the counter.
+func (this RefundStats) Record(hitsAddend uint64, refunded uint64) {
+	this.Refunds.Inc()
+	this.RefundedHits.Add(refunded)
+	if refunded < hitsAddend {
+		this.Clamped.Inc()
+	}
+}
+
+// GenerateRefundCacheKeys returns the cache keys of the counters of the limits which can be refunded,
+// those of the windows of countedAt, and the hits to refund from each of them, the hits addends with
+// the cost of the limits.
+func (this *BaseRateLimiter) GenerateRefundCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit, countedAt int64,
+) ([]CacheKey, []uint64) {
+	refundable := make([]*config.RateLimit, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.LeakyBucket == nil && limit.Concurrency == nil {
+			refundable[i] = limit
+		}
+	}
+	// the refunds are not hits of the limits
+	return this.generateCacheKeysAt(request, refundable, countedAt), GetHitsAddends(request, refundable)
+}
+
+// ForgetLocalCache removes a key from the local cache, once it is no longer over or near its limit.
+func (this *BaseRateLimiter) ForgetLocalCache(key string) {
+	if this.localCache == nil {
+		return
+	}
+	if this.perSecondCache != nil {
+		this.perSecondCache.del(key)
+	}
+	this.localCache.Del([]byte(key))
+}
@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/google/uuid"
+	gostats "github.com/lyft/gostats"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+var ErrInvalidReservationId = errors.New("invalid reservation id")
+
+// ReservationStats count the reservations of the caches.
+type ReservationStats struct {
+	Reserved  gostats.Counter
+	Rejected  gostats.Counter
+	Committed gostats.Counter
+	Cancelled gostats.Counter
+	// Expired counts the reservations committed or cancelled after their hold expired.
+	Expired gostats.Counter
+}
+
+func NewReservationStats(scope gostats.Scope) ReservationStats {
+	return ReservationStats{
+		Reserved:  scope.NewCounter("reserved"),
+		Rejected:  scope.NewCounter("rejected"),
+		Committed: scope.NewCounter("committed"),
+		Cancelled: scope.NewCounter("cancelled"),
+		Expired:   scope.NewCounter("expired"),
+	}
+}
+
+// NewReservationId returns the identifier of a reservation made at now. The identifier carries the
+// time of the reservation, so that it is committed or cancelled on the counters of the windows it
+// was reserved in.
+func NewReservationId(now int64) string {
+	return strconv.FormatInt(now, 10) + "-" + uuid.NewString()
+}
+
+// ReservationTime returns the time a reservation was made at, ErrInvalidReservationId if the
+// identifier was not returned by NewReservationId.
+func ReservationTime(reservationId string) (int64, error) {
+	now, id, found := strings.Cut(reservationId, "-")
+	if !found {
+		return 0, ErrInvalidReservationId
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return 0, ErrInvalidReservationId
+	}
+	reservedAt, err := strconv.ParseInt(now, 10, 64)
+	if err != nil || reservedAt < 0 {
+		return 0, ErrInvalidReservationId
+	}
+	return reservedAt, nil
+}
+
+// GenerateReservationCacheKeys returns the cache keys of the counters of the limits which can be
+// reserved, in the windows at the time of the reservation, and the hits to hold on each of them.
+// Throws ErrInvalidReservationId if the reservation id is invalid.
+func (this *BaseRateLimiter) GenerateReservationCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit, reservationId string,
+) ([]CacheKey, []uint64) {
+	reservedAt, err := ReservationTime(reservationId)
+	if err != nil {
+		panic(err)
+	}
+	reservable := make([]*config.RateLimit, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.LeakyBucket == nil && limit.Concurrency == nil {
+			reservable[i] = limit
+		}
+	}
+	return this.generateCacheKeysAt(request, reservable, reservedAt), GetHitsAddends(request, reservable)
+}
+
+// NewReservation returns the identifier of a reservation made now.
+func (this *BaseRateLimiter) NewReservation() string {
+	return NewReservationId(this.timeSource.UnixNow())
+}
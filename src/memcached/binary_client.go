@@ -0,0 +1,382 @@
+package memcached
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// The binary protocol opcodes and statuses used by binaryClient.
+const (
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+	binaryHeaderLength  = 24
+
+	opcodeAdd       = 0x02
+	opcodeIncrement = 0x05
+	opcodeDecrement = 0x06
+	opcodeNoop      = 0x0a
+	opcodeGetKQ     = 0x0d
+	opcodeSaslAuth  = 0x21
+
+	statusSuccess     = 0x0000
+	statusKeyNotFound = 0x0001
+	statusKeyExists   = 0x0002
+	statusNotStored   = 0x0005
+	statusAuthError   = 0x0020
+)
+
+// binaryClient is a memcache Client speaking the binary protocol, which memcached requires to
+// authenticate with SASL. Each new connection authenticates with the PLAIN mechanism before its
+// first command.
+type binaryClient struct {
+	selector     memcache.ServerSelector
+	dialContext  func(ctx context.Context, network, address string) (net.Conn, error)
+	timeout      time.Duration
+	maxIdleConns int
+	username     string
+	password     string
+
+	mu       sync.Mutex
+	freeConn map[string][]*binaryConn
+}
+
+type binaryConn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+type binaryResponse struct {
+	opcode byte
+	status uint16
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// newBinaryClient creates a client of the servers of selector authenticating as username. The
+// connections are dialed with dialContext, nil for a plain TCP connection.
+func newBinaryClient(selector memcache.ServerSelector, username string, password string,
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error), maxIdleConns int,
+) *binaryClient {
+	if dialContext == nil {
+		var dialer net.Dialer
+		dialContext = dialer.DialContext
+	}
+	if maxIdleConns <= 0 {
+		maxIdleConns = memcache.DefaultMaxIdleConns
+	}
+	return &binaryClient{
+		selector:     selector,
+		dialContext:  dialContext,
+		timeout:      memcache.DefaultTimeout,
+		maxIdleConns: maxIdleConns,
+		username:     username,
+		password:     password,
+		freeConn:     map[string][]*binaryConn{},
+	}
+}
+
+var _ Client = (*binaryClient)(nil)
+
+// legalKey is the key check of the memcache client, the keys being at most 250 bytes without
+// spaces or control characters.
+func legalKey(key string) bool {
+	if len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *binaryClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	keysByAddr := map[net.Addr][]string{}
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, memcache.ErrMalformedKey
+		}
+		addr, err := this.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		keysByAddr[addr] = append(keysByAddr[addr], key)
+	}
+
+	items := make(map[string]*memcache.Item, len(keys))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keysByAddr))
+	for addr, keys := range keysByAddr {
+		wg.Add(1)
+		go func(addr net.Addr, keys []string) {
+			defer wg.Done()
+			serverItems, err := this.getMultiFromServer(addr, keys)
+			mu.Lock()
+			for key, item := range serverItems {
+				items[key] = item
+			}
+			mu.Unlock()
+			if err != nil {
+				errs <- err
+			}
+		}(addr, keys)
+	}
+	wg.Wait()
+	close(errs)
+	return items, <-errs
+}
+
+func (this *binaryClient) getMultiFromServer(addr net.Addr, keys []string) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	err := this.withConn(addr, func(cn *binaryConn) error {
+		// the quiet gets only answer the hits, the noop ends the responses
+		for _, key := range keys {
+			if err := cn.writeRequest(opcodeGetKQ, nil, key, nil); err != nil {
+				return err
+			}
+		}
+		if err := cn.writeRequest(opcodeNoop, nil, "", nil); err != nil {
+			return err
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return err
+		}
+		for {
+			resp, err := cn.readResponse()
+			if err != nil {
+				return err
+			}
+			if resp.opcode == opcodeNoop {
+				return nil
+			}
+			if resp.status != statusSuccess {
+				continue
+			}
+			item := &memcache.Item{Key: string(resp.key), Value: resp.value}
+			if len(resp.extras) >= 4 {
+				item.Flags = binary.BigEndian.Uint32(resp.extras)
+			}
+			items[item.Key] = item
+		}
+	})
+	return items, err
+}
+
+func (this *binaryClient) Increment(key string, delta uint64) (uint64, error) {
+	return this.incrementOrDecrement(key, opcodeIncrement, delta)
+}
+
+func (this *binaryClient) Decrement(key string, delta uint64) (uint64, error) {
+	return this.incrementOrDecrement(key, opcodeDecrement, delta)
+}
+
+func (this *binaryClient) incrementOrDecrement(key string, opcode byte, delta uint64) (uint64, error) {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras, delta)
+	// an expiration of 0xffffffff fails the increment of a missing key instead of creating it
+	binary.BigEndian.PutUint32(extras[16:], 0xffffffff)
+	var newValue uint64
+	err := this.do(key, opcode, extras, nil, func(resp *binaryResponse) error {
+		switch resp.status {
+		case statusSuccess:
+			if len(resp.value) != 8 {
+				return fmt.Errorf("memcache: invalid increment response of %d bytes", len(resp.value))
+			}
+			newValue = binary.BigEndian.Uint64(resp.value)
+			return nil
+		case statusKeyNotFound:
+			return memcache.ErrCacheMiss
+		default:
+			return statusError(resp.status)
+		}
+	})
+	return newValue, err
+}
+
+func (this *binaryClient) Add(item *memcache.Item) error {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, item.Flags)
+	binary.BigEndian.PutUint32(extras[4:], uint32(item.Expiration))
+	return this.do(item.Key, opcodeAdd, extras, item.Value, func(resp *binaryResponse) error {
+		switch resp.status {
+		case statusSuccess:
+			return nil
+		case statusKeyExists, statusNotStored:
+			return memcache.ErrNotStored
+		default:
+			return statusError(resp.status)
+		}
+	})
+}
+
+// do sends a single request for the key and handles its response.
+func (this *binaryClient) do(key string, opcode byte, extras []byte, value []byte,
+	handle func(resp *binaryResponse) error,
+) error {
+	if !legalKey(key) {
+		return memcache.ErrMalformedKey
+	}
+	addr, err := this.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+	var result error
+	err = this.withConn(addr, func(cn *binaryConn) error {
+		if err := cn.writeRequest(opcode, extras, key, value); err != nil {
+			return err
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return err
+		}
+		resp, err := cn.readResponse()
+		if err != nil {
+			return err
+		}
+		result = handle(resp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// withConn runs f with a connection to addr, the connection returning to the pool unless f fails.
+func (this *binaryClient) withConn(addr net.Addr, f func(cn *binaryConn) error) error {
+	cn, err := this.getConn(addr)
+	if err != nil {
+		return err
+	}
+	cn.nc.SetDeadline(time.Now().Add(this.timeout))
+	if err := f(cn); err != nil {
+		cn.nc.Close()
+		return err
+	}
+	this.putFreeConn(addr, cn)
+	return nil
+}
+
+func (this *binaryClient) getConn(addr net.Addr) (*binaryConn, error) {
+	this.mu.Lock()
+	if free := this.freeConn[addr.String()]; len(free) > 0 {
+		cn := free[len(free)-1]
+		this.freeConn[addr.String()] = free[:len(free)-1]
+		this.mu.Unlock()
+		return cn, nil
+	}
+	this.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+	nc, err := this.dialContext(ctx, addr.Network(), addr.String())
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &memcache.ConnectTimeoutError{Addr: addr}
+		}
+		return nil, err
+	}
+	cn := &binaryConn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}
+	nc.SetDeadline(time.Now().Add(this.timeout))
+	if err := cn.authenticate(this.username, this.password); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (this *binaryClient) putFreeConn(addr net.Addr, cn *binaryConn) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	free := this.freeConn[addr.String()]
+	if len(free) >= this.maxIdleConns {
+		cn.nc.Close()
+		return
+	}
+	this.freeConn[addr.String()] = append(free, cn)
+}
+
+// authenticate authenticates the connection with the SASL PLAIN mechanism.
+func (this *binaryConn) authenticate(username string, password string) error {
+	if err := this.writeRequest(opcodeSaslAuth, nil, "PLAIN", []byte("\x00"+username+"\x00"+password)); err != nil {
+		return err
+	}
+	if err := this.rw.Flush(); err != nil {
+		return err
+	}
+	resp, err := this.readResponse()
+	if err != nil {
+		return err
+	}
+	if resp.status != statusSuccess {
+		return fmt.Errorf("memcache: SASL authentication failed: %w", statusError(resp.status))
+	}
+	return nil
+}
+
+func (this *binaryConn) writeRequest(opcode byte, extras []byte, key string, value []byte) error {
+	var header [binaryHeaderLength]byte
+	header[0] = binaryRequestMagic
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	if _, err := this.rw.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := this.rw.Write(extras); err != nil {
+		return err
+	}
+	if _, err := this.rw.WriteString(key); err != nil {
+		return err
+	}
+	_, err := this.rw.Write(value)
+	return err
+}
+
+func (this *binaryConn) readResponse() (*binaryResponse, error) {
+	var header [binaryHeaderLength]byte
+	if _, err := io.ReadFull(this.rw, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != binaryResponseMagic {
+		return nil, fmt.Errorf("memcache: invalid response magic 0x%x", header[0])
+	}
+	keyLength := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLength := int(header[4])
+	bodyLength := int(binary.BigEndian.Uint32(header[8:]))
+	if keyLength+extrasLength > bodyLength {
+		return nil, fmt.Errorf("memcache: invalid response body length %d", bodyLength)
+	}
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(this.rw, body); err != nil {
+		return nil, err
+	}
+	return &binaryResponse{
+		opcode: header[1],
+		status: binary.BigEndian.Uint16(header[6:]),
+		extras: body[:extrasLength],
+		key:    body[extrasLength : extrasLength+keyLength],
+		value:  body[extrasLength+keyLength:],
+	}, nil
+}
+
+// statusError is the error of an unexpected status of the binary protocol.
+type statusError uint16
+
+func (e statusError) Error() string {
+	if e == statusAuthError {
+		return "memcache: authentication error"
+	}
+	return fmt.Sprintf("memcache: status 0x%04x", uint16(e))
+}
@@ -0,0 +1,185 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBinaryServer is a memcached speaking the binary protocol, requiring the SASL PLAIN
+// authentication of each connection.
+type fakeBinaryServer struct {
+	listener    net.Listener
+	credentials string
+
+	mu    sync.Mutex
+	items map[string][]byte
+	conns int
+}
+
+func newFakeBinaryServer(t *testing.T, username string, password string) *fakeBinaryServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &fakeBinaryServer{listener: listener, credentials: "\x00" + username + "\x00" + password, items: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns++
+			server.mu.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (this *fakeBinaryServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	authenticated := false
+	for {
+		var header [binaryHeaderLength]byte
+		if _, err := io.ReadFull(rw, header[:]); err != nil {
+			return
+		}
+		opcode := header[1]
+		keyLength := int(binary.BigEndian.Uint16(header[2:]))
+		extrasLength := int(header[4])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(rw, body); err != nil {
+			return
+		}
+		extras := body[:extrasLength]
+		key := string(body[extrasLength : extrasLength+keyLength])
+		value := body[extrasLength+keyLength:]
+
+		respond := func(status uint16, extras []byte, key string, value []byte) {
+			var header [binaryHeaderLength]byte
+			header[0] = binaryResponseMagic
+			header[1] = opcode
+			binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+			header[4] = byte(len(extras))
+			binary.BigEndian.PutUint16(header[6:], status)
+			binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+			rw.Write(header[:])
+			rw.Write(extras)
+			rw.WriteString(key)
+			rw.Write(value)
+		}
+
+		if opcode == opcodeSaslAuth {
+			authenticated = key == "PLAIN" && string(value) == this.credentials
+			if authenticated {
+				respond(statusSuccess, nil, "", nil)
+			} else {
+				respond(statusAuthError, nil, "", nil)
+			}
+			rw.Flush()
+			continue
+		}
+		if !authenticated {
+			respond(statusAuthError, nil, "", nil)
+			rw.Flush()
+			return
+		}
+
+		this.mu.Lock()
+		switch opcode {
+		case opcodeGetKQ:
+			if item, ok := this.items[key]; ok {
+				respond(statusSuccess, []byte{0, 0, 0, 0}, key, item)
+			}
+		case opcodeNoop:
+			respond(statusSuccess, nil, "", nil)
+			rw.Flush()
+		case opcodeAdd:
+			if _, ok := this.items[key]; ok {
+				respond(statusKeyExists, nil, "", nil)
+			} else {
+				this.items[key] = append([]byte{}, value...)
+				respond(statusSuccess, nil, "", nil)
+			}
+			rw.Flush()
+		case opcodeIncrement, opcodeDecrement:
+			item, ok := this.items[key]
+			if !ok {
+				respond(statusKeyNotFound, nil, "", nil)
+			} else {
+				counter, _ := strconv.ParseUint(string(item), 10, 64)
+				delta := binary.BigEndian.Uint64(extras)
+				if opcode == opcodeIncrement {
+					counter += delta
+				} else if delta < counter {
+					counter -= delta
+				} else {
+					counter = 0
+				}
+				this.items[key] = []byte(strconv.FormatUint(counter, 10))
+				newValue := make([]byte, 8)
+				binary.BigEndian.PutUint64(newValue, counter)
+				respond(statusSuccess, nil, "", newValue)
+			}
+			rw.Flush()
+		}
+		this.mu.Unlock()
+	}
+}
+
+func TestBinaryClient(t *testing.T) {
+	assert := assert.New(t)
+	server := newFakeBinaryServer(t, "user", "secret")
+	selector := new(memcache.ServerList)
+	assert.NoError(selector.SetServers(server.listener.Addr().String()))
+	client := newBinaryClient(selector, "user", "secret", nil, 1)
+
+	_, err := client.Increment("key", 1)
+	assert.Equal(memcache.ErrCacheMiss, err)
+	assert.NoError(client.Add(&memcache.Item{Key: "key", Value: []byte("2"), Expiration: 60}))
+	assert.Equal(memcache.ErrNotStored, client.Add(&memcache.Item{Key: "key", Value: []byte("2")}))
+	newValue, err := client.Increment("key", 3)
+	assert.NoError(err)
+	assert.EqualValues(5, newValue)
+
+	items, err := client.GetMulti([]string{"key", "missing"})
+	assert.NoError(err)
+	assert.Len(items, 1)
+	assert.Equal([]byte("5"), items["key"].Value)
+
+	newValue, err = client.Decrement("key", 2)
+	assert.NoError(err)
+	assert.EqualValues(3, newValue)
+	newValue, err = client.Decrement("key", 10)
+	assert.NoError(err)
+	assert.EqualValues(0, newValue)
+	_, err = client.Decrement("missing", 1)
+	assert.Equal(memcache.ErrCacheMiss, err)
+
+	_, err = client.GetMulti([]string{"a key"})
+	assert.Equal(memcache.ErrMalformedKey, err)
+	// the idle connection is reused
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(1, server.conns)
+}
+
+func TestBinaryClientAuthenticationError(t *testing.T) {
+	assert := assert.New(t)
+	server := newFakeBinaryServer(t, "user", "secret")
+	selector := new(memcache.ServerList)
+	assert.NoError(selector.SetServers(server.listener.Addr().String()))
+	client := newBinaryClient(selector, "user", "wrong", nil, 1)
+
+	_, err := client.GetMulti([]string{"key"})
+	assert.EqualError(err, "memcache: SASL authentication failed: memcache: authentication error")
+}
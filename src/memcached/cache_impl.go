@@ -18,6 +18,7 @@ package memcached
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
@@ -49,14 +50,14 @@ import (
 var tracer = otel.Tracer("memcached.cacheImpl")
 
 type rateLimitMemcacheImpl struct {
-	client                     Client
-	timeSource                 utils.TimeSource
-	jitterRand                 *rand.Rand
-	expirationJitterMaxSeconds int64
-	localCache                 *freecache.Cache
-	waitGroup                  sync.WaitGroup
-	nearLimitRatio             float32
-	baseRateLimiter            *limiter.BaseRateLimiter
+	client          Client
+	timeSource      utils.TimeSource
+	localCache      *freecache.Cache
+	waitGroup       sync.WaitGroup
+	baseRateLimiter *limiter.BaseRateLimiter
+	// queue runs the increments, nil to run them with runAsync
+	queue       *incrementQueue
+	refundStats limiter.RefundStats
 }
 
 var AutoFlushForIntegrationTests bool = false
@@ -71,22 +72,27 @@ func (this *rateLimitMemcacheImpl) DoLimit(
 	logger.Debugf("starting cache lookup")
 
 	// request.HitsAddend could be 0 (default value) if not specified by the caller in the Ratelimit request.
-	hitsAddends := utils.GetHitsAddends(request)
+	hitsAddends := limiter.GetHitsAddends(request, limits)
 
+	timing := this.baseRateLimiter.Timing
+	phaseStart := time.Now()
 	// First build a list of all cache keys that we are actually going to hit.
 	cacheKeys := this.baseRateLimiter.GenerateCacheKeys(request, limits, hitsAddends)
+	limiter.DecisionDebugFromContext(ctx).AddCacheKeys(cacheKeys)
+	timing.CacheKeys.AddDuration(time.Since(phaseStart))
 
 	isOverLimitWithLocalCache := make([]bool, len(request.Descriptors))
 
 	keysToGet := make([]string, 0, len(request.Descriptors))
 
+	phaseStart = time.Now()
 	for i, cacheKey := range cacheKeys {
 		if cacheKey.Key == "" {
 			continue
 		}
 
 		// Check if key is over the limit in local cache.
-		if this.baseRateLimiter.IsOverLimitWithLocalCache(cacheKey.Key) {
+		if this.baseRateLimiter.IsOverLimitWithLocalCache(request.Domain, cacheKey.Key) {
 			isOverLimitWithLocalCache[i] = true
 			logger.Debugf("cache key is over the limit: %s", cacheKey.Key)
 			continue
@@ -95,6 +101,7 @@ func (this *rateLimitMemcacheImpl) DoLimit(
 		logger.Debugf("looking up cache key: %s", cacheKey.Key)
 		keysToGet = append(keysToGet, cacheKey.Key)
 	}
+	timing.LocalCache.AddDuration(time.Since(phaseStart))
 
 	// Generate trace
 	_, span := tracer.Start(ctx, "Memcached Fetch Execution",
@@ -112,9 +119,12 @@ func (this *rateLimitMemcacheImpl) DoLimit(
 	var err error
 
 	if len(keysToGet) > 0 {
-		memcacheValues, err = this.client.GetMulti(keysToGet)
+		phaseStart = time.Now()
+		memcacheValues, err = this.getMulti(ctx, keysToGet)
+		timing.BackendPrecheck.AddDuration(time.Since(phaseStart))
 		if err != nil {
 			logger.Errorf("Error multi-getting memcache keys (%s): %s", keysToGet, err)
+			limiter.ReportBackendError(ctx, err)
 		}
 	}
 
@@ -135,13 +145,23 @@ func (this *rateLimitMemcacheImpl) DoLimit(
 		limitAfterIncrease := limitBeforeIncrease + hitsAddends[i]
 
 		limitInfo := limiter.NewRateLimitInfo(limits[i], limitBeforeIncrease, limitAfterIncrease, 0, 0)
+		if limits[i] != nil && limits[i].RequestAligned {
+			// memcache doesn't return the expiration of a key, the whole window bounds its remaining time
+			limitInfo.SetMaxDurationUntilReset(time.Duration(utils.UnitToDividerWithMultiplier(limits[i].Limit.Unit,
+				limits[i].UnitMultiplier)) * time.Second)
+		}
 
 		responseDescriptorStatuses[i] = this.baseRateLimiter.GetResponseDescriptorStatus(cacheKey.Key,
 			limitInfo, isOverLimitWithLocalCache[i], hitsAddends[i])
 	}
 
 	this.waitGroup.Add(1)
-	runAsync(func() { this.increaseAsync(cacheKeys, isOverLimitWithLocalCache, limits, hitsAddends) })
+	increase := func() { this.increaseAsync(cacheKeys, isOverLimitWithLocalCache, limits, hitsAddends) }
+	if this.queue == nil {
+		runAsync(increase)
+	} else if dropped := this.queue.submit(increase); dropped {
+		this.waitGroup.Done()
+	}
 	if AutoFlushForIntegrationTests {
 		this.Flush()
 	}
@@ -149,21 +169,80 @@ func (this *rateLimitMemcacheImpl) DoLimit(
 	return responseDescriptorStatuses
 }
 
+func (this *rateLimitMemcacheImpl) GetCounters(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []limiter.CounterValue {
+	cacheKeys := this.baseRateLimiter.GenerateCacheKeys(request, limits, make([]uint64, len(request.Descriptors)))
+	counters := make([]limiter.CounterValue, len(request.Descriptors))
+	keysToGet := make([]string, 0, len(request.Descriptors))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key != "" {
+			counters[i].Key = cacheKey.Key
+			keysToGet = append(keysToGet, cacheKey.Key)
+		}
+	}
+	if len(keysToGet) == 0 {
+		return counters
+	}
+
+	memcacheValues, err := this.getMulti(ctx, keysToGet)
+	if err != nil {
+		panic(MemcacheError(err.Error()))
+	}
+	for i := range counters {
+		if item, ok := memcacheValues[counters[i].Key]; ok {
+			value, err := strconv.ParseUint(string(item.Value), 10, 64)
+			if err != nil {
+				logger.Errorf("Unexpected non-numeric value in memcached: %v", item)
+				continue
+			}
+			counters[i].Value = value
+		}
+	}
+	return counters
+}
+
+type getMultiResult struct {
+	items map[string]*memcache.Item
+	err   error
+}
+
+// getMulti returns the error of ctx if it is done before the keys are read, the memcache client
+// does not take a context.
+func (this *rateLimitMemcacheImpl) getMulti(ctx context.Context, keys []string) (map[string]*memcache.Item, error) {
+	if ctx.Done() == nil {
+		return this.client.GetMulti(keys)
+	}
+	result := make(chan getMultiResult, 1)
+	go func() {
+		items, err := this.client.GetMulti(keys)
+		result <- getMultiResult{items: items, err: err}
+	}()
+	select {
+	case r := <-result:
+		return r.items, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (this *rateLimitMemcacheImpl) increaseAsync(cacheKeys []limiter.CacheKey, isOverLimitWithLocalCache []bool,
 	limits []*config.RateLimit, hitsAddends []uint64,
 ) {
 	defer this.waitGroup.Done()
+	// the increments are not on the path of the request, they are timed on their own
+	defer this.baseRateLimiter.Timing.BackendIncrement.AllocateSpan().Complete()
 	for i, cacheKey := range cacheKeys {
-		if cacheKey.Key == "" || isOverLimitWithLocalCache[i] {
+		// a hits addend of 0 only reads the counter, which must not be created by the query
+		if cacheKey.Key == "" || isOverLimitWithLocalCache[i] || hitsAddends[i] == 0 {
 			continue
 		}
 
 		_, err := this.client.Increment(cacheKey.Key, hitsAddends[i])
 		if err == memcache.ErrCacheMiss {
-			expirationSeconds := utils.UnitToDivider(limits[i].Limit.Unit)
-			if this.expirationJitterMaxSeconds > 0 {
-				expirationSeconds += this.jitterRand.Int63n(this.expirationJitterMaxSeconds)
-			}
+			expirationSeconds := this.baseRateLimiter.ExpirationSeconds(limits[i])
 
 			// Need to add instead of increment.
 			err = this.client.Add(&memcache.Item{
@@ -194,7 +273,39 @@ func (this *rateLimitMemcacheImpl) Flush() {
 	this.waitGroup.Wait()
 }
 
-func refreshServersPeriodically(serverList *memcache.ServerList, srv string, d time.Duration, resolver srv.SrvResolver, finish <-chan struct{}) {
+// Close drains the increments so that they aren't lost when the service stops, the increments of
+// the requests still in flight then running in the request.
+func (this *rateLimitMemcacheImpl) Close() error {
+	if this.queue != nil {
+		this.queue.close()
+	}
+	this.Flush()
+	return nil
+}
+
+func (this *rateLimitMemcacheImpl) SetNearLimitRatio(ratio float32) {
+	this.baseRateLimiter.SetNearLimitRatio(ratio)
+}
+
+func (this *rateLimitMemcacheImpl) SetCacheKeyMaxLength(maxLength int) {
+	this.baseRateLimiter.SetCacheKeyMaxLength(maxLength)
+}
+
+func (this *rateLimitMemcacheImpl) SetExpirationJitterPolicy(policy limiter.ExpirationJitterPolicy) {
+	this.baseRateLimiter.SetExpirationJitterPolicy(policy)
+}
+
+func (this *rateLimitMemcacheImpl) SetLocalCachePolicy(policy limiter.LocalCachePolicy) {
+	this.baseRateLimiter.SetLocalCachePolicy(policy)
+}
+
+// serverSelector is a selector whose servers are set from the SRV records.
+type serverSelector interface {
+	memcache.ServerSelector
+	SetServers(servers ...string) error
+}
+
+func refreshServersPeriodically(serverList serverSelector, srv string, d time.Duration, resolver srv.SrvResolver, finish <-chan struct{}) {
 	t := time.NewTicker(d)
 	defer t.Stop()
 	for {
@@ -212,7 +323,7 @@ func refreshServersPeriodically(serverList *memcache.ServerList, srv string, d t
 	}
 }
 
-func refreshServers(serverList *memcache.ServerList, srv string, resolver srv.SrvResolver) error {
+func refreshServers(serverList serverSelector, srv string, resolver srv.SrvResolver) error {
 	servers, err := resolver.ServerStringsFromSrv(srv)
 	if err != nil {
 		return err
@@ -224,8 +335,8 @@ func refreshServers(serverList *memcache.ServerList, srv string, resolver srv.Sr
 	return nil
 }
 
-func newMemcachedFromSrv(srv string, d time.Duration, resolver srv.SrvResolver) *memcache.Client {
-	serverList := new(memcache.ServerList)
+// setServersFromSrv sets the servers of the SRV records, refreshed every d unless 0.
+func setServersFromSrv(serverList serverSelector, srv string, d time.Duration, resolver srv.SrvResolver) {
 	err := refreshServers(serverList, srv, resolver)
 	if err != nil {
 		errorText := "Unable to fetch servers from SRV"
@@ -240,31 +351,53 @@ func newMemcachedFromSrv(srv string, d time.Duration, resolver srv.SrvResolver)
 	} else {
 		logger.Debugf("not periodically refreshing memcached hosts")
 	}
-
-	return memcache.NewFromSelector(serverList)
 }
 
-func newMemcacheFromSettings(s settings.Settings) Client {
+func newMemcacheFromSettings(s settings.Settings, scope gostats.Scope) Client {
 	if s.MemcacheSrv != "" && len(s.MemcacheHostPort) > 0 {
 		panic(MemcacheError("Both MEMCADHE_HOST_PORT and MEMCACHE_SRV are set"))
 	}
-	var client *memcache.Client
+	var selector serverSelector
+	var ketama *KetamaSelector
+	switch s.MemcacheHashing {
+	case "default", "":
+		selector = new(memcache.ServerList)
+	case "ketama":
+		ketama = NewKetamaSelector(s.MemcacheVirtualNodes, s.MemcacheEjectionFailures, s.MemcacheEjectionDuration, scope)
+		selector = ketama
+	default:
+		panic(MemcacheError(fmt.Sprintf("Invalid MEMCACHE_HASHING: %s", s.MemcacheHashing)))
+	}
 	if s.MemcacheSrv != "" {
 		logger.Debugf("Using MEMCACHE_SRV: %v", s.MemcacheSrv)
-		client = newMemcachedFromSrv(s.MemcacheSrv, s.MemcacheSrvRefresh, new(srv.DnsSrvResolver))
+		setServersFromSrv(selector, s.MemcacheSrv, s.MemcacheSrvRefresh, new(srv.DnsSrvResolver))
 	} else {
 		logger.Debugf("Using MEMCACHE_HOST_PORT: %v", s.MemcacheHostPort)
-		client = memcache.New(s.MemcacheHostPort...)
+		if err := selector.SetServers(s.MemcacheHostPort...); err != nil {
+			logger.Errorf("Unable to resolve MEMCACHE_HOST_PORT: %v", err)
+		}
 	}
-	client.MaxIdleConns = s.MemcacheMaxIdleConns
+	var dialContext func(ctx context.Context, network, address string) (net.Conn, error)
 	if s.MemcacheTls {
-		client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
 			var td tls.Dialer
 			td.Config = s.MemcacheTlsConfig
 			return td.DialContext(ctx, network, address)
 		}
 	}
-	return client
+	if ketama != nil {
+		dialContext = ketama.Dialer(dialContext)
+	}
+	// SASL requires the binary protocol, which the memcache client doesn't speak
+	if s.MemcacheSaslUsername != "" {
+		logger.Debugf("Using the binary protocol to authenticate as %s", s.MemcacheSaslUsername)
+		return WithFanout(newBinaryClient(selector, s.MemcacheSaslUsername, s.MemcacheSaslPassword, dialContext,
+			s.MemcacheMaxIdleConns), selector, s.MemcacheGetFanout, scope)
+	}
+	client := memcache.NewFromSelector(selector)
+	client.MaxIdleConns = s.MemcacheMaxIdleConns
+	client.DialContext = dialContext
+	return WithFanout(newMemcacheClient(client, selector), selector, s.MemcacheGetFanout, scope)
 }
 
 var taskQueue = make(chan func())
@@ -304,22 +437,43 @@ func runAsync(task func()) {
 func NewRateLimitCacheImpl(client Client, timeSource utils.TimeSource, jitterRand *rand.Rand,
 	expirationJitterMaxSeconds int64, localCache *freecache.Cache, statsManager stats.Manager, nearLimitRatio float32, cacheKeyPrefix string,
 ) limiter.RateLimitCache {
-	return &rateLimitMemcacheImpl{
-		client:                     client,
-		timeSource:                 timeSource,
-		jitterRand:                 jitterRand,
-		expirationJitterMaxSeconds: expirationJitterMaxSeconds,
-		localCache:                 localCache,
-		nearLimitRatio:             nearLimitRatio,
-		baseRateLimiter:            limiter.NewBaseRateLimit(timeSource, jitterRand, expirationJitterMaxSeconds, localCache, nearLimitRatio, cacheKeyPrefix, statsManager),
+	return NewRateLimitCacheImplWithIncrementQueue(client, timeSource, jitterRand, expirationJitterMaxSeconds, localCache,
+		statsManager, nearLimitRatio, cacheKeyPrefix, IncrementQueueSettings{}, nil)
+}
+
+// NewRateLimitCacheImplWithIncrementQueue runs the increments on the workers of queue, whose queued,
+// overflowing and dropped increments count in scope. The cache is an io.Closer draining the
+// increments.
+func NewRateLimitCacheImplWithIncrementQueue(client Client, timeSource utils.TimeSource, jitterRand *rand.Rand,
+	expirationJitterMaxSeconds int64, localCache *freecache.Cache, statsManager stats.Manager, nearLimitRatio float32, cacheKeyPrefix string,
+	queue IncrementQueueSettings, scope gostats.Scope,
+) limiter.RateLimitCache {
+	cache := &rateLimitMemcacheImpl{
+		client:          client,
+		timeSource:      timeSource,
+		localCache:      localCache,
+		baseRateLimiter: limiter.NewBaseRateLimit(timeSource, jitterRand, expirationJitterMaxSeconds, localCache, nearLimitRatio, cacheKeyPrefix, statsManager),
+		refundStats:     limiter.NewRefundStats(statsManager.GetStatsStore().Scope("ratelimit").Scope("refund")),
 	}
+	if queue.Workers > 0 {
+		cache.queue = newIncrementQueue(queue, scope)
+	}
+	return cache
 }
 
 func NewRateLimitCacheImplFromSettings(s settings.Settings, timeSource utils.TimeSource, jitterRand *rand.Rand,
 	localCache *freecache.Cache, scope gostats.Scope, statsManager stats.Manager,
 ) limiter.RateLimitCache {
-	return NewRateLimitCacheImpl(
-		CollectStats(newMemcacheFromSettings(s), scope.Scope("memcache")),
+	var dropOnOverflow bool
+	switch s.MemcacheIncrementOverflow {
+	case "sync", "":
+	case "drop":
+		dropOnOverflow = true
+	default:
+		panic(MemcacheError(fmt.Sprintf("Invalid MEMCACHE_INCREMENT_OVERFLOW: %s", s.MemcacheIncrementOverflow)))
+	}
+	return NewRateLimitCacheImplWithIncrementQueue(
+		CollectStats(newMemcacheFromSettings(s, scope.Scope("memcache")), scope.Scope("memcache")),
 		timeSource,
 		jitterRand,
 		s.ExpirationJitterMaxSeconds,
@@ -327,5 +481,11 @@ func NewRateLimitCacheImplFromSettings(s settings.Settings, timeSource utils.Tim
 		statsManager,
 		s.NearLimitRatio,
 		s.CacheKeyPrefix,
+		IncrementQueueSettings{
+			Workers:        s.MemcacheIncrementWorkers,
+			Size:           s.MemcacheIncrementQueueSize,
+			DropOnOverflow: dropOnOverflow,
+		},
+		scope.Scope("memcache").Scope("increment_queue"),
 	)
 }
@@ -17,5 +17,7 @@ var _ Client = (*memcache.Client)(nil)
 type Client interface {
 	GetMulti(keys []string) (map[string]*memcache.Item, error)
 	Increment(key string, delta uint64) (newValue uint64, err error)
+	// Decrement clamps the value at zero, memcache.ErrCacheMiss if the key is missing.
+	Decrement(key string, delta uint64) (newValue uint64, err error)
 	Add(item *memcache.Item) error
 }
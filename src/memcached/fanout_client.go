@@ -0,0 +1,145 @@
+package memcached
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gostats "github.com/lyft/gostats"
+)
+
+// fanoutClient splits the keys of GetMulti by server and reads them from the servers concurrently,
+// at most maxFanout servers at a time, 0 for all of them, timing the reads of each server.
+type fanoutClient struct {
+	Client
+	selector  memcache.ServerSelector
+	maxFanout int
+	scope     gostats.Scope
+	// timers are the gostats.Timer of the reads of each server by address
+	timers sync.Map
+}
+
+// serverReader is implemented by the clients reading the keys of a server already picked, so that
+// the keys of a GetMulti are picked once. The keys of the other clients are picked again by them.
+type serverReader interface {
+	getMultiFromServer(addr net.Addr, keys []string) (map[string]*memcache.Item, error)
+}
+
+// memcacheClient is the memcache client reading the keys of a server with a client of this server
+// only, which keeps its own idle connections, so that the keys are not picked again.
+type memcacheClient struct {
+	*memcache.Client
+	selector memcache.ServerSelector
+	// servers are the *memcache.Client of each server by address
+	servers sync.Map
+}
+
+// singleServer is the selector of the client of a server.
+type singleServer struct {
+	addr net.Addr
+}
+
+func (this singleServer) PickServer(string) (net.Addr, error) { return this.addr, nil }
+func (this singleServer) Each(f func(net.Addr) error) error   { return f(this.addr) }
+
+func newMemcacheClient(client *memcache.Client, selector memcache.ServerSelector) *memcacheClient {
+	return &memcacheClient{Client: client, selector: selector}
+}
+
+func (this *memcacheClient) getMultiFromServer(addr net.Addr, keys []string) (map[string]*memcache.Item, error) {
+	client, ok := this.servers.Load(addr.String())
+	if !ok {
+		// the clients of the servers which left are closed with the first new server
+		current := map[string]bool{addr.String(): true}
+		this.selector.Each(func(addr net.Addr) error {
+			current[addr.String()] = true
+			return nil
+		})
+		this.servers.Range(func(addr, client any) bool {
+			if !current[addr.(string)] {
+				this.servers.Delete(addr)
+				client.(*memcache.Client).Close()
+			}
+			return true
+		})
+
+		server := memcache.NewFromSelector(singleServer{addr: addr})
+		server.Timeout = this.Timeout
+		server.MaxIdleConns = this.MaxIdleConns
+		server.DialContext = this.DialContext
+		client, _ = this.servers.LoadOrStore(addr.String(), server)
+	}
+	return client.(*memcache.Client).GetMulti(keys)
+}
+
+// WithFanout wraps the client of the servers of selector so that the keys of a GetMulti are read
+// from their servers concurrently, at most maxFanout at a time, the latency of the reads of each
+// server being timed in scope as multiget_latency tagged with the server.
+func WithFanout(client Client, selector memcache.ServerSelector, maxFanout int, scope gostats.Scope) Client {
+	return &fanoutClient{Client: client, selector: selector, maxFanout: maxFanout, scope: scope}
+}
+
+func (this *fanoutClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	keysByAddr := map[net.Addr][]string{}
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, memcache.ErrMalformedKey
+		}
+		addr, err := this.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		keysByAddr[addr] = append(keysByAddr[addr], key)
+	}
+	if len(keysByAddr) <= 1 {
+		for addr := range keysByAddr {
+			return this.getFromServer(addr, keys)
+		}
+		return map[string]*memcache.Item{}, nil
+	}
+
+	fanout := len(keysByAddr)
+	if this.maxFanout > 0 && this.maxFanout < fanout {
+		fanout = this.maxFanout
+	}
+	slots := make(chan struct{}, fanout)
+	items := make(map[string]*memcache.Item, len(keys))
+	var mu sync.Mutex
+	var err error
+	var wg sync.WaitGroup
+	for addr, keys := range keysByAddr {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(addr net.Addr, keys []string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			serverItems, serverErr := this.getFromServer(addr, keys)
+			mu.Lock()
+			defer mu.Unlock()
+			for key, item := range serverItems {
+				items[key] = item
+			}
+			if serverErr != nil {
+				err = serverErr
+			}
+		}(addr, keys)
+	}
+	wg.Wait()
+	return items, err
+}
+
+func (this *fanoutClient) getFromServer(addr net.Addr, keys []string) (map[string]*memcache.Item, error) {
+	timer, ok := this.timers.Load(addr.String())
+	if !ok {
+		timer, _ = this.timers.LoadOrStore(addr.String(),
+			this.scope.NewTimerWithTags("multiget_latency", map[string]string{"server": addr.String()}))
+	}
+	span := timer.(gostats.Timer).AllocateSpan()
+	defer span.Complete()
+	if reader, ok := this.Client.(serverReader); ok {
+		return reader.getMultiFromServer(addr, keys)
+	}
+	return this.Client.GetMulti(keys)
+}
@@ -0,0 +1,44 @@
+package memcached
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingSelector counts the keys picked.
+type countingSelector struct {
+	memcache.ServerList
+	picks atomic.Int32
+}
+
+func (this *countingSelector) PickServer(key string) (net.Addr, error) {
+	this.picks.Add(1)
+	return this.ServerList.PickServer(key)
+}
+
+func TestFanoutClientPicksOnce(t *testing.T) {
+	assert := assert.New(t)
+	servers := []*fakeBinaryServer{newFakeBinaryServer(t, "user", "secret"), newFakeBinaryServer(t, "user", "secret")}
+	selector := &countingSelector{}
+	assert.NoError(selector.SetServers(servers[0].listener.Addr().String(), servers[1].listener.Addr().String()))
+	client := WithFanout(newBinaryClient(selector, "user", "secret", nil, 1), selector, 0,
+		gostats.NewStore(gostats.NewNullSink(), false))
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		assert.NoError(client.Add(&memcache.Item{Key: keys[i], Value: []byte("1")}))
+	}
+	selector.picks.Store(0)
+
+	items, err := client.GetMulti(keys)
+	assert.NoError(err)
+	assert.Len(items, len(keys))
+	assert.EqualValues(len(keys), selector.picks.Load())
+}
@@ -0,0 +1,99 @@
+package memcached
+
+import (
+	"sync"
+
+	gostats "github.com/lyft/gostats"
+)
+
+// IncrementQueueSettings bounds the asynchronous increments of the memcache cache. With 0 workers
+// each increment runs on a worker created on demand, without bound.
+type IncrementQueueSettings struct {
+	// Workers is the number of workers running the increments.
+	Workers int
+	// Size is the number of increments waiting for a worker, beyond which the queue overflows.
+	Size int
+	// DropOnOverflow drops the increments of a full queue instead of running them in the request.
+	DropOnOverflow bool
+}
+
+// incrementQueue runs the increments on a fixed number of workers. Once closed the increments run
+// in the request, so that none is lost while the service stops.
+type incrementQueue struct {
+	tasks          chan func()
+	dropOnOverflow bool
+	mu             sync.RWMutex
+	closed         bool
+	workers        sync.WaitGroup
+
+	// queued is the number of waiting increments, overflow counts the increments of a full queue
+	// of which dropped counts the dropped ones.
+	queued   gostats.Gauge
+	overflow gostats.Counter
+	dropped  gostats.Counter
+}
+
+func newIncrementQueue(settings IncrementQueueSettings, scope gostats.Scope) *incrementQueue {
+	queue := &incrementQueue{
+		tasks:          make(chan func(), settings.Size),
+		dropOnOverflow: settings.DropOnOverflow,
+		queued:         scope.NewGauge("queued"),
+		overflow:       scope.NewCounter("overflow"),
+		dropped:        scope.NewCounter("dropped"),
+	}
+	for i := 0; i < settings.Workers; i++ {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+	return queue
+}
+
+func (this *incrementQueue) work() {
+	defer this.workers.Done()
+	for task := range this.tasks {
+		this.queued.Dec()
+		task()
+	}
+}
+
+// submit queues the task, or runs it when the queue is full or closed unless it drops it, and
+// returns whether the task was dropped.
+func (this *incrementQueue) submit(task func()) bool {
+	this.mu.RLock()
+	if !this.closed {
+		// counted before the send, a worker may run the task and Dec the gauge before the send returns
+		this.queued.Inc()
+		select {
+		case this.tasks <- task:
+			this.mu.RUnlock()
+			return false
+		default:
+			this.queued.Dec()
+		}
+	}
+	closed := this.closed
+	this.mu.RUnlock()
+
+	if !closed {
+		this.overflow.Inc()
+		if this.dropOnOverflow {
+			this.dropped.Inc()
+			return true
+		}
+	}
+	task()
+	return false
+}
+
+// close waits for the workers to run the queued increments.
+func (this *incrementQueue) close() {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.tasks)
+	this.mu.Unlock()
+	this.workers.Wait()
+}
@@ -0,0 +1,215 @@
+package memcached
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+)
+
+// KetamaSelector is a memcache.ServerSelector placing the nodes on a ring of consistent hashes, so
+// that adding or removing a node only moves the keys of its share of the ring. Each node is placed
+// on the ring virtualNodes times, rounded up to a multiple of 4 as in ketama.
+//
+// A node failing to accept ejectionFailures consecutive connections is ejected for ejectionDuration,
+// its keys moving to the next nodes of the ring. The ejection is passive: the node is tried again
+// once the duration elapsed, and ejected again after another ejectionFailures failed connections.
+type KetamaSelector struct {
+	virtualNodes     int
+	ejectionFailures int32
+	ejectionDuration time.Duration
+
+	mu sync.RWMutex
+	// points is the ring sorted by hash, each point indexing nodes
+	points []ketamaPoint
+	nodes  []*ketamaNode
+	// byAddr indexes the nodes by the address dialed by the client
+	byAddr map[string]*ketamaNode
+
+	ejections         gostats.Counter
+	redistributedKeys gostats.Counter
+	now               func() time.Time
+}
+
+type ketamaPoint struct {
+	hash uint32
+	node int
+}
+
+type ketamaNode struct {
+	addr     net.Addr
+	failures atomic.Int32
+	// ejectedUntil is the end of the ejection in unix nanoseconds, 0 when not ejected
+	ejectedUntil atomic.Int64
+}
+
+// ketamaAddr caches the Network() and String() values of an address, as the default selector does.
+type ketamaAddr struct {
+	network string
+	str     string
+}
+
+func (this *ketamaAddr) Network() string { return this.network }
+func (this *ketamaAddr) String() string  { return this.str }
+
+// NewKetamaSelector creates a selector without nodes, ejectionFailures of 0 disabling the ejection.
+// The ejections and the keys picked on another node than theirs count in scope.
+func NewKetamaSelector(virtualNodes int, ejectionFailures int, ejectionDuration time.Duration,
+	scope gostats.Scope,
+) *KetamaSelector {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	return &KetamaSelector{
+		virtualNodes:      virtualNodes,
+		ejectionFailures:  int32(ejectionFailures),
+		ejectionDuration:  ejectionDuration,
+		byAddr:            map[string]*ketamaNode{},
+		ejections:         scope.NewCounter("ejections"),
+		redistributedKeys: scope.NewCounter("redistributed_keys"),
+		now:               time.Now,
+	}
+}
+
+// SetServers changes the nodes of the ring, keeping the ejection of the nodes still present. If a
+// server fails to resolve no change is made.
+func (this *KetamaSelector) SetServers(servers ...string) error {
+	addrs := make([]net.Addr, len(servers))
+	for i, server := range servers {
+		if strings.Contains(server, "/") {
+			addr, err := net.ResolveUnixAddr("unix", server)
+			if err != nil {
+				return err
+			}
+			addrs[i] = &ketamaAddr{network: addr.Network(), str: addr.String()}
+		} else {
+			addr, err := net.ResolveTCPAddr("tcp", server)
+			if err != nil {
+				return err
+			}
+			addrs[i] = &ketamaAddr{network: addr.Network(), str: addr.String()}
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	nodes := make([]*ketamaNode, 0, len(addrs))
+	byAddr := make(map[string]*ketamaNode, len(addrs))
+	points := make([]ketamaPoint, 0, len(addrs)*this.virtualNodes)
+	for _, addr := range addrs {
+		if _, ok := byAddr[addr.String()]; ok {
+			continue
+		}
+		node, ok := this.byAddr[addr.String()]
+		if !ok {
+			node = &ketamaNode{addr: addr}
+		}
+		byAddr[addr.String()] = node
+		nodes = append(nodes, node)
+		// each md5 digest of a virtual node gives 4 points of the ring
+		for i := 0; i*4 < this.virtualNodes; i++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", addr.String(), i)))
+			for j := 0; j < 4; j++ {
+				points = append(points, ketamaPoint{
+					hash: binary.LittleEndian.Uint32(digest[j*4:]),
+					node: len(nodes) - 1,
+				})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	this.points = points
+	this.nodes = nodes
+	this.byAddr = byAddr
+	return nil
+}
+
+// PickServer returns the node of the first point of the ring at or after the hash of the key,
+// skipping the ejected nodes. If every node is ejected the key stays on its node.
+func (this *KetamaSelector) PickServer(key string) (net.Addr, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if len(this.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:])
+	start := sort.Search(len(this.points), func(i int) bool { return this.points[i].hash >= hash })
+
+	now := this.now().UnixNano()
+	primary := this.points[start%len(this.points)].node
+	for i := 0; i < len(this.points); i++ {
+		node := this.points[(start+i)%len(this.points)].node
+		if !this.nodes[node].isEjected(now) {
+			if node != primary {
+				this.redistributedKeys.Inc()
+			}
+			return this.nodes[node].addr, nil
+		}
+	}
+	return this.nodes[primary].addr, nil
+}
+
+// Each calls f with each node of the ring.
+func (this *KetamaSelector) Each(f func(net.Addr) error) error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	for _, node := range this.nodes {
+		if err := f(node.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dialer wraps the dialer of the client, nil for the default one, to eject the nodes failing to
+// accept connections.
+func (this *KetamaSelector) Dialer(dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		this.reportDial(address, err)
+		return conn, err
+	}
+}
+
+func (this *KetamaSelector) reportDial(address string, err error) {
+	if this.ejectionFailures <= 0 {
+		return
+	}
+	this.mu.RLock()
+	node, ok := this.byAddr[address]
+	this.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err == nil {
+		node.failures.Store(0)
+		return
+	}
+	if node.failures.Add(1) < this.ejectionFailures {
+		return
+	}
+	node.failures.Store(0)
+	node.ejectedUntil.Store(this.now().Add(this.ejectionDuration).UnixNano())
+	this.ejections.Inc()
+	logger.Warnf("ejecting memcache node %s for %v: %v", address, this.ejectionDuration, err)
+}
+
+func (this *ketamaNode) isEjected(now int64) bool {
+	return now < this.ejectedUntil.Load()
+}
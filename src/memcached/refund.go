@@ -0,0 +1,52 @@
+package memcached
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// RefundHits decrements the counters, memcached clamps them at zero and does not create the missing
+// ones. The decrement does not return the hits removed: a refund is reported in full unless its
+// counter is missing, and a counter decremented to zero counts as clamped. The increments of the
+// requests still in flight are not waited for.
+func (this *rateLimitMemcacheImpl) RefundHits(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	countedAt int64,
+) []limiter.RefundValue {
+	cacheKeys, hitsAddends := this.baseRateLimiter.GenerateRefundCacheKeys(request, limits, countedAt)
+	refunds := make([]limiter.RefundValue, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		refunds[i].Key = cacheKey.Key
+		if hitsAddends[i] == 0 {
+			continue
+		}
+
+		value, err := this.client.Decrement(cacheKey.Key, hitsAddends[i])
+		if err == memcache.ErrCacheMiss {
+			this.refundStats.Record(hitsAddends[i], 0)
+			continue
+		}
+		if err != nil {
+			panic(MemcacheError(err.Error()))
+		}
+		refunds[i].Value = value
+		refunds[i].Refunded = hitsAddends[i]
+		this.refundStats.Refunds.Inc()
+		this.refundStats.RefundedHits.Add(hitsAddends[i])
+		if value == 0 {
+			this.refundStats.Clamped.Inc()
+		}
+		// the key may no longer be over or near its limit
+		this.baseRateLimiter.ForgetLocalCache(cacheKey.Key)
+	}
+	return refunds
+}
@@ -1,79 +1,86 @@
 package memcached
 
 import (
+	"time"
+
 	"github.com/bradfitz/gomemcache/memcache"
 	stats "github.com/lyft/gostats"
+
+	rlstats "github.com/envoyproxy/ratelimit/src/stats"
 )
 
 type statsCollectingClient struct {
 	c Client
 
-	multiGetSuccess  stats.Counter
-	multiGetError    stats.Counter
-	incrementSuccess stats.Counter
-	incrementMiss    stats.Counter
-	incrementError   stats.Counter
-	addSuccess       stats.Counter
-	addError         stats.Counter
-	addNotStored     stats.Counter
-	keysRequested    stats.Counter
-	keysFound        stats.Counter
+	multiGet      rlstats.BackendOpStats
+	increment     rlstats.BackendOpStats
+	decrement     rlstats.BackendOpStats
+	add           rlstats.BackendOpStats
+	addNotStored  stats.Counter
+	keysRequested stats.Counter
+	keysFound     stats.Counter
 }
 
+// CollectStats counts the results of the operations of the client and times them with the backend
+// operation stats shared with Redis, a failed add of an existing key counting as add not_stored.
 func CollectStats(c Client, scope stats.Scope) Client {
 	return statsCollectingClient{
-		c:                c,
-		multiGetSuccess:  scope.NewCounterWithTags("multiget", map[string]string{"code": "success"}),
-		multiGetError:    scope.NewCounterWithTags("multiget", map[string]string{"code": "error"}),
-		incrementSuccess: scope.NewCounterWithTags("increment", map[string]string{"code": "success"}),
-		incrementMiss:    scope.NewCounterWithTags("increment", map[string]string{"code": "miss"}),
-		incrementError:   scope.NewCounterWithTags("increment", map[string]string{"code": "error"}),
-		addSuccess:       scope.NewCounterWithTags("add", map[string]string{"code": "success"}),
-		addError:         scope.NewCounterWithTags("add", map[string]string{"code": "error"}),
-		addNotStored:     scope.NewCounterWithTags("add", map[string]string{"code": "not_stored"}),
-		keysRequested:    scope.NewCounter("keys_requested"),
-		keysFound:        scope.NewCounter("keys_found"),
+		c:             c,
+		multiGet:      rlstats.NewBackendOpStats(scope, "multiget"),
+		increment:     rlstats.NewBackendOpStats(scope, "increment"),
+		decrement:     rlstats.NewBackendOpStats(scope, "decrement"),
+		add:           rlstats.NewBackendOpStats(scope, "add"),
+		addNotStored:  scope.NewCounterWithTags("add", map[string]string{"code": "not_stored"}),
+		keysRequested: scope.NewCounter("keys_requested"),
+		keysFound:     scope.NewCounter("keys_found"),
 	}
 }
 
 func (scc statsCollectingClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
 	scc.keysRequested.Add(uint64(len(keys)))
 
+	start := time.Now()
 	results, err := scc.c.GetMulti(keys)
+	scc.multiGet.Record(start, err, false)
 
-	if err != nil {
-		scc.multiGetError.Inc()
-	} else {
+	if err == nil {
 		scc.keysFound.Add(uint64(len(results)))
-		scc.multiGetSuccess.Inc()
 	}
 
 	return results, err
 }
 
 func (scc statsCollectingClient) Increment(key string, delta uint64) (newValue uint64, err error) {
+	start := time.Now()
 	newValue, err = scc.c.Increment(key, delta)
-	switch err {
-	case memcache.ErrCacheMiss:
-		scc.incrementMiss.Inc()
-	case nil:
-		scc.incrementSuccess.Inc()
-	default:
-		scc.incrementError.Inc()
+	if err == memcache.ErrCacheMiss {
+		scc.increment.Record(start, nil, true)
+	} else {
+		scc.increment.Record(start, err, false)
+	}
+	return
+}
+
+func (scc statsCollectingClient) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	start := time.Now()
+	newValue, err = scc.c.Decrement(key, delta)
+	if err == memcache.ErrCacheMiss {
+		scc.decrement.Record(start, nil, true)
+	} else {
+		scc.decrement.Record(start, err, false)
 	}
 	return
 }
 
 func (scc statsCollectingClient) Add(item *memcache.Item) error {
+	start := time.Now()
 	err := scc.c.Add(item)
 
-	switch err {
-	case memcache.ErrNotStored:
+	if err == memcache.ErrNotStored {
+		scc.add.Latency.AddDuration(time.Since(start))
 		scc.addNotStored.Inc()
-	case nil:
-		scc.addSuccess.Inc()
-	default:
-		scc.addError.Inc()
+	} else {
+		scc.add.Record(start, err, false)
 	}
 
 	return err
@@ -0,0 +1,158 @@
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+type pusherStats struct {
+	pushSuccess gostats.Counter
+	pushFailure gostats.Counter
+}
+
+func newPusherStats(scope gostats.Scope) pusherStats {
+	ret := pusherStats{}
+	ret.pushSuccess = scope.NewCounter("push_success")
+	ret.pushFailure = scope.NewCounter("push_failure")
+	return ret
+}
+
+// Pusher continuously profiles the process, pushing a CPU profile of the start of each interval
+// and a heap profile to a pyroscope compatible /ingest API. The CPU profiler is left free for the
+// rest of the interval, so that /debug/pprof/profile can use it.
+type Pusher struct {
+	ingestUrl   string
+	appName     string
+	interval    time.Duration
+	cpuDuration time.Duration
+	client      *http.Client
+	stats       pusherStats
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+}
+
+// NewPusher creates a Pusher from the profiling settings.
+func NewPusher(s settings.Settings, scope gostats.Scope) *Pusher {
+	return &Pusher{
+		ingestUrl:   s.ProfilingPushUrl,
+		appName:     s.ProfilingAppName,
+		interval:    s.ProfilingPushInterval,
+		cpuDuration: s.ProfilingCpuDuration,
+		client:      &http.Client{Timeout: s.ProfilingPushInterval},
+		stats:       newPusherStats(scope),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start profiles the process in the background until Stop is called.
+func (this *Pusher) Start() {
+	logger.Infof("Pushing the profiles to %s every %s", this.ingestUrl, this.interval)
+	go func() {
+		defer close(this.done)
+		for {
+			select {
+			case <-this.stop:
+				return
+			default:
+			}
+			start := time.Now()
+			this.profile()
+			if !this.wait(this.interval - time.Since(start)) {
+				return
+			}
+		}
+	}()
+}
+
+// wait waits for d, false if Stop is called first.
+func (this *Pusher) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-this.stop:
+		return false
+	}
+}
+
+// Stop ends the profiling, the CPU profile being taken being pushed.
+func (this *Pusher) Stop() {
+	this.stopOnce.Do(func() { close(this.stop) })
+	<-this.done
+}
+
+// profile records the CPU profile of the CPU duration, or until Stop, and pushes it with the heap
+// profile.
+func (this *Pusher) profile() {
+	from := time.Now()
+	var cpu bytes.Buffer
+	// the CPU profile fails if another one is running, e.g. from /debug/pprof/profile
+	cpuErr := pprof.StartCPUProfile(&cpu)
+	if cpuErr != nil {
+		logger.Warnf("unable to start the CPU profile: %v", cpuErr)
+	}
+	this.wait(this.cpuDuration)
+	if cpuErr == nil {
+		pprof.StopCPUProfile()
+	}
+	until := time.Now()
+
+	if cpuErr == nil {
+		this.push("cpu", &cpu, from, until)
+	}
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		logger.Warnf("unable to write the heap profile: %v", err)
+		return
+	}
+	this.push("heap", &heap, from, until)
+}
+
+func (this *Pusher) push(profileType string, profile *bytes.Buffer, from time.Time, until time.Time) {
+	if err := this.ingest(profileType, profile, from, until); err != nil {
+		logger.Warnf("unable to push the %s profile: %v", profileType, err)
+		this.stats.pushFailure.Inc()
+		return
+	}
+	this.stats.pushSuccess.Inc()
+}
+
+func (this *Pusher) ingest(profileType string, profile *bytes.Buffer, from time.Time, until time.Time) error {
+	query := url.Values{}
+	query.Set("name", this.appName+"."+profileType)
+	query.Set("from", strconv.FormatInt(from.Unix(), 10))
+	query.Set("until", strconv.FormatInt(until.Unix(), 10))
+	query.Set("format", "pprof")
+	query.Set("spyName", "gospy")
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, this.ingestUrl+"?"+query.Encode(), profile)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := this.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
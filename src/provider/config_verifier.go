@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lyft/goruntime/snapshot"
+	gostats "github.com/lyft/gostats"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// configVerifier verifies the config files of a reload against a checksum manifest in the sha256sum
+// format, whose detached ed25519 signature is verified first when a public key is given.
+type configVerifier struct {
+	manifestKey  string
+	signatureKey string
+	// keyPrefix is the prefix of the runtime keys of the files of the config directory.
+	keyPrefix string
+	publicKey ed25519.PublicKey
+	verified  gostats.Counter
+	rejected  gostats.Counter
+}
+
+// newConfigVerifier returns the verifier of the config files of settings, nil if they aren't verified.
+// It panics if the public key can't be loaded.
+func newConfigVerifier(s settings.Settings, scope gostats.Scope) *configVerifier {
+	if s.ConfigChecksumManifest == "" {
+		return nil
+	}
+	keyPrefix := ""
+	if s.RuntimeWatchRoot {
+		keyPrefix = s.RuntimeAppDirectory + "."
+	}
+	ret := &configVerifier{
+		manifestKey:  keyPrefix + strings.ReplaceAll(s.ConfigChecksumManifest, "/", "."),
+		signatureKey: keyPrefix + strings.ReplaceAll(s.ConfigChecksumManifest, "/", ".") + ".sig",
+		keyPrefix:    keyPrefix,
+		verified:     scope.NewCounter("verified"),
+		rejected:     scope.NewCounter("rejected"),
+	}
+	if s.ConfigSignaturePublicKey != "" {
+		publicKey, err := loadEd25519PublicKey(s.ConfigSignaturePublicKey)
+		if err != nil {
+			panic(fmt.Errorf("failed to load CONFIG_SIGNATURE_PUBLIC_KEY: %w", err))
+		}
+		ret.publicKey = publicKey
+	}
+	return ret
+}
+
+func loadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+// isVerificationFile returns whether the runtime key is the manifest or its signature, which aren't configs.
+func (this *configVerifier) isVerificationFile(key string) bool {
+	return key == this.manifestKey || key == this.signatureKey
+}
+
+// verify checks the config files of keys in snapshot against the manifest, each of them being
+// listed with its checksum and each listed file being present.
+// @throws RateLimitConfigError if the files don't match the manifest or the manifest isn't signed.
+func (this *configVerifier) verify(snapshot snapshot.IFace, keys []string) {
+	if err := this.check(snapshot, keys); err != nil {
+		this.rejected.Inc()
+		panic(config.RateLimitConfigError("config verification failed: " + err.Error()))
+	}
+	this.verified.Inc()
+}
+
+func (this *configVerifier) check(snapshot snapshot.IFace, keys []string) error {
+	entries := snapshot.Entries()
+	if _, ok := entries[this.manifestKey]; !ok {
+		return fmt.Errorf("missing checksum manifest %s", this.manifestKey)
+	}
+	manifest := snapshot.Get(this.manifestKey)
+	if this.publicKey != nil {
+		if _, ok := entries[this.signatureKey]; !ok {
+			return fmt.Errorf("missing signature %s", this.signatureKey)
+		}
+		signature := []byte(snapshot.Get(this.signatureKey))
+		if len(signature) != ed25519.SignatureSize {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+			if err != nil {
+				return fmt.Errorf("invalid signature %s: %w", this.signatureKey, err)
+			}
+			signature = decoded
+		}
+		if !ed25519.Verify(this.publicKey, []byte(manifest), signature) {
+			return fmt.Errorf("the signature %s doesn't match the manifest", this.signatureKey)
+		}
+	}
+
+	checksums, err := this.parseManifest(manifest)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		checksum, ok := checksums[key]
+		if !ok {
+			return fmt.Errorf("%s is not in the manifest", key)
+		}
+		sum := sha256.Sum256([]byte(snapshot.Get(key)))
+		if hex.EncodeToString(sum[:]) != checksum {
+			return fmt.Errorf("the checksum of %s doesn't match the manifest", key)
+		}
+		delete(checksums, key)
+	}
+	for key := range checksums {
+		return fmt.Errorf("%s of the manifest is missing", key)
+	}
+	return nil
+}
+
+// parseManifest returns the checksums of the manifest by runtime key.
+func (this *configVerifier) parseManifest(manifest string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("invalid manifest line %q", line)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[1], "*"), "./")
+		checksums[this.keyPrefix+strings.ReplaceAll(name, "/", ".")] = strings.ToLower(fields[0])
+	}
+	return checksums, scanner.Err()
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpillora/backoff"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+type consulKVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+// ConsulProvider watches a key prefix in the Consul KV store using blocking queries and loads
+// every key under the prefix as a rate limit configuration file.
+type ConsulProvider struct {
+	settings              settings.Settings
+	loader                config.RateLimitConfigLoader
+	configUpdateEventChan chan ConfigUpdateEvent
+	statsManager          stats.Manager
+	client                *http.Client
+	ctx                   context.Context
+	cancel                context.CancelFunc
+}
+
+// NewConsulProvider creates a new ConsulProvider and starts watching the key prefix.
+func NewConsulProvider(settings settings.Settings, statsManager stats.Manager) RateLimitConfigProvider {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ConsulProvider{
+		settings:              settings,
+		loader:                config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
+		configUpdateEventChan: make(chan ConfigUpdateEvent),
+		statsManager:          statsManager,
+		client:                &http.Client{},
+		ctx:                   ctx,
+		cancel:                cancel,
+	}
+	logger.Infof("Watching Consul KV prefix '%s' on %s", settings.ConsulKVPrefix, settings.ConsulAddress)
+	go p.watch()
+	return p
+}
+
+// ConfigUpdateEvent returns config provider channel
+func (p *ConsulProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
+	return p.configUpdateEventChan
+}
+
+func (p *ConsulProvider) Stop() {
+	p.cancel()
+}
+
+func (p *ConsulProvider) watch() {
+	b := &backoff.Backoff{
+		Min:    p.settings.ConsulRetryInitialInterval,
+		Max:    p.settings.ConsulRetryMaxInterval,
+		Jitter: true,
+	}
+
+	var index uint64
+	for {
+		pairs, newIndex, err := p.fetch(index)
+		if p.ctx.Err() != nil {
+			logger.Info("Stopping Consul KV watch for rate limit configurations")
+			return
+		}
+		if err != nil {
+			d := b.Duration()
+			logger.Errorf("Consul KV watch failed, retrying in %s: %s", d, err.Error())
+			select {
+			case <-time.After(d):
+			case <-p.ctx.Done():
+				return
+			}
+			continue
+		}
+		b.Reset()
+
+		// A blocking query returns on timeout without changes, and the index can go backwards
+		// when the Consul servers are restored from a snapshot.
+		if newIndex == index {
+			continue
+		}
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+		p.sendEvent(pairs)
+	}
+}
+
+// fetch runs a blocking query on the key prefix and returns the keys with the new Consul index.
+func (p *ConsulProvider) fetch(index uint64) ([]consulKVPair, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%dms", p.settings.ConsulWaitTime.Milliseconds()))
+	}
+	reqUrl := fmt.Sprintf("%s/v1/kv/%s?%s", strings.TrimSuffix(p.settings.ConsulAddress, "/"), p.settings.ConsulKVPrefix, query.Encode())
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.settings.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", p.settings.ConsulToken)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, 0, fmt.Errorf("unexpected status from Consul: %s", resp.Status)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index header: %w", err)
+	}
+	pairs := []consulKVPair{}
+	// a 404 means there are no keys under the prefix
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode Consul KV response: %w", err)
+		}
+	}
+	return pairs, newIndex, nil
+}
+
+func (p *ConsulProvider) sendEvent(pairs []consulKVPair) {
+	defer func() {
+		if e := recover(); e != nil {
+			p.send(&ConfigUpdateEventImpl{err: e})
+		}
+	}()
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	files := []config.RateLimitConfigToLoad{}
+	for _, pair := range pairs {
+		// skip folders
+		if strings.HasSuffix(pair.Key, "/") || len(pair.Value) == 0 {
+			continue
+		}
+		configYaml := config.ConfigFileContentToYamlWithOptions(pair.Key, string(pair.Value), config.NewLoaderOptions(p.settings))
+		files = append(files, config.RateLimitConfigToLoad{Name: pair.Key, ConfigYaml: configYaml})
+	}
+
+	rlSettings := settings.NewSettings()
+	newConfig := p.loader.Load(files, p.statsManager, rlSettings.MergeDomainConfigurations)
+	p.send(&ConfigUpdateEventImpl{config: newConfig})
+}
+
+func (p *ConsulProvider) send(event ConfigUpdateEvent) {
+	select {
+	case p.configUpdateEventChan <- event:
+	case <-p.ctx.Done():
+	}
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/lyft/goruntime/loader"
@@ -11,17 +12,30 @@ import (
 	"github.com/envoyproxy/ratelimit/src/config"
 	"github.com/envoyproxy/ratelimit/src/settings"
 	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/src/utils"
 )
 
 type FileProvider struct {
 	settings              settings.Settings
 	loader                config.RateLimitConfigLoader
 	configUpdateEventChan chan ConfigUpdateEvent
-	runtime               loader.IFace
-	runtimeUpdateEvent    chan int
-	runtimeWatchRoot      bool
-	rootStore             gostats.Store
-	statsManager          stats.Manager
+	// sources are the config directories, in the order of their files in the configuration.
+	sources            []*runtimeSource
+	runtimeUpdateEvent chan int
+	runtimeWatchRoot   bool
+	rootStore          gostats.Store
+	statsManager       stats.Manager
+	// verifier verifies the config files before they are loaded, nil if they aren't verified.
+	verifier *configVerifier
+}
+
+// runtimeSource is the config directory of a runtime subdirectory.
+type runtimeSource struct {
+	subdirectory string
+	runtime      loader.IFace
+	updates      chan int
+	reloads      gostats.Counter
+	files        gostats.Gauge
 }
 
 func (p *FileProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
@@ -31,7 +45,16 @@ func (p *FileProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
 func (p *FileProvider) Stop() {}
 
 func (p *FileProvider) watch() {
-	p.runtime.AddUpdateCallback(p.runtimeUpdateEvent)
+	for _, source := range p.sources {
+		source.runtime.AddUpdateCallback(source.updates)
+		go func(source *runtimeSource) {
+			for range source.updates {
+				logger.Debugf("got runtime update of %q", source.subdirectory)
+				source.reloads.Inc()
+				p.runtimeUpdateEvent <- 1
+			}
+		}(source)
+	}
 
 	go func() {
 		p.sendEvent()
@@ -53,14 +76,33 @@ func (p *FileProvider) sendEvent() {
 	}()
 
 	files := []config.RateLimitConfigToLoad{}
-	snapshot := p.runtime.Snapshot()
-	for _, key := range snapshot.Keys() {
-		if p.runtimeWatchRoot && !strings.HasPrefix(key, p.settings.RuntimeAppDirectory+".") {
-			continue
+	for _, source := range p.sources {
+		snapshot := source.runtime.Snapshot()
+		keys := []string{}
+		for _, key := range snapshot.Keys() {
+			if p.runtimeWatchRoot && !strings.HasPrefix(key, p.settings.RuntimeAppDirectory+".") {
+				continue
+			}
+			if p.verifier != nil && p.verifier.isVerificationFile(key) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		// the files of a source are loaded in a stable order, for the merged domains to be too
+		sort.Strings(keys)
+		if p.verifier != nil {
+			p.verifier.verify(snapshot, keys)
+		}
+		source.files.Set(uint64(len(keys)))
+
+		for _, key := range keys {
+			name := key
+			if len(p.sources) > 1 {
+				name = source.subdirectory + "/" + key
+			}
+			configYaml := config.ConfigFileContentToYamlWithOptions(name, snapshot.Get(key), config.NewLoaderOptions(p.settings))
+			files = append(files, config.RateLimitConfigToLoad{Name: name, ConfigYaml: configYaml})
 		}
-
-		configYaml := config.ConfigFileContentToYaml(key, snapshot.Get(key))
-		files = append(files, config.RateLimitConfigToLoad{Name: key, ConfigYaml: configYaml})
 	}
 
 	rlSettings := settings.NewSettings()
@@ -69,18 +111,19 @@ func (p *FileProvider) sendEvent() {
 	p.configUpdateEventChan <- &ConfigUpdateEventImpl{config: newConfig}
 }
 
-func (p *FileProvider) setupRuntime() {
+func (p *FileProvider) setupRuntime(subdirectory string) loader.IFace {
 	loaderOpts := make([]loader.Option, 0, 1)
 	if p.settings.RuntimeIgnoreDotFiles {
 		loaderOpts = append(loaderOpts, loader.IgnoreDotFiles)
 	} else {
 		loaderOpts = append(loaderOpts, loader.AllowDotFiles)
 	}
+	var runtime loader.IFace
 	var err error
 	if p.settings.RuntimeWatchRoot {
-		p.runtime, err = loader.New2(
+		runtime, err = loader.New2(
 			p.settings.RuntimePath,
-			p.settings.RuntimeSubdirectory,
+			subdirectory,
 			p.rootStore.ScopeWithTags("runtime", p.settings.ExtraTags),
 			&loader.SymlinkRefresher{RuntimePath: p.settings.RuntimePath},
 			loaderOpts...)
@@ -89,8 +132,8 @@ func (p *FileProvider) setupRuntime() {
 		// Adding loader.Remove to the default set of goruntime's FileSystemOps.
 		directoryRefresher.WatchFileSystemOps(loader.Remove, loader.Write, loader.Create, loader.Chmod)
 
-		p.runtime, err = loader.New2(
-			filepath.Join(p.settings.RuntimePath, p.settings.RuntimeSubdirectory),
+		runtime, err = loader.New2(
+			filepath.Join(p.settings.RuntimePath, subdirectory),
 			p.settings.RuntimeAppDirectory,
 			p.rootStore.ScopeWithTags("runtime", p.settings.ExtraTags),
 			directoryRefresher,
@@ -100,19 +143,43 @@ func (p *FileProvider) setupRuntime() {
 	if err != nil {
 		panic(err)
 	}
+	return runtime
 }
 
+// NewFileProvider returns the provider of the config files of the runtime subdirectories of settings,
+// whose configurations are loaded together in the order of the subdirectories.
 func NewFileProvider(settings settings.Settings, statsManager stats.Manager, rootStore gostats.Store) RateLimitConfigProvider {
 	p := &FileProvider{
 		settings:              settings,
-		loader:                config.NewRateLimitConfigLoaderImpl(),
+		loader:                config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
 		configUpdateEventChan: make(chan ConfigUpdateEvent),
 		runtimeUpdateEvent:    make(chan int),
 		runtimeWatchRoot:      settings.RuntimeWatchRoot,
 		rootStore:             rootStore,
 		statsManager:          statsManager,
+		verifier: newConfigVerifier(settings,
+			statsManager.GetStatsStore().ScopeWithTags("ratelimit", settings.ExtraTags).Scope("config_verification")),
+	}
+	// the overlays of the runtime subdirectories follow the base one, at the root when unset
+	subdirectories := settings.RuntimeSubdirectories
+	if settings.RuntimeSubdirectory != "" || len(subdirectories) == 0 {
+		subdirectories = append([]string{settings.RuntimeSubdirectory}, subdirectories...)
+	}
+	sourcesScope := statsManager.GetStatsStore().ScopeWithTags("ratelimit", settings.ExtraTags).Scope("config_source")
+	for _, subdirectory := range subdirectories {
+		name := subdirectory
+		if name == "" {
+			name = "root"
+		}
+		scope := sourcesScope.Scope(utils.SanitizeStatName(name))
+		p.sources = append(p.sources, &runtimeSource{
+			subdirectory: subdirectory,
+			runtime:      p.setupRuntime(subdirectory),
+			updates:      make(chan int),
+			reloads:      scope.NewCounter("reloads"),
+			files:        scope.NewGauge("files"),
+		})
 	}
-	p.setupRuntime()
 	go p.watch()
 	return p
 }
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jpillora/backoff"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+type kubernetesObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type kubernetesConfigMap struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Data     map[string]string    `json:"data"`
+}
+
+type kubernetesConfigMapList struct {
+	Metadata kubernetesObjectMeta  `json:"metadata"`
+	Items    []kubernetesConfigMap `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type string `json:"type"`
+}
+
+// KubernetesProvider watches labeled ConfigMaps through the Kubernetes API and loads every
+// `.yaml`/`.yml` data key as a rate limit configuration. Any change to the matching ConfigMaps
+// reloads the whole set.
+type KubernetesProvider struct {
+	settings              settings.Settings
+	loader                config.RateLimitConfigLoader
+	configUpdateEventChan chan ConfigUpdateEvent
+	statsManager          stats.Manager
+	client                *http.Client
+	apiServerUrl          string
+	namespace             string
+	ctx                   context.Context
+	cancel                context.CancelFunc
+}
+
+// NewKubernetesProvider creates a new KubernetesProvider and starts watching ConfigMaps.
+func NewKubernetesProvider(settings settings.Settings, statsManager stats.Manager) RateLimitConfigProvider {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &KubernetesProvider{
+		settings:              settings,
+		loader:                config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
+		configUpdateEventChan: make(chan ConfigUpdateEvent),
+		statsManager:          statsManager,
+		client:                newKubernetesHttpClient(settings),
+		apiServerUrl:          getKubernetesApiServerUrl(settings),
+		namespace:             getKubernetesNamespace(settings),
+		ctx:                   ctx,
+		cancel:                cancel,
+	}
+	logger.Infof("Watching ConfigMaps in namespace '%s' with label selector '%s' on %s",
+		p.namespace, settings.KubernetesConfigLabelSelector, p.apiServerUrl)
+	go p.watch()
+	return p
+}
+
+// ConfigUpdateEvent returns config provider channel
+func (p *KubernetesProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
+	return p.configUpdateEventChan
+}
+
+func (p *KubernetesProvider) Stop() {
+	p.cancel()
+}
+
+func (p *KubernetesProvider) watch() {
+	b := &backoff.Backoff{
+		Min:    p.settings.KubernetesRetryInitialInterval,
+		Max:    p.settings.KubernetesRetryMaxInterval,
+		Jitter: true,
+	}
+
+	for {
+		resourceVersion, err := p.listAndSend()
+		if err == nil {
+			b.Reset()
+			err = p.watchConfigMaps(resourceVersion)
+		}
+		if p.ctx.Err() != nil {
+			logger.Info("Stopping Kubernetes ConfigMap watch for rate limit configurations")
+			return
+		}
+		if err != nil {
+			d := b.Duration()
+			logger.Errorf("Kubernetes ConfigMap watch failed, retrying in %s: %s", d, err.Error())
+			select {
+			case <-time.After(d):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// listAndSend lists the matching ConfigMaps, sends the loaded config and returns the list
+// resource version to start watching from.
+func (p *KubernetesProvider) listAndSend() (string, error) {
+	list := &kubernetesConfigMapList{}
+	resp, err := p.doRequest(url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return "", fmt.Errorf("failed to decode ConfigMap list: %w", err)
+	}
+
+	p.sendEvent(list.Items)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchConfigMaps blocks until a ConfigMap changes or the watch ends. A nil error means the
+// ConfigMaps must be listed again.
+func (p *KubernetesProvider) watchConfigMaps(resourceVersion string) error {
+	resp, err := p.doRequest(url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := &kubernetesWatchEvent{}
+		if err := decoder.Decode(event); err != nil {
+			if p.ctx.Err() != nil {
+				return nil
+			}
+			// the API server closes watches periodically, start over with a new list
+			logger.Debugf("Kubernetes ConfigMap watch ended: %s", err.Error())
+			return nil
+		}
+		switch event.Type {
+		case "BOOKMARK":
+			continue
+		case "ERROR":
+			// typically the resource version is too old, start over with a new list
+			logger.Debugf("Kubernetes ConfigMap watch returned an error event")
+			return nil
+		default:
+			logger.Debugf("Kubernetes ConfigMap %s event, reloading config", event.Type)
+			return nil
+		}
+	}
+}
+
+func (p *KubernetesProvider) doRequest(query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", p.settings.KubernetesConfigLabelSelector)
+	reqUrl := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps?%s", p.apiServerUrl, url.PathEscape(p.namespace), query.Encode())
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the service account token is rotated by the kubelet, read it on every request
+	if p.settings.KubernetesTokenFile != "" {
+		token, err := os.ReadFile(p.settings.KubernetesTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Kubernetes token file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status from Kubernetes API: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (p *KubernetesProvider) sendEvent(configMaps []kubernetesConfigMap) {
+	defer func() {
+		if e := recover(); e != nil {
+			p.send(&ConfigUpdateEventImpl{err: e})
+		}
+	}()
+
+	sort.Slice(configMaps, func(i, j int) bool { return configMaps[i].Metadata.Name < configMaps[j].Metadata.Name })
+	files := []config.RateLimitConfigToLoad{}
+	for _, cm := range configMaps {
+		keys := make([]string, 0, len(cm.Data))
+		for key := range cm.Data {
+			if strings.HasSuffix(key, ".yaml") || strings.HasSuffix(key, ".yml") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := cm.Metadata.Namespace + "/" + cm.Metadata.Name + "/" + key
+			configYaml := config.ConfigFileContentToYamlWithOptions(name, cm.Data[key], config.NewLoaderOptions(p.settings))
+			files = append(files, config.RateLimitConfigToLoad{Name: name, ConfigYaml: configYaml})
+		}
+	}
+
+	rlSettings := settings.NewSettings()
+	newConfig := p.loader.Load(files, p.statsManager, rlSettings.MergeDomainConfigurations)
+	p.send(&ConfigUpdateEventImpl{config: newConfig})
+}
+
+func (p *KubernetesProvider) send(event ConfigUpdateEvent) {
+	select {
+	case p.configUpdateEventChan <- event:
+	case <-p.ctx.Done():
+	}
+}
+
+func newKubernetesHttpClient(s settings.Settings) *http.Client {
+	var tlsConfig *tls.Config
+	if s.KubernetesCACert != "" {
+		if _, err := os.Stat(s.KubernetesCACert); err == nil {
+			tlsConfig = utils.TlsConfigFromFiles("", "", s.KubernetesCACert, utils.ServerCA, false)
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DialContext:     (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		},
+	}
+}
+
+func getKubernetesApiServerUrl(s settings.Settings) string {
+	if s.KubernetesApiServerUrl != "" {
+		return strings.TrimSuffix(s.KubernetesApiServerUrl, "/")
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		logger.Fatalf("KUBERNETES_API_SERVER_URL is not set and the service is not running in a Kubernetes cluster")
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+func getKubernetesNamespace(s settings.Settings) string {
+	if s.KubernetesConfigNamespace != "" {
+		return s.KubernetesConfigNamespace
+	}
+	namespace, err := os.ReadFile(s.KubernetesNamespaceFile)
+	if err != nil {
+		logger.Fatalf("KUBERNETES_CONFIG_NAMESPACE is not set and the namespace could not be read: %v", err)
+	}
+	return strings.TrimSpace(string(namespace))
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+// MergedProvider runs the file provider and an xDS provider side by side and merges their
+// configurations by domain, so that the domains can be moved to xDS one at a time. A domain
+// defined by both providers is entirely taken from the one with precedence.
+type MergedProvider struct {
+	file                  RateLimitConfigProvider
+	xds                   RateLimitConfigProvider
+	xdsPrecedence         bool
+	configUpdateEventChan chan ConfigUpdateEvent
+	stop                  chan struct{}
+}
+
+// NewMergedProvider merges the configurations of the file and xDS providers, the xDS domains
+// override the file domains when xdsPrecedence is set and the other way around otherwise.
+func NewMergedProvider(file RateLimitConfigProvider, xds RateLimitConfigProvider, xdsPrecedence bool) RateLimitConfigProvider {
+	p := &MergedProvider{
+		file:                  file,
+		xds:                   xds,
+		xdsPrecedence:         xdsPrecedence,
+		configUpdateEventChan: make(chan ConfigUpdateEvent),
+		stop:                  make(chan struct{}),
+	}
+	go p.watch()
+	return p
+}
+
+// ConfigUpdateEvent returns config provider channel
+func (p *MergedProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
+	return p.configUpdateEventChan
+}
+
+func (p *MergedProvider) Stop() {
+	close(p.stop)
+	p.file.Stop()
+	p.xds.Stop()
+}
+
+func (p *MergedProvider) watch() {
+	// the last valid configuration of each provider, a rejected update keeps the previous one
+	var fileConfig, xdsConfig config.RateLimitConfig
+	for {
+		var event ConfigUpdateEvent
+		fromFile := false
+		select {
+		case event = <-p.file.ConfigUpdateEvent():
+			fromFile = true
+		case event = <-p.xds.ConfigUpdateEvent():
+		case <-p.stop:
+			return
+		}
+
+		newConfig, err := event.GetConfig()
+		if err != nil {
+			p.send(event)
+			continue
+		}
+		if fromFile {
+			fileConfig = newConfig
+		} else {
+			xdsConfig = newConfig
+		}
+		p.send(&ConfigUpdateEventImpl{config: p.merge(fileConfig, xdsConfig)})
+	}
+}
+
+func (p *MergedProvider) merge(fileConfig, xdsConfig config.RateLimitConfig) config.RateLimitConfig {
+	if p.xdsPrecedence {
+		return config.NewMergedRateLimitConfig(xdsConfig, fileConfig)
+	}
+	return config.NewMergedRateLimitConfig(fileConfig, xdsConfig)
+}
+
+func (p *MergedProvider) send(event ConfigUpdateEvent) {
+	select {
+	case p.configUpdateEventChan <- event:
+	case <-p.stop:
+	}
+}
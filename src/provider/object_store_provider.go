@@ -0,0 +1,214 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+const objectStoreRequestTimeout = 30 * time.Second
+
+type objectStoreObject struct {
+	url     string
+	etag    string
+	content string
+	loaded  bool
+}
+
+// ObjectStoreProvider periodically polls config objects in S3 or GCS buckets and reloads the
+// config when the ETag of any object changes. Unchanged objects are not downloaded again.
+type ObjectStoreProvider struct {
+	settings              settings.Settings
+	loader                config.RateLimitConfigLoader
+	configUpdateEventChan chan ConfigUpdateEvent
+	statsManager          stats.Manager
+	client                *http.Client
+	objects               []*objectStoreObject
+	ctx                   context.Context
+	cancel                context.CancelFunc
+}
+
+// NewObjectStoreProvider creates a new ObjectStoreProvider and starts polling the objects.
+func NewObjectStoreProvider(settings settings.Settings, statsManager stats.Manager) RateLimitConfigProvider {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ObjectStoreProvider{
+		settings:              settings,
+		loader:                config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
+		configUpdateEventChan: make(chan ConfigUpdateEvent),
+		statsManager:          statsManager,
+		client:                &http.Client{Timeout: objectStoreRequestTimeout},
+		ctx:                   ctx,
+		cancel:                cancel,
+	}
+	for _, objectUrl := range settings.ObjectStoreUrls {
+		if _, err := url.Parse(objectUrl); err != nil || !(strings.HasPrefix(objectUrl, "s3://") || strings.HasPrefix(objectUrl, "gs://")) {
+			logger.Fatalf("Invalid object store URL '%s', expected s3://<bucket>/<key> or gs://<bucket>/<object>", objectUrl)
+		}
+		p.objects = append(p.objects, &objectStoreObject{url: objectUrl})
+	}
+	logger.Infof("Polling %d object store config objects every %s", len(p.objects), settings.ObjectStorePollInterval)
+	go p.poll()
+	return p
+}
+
+// ConfigUpdateEvent returns config provider channel
+func (p *ObjectStoreProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
+	return p.configUpdateEventChan
+}
+
+func (p *ObjectStoreProvider) Stop() {
+	p.cancel()
+}
+
+func (p *ObjectStoreProvider) poll() {
+	ticker := time.NewTicker(p.settings.ObjectStorePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.refresh() {
+			p.sendEvent()
+		}
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			logger.Info("Stopping object store polling for rate limit configurations")
+			return
+		}
+	}
+}
+
+// refresh fetches the objects and returns true if the config must be reloaded, i.e. at least
+// one object changed and all objects were loaded at least once.
+func (p *ObjectStoreProvider) refresh() bool {
+	changed := false
+	allLoaded := true
+	for _, object := range p.objects {
+		objectChanged, err := p.fetch(object)
+		if err != nil {
+			// keep the previous content of the object
+			logger.Errorf("Failed to fetch config object %s: %s", object.url, err.Error())
+		}
+		changed = changed || objectChanged
+		allLoaded = allLoaded && object.loaded
+	}
+	return changed && allLoaded
+}
+
+func (p *ObjectStoreProvider) fetch(object *objectStoreObject) (bool, error) {
+	req, err := p.newRequest(object.url)
+	if err != nil {
+		return false, err
+	}
+	if object.etag != "" {
+		req.Header.Set("If-None-Match", object.etag)
+	}
+	p.authorize(req, object.url)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	etag := resp.Header.Get("ETag")
+	if object.loaded && etag != "" && etag == object.etag {
+		return false, nil
+	}
+	logger.Debugf("Config object %s changed, ETag %s", object.url, etag)
+	object.etag = etag
+	object.content = string(body)
+	object.loaded = true
+	return true, nil
+}
+
+// newRequest maps s3:// and gs:// URLs to their HTTP API endpoints.
+func (p *ObjectStoreProvider) newRequest(objectUrl string) (*http.Request, error) {
+	u, err := url.Parse(objectUrl)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+
+	var httpUrl string
+	switch u.Scheme {
+	case "s3":
+		if p.settings.ObjectStoreS3Endpoint != "" {
+			// path-style for S3 compatible stores
+			httpUrl = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(p.settings.ObjectStoreS3Endpoint, "/"), bucket, key)
+		} else {
+			httpUrl = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, p.settings.ObjectStoreS3Region, key)
+		}
+	case "gs":
+		httpUrl = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(p.settings.ObjectStoreGcsEndpoint, "/"), bucket, key)
+	default:
+		return nil, fmt.Errorf("unsupported object store scheme: %s", u.Scheme)
+	}
+	return http.NewRequestWithContext(p.ctx, http.MethodGet, httpUrl, nil)
+}
+
+func (p *ObjectStoreProvider) authorize(req *http.Request, objectUrl string) {
+	switch {
+	case strings.HasPrefix(objectUrl, "s3://") && p.settings.AwsAccessKeyId != "":
+		signAwsV4(req, awsCredentials{
+			accessKeyId:     p.settings.AwsAccessKeyId,
+			secretAccessKey: p.settings.AwsSecretAccessKey,
+			sessionToken:    p.settings.AwsSessionToken,
+		}, p.settings.ObjectStoreS3Region, "s3", time.Now())
+	case strings.HasPrefix(objectUrl, "gs://") && p.settings.ObjectStoreGcsTokenFile != "":
+		// the token is refreshed by an external process, read it on every request
+		token, err := os.ReadFile(p.settings.ObjectStoreGcsTokenFile)
+		if err != nil {
+			logger.Errorf("Failed to read GCS token file: %v", err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+}
+
+func (p *ObjectStoreProvider) sendEvent() {
+	defer func() {
+		if e := recover(); e != nil {
+			p.send(&ConfigUpdateEventImpl{err: e})
+		}
+	}()
+
+	files := make([]config.RateLimitConfigToLoad, 0, len(p.objects))
+	for _, object := range p.objects {
+		configYaml := config.ConfigFileContentToYamlWithOptions(object.url, object.content, config.NewLoaderOptions(p.settings))
+		files = append(files, config.RateLimitConfigToLoad{Name: object.url, ConfigYaml: configYaml})
+	}
+
+	rlSettings := settings.NewSettings()
+	newConfig := p.loader.Load(files, p.statsManager, rlSettings.MergeDomainConfigurations)
+	p.send(&ConfigUpdateEventImpl{config: newConfig})
+}
+
+func (p *ObjectStoreProvider) send(event ConfigUpdateEvent) {
+	select {
+	case p.configUpdateEventChan <- event:
+	case <-p.ctx.Done():
+	}
+}
@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// SdsCertProvider fetches the certificate of the gRPC server from the Secret Discovery Service of
+// an xDS server, e.g. the Istio agent, so that the certificates are rotated by the mesh.
+type SdsCertProvider struct {
+	settings   settings.Settings
+	secretName string
+	certLock   sync.RWMutex
+	cert       *tls.Certificate
+	received   chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	updates    gostats.Counter
+	errors     gostats.Counter
+}
+
+// NewSdsCertProvider streams the secret secretName from the SDS server at
+// GRPC_SERVER_TLS_SDS_SERVER_URL, waiting up to GRPC_SERVER_TLS_SDS_INITIAL_FETCH_TIMEOUT for the
+// first certificate. The TLS handshakes fail until a certificate is received.
+func NewSdsCertProvider(s settings.Settings, rootStore gostats.Store, secretName string) *SdsCertProvider {
+	ctx, cancel := context.WithCancel(context.Background())
+	scope := rootStore.ScopeWithTags("sds", s.ExtraTags)
+	p := &SdsCertProvider{
+		settings:   s,
+		secretName: secretName,
+		received:   make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		updates:    scope.NewCounter("update_success"),
+		errors:     scope.NewCounter("update_error"),
+	}
+	go p.watch()
+
+	select {
+	case <-p.received:
+	case <-time.After(s.GrpcServerTlsSdsInitialFetchTimeout):
+		logger.Errorf("SdsCertProvider did not receive the secret '%s' within %s, the TLS handshakes fail until it is received",
+			secretName, s.GrpcServerTlsSdsInitialFetchTimeout)
+	}
+	return p
+}
+
+// GetCertificateFunc returns a function compatible with tls.Config.GetCertificate, fetching the current certificate
+func (p *SdsCertProvider) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		p.certLock.RLock()
+		defer p.certLock.RUnlock()
+		if p.cert == nil {
+			return nil, fmt.Errorf("no certificate received from SDS for the secret '%s'", p.secretName)
+		}
+		return p.cert, nil
+	}
+}
+
+// Stop stops streaming the secret.
+func (p *SdsCertProvider) Stop() {
+	p.cancel()
+}
+
+func (p *SdsCertProvider) watch() {
+	// the SDS server is dialed with the xDS client settings, e.g. its TLS and token
+	xdsSettings := p.settings
+	if p.settings.GrpcServerTlsSdsServerUrl != "" {
+		xdsSettings.ConfigGrpcXdsServerUrl = p.settings.GrpcServerTlsSdsServerUrl
+	}
+	b := newXdsClientBackoff(p.settings)
+
+	for p.ctx.Err() == nil {
+		err := p.stream(xdsSettings)
+		if p.ctx.Err() != nil {
+			break
+		}
+		logger.Errorf("SdsCertProvider stream for the secret '%s' failed: %v", p.secretName, err)
+		d := getJitteredExponentialBackOffDuration(b)
+		select {
+		case <-time.After(d):
+		case <-p.ctx.Done():
+		}
+	}
+	logger.Info("Stopping SDS watch for the gRPC server certificate")
+}
+
+func (p *SdsCertProvider) stream(xdsSettings settings.Settings) error {
+	conn, err := getXdsGrpcConnection(xdsSettings)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := secretv3.NewSecretDiscoveryServiceClient(conn).StreamSecrets(p.ctx)
+	if err != nil {
+		return err
+	}
+	node := getClientNode(p.settings)
+	if err := stream.Send(p.newRequest(node, nil, nil)); err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		var errorDetail *status.Status
+		if err := p.update(resp.GetResources()); err != nil {
+			p.errors.Inc()
+			logger.Errorf("SdsCertProvider rejected the secret '%s': %v", p.secretName, err)
+			errorDetail = &status.Status{Message: err.Error()}
+		} else {
+			p.updates.Inc()
+		}
+		if err := stream.Send(p.newRequest(node, resp, errorDetail)); err != nil {
+			return err
+		}
+	}
+}
+
+// newRequest acks the response resp, or nacks it with errorDetail.
+func (p *SdsCertProvider) newRequest(node *corev3.Node, resp *discovery.DiscoveryResponse, errorDetail *status.Status) *discovery.DiscoveryRequest {
+	req := &discovery.DiscoveryRequest{
+		Node:          node,
+		TypeUrl:       resource.SecretType,
+		ResourceNames: []string{p.secretName},
+		ResponseNonce: resp.GetNonce(),
+		ErrorDetail:   errorDetail,
+	}
+	if errorDetail == nil {
+		req.VersionInfo = resp.GetVersionInfo()
+	}
+	return req
+}
+
+func (p *SdsCertProvider) update(resources []*anypb.Any) error {
+	for _, res := range resources {
+		secret := &tlsv3.Secret{}
+		if err := res.UnmarshalTo(secret); err != nil {
+			return err
+		}
+		if secret.GetName() != p.secretName {
+			continue
+		}
+		cert, err := tlsCertificateFromSecret(secret.GetTlsCertificate())
+		if err != nil {
+			return err
+		}
+
+		p.certLock.Lock()
+		first := p.cert == nil
+		p.cert = cert
+		p.certLock.Unlock()
+		if first {
+			close(p.received)
+		}
+		logger.Infof("SdsCertProvider updated the certificate from the secret '%s'", p.secretName)
+		return nil
+	}
+	return fmt.Errorf("the response does not contain the secret '%s'", p.secretName)
+}
+
+func tlsCertificateFromSecret(tlsCertificate *tlsv3.TlsCertificate) (*tls.Certificate, error) {
+	if tlsCertificate == nil {
+		return nil, errors.New("the secret is not a TLS certificate")
+	}
+	certPem, err := readDataSource(tlsCertificate.GetCertificateChain())
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate chain: %w", err)
+	}
+	keyPem, err := readDataSource(tlsCertificate.GetPrivateKey())
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func readDataSource(source *corev3.DataSource) ([]byte, error) {
+	switch {
+	case source == nil:
+		return nil, errors.New("missing data source")
+	case source.GetInlineBytes() != nil:
+		return source.GetInlineBytes(), nil
+	case source.GetInlineString() != "":
+		return []byte(source.GetInlineString()), nil
+	case source.GetFilename() != "":
+		return os.ReadFile(source.GetFilename())
+	case source.GetEnvironmentVariable() != "":
+		return []byte(os.Getenv(source.GetEnvironmentVariable())), nil
+	default:
+		return nil, errors.New("unsupported data source")
+	}
+}
@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
+	"github.com/jpillora/backoff"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// Helpers shared by the SotW and Delta xDS providers.
+
+func newXdsClientBackoff(s settings.Settings) *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    s.XdsClientBackoffInitialInterval,
+		Max:    s.XdsClientBackoffMaxInterval,
+		Factor: s.XdsClientBackoffRandomFactor,
+		Jitter: s.XdsClientBackoffJitter,
+	}
+}
+
+func getJitteredExponentialBackOffDuration(b *backoff.Backoff) time.Duration {
+	logger.Debugf("Retry attempt# %f", b.Attempt())
+	return b.Duration()
+}
+
+func getXdsGrpcConnection(s settings.Settings) (*grpc.ClientConn, error) {
+	backOff := grpc_retry.BackoffLinearWithJitter(s.ConfigGrpcXdsServerConnectRetryInterval, 0.5)
+	logger.Infof("Dialing xDS Management Server: '%s'", s.ConfigGrpcXdsServerUrl)
+	grpcOptions := []grpc.DialOption{
+		getXdsGrpcTransportCredentials(s),
+		grpc.WithBlock(),
+		grpc.WithStreamInterceptor(
+			grpc_retry.StreamClientInterceptor(grpc_retry.WithBackoff(backOff)),
+		),
+	}
+	if s.ConfigGrpcXdsClientToken != "" || s.ConfigGrpcXdsClientTokenFile != "" {
+		if !s.ConfigGrpcXdsServerUseTls {
+			logger.Warn("xDS client token is configured without TLS, the token is sent in plaintext")
+		}
+		grpcOptions = append(grpcOptions, grpc.WithPerRPCCredentials(NewXdsTokenCredentials(
+			s.ConfigGrpcXdsClientToken,
+			s.ConfigGrpcXdsClientTokenFile,
+			s.ConfigGrpcXdsClientTokenRefreshInterval,
+			s.ConfigGrpcXdsServerUseTls,
+		)))
+	}
+	maxRecvMsgSize := s.XdsClientGrpcOptionsMaxMsgSizeInBytes
+	if maxRecvMsgSize != 0 {
+		logger.Infof("Setting xDS gRPC max receive message size to %d bytes", maxRecvMsgSize)
+		grpcOptions = append(grpcOptions,
+			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxRecvMsgSize)))
+	}
+	return grpc.Dial(
+		s.ConfigGrpcXdsServerUrl,
+		grpcOptions...,
+	)
+}
+
+func getXdsGrpcTransportCredentials(s settings.Settings) grpc.DialOption {
+	if !s.ConfigGrpcXdsServerUseTls {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+
+	configGrpcXdsTlsConfig := s.ConfigGrpcXdsTlsConfig
+	if s.ConfigGrpcXdsServerTlsSAN != "" {
+		logger.Infof("ServerName used for xDS Management Service hostname verification is %s", s.ConfigGrpcXdsServerTlsSAN)
+		configGrpcXdsTlsConfig.ServerName = s.ConfigGrpcXdsServerTlsSAN
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(configGrpcXdsTlsConfig))
+}
+
+func getClientNode(s settings.Settings) *corev3.Node {
+	// setting metadata for node
+	metadataMap := make(map[string]*structpb.Value)
+	for _, entry := range strings.Split(s.ConfigGrpcXdsNodeMetadata, ",") {
+		keyValPair := strings.SplitN(entry, "=", 2)
+		if len(keyValPair) == 2 {
+			metadataMap[keyValPair[0]] = structpb.NewStringValue(keyValPair[1])
+		}
+	}
+
+	return &corev3.Node{
+		Id:       s.ConfigGrpcXdsNodeId,
+		Metadata: &structpb.Struct{Fields: metadataMap},
+	}
+}
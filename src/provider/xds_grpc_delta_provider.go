@@ -0,0 +1,240 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	rls_conf_v3 "github.com/envoyproxy/go-control-plane/ratelimit/config/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	status "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+type xdsDeltaStats struct {
+	resourcesAdded   gostats.Counter
+	resourcesRemoved gostats.Counter
+	resourcesTotal   gostats.Gauge
+}
+
+func newXdsDeltaStats(scope gostats.Scope) xdsDeltaStats {
+	ret := xdsDeltaStats{}
+	ret.resourcesAdded = scope.NewCounter("resources_added")
+	ret.resourcesRemoved = scope.NewCounter("resources_removed")
+	ret.resourcesTotal = scope.NewGauge("resources_total")
+	return ret
+}
+
+type xdsDeltaResource struct {
+	version string
+	config  *rls_conf_v3.RateLimitConfig
+}
+
+// XdsGrpcDeltaProvider is the incremental (Delta) xDS provider which implements
+// `RateLimitConfigProvider` interface. The management server only sends the
+// resources which changed, and the provider keeps the full set of resources locally.
+type XdsGrpcDeltaProvider struct {
+	settings              settings.Settings
+	loader                config.RateLimitConfigLoader
+	configUpdateEventChan chan ConfigUpdateEvent
+	statsManager          stats.Manager
+	stats                 xdsDeltaStats
+	ctx                   context.Context
+	// resources is the last accepted set of rate limit config resources keyed by resource name
+	resources map[string]xdsDeltaResource
+	mu        sync.Mutex
+	// connectionRetryChannel is the channel which trigger true for connection issues
+	connectionRetryChannel chan bool
+}
+
+// NewXdsGrpcDeltaProvider initializes Delta xDS listener and returns the xDS provider.
+func NewXdsGrpcDeltaProvider(settings settings.Settings, statsManager stats.Manager) RateLimitConfigProvider {
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.New(settings.ConfigGrpcXdsClientAdditionalHeaders))
+	p := &XdsGrpcDeltaProvider{
+		settings:               settings,
+		statsManager:           statsManager,
+		stats:                  newXdsDeltaStats(statsManager.GetStatsStore().ScopeWithTags("ratelimit", settings.ExtraTags).Scope("xds_delta")),
+		ctx:                    ctx,
+		configUpdateEventChan:  make(chan ConfigUpdateEvent),
+		connectionRetryChannel: make(chan bool),
+		loader:                 config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
+		resources:              make(map[string]xdsDeltaResource),
+	}
+	go p.initXdsClient()
+	return p
+}
+
+// ConfigUpdateEvent returns config provider channel
+func (p *XdsGrpcDeltaProvider) ConfigUpdateEvent() <-chan ConfigUpdateEvent {
+	return p.configUpdateEventChan
+}
+
+func (p *XdsGrpcDeltaProvider) Stop() {
+	p.connectionRetryChannel <- false
+}
+
+func (p *XdsGrpcDeltaProvider) initXdsClient() {
+	logger.Info("Starting Delta xDS client connection for rate limit configurations")
+	conn := p.initializeAndWatch()
+	b := newXdsClientBackoff(p.settings)
+
+	for retryEvent := range p.connectionRetryChannel {
+		if conn != nil {
+			conn.Close()
+		}
+		if !retryEvent { // stop watching
+			logger.Info("Stopping Delta xDS client watch for rate limit configurations")
+			break
+		}
+		d := getJitteredExponentialBackOffDuration(b)
+		logger.Debugf("Sleeping for %s using exponential backoff\n", d)
+		time.Sleep(d)
+		conn = p.initializeAndWatch()
+	}
+}
+
+func (p *XdsGrpcDeltaProvider) initializeAndWatch() *grpc.ClientConn {
+	conn, err := getXdsGrpcConnection(p.settings)
+	if err != nil {
+		logger.Errorf("Error initializing gRPC connection to xDS Management Server: %s", err.Error())
+		p.retryGrpcConn()
+		return nil
+	}
+
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).DeltaAggregatedResources(p.ctx)
+	if err == nil {
+		err = stream.Send(p.initialRequest())
+	}
+	if err != nil {
+		logger.Errorf("Error initializing Delta xDS stream: %s", err.Error())
+		p.retryGrpcConn()
+		return conn
+	}
+
+	logger.Info("Connection to xDS Management Server is successful")
+	go p.watchConfigs(stream)
+	return conn
+}
+
+// initialRequest subscribes to all rate limit config resources. On reconnect, the versions
+// of the resources already known are sent so that the server only sends what changed.
+func (p *XdsGrpcDeltaProvider) initialRequest() *discovery.DeltaDiscoveryRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	versions := make(map[string]string, len(p.resources))
+	for name, res := range p.resources {
+		versions[name] = res.version
+	}
+	return &discovery.DeltaDiscoveryRequest{
+		Node:                    getClientNode(p.settings),
+		TypeUrl:                 resource.RateLimitConfigType,
+		InitialResourceVersions: versions,
+	}
+}
+
+func (p *XdsGrpcDeltaProvider) watchConfigs(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient) {
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			logger.Errorf("Failed to receive configuration from xDS Management Server: %s", err.Error())
+			p.retryGrpcConn()
+			return
+		}
+		logger.Tracef("Delta response received from xDS Management Server: %v", resp)
+
+		ack := &discovery.DeltaDiscoveryRequest{
+			TypeUrl:       resp.GetTypeUrl(),
+			ResponseNonce: resp.GetNonce(),
+		}
+		if err := p.applyDelta(resp); err != nil {
+			ack.ErrorDetail = &status.Status{Message: err.Error()}
+		}
+		if err := stream.Send(ack); err != nil {
+			logger.Errorf("Failed to send Delta xDS acknowledgement: %s", err.Error())
+			p.retryGrpcConn()
+			return
+		}
+	}
+}
+
+// applyDelta merges the added, updated and removed resources of the response into a copy of
+// the current resources and loads the result. The current resources are only replaced if the
+// merged config loads successfully; otherwise the error is returned so the response is NACKed.
+func (p *XdsGrpcDeltaProvider) applyDelta(resp *discovery.DeltaDiscoveryResponse) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := make(map[string]xdsDeltaResource, len(p.resources)+len(resp.GetResources()))
+	for name, res := range p.resources {
+		next[name] = res
+	}
+	for _, res := range resp.GetResources() {
+		confPb := &rls_conf_v3.RateLimitConfig{}
+		if err := anypb.UnmarshalTo(res.GetResource(), confPb, proto.UnmarshalOptions{}); err != nil {
+			logger.Errorf("Error while unmarshalling config from xDS Management Server: %s", err.Error())
+			return err
+		}
+		name := res.GetName()
+		if name == "" {
+			name = confPb.Name
+		}
+		next[name] = xdsDeltaResource{version: res.GetVersion(), config: confPb}
+	}
+	removed := 0
+	for _, name := range resp.GetRemovedResources() {
+		if _, ok := next[name]; ok {
+			delete(next, name)
+			removed++
+		}
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			p.configUpdateEventChan <- &ConfigUpdateEventImpl{err: e}
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	rlSettings := settings.NewSettings()
+	rlsConf := p.loader.Load(deltaResourcesToLoad(next), p.statsManager, rlSettings.MergeDomainConfigurations)
+
+	p.resources = next
+	p.stats.resourcesAdded.Add(uint64(len(resp.GetResources())))
+	p.stats.resourcesRemoved.Add(uint64(removed))
+	p.stats.resourcesTotal.Set(uint64(len(next)))
+	p.configUpdateEventChan <- &ConfigUpdateEventImpl{config: rlsConf}
+	return nil
+}
+
+func deltaResourcesToLoad(resources map[string]xdsDeltaResource) []config.RateLimitConfigToLoad {
+	// Sort by name so that domain merging and error messages are deterministic.
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conf := make([]config.RateLimitConfigToLoad, 0, len(names))
+	for _, name := range names {
+		confPb := resources[name].config
+		conf = append(conf, config.RateLimitConfigToLoad{Name: confPb.Name, ConfigYaml: config.ConfigXdsProtoToYaml(confPb)})
+	}
+	return conf
+}
+
+func (p *XdsGrpcDeltaProvider) retryGrpcConn() {
+	p.connectionRetryChannel <- true
+}
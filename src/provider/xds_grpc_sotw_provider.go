@@ -3,22 +3,15 @@ package provider
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	"google.golang.org/grpc/metadata"
 
-	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
-	grpc_retry "github.com/grpc-ecosystem/go-grpc-middleware/retry"
-	"github.com/jpillora/backoff"
 	logger "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
-	"google.golang.org/protobuf/types/known/structpb"
 
 	"github.com/envoyproxy/ratelimit/src/config"
 	"github.com/envoyproxy/ratelimit/src/settings"
@@ -49,7 +42,7 @@ func NewXdsGrpcSotwProvider(settings settings.Settings, statsManager stats.Manag
 		ctx:                    ctx,
 		configUpdateEventChan:  make(chan ConfigUpdateEvent),
 		connectionRetryChannel: make(chan bool),
-		loader:                 config.NewRateLimitConfigLoaderImpl(),
+		loader:                 config.NewRateLimitConfigLoaderWithOptions(config.NewLoaderOptions(settings)),
 		adsClient:              sotw.NewADSClient(ctx, getClientNode(settings), resource.RateLimitConfigType),
 	}
 	go p.initXdsClient()
@@ -68,12 +61,7 @@ func (p *XdsGrpcSotwProvider) Stop() {
 func (p *XdsGrpcSotwProvider) initXdsClient() {
 	logger.Info("Starting xDS client connection for rate limit configurations")
 	conn := p.initializeAndWatch()
-	b := &backoff.Backoff{
-		Min:    p.settings.XdsClientBackoffInitialInterval,
-		Max:    p.settings.XdsClientBackoffMaxInterval,
-		Factor: p.settings.XdsClientBackoffRandomFactor,
-		Jitter: p.settings.XdsClientBackoffJitter,
-	}
+	b := newXdsClientBackoff(p.settings)
 
 	for retryEvent := range p.connectionRetryChannel {
 		if conn != nil {
@@ -83,20 +71,15 @@ func (p *XdsGrpcSotwProvider) initXdsClient() {
 			logger.Info("Stopping xDS client watch for rate limit configurations")
 			break
 		}
-		d := p.getJitteredExponentialBackOffDuration(b)
+		d := getJitteredExponentialBackOffDuration(b)
 		logger.Debugf("Sleeping for %s using exponential backoff\n", d)
 		time.Sleep(d)
 		conn = p.initializeAndWatch()
 	}
 }
 
-func (p *XdsGrpcSotwProvider) getJitteredExponentialBackOffDuration(b *backoff.Backoff) time.Duration {
-	logger.Debugf("Retry attempt# %f", b.Attempt())
-	return b.Duration()
-}
-
 func (p *XdsGrpcSotwProvider) initializeAndWatch() *grpc.ClientConn {
-	conn, err := p.getGrpcConnection()
+	conn, err := getXdsGrpcConnection(p.settings)
 	if err != nil {
 		logger.Errorf("Error initializing gRPC connection to xDS Management Server: %s", err.Error())
 		p.retryGrpcConn()
@@ -123,41 +106,6 @@ func (p *XdsGrpcSotwProvider) watchConfigs() {
 	}
 }
 
-func (p *XdsGrpcSotwProvider) getGrpcConnection() (*grpc.ClientConn, error) {
-	backOff := grpc_retry.BackoffLinearWithJitter(p.settings.ConfigGrpcXdsServerConnectRetryInterval, 0.5)
-	logger.Infof("Dialing xDS Management Server: '%s'", p.settings.ConfigGrpcXdsServerUrl)
-	grpcOptions := []grpc.DialOption{
-		p.getGrpcTransportCredentials(),
-		grpc.WithBlock(),
-		grpc.WithStreamInterceptor(
-			grpc_retry.StreamClientInterceptor(grpc_retry.WithBackoff(backOff)),
-		),
-	}
-	maxRecvMsgSize := p.settings.XdsClientGrpcOptionsMaxMsgSizeInBytes
-	if maxRecvMsgSize != 0 {
-		logger.Infof("Setting xDS gRPC max receive message size to %d bytes", maxRecvMsgSize)
-		grpcOptions = append(grpcOptions,
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxRecvMsgSize)))
-	}
-	return grpc.Dial(
-		p.settings.ConfigGrpcXdsServerUrl,
-		grpcOptions...,
-	)
-}
-
-func (p *XdsGrpcSotwProvider) getGrpcTransportCredentials() grpc.DialOption {
-	if !p.settings.ConfigGrpcXdsServerUseTls {
-		return grpc.WithTransportCredentials(insecure.NewCredentials())
-	}
-
-	configGrpcXdsTlsConfig := p.settings.ConfigGrpcXdsTlsConfig
-	if p.settings.ConfigGrpcXdsServerTlsSAN != "" {
-		logger.Infof("ServerName used for xDS Management Service hostname verification is %s", p.settings.ConfigGrpcXdsServerTlsSAN)
-		configGrpcXdsTlsConfig.ServerName = p.settings.ConfigGrpcXdsServerTlsSAN
-	}
-	return grpc.WithTransportCredentials(credentials.NewTLS(configGrpcXdsTlsConfig))
-}
-
 func (p *XdsGrpcSotwProvider) sendConfigs(resources []*anypb.Any) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -188,19 +136,3 @@ func (p *XdsGrpcSotwProvider) sendConfigs(resources []*anypb.Any) {
 func (p *XdsGrpcSotwProvider) retryGrpcConn() {
 	p.connectionRetryChannel <- true
 }
-
-func getClientNode(s settings.Settings) *corev3.Node {
-	// setting metadata for node
-	metadataMap := make(map[string]*structpb.Value)
-	for _, entry := range strings.Split(s.ConfigGrpcXdsNodeMetadata, ",") {
-		keyValPair := strings.SplitN(entry, "=", 2)
-		if len(keyValPair) == 2 {
-			metadataMap[keyValPair[0]] = structpb.NewStringValue(keyValPair[1])
-		}
-	}
-
-	return &corev3.Node{
-		Id:       s.ConfigGrpcXdsNodeId,
-		Metadata: &structpb.Struct{Fields: metadataMap},
-	}
-}
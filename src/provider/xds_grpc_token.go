@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// XdsTokenCredentials implements grpc `credentials.PerRPCCredentials` and adds a bearer token
+// to the requests sent to the xDS Management Server. The token is either static or read from a
+// file, in which case the file is re-read once the refresh interval has elapsed so that rotated
+// tokens (e.g. projected service account tokens) are picked up on the next stream.
+type XdsTokenCredentials struct {
+	token           string
+	tokenFile       string
+	refreshInterval time.Duration
+	requireTls      bool
+	lastRefresh     time.Time
+	mu              sync.Mutex
+}
+
+// NewXdsTokenCredentials creates a new XdsTokenCredentials. If tokenFile is set it takes
+// precedence over the static token.
+func NewXdsTokenCredentials(token string, tokenFile string, refreshInterval time.Duration, requireTls bool) *XdsTokenCredentials {
+	return &XdsTokenCredentials{
+		token:           token,
+		tokenFile:       tokenFile,
+		refreshInterval: refreshInterval,
+		requireTls:      requireTls,
+	}
+}
+
+// GetRequestMetadata returns the authorization header for the request.
+func (c *XdsTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.getToken()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity reports whether the token must only be sent over TLS.
+func (c *XdsTokenCredentials) RequireTransportSecurity() bool {
+	return c.requireTls
+}
+
+func (c *XdsTokenCredentials) getToken() (string, error) {
+	if c.tokenFile == "" {
+		return c.token, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Since(c.lastRefresh) < c.refreshInterval {
+		return c.token, nil
+	}
+	b, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		if c.token != "" {
+			// keep the old token if the file is temporarily unavailable during rotation
+			logger.Errorf("Failed to refresh xDS client token from %s, using the previous token: %v", c.tokenFile, err)
+			return c.token, nil
+		}
+		return "", fmt.Errorf("failed to read xDS client token file %s: %w", c.tokenFile, err)
+	}
+	c.token = strings.TrimSpace(string(b))
+	c.lastRefresh = time.Now()
+	logger.Debugf("Refreshed xDS client token from %s", c.tokenFile)
+	return c.token, nil
+}
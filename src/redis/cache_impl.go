@@ -1,8 +1,10 @@
 package redis
 
 import (
+	"fmt"
 	"io"
 	"math/rand"
+	"strings"
 
 	"github.com/coocood/freecache"
 
@@ -15,22 +17,77 @@ import (
 
 func NewRateLimiterCacheImplFromSettings(s settings.Settings, localCache *freecache.Cache, srv server.Server, timeSource utils.TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64, statsManager stats.Manager) (limiter.RateLimitCache, io.Closer) {
 	closer := &utils.MultiCloser{}
+	var workerPool *PipelineWorkerPool
+	if s.RedisPipelineWorkers > 0 {
+		workerPool = NewPipelineWorkerPool(srv.Scope().Scope("redis_pipeline_workers"), s.RedisPipelineWorkers, s.RedisPipelineWorkerQueueSize)
+	}
+	retryPolicy := RetryPolicy{
+		MaxRetries:      s.RedisMaxRetries,
+		BackoffMin:      s.RedisRetryBackoffMin,
+		BackoffMax:      s.RedisRetryBackoffMax,
+		HedgeDelay:      s.RedisHedgeDelay,
+		FailoverTimeout: s.RedisSentinelFailoverTimeout,
+		FailoverGrace:   s.RedisSentinelFailoverGrace,
+	}
+	clusterPolicy := ClusterPolicy{
+		TopologyRefreshInterval: s.RedisClusterTopologyRefreshInterval,
+		FailOnRedirect:          s.RedisClusterFailOnRedirect,
+	}
 	var perSecondPool Client
 	if s.RedisPerSecond {
+		// the per second Redis has its own server name, the host of its URL by default
+		perSecondTlsConfig := s.RedisTlsConfig
+		if perSecondTlsConfig != nil {
+			perSecondTlsConfig = perSecondTlsConfig.Clone()
+			perSecondTlsConfig.ServerName = s.RedisPerSecondTlsServerName
+		}
 		perSecondPool = NewClientImpl(srv.Scope().Scope("redis_per_second_pool"), s.RedisPerSecondTls, s.RedisPerSecondAuth, s.RedisPerSecondSocketType,
-			s.RedisPerSecondType, s.RedisPerSecondUrl, s.RedisPerSecondPoolSize, s.RedisPerSecondPipelineWindow, s.RedisPerSecondPipelineLimit, s.RedisTlsConfig, s.RedisHealthCheckActiveConnection, srv, s.RedisPerSecondTimeout,
-			s.RedisPerSecondPoolOnEmptyBehavior, s.RedisPerSecondSentinelAuth)
+			s.RedisPerSecondType, s.RedisPerSecondUrl, s.RedisPerSecondPoolSize, s.RedisPerSecondPipelineWindow, s.RedisPerSecondPipelineLimit, perSecondTlsConfig, s.RedisHealthCheckActiveConnection, srv, s.RedisPerSecondTimeout,
+			s.RedisPerSecondPoolOnEmptyBehavior, s.RedisPerSecondSentinelAuth, workerPool, retryPolicy, clusterPolicy)
 		closer.Closers = append(closer.Closers, perSecondPool)
 	}
 
 	otherPool := NewClientImpl(srv.Scope().Scope("redis_pool"), s.RedisTls, s.RedisAuth, s.RedisSocketType, s.RedisType, s.RedisUrl, s.RedisPoolSize,
 		s.RedisPipelineWindow, s.RedisPipelineLimit, s.RedisTlsConfig, s.RedisHealthCheckActiveConnection, srv, s.RedisTimeout,
-		s.RedisPoolOnEmptyBehavior, s.RedisSentinelAuth)
+		s.RedisPoolOnEmptyBehavior, s.RedisSentinelAuth, workerPool, retryPolicy, clusterPolicy)
 	closer.Closers = append(closer.Closers, otherPool)
 
-	return NewFixedRateLimitCacheImpl(
-		otherPool,
-		perSecondPool,
+	router := NewClientRouter(otherPool, perSecondPool)
+	namedPools := make(map[string]Client)
+	for name, url := range ParseRedisPools(s.RedisPools) {
+		namedPool := NewClientImpl(srv.Scope().Scope("redis_pools").Scope(name), s.RedisTls, s.RedisAuth, s.RedisSocketType, s.RedisType,
+			url, s.RedisPoolSize, s.RedisPipelineWindow, s.RedisPipelineLimit, s.RedisTlsConfig, s.RedisHealthCheckActiveConnection,
+			srv, s.RedisTimeout, s.RedisPoolOnEmptyBehavior, s.RedisSentinelAuth, workerPool, retryPolicy, clusterPolicy)
+		namedPools[name] = namedPool
+		router.AddNamedPool(name, namedPool)
+		closer.Closers = append(closer.Closers, namedPool)
+	}
+	if workerPool != nil {
+		// closed after the clients so that no pipeline is submitted anymore
+		closer.Closers = append(closer.Closers, workerPool)
+	}
+	var clientSideCache *ClientSideCache
+	if s.RedisClientSideCaching {
+		if localCache == nil {
+			panic(RedisError("REDIS_CLIENT_SIDE_CACHING requires the local cache, set LOCAL_CACHE_SIZE_IN_BYTES"))
+		}
+		if !strings.EqualFold(s.RedisType, "single") {
+			panic(RedisError("REDIS_CLIENT_SIDE_CACHING is only supported with REDIS_TYPE=SINGLE"))
+		}
+		clientSideCache = NewClientSideCache(srv.Scope().Scope("redis_client_side_cache"), localCache,
+			createDialer(s.RedisTimeout, s.RedisTls, s.RedisTlsConfig, s.RedisAuth, ""), s.RedisSocketType, s.RedisUrl,
+			s.RedisClientSideCachingQueueSize)
+		closer.Closers = append(closer.Closers, clientSideCache)
+	}
+	for unit, name := range s.RedisUnitRoutes {
+		router.AddUnitRoute(ParseRateLimitUnit(unit), mustGetNamedPool(namedPools, name))
+	}
+	for domain, name := range s.RedisDomainRoutes {
+		router.AddDomainRoute(domain, mustGetNamedPool(namedPools, name))
+	}
+
+	return NewFixedRateLimitCacheImplWithRouter(
+		router,
 		timeSource,
 		jitterRand,
 		expirationJitterMaxSeconds,
@@ -39,5 +96,15 @@ func NewRateLimiterCacheImplFromSettings(s settings.Settings, localCache *freeca
 		s.CacheKeyPrefix,
 		statsManager,
 		s.StopCacheKeyIncrementWhenOverlimit,
+		clientSideCache,
+		srv.Flags(),
 	), closer
 }
+
+func mustGetNamedPool(namedPools map[string]Client, name string) Client {
+	pool, ok := namedPools[name]
+	if !ok {
+		panic(RedisError(fmt.Sprintf("unknown redis pool %q, declare it in REDIS_POOLS", name)))
+	}
+	return pool
+}
@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// ClientRouter selects the Redis client of a limit. The named pool selected by the domain's
+// backend in the config takes precedence over a domain route, which takes precedence over a
+// unit route, and limits without a route use the default client.
+type ClientRouter struct {
+	defaultClient Client
+	unitClients   map[pb.RateLimitResponse_RateLimit_Unit]Client
+	domainClients map[string]Client
+	namedClients  map[string]Client
+}
+
+// NewClientRouter creates a router sending everything to defaultClient, and SECOND limits to
+// perSecondClient if it is not nil.
+func NewClientRouter(defaultClient Client, perSecondClient Client) *ClientRouter {
+	r := &ClientRouter{
+		defaultClient: defaultClient,
+		unitClients:   make(map[pb.RateLimitResponse_RateLimit_Unit]Client),
+		domainClients: make(map[string]Client),
+		namedClients:  make(map[string]Client),
+	}
+	if perSecondClient != nil {
+		r.unitClients[pb.RateLimitResponse_RateLimit_SECOND] = perSecondClient
+	}
+	return r
+}
+
+// AddUnitRoute routes the limits of the given unit to client.
+func (r *ClientRouter) AddUnitRoute(unit pb.RateLimitResponse_RateLimit_Unit, client Client) {
+	r.unitClients[unit] = client
+}
+
+// AddDomainRoute routes all the limits of the given domain to client.
+func (r *ClientRouter) AddDomainRoute(domain string, client Client) {
+	r.domainClients[domain] = client
+}
+
+// AddNamedPool registers a named pool which domains can select with their backend.
+func (r *ClientRouter) AddNamedPool(name string, client Client) {
+	r.namedClients[name] = client
+}
+
+// ClientFor returns the client of a limit. An unknown backend, which fails the load of the
+// configurations with the backend names, is ignored and the limit is routed as if the domain had
+// no backend.
+func (r *ClientRouter) ClientFor(domain string, backend string, unit pb.RateLimitResponse_RateLimit_Unit) Client {
+	if backend != "" {
+		if client, ok := r.namedClients[backend]; ok {
+			return client
+		}
+		logger.Debugf("unknown redis pool '%s' for domain '%s', using the default routing", backend, domain)
+	}
+	if client, ok := r.domainClients[domain]; ok {
+		return client
+	}
+	if client, ok := r.unitClients[unit]; ok {
+		return client
+	}
+	return r.defaultClient
+}
+
+// Clients returns the distinct clients of the routes.
+func (r *ClientRouter) Clients() []Client {
+	clients := []Client{r.defaultClient}
+	seen := map[Client]bool{r.defaultClient: true}
+	add := func(client Client) {
+		if !seen[client] {
+			seen[client] = true
+			clients = append(clients, client)
+		}
+	}
+	for _, client := range r.unitClients {
+		add(client)
+	}
+	for _, client := range r.domainClients {
+		add(client)
+	}
+	for _, client := range r.namedClients {
+		add(client)
+	}
+	return clients
+}
+
+// ParseRedisPools parses a list of named Redis pools in the format
+// "<name>=<url>;<name>=<url>". The url has the same format as REDIS_URL.
+func ParseRedisPools(value string) map[string]string {
+	pools, err := settings.ParseRedisPools(value)
+	if err != nil {
+		panic(RedisError(err.Error()))
+	}
+	return pools
+}
+
+// ParseRateLimitUnit parses a unit name such as "MINUTE" of a unit route.
+func ParseRateLimitUnit(name string) pb.RateLimitResponse_RateLimit_Unit {
+	unit, ok := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(name)]
+	if !ok || unit == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
+		panic(RedisError(fmt.Sprintf("invalid rate limit unit %q in redis unit routes", name)))
+	}
+	return pb.RateLimitResponse_RateLimit_Unit(unit)
+}
@@ -0,0 +1,308 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/jpillora/backoff"
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix/v4"
+	"github.com/mediocregopher/radix/v4/resp"
+	"github.com/mediocregopher/radix/v4/resp/resp3"
+	logger "github.com/sirupsen/logrus"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// overLimitMarkerSuffix is appended to a cache key to name the marker of its over-limit window. The
+// cache keys end with their window, so that a marker is never a counter.
+const overLimitMarkerSuffix = ":over_limit"
+
+// minOwnedPrune is the number of owned keys from which the expired ones are pruned.
+const minOwnedPrune = 1024
+
+type clientSideCacheStats struct {
+	tracked     stats.Counter
+	trackDrops  stats.Counter
+	invalidated stats.Counter
+	flushes     stats.Counter
+	errors      stats.Counter
+}
+
+func newClientSideCacheStats(scope stats.Scope) clientSideCacheStats {
+	ret := clientSideCacheStats{}
+	ret.tracked = scope.NewCounter("tracked")
+	ret.trackDrops = scope.NewCounter("track_drops")
+	ret.invalidated = scope.NewCounter("invalidated")
+	ret.flushes = scope.NewCounter("flushes")
+	ret.errors = scope.NewCounter("errors")
+	return ret
+}
+
+// ClientSideCache uses Redis client-side caching to keep the over-limit keys of the local
+// cache consistent with Redis. The counters are modified by every request, so the over-limit
+// windows are marked in Redis by a marker key, <cache key>:over_limit, set once with the
+// expiration of the window. The markers are tracked on a dedicated connection and Redis publishes
+// an invalidation on __redis__:invalidate when a marker is deleted, e.g. by a manual reset, upon
+// which its key is removed from the local cache. The tracking uses the RESP2 redirect mode so that
+// it works with the regular connections.
+type ClientSideCache struct {
+	localCache *freecache.Cache
+	dialer     radix.Dialer
+	network    string
+	addr       string
+	keys       chan trackedKey
+	stats      clientSideCacheStats
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	// owned are the keys of the local cache tracked by this cache, the only ones it removes.
+	mu        sync.Mutex
+	owned     map[string]struct{}
+	nextPrune int
+}
+
+type trackedKey struct {
+	key string
+	ttl time.Duration
+}
+
+// NewClientSideCache starts tracking the over-limit keys of localCache on the Redis at addr.
+// Up to queueSize keys wait to be tracked, further keys are only cached locally until expiry.
+func NewClientSideCache(scope stats.Scope, localCache *freecache.Cache, dialer radix.Dialer, network, addr string, queueSize int) *ClientSideCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &ClientSideCache{
+		localCache: localCache,
+		dialer:     dialer,
+		network:    network,
+		addr:       addr,
+		keys:       make(chan trackedKey, queueSize),
+		stats:      newClientSideCacheStats(scope),
+		ctx:        ctx,
+		cancel:     cancel,
+		owned:      make(map[string]struct{}),
+		nextPrune:  minOwnedPrune,
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// Track marks the over-limit window of a key stored in the local cache in Redis for ttl, the
+// remaining duration of the window, and asks Redis to notify the invalidation of the marker.
+func (c *ClientSideCache) Track(key string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	select {
+	case c.keys <- trackedKey{key: key, ttl: ttl}:
+	default:
+		c.stats.trackDrops.Inc()
+	}
+}
+
+func (c *ClientSideCache) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *ClientSideCache) run() {
+	defer c.wg.Done()
+
+	b := &backoff.Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second, Jitter: true}
+	for {
+		err := c.session(b)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.stats.errors.Inc()
+		logger.Errorf("redis client-side caching connection failed: %v", err)
+		select {
+		case <-time.After(b.Duration()):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// session subscribes to the invalidations, enables the tracking and tracks the over-limit keys
+// until a connection fails.
+func (c *ClientSideCache) session(b *backoff.Backoff) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	subConn, err := c.dialer.Dial(ctx, c.network, c.addr)
+	if err != nil {
+		return err
+	}
+	defer subConn.Close()
+	var subId int64
+	if err := subConn.Do(ctx, radix.Cmd(&subId, "CLIENT", "ID")); err != nil {
+		return err
+	}
+	if err := subConn.Do(ctx, radix.Cmd(nil, "SUBSCRIBE", invalidateChannel)); err != nil {
+		return err
+	}
+
+	trackingConn, err := c.dialer.Dial(ctx, c.network, c.addr)
+	if err != nil {
+		return err
+	}
+	defer trackingConn.Close()
+	if err := trackingConn.Do(ctx, radix.Cmd(nil, "CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(subId, 10), "OPTIN", "NOLOOP")); err != nil {
+		return err
+	}
+
+	// The keys tracked before the session may have been invalidated while not subscribed.
+	c.flush()
+	b.Reset()
+	logger.Debugf("redis client-side caching enabled, invalidations redirected to client %d", subId)
+
+	subErr := make(chan error, 1)
+	go func() {
+		subErr <- c.invalidate(ctx, subConn)
+	}()
+
+	for {
+		select {
+		case tracked := <-c.keys:
+			if err := c.track(ctx, trackingConn, tracked); err != nil {
+				return err
+			}
+		case err := <-subErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// track sets the marker of a key if it is not set yet, and reads it on the tracking connection with
+// caching enabled for that read only. Setting a marker already set doesn't modify it, so that the
+// instances marking the same window don't invalidate each other.
+func (c *ClientSideCache) track(ctx context.Context, conn radix.Conn, tracked trackedKey) error {
+	marker := tracked.key + overLimitMarkerSuffix
+	if err := conn.Do(ctx, radix.FlatCmd(nil, "SET", marker, 1, "NX", "PX", tracked.ttl.Milliseconds())); err != nil {
+		return err
+	}
+	if err := conn.Do(ctx, radix.Cmd(nil, "CLIENT", "CACHING", "YES")); err != nil {
+		return err
+	}
+	if err := conn.Do(ctx, radix.Cmd(nil, "EXISTS", marker)); err != nil {
+		return err
+	}
+	c.own(tracked.key)
+	c.stats.tracked.Inc()
+	return nil
+}
+
+// own records a tracked key, pruning the keys which left the local cache once their number doubled.
+func (c *ClientSideCache) own(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owned[key] = struct{}{}
+	if len(c.owned) < c.nextPrune {
+		return
+	}
+	for owned := range c.owned {
+		if _, err := c.localCache.TTL([]byte(owned)); err != nil {
+			delete(c.owned, owned)
+		}
+	}
+	c.nextPrune = max(2*len(c.owned), minOwnedPrune)
+}
+
+// invalidate removes the keys of the invalidated markers from the local cache until the connection
+// fails.
+func (c *ClientSideCache) invalidate(ctx context.Context, conn radix.Conn) error {
+	for {
+		var msg invalidationMessage
+		if err := conn.EncodeDecode(ctx, nil, &msg); err != nil {
+			return err
+		}
+		if !msg.invalidation {
+			continue
+		}
+		if msg.keys == nil {
+			// the whole database was flushed
+			c.flush()
+			continue
+		}
+		for _, marker := range msg.keys {
+			key, ok := strings.CutSuffix(marker, overLimitMarkerSuffix)
+			if !ok {
+				continue
+			}
+			logger.Debugf("redis invalidated over-limit key: %s", key)
+			c.mu.Lock()
+			delete(c.owned, key)
+			c.mu.Unlock()
+			c.localCache.Del([]byte(key))
+			c.stats.invalidated.Inc()
+		}
+	}
+}
+
+// flush removes the tracked keys from the local cache, leaving its other entries.
+func (c *ClientSideCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.owned {
+		c.localCache.Del([]byte(key))
+	}
+	clear(c.owned)
+	c.nextPrune = minOwnedPrune
+	c.stats.flushes.Inc()
+}
+
+// invalidationMessage is a message of the invalidation channel, whose payload is the list of
+// invalidated keys, or null when the database was flushed.
+type invalidationMessage struct {
+	invalidation bool
+	keys         []string
+}
+
+func (m *invalidationMessage) UnmarshalRESP(br resp.BufferedReader, o *resp.Opts) error {
+	var numElems int
+	if ok, _ := resp3.NextMessageIs(br, resp3.PushHeaderPrefix); ok {
+		var ph resp3.PushHeader
+		if err := ph.UnmarshalRESP(br, o); err != nil {
+			return err
+		}
+		numElems = ph.NumElems
+	} else {
+		var ah resp3.ArrayHeader
+		if err := ah.UnmarshalRESP(br, o); err != nil {
+			return err
+		}
+		numElems = ah.NumElems
+	}
+	if numElems != 3 {
+		// not a message of the channel, discard it
+		for i := 0; i < numElems; i++ {
+			if err := resp3.Unmarshal(br, nil, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var msgType, channel resp3.BlobString
+	if err := msgType.UnmarshalRESP(br, o); err != nil {
+		return err
+	}
+	if err := channel.UnmarshalRESP(br, o); err != nil {
+		return err
+	}
+	m.invalidation = msgType.S == "message" && channel.S == invalidateChannel
+	if !m.invalidation {
+		return resp3.Unmarshal(br, nil, o)
+	}
+	return resp3.Unmarshal(br, &m.keys, o)
+}
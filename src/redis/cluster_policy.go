@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix/v4"
+	"github.com/mediocregopher/radix/v4/resp/resp3"
+	"github.com/mediocregopher/radix/v4/trace"
+	logger "github.com/sirupsen/logrus"
+)
+
+// ClusterPolicy controls how a client follows the topology of a Redis Cluster while it is resharded.
+type ClusterPolicy struct {
+	// TopologyRefreshInterval is the interval of the topology refreshes, 0 uses the default of 5s and
+	// a negative interval disables the periodic refreshes. A MOVED redirect always refreshes the topology.
+	TopologyRefreshInterval time.Duration
+	// FailOnRedirect returns the MOVED and ASK redirects as errors instead of following them, so that
+	// a command fails fast during a resharding rather than hopping between the nodes.
+	FailOnRedirect bool
+}
+
+type clusterStats struct {
+	moved           stats.Counter
+	ask             stats.Counter
+	redirectErrors  stats.Counter
+	topologyChanges stats.Counter
+	internalErrors  stats.Counter
+	nodes           stats.Gauge
+	down            stats.Gauge
+}
+
+func newClusterStats(scope stats.Scope) clusterStats {
+	ret := clusterStats{}
+	ret.moved = scope.NewCounter("moved")
+	ret.ask = scope.NewCounter("ask")
+	ret.redirectErrors = scope.NewCounter("redirect_errors")
+	ret.topologyChanges = scope.NewCounter("topology_changes")
+	ret.internalErrors = scope.NewCounter("internal_errors")
+	ret.nodes = scope.NewGauge("nodes")
+	ret.down = scope.NewGauge("down")
+	return ret
+}
+
+func clusterTrace(cs *clusterStats) trace.ClusterTrace {
+	return trace.ClusterTrace{
+		StateChange: func(change trace.ClusterStateChange) {
+			if change.IsDown {
+				logger.Warnf("redis cluster is down")
+				cs.down.Set(1)
+			} else {
+				logger.Warnf("redis cluster is up")
+				cs.down.Set(0)
+			}
+		},
+		TopoChanged: func(change trace.ClusterTopoChanged) {
+			logger.Infof("redis cluster topology changed: %d nodes added, %d removed, %d changed",
+				len(change.Added), len(change.Removed), len(change.Changed))
+			cs.topologyChanges.Inc()
+			cs.nodes.Add(uint64(len(change.Added)))
+			cs.nodes.Sub(uint64(len(change.Removed)))
+		},
+		Redirected: func(redirect trace.ClusterRedirected) {
+			if redirect.Moved {
+				cs.moved.Inc()
+			} else {
+				cs.ask.Inc()
+			}
+		},
+		InternalError: func(internalError trace.ClusterInternalError) {
+			logger.Errorf("redis cluster error: %v", internalError.Err)
+			cs.internalErrors.Inc()
+		},
+	}
+}
+
+// clusterClient counts the redirects returned as errors by a cluster and, when the redirects must
+// not be followed, marks the actions as not retryable on the node of a redirect.
+type clusterClient struct {
+	redisClient
+	failOnRedirect bool
+	stats          *clusterStats
+}
+
+// noRedirectAction is an action which is not retried on another node after a MOVED or ASK redirect.
+type noRedirectAction struct {
+	radix.Action
+}
+
+func (a noRedirectAction) Properties() radix.ActionProperties {
+	ret := a.Action.Properties()
+	ret.CanRetry = false
+	return ret
+}
+
+func (c *clusterClient) Do(ctx context.Context, action radix.Action) error {
+	if c.failOnRedirect {
+		action = noRedirectAction{action}
+	}
+	err := c.redisClient.Do(ctx, action)
+	if isRedirectError(err) {
+		c.stats.redirectErrors.Inc()
+	}
+	return err
+}
+
+func isRedirectError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var replyErr resp3.SimpleError
+	if errors.As(err, &replyErr) {
+		return strings.HasPrefix(replyErr.S, "MOVED ") || strings.HasPrefix(replyErr.S, "ASK ")
+	}
+	// returned by radix when the redirects did not end
+	return err.Error() == "cluster action redirected too many times"
+}
@@ -0,0 +1,173 @@
+package redis
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// The states of a lease returned by acquireLeaseScript.
+const (
+	leaseRejected = 0
+	leaseAcquired = 1
+	leaseRenewed  = 2
+	// leaseShadowed admits the request of a shadow mode limit at its maximum without a lease
+	leaseShadowed = 3
+)
+
+// acquireLeaseScript adds the lease ARGV[4] to the sorted set of the leases of KEYS[1] if fewer than
+// ARGV[3] leases are held, or renews it if it is held. The leases are scored by their expiration,
+// the expired leases being removed first. The time is given by the caller, so that the script stays
+// deterministic.
+//
+// ARGV: the time in milliseconds, the TTL of the lease in milliseconds, the maximum of leases, the
+// lease and 1 to admit the request over the maximum without adding the lease. Returns the state of
+// the lease and the number of leases held.
+const acquireLeaseScript = `
+local now, ttl, max = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local state = 0
+if redis.call('ZSCORE', KEYS[1], ARGV[4]) then
+  state = 2
+elseif redis.call('ZCARD', KEYS[1]) < max then
+  state = 1
+elseif ARGV[5] == '1' then
+  return {3, redis.call('ZCARD', KEYS[1])}
+end
+if state > 0 then
+  redis.call('ZADD', KEYS[1], now + ttl, ARGV[4])
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return {state, redis.call('ZCARD', KEYS[1])}
+`
+
+// releaseLeaseScript removes the lease ARGV[2] from the leases of KEYS[1], along with the leases
+// expired at ARGV[1]. Returns the number of leases held.
+const releaseLeaseScript = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', tonumber(ARGV[1]))
+redis.call('ZREM', KEYS[1], ARGV[2])
+return redis.call('ZCARD', KEYS[1])
+`
+
+// concurrencyCacheKeys returns the cache keys and clients of the limits with a concurrency, counting
+// hitsAddend hits on each of them.
+func (this *fixedRateLimitCacheImpl) concurrencyCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit, hitsAddend uint64,
+) ([]limiter.CacheKey, []Client) {
+	withConcurrency := make([]*config.RateLimit, len(limits))
+	clients := make([]Client, len(limits))
+	hitsAddends := make([]uint64, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.Concurrency != nil {
+			withConcurrency[i] = limit
+			clients[i] = this.router.ClientFor(request.Domain, limit.Backend, limit.Limit.Unit)
+			hitsAddends[i] = hitsAddend
+		}
+	}
+	return this.baseRateLimiter.GenerateCacheKeys(request, withConcurrency, hitsAddends), clients
+}
+
+func (this *fixedRateLimitCacheImpl) AcquireLeases(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	leaseId string,
+) []limiter.LeaseValue {
+	cacheKeys, clients := this.concurrencyCacheKeys(request, limits, 1)
+	results := make([][]int64, len(cacheKeys))
+	now := utils.UnixMilliNow(this.timeSource)
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		shadowed := 0
+		if limits[i].ShadowMode {
+			shadowed = 1
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, &results[i], acquireLeaseScript, cacheKey.Key, now,
+			limits[i].Concurrency.LeaseTtl.Milliseconds(), limits[i].Concurrency.MaxInFlight, leaseId, shadowed)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	leases := make([]limiter.LeaseValue, len(cacheKeys))
+	rejected := false
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" || len(results[i]) != 2 {
+			continue
+		}
+		leases[i] = limiter.LeaseValue{
+			Key:      cacheKey.Key,
+			Acquired: results[i][0] != leaseRejected,
+			InFlight: uint32(results[i][1]),
+		}
+		switch {
+		case !leases[i].Acquired:
+			logger.Debugf("cache key is at its maximum of leases: %s", cacheKey.Key)
+			limits[i].Stats.OverLimit.Inc()
+			rejected = true
+		case results[i][0] == leaseShadowed:
+			logger.Debugf("cache key is at its maximum of leases in shadow mode: %s", cacheKey.Key)
+			limits[i].Stats.OverLimit.Inc()
+			limits[i].Stats.ShadowMode.Inc()
+		default:
+			limits[i].Stats.WithinLimit.Inc()
+		}
+	}
+	if !rejected {
+		return leases
+	}
+
+	// the lease is acquired on every descriptor or on none, the renewed leases stay held
+	pipelines = newClientPipelines()
+	for i, lease := range leases {
+		if !lease.Acquired || results[i][0] != leaseAcquired {
+			continue
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, nil, releaseLeaseScript, lease.Key, now, leaseId)
+		leases[i].Acquired = false
+		leases[i].InFlight--
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+	return leases
+}
+
+func (this *fixedRateLimitCacheImpl) ReleaseLeases(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	leaseId string,
+) []limiter.LeaseValue {
+	cacheKeys, clients := this.concurrencyCacheKeys(request, limits, 0)
+	inFlight := make([]int64, len(cacheKeys))
+	now := utils.UnixMilliNow(this.timeSource)
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, &inFlight[i], releaseLeaseScript, cacheKey.Key, now, leaseId)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	leases := make([]limiter.LeaseValue, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key != "" {
+			leases[i] = limiter.LeaseValue{Key: cacheKey.Key, InFlight: uint32(inFlight[i])}
+		}
+	}
+	return leases
+}
@@ -1,6 +1,10 @@
 package redis
 
-import "github.com/mediocregopher/radix/v4"
+import (
+	"context"
+
+	"github.com/mediocregopher/radix/v4"
+)
 
 // Errors that may be raised during config parsing.
 type RedisError string
@@ -28,12 +32,32 @@ type Client interface {
 	// @param args supplies the additional arguments.
 	PipeAppend(pipeline Pipeline, rcv interface{}, cmd, key string, args ...interface{}) Pipeline
 
+	// PipeAppendScript appends the EVAL of a Lua script on a single key onto the pipeline queue.
+	//
+	// @param pipeline supplies the queue for pending commands.
+	// @param rcv supplies receiver for the result.
+	// @param script supplies the body of the script.
+	// @param key supplies the key of the script, its KEYS[1].
+	// @param args supplies the arguments of the script, its ARGV.
+	PipeAppendScript(pipeline Pipeline, rcv interface{}, script, key string, args ...interface{}) Pipeline
+
 	// PipeDo writes multiple commands to a Conn in
 	// a single write, then reads their responses in a single read. This reduces
 	// network delay into a single round-trip.
 	//
+	// @param ctx supplies the context of the request, the pipeline is aborted when it is done.
 	// @param pipeline supplies the queue for pending commands.
-	PipeDo(pipeline Pipeline) error
+	PipeDo(ctx context.Context, pipeline Pipeline) error
+
+	// ScanKeys calls fn with the keys matching a SCAN pattern, on every primary in cluster mode,
+	// until fn returns false or maxScans SCAN commands were sent. A key may be seen more than once.
+	//
+	// @param ctx supplies the context of the scan, the scan is aborted when it is done.
+	// @param pattern supplies the glob-style pattern of the keys.
+	// @param maxScans supplies the most SCAN commands sent, each one examining about 1000 keys.
+	// @param fn supplies the function called with each key.
+	// @return the number of SCAN commands sent.
+	ScanKeys(ctx context.Context, pattern string, maxScans int, fn func(key string) bool) (int, error)
 
 	// Once Close() is called all future method calls on the Client will return
 	// an error
@@ -48,6 +72,13 @@ type Client interface {
 type PipelineAction struct {
 	Action radix.Action
 	Key    string
+
+	// the command is kept to execute a copy of the action when hedging
+	cmd  string
+	args []interface{}
+	rcv  interface{}
+	// reply tells whether the reply of a GET is null, nil for the other commands
+	reply *radix.Maybe
 }
 
 type Pipeline []PipelineAction
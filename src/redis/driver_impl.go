@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	stats "github.com/lyft/gostats"
@@ -14,13 +15,21 @@ import (
 	logger "github.com/sirupsen/logrus"
 
 	"github.com/envoyproxy/ratelimit/src/server"
+	rlstats "github.com/envoyproxy/ratelimit/src/stats"
 	"github.com/envoyproxy/ratelimit/src/utils"
 )
 
 type poolStats struct {
-	connectionActive stats.Gauge
-	connectionTotal  stats.Counter
-	connectionClose  stats.Counter
+	connectionActive    stats.Gauge
+	connectionTotal     stats.Counter
+	connectionClose     stats.Counter
+	connectionReconnect stats.Counter
+	connectionFail      stats.Counter
+	connectionTime      stats.Timer
+	requestActive       stats.Gauge
+	requestTime         stats.Timer
+	requestTimeout      stats.Counter
+	nodeScope           stats.Scope
 }
 
 func newPoolStats(scope stats.Scope) poolStats {
@@ -28,15 +37,55 @@ func newPoolStats(scope stats.Scope) poolStats {
 	ret.connectionActive = scope.NewGauge("cx_active")
 	ret.connectionTotal = scope.NewCounter("cx_total")
 	ret.connectionClose = scope.NewCounter("cx_local_close")
+	ret.connectionReconnect = scope.NewCounter("cx_reconnect")
+	ret.connectionFail = scope.NewCounter("cx_connect_fail")
+	ret.connectionTime = scope.NewTimer("cx_connect_time")
+	ret.requestActive = scope.NewGauge("rq_active")
+	ret.requestTime = scope.NewTimer("rq_time")
+	ret.requestTimeout = scope.NewCounter("rq_timeout")
+	ret.nodeScope = scope.Scope("node")
 	return ret
 }
 
+// nodeStats are the stats of one node of the pool, i.e. one node of a cluster, the current master of the
+// sentinels or the single instance.
+type nodeStats struct {
+	connectionActive stats.Gauge
+	healthy          stats.Gauge
+}
+
+func (ps *poolStats) node(addr string) nodeStats {
+	scope := ps.nodeScope.Scope(strings.ReplaceAll(utils.SanitizeStatName(addr), ".", "_"))
+	return nodeStats{
+		connectionActive: scope.NewGauge("cx_active"),
+		healthy:          scope.NewGauge("healthy"),
+	}
+}
+
+func (ns nodeStats) update(delta int64) {
+	if delta > 0 {
+		ns.connectionActive.Add(uint64(delta))
+	} else {
+		ns.connectionActive.Sub(uint64(-delta))
+	}
+	if ns.connectionActive.Value() > 0 {
+		ns.healthy.Set(1)
+	} else {
+		ns.healthy.Set(0)
+	}
+}
+
 func poolTrace(ps *poolStats, healthCheckActiveConnection bool, srv server.Server) trace.PoolTrace {
 	return trace.PoolTrace{
 		ConnCreated: func(newConn trace.PoolConnCreated) {
+			ps.connectionTime.AddValue(float64(newConn.ConnectTime.Milliseconds()))
 			if newConn.Err == nil {
 				ps.connectionTotal.Add(1)
 				ps.connectionActive.Add(1)
+				ps.node(newConn.Addr).update(1)
+				if newConn.Reason == trace.PoolConnCreatedReasonReconnect {
+					ps.connectionReconnect.Add(1)
+				}
 				if healthCheckActiveConnection && srv != nil {
 					err := srv.HealthChecker().Ok(server.RedisHealthComponentName)
 					if err != nil {
@@ -44,12 +93,14 @@ func poolTrace(ps *poolStats, healthCheckActiveConnection bool, srv server.Serve
 					}
 				}
 			} else {
+				ps.connectionFail.Add(1)
 				logger.Errorf("creating redis connection error : %v", newConn.Err)
 			}
 		},
-		ConnClosed: func(_ trace.PoolConnClosed) {
+		ConnClosed: func(closedConn trace.PoolConnClosed) {
 			ps.connectionActive.Sub(1)
 			ps.connectionClose.Add(1)
+			ps.node(closedConn.Addr).update(-1)
 			if healthCheckActiveConnection && srv != nil && ps.connectionActive.Value() == 0 {
 				err := srv.HealthChecker().Fail(server.RedisHealthComponentName)
 				if err != nil {
@@ -60,6 +111,25 @@ func poolTrace(ps *poolStats, healthCheckActiveConnection bool, srv server.Serve
 	}
 }
 
+// tracedPool measures the commands executed on a pool of connections, the wait for a connection
+// included.
+type tracedPool struct {
+	radix.Client
+	stats *poolStats
+}
+
+func (p *tracedPool) Do(ctx context.Context, action radix.Action) error {
+	p.stats.requestActive.Inc()
+	start := time.Now()
+	err := p.Client.Do(ctx, action)
+	p.stats.requestTime.AddValue(float64(time.Since(start).Milliseconds()))
+	p.stats.requestActive.Dec()
+	if err != nil && ctx.Err() != nil {
+		p.stats.requestTimeout.Inc()
+	}
+	return err
+}
+
 // redisClient is an interface that abstracts radix Client, Cluster, and Sentinel
 // All of these types have Do(context.Context, Action) and Close() methods
 type redisClient interface {
@@ -71,6 +141,14 @@ type clientImpl struct {
 	client    redisClient
 	stats     poolStats
 	isCluster bool
+	// workerPool executes the grouped pipelines of cluster mode concurrently, nil to execute them sequentially.
+	workerPool  *PipelineWorkerPool
+	retryPolicy RetryPolicy
+	retryStats  retryStats
+	// failover detects the failovers of the sentinel masters, nil for the other types.
+	failover *failoverDetector
+	// ops counts and times the commands and the pipelines with the backend operation stats.
+	ops *rlstats.BackendOps
 }
 
 func checkError(err error) {
@@ -121,7 +199,8 @@ func createDialer(timeout time.Duration, useTls bool, tlsConfig *tls.Config, aut
 
 func NewClientImpl(scope stats.Scope, useTls bool, auth, redisSocketType, redisType, url string, poolSize int,
 	pipelineWindow time.Duration, pipelineLimit int, tlsConfig *tls.Config, healthCheckActiveConnection bool, srv server.Server,
-	timeout time.Duration, poolOnEmptyBehavior string, sentinelAuth string,
+	timeout time.Duration, poolOnEmptyBehavior string, sentinelAuth string, workerPool *PipelineWorkerPool, retryPolicy RetryPolicy,
+	clusterPolicy ClusterPolicy,
 ) Client {
 	maskedUrl := utils.MaskCredentialsInUrl(url)
 	logger.Warnf("connecting to redis on %s with pool size %d", maskedUrl, poolSize)
@@ -187,11 +266,23 @@ func NewClientImpl(scope stats.Scope, useTls bool, auth, redisSocketType, redisT
 		logger.Warnf("Redis pool %s: using v4 default (fixed size=%d, blocks when full)", maskedUrl, poolSize)
 	}
 
+	// The pools of the cluster nodes and of the sentinel master are created with the same
+	// config, each of them is measured.
+	measuredConfig := poolConfig
+	poolConfig.CustomPool = func(ctx context.Context, network, addr string) (radix.Client, error) {
+		pool, err := measuredConfig.New(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &tracedPool{Client: pool, stats: &stats}, nil
+	}
+
 	poolFunc := func(ctx context.Context, network, addr string) (radix.Client, error) {
 		return poolConfig.New(ctx, network, addr)
 	}
 
 	var client redisClient
+	var failover *failoverDetector
 	var err error
 	ctx := context.Background()
 
@@ -202,10 +293,17 @@ func NewClientImpl(scope stats.Scope, useTls bool, auth, redisSocketType, redisT
 	case "cluster":
 		urls := strings.Split(url, ",")
 		logger.Warnf("Creating cluster with urls %v", urls)
+		clusterStats := newClusterStats(scope.Scope("cluster"))
 		clusterConfig := radix.ClusterConfig{
 			PoolConfig: poolConfig,
+			SyncEvery:  clusterPolicy.TopologyRefreshInterval,
+			Trace:      clusterTrace(&clusterStats),
+		}
+		var cluster *radix.Cluster
+		cluster, err = clusterConfig.New(ctx, urls)
+		if err == nil {
+			client = &clusterClient{redisClient: cluster, failOnRedirect: clusterPolicy.FailOnRedirect, stats: &clusterStats}
 		}
-		client, err = clusterConfig.New(ctx, urls)
 	case "sentinel":
 		urls := strings.Split(url, ",")
 		if len(urls) < 2 {
@@ -216,9 +314,11 @@ func NewClientImpl(scope stats.Scope, useTls bool, auth, redisSocketType, redisT
 		// sentinelAuth is for Sentinel nodes, auth is for Redis master/replica
 		sentinelDialer := createDialer(timeout, useTls, tlsConfig, sentinelAuth, fmt.Sprintf("sentinel(%s)", maskedUrl))
 
+		failover = newFailoverDetector(scope.Scope("sentinel"))
 		sentinelConfig := radix.SentinelConfig{
 			PoolConfig:     poolConfig,
 			SentinelDialer: sentinelDialer,
+			Trace:          failover.trace(),
 		}
 		client, err = sentinelConfig.New(ctx, urls[0], urls[1:])
 	default:
@@ -235,9 +335,14 @@ func NewClientImpl(scope stats.Scope, useTls bool, auth, redisSocketType, redisT
 	}
 
 	return &clientImpl{
-		client:    client,
-		stats:     stats,
-		isCluster: isCluster,
+		client:      client,
+		stats:       stats,
+		isCluster:   isCluster,
+		workerPool:  workerPool,
+		retryPolicy: retryPolicy,
+		retryStats:  newRetryStats(scope),
+		failover:    failover,
+		ops:         rlstats.NewBackendOps(scope),
 	}
 }
 
@@ -247,7 +352,85 @@ func (c *clientImpl) DoCmd(rcv interface{}, cmd, key string, args ...interface{}
 	allArgs := make([]interface{}, 0, 1+len(args))
 	allArgs = append(allArgs, key)
 	allArgs = append(allArgs, args...)
-	return c.client.Do(ctx, radix.FlatCmd(rcv, cmd, allArgs...))
+	action, reply := newAction(rcv, cmd, allArgs)
+	start := time.Now()
+	err := c.withRetries(ctx, readOnlyCommands[cmd], func() error {
+		return c.client.Do(ctx, action)
+	})
+	c.ops.Op(cmd).Record(start, err, isMiss(reply))
+	return err
+}
+
+// newAction returns the action of a command, and the reply of a GET with a receiver, which tells
+// whether the key is missing.
+func newAction(rcv interface{}, cmd string, args []interface{}) (radix.Action, *radix.Maybe) {
+	if cmd != "GET" || rcv == nil {
+		return radix.FlatCmd(rcv, cmd, args...), nil
+	}
+	reply := &radix.Maybe{Rcv: rcv}
+	return radix.FlatCmd(reply, cmd, args...), reply
+}
+
+func isMiss(reply *radix.Maybe) bool {
+	return reply != nil && reply.Null
+}
+
+// scanCount is the COUNT hint of the SCAN commands of ScanKeys.
+const scanCount = 1000
+
+func (c *clientImpl) ScanKeys(ctx context.Context, pattern string, maxScans int, fn func(key string) bool) (int, error) {
+	nodes := []redisClient{c.client}
+	if cluster, ok := c.client.(*clusterClient); ok {
+		if radixCluster, ok := cluster.redisClient.(*radix.Cluster); ok {
+			replicaSets, err := radixCluster.Clients()
+			if err != nil {
+				return 0, err
+			}
+			nodes = nodes[:0]
+			for _, replicaSet := range replicaSets {
+				nodes = append(nodes, replicaSet.Primary)
+			}
+		}
+	}
+	scans := 0
+	for _, node := range nodes {
+		cursor := "0"
+		for {
+			if scans >= maxScans {
+				return scans, nil
+			}
+			var result []interface{}
+			start := time.Now()
+			err := node.Do(ctx, radix.FlatCmd(&result, "SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+			c.ops.Op("SCAN").Record(start, err, false)
+			scans++
+			if err != nil {
+				return scans, err
+			}
+			if len(result) != 2 {
+				return scans, fmt.Errorf("unexpected SCAN reply of %d elements", len(result))
+			}
+			cursor = scanString(result[0])
+			keys, _ := result[1].([]interface{})
+			for _, key := range keys {
+				if !fn(scanString(key)) {
+					return scans, nil
+				}
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return scans, nil
+}
+
+// scanString returns an element of a SCAN reply, unmarshalled as bytes.
+func scanString(element interface{}) string {
+	if b, ok := element.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(element)
 }
 
 func (c *clientImpl) Close() error {
@@ -263,14 +446,70 @@ func (c *clientImpl) PipeAppend(pipeline Pipeline, rcv interface{}, cmd, key str
 	allArgs := make([]interface{}, 0, 1+len(args))
 	allArgs = append(allArgs, key)
 	allArgs = append(allArgs, args...)
+	action, reply := newAction(rcv, cmd, allArgs)
 	return append(pipeline, PipelineAction{
-		Action: radix.FlatCmd(rcv, cmd, allArgs...),
+		Action: action,
 		Key:    key,
+		cmd:    cmd,
+		args:   allArgs,
+		rcv:    rcv,
+		reply:  reply,
 	})
 }
 
-func (c *clientImpl) PipeDo(pipeline Pipeline) error {
-	ctx := context.Background()
+func (c *clientImpl) PipeAppendScript(pipeline Pipeline, rcv interface{}, script, key string, args ...interface{}) Pipeline {
+	allArgs := make([]interface{}, 0, 3+len(args))
+	allArgs = append(allArgs, script, 1, key)
+	allArgs = append(allArgs, args...)
+	return append(pipeline, PipelineAction{
+		Action: scriptAction{Action: radix.FlatCmd(rcv, "EVAL", allArgs...), keys: []string{key}},
+		Key:    key,
+		cmd:    "EVAL",
+		args:   allArgs,
+		rcv:    rcv,
+	})
+}
+
+// scriptAction is an EVAL routed by the key of its script in cluster mode, radix not reading the
+// keys of an EVAL. Unlike radix.EvalScript it can be pipelined, the script being sent with EVAL
+// instead of EVALSHA.
+type scriptAction struct {
+	radix.Action
+	keys []string
+}
+
+func (a scriptAction) Properties() radix.ActionProperties {
+	properties := a.Action.Properties()
+	properties.Keys = a.keys
+	return properties
+}
+
+func (c *clientImpl) PipeDo(ctx context.Context, pipeline Pipeline) error {
+	readOnly := isReadOnly(pipeline)
+	hedge := c.retryPolicy.HedgeDelay > 0 && readOnly
+	var failoverChange <-chan struct{}
+	if c.failover != nil {
+		failoverChange = c.failover.nextChange()
+	}
+	start := time.Now()
+	err := c.withRetries(ctx, readOnly, func() error {
+		if hedge {
+			return c.doHedged(ctx, pipeline)
+		}
+		return c.execute(ctx, pipeline)
+	})
+	if err != nil && c.failover != nil {
+		err = c.recoverFailover(ctx, err, failoverChange, pipeline)
+	}
+	c.ops.Op("pipeline").Record(start, err, false)
+	// each command counts under its own name, with the latency of its pipeline
+	for _, pa := range pipeline {
+		c.ops.Op(pa.cmd).Record(start, err, err == nil && isMiss(pa.reply))
+	}
+	return err
+}
+
+func (c *clientImpl) execute(ctx context.Context, pipeline Pipeline) error {
 	if c.isCluster {
 		// Cluster mode: group commands by key and execute each group as a pipeline.
 		// This ensures INCRBY + EXPIRE for the same key are pipelined together (same slot),
@@ -303,23 +542,44 @@ func (c *clientImpl) executeGroupedPipeline(ctx context.Context, pipeline Pipeli
 		}
 	}
 
-	// Execute each group
-	for _, actions := range groups {
-		if len(actions) == 1 {
-			if err := c.client.Do(ctx, actions[0]); err != nil {
-				return err
-			}
-		} else {
-			// Multiple commands for same key: pipeline them together
-			p := radix.NewPipeline()
-			for _, action := range actions {
-				p.Append(action)
-			}
-			if err := c.client.Do(ctx, p); err != nil {
+	if c.workerPool != nil && len(groups) > 1 {
+		// Execute the groups concurrently on the shared worker pool.
+		errs := make([]error, len(groups))
+		var wg sync.WaitGroup
+		wg.Add(len(groups))
+		for i, actions := range groups {
+			c.workerPool.Submit(func() {
+				defer wg.Done()
+				errs[i] = c.executeGroup(ctx, actions)
+			})
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
 				return err
 			}
 		}
+		return nil
+	}
+
+	// Execute each group
+	for _, actions := range groups {
+		if err := c.executeGroup(ctx, actions); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+func (c *clientImpl) executeGroup(ctx context.Context, actions []radix.Action) error {
+	if len(actions) == 1 {
+		return c.client.Do(ctx, actions[0])
+	}
+	// Multiple commands for same key: pipeline them together
+	p := radix.NewPipeline()
+	for _, action := range actions {
+		p.Append(action)
+	}
+	return c.client.Do(ctx, p)
+}
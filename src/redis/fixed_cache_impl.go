@@ -2,6 +2,7 @@ package redis
 
 import (
 	"math/rand"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -15,6 +16,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/flags"
 	"github.com/envoyproxy/ratelimit/src/limiter"
 	"github.com/envoyproxy/ratelimit/src/utils"
 )
@@ -22,14 +24,57 @@ import (
 var tracer = otel.Tracer("redis.fixedCacheImpl")
 
 type fixedRateLimitCacheImpl struct {
-	client Client
-	// Optional Client for a dedicated cache of per second limits.
-	// If this client is nil, then the Cache will use the client for all
-	// limits regardless of unit. If this client is not nil, then it
-	// is used for limits that have a SECOND unit.
-	perSecondClient                    Client
+	// router selects the client of each limit. By default all limits use the same client,
+	// optionally with a dedicated client for limits that have a SECOND unit.
+	router                             *ClientRouter
+	timeSource                         utils.TimeSource
 	stopCacheKeyIncrementWhenOverlimit bool
 	baseRateLimiter                    *limiter.BaseRateLimiter
+	// getCoalescer deduplicates the concurrent GETs of stopCacheKeyIncrementWhenOverlimit.
+	getCoalescer *getCoalescer
+	// clientSideCache tracks the over-limit keys of the local cache, nil if disabled.
+	clientSideCache  *ClientSideCache
+	flags            flags.Flags
+	penaltyStats     penaltyBoxStats
+	refundStats      limiter.RefundStats
+	reservationStats limiter.ReservationStats
+}
+
+// clientPipelines keeps one pipeline per client, in the order the clients are first used.
+type clientPipelines struct {
+	clients   []Client
+	pipelines map[Client]*Pipeline
+}
+
+func newClientPipelines() *clientPipelines {
+	return &clientPipelines{pipelines: make(map[Client]*Pipeline)}
+}
+
+func (c *clientPipelines) get(client Client) *Pipeline {
+	pipeline, ok := c.pipelines[client]
+	if !ok {
+		pipeline = &Pipeline{}
+		c.pipelines[client] = pipeline
+		c.clients = append(c.clients, client)
+	}
+	return pipeline
+}
+
+func (c *clientPipelines) length() int {
+	length := 0
+	for _, pipeline := range c.pipelines {
+		length += len(*pipeline)
+	}
+	return length
+}
+
+// do executes the pipelines and returns the error of each client.
+func (c *clientPipelines) do(ctx context.Context) map[Client]error {
+	errs := make(map[Client]error, len(c.clients))
+	for _, client := range c.clients {
+		errs[client] = client.PipeDo(ctx, *c.pipelines[client])
+	}
+	return errs
 }
 
 func pipelineAppend(client Client, pipeline *Pipeline, key string, hitsAddend uint64, result *uint64, expirationSeconds int64) {
@@ -37,6 +82,19 @@ func pipelineAppend(client Client, pipeline *Pipeline, key string, hitsAddend ui
 	*pipeline = client.PipeAppend(*pipeline, nil, "EXPIRE", key, expirationSeconds)
 }
 
+// pipelineAppendRequestAligned creates the key of a request aligned window expiring at its end, so
+// that the window starts with the first request, then increments it and reads its remaining time.
+func pipelineAppendRequestAligned(client Client, pipeline *Pipeline, key string, hitsAddend uint64, result *uint64,
+	ttl *int64, expirationSeconds int64,
+) {
+	*pipeline = client.PipeAppend(*pipeline, nil, "SET", key, 0, "EX", expirationSeconds, "NX")
+	*pipeline = client.PipeAppend(*pipeline, result, "INCRBY", key, hitsAddend)
+	*pipeline = client.PipeAppend(*pipeline, ttl, "PTTL", key)
+}
+
+// missingKeyTtl is the PTTL of a missing key.
+const missingKeyTtl = -2
+
 func pipelineAppendtoGet(client Client, pipeline *Pipeline, key string, result *uint64) {
 	*pipeline = client.PipeAppend(*pipeline, result, "GET", key)
 }
@@ -78,15 +136,31 @@ func (this *fixedRateLimitCacheImpl) DoLimit(
 ) []*pb.RateLimitResponse_DescriptorStatus {
 	logger.Debugf("starting cache lookup")
 
-	hitsAddends := utils.GetHitsAddends(request)
+	hitsAddends := limiter.GetHitsAddends(request, limits)
 
+	timing := this.baseRateLimiter.Timing
+	phaseStart := time.Now()
 	// First build a list of all cache keys that we are actually going to hit.
 	cacheKeys := this.baseRateLimiter.GenerateCacheKeys(request, limits, hitsAddends)
+	limiter.DecisionDebugFromContext(ctx).AddCacheKeys(cacheKeys)
 
 	isOverLimitWithLocalCache := make([]bool, len(request.Descriptors))
 	results := make([]uint64, len(request.Descriptors))
+	// the remaining milliseconds of the windows of the request aligned limits
+	ttls := make([]int64, len(request.Descriptors))
+	// whether the hits were added to the leaky buckets and their level
+	leakyBuckets := make([][]string, len(request.Descriptors))
+	// the hits added to the leaky buckets, 0 when they were not incremented
+	leakyBucketHits := make([]uint64, len(request.Descriptors))
+	// the counters of the previous windows of the limits with a carry-over
+	previousCacheKeys := this.baseRateLimiter.GeneratePreviousWindowCacheKeys(request, limits)
+	previousCounts := make([]uint64, len(request.Descriptors))
+	timing.CacheKeys.AddDuration(time.Since(phaseStart))
 	currentCount := make([]uint64, len(request.Descriptors))
-	var pipeline, perSecondPipeline, pipelineToGet, perSecondPipelineToGet Pipeline
+	// whether currentCount holds the counter read before the increment
+	counted := make([]bool, len(request.Descriptors))
+	clients := make([]Client, len(request.Descriptors))
+	pipelines, pipelinesToGet := newClientPipelines(), newClientPipelines()
 
 	overlimitIndexes := make([]bool, len(request.Descriptors))
 	nearlimitIndexes := make([]bool, len(request.Descriptors))
@@ -94,13 +168,15 @@ func (this *fixedRateLimitCacheImpl) DoLimit(
 	isCacheKeyNearlimit := false
 
 	// Check if any of the keys are already to the over limit in cache.
+	phaseStart = time.Now()
 	for i, cacheKey := range cacheKeys {
 		if cacheKey.Key == "" {
 			continue
 		}
+		clients[i] = this.router.ClientFor(request.Domain, limits[i].Backend, limits[i].Limit.Unit)
 
 		// Check if key is over the limit in local cache.
-		if this.baseRateLimiter.IsOverLimitWithLocalCache(cacheKey.Key) {
+		if this.baseRateLimiter.IsOverLimitWithLocalCache(request.Domain, cacheKey.Key) {
 			if limits[i].ShadowMode {
 				logger.Debugf("Cache key %s would be rate limited but shadow mode is enabled on this rule", cacheKey.Key)
 			} else {
@@ -111,33 +187,93 @@ func (this *fixedRateLimitCacheImpl) DoLimit(
 			overlimitIndexes[i] = true
 		}
 	}
+	timing.LocalCache.AddDuration(time.Since(phaseStart))
+
+	// The descriptors in the penalty box are rejected without counting their hits. The bans of the
+	// leaky buckets are read before adding the hits to their buckets, those of the fixed windows with
+	// the increments of their counters, which are given back.
+	phaseStart = time.Now()
+	bans := this.getBans(ctx, cacheKeys, limits, clients, true)
+	// the precheck is only timed when it reads the backend
+	prechecked := bans != nil
+	if bans == nil {
+		bans = make([]time.Duration, len(cacheKeys))
+	}
+	isBanned := func(i int) bool { return bans[i] > 0 }
+	for i := range cacheKeys {
+		if isBanned(i) {
+			logger.Debugf("cache key is in the penalty box: %s", cacheKeys[i].Key)
+			isCacheKeyOverlimit = true
+			overlimitIndexes[i] = true
+		}
+	}
 
 	// If none of the keys are over limit in local cache and the stopCacheKeyIncrementWhenOverlimit is true,
 	// then we check if any of the keys are near limit in redis cache.
 	if this.stopCacheKeyIncrementWhenOverlimit && !isCacheKeyOverlimit {
+		// Concurrent requests for the same key share a single GET, only the leader of a key reads it.
+		coalesce := this.flags.Enabled(flags.RedisGetCoalescing, request.Domain, 100)
+		leaderGets := make([]*inflightGet, len(cacheKeys))
+		leaderKeys := make([]string, len(cacheKeys))
+		followerGets := make([]*inflightGet, len(cacheKeys))
+		// The followers of a leader which panics before publishing its reads fail with its panic
+		// instead of waiting forever.
+		defer func() {
+			if r := recover(); r != nil {
+				this.getCoalescer.abandon(leaderKeys, leaderGets, r)
+				panic(r)
+			}
+		}()
 		for i, cacheKey := range cacheKeys {
-			if cacheKey.Key == "" {
+			if cacheKey.Key == "" || limits[i].LeakyBucket != nil {
+				continue
+			}
+			// The keys which are not known to be near the limit are assumed to stay under it.
+			if this.baseRateLimiter.LocalCacheStoresNearLimit() && !this.baseRateLimiter.IsNearLimitWithLocalCache(cacheKey.Key) {
 				continue
 			}
 
-			if this.perSecondClient != nil && cacheKey.PerSecond {
-				if perSecondPipelineToGet == nil {
-					perSecondPipelineToGet = Pipeline{}
-				}
-				pipelineAppendtoGet(this.perSecondClient, &perSecondPipelineToGet, cacheKey.Key, &currentCount[i])
-			} else {
-				if pipelineToGet == nil {
-					pipelineToGet = Pipeline{}
+			if coalesce {
+				call, leader := this.getCoalescer.join(cacheKey.Key)
+				if !leader {
+					followerGets[i] = call
+					continue
 				}
-				pipelineAppendtoGet(this.client, &pipelineToGet, cacheKey.Key, &currentCount[i])
+				leaderGets[i] = call
+				leaderKeys[i] = cacheKey.Key
 			}
+
+			pipelineAppendtoGet(clients[i], pipelinesToGet.get(clients[i]), cacheKey.Key, &currentCount[i])
+			counted[i] = true
 		}
 
-		if pipelineToGet != nil {
-			checkError(this.client.PipeDo(pipelineToGet))
+		errs := pipelinesToGet.do(ctx)
+		prechecked = prechecked || len(pipelinesToGet.clients) > 0
+		// Publish the reads before checking errors so that waiting requests are always released.
+		for i, call := range leaderGets {
+			if call != nil {
+				this.getCoalescer.complete(cacheKeys[i].Key, call, currentCount[i], errs[clients[i]])
+				leaderGets[i] = nil
+			}
 		}
-		if perSecondPipelineToGet != nil {
-			checkError(this.perSecondClient.PipeDo(perSecondPipelineToGet))
+		for _, client := range pipelinesToGet.clients {
+			checkError(errs[client])
+		}
+		waitStart := time.Now()
+		waited := false
+		for i, call := range followerGets {
+			if call == nil {
+				continue
+			}
+			value, err := call.wait(ctx)
+			checkError(err)
+			currentCount[i] = value
+			counted[i] = true
+			waited = true
+		}
+		if waited {
+			timing.HotKeyWait.AddDuration(time.Since(waitStart))
+			prechecked = true
 		}
 
 		for i, cacheKey := range cacheKeys {
@@ -157,80 +293,260 @@ func (this *fixedRateLimitCacheImpl) DoLimit(
 		}
 	}
 
+	if prechecked {
+		timing.BackendPrecheck.AddDuration(time.Since(phaseStart))
+	}
+
 	// Now, actually setup the pipeline to increase the usage of cache key, skipping empty cache keys.
+	phaseStart = time.Now()
+	banTtls := make([]int64, len(cacheKeys))
+	incrementedHits := make([]uint64, len(cacheKeys))
 	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key != "" && limits[i].Penalty != nil && limits[i].LeakyBucket == nil {
+			pipelineAppendBan(clients[i], pipelines.get(clients[i]), cacheKey.Key, &banTtls[i])
+		}
 		if cacheKey.Key == "" || overlimitIndexes[i] {
 			continue
 		}
 
 		logger.Debugf("looking up cache key: %s", cacheKey.Key)
 
-		expirationSeconds := utils.UnitToDivider(limits[i].Limit.Unit)
-		if this.baseRateLimiter.ExpirationJitterMaxSeconds > 0 {
-			expirationSeconds += this.baseRateLimiter.JitterRand.Int63n(this.baseRateLimiter.ExpirationJitterMaxSeconds)
-		}
+		expirationSeconds := this.baseRateLimiter.ExpirationSeconds(limits[i])
+		hitsAddend := this.getHitsAddend(hitsAddends[i], isCacheKeyOverlimit, isCacheKeyNearlimit, nearlimitIndexes[i])
 
-		// Use the perSecondConn if it is not nil and the cacheKey represents a per second Limit.
-		if this.perSecondClient != nil && cacheKey.PerSecond {
-			if perSecondPipeline == nil {
-				perSecondPipeline = Pipeline{}
+		if hitsAddend == 0 && limits[i].LeakyBucket == nil {
+			// A query only reads the counter, without creating the key or extending its window, the
+			// counter read before the increment being reused.
+			if counted[i] {
+				results[i] = currentCount[i]
+			} else {
+				pipelineAppendtoGet(clients[i], pipelines.get(clients[i]), cacheKey.Key, &results[i])
 			}
-			pipelineAppend(this.perSecondClient, &perSecondPipeline, cacheKey.Key, this.getHitsAddend(hitsAddends[i],
-				isCacheKeyOverlimit, isCacheKeyNearlimit, nearlimitIndexes[i]), &results[i], expirationSeconds)
-		} else {
-			if pipeline == nil {
-				pipeline = Pipeline{}
+			if limits[i].RequestAligned {
+				*pipelines.get(clients[i]) = clients[i].PipeAppend(*pipelines.get(clients[i]), &ttls[i], "PTTL", cacheKey.Key)
 			}
-			pipelineAppend(this.client, &pipeline, cacheKey.Key, this.getHitsAddend(hitsAddends[i], isCacheKeyOverlimit,
-				isCacheKeyNearlimit, nearlimitIndexes[i]), &results[i], expirationSeconds)
+		} else if limits[i].LeakyBucket != nil {
+			pipelineAppendLeakyBucket(clients[i], pipelines.get(clients[i]), cacheKey.Key, limits[i],
+				utils.UnixMilliNow(this.timeSource), hitsAddend, &leakyBuckets[i])
+			leakyBucketHits[i] = hitsAddend
+		} else if limits[i].RequestAligned {
+			pipelineAppendRequestAligned(clients[i], pipelines.get(clients[i]), cacheKey.Key, hitsAddend, &results[i],
+				&ttls[i], expirationSeconds)
+			incrementedHits[i] = hitsAddend
+		} else {
+			pipelineAppend(clients[i], pipelines.get(clients[i]), cacheKey.Key, hitsAddend, &results[i], expirationSeconds)
+			incrementedHits[i] = hitsAddend
 		}
 	}
 
 	// Generate trace
 	_, span := tracer.Start(ctx, "Redis Pipeline Execution",
 		trace.WithAttributes(
-			attribute.Int("pipeline length", len(pipeline)),
-			attribute.Int("perSecondPipeline length", len(perSecondPipeline)),
+			attribute.Int("pipeline length", pipelines.length()),
+			attribute.Int("pipeline count", len(pipelines.clients)),
 		),
 	)
 	defer span.End()
 
-	if pipeline != nil {
-		checkError(this.client.PipeDo(pipeline))
-	}
-	if perSecondPipeline != nil {
-		checkError(this.perSecondClient.PipeDo(perSecondPipeline))
+	for _, client := range pipelines.clients {
+		checkError(client.PipeDo(ctx, *pipelines.pipelines[client]))
 	}
+	this.expireRequestAligned(ctx, cacheKeys, limits, clients, ttls)
+	this.giveBackBannedHits(ctx, cacheKeys, clients, banTtls, incrementedHits, bans)
+	this.reclaimExpiredHolds(ctx, cacheKeys, limits, hitsAddends, clients, results)
+	this.readPreviousCounts(ctx, previousCacheKeys, limits, clients, results, previousCounts)
+	timing.BackendIncrement.AddDuration(time.Since(phaseStart))
 
 	// Now fetch the pipeline.
 	responseDescriptorStatuses := make([]*pb.RateLimitResponse_DescriptorStatus,
 		len(request.Descriptors))
+	// the over-limits of the limits with a penalty, which may place their descriptors in the penalty box
+	penaltyOverLimits := make([]bool, len(request.Descriptors))
 	for i, cacheKey := range cacheKeys {
+		if isBanned(i) {
+			this.penaltyStats.rejected.Inc()
+			responseDescriptorStatuses[i] = this.baseRateLimiter.GetPenaltyDescriptorStatus(limits[i], bans[i], hitsAddends[i])
+			continue
+		}
+		if cacheKey.Key != "" && limits[i].LeakyBucket != nil {
+			var overLimit bool
+			responseDescriptorStatuses[i], overLimit = this.getLeakyBucketDescriptorStatus(limits[i], leakyBuckets[i],
+				leakyBucketHits[i])
+			penaltyOverLimits[i] = overLimit && limits[i].Penalty != nil && hitsAddends[i] > 0
+			continue
+		}
 
 		limitAfterIncrease := results[i]
 		limitBeforeIncrease := limitAfterIncrease - hitsAddends[i]
 
 		limitInfo := limiter.NewRateLimitInfo(limits[i], limitBeforeIncrease, limitAfterIncrease, 0, 0)
+		if ttls[i] > 0 {
+			limitInfo.SetDurationUntilReset(time.Duration(ttls[i]) * time.Millisecond)
+		} else if ttls[i] == missingKeyTtl {
+			// the window of a request aligned limit starts with its first hit, not with a query
+			limitInfo.SetDurationUntilReset(time.Duration(utils.UnitToDividerWithMultiplier(limits[i].Limit.Unit,
+				limits[i].UnitMultiplier)) * time.Second)
+		}
+		var overLimitThreshold uint64
+		if limits[i] != nil {
+			// the previous window is only read when the credit decides
+			var credit uint64
+			if limiter.NeedsCarryOverCredit(limits[i], limitAfterIncrease) {
+				credit = limiter.CarryOverCredit(limits[i], previousCounts[i])
+			}
+			limitInfo.SetCredit(credit)
+			overLimitThreshold = uint64(limits[i].Limit.RequestsPerUnit) + credit
+		}
 
 		responseDescriptorStatuses[i] = this.baseRateLimiter.GetResponseDescriptorStatus(cacheKey.Key,
 			limitInfo, isOverLimitWithLocalCache[i], hitsAddends[i])
 
+		// The key was just added to the local cache, let Redis notify its invalidation.
+		if this.clientSideCache != nil && clients[i] == this.router.defaultClient && !isOverLimitWithLocalCache[i] &&
+			cacheKey.Key != "" && limitAfterIncrease > overLimitThreshold && !limits[i].SpillsOver {
+			this.clientSideCache.Track(cacheKey.Key, responseDescriptorStatuses[i].GetDurationUntilReset().AsDuration())
+		}
+
+		if cacheKey.Key != "" && limits[i].Penalty != nil && hitsAddends[i] > 0 &&
+			(isOverLimitWithLocalCache[i] || limitAfterIncrease > overLimitThreshold) {
+			penaltyOverLimits[i] = true
+		}
 	}
+	this.addOverLimits(ctx, cacheKeys, limits, clients, penaltyOverLimits)
 
 	return responseDescriptorStatuses
 }
 
+// readPreviousCounts reads the counters of the previous windows of the limits with a carry-over whose
+// decision depends on the credit, the counters of the current windows within the limit or past the
+// largest credit deciding alone.
+func (this *fixedRateLimitCacheImpl) readPreviousCounts(ctx context.Context, previousCacheKeys []limiter.CacheKey,
+	limits []*config.RateLimit, clients []Client, results []uint64, previousCounts []uint64,
+) {
+	pipelines := newClientPipelines()
+	for i, previousCacheKey := range previousCacheKeys {
+		if previousCacheKey.Key == "" || !limiter.NeedsCarryOverCredit(limits[i], results[i]) {
+			continue
+		}
+		pipelineAppendtoGet(clients[i], pipelines.get(clients[i]), previousCacheKey.Key, &previousCounts[i])
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+}
+
+// expireRequestAligned sets the expiration of the keys of the request aligned windows which expired
+// between their creation and their increment, and were created again without expiration.
+func (this *fixedRateLimitCacheImpl) expireRequestAligned(ctx context.Context, cacheKeys []limiter.CacheKey,
+	limits []*config.RateLimit, clients []Client, ttls []int64,
+) {
+	pipelines := newClientPipelines()
+	for i, ttl := range ttls {
+		// PTTL is -1 for a key without expiration
+		if ttl != -1 || limits[i] == nil || !limits[i].RequestAligned {
+			continue
+		}
+		expirationSeconds := utils.UnitToDividerWithMultiplier(limits[i].Limit.Unit, limits[i].UnitMultiplier)
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "EXPIRE", cacheKeys[i].Key, expirationSeconds)
+		ttls[i] = expirationSeconds * 1000
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+}
+
+func (this *fixedRateLimitCacheImpl) GetCounters(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []limiter.CounterValue {
+	cacheKeys := this.baseRateLimiter.GenerateCacheKeys(request, limits, make([]uint64, len(request.Descriptors)))
+	counters := make([]limiter.CounterValue, len(request.Descriptors))
+	ttls := make([]int64, len(request.Descriptors))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		// the leaky buckets and the leases have no counter
+		if cacheKey.Key == "" || limits[i].LeakyBucket != nil || limits[i].Concurrency != nil {
+			continue
+		}
+		counters[i].Key = cacheKey.Key
+		client := this.router.ClientFor(request.Domain, limits[i].Backend, limits[i].Limit.Unit)
+		pipelineAppendtoGet(client, pipelines.get(client), cacheKey.Key, &counters[i].Value)
+		// the window of a request aligned limit ends with its key
+		if limits[i].RequestAligned {
+			*pipelines.get(client) = client.PipeAppend(*pipelines.get(client), &ttls[i], "PTTL", cacheKey.Key)
+		}
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+	for i, ttl := range ttls {
+		if ttl > 0 {
+			counters[i].Ttl = time.Duration(ttl) * time.Millisecond
+		}
+	}
+	return counters
+}
+
 // Flush() is a no-op with redis since quota reads and updates happen synchronously.
 func (this *fixedRateLimitCacheImpl) Flush() {}
 
+// ProbeBackend PINGs every client of the cache.
+func (this *fixedRateLimitCacheImpl) ProbeBackend() error {
+	for _, client := range this.router.Clients() {
+		var pong string
+		if err := client.DoCmd(&pong, "PING", "pong"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *fixedRateLimitCacheImpl) SetNearLimitRatio(ratio float32) {
+	this.baseRateLimiter.SetNearLimitRatio(ratio)
+}
+
+func (this *fixedRateLimitCacheImpl) SetCacheKeyMaxLength(maxLength int) {
+	this.baseRateLimiter.SetCacheKeyMaxLength(maxLength)
+}
+
+func (this *fixedRateLimitCacheImpl) SetExpirationJitterPolicy(policy limiter.ExpirationJitterPolicy) {
+	this.baseRateLimiter.SetExpirationJitterPolicy(policy)
+}
+
+func (this *fixedRateLimitCacheImpl) SetLocalCachePolicy(policy limiter.LocalCachePolicy) {
+	this.baseRateLimiter.SetLocalCachePolicy(policy)
+}
+
 func NewFixedRateLimitCacheImpl(client Client, perSecondClient Client, timeSource utils.TimeSource,
 	jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, nearLimitRatio float32, cacheKeyPrefix string, statsManager stats.Manager,
 	stopCacheKeyIncrementWhenOverlimit bool,
 ) limiter.RateLimitCache {
+	return NewFixedRateLimitCacheImplWithRouter(NewClientRouter(client, perSecondClient), timeSource, jitterRand, expirationJitterMaxSeconds,
+		localCache, nearLimitRatio, cacheKeyPrefix, statsManager, stopCacheKeyIncrementWhenOverlimit, nil, nil)
+}
+
+// NewFixedRateLimitCacheImplWithRouter creates a cache whose limits are routed to multiple Redis clients.
+// If clientSideCache is not nil, it tracks the over-limit keys of the default client stored in localCache.
+// The features are gated by featureFlags, static flags being used if it is nil.
+func NewFixedRateLimitCacheImplWithRouter(router *ClientRouter, timeSource utils.TimeSource,
+	jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, nearLimitRatio float32, cacheKeyPrefix string, statsManager stats.Manager,
+	stopCacheKeyIncrementWhenOverlimit bool, clientSideCache *ClientSideCache, featureFlags flags.Flags,
+) limiter.RateLimitCache {
+	if featureFlags == nil {
+		featureFlags = flags.NewStaticFlags()
+	}
 	return &fixedRateLimitCacheImpl{
-		client:                             client,
-		perSecondClient:                    perSecondClient,
+		router:                             router,
+		timeSource:                         timeSource,
+		clientSideCache:                    clientSideCache,
+		flags:                              featureFlags,
 		stopCacheKeyIncrementWhenOverlimit: stopCacheKeyIncrementWhenOverlimit,
+		getCoalescer:                       newGetCoalescer(),
+		penaltyStats:                       newPenaltyBoxStats(statsManager.GetStatsStore().Scope("ratelimit").Scope("penalty_box")),
+		refundStats:                        limiter.NewRefundStats(statsManager.GetStatsStore().Scope("ratelimit").Scope("refund")),
+		reservationStats:                   limiter.NewReservationStats(statsManager.GetStatsStore().Scope("ratelimit").Scope("reservation")),
 		baseRateLimiter:                    limiter.NewBaseRateLimit(timeSource, jitterRand, expirationJitterMaxSeconds, localCache, nearLimitRatio, cacheKeyPrefix, statsManager),
 	}
 }
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type inflightGet struct {
+	done  chan struct{}
+	value uint64
+	err   error
+}
+
+// getCoalescer deduplicates concurrent GETs of the same cache key: the first request to read
+// a key (the leader) fetches it in its own pipeline, and concurrent requests for the same key
+// wait for and share the leader's result instead of issuing their own GET.
+type getCoalescer struct {
+	mu       sync.Mutex
+	inflight map[string]*inflightGet
+}
+
+func newGetCoalescer() *getCoalescer {
+	return &getCoalescer{inflight: make(map[string]*inflightGet)}
+}
+
+// join returns the in-flight read of key and whether the caller is its leader. A leader must
+// call complete once the read is done, or abandon if it panics before.
+func (c *getCoalescer) join(key string) (*inflightGet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.inflight[key]; ok {
+		return call, false
+	}
+	call := &inflightGet{done: make(chan struct{})}
+	c.inflight[key] = call
+	return call, true
+}
+
+// complete publishes the result of a leader read to the waiting requests.
+func (c *getCoalescer) complete(key string, call *inflightGet, value uint64, err error) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+
+	call.value = value
+	call.err = err
+	close(call.done)
+}
+
+// abandon publishes the panic of a leader as the error of its reads not completed yet, the nil
+// calls being the completed ones.
+func (c *getCoalescer) abandon(keys []string, calls []*inflightGet, panicValue interface{}) {
+	err := fmt.Errorf("coalesced read failed: %v", panicValue)
+	for i, call := range calls {
+		if call != nil {
+			c.complete(keys[i], call, 0, err)
+		}
+	}
+}
+
+// wait blocks until the leader read completes and returns its result, or the error of ctx if it
+// is done first.
+func (call *inflightGet) wait(ctx context.Context) (uint64, error) {
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
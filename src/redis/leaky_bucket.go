@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// leakyBucketScript adds the hits to the bucket of KEYS[1] if they fit, after draining it since its
+// last update. The bucket is a hash of its level and of the time of its last update, expiring once
+// empty. The time is given by the caller, so that the script stays deterministic.
+//
+// ARGV: the hits drained per window, the window in milliseconds, the size of the bucket, the time
+// in milliseconds and the hits. Returns whether the hits were added and the level of the bucket. The
+// bucket is only read without hits.
+const leakyBucketScript = `
+local drained, window, size = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local now, hits = tonumber(ARGV[4]), tonumber(ARGV[5])
+local bucket = redis.call('HMGET', KEYS[1], 'level', 'updated')
+local level = tonumber(bucket[1]) or 0
+local updated = tonumber(bucket[2]) or now
+if now > updated then
+  level = math.max(0, level - (now - updated) * drained / window)
+  updated = now
+end
+local added = 0
+if level + hits <= size then
+  level = level + hits
+  added = 1
+end
+if hits > 0 then
+  redis.call('HMSET', KEYS[1], 'level', tostring(level), 'updated', updated)
+  redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(level * window / drained)))
+end
+return {added, tostring(level)}
+`
+
+// pipelineAppendLeakyBucket adds the hits to the leaky bucket of the limit at the unix time now in
+// milliseconds.
+func pipelineAppendLeakyBucket(client Client, pipeline *Pipeline, key string, limit *config.RateLimit,
+	now int64, hitsAddend uint64, result *[]string,
+) {
+	window := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier) * 1000
+	*pipeline = client.PipeAppendScript(*pipeline, result, leakyBucketScript, key, limit.Limit.RequestsPerUnit,
+		window, limit.LeakyBucket.BucketSize, now, hitsAddend)
+}
+
+// getLeakyBucketDescriptorStatus returns the status of the hits added to a leaky bucket, or not, and
+// whether they were over the limit. The duration until the reset is the time until the bucket is
+// empty, or until the rejected hits fit in it. The hits are those added to the bucket, 0 for a query
+// or when the increments were skipped, which is not counted within the limit.
+func (this *fixedRateLimitCacheImpl) getLeakyBucketDescriptorStatus(limit *config.RateLimit, result []string,
+	hitsAddend uint64,
+) (*pb.RateLimitResponse_DescriptorStatus, bool) {
+	added := len(result) == 2 && result[0] == "1"
+	var level float64
+	if len(result) == 2 {
+		var err error
+		if level, err = strconv.ParseFloat(result[1], 64); err != nil {
+			logger.Errorf("invalid leaky bucket level %q: %v", result[1], err)
+		}
+	}
+	size := float64(limit.LeakyBucket.BucketSize)
+	window := time.Duration(utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)) * time.Second
+	// the time taken to drain the given level
+	drainTime := func(level float64) *durationpb.Duration {
+		drain := time.Duration(level / float64(limit.Limit.RequestsPerUnit) * float64(window))
+		return &durationpb.Duration{Seconds: int64((drain + time.Second - 1) / time.Second)}
+	}
+
+	if !added {
+		status := &pb.RateLimitResponse_DescriptorStatus{
+			Code:               pb.RateLimitResponse_OVER_LIMIT,
+			CurrentLimit:       limit.CurrentLimit(),
+			DurationUntilReset: drainTime(level + float64(hitsAddend) - size),
+		}
+		// the over limit of a limit spilling over is recorded by the service
+		if limit.SpillsOver {
+			return status, true
+		}
+		limit.Stats.OverLimit.Add(hitsAddend)
+		if limit.ShadowMode {
+			logger.Debugf("Limit with key %s, is in shadow_mode", limit.FullKey)
+			status.Code = pb.RateLimitResponse_OK
+			limit.Stats.ShadowMode.Add(hitsAddend)
+		}
+		return status, true
+	}
+
+	if level > math.Floor(size*float64(this.baseRateLimiter.NearLimitRatio())) {
+		limit.Stats.NearLimit.Add(hitsAddend)
+	}
+	limit.Stats.WithinLimit.Add(hitsAddend)
+	return &pb.RateLimitResponse_DescriptorStatus{
+		Code:               pb.RateLimitResponse_OK,
+		CurrentLimit:       limit.CurrentLimit(),
+		LimitRemaining:     uint32(math.Max(0, math.Floor(size-level))),
+		DurationUntilReset: drainTime(level),
+	}, false
+}
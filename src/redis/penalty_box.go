@@ -0,0 +1,194 @@
+package redis
+
+import (
+	"slices"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// penaltyBoxStats counts the descriptors placed in and released from the penalty box.
+type penaltyBoxStats struct {
+	// banned counts the descriptors placed in the penalty box.
+	banned gostats.Counter
+	// rejected counts the requests of the descriptors in the penalty box.
+	rejected gostats.Counter
+	// released counts the bans cleared before their end.
+	released gostats.Counter
+}
+
+func newPenaltyBoxStats(scope gostats.Scope) penaltyBoxStats {
+	return penaltyBoxStats{
+		banned:   scope.NewCounter("banned"),
+		rejected: scope.NewCounter("rejected"),
+		released: scope.NewCounter("released"),
+	}
+}
+
+// getBans reads the remaining ban of the descriptors of the limits with a penalty, only of those
+// with a leaky bucket if leakyBucketsOnly, nil if no such limit has a penalty.
+func (this *fixedRateLimitCacheImpl) getBans(ctx context.Context, cacheKeys []limiter.CacheKey,
+	limits []*config.RateLimit, clients []Client, leakyBucketsOnly bool,
+) []time.Duration {
+	ttls := make([]int64, len(cacheKeys))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" || limits[i].Penalty == nil || (leakyBucketsOnly && limits[i].LeakyBucket == nil) {
+			continue
+		}
+		pipelineAppendBan(clients[i], pipelines.get(clients[i]), cacheKey.Key, &ttls[i])
+	}
+	if len(pipelines.clients) == 0 {
+		return nil
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	bans := make([]time.Duration, len(cacheKeys))
+	for i, ttl := range ttls {
+		bans[i] = banDuration(ttl)
+	}
+	return bans
+}
+
+// pipelineAppendBan reads the remaining ban of the descriptor of a cache key, in milliseconds.
+func pipelineAppendBan(client Client, pipeline *Pipeline, key string, ttl *int64) {
+	ban, _ := limiter.PenaltyKeys(key)
+	*pipeline = client.PipeAppend(*pipeline, ttl, "PTTL", ban)
+}
+
+// banDuration returns the remaining ban read by PTTL, which is negative for a missing key.
+func banDuration(ttl int64) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Millisecond
+}
+
+// giveBackBannedHits sets the bans read with the increments of the counters, and gives the hits of
+// the banned descriptors back to their counters, so that they are rejected without counting.
+func (this *fixedRateLimitCacheImpl) giveBackBannedHits(ctx context.Context, cacheKeys []limiter.CacheKey,
+	clients []Client, banTtls []int64, hits []uint64, bans []time.Duration,
+) {
+	refunds := make([]limiter.CacheKey, len(cacheKeys))
+	refunded := false
+	for i, ttl := range banTtls {
+		if bans[i] = max(bans[i], banDuration(ttl)); bans[i] > 0 && hits[i] > 0 {
+			refunds[i] = cacheKeys[i]
+			refunded = true
+		}
+	}
+	if refunded {
+		this.refundCounters(ctx, refunds, hits, clients)
+	}
+}
+
+// addOverLimits counts the over-limits of the descriptors of the limits with a penalty, the count
+// expiring at the end of the window of the penalty, and places the descriptors reaching the
+// over-limits of their penalty in the penalty box.
+func (this *fixedRateLimitCacheImpl) addOverLimits(ctx context.Context, cacheKeys []limiter.CacheKey,
+	limits []*config.RateLimit, clients []Client, overLimit []bool,
+) {
+	if !slices.Contains(overLimit, true) {
+		return
+	}
+	counts := make([]uint64, len(cacheKeys))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if !overLimit[i] {
+			continue
+		}
+		_, overLimits := limiter.PenaltyKeys(cacheKey.Key)
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "SET", overLimits, 0, "EX",
+			int64(limits[i].Penalty.Window/time.Second), "NX")
+		*pipeline = clients[i].PipeAppend(*pipeline, &counts[i], "INCR", overLimits)
+	}
+	if len(pipelines.clients) == 0 {
+		return
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	banPipelines := newClientPipelines()
+	for i, count := range counts {
+		if !overLimit[i] || count < uint64(limits[i].Penalty.OverLimits) {
+			continue
+		}
+		ban, overLimits := limiter.PenaltyKeys(cacheKeys[i].Key)
+		pipeline := banPipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "SET", ban, 1, "PX",
+			limits[i].Penalty.Duration.Milliseconds())
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "DEL", overLimits)
+		this.penaltyStats.banned.Inc()
+	}
+	for _, err := range banPipelines.do(ctx) {
+		checkError(err)
+	}
+}
+
+// penaltyCacheKeys returns the cache keys and clients of the limits with a penalty.
+func (this *fixedRateLimitCacheImpl) penaltyCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) ([]limiter.CacheKey, []Client) {
+	withPenalty := make([]*config.RateLimit, len(limits))
+	clients := make([]Client, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.Penalty != nil {
+			withPenalty[i] = limit
+			clients[i] = this.router.ClientFor(request.Domain, limit.Backend, limit.Limit.Unit)
+		}
+	}
+	return this.baseRateLimiter.GenerateCacheKeys(request, withPenalty, make([]uint64, len(request.Descriptors))), clients
+}
+
+func (this *fixedRateLimitCacheImpl) GetPenalties(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []limiter.PenaltyValue {
+	cacheKeys, clients := this.penaltyCacheKeys(request, limits)
+	penalties := make([]limiter.PenaltyValue, len(request.Descriptors))
+	bans := this.getBans(ctx, cacheKeys, limits, clients, false)
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		penalties[i].Key, _ = limiter.PenaltyKeys(cacheKey.Key)
+		penalties[i].Remaining = bans[i]
+	}
+	return penalties
+}
+
+func (this *fixedRateLimitCacheImpl) ClearPenalties(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) []limiter.PenaltyValue {
+	penalties := this.GetPenalties(ctx, request, limits)
+	cacheKeys, clients := this.penaltyCacheKeys(request, limits)
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		ban, overLimits := limiter.PenaltyKeys(cacheKey.Key)
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "DEL", ban)
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "DEL", overLimits)
+		if penalties[i].Remaining > 0 {
+			this.penaltyStats.released.Inc()
+		}
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+	return penalties
+}
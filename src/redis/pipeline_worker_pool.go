@@ -0,0 +1,69 @@
+package redis
+
+import (
+	"sync"
+
+	stats "github.com/lyft/gostats"
+)
+
+type pipelineWorkerPoolStats struct {
+	queueDepth    stats.Gauge
+	activeWorkers stats.Gauge
+	tasks         stats.Counter
+}
+
+func newPipelineWorkerPoolStats(scope stats.Scope) pipelineWorkerPoolStats {
+	ret := pipelineWorkerPoolStats{}
+	ret.queueDepth = scope.NewGauge("queue_depth")
+	ret.activeWorkers = scope.NewGauge("active_workers")
+	ret.tasks = scope.NewCounter("tasks")
+	return ret
+}
+
+// PipelineWorkerPool is a fixed set of goroutines shared across requests which execute the
+// per-slot pipelines of cluster mode concurrently, bounding the number of goroutines and of
+// in-flight pipelines regardless of the request rate.
+type PipelineWorkerPool struct {
+	tasks     chan func()
+	stats     pipelineWorkerPoolStats
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewPipelineWorkerPool starts a pool of workers goroutines. Submit blocks once queueSize
+// tasks are waiting for a worker.
+func NewPipelineWorkerPool(scope stats.Scope, workers int, queueSize int) *PipelineWorkerPool {
+	p := &PipelineWorkerPool{
+		tasks: make(chan func(), queueSize),
+		stats: newPipelineWorkerPoolStats(scope),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *PipelineWorkerPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		p.stats.queueDepth.Dec()
+		p.stats.activeWorkers.Inc()
+		task()
+		p.stats.activeWorkers.Dec()
+	}
+}
+
+// Submit queues a task for execution by a worker.
+func (p *PipelineWorkerPool) Submit(task func()) {
+	p.stats.tasks.Inc()
+	p.stats.queueDepth.Inc()
+	p.tasks <- task
+}
+
+// Close stops the workers once the queued tasks are executed. No task may be submitted after Close.
+func (p *PipelineWorkerPool) Close() error {
+	p.closeOnce.Do(func() { close(p.tasks) })
+	p.wg.Wait()
+	return nil
+}
@@ -0,0 +1,64 @@
+package redis
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// refundScript removes up to ARGV[1] hits from the counter of KEYS[1], clamping it at zero. A missing
+// counter is not created and DECRBY keeps the expiration of the key. Returns the counter and the
+// hits removed.
+const refundScript = `
+local value = tonumber(redis.call('GET', KEYS[1]))
+if not value then
+  return {0, 0}
+end
+local refunded = math.min(value, tonumber(ARGV[1]))
+return {redis.call('DECRBY', KEYS[1], refunded), refunded}
+`
+
+func (this *fixedRateLimitCacheImpl) RefundHits(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	countedAt int64,
+) []limiter.RefundValue {
+	cacheKeys, hitsAddends := this.baseRateLimiter.GenerateRefundCacheKeys(request, limits, countedAt)
+	results := make([][]int64, len(cacheKeys))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" || hitsAddends[i] == 0 {
+			continue
+		}
+		client := this.router.ClientFor(request.Domain, limits[i].Backend, limits[i].Limit.Unit)
+		pipeline := pipelines.get(client)
+		*pipeline = client.PipeAppendScript(*pipeline, &results[i], refundScript, cacheKey.Key, hitsAddends[i])
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	refunds := make([]limiter.RefundValue, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		refunds[i].Key = cacheKey.Key
+		if hitsAddends[i] == 0 {
+			continue
+		}
+		if len(results[i]) == 2 {
+			refunds[i].Value = uint64(results[i][0])
+			refunds[i].Refunded = uint64(results[i][1])
+		}
+		this.refundStats.Record(hitsAddends[i], refunds[i].Refunded)
+		if refunds[i].Refunded > 0 {
+			// the key may no longer be over or near its limit
+			this.baseRateLimiter.ForgetLocalCache(cacheKey.Key)
+		}
+	}
+	return refunds
+}
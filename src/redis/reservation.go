@@ -0,0 +1,325 @@
+package redis
+
+import (
+	"strconv"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// releaseHoldsScript removes the holds expired at ARGV[1] from the sorted set of the holds of
+// KEYS[1], along with the hold ARGV[2] unless it is empty. The holds are scored by their expiration
+// and named by their hits and their reservation. Returns 1 if the hold ARGV[2] was held and the
+// hits of the expired holds, which are to be given back to the counter.
+const releaseHoldsScript = `
+local reclaimed = 0
+for _, hold in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])) do
+  reclaimed = reclaimed + tonumber(string.match(hold, '^(%d+):'))
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local held = 0
+if ARGV[2] ~= '' then
+  held = redis.call('ZREM', KEYS[1], ARGV[2])
+end
+return {held, reclaimed}
+`
+
+// reserveScript gives back the ARGV[1] hits of the expired holds to the counter of KEYS[1], then
+// adds the ARGV[2] hits of the reservation if the counter stays within the limit ARGV[3], or ARGV[5]
+// is 1. A new counter expires after ARGV[4] seconds. Returns 1 if the hits were added and the counter.
+const reserveScript = `
+local reclaimed, hits, limit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local value = tonumber(redis.call('GET', KEYS[1]))
+if value and reclaimed > 0 then
+  value = redis.call('DECRBY', KEYS[1], math.min(value, reclaimed))
+end
+value = value or 0
+if value + hits > limit and ARGV[5] ~= '1' then
+  return {0, value}
+end
+value = redis.call('INCRBY', KEYS[1], hits)
+if redis.call('TTL', KEYS[1]) == -1 then
+  redis.call('EXPIRE', KEYS[1], ARGV[4])
+end
+return {1, value}
+`
+
+func holdsKey(key string) string {
+	return key + "_holds"
+}
+
+func holdMember(hitsAddend uint64, reservationId string) string {
+	return strconv.FormatUint(hitsAddend, 10) + ":" + reservationId
+}
+
+// reservationCacheKeys returns the cache keys, the hits and the clients of the limits which can be
+// reserved.
+func (this *fixedRateLimitCacheImpl) reservationCacheKeys(request *pb.RateLimitRequest,
+	limits []*config.RateLimit, reservationId string,
+) ([]limiter.CacheKey, []uint64, []Client) {
+	cacheKeys, hitsAddends := this.baseRateLimiter.GenerateReservationCacheKeys(request, limits, reservationId)
+	clients := make([]Client, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key != "" {
+			clients[i] = this.router.ClientFor(request.Domain, limits[i].Backend, limits[i].Limit.Unit)
+		}
+	}
+	return cacheKeys, hitsAddends, clients
+}
+
+// releaseHolds removes the expired holds of the keys, and the holds of the reservation unless it is
+// empty. Returns whether each hold of the reservation was held and the hits of the expired holds.
+func (this *fixedRateLimitCacheImpl) releaseHolds(ctx context.Context, cacheKeys []limiter.CacheKey,
+	hitsAddends []uint64, clients []Client, reservationId string,
+) ([]bool, []uint64) {
+	results := make([][]int64, len(cacheKeys))
+	now := utils.UnixMilliNow(this.timeSource)
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		member := ""
+		if reservationId != "" {
+			member = holdMember(hitsAddends[i], reservationId)
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, &results[i], releaseHoldsScript, holdsKey(cacheKey.Key), now, member)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	held := make([]bool, len(cacheKeys))
+	reclaimed := make([]uint64, len(cacheKeys))
+	for i := range cacheKeys {
+		if len(results[i]) == 2 {
+			held[i] = results[i][0] == 1
+			reclaimed[i] = uint64(results[i][1])
+		}
+	}
+	return held, reclaimed
+}
+
+// reclaimExpiredHolds gives back the hits of the expired holds of the counters the increments took
+// over their limit, updating their results, so that the hits of the reservations never committed
+// nor cancelled don't reject the requests once their hold expired.
+func (this *fixedRateLimitCacheImpl) reclaimExpiredHolds(ctx context.Context, cacheKeys []limiter.CacheKey,
+	limits []*config.RateLimit, hitsAddends []uint64, clients []Client, results []uint64,
+) {
+	overLimitKeys := make([]limiter.CacheKey, len(cacheKeys))
+	overLimit := false
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" || limits[i].LeakyBucket != nil || limits[i].Concurrency != nil || hitsAddends[i] == 0 ||
+			results[i] <= uint64(limits[i].Limit.RequestsPerUnit) {
+			continue
+		}
+		overLimitKeys[i] = cacheKey
+		overLimit = true
+	}
+	if !overLimit {
+		return
+	}
+
+	_, reclaimed := this.releaseHolds(ctx, overLimitKeys, hitsAddends, clients, "")
+	for i := range overLimitKeys {
+		if reclaimed[i] == 0 {
+			overLimitKeys[i] = limiter.CacheKey{}
+		}
+	}
+	values := this.refundCounters(ctx, overLimitKeys, reclaimed, clients)
+	for i, cacheKey := range overLimitKeys {
+		// the counter may have expired since its increment
+		if cacheKey.Key != "" && values[i] >= hitsAddends[i] {
+			results[i] = values[i]
+		}
+	}
+}
+
+// refundCounters removes the hits from the counters with refundScript, returning the counters.
+func (this *fixedRateLimitCacheImpl) refundCounters(ctx context.Context, cacheKeys []limiter.CacheKey,
+	hits []uint64, clients []Client,
+) []uint64 {
+	results := make([][]int64, len(cacheKeys))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, &results[i], refundScript, cacheKey.Key, hits[i])
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	values := make([]uint64, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if len(results[i]) != 2 {
+			continue
+		}
+		values[i] = uint64(results[i][0])
+		if results[i][1] > 0 {
+			// the key may no longer be over or near its limit
+			this.baseRateLimiter.ForgetLocalCache(cacheKey.Key)
+		}
+	}
+	return values
+}
+
+func (this *fixedRateLimitCacheImpl) Reserve(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	ttl time.Duration,
+) (string, []limiter.ReservationValue) {
+	reservationId := this.baseRateLimiter.NewReservation()
+	cacheKeys, hitsAddends, clients := this.reservationCacheKeys(request, limits, reservationId)
+	// the expired holds are given back before the hits are counted
+	_, reclaimed := this.releaseHolds(ctx, cacheKeys, hitsAddends, clients, "")
+
+	results := make([][]int64, len(cacheKeys))
+	pipelines := newClientPipelines()
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		overLimit := 0
+		if limits[i].ShadowMode {
+			overLimit = 1
+		}
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppendScript(*pipeline, &results[i], reserveScript, cacheKey.Key, reclaimed[i],
+			hitsAddends[i], limits[i].Limit.RequestsPerUnit, this.baseRateLimiter.ExpirationSeconds(limits[i]), overLimit)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	holds := make([]limiter.ReservationValue, len(cacheKeys))
+	rejected := false
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" || len(results[i]) != 2 {
+			continue
+		}
+		holds[i] = limiter.ReservationValue{
+			Key:   cacheKey.Key,
+			Held:  results[i][0] == 1,
+			Value: uint64(results[i][1]),
+		}
+		limits[i].Stats.TotalHits.Add(hitsAddends[i])
+		switch {
+		case !holds[i].Held:
+			logger.Debugf("cache key is over its limit, the reservation is rejected: %s", cacheKey.Key)
+			limits[i].Stats.OverLimit.Add(hitsAddends[i])
+			rejected = true
+		case holds[i].Value > uint64(limits[i].Limit.RequestsPerUnit):
+			limits[i].Stats.OverLimit.Add(hitsAddends[i])
+			limits[i].Stats.ShadowMode.Add(hitsAddends[i])
+		default:
+			limits[i].Stats.WithinLimit.Add(hitsAddends[i])
+		}
+	}
+
+	if rejected {
+		// the hits are held on every descriptor or on none
+		this.reservationStats.Rejected.Inc()
+		refunds := make([]uint64, len(cacheKeys))
+		for i, hold := range holds {
+			if hold.Held {
+				refunds[i] = hitsAddends[i]
+				holds[i].Held = false
+			}
+		}
+		values := this.refundCounters(ctx, cacheKeys, refunds, clients)
+		for i, hold := range holds {
+			if hold.Key != "" {
+				holds[i].Value = values[i]
+			}
+		}
+		return reservationId, holds
+	}
+
+	expiration := utils.UnixMilliNow(this.timeSource) + ttl.Milliseconds()
+	pipelines = newClientPipelines()
+	for i, hold := range holds {
+		if hold.Key == "" {
+			continue
+		}
+		// the holds are kept as long as their counter, and can't outlive their window
+		holdsTtl := this.baseRateLimiter.ExpirationSeconds(limits[i]) + int64(ttl.Seconds()) + 1
+		pipeline := pipelines.get(clients[i])
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "ZADD", holdsKey(hold.Key), expiration, holdMember(hitsAddends[i], reservationId))
+		*pipeline = clients[i].PipeAppend(*pipeline, nil, "EXPIRE", holdsKey(hold.Key), holdsTtl)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+	this.reservationStats.Reserved.Inc()
+	return reservationId, holds
+}
+
+func (this *fixedRateLimitCacheImpl) CommitReservation(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	reservationId string,
+) []limiter.ReservationValue {
+	return this.releaseReservation(ctx, request, limits, reservationId, false)
+}
+
+func (this *fixedRateLimitCacheImpl) CancelReservation(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	reservationId string,
+) []limiter.ReservationValue {
+	return this.releaseReservation(ctx, request, limits, reservationId, true)
+}
+
+// releaseReservation removes the holds of a reservation, giving back its hits if it is cancelled.
+// The hits of the expired holds are given back, whether they are of the reservation or not.
+func (this *fixedRateLimitCacheImpl) releaseReservation(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	reservationId string,
+	cancel bool,
+) []limiter.ReservationValue {
+	cacheKeys, hitsAddends, clients := this.reservationCacheKeys(request, limits, reservationId)
+	held, refunds := this.releaseHolds(ctx, cacheKeys, hitsAddends, clients, reservationId)
+	expired := false
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key == "" {
+			continue
+		}
+		if !held[i] {
+			expired = true
+		} else if cancel {
+			refunds[i] += hitsAddends[i]
+		}
+	}
+	values := this.refundCounters(ctx, cacheKeys, refunds, clients)
+
+	holds := make([]limiter.ReservationValue, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.Key != "" {
+			holds[i] = limiter.ReservationValue{Key: cacheKey.Key, Held: held[i], Value: values[i]}
+		}
+	}
+	switch {
+	case expired:
+		this.reservationStats.Expired.Inc()
+	case cancel:
+		this.reservationStats.Cancelled.Inc()
+	default:
+		this.reservationStats.Committed.Inc()
+	}
+	return holds
+}
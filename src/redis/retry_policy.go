@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jpillora/backoff"
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix/v4"
+	"github.com/mediocregopher/radix/v4/resp/resp3"
+)
+
+// RetryPolicy controls how a client retries the commands failing with a transient error, such as
+// a connection reset or a cluster failover, and whether it hedges the read-only pipelines.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries of a failed command, 0 disables the retries.
+	MaxRetries int
+	// BackoffMin is the delay before the first retry, doubled on every retry up to BackoffMax.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// HedgeDelay sends a second copy of a read-only pipeline when the first one did not complete
+	// within the delay, the first reply is used. 0 disables the hedging.
+	HedgeDelay time.Duration
+	// FailoverTimeout is how long a pipeline failing on a sentinel master waits for the sentinels to
+	// announce a new master, 0 disables the failover handling. The read-only pipelines are then
+	// executed again on the new master.
+	FailoverTimeout time.Duration
+	// FailoverGrace answers the increments failing during a failover as if the counters were zero
+	// instead of failing them, so that the requests are allowed while the master changes.
+	FailoverGrace bool
+}
+
+type retryStats struct {
+	retries      stats.Counter
+	hedges       stats.Counter
+	hedgeWins    stats.Counter
+	retriesFails stats.Counter
+}
+
+func newRetryStats(scope stats.Scope) retryStats {
+	ret := retryStats{}
+	ret.retries = scope.NewCounter("retries")
+	ret.retriesFails = scope.NewCounter("retries_exhausted")
+	ret.hedges = scope.NewCounter("hedges")
+	ret.hedgeWins = scope.NewCounter("hedge_wins")
+	return ret
+}
+
+// transientErrorPrefixes are the error replies of Redis which are expected to go away on retry. Redis
+// rejects the commands with these errors without executing them.
+var transientErrorPrefixes = []string{"LOADING", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN", "READONLY"}
+
+// readOnlyCommands are the commands which can be executed again after a connection error.
+var readOnlyCommands = map[string]bool{"GET": true, "MGET": true, "PTTL": true, "TTL": true, "EXISTS": true}
+
+// isTransientError returns whether err is a connection error or a transient error reply of Redis.
+func isTransientError(err error) bool {
+	return isRejected(err) || isConnectionError(err)
+}
+
+// isRejected returns whether Redis rejected a command with a transient error, without executing it.
+func isRejected(err error) bool {
+	var replyErr resp3.SimpleError
+	if !errors.As(err, &replyErr) {
+		return false
+	}
+	for _, prefix := range transientErrorPrefixes {
+		if strings.HasPrefix(replyErr.S, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// isRetryable returns whether a command failing with err can be executed again. A command failing
+// with a connection error, e.g. a timeout or a reset, may have been executed, so that only the
+// read-only ones are retried then.
+func isRetryable(err error, readOnly bool) bool {
+	return isRejected(err) || (readOnly && isConnectionError(err))
+}
+
+// withRetries calls do until it succeeds, fails with an error which is not retryable, the retries are
+// exhausted or ctx is done. readOnly is whether do only executes read-only commands.
+func (c *clientImpl) withRetries(ctx context.Context, readOnly bool, do func() error) error {
+	err := do()
+	if err == nil || c.retryPolicy.MaxRetries == 0 {
+		return err
+	}
+
+	b := &backoff.Backoff{Min: c.retryPolicy.BackoffMin, Max: c.retryPolicy.BackoffMax, Jitter: true}
+	for retry := 0; retry < c.retryPolicy.MaxRetries && isRetryable(err, readOnly); retry++ {
+		c.retryStats.retries.Inc()
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err = do(); err == nil {
+			return nil
+		}
+	}
+	c.retryStats.retriesFails.Inc()
+	return err
+}
+
+func isReadOnly(pipeline Pipeline) bool {
+	for _, pa := range pipeline {
+		if !readOnlyCommands[pa.cmd] {
+			return false
+		}
+	}
+	return len(pipeline) > 0
+}
+
+type hedgeResult struct {
+	hedge   bool
+	rcvs    []interface{}
+	replies []*radix.Maybe
+	err     error
+}
+
+// doHedged executes a read-only pipeline, and a second copy of it if the first one is not done
+// within the hedge delay. Each copy reads into its own receivers and the receivers of the
+// pipeline are set from the first successful copy.
+func (c *clientImpl) doHedged(ctx context.Context, pipeline Pipeline) error {
+	results := make(chan hedgeResult, 2)
+	start := func(hedge bool) {
+		rcvs := make([]interface{}, len(pipeline))
+		replies := make([]*radix.Maybe, len(pipeline))
+		p := make(Pipeline, len(pipeline))
+		for i, pa := range pipeline {
+			if pa.rcv != nil {
+				rcvs[i] = reflect.New(reflect.TypeOf(pa.rcv).Elem()).Interface()
+			}
+			var action radix.Action
+			action, replies[i] = newAction(rcvs[i], pa.cmd, pa.args)
+			p[i] = PipelineAction{
+				Action: action,
+				Key:    pa.Key,
+			}
+		}
+		go func() {
+			results <- hedgeResult{hedge: hedge, rcvs: rcvs, replies: replies, err: c.execute(ctx, p)}
+		}()
+	}
+
+	start(false)
+	timer := time.NewTimer(c.retryPolicy.HedgeDelay)
+	defer timer.Stop()
+
+	pending := 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			c.retryStats.hedges.Inc()
+			start(true)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				// wait for the hedge if it was sent
+				err = result.err
+				continue
+			}
+			if result.hedge {
+				c.retryStats.hedgeWins.Inc()
+			}
+			for i, pa := range pipeline {
+				if pa.rcv != nil {
+					reflect.ValueOf(pa.rcv).Elem().Set(reflect.ValueOf(result.rcvs[i]).Elem())
+				}
+				if pa.reply != nil {
+					pa.reply.Null = result.replies[i].Null
+				}
+			}
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix/v4/trace"
+	logger "github.com/sirupsen/logrus"
+)
+
+type failoverStats struct {
+	failovers      stats.Counter
+	retries        stats.Counter
+	graces         stats.Counter
+	internalErrors stats.Counter
+}
+
+func newFailoverStats(scope stats.Scope) failoverStats {
+	ret := failoverStats{}
+	ret.failovers = scope.NewCounter("failovers")
+	ret.retries = scope.NewCounter("failover_retries")
+	ret.graces = scope.NewCounter("failover_graces")
+	ret.internalErrors = scope.NewCounter("internal_errors")
+	return ret
+}
+
+// failoverDetector follows the master announced by the sentinels to detect the failovers.
+type failoverDetector struct {
+	mu     sync.Mutex
+	master string
+	// changes is closed and replaced on every change of the master
+	changes chan struct{}
+	stats   failoverStats
+}
+
+func newFailoverDetector(scope stats.Scope) *failoverDetector {
+	return &failoverDetector{
+		changes: make(chan struct{}),
+		stats:   newFailoverStats(scope),
+	}
+}
+
+func (d *failoverDetector) trace() trace.SentinelTrace {
+	return trace.SentinelTrace{
+		TopoChanged: func(change trace.SentinelTopoChanged) {
+			for _, nodes := range [][]trace.SentinelNodeInfo{change.Added, change.Changed} {
+				for _, node := range nodes {
+					if node.IsPrimary {
+						d.setMaster(node.Addr)
+					}
+				}
+			}
+		},
+		InternalError: func(internalError trace.SentinelInternalError) {
+			logger.Errorf("redis sentinel error: %v", internalError.Err)
+			d.stats.internalErrors.Inc()
+		},
+	}
+}
+
+func (d *failoverDetector) setMaster(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.master == addr {
+		return
+	}
+	if d.master != "" {
+		logger.Warnf("redis sentinel failover from %s to %s", d.master, addr)
+		d.stats.failovers.Inc()
+	}
+	d.master = addr
+	close(d.changes)
+	d.changes = make(chan struct{})
+}
+
+// nextChange returns a channel closed on the next change of the master.
+func (d *failoverDetector) nextChange() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changes
+}
+
+// recoverFailover handles a pipeline which failed with err during a failover, i.e. when the master
+// changes within the failover timeout from the start of the pipeline. The read-only pipelines are
+// executed again on the new master, the increments are either failed or, in grace mode, answered
+// as if the counters were zero.
+func (c *clientImpl) recoverFailover(ctx context.Context, err error, change <-chan struct{}, pipeline Pipeline) error {
+	if c.retryPolicy.FailoverTimeout <= 0 || !isTransientError(err) {
+		return err
+	}
+
+	timer := time.NewTimer(c.retryPolicy.FailoverTimeout)
+	defer timer.Stop()
+	select {
+	case <-change:
+	case <-timer.C:
+		return err
+	case <-ctx.Done():
+		return err
+	}
+
+	if isReadOnly(pipeline) {
+		c.failover.stats.retries.Inc()
+		return c.execute(ctx, pipeline)
+	}
+	if c.retryPolicy.FailoverGrace {
+		c.failover.stats.graces.Inc()
+		return nil
+	}
+	return err
+}
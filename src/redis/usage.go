@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// globEscaper escapes the special characters of the SCAN patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (this *fixedRateLimitCacheImpl) ScanCounters(
+	ctx context.Context,
+	domain string,
+	prefix string,
+	max int,
+	maxScans int,
+) []limiter.UsageValue {
+	pattern := globEscaper.Replace(this.baseRateLimiter.DomainPrefix(domain)+prefix) + "*"
+	var keys []string
+	var keyClients []Client
+	// the domain may be routed to any of the clients, which share the SCAN budget
+	for _, client := range this.router.Clients() {
+		scans, err := client.ScanKeys(ctx, pattern, maxScans, func(key string) bool {
+			if limiter.IsCounterKey(key) {
+				keys = append(keys, key)
+				keyClients = append(keyClients, client)
+			}
+			return len(keys) < max
+		})
+		checkError(err)
+		maxScans -= scans
+		if len(keys) >= max || maxScans <= 0 {
+			break
+		}
+	}
+
+	values := make([]*int64, len(keys))
+	ttls := make([]int64, len(keys))
+	pipelines := newClientPipelines()
+	for i, key := range keys {
+		pipeline := pipelines.get(keyClients[i])
+		*pipeline = keyClients[i].PipeAppend(*pipeline, &values[i], "GET", key)
+		*pipeline = keyClients[i].PipeAppend(*pipeline, &ttls[i], "PTTL", key)
+	}
+	for _, err := range pipelines.do(ctx) {
+		checkError(err)
+	}
+
+	usage := make([]limiter.UsageValue, 0, len(keys))
+	for i, key := range keys {
+		// the counter expired since it was scanned
+		if values[i] == nil {
+			continue
+		}
+		value := limiter.UsageValue{Key: key, Value: uint64(*values[i])}
+		if ttls[i] > 0 {
+			value.Ttl = time.Duration(ttls[i]) * time.Millisecond
+		}
+		usage = append(usage, value)
+	}
+	return usage
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+type callerContextKey struct{}
+
+// CallerFromContext returns the caller authenticated by the Authenticator, empty when the
+// authentication is disabled.
+func CallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerContextKey{}).(string)
+	return caller
+}
+
+// Authenticator authenticates the callers of the gRPC services and of the HTTP endpoints of the main
+// port, by a static API key or a JWT bearer token, before serving their calls. The health checks are
+// not authenticated.
+type Authenticator struct {
+	apiKeys         map[string]string
+	apiKeyHeader    string
+	jwtVerifier     *JwtVerifier
+	scope           gostats.Scope
+	unauthenticated gostats.Counter
+}
+
+// NewAuthenticator accepts the API keys of apiKeys, a map of the caller names to their key, sent
+// in the apiKeyHeader metadata, and the tokens verified by jwtVerifier, which may be nil, sent in
+// the authorization metadata.
+func NewAuthenticator(scope gostats.Scope, apiKeys map[string]string, apiKeyHeader string, jwtVerifier *JwtVerifier) *Authenticator {
+	return &Authenticator{
+		apiKeys:         apiKeys,
+		apiKeyHeader:    strings.ToLower(apiKeyHeader),
+		jwtVerifier:     jwtVerifier,
+		scope:           scope,
+		unauthenticated: scope.NewCounter("unauthenticated"),
+	}
+}
+
+// authenticate returns the caller of the credentials in the headers returned by header, which
+// returns the first value of a header, empty if missing.
+func (this *Authenticator) authenticate(header func(name string) string) (string, bool) {
+	if value := header(this.apiKeyHeader); value != "" && len(this.apiKeys) > 0 {
+		caller := ""
+		for name, key := range this.apiKeys {
+			// the keys are all compared so that the time does not tell which one matched
+			if subtle.ConstantTimeCompare([]byte(value), []byte(key)) == 1 {
+				caller = name
+			}
+		}
+		if caller != "" {
+			return caller, true
+		}
+		logger.Debugf("Rejecting an unknown API key")
+	}
+	if value := header("authorization"); value != "" && this.jwtVerifier != nil {
+		token, found := strings.CutPrefix(value, "Bearer ")
+		if found {
+			caller, err := this.jwtVerifier.Verify(token)
+			if err == nil {
+				return caller, true
+			}
+			logger.Debugf("Rejecting a token: %v", err)
+		}
+	}
+	return "", false
+}
+
+func metadataHeader(md metadata.MD) func(name string) string {
+	return func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// UnaryServerInterceptor fails the calls of the unauthenticated callers with UNAUTHENTICATED and
+// passes the caller of the other calls in their context, see CallerFromContext.
+func (this *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		caller, ok := this.authenticate(metadataHeader(md))
+		if !ok {
+			this.unauthenticated.Inc()
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid credentials")
+		}
+		this.scope.Scope(utils.SanitizeStatName(caller)).NewCounter("authenticated").Inc()
+		return handler(context.WithValue(ctx, callerContextKey{}, caller), req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (this *authenticatedStream) Context() context.Context {
+	return this.ctx
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for the streaming calls.
+func (this *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+			return handler(srv, stream)
+		}
+
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		caller, ok := this.authenticate(metadataHeader(md))
+		if !ok {
+			this.unauthenticated.Inc()
+			return status.Error(codes.Unauthenticated, "missing or invalid credentials")
+		}
+		this.scope.Scope(utils.SanitizeStatName(caller)).NewCounter("authenticated").Inc()
+		return handler(srv, &authenticatedStream{stream, context.WithValue(stream.Context(), callerContextKey{}, caller)})
+	}
+}
+
+// HTTPMiddleware answers 401 Unauthorized to the requests of the unauthenticated callers and passes
+// the caller of the other requests in their context, except for the health checks.
+func (this *Authenticator) HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/healthcheck" || request.URL.Path == "/ready" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		caller, ok := this.authenticate(request.Header.Get)
+		if !ok {
+			this.unauthenticated.Inc()
+			http.Error(writer, "missing or invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		this.scope.Scope(utils.SanitizeStatName(caller)).NewCounter("authenticated").Inc()
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), callerContextKey{}, caller)))
+	})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// maxTrackedCallers bounds the callers whose calls are counted on their own. Past it, the idle
+// callers are dropped, and the new callers share the overflow bucket while none is idle.
+const maxTrackedCallers = 10000
+
+// overflowCaller is the bucket of the new callers past maxTrackedCallers, which no identity names.
+const overflowCaller = ""
+
+type callerBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// CallerLimiter bounds the gRPC calls of each caller to perSecond calls per second, with bursts
+// of up to burst calls, so that an abusive client cannot starve the other ones. The caller of a
+// call is the one authenticated by the Authenticator, else the SAN of its client certificate, else
+// its IP address.
+type CallerLimiter struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	buckets   map[string]*callerBucket
+	// the last time the idle callers were dropped
+	swept     time.Time
+	now       func() time.Time
+	scope     gostats.Scope
+	throttled gostats.Counter
+}
+
+func NewCallerLimiter(scope gostats.Scope, perSecond float64, burst int) *CallerLimiter {
+	if burst <= 0 {
+		burst = int(perSecond)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &CallerLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		buckets:   map[string]*callerBucket{},
+		now:       time.Now,
+		scope:     scope,
+		throttled: scope.NewCounter("throttled"),
+	}
+}
+
+// allow returns whether the caller can make a call, and the bucket it was counted in, the caller or
+// overflowCaller.
+func (this *CallerLimiter) allow(caller string) (bool, string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+	bucket, ok := this.buckets[caller]
+	if !ok {
+		if len(this.buckets) >= maxTrackedCallers {
+			this.dropIdleCallers(now)
+		}
+		if len(this.buckets) >= maxTrackedCallers {
+			caller = overflowCaller
+			bucket = this.buckets[overflowCaller]
+		}
+		if bucket == nil {
+			bucket = &callerBucket{tokens: this.burst, last: now}
+			this.buckets[caller] = bucket
+		}
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * this.perSecond
+	if bucket.tokens > this.burst {
+		bucket.tokens = this.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, caller
+	}
+	bucket.tokens--
+	return true, caller
+}
+
+// dropIdleCallers drops the callers whose burst is refilled, which are tracked again as new
+// callers, at most once per second. The callers which are not idle keep their bucket.
+func (this *CallerLimiter) dropIdleCallers(now time.Time) {
+	if now.Sub(this.swept) < time.Second {
+		return
+	}
+	this.swept = now
+	for caller, bucket := range this.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*this.perSecond >= this.burst {
+			delete(this.buckets, caller)
+		}
+	}
+}
+
+func callerIdentity(ctx context.Context) string {
+	if caller := CallerFromContext(ctx); caller != "" {
+		return caller
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unknown"
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+		cert := tlsInfo.State.PeerCertificates[0]
+		switch {
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case cert.Subject.CommonName != "":
+			return cert.Subject.CommonName
+		}
+	}
+	if p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		// e.g. the callers on a unix domain socket
+		return p.Addr.String()
+	}
+	return host
+}
+
+// UnaryServerInterceptor fails the calls beyond the rate of their caller with RESOURCE_EXHAUSTED.
+// The gRPC health checks are not limited.
+func (this *CallerLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+			return handler(ctx, req)
+		}
+
+		caller := callerIdentity(ctx)
+		if allowed, bucket := this.allow(caller); !allowed {
+			this.throttled.Inc()
+			// the stats are only named after the tracked callers
+			if bucket == overflowCaller {
+				this.scope.Scope("overflow").NewCounter("throttled").Inc()
+			} else {
+				this.scope.Scope(utils.SanitizeStatName(caller)).NewCounter("throttled").Inc()
+			}
+			return nil, status.Errorf(codes.ResourceExhausted, "too many calls from %s", caller)
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// ConfigGetter returns the configuration currently used by the service.
+type ConfigGetter interface {
+	GetCurrentConfig() (config.RateLimitConfig, bool)
+}
+
+type checkResponse struct {
+	Domain      string                  `json:"domain"`
+	Descriptors []*checkDescriptorState `json:"descriptors"`
+}
+
+type checkDescriptorState struct {
+	// Rule is the matched rule, nil if no rule matched the descriptor.
+	Rule         *config.RateLimitDump `json:"rule,omitempty"`
+	Backend      string                `json:"backend,omitempty"`
+	CacheKey     string                `json:"cache_key,omitempty"`
+	CurrentValue uint64                `json:"current_value"`
+}
+
+// NewCheckHandler returns a handler which resolves the descriptors of a ShouldRateLimit request,
+// in the JSON form of the /json endpoint, and returns the matched rules and the current value of
+// their counters. Nothing is incremented.
+func NewCheckHandler(configGetter ConfigGetter, counterReader limiter.CounterReader) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+		if !ok {
+			return
+		}
+
+		ctx := context.Background()
+		matched := make([]*config.RateLimit, len(req.Descriptors))
+		// the unlimited rules have no counter
+		limits := make([]*config.RateLimit, len(req.Descriptors))
+		for i, descriptor := range req.Descriptors {
+			matched[i] = current.GetLimit(ctx, req.Domain, descriptor)
+			if matched[i] != nil && !matched[i].Unlimited {
+				limits[i] = matched[i]
+			}
+		}
+
+		counters, err := readCounters(ctx, counterReader, req, limits)
+		if err != nil {
+			logger.Warnf("error reading the counters: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &checkResponse{Domain: req.Domain, Descriptors: make([]*checkDescriptorState, len(req.Descriptors))}
+		for i, limit := range matched {
+			state := &checkDescriptorState{CacheKey: counters[i].Key, CurrentValue: counters[i].Value}
+			if limit != nil {
+				state.Rule = config.NewRateLimitDump(limit)
+				state.Backend = limit.Backend
+			}
+			resp.Descriptors[i] = state
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the check response: %v", err)
+		}
+	}
+}
+
+// readDescriptorsRequest reads a ShouldRateLimit request in the JSON form of the /json endpoint
+// and returns it with the current configuration, or writes the error response.
+func readDescriptorsRequest(writer http.ResponseWriter, request *http.Request, configGetter ConfigGetter,
+) (*pb.RateLimitRequest, config.RateLimitConfig, bool) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		logger.Warnf("error: %s", err.Error())
+		writeHttpStatus(writer, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	var req pb.RateLimitRequest
+	if err := protojson.Unmarshal(body, &req); err != nil {
+		logger.Warnf("error: %s", err.Error())
+		writeHttpStatus(writer, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if req.Domain == "" || len(req.Descriptors) == 0 {
+		http.Error(writer, "the domain and the descriptors are required", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	current, _ := configGetter.GetCurrentConfig()
+	if current == nil {
+		http.Error(writer, "no rate limit configuration loaded", http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+	return &req, current, true
+}
+
+// readCounters turns the panics of the cache into an error.
+func readCounters(ctx context.Context, counterReader limiter.CounterReader, request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+) (counters []limiter.CounterValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	return counterReader.GetCounters(ctx, request, limits), nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/google/uuid"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+type concurrencyResponse struct {
+	Domain  string `json:"domain"`
+	LeaseId string `json:"lease_id"`
+	// Acquired is false if a descriptor is at its maximum of leases, the lease then being held on
+	// none of the descriptors.
+	Acquired    bool                     `json:"acquired"`
+	Descriptors []*concurrencyDescriptor `json:"descriptors"`
+}
+
+type concurrencyDescriptor struct {
+	// Rule is the matched rule, nil if no rule matched the descriptor.
+	Rule *config.RateLimitDump `json:"rule,omitempty"`
+	// Key is the key of the leases, empty if the rule has no concurrency.
+	Key         string `json:"key,omitempty"`
+	Acquired    bool   `json:"acquired"`
+	InFlight    uint32 `json:"in_flight"`
+	MaxInFlight uint32 `json:"max_in_flight,omitempty"`
+}
+
+// NewConcurrencyHandler returns a handler which resolves the descriptors of a ShouldRateLimit
+// request, in the JSON form of the /json endpoint, and acquires a lease on those with a concurrency
+// limit with a POST, or releases it with a DELETE. The lease is given by the lease_id query
+// parameter, a POST without it acquiring a new lease and a POST with it renewing the lease. A lease
+// which couldn't be acquired is answered with a 429.
+func NewConcurrencyHandler(configGetter ConfigGetter, concurrencyLimiter limiter.ConcurrencyLimiter) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		release := request.Method == http.MethodDelete
+		leaseId := request.URL.Query().Get("lease_id")
+		if leaseId == "" {
+			if release {
+				http.Error(writer, "the lease_id is required", http.StatusBadRequest)
+				return
+			}
+			leaseId = uuid.NewString()
+		}
+
+		req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+		if !ok {
+			return
+		}
+
+		ctx := context.Background()
+		limits := make([]*config.RateLimit, len(req.Descriptors))
+		for i, descriptor := range req.Descriptors {
+			limits[i] = current.GetLimit(ctx, req.Domain, descriptor)
+		}
+
+		leases, err := accessLeases(ctx, concurrencyLimiter, req, limits, leaseId, release)
+		if err != nil {
+			logger.Warnf("error accessing the leases: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &concurrencyResponse{
+			Domain:      req.Domain,
+			LeaseId:     leaseId,
+			Acquired:    !release,
+			Descriptors: make([]*concurrencyDescriptor, len(req.Descriptors)),
+		}
+		for i, limit := range limits {
+			state := &concurrencyDescriptor{
+				Key:      leases[i].Key,
+				Acquired: leases[i].Acquired,
+				InFlight: leases[i].InFlight,
+			}
+			if limit != nil {
+				state.Rule = config.NewRateLimitDump(limit)
+				if limit.Concurrency != nil {
+					state.MaxInFlight = limit.Concurrency.MaxInFlight
+				}
+			}
+			if state.Key != "" && !state.Acquired {
+				resp.Acquired = false
+			}
+			resp.Descriptors[i] = state
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if !release && !resp.Acquired {
+			writer.WriteHeader(http.StatusTooManyRequests)
+		}
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the concurrency response: %v", err)
+		}
+	}
+}
+
+// accessLeases acquires or releases the leases, turning the panics of the cache into an error.
+func accessLeases(ctx context.Context, concurrencyLimiter limiter.ConcurrencyLimiter, request *pb.RateLimitRequest,
+	limits []*config.RateLimit, leaseId string, release bool,
+) (leases []limiter.LeaseValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	if release {
+		return concurrencyLimiter.ReleaseLeases(ctx, request, limits, leaseId), nil
+	}
+	return concurrencyLimiter.AcquireLeases(ctx, request, limits, leaseId), nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	gostats "github.com/lyft/gostats"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// literalPrefix introduces a literal value in an ext_authz descriptor mapping, e.g. "generic_key=literal:api".
+const literalPrefix = "literal:"
+
+// ExtAuthzEntry maps an attribute of the CheckRequests to a descriptor entry.
+type ExtAuthzEntry struct {
+	Key       string
+	Attribute string
+}
+
+// ParseExtAuthzDescriptors parses the descriptors of EXT_AUTHZ_DESCRIPTORS: the descriptors are
+// separated by ';' and their entries by ',', each entry being key=attribute.
+func ParseExtAuthzDescriptors(spec string) ([][]ExtAuthzEntry, error) {
+	var ret [][]ExtAuthzEntry
+	for _, descriptorSpec := range strings.Split(spec, ";") {
+		if strings.TrimSpace(descriptorSpec) == "" {
+			continue
+		}
+		var descriptor []ExtAuthzEntry
+		for _, entrySpec := range strings.Split(descriptorSpec, ",") {
+			key, attribute, found := strings.Cut(strings.TrimSpace(entrySpec), "=")
+			if !found || key == "" || !isValidExtAuthzAttribute(attribute) {
+				return nil, fmt.Errorf("invalid ext_authz descriptor entry '%s'", entrySpec)
+			}
+			descriptor = append(descriptor, ExtAuthzEntry{Key: key, Attribute: attribute})
+		}
+		ret = append(ret, descriptor)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no ext_authz descriptor in '%s'", spec)
+	}
+	return ret, nil
+}
+
+func isValidExtAuthzAttribute(attribute string) bool {
+	switch attribute {
+	case "source.address", "destination.address", "request.http.method", "request.http.host", "request.http.path":
+		return true
+	}
+	return strings.HasPrefix(attribute, "request.http.headers.") || strings.HasPrefix(attribute, "context_extensions.") ||
+		strings.HasPrefix(attribute, literalPrefix)
+}
+
+type extAuthzStats struct {
+	requests     gostats.Counter
+	overLimit    gostats.Counter
+	serviceError gostats.Counter
+}
+
+func newExtAuthzStats(scope gostats.Scope) extAuthzStats {
+	ret := extAuthzStats{}
+	ret.requests = scope.NewCounter("requests")
+	ret.overLimit = scope.NewCounter("over_limit")
+	ret.serviceError = scope.NewCounter("service_error")
+	return ret
+}
+
+type extAuthzServer struct {
+	svc         pb.RateLimitServiceServer
+	domain      string
+	descriptors [][]ExtAuthzEntry
+	stats       extAuthzStats
+}
+
+// NewExtAuthzServer adapts the rate limit service to the Envoy ext_authz Authorization service,
+// for the gateways which can only call an external authorization service. The attributes of each
+// CheckRequest are mapped to descriptors of domain, a descriptor whose attributes are missing
+// being skipped like the rate limit actions of Envoy. An over limit request is denied with a 429.
+func NewExtAuthzServer(svc pb.RateLimitServiceServer, domain string, descriptors [][]ExtAuthzEntry, scope gostats.Scope) auth.AuthorizationServer {
+	return &extAuthzServer{
+		svc:         svc,
+		domain:      domain,
+		descriptors: descriptors,
+		stats:       newExtAuthzStats(scope),
+	}
+}
+
+func (this *extAuthzServer) Check(ctx context.Context, request *auth.CheckRequest) (*auth.CheckResponse, error) {
+	this.stats.requests.Inc()
+	rlRequest := &pb.RateLimitRequest{Domain: this.domain, HitsAddend: 1}
+	for _, descriptor := range this.descriptors {
+		if rlDescriptor := buildExtAuthzDescriptor(request, descriptor); rlDescriptor != nil {
+			rlRequest.Descriptors = append(rlRequest.Descriptors, rlDescriptor)
+		}
+	}
+	if len(rlRequest.Descriptors) == 0 {
+		return okCheckResponse(nil), nil
+	}
+
+	response, err := this.svc.ShouldRateLimit(ctx, rlRequest)
+	if err != nil {
+		this.stats.serviceError.Inc()
+		return nil, err
+	}
+	if response.OverallCode == pb.RateLimitResponse_OVER_LIMIT {
+		this.stats.overLimit.Inc()
+		return &auth.CheckResponse{
+			Status: &status.Status{Code: int32(code.Code_RESOURCE_EXHAUSTED)},
+			HttpResponse: &auth.CheckResponse_DeniedResponse{DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &envoy_type.HttpStatus{Code: envoy_type.StatusCode_TooManyRequests},
+				Headers: toHeaderValueOptions(response.ResponseHeadersToAdd),
+			}},
+			DynamicMetadata: response.DynamicMetadata,
+		}, nil
+	}
+	ret := okCheckResponse(toHeaderValueOptions(response.ResponseHeadersToAdd))
+	ret.DynamicMetadata = response.DynamicMetadata
+	return ret, nil
+}
+
+func okCheckResponse(headers []*core.HeaderValueOption) *auth.CheckResponse {
+	return &auth.CheckResponse{
+		Status:       &status.Status{Code: int32(code.Code_OK)},
+		HttpResponse: &auth.CheckResponse_OkResponse{OkResponse: &auth.OkHttpResponse{ResponseHeadersToAdd: headers}},
+	}
+}
+
+func toHeaderValueOptions(headers []*core.HeaderValue) []*core.HeaderValueOption {
+	var ret []*core.HeaderValueOption
+	for _, header := range headers {
+		ret = append(ret, &core.HeaderValueOption{Header: header})
+	}
+	return ret
+}
+
+// buildExtAuthzDescriptor returns nil if an attribute of the descriptor is missing from the request.
+func buildExtAuthzDescriptor(request *auth.CheckRequest, entries []ExtAuthzEntry) *pb_struct.RateLimitDescriptor {
+	descriptor := &pb_struct.RateLimitDescriptor{}
+	for _, entry := range entries {
+		value := extAuthzAttribute(request.GetAttributes(), entry.Attribute)
+		if value == "" {
+			return nil
+		}
+		descriptor.Entries = append(descriptor.Entries, &pb_struct.RateLimitDescriptor_Entry{Key: entry.Key, Value: value})
+	}
+	return descriptor
+}
+
+func extAuthzAttribute(attributes *auth.AttributeContext, attribute string) string {
+	http := attributes.GetRequest().GetHttp()
+	switch attribute {
+	case "source.address":
+		return attributes.GetSource().GetAddress().GetSocketAddress().GetAddress()
+	case "destination.address":
+		return attributes.GetDestination().GetAddress().GetSocketAddress().GetAddress()
+	case "request.http.method":
+		return http.GetMethod()
+	case "request.http.host":
+		return http.GetHost()
+	case "request.http.path":
+		return http.GetPath()
+	}
+	if name, found := strings.CutPrefix(attribute, "request.http.headers."); found {
+		// the header names of the CheckRequests are lower case
+		return http.GetHeaders()[strings.ToLower(name)]
+	}
+	if name, found := strings.CutPrefix(attribute, "context_extensions."); found {
+		return attributes.GetContextExtensions()[name]
+	}
+	return strings.TrimPrefix(attribute, literalPrefix)
+}
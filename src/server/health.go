@@ -22,12 +22,20 @@ type HealthChecker struct {
 	healthMap map[string]bool
 	ok        uint32
 	name      string
+
+	// readiness, the service is ready once a configuration was loaded and, if it can be probed, the
+	// backend reached
+	configLoaded     bool
+	backendProbed    bool
+	backendReachable bool
+	ready            chan struct{}
 }
 
 const (
 	ConfigHealthComponentName = "config"
 	RedisHealthComponentName  = "redis"
 	SigtermComponentName      = "sigterm"
+	CanaryHealthComponentName = "canary"
 )
 
 func areAllComponentsHealthy(healthMap map[string]bool) bool {
@@ -58,6 +66,7 @@ func NewHealthChecker(grpcHealthServer *health.Server, name string, healthyWithA
 	ret.healthMap[SigtermComponentName] = true
 
 	ret.grpc = grpcHealthServer
+	ret.ready = make(chan struct{})
 
 	if areAllComponentsHealthy(ret.healthMap) {
 		ret.grpc.SetServingStatus(ret.name, healthpb.HealthCheckResponse_SERVING)
@@ -125,6 +134,77 @@ func (hc *HealthChecker) Ok(componentName string) error {
 	return nil
 }
 
+// AddComponent registers an additional, initially healthy, component whose status
+// contributes to the overall health. Registering an existing component is a no-op.
+func (hc *HealthChecker) AddComponent(componentName string) {
+	hc.Lock()
+	defer hc.Unlock()
+	if _, ok := hc.healthMap[componentName]; !ok {
+		hc.healthMap[componentName] = true
+	}
+}
+
+// ConfigLoaded records that a configuration with at least one domain was loaded.
+func (hc *HealthChecker) ConfigLoaded() {
+	hc.Lock()
+	defer hc.Unlock()
+	hc.configLoaded = true
+	hc.signalReady()
+}
+
+// ProbeBackend makes the readiness wait for the rate limit backend to be reached, see
+// BackendReachable. It is only called for the backends which can be probed, and before the first
+// configuration is loaded.
+func (hc *HealthChecker) ProbeBackend() {
+	hc.Lock()
+	defer hc.Unlock()
+	hc.backendProbed = true
+}
+
+// BackendReachable records that a probe of the rate limit backend succeeded.
+func (hc *HealthChecker) BackendReachable() {
+	hc.Lock()
+	defer hc.Unlock()
+	hc.backendReachable = true
+	hc.signalReady()
+}
+
+func (hc *HealthChecker) signalReady() {
+	if !hc.configLoaded || (hc.backendProbed && !hc.backendReachable) {
+		return
+	}
+	select {
+	case <-hc.ready:
+	default:
+		close(hc.ready)
+	}
+}
+
+// Ready returns a channel closed once a configuration was loaded and the backend reached.
+func (hc *HealthChecker) Ready() <-chan struct{} {
+	return hc.ready
+}
+
+// IsReady tells whether the service is ready and healthy, which /ready reports. Unlike the
+// health, the readiness waits for the first configuration and backend probe.
+func (hc *HealthChecker) IsReady() bool {
+	select {
+	case <-hc.ready:
+		return atomic.LoadUint32(&hc.ok) == 1
+	default:
+		return false
+	}
+}
+
+// ServeReady serves the /ready endpoint.
+func (hc *HealthChecker) ServeReady(w http.ResponseWriter, r *http.Request) {
+	if hc.IsReady() {
+		w.Write([]byte("READY"))
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
 func (hc *HealthChecker) Server() *health.Server {
 	return hc.grpc
 }
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+)
+
+// IpFilter admits the connections by the IP address of the client: a denied address is never
+// admitted, and when there is an allowlist only the allowed addresses are admitted.
+type IpFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// NewIpFilter parses the CIDRs of the allowlist and denylist, a bare IP address being its own
+// /32 or /128 network.
+func NewIpFilter(allowed []string, denied []string) (*IpFilter, error) {
+	ret := &IpFilter{}
+	var err error
+	if ret.allowed, err = parseCidrs(allowed); err != nil {
+		return nil, err
+	}
+	if ret.denied, err = parseCidrs(denied); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s'", cidr)
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+// IsEmpty tells whether the filter admits all the connections.
+func (this *IpFilter) IsEmpty() bool {
+	return len(this.allowed) == 0 && len(this.denied) == 0
+}
+
+// Admits tells whether the connections of addr are admitted. The addresses without an IP, e.g.
+// of the unix domain sockets, are admitted.
+func (this *IpFilter) Admits(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	for _, network := range this.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(this.allowed) == 0 {
+		return true
+	}
+	for _, network := range this.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredListener closes the connections which its filter does not admit as soon as they are
+// accepted.
+type filteredListener struct {
+	net.Listener
+	filter *IpFilter
+	denied gostats.Counter
+}
+
+// NewFilteredListener admits the connections of listener with filter, counting the other ones in
+// denied.
+func NewFilteredListener(listener net.Listener, filter *IpFilter, denied gostats.Counter) net.Listener {
+	return &filteredListener{Listener: listener, filter: filter, denied: denied}
+}
+
+func (this *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if this.filter.Admits(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		this.denied.Inc()
+		logger.Debugf("Denying the connection of %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// JwtVerifier verifies the signature, issuer, audience and lifetime of the JWTs signed with the
+// RS256, RS384, RS512, ES256 or ES384 keys of a JWKS, which is re-fetched every refreshInterval
+// and when a token is signed by an unknown key.
+type JwtVerifier struct {
+	issuer          string
+	audience        string
+	callerClaim     string
+	jwksUri         string
+	refreshInterval time.Duration
+	timeSource      utils.TimeSource
+	httpClient      *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]jwtKey
+	fetchedAt time.Time
+	// fetching is closed when the fetch in progress, if any, is done
+	fetching chan struct{}
+}
+
+// minJwksFetchInterval bounds the fetches of the JWKS for the tokens signed by unknown keys.
+const minJwksFetchInterval = time.Second
+
+// jwtKey is a key of the JWKS and the algorithm it is restricted to, any if empty.
+type jwtKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// NewJwtVerifier creates a verifier of the tokens of issuer for audience, either of which is not
+// checked when empty, with the keys of the JWKS at jwksUri, an http(s) URL or a file path. The
+// caller of a token is its callerClaim claim.
+func NewJwtVerifier(issuer string, audience string, callerClaim string, jwksUri string, refreshInterval time.Duration,
+	timeSource utils.TimeSource,
+) *JwtVerifier {
+	return &JwtVerifier{
+		issuer:          issuer,
+		audience:        audience,
+		callerClaim:     callerClaim,
+		jwksUri:         jwksUri,
+		refreshInterval: refreshInterval,
+		timeSource:      timeSource,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Verify returns the caller of a valid token.
+func (this *JwtVerifier) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid token signature: %w", err)
+	}
+	key, err := this.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid token claims: %w", err)
+	}
+	if err := this.verifyClaims(claims); err != nil {
+		return "", err
+	}
+	caller, _ := claims[this.callerClaim].(string)
+	if caller == "" {
+		return "", fmt.Errorf("the token has no %s claim", this.callerClaim)
+	}
+	return caller, nil
+}
+
+func (this *JwtVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := float64(this.timeSource.UnixNow())
+	if exp, ok := claims["exp"].(float64); !ok || now >= exp {
+		return errors.New("the token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return errors.New("the token is not valid yet")
+	}
+	if this.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != this.issuer {
+			return fmt.Errorf("unexpected token issuer '%s'", iss)
+		}
+	}
+	if this.audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == this.audience {
+				return nil
+			}
+		case []interface{}:
+			for _, value := range aud {
+				if value == this.audience {
+					return nil
+				}
+			}
+		}
+		return errors.New("the token is not for this audience")
+	}
+	return nil
+}
+
+// key returns the key kid of the JWKS, which is fetched when it expired or does not have the key,
+// at most once per minJwksFetchInterval for the unknown keys. The callers needing a fetch while one
+// is in progress wait for it rather than fetching the JWKS again.
+func (this *JwtVerifier) key(kid string) (jwtKey, error) {
+	this.mu.Lock()
+	now := time.Unix(this.timeSource.UnixNow(), 0)
+	key, found := this.keys[kid]
+	sinceFetch := now.Sub(this.fetchedAt)
+	if sinceFetch >= this.refreshInterval || (!found && sinceFetch >= minJwksFetchInterval) {
+		fetching := this.fetching
+		if fetching == nil {
+			fetching = make(chan struct{})
+			this.fetching = fetching
+			go this.fetch(now, fetching)
+		}
+		this.mu.Unlock()
+		<-fetching
+		this.mu.Lock()
+		key, found = this.keys[kid]
+	}
+	this.mu.Unlock()
+
+	if !found {
+		return jwtKey{}, fmt.Errorf("unknown token key '%s'", kid)
+	}
+	return key, nil
+}
+
+// fetch fetches the JWKS without holding the lock, and closes done once the keys are replaced.
+func (this *JwtVerifier) fetch(now time.Time, done chan struct{}) {
+	keys, err := this.fetchKeys()
+	if err != nil {
+		logger.Errorf("Failed to fetch the JWKS from '%s': %v", this.jwksUri, err)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err == nil {
+		this.keys = keys
+	}
+	// a failed fetch is not retried before the next interval, the previous keys being kept
+	this.fetchedAt = now
+	this.fetching = nil
+	close(done)
+}
+
+func (this *JwtVerifier) fetchKeys() (map[string]jwtKey, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(this.jwksUri, "http://") || strings.HasPrefix(this.jwksUri, "https://") {
+		var resp *http.Response
+		resp, err = this.httpClient.Get(this.jwksUri)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		body, err = io.ReadAll(resp.Body)
+	} else {
+		body, err = os.ReadFile(this.jwksUri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJwks(body)
+}
+
+func parseJwks(body []byte) (map[string]jwtKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]jwtKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Warnf("Ignoring the JWKS key '%s': %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = jwtKey{key: key, alg: k.Alg}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
+
+func verifyJwtSignature(alg string, jwtKey jwtKey, signed string, signature []byte) error {
+	if jwtKey.alg != "" && jwtKey.alg != alg {
+		return fmt.Errorf("the algorithm '%s' does not match the '%s' key", alg, jwtKey.alg)
+	}
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm '%s'", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := jwtKey.key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("the algorithm '%s' does not match the RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES"+strconv.Itoa(key.Curve.Params().BitSize) {
+			return fmt.Errorf("the algorithm '%s' does not match the %s key", alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported token key")
+	}
+	return nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
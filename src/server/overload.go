@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type overloadStats struct {
+	inFlight gostats.Gauge
+	queued   gostats.Counter
+	shed     gostats.Counter
+}
+
+func newOverloadStats(scope gostats.Scope) overloadStats {
+	ret := overloadStats{}
+	ret.inFlight = scope.NewGauge("in_flight")
+	ret.queued = scope.NewCounter("queued")
+	ret.shed = scope.NewCounter("shed")
+	return ret
+}
+
+// OverloadManager bounds the number of ShouldRateLimit calls in flight. A call beyond the bound
+// waits up to maxQueueWait for a slot, then it is shed: answered OK if shedWithOk, or failed
+// with UNAVAILABLE.
+type OverloadManager struct {
+	slots        chan struct{}
+	maxQueueWait time.Duration
+	shedWithOk   bool
+	stats        overloadStats
+}
+
+func NewOverloadManager(scope gostats.Scope, maxInFlight int, maxQueueWait time.Duration, shedWithOk bool) *OverloadManager {
+	return &OverloadManager{
+		slots:        make(chan struct{}, maxInFlight),
+		maxQueueWait: maxQueueWait,
+		shedWithOk:   shedWithOk,
+		stats:        newOverloadStats(scope),
+	}
+}
+
+func (this *OverloadManager) acquire(ctx context.Context) bool {
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if this.maxQueueWait <= 0 {
+		return false
+	}
+
+	this.stats.queued.Inc()
+	timer := time.NewTimer(this.maxQueueWait)
+	defer timer.Stop()
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (this *OverloadManager) release() {
+	<-this.slots
+	this.stats.inFlight.Set(uint64(len(this.slots)))
+}
+
+// UnaryServerInterceptor applies the bound to the ShouldRateLimit calls, the other calls are
+// passed through.
+func (this *OverloadManager) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := req.(*pb.RateLimitRequest); !ok {
+			return handler(ctx, req)
+		}
+		if !this.acquire(ctx) {
+			this.stats.shed.Inc()
+			if this.shedWithOk {
+				return &pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_OK}, nil
+			}
+			return nil, status.Error(codes.Unavailable, "ratelimit service overloaded")
+		}
+		this.stats.inFlight.Set(uint64(len(this.slots)))
+		defer this.release()
+		return handler(ctx, req)
+	}
+}
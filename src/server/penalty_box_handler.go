@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+type penaltyBoxResponse struct {
+	Domain      string                  `json:"domain"`
+	Descriptors []*penaltyBoxDescriptor `json:"descriptors"`
+}
+
+type penaltyBoxDescriptor struct {
+	// Rule is the matched rule, nil if no rule matched the descriptor.
+	Rule *config.RateLimitDump `json:"rule,omitempty"`
+	// Key is the key of the ban, empty if the rule has no penalty.
+	Key    string `json:"key,omitempty"`
+	Banned bool   `json:"banned"`
+	// RemainingSeconds is the remaining duration of the ban, or of the cleared ban for a DELETE.
+	RemainingSeconds float64 `json:"remaining_seconds,omitempty"`
+}
+
+// NewPenaltyBoxHandler returns a handler which resolves the descriptors of a ShouldRateLimit
+// request, in the JSON form of the /json endpoint, and returns whether they are in the penalty box
+// of their rule with a POST, or releases them from it with a DELETE.
+func NewPenaltyBoxHandler(configGetter ConfigGetter, penaltyBox limiter.PenaltyBox) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+		if !ok {
+			return
+		}
+
+		ctx := context.Background()
+		// the lookups don't count in the stats of the limits nor create them
+		lookupCtx := config.WithReadOnlyLookup(ctx)
+		limits := make([]*config.RateLimit, len(req.Descriptors))
+		for i, descriptor := range req.Descriptors {
+			limits[i] = current.GetLimit(lookupCtx, req.Domain, descriptor)
+		}
+
+		penalties, err := accessPenalties(ctx, penaltyBox, req, limits, request.Method == http.MethodDelete)
+		if err != nil {
+			logger.Warnf("error accessing the penalty box: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &penaltyBoxResponse{Domain: req.Domain, Descriptors: make([]*penaltyBoxDescriptor, len(req.Descriptors))}
+		for i, limit := range limits {
+			state := &penaltyBoxDescriptor{
+				Key:              penalties[i].Key,
+				Banned:           penalties[i].Remaining > 0,
+				RemainingSeconds: penalties[i].Remaining.Seconds(),
+			}
+			if limit != nil {
+				state.Rule = config.NewRateLimitDump(limit)
+			}
+			resp.Descriptors[i] = state
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the penalty box response: %v", err)
+		}
+	}
+}
+
+// accessPenalties reads or clears the penalties, turning the panics of the cache into an error.
+func accessPenalties(ctx context.Context, penaltyBox limiter.PenaltyBox, request *pb.RateLimitRequest,
+	limits []*config.RateLimit, clear bool,
+) (penalties []limiter.PenaltyValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	if clear {
+		return penaltyBox.ClearPenalties(ctx, request, limits), nil
+	}
+	return penaltyBox.GetPenalties(ctx, request, limits), nil
+}
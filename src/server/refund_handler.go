@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+type refundResponse struct {
+	Domain      string              `json:"domain"`
+	Descriptors []*refundDescriptor `json:"descriptors"`
+}
+
+type refundDescriptor struct {
+	// Rule is the matched rule, nil if no rule matched the descriptor.
+	Rule *config.RateLimitDump `json:"rule,omitempty"`
+	// Key is the key of the refunded counter, empty if the descriptor has no counter to refund.
+	Key   string `json:"key,omitempty"`
+	Value uint64 `json:"value"`
+	// Refunded is the number of hits removed from the counter, less than the hits addend of the
+	// request if the counter was clamped at zero.
+	Refunded uint64 `json:"refunded"`
+}
+
+// NewRefundHandler returns a handler which resolves the descriptors of a ShouldRateLimit request, in
+// the JSON form of the /json endpoint, and gives back the hits of the request to their counters with
+// a POST, for the requests rolled back after they were counted. The counted_at query parameter is the
+// Unix time the request was counted at, so that the hits are given back to the windows which counted
+// them rather than to the current ones.
+func NewRefundHandler(configGetter ConfigGetter, refunder limiter.Refunder) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		countedAt, err := strconv.ParseInt(request.URL.Query().Get("counted_at"), 10, 64)
+		if err != nil || countedAt <= 0 {
+			http.Error(writer, "counted_at, the Unix time the request was counted at, is required", http.StatusBadRequest)
+			return
+		}
+
+		req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+		if !ok {
+			return
+		}
+
+		ctx := context.Background()
+		limits := make([]*config.RateLimit, len(req.Descriptors))
+		for i, descriptor := range req.Descriptors {
+			limits[i] = current.GetLimit(ctx, req.Domain, descriptor)
+		}
+
+		refunds, err := refundHits(ctx, refunder, req, limits, countedAt)
+		if err != nil {
+			logger.Warnf("error refunding the hits: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &refundResponse{
+			Domain:      req.Domain,
+			Descriptors: make([]*refundDescriptor, len(req.Descriptors)),
+		}
+		for i, limit := range limits {
+			state := &refundDescriptor{
+				Key:      refunds[i].Key,
+				Value:    refunds[i].Value,
+				Refunded: refunds[i].Refunded,
+			}
+			if limit != nil {
+				state.Rule = config.NewRateLimitDump(limit)
+			}
+			resp.Descriptors[i] = state
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the refund response: %v", err)
+		}
+	}
+}
+
+// refundHits refunds the hits, turning the panics of the cache into an error.
+func refundHits(ctx context.Context, refunder limiter.Refunder, request *pb.RateLimitRequest,
+	limits []*config.RateLimit, countedAt int64,
+) (refunds []limiter.RefundValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	return refunder.RefundHits(ctx, request, limits, countedAt), nil
+}
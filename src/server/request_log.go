@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// RequestLogSampler logs up to perSecond ShouldRateLimit calls per second at INFO level, with
+// their descriptors and decisions, whatever the log level of the other messages.
+type RequestLogSampler struct {
+	mu          sync.Mutex
+	perSecond   int
+	windowStart time.Time
+	logged      int
+	now         func() time.Time
+	log         *logger.Logger
+}
+
+func NewRequestLogSampler(perSecond int, log *logger.Logger) *RequestLogSampler {
+	return &RequestLogSampler{
+		perSecond: perSecond,
+		now:       time.Now,
+		log:       log,
+	}
+}
+
+func (this *RequestLogSampler) sample() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+	if now.Sub(this.windowStart) >= time.Second {
+		this.windowStart = now
+		this.logged = 0
+	}
+	if this.logged >= this.perSecond {
+		return false
+	}
+	this.logged++
+	return true
+}
+
+func descriptorStrings(request *pb.RateLimitRequest) []string {
+	ret := make([]string, len(request.Descriptors))
+	for i, descriptor := range request.Descriptors {
+		entries := make([]string, len(descriptor.Entries))
+		for j, entry := range descriptor.Entries {
+			entries[j] = entry.Key + "=" + entry.Value
+		}
+		ret[i] = strings.Join(entries, ",")
+	}
+	return ret
+}
+
+func statusStrings(response *pb.RateLimitResponse) []string {
+	ret := make([]string, len(response.Statuses))
+	for i, status := range response.Statuses {
+		ret[i] = status.Code.String()
+	}
+	return ret
+}
+
+// UnaryServerInterceptor logs the sampled ShouldRateLimit calls, the other calls are passed
+// through.
+func (this *RequestLogSampler) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		request, ok := req.(*pb.RateLimitRequest)
+		if !ok || !this.sample() {
+			return handler(ctx, req)
+		}
+
+		start := this.now()
+		resp, err := handler(ctx, req)
+		fields := logger.Fields{
+			"domain":      request.Domain,
+			"descriptors": descriptorStrings(request),
+			"duration":    this.now().Sub(start).String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else if response, ok := resp.(*pb.RateLimitResponse); ok {
+			fields["overall_code"] = response.OverallCode.String()
+			fields["statuses"] = statusStrings(response)
+		}
+		this.log.WithFields(fields).Info("sampled ShouldRateLimit request")
+		return resp, err
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+type reservationResponse struct {
+	Domain        string `json:"domain"`
+	ReservationId string `json:"reservation_id"`
+	// Held is false if a descriptor is over its limit when reserving, the hits then being held on
+	// none of the descriptors, or if the hold of a descriptor expired when committing or cancelling.
+	Held        bool                     `json:"held"`
+	Descriptors []*reservationDescriptor `json:"descriptors"`
+}
+
+type reservationDescriptor struct {
+	// Rule is the matched rule, nil if no rule matched the descriptor.
+	Rule *config.RateLimitDump `json:"rule,omitempty"`
+	// Key is the key of the counter, empty if the descriptor has no counter to reserve.
+	Key   string `json:"key,omitempty"`
+	Held  bool   `json:"held"`
+	Value uint64 `json:"value"`
+}
+
+// NewReservationHandler returns a handler which resolves the descriptors of a ShouldRateLimit
+// request, in the JSON form of the /json endpoint, and holds their hits with a POST for the ttl query
+// parameter, defaultTtl if it is not given. The reservation given by the reservation_id query
+// parameter is committed with a PUT and cancelled with a DELETE of the same request. A reservation
+// which couldn't be held is answered with a 429, the commit of an expired reservation with a 410.
+func NewReservationHandler(configGetter ConfigGetter, reserver limiter.Reserver, defaultTtl time.Duration, maxTtl time.Duration) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ttl := defaultTtl
+		reservationId := request.URL.Query().Get("reservation_id")
+		switch request.Method {
+		case http.MethodPost:
+			if param := request.URL.Query().Get("ttl"); param != "" {
+				var err error
+				ttl, err = time.ParseDuration(param)
+				if err != nil || ttl <= 0 || ttl > maxTtl {
+					http.Error(writer, fmt.Sprintf("the ttl should be a positive duration up to %s", maxTtl), http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodPut, http.MethodDelete:
+			if _, err := limiter.ReservationTime(reservationId); err != nil {
+				http.Error(writer, "a valid reservation_id is required", http.StatusBadRequest)
+				return
+			}
+		default:
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+		if !ok {
+			return
+		}
+
+		ctx := context.Background()
+		limits := make([]*config.RateLimit, len(req.Descriptors))
+		for i, descriptor := range req.Descriptors {
+			limits[i] = current.GetLimit(ctx, req.Domain, descriptor)
+		}
+
+		reservationId, holds, err := accessReservation(ctx, reserver, req, limits, request.Method, reservationId, ttl)
+		if err != nil {
+			logger.Warnf("error accessing the reservation: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &reservationResponse{
+			Domain:        req.Domain,
+			ReservationId: reservationId,
+			Held:          true,
+			Descriptors:   make([]*reservationDescriptor, len(req.Descriptors)),
+		}
+		for i, limit := range limits {
+			state := &reservationDescriptor{
+				Key:   holds[i].Key,
+				Held:  holds[i].Held,
+				Value: holds[i].Value,
+			}
+			if limit != nil {
+				state.Rule = config.NewRateLimitDump(limit)
+			}
+			if state.Key != "" && !state.Held {
+				resp.Held = false
+			}
+			resp.Descriptors[i] = state
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		switch {
+		case request.Method == http.MethodPost && !resp.Held:
+			writer.WriteHeader(http.StatusTooManyRequests)
+		case request.Method == http.MethodPut && !resp.Held:
+			writer.WriteHeader(http.StatusGone)
+		}
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the reservation response: %v", err)
+		}
+	}
+}
+
+// accessReservation reserves, commits or cancels the reservation according to the method, turning
+// the panics of the cache into an error.
+func accessReservation(ctx context.Context, reserver limiter.Reserver, request *pb.RateLimitRequest,
+	limits []*config.RateLimit, method string, reservationId string, ttl time.Duration,
+) (id string, holds []limiter.ReservationValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	switch method {
+	case http.MethodPost:
+		id, holds = reserver.Reserve(ctx, request, limits, ttl)
+		return id, holds, nil
+	case http.MethodPut:
+		return reservationId, reserver.CommitReservation(ctx, request, limits, reservationId), nil
+	default:
+		return reservationId, reserver.CancelReservation(ctx, request, limits, reservationId), nil
+	}
+}
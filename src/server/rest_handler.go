@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeJson     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+type restStats struct {
+	requests     gostats.Counter
+	overLimit    gostats.Counter
+	badRequests  gostats.Counter
+	serviceError gostats.Counter
+}
+
+func newRestStats(scope gostats.Scope) restStats {
+	ret := restStats{}
+	ret.requests = scope.NewCounter("requests")
+	ret.overLimit = scope.NewCounter("over_limit")
+	ret.badRequests = scope.NewCounter("bad_requests")
+	ret.serviceError = scope.NewCounter("service_error")
+	return ret
+}
+
+// NewRestHandler returns the handler of POST /ratelimit/v3/should_rate_limit. It takes a complete
+// RateLimitRequest and returns the complete RateLimitResponse, including the unset fields, in
+// JSON (proto3 JSON mapping) or in the protobuf binary format depending on the Content-Type and
+// Accept headers. The status code is 200 if the request is allowed, 429 if it is over limit.
+func NewRestHandler(svc pb.RateLimitServiceServer, scope gostats.Scope) func(http.ResponseWriter, *http.Request) {
+	stats := newRestStats(scope)
+	return func(writer http.ResponseWriter, request *http.Request) {
+		stats.requests.Inc()
+		if request.Method != http.MethodPost {
+			stats.badRequests.Inc()
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+
+		requestType := contentTypeJson
+		if header := request.Header.Get("Content-Type"); header != "" {
+			mediaType, _, err := mime.ParseMediaType(header)
+			if err != nil || (mediaType != contentTypeJson && !isProtobufMediaType(mediaType)) {
+				stats.badRequests.Inc()
+				writeHttpStatus(writer, http.StatusUnsupportedMediaType)
+				return
+			}
+			requestType = mediaType
+		}
+		responseType, ok := negotiateResponseType(request.Header.Get("Accept"))
+		if !ok {
+			stats.badRequests.Inc()
+			writeHttpStatus(writer, http.StatusNotAcceptable)
+			return
+		}
+
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			stats.badRequests.Inc()
+			writeHttpStatus(writer, http.StatusBadRequest)
+			return
+		}
+		var req pb.RateLimitRequest
+		if isProtobufMediaType(requestType) {
+			err = proto.Unmarshal(body, &req)
+		} else {
+			err = protojson.Unmarshal(body, &req)
+		}
+		if err != nil {
+			logger.Warnf("error: %s", err.Error())
+			stats.badRequests.Inc()
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Domain == "" || len(req.Descriptors) == 0 {
+			stats.badRequests.Inc()
+			http.Error(writer, "the domain and the descriptors are required", http.StatusBadRequest)
+			return
+		}
+
+		// the request is valid, the errors come from the backend or the configuration
+		resp, err := svc.ShouldRateLimit(context.Background(), &req)
+		if err != nil {
+			logger.Warnf("error: %s", err.Error())
+			stats.serviceError.Inc()
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if resp == nil {
+			logger.Error("nil response")
+			stats.serviceError.Inc()
+			writeHttpStatus(writer, http.StatusInternalServerError)
+			return
+		}
+
+		var encoded []byte
+		if responseType == contentTypeProtobuf {
+			encoded, err = proto.Marshal(resp)
+		} else {
+			encoded, err = protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+		}
+		if err != nil {
+			logger.Errorf("error marshaling the response: %s", err.Error())
+			stats.serviceError.Inc()
+			writeHttpStatus(writer, http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", responseType)
+		switch resp.OverallCode {
+		case pb.RateLimitResponse_UNKNOWN:
+			stats.serviceError.Inc()
+			writer.WriteHeader(http.StatusInternalServerError)
+		case pb.RateLimitResponse_OVER_LIMIT:
+			stats.overLimit.Inc()
+			writer.WriteHeader(http.StatusTooManyRequests)
+		}
+		writer.Write(encoded)
+	}
+}
+
+func isProtobufMediaType(mediaType string) bool {
+	return mediaType == contentTypeProtobuf || mediaType == "application/protobuf"
+}
+
+// negotiateResponseType returns the first media type of the Accept header which can be
+// produced, JSON if the header is empty.
+func negotiateResponseType(accept string) (string, bool) {
+	if accept == "" {
+		return contentTypeJson, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == contentTypeJson || mediaType == "application/*" || mediaType == "*/*":
+			return contentTypeJson, true
+		case isProtobufMediaType(mediaType):
+			return contentTypeProtobuf, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+
+	pb_v2 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	"google.golang.org/protobuf/proto"
+)
+
+type rateLimitServiceV2 struct {
+	svc      pb.RateLimitServiceServer
+	requests gostats.Counter
+}
+
+// NewRateLimitServiceV2 adapts the rate limit service to the legacy v2 API. The v3 messages kept
+// the field numbers of the v2 ones, so the requests and responses are transcoded through their
+// wire format, the v3 only fields of the responses being dropped. The v2 requests are counted so
+// that the end of a migration can be told.
+func NewRateLimitServiceV2(svc pb.RateLimitServiceServer, scope gostats.Scope) pb_v2.RateLimitServiceServer {
+	return &rateLimitServiceV2{svc: svc, requests: scope.NewCounter("requests")}
+}
+
+func (this *rateLimitServiceV2) ShouldRateLimit(ctx context.Context, request *pb_v2.RateLimitRequest) (*pb_v2.RateLimitResponse, error) {
+	this.requests.Inc()
+	v3Request := &pb.RateLimitRequest{}
+	if err := transcode(request, v3Request); err != nil {
+		return nil, err
+	}
+
+	v3Response, err := this.svc.ShouldRateLimit(ctx, v3Request)
+	if err != nil {
+		return nil, err
+	}
+	response := &pb_v2.RateLimitResponse{}
+	if err := transcode(v3Response, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func transcode(from proto.Message, to proto.Message) error {
+	encoded, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return proto.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(encoded, to)
+}
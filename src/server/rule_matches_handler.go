@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+type ruleMatchesDomain struct {
+	Domain string        `json:"domain"`
+	Rules  []ruleMatches `json:"rules"`
+}
+
+type ruleMatches struct {
+	// Rule is the stats key of the rule, e.g. domain.key_value.subkey.
+	Rule    string `json:"rule"`
+	Name    string `json:"name,omitempty"`
+	Matched uint64 `json:"matched"`
+}
+
+// NewRuleMatchesHandler returns a handler listing the rules of the current configuration with the
+// descriptors which matched each of them since the start, of the domain query parameter only if set.
+// With unmatched=true, only the rules which matched no descriptor are listed.
+func NewRuleMatchesHandler(configGetter ConfigGetter, statsManager stats.Manager) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		query := request.URL.Query()
+		onlyUnmatched := query.Get("unmatched") == "true"
+
+		resp := []ruleMatchesDomain{}
+		current, _ := configGetter.GetCurrentConfig()
+		if current != nil {
+			for _, domain := range current.DumpTree() {
+				if name := query.Get("domain"); name != "" && name != domain.Domain {
+					continue
+				}
+				rules := []ruleMatches{}
+				for _, rule := range flattenRules(domain.Descriptors, nil) {
+					matched := statsManager.NewStatsWithRollups(domain.Domain, rule.StatsKey).Matched.Value()
+					if !onlyUnmatched || matched == 0 {
+						rules = append(rules, ruleMatches{Rule: rule.StatsKey, Name: rule.Name, Matched: matched})
+					}
+				}
+				resp = append(resp, ruleMatchesDomain{Domain: domain.Domain, Rules: rules})
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the rule matches: %v", err)
+		}
+	}
+}
+
+// flattenRules appends the limits of a descriptor tree to rules, depth first.
+func flattenRules(descriptors []*config.DescriptorDump, rules []*config.RateLimitDump) []*config.RateLimitDump {
+	for _, descriptor := range descriptors {
+		if descriptor.RateLimit != nil {
+			rules = append(rules, descriptor.RateLimit)
+		}
+		rules = flattenRules(descriptor.Descriptors, rules)
+	}
+	return rules
+}
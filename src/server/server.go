@@ -2,9 +2,12 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 
+	"github.com/envoyproxy/ratelimit/src/flags"
+	"github.com/envoyproxy/ratelimit/src/limiter"
 	"github.com/envoyproxy/ratelimit/src/provider"
 
 	stats "github.com/lyft/gostats"
@@ -19,6 +22,17 @@ type Server interface {
 	 */
 	Start()
 
+	/**
+	 * Opens the HTTP, gRPC and debug listeners without serving them, the
+	 * error tells why a listener could not be opened.
+	 */
+	Listen() error
+
+	/**
+	 * Serves the listeners opened by 'Listen', blocks until 'Stop'.
+	 */
+	Serve()
+
 	/**
 	 * Returns the root of the stats tree for the server
 	 */
@@ -30,6 +44,28 @@ type Server interface {
 	AddDebugHttpEndpoint(path string, help string, handler http.HandlerFunc)
 	AddJsonHandler(pb.RateLimitServiceServer)
 
+	/**
+	 * Add the endpoint acquiring and releasing the leases of the concurrency limits.
+	 */
+	AddConcurrencyHandler(configGetter ConfigGetter, concurrencyLimiter limiter.ConcurrencyLimiter)
+
+	/**
+	 * Add the endpoint refunding the hits of the requests rolled back.
+	 */
+	AddRefundHandler(configGetter ConfigGetter, refunder limiter.Refunder)
+
+	/**
+	 * Add the endpoint reserving hits and committing or cancelling the reservations.
+	 */
+	AddReservationHandler(configGetter ConfigGetter, reserver limiter.Reserver, defaultTtl time.Duration, maxTtl time.Duration)
+
+	/**
+	 * Add the read-only endpoint reporting the usage of the limits if counterReader is not nil, and
+	 * listing the counters if counterScanner is not nil.
+	 */
+	AddUsageHandler(configGetter ConfigGetter, counterReader limiter.CounterReader, counterScanner limiter.CounterScanner,
+		maxCounters int, maxScans int)
+
 	/**
 	 * Returns the embedded gRPC server to be used for registering gRPC endpoints.
 	 */
@@ -40,6 +76,11 @@ type Server interface {
 	 */
 	HealthChecker() *HealthChecker
 
+	/**
+	 * Returns the feature flags gating the risky features.
+	 */
+	Flags() flags.Flags
+
 	/**
 	 * Returns the configuration provider for the server.
 	 */
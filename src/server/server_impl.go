@@ -2,7 +2,8 @@ package server
 
 import (
 	"context"
-	"expvar"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -10,15 +11,19 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/protobuf/encoding/protojson"
 
+	"github.com/envoyproxy/ratelimit/src/flags"
 	"github.com/envoyproxy/ratelimit/src/provider"
 	"github.com/envoyproxy/ratelimit/src/stats"
 
@@ -34,6 +39,7 @@ import (
 
 	"github.com/envoyproxy/ratelimit/src/limiter"
 	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/utils"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
@@ -49,28 +55,39 @@ type serverDebugListener struct {
 	listener  net.Listener
 }
 
-type grpcListenType int
+type listenType int
 
 const (
-	tcp              grpcListenType = 0
-	unixDomainSocket grpcListenType = 1
+	tcp              listenType = 0
+	unixDomainSocket listenType = 1
 )
 
 type server struct {
 	httpAddress      string
 	grpcAddress      string
-	grpcListenType   grpcListenType
+	grpcListenType   listenType
 	debugAddress     string
+	debugListenType  listenType
+	udsFileMode      string
+	grpcIpFilter     *IpFilter
+	debugIpFilter    *IpFilter
 	router           *mux.Router
 	grpcServer       *grpc.Server
 	store            gostats.Store
 	scope            gostats.Scope
 	provider         provider.RateLimitConfigProvider
+	flags            flags.Flags
 	debugListener    serverDebugListener
 	httpServer       *http.Server
+	grpcListener     net.Listener
+	httpListener     net.Listener
 	listenerMu       sync.Mutex
 	health           *HealthChecker
 	grpcCertProvider *provider.CertProvider
+	reloadOnSighup   bool
+
+	// grpcSdsCertProvider replaces grpcCertProvider with GRPC_SERVER_TLS_SDS_SECRET_NAME
+	grpcSdsCertProvider *provider.SdsCertProvider
 }
 
 func (server *server) AddDebugHttpEndpoint(path string, help string, handler http.HandlerFunc) {
@@ -146,20 +163,77 @@ func writeHttpStatus(writer http.ResponseWriter, code int) {
 	http.Error(writer, http.StatusText(code), code)
 }
 
-func getProviderImpl(s settings.Settings, statsManager stats.Manager, rootStore gostats.Store) provider.RateLimitConfigProvider {
+// NewProvider creates the configuration provider selected by CONFIG_TYPE.
+func NewProvider(s settings.Settings, statsManager stats.Manager, rootStore gostats.Store) (provider.RateLimitConfigProvider, error) {
 	switch s.ConfigType {
 	case "FILE":
-		return provider.NewFileProvider(s, statsManager, rootStore)
+		return provider.NewFileProvider(s, statsManager, rootStore), nil
 	case "GRPC_XDS_SOTW":
-		return provider.NewXdsGrpcSotwProvider(s, statsManager)
+		return provider.NewXdsGrpcSotwProvider(s, statsManager), nil
+	case "GRPC_XDS_DELTA":
+		return provider.NewXdsGrpcDeltaProvider(s, statsManager), nil
+	case "KUBERNETES":
+		return provider.NewKubernetesProvider(s, statsManager), nil
+	case "CONSUL":
+		return provider.NewConsulProvider(s, statsManager), nil
+	case "OBJECT_STORE":
+		return provider.NewObjectStoreProvider(s, statsManager), nil
+	case "FILE_AND_GRPC_XDS_SOTW":
+		xdsPrecedence, err := getXdsMergePrecedence(s)
+		if err != nil {
+			return nil, err
+		}
+		return provider.NewMergedProvider(
+			provider.NewFileProvider(s, statsManager, rootStore),
+			provider.NewXdsGrpcSotwProvider(s, statsManager),
+			xdsPrecedence), nil
+	case "FILE_AND_GRPC_XDS_DELTA":
+		xdsPrecedence, err := getXdsMergePrecedence(s)
+		if err != nil {
+			return nil, err
+		}
+		return provider.NewMergedProvider(
+			provider.NewFileProvider(s, statsManager, rootStore),
+			provider.NewXdsGrpcDeltaProvider(s, statsManager),
+			xdsPrecedence), nil
+	default:
+		return nil, fmt.Errorf("invalid setting for ConfigType: %s", s.ConfigType)
+	}
+}
+
+func getXdsMergePrecedence(s settings.Settings) (bool, error) {
+	switch s.ConfigMergePrecedence {
+	case "XDS":
+		return true, nil
+	case "FILE":
+		return false, nil
 	default:
-		logger.Fatalf("Invalid setting for ConfigType: %s", s.ConfigType)
-		panic("This line should not be reachable")
+		return false, fmt.Errorf("invalid setting for ConfigMergePrecedence: %s", s.ConfigMergePrecedence)
 	}
 }
 
 func (server *server) AddJsonHandler(svc pb.RateLimitServiceServer) {
 	server.router.HandleFunc("/json", NewJsonHandler(svc))
+	server.router.HandleFunc("/ratelimit/v3/should_rate_limit", NewRestHandler(svc, server.scope.Scope("http").Scope("should_rate_limit")))
+}
+
+func (server *server) AddConcurrencyHandler(configGetter ConfigGetter, concurrencyLimiter limiter.ConcurrencyLimiter) {
+	server.router.HandleFunc("/ratelimit/v3/concurrency", NewConcurrencyHandler(configGetter, concurrencyLimiter))
+}
+
+func (server *server) AddRefundHandler(configGetter ConfigGetter, refunder limiter.Refunder) {
+	server.router.HandleFunc("/ratelimit/v3/refund", NewRefundHandler(configGetter, refunder))
+}
+
+func (server *server) AddReservationHandler(configGetter ConfigGetter, reserver limiter.Reserver, defaultTtl time.Duration, maxTtl time.Duration) {
+	server.router.HandleFunc("/ratelimit/v3/reservations", NewReservationHandler(configGetter, reserver, defaultTtl, maxTtl))
+}
+
+func (server *server) AddUsageHandler(configGetter ConfigGetter, counterReader limiter.CounterReader,
+	counterScanner limiter.CounterScanner, maxCounters int, maxScans int,
+) {
+	server.router.HandleFunc("/ratelimit/v3/usage", NewUsageHandler(configGetter, counterReader, counterScanner, maxCounters,
+		maxScans, utils.NewTimeSourceImpl()))
 }
 
 func (server *server) GrpcServer() *grpc.Server {
@@ -167,59 +241,113 @@ func (server *server) GrpcServer() *grpc.Server {
 }
 
 func (server *server) Start() {
-	go func() {
-		logger.Warnf("Listening for debug on '%s'", server.debugAddress)
-		var err error
-		server.listenerMu.Lock()
-		server.debugListener.listener, err = reuseport.Listen("tcp", server.debugAddress)
-		server.listenerMu.Unlock()
+	if err := server.Listen(); err != nil {
+		logger.Fatal(err)
+	}
 
-		if err != nil {
-			logger.Errorf("Failed to open debug HTTP listener: '%+v'", err)
-			return
-		}
-		err = http.Serve(server.debugListener.listener, server.debugListener.debugMux)
-		logger.Infof("Failed to start debug server '%+v'", err)
-	}()
+	server.handleGracefulShutdown()
 
-	go server.startGrpc()
+	server.Serve()
+}
 
-	server.handleGracefulShutdown()
+func (server *server) Listen() error {
+	logger.Warnf("Listening for debug on '%s'", server.debugAddress)
+	debugListener, err := server.listen(server.debugListenType, server.debugAddress, server.debugIpFilter, "debug")
+	if err != nil {
+		// the debug port is best effort, the service runs without it
+		logger.Errorf("Failed to open debug HTTP listener: '%+v'", err)
+		debugListener = nil
+	}
 
-	logger.Warnf("Listening for HTTP on '%s'", server.httpAddress)
-	list, err := reuseport.Listen("tcp", server.httpAddress)
+	logger.Warnf("Listening for gRPC on '%s'", server.grpcAddress)
+	grpcListener, err := server.listen(server.grpcListenType, server.grpcAddress, server.grpcIpFilter, "grpc")
 	if err != nil {
-		logger.Fatalf("Failed to open HTTP listener: '%+v'", err)
+		closeListener(debugListener)
+		return fmt.Errorf("failed to listen for gRPC on '%s': %w", server.grpcAddress, err)
 	}
-	srv := &http.Server{Handler: server.router}
-	server.listenerMu.Lock()
-	server.httpServer = srv
-	server.listenerMu.Unlock()
-	err = srv.Serve(list)
 
-	if err != http.ErrServerClosed {
-		logger.Fatal(err)
+	logger.Warnf("Listening for HTTP on '%s'", server.httpAddress)
+	httpListener, err := reuseport.Listen("tcp", server.httpAddress)
+	if err != nil {
+		closeListener(debugListener)
+		closeListener(grpcListener)
+		return fmt.Errorf("failed to listen for HTTP on '%s': %w", server.httpAddress, err)
 	}
+
+	server.listenerMu.Lock()
+	defer server.listenerMu.Unlock()
+	server.debugListener.listener = debugListener
+	server.grpcListener = grpcListener
+	server.httpListener = httpListener
+	server.httpServer = &http.Server{Handler: server.router}
+	return nil
 }
 
-func (server *server) startGrpc() {
-	logger.Warnf("Listening for gRPC on '%s'", server.grpcAddress)
-	var lis net.Listener
+// listen opens a listener admitting the connections with filter, whose denied connections are
+// counted in the listener.<name>.denied stat.
+func (server *server) listen(listenType listenType, address string, filter *IpFilter, name string) (net.Listener, error) {
+	var listener net.Listener
 	var err error
-
-	switch server.grpcListenType {
+	switch listenType {
 	case tcp:
-		lis, err = reuseport.Listen("tcp", server.grpcAddress)
+		listener, err = reuseport.Listen("tcp", address)
 	case unixDomainSocket:
-		lis, err = net.Listen("unix", server.grpcAddress)
+		listener, err = listenUnix(address, server.udsFileMode)
+	default:
+		err = fmt.Errorf("invalid listen type %v", listenType)
+	}
+	if err != nil || filter.IsEmpty() {
+		return listener, err
+	}
+	return NewFilteredListener(listener, filter, server.scope.Scope("listener").Scope(name).NewCounter("denied")), nil
+}
+
+// listenAddress selects the socket of a listener from its settings, a unix domain socket path
+// without a socket type being a unix domain socket as well.
+func listenAddress(name string, socketType string, uds string, host string, port int) (listenType, string) {
+	switch socketType {
+	case "tcp", "":
+		if uds != "" {
+			return unixDomainSocket, uds
+		}
+		return tcp, net.JoinHostPort(host, strconv.Itoa(port))
+	case "unix":
+		if uds == "" {
+			panic(fmt.Sprintf("%s_SOCKET_TYPE unix requires the socket path in %s_UDS", name, name))
+		}
+		return unixDomainSocket, uds
 	default:
-		logger.Fatalf("Invalid gRPC listen type %v", server.grpcListenType)
+		panic(fmt.Sprintf("invalid %s_SOCKET_TYPE %q, expected tcp or unix", name, socketType))
 	}
+}
 
-	if err != nil {
-		logger.Fatalf("Failed to listen for gRPC on '%s': %v", server.grpcAddress, err)
+func closeListener(listener net.Listener) {
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+func (server *server) Serve() {
+	server.listenerMu.Lock()
+	debugListener := server.debugListener.listener
+	grpcListener := server.grpcListener
+	httpListener := server.httpListener
+	httpServer := server.httpServer
+	server.listenerMu.Unlock()
+
+	if debugListener != nil {
+		go func() {
+			err := http.Serve(debugListener, server.debugListener.debugMux)
+			logger.Infof("Failed to start debug server '%+v'", err)
+		}()
+	}
+
+	go server.grpcServer.Serve(grpcListener)
+
+	err := httpServer.Serve(httpListener)
+	if err != http.ErrServerClosed {
+		logger.Fatal(err)
 	}
-	server.grpcServer.Serve(lis)
 }
 
 func (server *server) Scope() gostats.Scope {
@@ -230,46 +358,132 @@ func (server *server) Provider() provider.RateLimitConfigProvider {
 	return server.provider
 }
 
-func NewServer(s settings.Settings, name string, statsManager stats.Manager, localCache *freecache.Cache, opts ...settings.Option) Server {
-	return newServer(s, name, statsManager, localCache, opts...)
+func NewServer(s settings.Settings, name string, statsManager stats.Manager, localCache *freecache.Cache, opts ...settings.Option) (Server, error) {
+	return NewServerWithProvider(s, name, statsManager, localCache, NewProvider, opts...)
 }
 
-func newServer(s settings.Settings, name string, statsManager stats.Manager, localCache *freecache.Cache, opts ...settings.Option) *server {
+// ProviderFactory creates the configuration provider of a server, an error for invalid settings.
+type ProviderFactory func(s settings.Settings, statsManager stats.Manager, rootStore gostats.Store) (provider.RateLimitConfigProvider, error)
+
+// NewServerWithProvider is NewServer with the configuration provider created by providerFactory in
+// place of the one selected by CONFIG_TYPE, for the applications embedding the service.
+func NewServerWithProvider(s settings.Settings, name string, statsManager stats.Manager, localCache *freecache.Cache,
+	providerFactory ProviderFactory, opts ...settings.Option,
+) (Server, error) {
+	ret, err := newServer(s, name, statsManager, localCache, providerFactory, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func newServer(s settings.Settings, name string, statsManager stats.Manager, localCache *freecache.Cache,
+	providerFactory ProviderFactory, opts ...settings.Option,
+) (*server, error) {
 	for _, opt := range opts {
 		opt(&s)
 	}
 
 	ret := new(server)
+	// SIGHUP reloads the settings instead of shutting down
+	ret.reloadOnSighup = s.SettingsReloadFile != ""
 
 	// setup stats
 	ret.store = statsManager.GetStatsStore()
 	ret.scope = ret.store.ScopeWithTags(name, s.ExtraTags)
 	ret.store.AddStatGenerator(gostats.NewRuntimeStats(ret.scope.Scope("go")))
 	if localCache != nil {
-		ret.store.AddStatGenerator(limiter.NewLocalCacheStats(localCache, ret.scope.Scope("localcache")))
+		ret.store.AddStatGenerator(limiter.NewLocalCacheStats(localCache, s.LocalCacheSizeInBytes, ret.scope.Scope("localcache")))
 	}
 
 	keepaliveOpt := grpc.KeepaliveParams(keepalive.ServerParameters{
+		MaxConnectionIdle:     s.GrpcMaxConnectionIdle,
 		MaxConnectionAge:      s.GrpcMaxConnectionAge,
 		MaxConnectionAgeGrace: s.GrpcMaxConnectionAgeGrace,
+		Time:                  s.GrpcKeepaliveTime,
+		Timeout:               s.GrpcKeepaliveTimeout,
+	})
+	keepaliveEnforcementOpt := grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             s.GrpcKeepaliveMinTime,
+		PermitWithoutStream: s.GrpcKeepalivePermitWithoutStream,
 	})
+	unaryInterceptors := []grpc.UnaryServerInterceptor{s.GrpcUnaryInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{}
+	var authenticator *Authenticator
+	if len(s.GrpcAuthApiKeys) > 0 || s.GrpcAuthJwksUri != "" {
+		var jwtVerifier *JwtVerifier
+		if s.GrpcAuthJwksUri != "" {
+			jwtVerifier = NewJwtVerifier(s.GrpcAuthJwtIssuer, s.GrpcAuthJwtAudience, s.GrpcAuthJwtCallerClaim,
+				s.GrpcAuthJwksUri, s.GrpcAuthJwksRefreshInterval, utils.NewTimeSourceImpl())
+		}
+		authenticator = NewAuthenticator(ret.scope.Scope("auth"), s.GrpcAuthApiKeys, s.GrpcAuthApiKeyHeader, jwtVerifier)
+		unaryInterceptors = append(unaryInterceptors, authenticator.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, authenticator.StreamServerInterceptor())
+	}
+	if s.CallerRateLimitPerSecond > 0 {
+		// after the authentication, which names the callers
+		callerLimiter := NewCallerLimiter(ret.scope.Scope("caller_limit"), s.CallerRateLimitPerSecond, s.CallerRateLimitBurst)
+		unaryInterceptors = append(unaryInterceptors, callerLimiter.UnaryServerInterceptor())
+	}
+	if s.RequestLogSamplesPerSecond > 0 {
+		// the sampled requests are logged whatever LOG_LEVEL is
+		requestLog := logger.New()
+		requestLog.SetOutput(logger.StandardLogger().Out)
+		requestLog.SetFormatter(logger.StandardLogger().Formatter)
+		requestLog.SetLevel(logger.InfoLevel)
+		sampler := NewRequestLogSampler(s.RequestLogSamplesPerSecond, requestLog)
+		unaryInterceptors = append(unaryInterceptors, sampler.UnaryServerInterceptor())
+	}
+	if s.OverloadMaxInFlight > 0 {
+		var shedWithOk bool
+		switch strings.ToUpper(s.OverloadShedCode) {
+		case "OK":
+			shedWithOk = true
+		case "UNAVAILABLE":
+		default:
+			panic(fmt.Sprintf("invalid OVERLOAD_SHED_CODE %q, expected OK or UNAVAILABLE", s.OverloadShedCode))
+		}
+		overloadManager := NewOverloadManager(ret.scope.Scope("overload"), s.OverloadMaxInFlight, s.OverloadMaxQueueWait, shedWithOk)
+		unaryInterceptors = append(unaryInterceptors, overloadManager.UnaryServerInterceptor())
+	}
+	// chain otel interceptor after the input interceptor
+	unaryInterceptors = append(unaryInterceptors, otelgrpc.UnaryServerInterceptor())
 	grpcOptions := []grpc.ServerOption{
 		keepaliveOpt,
-		grpc.ChainUnaryInterceptor(
-			s.GrpcUnaryInterceptor, // chain otel interceptor after the input interceptor
-			otelgrpc.UnaryServerInterceptor(),
-		),
-		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+		keepaliveEnforcementOpt,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(append(streamInterceptors, otelgrpc.StreamServerInterceptor())...),
+	}
+	if s.GrpcMaxConcurrentStreams > 0 {
+		grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(s.GrpcMaxConcurrentStreams))
 	}
 	if s.GrpcServerUseTLS {
 		grpcServerTlsConfig := s.GrpcServerTlsConfig
-		ret.grpcCertProvider = provider.NewCertProvider(s, ret.store, s.GrpcServerTlsCert, s.GrpcServerTlsKey)
+		var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		if s.GrpcServerTlsSdsSecretName != "" {
+			ret.grpcSdsCertProvider = provider.NewSdsCertProvider(s, ret.store, s.GrpcServerTlsSdsSecretName)
+			getCertificate = ret.grpcSdsCertProvider.GetCertificateFunc()
+		} else {
+			ret.grpcCertProvider = provider.NewCertProvider(s, ret.store, s.GrpcServerTlsCert, s.GrpcServerTlsKey)
+			getCertificate = ret.grpcCertProvider.GetCertificateFunc()
+		}
 		// Remove the static certificates and use the provider via the GetCertificate function
 		grpcServerTlsConfig.Certificates = nil
-		grpcServerTlsConfig.GetCertificate = ret.grpcCertProvider.GetCertificateFunc()
+		grpcServerTlsConfig.GetCertificate = getCertificate
 		// Verify client SAN if provided
+		var verifications []func([][]byte, [][]*x509.Certificate) error
 		if s.GrpcClientTlsSAN != "" {
-			grpcServerTlsConfig.VerifyPeerCertificate = verifyClient(grpcServerTlsConfig.ClientCAs, s.GrpcClientTlsSAN)
+			verifications = append(verifications, verifyClient(grpcServerTlsConfig.ClientCAs, s.GrpcClientTlsSAN))
+		}
+		if len(s.GrpcClientTlsAllowedSans) > 0 {
+			if grpcServerTlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+				panic("GRPC_CLIENT_TLS_ALLOWED_SANS requires the client CA of GRPC_CLIENT_TLS_CACERT")
+			}
+			verifications = append(verifications,
+				VerifyClientSans(s.GrpcClientTlsAllowedSans, ret.scope.Scope("tls").NewCounter("client_rejected")))
+		}
+		if len(verifications) > 0 {
+			grpcServerTlsConfig.VerifyPeerCertificate = chainVerifications(verifications...)
 		}
 		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(grpcServerTlsConfig)))
 	}
@@ -277,61 +491,59 @@ func newServer(s settings.Settings, name string, statsManager stats.Manager, loc
 
 	// setup listen addresses
 	ret.httpAddress = net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
-	if s.GrpcUds != "" {
-		ret.grpcAddress = s.GrpcUds
-		ret.grpcListenType = unixDomainSocket
-	} else {
-		ret.grpcAddress = net.JoinHostPort(s.GrpcHost, strconv.Itoa(s.GrpcPort))
-		ret.grpcListenType = tcp
+	ret.grpcListenType, ret.grpcAddress = listenAddress("GRPC", s.GrpcSocketType, s.GrpcUds, s.GrpcHost, s.GrpcPort)
+	ret.debugListenType, ret.debugAddress = listenAddress("DEBUG", s.DebugSocketType, s.DebugUds, s.DebugHost, s.DebugPort)
+	ret.udsFileMode = s.UdsFileMode
+	var err error
+	if ret.grpcIpFilter, err = NewIpFilter(s.GrpcAllowedCidrs, s.GrpcDeniedCidrs); err != nil {
+		panic(fmt.Sprintf("invalid GRPC_ALLOWED_CIDRS or GRPC_DENIED_CIDRS: %v", err))
+	}
+	if ret.debugIpFilter, err = NewIpFilter(s.DebugAllowedCidrs, s.DebugDeniedCidrs); err != nil {
+		panic(fmt.Sprintf("invalid DEBUG_ALLOWED_CIDRS or DEBUG_DENIED_CIDRS: %v", err))
+	}
+	if ret.udsFileMode != "" {
+		if _, err := parseFileMode(ret.udsFileMode); err != nil {
+			panic(fmt.Sprintf("invalid UDS_FILE_MODE: %v", err))
+		}
 	}
-	ret.debugAddress = net.JoinHostPort(s.DebugHost, strconv.Itoa(s.DebugPort))
 
 	// setup config provider
-	ret.provider = getProviderImpl(s, statsManager, ret.store)
+	if ret.provider, err = providerFactory(s, statsManager, ret.store); err != nil {
+		return nil, err
+	}
+
+	// setup feature flags
+	featureFlags, err := flags.NewFlagsFromSettings(s, ret.store)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FEATURE_FLAGS_DIRECTORY: %w", err)
+	}
+	ret.flags = featureFlags
 
 	// setup http router
 	ret.router = mux.NewRouter()
+	if authenticator != nil {
+		// the endpoints of the main port answer the same callers as the gRPC services
+		ret.router.Use(authenticator.HTTPMiddleware)
+	}
 
-	// setup healthcheck path
+	// setup healthcheck and readiness paths
 	ret.health = NewHealthChecker(health.NewServer(), "ratelimit", s.HealthyWithAtLeastOneConfigLoaded)
 	ret.router.Path("/healthcheck").Handler(ret.health)
+	ret.router.Path("/ready").HandlerFunc(ret.health.ServeReady)
 	healthpb.RegisterHealthServer(ret.grpcServer, ret.health.Server())
 
 	// setup default debug listener
 	ret.debugListener.debugMux = http.NewServeMux()
 	ret.debugListener.endpoints = map[string]string{}
-	ret.AddDebugHttpEndpoint(
-		"/debug/pprof/",
-		"root of various pprof endpoints. hit for help.",
-		func(writer http.ResponseWriter, request *http.Request) {
-			pprof.Index(writer, request)
-		})
-
-	// setup cpu profiling endpoint
-	ret.AddDebugHttpEndpoint(
-		"/debug/pprof/profile",
-		"CPU profiling endpoint",
-		func(writer http.ResponseWriter, request *http.Request) {
-			pprof.Profile(writer, request)
-		})
+	if s.DebugPprofEnabled {
+		ret.addPprofEndpoints(s)
+	}
 
 	// setup stats endpoint
 	ret.AddDebugHttpEndpoint(
 		"/stats",
-		"print out stats",
-		func(writer http.ResponseWriter, request *http.Request) {
-			expvar.Do(func(kv expvar.KeyValue) {
-				io.WriteString(writer, fmt.Sprintf("%s: %s\n", kv.Key, kv.Value))
-			})
-		})
-
-	// setup trace endpoint
-	ret.AddDebugHttpEndpoint(
-		"/debug/pprof/trace",
-		"trace endpoint",
-		func(writer http.ResponseWriter, request *http.Request) {
-			pprof.Trace(writer, request)
-		})
+		"print out the counters, gauges and timers in JSON, those whose name contains ?filter only, or the expvars with ?format=text",
+		newStatsHandler(statsManager))
 
 	// setup debug root
 	ret.debugListener.debugMux.HandleFunc(
@@ -349,7 +561,47 @@ func newServer(s settings.Settings, name string, statsManager stats.Manager, loc
 			}
 		})
 
-	return ret
+	return ret, nil
+}
+
+// addPprofEndpoints serves the pprof profiles on the debug port, sampling the mutex and block events at
+// the rates of the settings.
+func (server *server) addPprofEndpoints(s settings.Settings) {
+	runtime.SetMutexProfileFraction(s.PprofMutexProfileFraction)
+	runtime.SetBlockProfileRate(s.PprofBlockProfileRate)
+
+	server.AddDebugHttpEndpoint(
+		"/debug/pprof/",
+		"root of various pprof endpoints. hit for help.",
+		func(writer http.ResponseWriter, request *http.Request) {
+			pprof.Index(writer, request)
+		})
+
+	// setup cpu profiling endpoint
+	server.AddDebugHttpEndpoint(
+		"/debug/pprof/profile",
+		"CPU profiling endpoint",
+		func(writer http.ResponseWriter, request *http.Request) {
+			pprof.Profile(writer, request)
+		})
+
+	server.AddDebugHttpEndpoint(
+		"/debug/pprof/cmdline",
+		"command line of the process",
+		pprof.Cmdline)
+
+	server.AddDebugHttpEndpoint(
+		"/debug/pprof/symbol",
+		"symbol lookup of program counters",
+		pprof.Symbol)
+
+	// setup trace endpoint
+	server.AddDebugHttpEndpoint(
+		"/debug/pprof/trace",
+		"trace endpoint",
+		func(writer http.ResponseWriter, request *http.Request) {
+			pprof.Trace(writer, request)
+		})
 }
 
 func (server *server) Stop() {
@@ -362,12 +614,21 @@ func (server *server) Stop() {
 	if server.httpServer != nil {
 		server.httpServer.Close()
 	}
+	// the listeners opened by Listen but never served
+	closeListener(server.grpcListener)
+	closeListener(server.httpListener)
 	server.provider.Stop()
+	if server.grpcSdsCertProvider != nil {
+		server.grpcSdsCertProvider.Stop()
+	}
 }
 
 func (server *server) handleGracefulShutdown() {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if !server.reloadOnSighup {
+		signal.Notify(sigs, syscall.SIGHUP)
+	}
 
 	go func() {
 		sig := <-sigs
@@ -381,3 +642,7 @@ func (server *server) handleGracefulShutdown() {
 func (server *server) HealthChecker() *HealthChecker {
 	return server.health
 }
+
+func (server *server) Flags() flags.Flags {
+	return server.flags
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+// newStatsHandler returns the handler of /stats, which writes the snapshot of the stats in JSON if
+// the stats manager keeps them, and the expvars otherwise or with ?format=text.
+func newStatsHandler(statsManager stats.Manager) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		snapshotter, ok := statsManager.(stats.Snapshotter)
+		if !ok || request.URL.Query().Get("format") == "text" {
+			expvar.Do(func(kv expvar.KeyValue) {
+				io.WriteString(writer, fmt.Sprintf("%s: %s\n", kv.Key, kv.Value))
+			})
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(snapshotter.Snapshot(request.URL.Query().Get("filter"))); err != nil {
+			logger.Errorf("failed to write the stats snapshot: %v", err)
+		}
+	}
+}
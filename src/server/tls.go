@@ -3,7 +3,10 @@ package server
 import (
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"strings"
 
+	gostats "github.com/lyft/gostats"
 	logger "github.com/sirupsen/logrus"
 )
 
@@ -32,3 +35,64 @@ func verifyClient(clientCAPool *x509.CertPool, clientSAN string) func(rawCerts [
 		return nil
 	}
 }
+
+// clientSans returns the SANs of cert, the DNS names, URIs e.g. SPIFFE IDs, email and IP addresses.
+func clientSans(cert *x509.Certificate) []string {
+	ret := append([]string{}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		ret = append(ret, uri.String())
+	}
+	ret = append(ret, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+// matchesSan tells whether san is allowed, an allowed SAN ending with '*' allowing its prefix,
+// e.g. "spiffe://cluster.local/ns/prod/*".
+func matchesSan(allowed []string, san string) bool {
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(san, prefix) {
+				return true
+			}
+		} else if san == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyClientSans rejects the client certificates without any of the allowed SANs, counting them
+// in rejected. It runs after the verification of the chain, which is left to the TLS config.
+func VerifyClientSans(allowed []string, rejected gostats.Counter) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			rejected.Inc()
+			return errors.New("missing client cert")
+		}
+		sans := clientSans(verifiedChains[0][0])
+		for _, san := range sans {
+			if matchesSan(allowed, san) {
+				return nil
+			}
+		}
+		rejected.Inc()
+		logger.Warnf("rejecting the client cert with the SANs %v", sans)
+		return fmt.Errorf("client cert SANs %v are not allowed", sans)
+	}
+}
+
+// chainVerifications runs the verifications one after the other, the first error failing the
+// handshake.
+func chainVerifications(verifications ...func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, verify := range verifications {
+			if err := verify(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
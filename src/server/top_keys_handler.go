@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/topkeys"
+)
+
+// defaultTopKeys is the number of descriptors listed without an n parameter.
+const defaultTopKeys = 10
+
+type topKeysDomain struct {
+	Domain string        `json:"domain"`
+	Keys   []topkeys.Key `json:"keys"`
+}
+
+// NewTopKeysHandler returns a handler listing the heaviest descriptors of the domain query
+// parameter, or of every domain without it, with their estimated hits and rate. The n query
+// parameter is the number of descriptors listed per domain.
+func NewTopKeysHandler(tracker *topkeys.Tracker) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		query := request.URL.Query()
+		n := defaultTopKeys
+		if param := query.Get("n"); param != "" {
+			var err error
+			if n, err = strconv.Atoi(param); err != nil || n <= 0 {
+				http.Error(writer, "n should be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		domains := tracker.Domains()
+		if domain := query.Get("domain"); domain != "" {
+			domains = []string{domain}
+		}
+
+		resp := make([]topKeysDomain, len(domains))
+		for i, domain := range domains {
+			resp[i] = topKeysDomain{Domain: domain, Keys: tracker.Top(domain, n)}
+			if resp[i].Keys == nil {
+				resp[i].Keys = []topkeys.Key{}
+			}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the top keys: %v", err)
+		}
+	}
+}
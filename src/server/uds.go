@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// listenUnix listens on the unix domain socket at path, removing the socket left by a previous
+// process which did not shut down, and sets the file mode of the socket when mode is not empty.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		fileMode, err := parseFileMode(mode)
+		if err == nil {
+			err = os.Chmod(path, fileMode)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set the mode of the socket '%s': %w", path, err)
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path when no process accepts its connections anymore.
+// A socket still served, or any other kind of file, is left for the listen to fail.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("the socket '%s' is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	logger.Warnf("Removing the stale socket '%s'", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the stale socket '%s': %w", path, err)
+	}
+	return nil
+}
+
+func parseFileMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0o777 {
+		return 0, fmt.Errorf("invalid file mode '%s', expected octal permissions e.g. 0660", mode)
+	}
+	return os.FileMode(value), nil
+}
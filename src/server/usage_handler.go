@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// defaultUsageCounters is the number of counters listed without a max parameter.
+const defaultUsageCounters = 100
+
+type usageResponse struct {
+	Domain      string             `json:"domain"`
+	Descriptors []*usageDescriptor `json:"descriptors,omitempty"`
+	Counters    []*usageCounter    `json:"counters,omitempty"`
+}
+
+type usageDescriptor struct {
+	Entries []*pb_struct.RateLimitDescriptor_Entry `json:"entries"`
+	Code    string                                 `json:"code"`
+	// The usage is omitted for the descriptors without a limit.
+	Limit *usageLimit `json:"limit,omitempty"`
+	// Used is the number of hits counted in the window, at most the limit.
+	Used      uint32 `json:"used"`
+	Remaining uint32 `json:"remaining"`
+	// ResetSeconds is omitted for the limits without a counter, and for the request aligned limits
+	// whose backend can't read the expiration of the counter.
+	ResetSeconds *int64 `json:"reset_seconds,omitempty"`
+}
+
+type usageLimit struct {
+	RequestsPerUnit uint32 `json:"requests_per_unit"`
+	Unit            string `json:"unit"`
+}
+
+type usageCounter struct {
+	Key          string `json:"key"`
+	Used         uint64 `json:"used"`
+	ResetSeconds int64  `json:"reset_seconds"`
+}
+
+// NewUsageHandler returns a read-only handler reporting the usage of the limits, for the usage
+// dashboards. A POST of a ShouldRateLimit request, in the JSON form of the /json endpoint, returns the
+// usage, limit and reset of each descriptor read from its counter, if counterReader is not nil. A GET
+// lists the counters of the domain query parameter whose descriptor entries start with the prefix
+// query parameter, up to the max query parameter and maxCounters with at most maxScans scans, if
+// counterScanner is not nil.
+func NewUsageHandler(configGetter ConfigGetter, counterReader limiter.CounterReader, counterScanner limiter.CounterScanner,
+	maxCounters int, maxScans int, timeSource utils.TimeSource,
+) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var resp *usageResponse
+		var ok bool
+		switch request.Method {
+		case http.MethodPost:
+			if counterReader == nil {
+				http.Error(writer, "the counters can't be read with this backend", http.StatusNotImplemented)
+				return
+			}
+			resp, ok = describeUsage(writer, request, configGetter, counterReader, timeSource)
+		case http.MethodGet:
+			if counterScanner == nil {
+				http.Error(writer, "the counters can't be listed with this backend", http.StatusNotImplemented)
+				return
+			}
+			resp, ok = listUsage(writer, request, counterScanner, maxCounters, maxScans)
+		default:
+			writeHttpStatus(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(resp); err != nil {
+			logger.Errorf("error writing the usage response: %v", err)
+		}
+	}
+}
+
+// describeUsage reads the counters of the limits of the descriptors of the request, or writes the
+// error response. The request is not a hit, so that it is neither counted nor seen by the stats.
+func describeUsage(writer http.ResponseWriter, request *http.Request, configGetter ConfigGetter,
+	counterReader limiter.CounterReader, timeSource utils.TimeSource,
+) (*usageResponse, bool) {
+	req, current, ok := readDescriptorsRequest(writer, request, configGetter)
+	if !ok {
+		return nil, false
+	}
+
+	ctx := context.Background()
+	matched := make([]*config.RateLimit, len(req.Descriptors))
+	// only the fixed windows have a counter of hits
+	limits := make([]*config.RateLimit, len(req.Descriptors))
+	for i, descriptor := range req.Descriptors {
+		matched[i] = current.GetLimit(ctx, req.Domain, descriptor)
+		if matched[i] != nil && !matched[i].Unlimited && matched[i].LeakyBucket == nil && matched[i].Concurrency == nil {
+			limits[i] = matched[i]
+		}
+	}
+
+	counters, err := readCounters(ctx, counterReader, req, limits)
+	if err != nil {
+		logger.Warnf("error querying the usage: %v", err)
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	resp := &usageResponse{Domain: req.Domain, Descriptors: make([]*usageDescriptor, len(req.Descriptors))}
+	for i, descriptor := range req.Descriptors {
+		usage := &usageDescriptor{Entries: descriptor.Entries, Code: pb.RateLimitResponse_OK.String()}
+		if limit := matched[i]; limit != nil && !limit.Unlimited {
+			usage.Limit = &usageLimit{
+				RequestsPerUnit: limit.Limit.RequestsPerUnit,
+				Unit:            limit.Limit.Unit.String(),
+			}
+		}
+		if limit := limits[i]; limit != nil {
+			usage.Used = uint32(min(counters[i].Value, uint64(limit.Limit.RequestsPerUnit)))
+			usage.Remaining = limit.Limit.RequestsPerUnit - usage.Used
+			if counters[i].Value > uint64(limit.Limit.RequestsPerUnit) && !limit.ShadowMode {
+				usage.Code = pb.RateLimitResponse_OVER_LIMIT.String()
+			}
+			usage.ResetSeconds = resetSeconds(limit, counters[i], timeSource)
+		}
+		resp.Descriptors[i] = usage
+	}
+	return resp, true
+}
+
+// resetSeconds returns the seconds until the reset of the counter of a limit, nil if unknown. The
+// window of a request aligned limit ends with its counter, and starts whole with the first hit.
+func resetSeconds(limit *config.RateLimit, counter limiter.CounterValue, timeSource utils.TimeSource) *int64 {
+	divider := utils.UnitToDividerWithMultiplier(limit.Limit.Unit, limit.UnitMultiplier)
+	var ret int64
+	switch {
+	case !limit.RequestAligned:
+		ret = utils.CalculateResetWithDivider(divider, timeSource).GetSeconds()
+	case counter.Ttl > 0:
+		ret = int64((counter.Ttl + time.Second - 1) / time.Second)
+	case counter.Value == 0:
+		ret = divider
+	default:
+		return nil
+	}
+	return &ret
+}
+
+// listUsage lists the counters of a domain, or writes the error response.
+func listUsage(writer http.ResponseWriter, request *http.Request, counterScanner limiter.CounterScanner, maxCounters int,
+	maxScans int,
+) (*usageResponse, bool) {
+	query := request.URL.Query()
+	domain := query.Get("domain")
+	if domain == "" {
+		http.Error(writer, "the domain is required", http.StatusBadRequest)
+		return nil, false
+	}
+	max := defaultUsageCounters
+	if param := query.Get("max"); param != "" {
+		var err error
+		if max, err = strconv.Atoi(param); err != nil || max <= 0 {
+			http.Error(writer, "the max should be a positive integer", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if max > maxCounters {
+		max = maxCounters
+	}
+
+	counters, err := scanCounters(context.Background(), counterScanner, domain, query.Get("prefix"), max, maxScans)
+	if err != nil {
+		logger.Warnf("error listing the counters: %v", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Key < counters[j].Key })
+
+	resp := &usageResponse{Domain: domain, Counters: make([]*usageCounter, len(counters))}
+	for i, counter := range counters {
+		resp.Counters[i] = &usageCounter{
+			Key:          counter.Key,
+			Used:         counter.Value,
+			ResetSeconds: int64(counter.Ttl.Seconds()),
+		}
+	}
+	return resp, true
+}
+
+// scanCounters lists the counters, turning the panics of the cache into an error.
+func scanCounters(ctx context.Context, counterScanner limiter.CounterScanner, domain string, prefix string,
+	max int, maxScans int,
+) (counters []limiter.UsageValue, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	return counterScanner.ScanCounters(ctx, domain, prefix, max, maxScans), nil
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+// recordConfigDiff logs the changes of a reloaded configuration and counts them by category.
+func (this *service) recordConfigDiff(diff *config.ConfigDiff) {
+	this.stats.ConfigDiff.DomainsAdded.Add(uint64(len(diff.DomainsAdded)))
+	this.stats.ConfigDiff.DomainsRemoved.Add(uint64(len(diff.DomainsRemoved)))
+	this.stats.ConfigDiff.RulesAdded.Add(uint64(len(diff.RulesAdded)))
+	this.stats.ConfigDiff.RulesRemoved.Add(uint64(len(diff.RulesRemoved)))
+	this.stats.ConfigDiff.LimitsChanged.Add(uint64(len(diff.LimitsChanged)))
+	this.stats.ConfigDiff.RulesChanged.Add(uint64(len(diff.RulesChanged)))
+	if diff.IsEmpty() {
+		logger.Info("the reloaded configuration has no changes")
+		return
+	}
+
+	fields := logger.Fields{}
+	for name, changes := range map[string][]string{
+		"domains_added":   diff.DomainsAdded,
+		"domains_removed": diff.DomainsRemoved,
+		"rules_added":     diff.RulesAdded,
+		"rules_removed":   diff.RulesRemoved,
+		"rules_changed":   diff.RulesChanged,
+	} {
+		if len(changes) > 0 {
+			fields[name] = changes
+		}
+	}
+	if len(diff.LimitsChanged) > 0 {
+		limitsChanged := make([]string, 0, len(diff.LimitsChanged))
+		for _, change := range diff.LimitsChanged {
+			limitsChanged = append(limitsChanged, change.Rule+": "+change.From+" -> "+change.To)
+		}
+		fields["limits_changed"] = limitsChanged
+	}
+	logger.WithFields(fields).Info("the reloaded configuration changed")
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+)
+
+// The request metadata asking for the debug trailers, and the trailers.
+const (
+	DebugRequestMetadata         = "x-ratelimit-debug"
+	DebugRuleTrailer             = "x-ratelimit-debug-rule"
+	DebugCacheKeyTrailer         = "x-ratelimit-debug-cache-key"
+	DebugBackendLatencyTrailer   = "x-ratelimit-debug-backend-latency"
+	debugRequestMetadataExpected = "true"
+)
+
+// debugRequested returns whether the gRPC metadata of the request asks for the debug trailers.
+func debugRequested(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, value := range md.Get(DebugRequestMetadata) {
+		if strings.EqualFold(value, debugRequestMetadataExpected) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDebugTrailers sets the trailing metadata of the response to the rule matched by each
+// descriptor, its cache key and the duration of the calls to the cache. The rules and the cache
+// keys have one value per descriptor, empty for the descriptors without limit.
+func setDebugTrailers(ctx context.Context, limits []*config.RateLimit, debug *limiter.DecisionDebug,
+	backendLatency time.Duration,
+) {
+	rules := make([]string, len(limits))
+	for i, limit := range limits {
+		switch {
+		case limit == nil:
+		case limit.Name != "":
+			rules[i] = limit.Name
+		default:
+			rules[i] = limit.FullKey
+		}
+	}
+	trailer := metadata.MD{
+		DebugRuleTrailer:           rules,
+		DebugCacheKeyTrailer:       debug.CacheKeys(len(limits)),
+		DebugBackendLatencyTrailer: []string{backendLatency.String()},
+	}
+	if err := grpc.SetTrailer(ctx, trailer); err != nil {
+		logger.Debugf("failed to set the debug trailers: %v", err)
+	}
+}
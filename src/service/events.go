@@ -0,0 +1,31 @@
+package ratelimit
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/events"
+)
+
+// EventsSetter is implemented by the services which can publish the transitions of their descriptors.
+type EventsSetter interface {
+	// SetEvents publishes the near limit and over limit transitions of the descriptors on broker, nil
+	// to stop publishing them. It must be called before the service is started.
+	SetEvents(broker *events.Broker)
+}
+
+func (this *service) SetEvents(broker *events.Broker) {
+	this.events = broker
+}
+
+// publishEvents publishes the transitions of the descriptors with a limit.
+func (this *service) publishEvents(request *pb.RateLimitRequest, limits []*config.RateLimit,
+	statuses []*pb.RateLimitResponse_DescriptorStatus,
+) {
+	for i, limit := range limits {
+		if limit == nil || limit.Unlimited {
+			continue
+		}
+		this.events.Publish(request.Domain, request.Descriptors[i], limit, statuses[i])
+	}
+}
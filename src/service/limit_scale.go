@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"math"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+)
+
+// LimitScaleFactorSetter is implemented by the services whose limits can be scaled at runtime.
+type LimitScaleFactorSetter interface {
+	// SetLimitScaleFactor multiplies the requests per unit of every limit by factor, 1 to apply the
+	// limits as configured.
+	SetLimitScaleFactor(factor float64)
+}
+
+func (this *service) SetLimitScaleFactor(factor float64) {
+	previous := math.Float64frombits(this.limitScaleFactor.Swap(math.Float64bits(factor)))
+	if previous != factor {
+		logger.Warnf("scaling the rate limits by %v", factor)
+	}
+}
+
+func (this *service) getLimitScaleFactor() float64 {
+	return math.Float64frombits(this.limitScaleFactor.Load())
+}
+
+// scaleLimit returns a copy of the limit whose requests per unit, and those of its quota, spillover
+// tiers and leaky bucket, are multiplied by factor. A scaled limit admits at least one request per
+// unit, the counters, stats and cache keys being those of the limit.
+func scaleLimit(limit *config.RateLimit, factor float64) *config.RateLimit {
+	scaled := *limit
+	scaled.Limit = &pb.RateLimitResponse_RateLimit{
+		RequestsPerUnit: scaleRequests(limit.Limit.RequestsPerUnit, factor),
+		Unit:            limit.Limit.Unit,
+		Name:            limit.Limit.Name,
+	}
+	if limit.Quota != nil {
+		scaled.Quota = scaleLimit(limit.Quota, factor)
+	}
+	if len(limit.Spillover) > 0 {
+		scaled.Spillover = make([]*config.RateLimit, len(limit.Spillover))
+		for i, tier := range limit.Spillover {
+			scaled.Spillover[i] = scaleLimit(tier, factor)
+		}
+	}
+	if limit.LeakyBucket != nil {
+		scaled.LeakyBucket = &config.LeakyBucket{BucketSize: scaleRequests(limit.LeakyBucket.BucketSize, factor)}
+	}
+	return &scaled
+}
+
+func scaleRequests(requests uint32, factor float64) uint32 {
+	if requests == 0 {
+		return 0
+	}
+	return uint32(max(1, min(math.Floor(float64(requests)*factor), math.MaxUint32)))
+}
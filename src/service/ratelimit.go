@@ -3,9 +3,11 @@ package ratelimit
 import (
 	"fmt"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -25,10 +27,12 @@ import (
 
 	"github.com/envoyproxy/ratelimit/src/assert"
 	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/events"
 	"github.com/envoyproxy/ratelimit/src/limiter"
 	"github.com/envoyproxy/ratelimit/src/provider"
 	"github.com/envoyproxy/ratelimit/src/redis"
 	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/topkeys"
 )
 
 var tracer = otel.Tracer("ratelimit")
@@ -39,20 +43,39 @@ type RateLimitServiceServer interface {
 	SetConfig(updateEvent provider.ConfigUpdateEvent, healthyWithAtLeastOneConfigLoad bool)
 }
 
-type service struct {
-	configLock                     sync.RWMutex
-	configUpdateEvent              <-chan provider.ConfigUpdateEvent
+// serviceConfig is replaced as a whole on reload, so that a request sees either the previous or
+// the new configuration and never a partially applied one.
+type serviceConfig struct {
 	config                         config.RateLimitConfig
-	cache                          limiter.RateLimitCache
-	stats                          stats.ServiceStats
-	health                         *server.HealthChecker
 	customHeadersEnabled           bool
 	customHeaderLimitHeader        string
 	customHeaderRemainingHeader    string
 	customHeaderResetHeader        string
-	customHeaderClock              utils.TimeSource
 	globalShadowMode               bool
 	responseDynamicMetadataEnabled bool
+	debugTrailersEnabled           bool
+	// outcomes counts the outcomes of the requests served with the configuration.
+	outcomes *requestOutcomes
+	// canary rolls back to the previous configuration during the bake period of a reload, nil
+	// if the configuration isn't baked.
+	canary *reloadCanary
+}
+
+type service struct {
+	configUpdateEvent <-chan provider.ConfigUpdateEvent
+	config            atomic.Pointer[serviceConfig]
+	// rolledBack is the configuration rolled back by its canary, nil if none is refused.
+	rolledBack        atomic.Pointer[serviceConfig]
+	cache             limiter.RateLimitCache
+	stats             stats.ServiceStats
+	health            *server.HealthChecker
+	customHeaderClock utils.TimeSource
+	// limitScaleFactor holds the bits of the float64 multiplying the limits.
+	limitScaleFactor atomic.Uint64
+	// topKeys counts the hits of the descriptors, nil if the heaviest descriptors aren't tracked.
+	topKeys *topkeys.Tracker
+	// events publishes the transitions of the descriptors, nil if they aren't published.
+	events *events.Broker
 }
 
 func (this *service) SetConfig(updateEvent provider.ConfigUpdateEvent, healthyWithAtLeastOneConfigLoad bool) {
@@ -67,10 +90,14 @@ func (this *service) SetConfig(updateEvent provider.ConfigUpdateEvent, healthyWi
 		logger.Errorf("Error loading new configuration: %s", configError.Error())
 		return
 	}
+	if this.refuseRolledBack(newConfig) {
+		return
+	}
 
+	hasDomains := !newConfig.IsEmptyDomains()
 	if healthyWithAtLeastOneConfigLoad {
 		err = nil
-		if !newConfig.IsEmptyDomains() {
+		if hasDomains {
 			err = this.health.Ok(server.ConfigHealthComponentName)
 		} else {
 			err = this.health.Fail(server.ConfigHealthComponentName)
@@ -79,26 +106,36 @@ func (this *service) SetConfig(updateEvent provider.ConfigUpdateEvent, healthyWi
 			logger.Errorf("Unable to update health status: %s", err)
 		}
 	}
+	if hasDomains {
+		this.health.ConfigLoaded()
+	}
 
 	this.stats.ConfigLoadSuccess.Inc()
 
-	this.configLock.Lock()
-	this.config = newConfig
-
 	rlSettings := settings.NewSettings()
-	this.globalShadowMode = rlSettings.GlobalShadowMode
-	this.responseDynamicMetadataEnabled = rlSettings.ResponseDynamicMetadata
+	snapshot := &serviceConfig{
+		config:                         newConfig,
+		globalShadowMode:               rlSettings.GlobalShadowMode,
+		responseDynamicMetadataEnabled: rlSettings.ResponseDynamicMetadata,
+		debugTrailersEnabled:           rlSettings.ResponseDebugTrailers,
+		outcomes:                       &requestOutcomes{},
+	}
+	previous := this.config.Load()
+	if previous != nil && previous.config != nil {
+		this.recordConfigDiff(config.DiffConfigs(previous.config, newConfig))
+	}
+	snapshot.canary = newReloadCanary(rlSettings, previous, this.customHeaderClock.UnixNow())
 
 	if rlSettings.RateLimitResponseHeadersEnabled {
-		this.customHeadersEnabled = true
+		snapshot.customHeadersEnabled = true
 
-		this.customHeaderLimitHeader = rlSettings.HeaderRatelimitLimit
+		snapshot.customHeaderLimitHeader = rlSettings.HeaderRatelimitLimit
 
-		this.customHeaderRemainingHeader = rlSettings.HeaderRatelimitRemaining
+		snapshot.customHeaderRemainingHeader = rlSettings.HeaderRatelimitRemaining
 
-		this.customHeaderResetHeader = rlSettings.HeaderRatelimitReset
+		snapshot.customHeaderResetHeader = rlSettings.HeaderRatelimitReset
 	}
-	this.configLock.Unlock()
+	this.config.Store(snapshot)
 	logger.Info("Successfully loaded new configuration")
 }
 
@@ -152,6 +189,7 @@ func (this *service) constructLimitsToCheck(request *pb.RateLimitRequest, ctx co
 		}
 
 		if limitsToCheck[i] != nil {
+			limitsToCheck[i].Stats.Matched.Inc()
 			for _, replace := range limitsToCheck[i].Replaces {
 				replacing[replace] = true
 			}
@@ -159,6 +197,17 @@ func (this *service) constructLimitsToCheck(request *pb.RateLimitRequest, ctx co
 			if limitsToCheck[i].Unlimited {
 				isUnlimited[i] = true
 				limitsToCheck[i] = nil
+			} else if limitsToCheck[i].Concurrency != nil {
+				// the concurrency limits are only checked by acquiring their leases
+				limitsToCheck[i] = nil
+			}
+		}
+	}
+
+	if factor := this.getLimitScaleFactor(); factor != 1 {
+		for i, limit := range limitsToCheck {
+			if limit != nil {
+				limitsToCheck[i] = scaleLimit(limit, factor)
 			}
 		}
 	}
@@ -180,20 +229,176 @@ func (this *service) constructLimitsToCheck(request *pb.RateLimitRequest, ctx co
 
 const MaxUint32 = uint32(1<<32 - 1)
 
+// doLimit checks the limits in the cache, along with the quotas of the limits which have one so that
+// a single call to the cache increments both. The status of a limit with a quota is the most
+// restrictive of the statuses of the limit and of its quota.
+func (this *service) doLimit(
+	ctx context.Context, request *pb.RateLimitRequest, limitsToCheck []*config.RateLimit,
+) []*pb.RateLimitResponse_DescriptorStatus {
+	var quotaIndexes []int
+	for i, limit := range limitsToCheck {
+		if limit != nil && limit.Quota != nil {
+			quotaIndexes = append(quotaIndexes, i)
+		}
+	}
+	if len(quotaIndexes) == 0 {
+		return this.cache.DoLimit(ctx, request, limitsToCheck)
+	}
+
+	// the quotas are checked as additional descriptors appended to the request
+	quotaRequest := &pb.RateLimitRequest{
+		Domain:      request.Domain,
+		Descriptors: append([]*ratelimitv3.RateLimitDescriptor{}, request.Descriptors...),
+		HitsAddend:  request.HitsAddend,
+	}
+	limitsWithQuotas := append([]*config.RateLimit{}, limitsToCheck...)
+	for _, i := range quotaIndexes {
+		quotaRequest.Descriptors = append(quotaRequest.Descriptors, request.Descriptors[i])
+		limitsWithQuotas = append(limitsWithQuotas, limitsToCheck[i].Quota)
+	}
+
+	statuses := this.cache.DoLimit(ctx, quotaRequest, limitsWithQuotas)
+	for j, i := range quotaIndexes {
+		if quotaStatus := statuses[len(limitsToCheck)+j]; isMoreRestrictive(quotaStatus, statuses[i]) {
+			statuses[i] = quotaStatus
+		}
+	}
+	return statuses[:len(limitsToCheck)]
+}
+
+// doSpillover checks the spillover tiers of the limits over the limit, in order, until a tier admits
+// the request. The limit and the status of a descriptor admitted by a tier are replaced by those of
+// the tier, a tier over the limit leaving the status of the limit. The over limit of the limits
+// spilling over is recorded once every tier rejected the request.
+func (this *service) doSpillover(ctx context.Context, request *pb.RateLimitRequest,
+	limitsToCheck []*config.RateLimit, statuses []*pb.RateLimitResponse_DescriptorStatus,
+) {
+	// the limits over the limit which spill over, by descriptor
+	rejecting := make([][]*config.RateLimit, len(limitsToCheck))
+	spilling := false
+	for i, limit := range limitsToCheck {
+		if limit != nil && limit.SpillsOver && statuses[i].Code == pb.RateLimitResponse_OVER_LIMIT {
+			rejecting[i] = []*config.RateLimit{limit}
+			spilling = true
+		}
+	}
+	if !spilling {
+		return
+	}
+
+	for tier := 0; ; tier++ {
+		tierRequest := &pb.RateLimitRequest{Domain: request.Domain, HitsAddend: request.HitsAddend}
+		var tierLimits []*config.RateLimit
+		var indexes []int
+		lastTier := true
+		for i, limit := range limitsToCheck {
+			if rejecting[i] == nil || tier >= len(limit.Spillover) || statuses[i].Code != pb.RateLimitResponse_OVER_LIMIT {
+				continue
+			}
+			lastTier = lastTier && tier == len(limit.Spillover)-1
+			descriptor, ok := spilloverDescriptor(request.Descriptors[i], limit.Spillover[tier])
+			if !ok {
+				logger.Debugf("descriptor has no entry %s for the spillover tier %s", limit.Spillover[tier].SpilloverKey,
+					limit.Spillover[tier].Name)
+				continue
+			}
+			tierRequest.Descriptors = append(tierRequest.Descriptors, descriptor)
+			tierLimits = append(tierLimits, limit.Spillover[tier])
+			indexes = append(indexes, i)
+		}
+
+		if len(indexes) > 0 {
+			tierStatuses := this.cache.DoLimit(ctx, tierRequest, tierLimits)
+			for j, i := range indexes {
+				if tierStatuses[j].Code == pb.RateLimitResponse_OK {
+					limitsToCheck[i] = tierLimits[j]
+					statuses[i] = tierStatuses[j]
+				} else if tierLimits[j].SpillsOver {
+					rejecting[i] = append(rejecting[i], tierLimits[j])
+				}
+			}
+		}
+		if lastTier {
+			break
+		}
+	}
+
+	hitsAddends := limiter.GetHitsAddends(request, limitsToCheck)
+	for i, limits := range rejecting {
+		if statuses[i].Code != pb.RateLimitResponse_OVER_LIMIT {
+			continue
+		}
+		for _, limit := range limits {
+			limit.Stats.OverLimit.Add(hitsAddends[i])
+		}
+	}
+}
+
+// spilloverDescriptor returns the descriptor of the pool of a spillover tier, keyed by the name of
+// the tier and by the entry of the descriptor keying the pool, false if the descriptor has no such
+// entry.
+func spilloverDescriptor(descriptor *ratelimitv3.RateLimitDescriptor, tier *config.RateLimit) (*ratelimitv3.RateLimitDescriptor, bool) {
+	entries := []*ratelimitv3.RateLimitDescriptor_Entry{{Key: config.SpilloverDescriptorKey, Value: tier.Name}}
+	if tier.SpilloverKey != "" {
+		found := false
+		for _, entry := range descriptor.Entries {
+			if entry.Key == tier.SpilloverKey {
+				entries = append(entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entry.Key, Value: entry.Value})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return &ratelimitv3.RateLimitDescriptor{Entries: entries, HitsAddend: descriptor.HitsAddend}, true
+}
+
+// isMoreRestrictive returns whether status is over the limit while other is not, or has less
+// remaining requests with the same code.
+func isMoreRestrictive(status *pb.RateLimitResponse_DescriptorStatus, other *pb.RateLimitResponse_DescriptorStatus) bool {
+	if status.Code != other.Code {
+		return status.Code == pb.RateLimitResponse_OVER_LIMIT
+	}
+	return status.LimitRemaining < other.LimitRemaining
+}
+
 func (this *service) shouldRateLimitWorker(
-	ctx context.Context, request *pb.RateLimitRequest,
+	ctx context.Context, request *pb.RateLimitRequest, snapshot *serviceConfig,
 ) *pb.RateLimitResponse {
 	checkServiceErr(request.Domain != "", "rate limit domain must not be empty")
 	checkServiceErr(len(request.Descriptors) != 0, "rate limit descriptor list must not be empty")
 
-	snappedConfig, globalShadowMode := this.GetCurrentConfig()
-	limitsToCheck, isUnlimited := this.constructLimitsToCheck(request, ctx, snappedConfig)
+	lookupStart := time.Now()
+	limitsToCheck, isUnlimited := this.constructLimitsToCheck(request, ctx, snapshot.config)
+	this.stats.ShouldRateLimit.Timing.ConfigLookup.AddDuration(time.Since(lookupStart))
+	if this.topKeys != nil {
+		this.addTopKeys(request, limitsToCheck)
+	}
 
 	assert.Assert(len(limitsToCheck) == len(isUnlimited))
 	assert.Assert(len(limitsToCheck) == len(request.Descriptors))
 
-	responseDescriptorStatuses := this.cache.DoLimit(ctx, request, limitsToCheck)
+	// The clients may ask for the rules and cache keys of the decision in the trailers of the response.
+	var decisionDebug *limiter.DecisionDebug
+	var matchedLimits []*config.RateLimit
+	cacheCtx := ctx
+	if snapshot.debugTrailersEnabled && debugRequested(ctx) {
+		cacheCtx, decisionDebug = limiter.WithDecisionDebug(ctx)
+		// the rules matched, before their spillover tiers
+		matchedLimits = slices.Clone(limitsToCheck)
+	}
+	cacheStart := time.Now()
+	responseDescriptorStatuses := this.doLimit(cacheCtx, request, limitsToCheck)
 	assert.Assert(len(limitsToCheck) == len(responseDescriptorStatuses))
+	this.doSpillover(cacheCtx, request, limitsToCheck, responseDescriptorStatuses)
+	if this.events != nil {
+		this.publishEvents(request, limitsToCheck, responseDescriptorStatuses)
+	}
+	if decisionDebug != nil {
+		setDebugTrailers(ctx, matchedLimits, decisionDebug, time.Since(cacheStart))
+	}
 
 	response := &pb.RateLimitResponse{}
 	response.Statuses = make([]*pb.RateLimitResponse_DescriptorStatus, len(request.Descriptors))
@@ -202,13 +407,15 @@ func (this *service) shouldRateLimitWorker(
 	// Keep track of the descriptor which is closest to hit the ratelimit
 	minLimitRemaining := MaxUint32
 	var minimumDescriptor *pb.RateLimitResponse_DescriptorStatus = nil
+	var minimumLimit *config.RateLimit = nil
 
 	for i, descriptorStatus := range responseDescriptorStatuses {
 		// Keep track of the descriptor closest to hit the ratelimit
-		if this.customHeadersEnabled &&
+		if snapshot.customHeadersEnabled &&
 			descriptorStatus.CurrentLimit != nil &&
 			descriptorStatus.LimitRemaining < minLimitRemaining {
 			minimumDescriptor = descriptorStatus
+			minimumLimit = limitsToCheck[i]
 			minLimitRemaining = descriptorStatus.LimitRemaining
 		}
 
@@ -223,30 +430,32 @@ func (this *service) shouldRateLimitWorker(
 				finalCode = descriptorStatus.Code
 
 				minimumDescriptor = descriptorStatus
+				minimumLimit = limitsToCheck[i]
 				minLimitRemaining = 0
 			}
 		}
 	}
 
 	// Add Headers if requested
-	if this.customHeadersEnabled && minimumDescriptor != nil {
+	if snapshot.customHeadersEnabled && minimumDescriptor != nil {
 		response.ResponseHeadersToAdd = []*core.HeaderValue{
-			this.rateLimitLimitHeader(minimumDescriptor),
-			this.rateLimitRemainingHeader(minimumDescriptor),
-			this.rateLimitResetHeader(minimumDescriptor),
+			this.rateLimitLimitHeader(snapshot, minimumDescriptor),
+			this.rateLimitRemainingHeader(snapshot, minimumDescriptor),
+			this.rateLimitResetHeader(snapshot, minimumDescriptor, minimumLimit),
 		}
 	}
 
 	// If there is a global shadow_mode, it should always return OK
-	if finalCode == pb.RateLimitResponse_OVER_LIMIT && globalShadowMode {
+	if finalCode == pb.RateLimitResponse_OVER_LIMIT && snapshot.globalShadowMode {
 		finalCode = pb.RateLimitResponse_OK
 		this.stats.GlobalShadowMode.Inc()
 	}
 
 	// If response dynamic data enabled, set dynamic data on response.
-	if this.responseDynamicMetadataEnabled {
+	if snapshot.responseDynamicMetadataEnabled {
 		response.DynamicMetadata = ratelimitToMetadata(request)
 	}
+	addLimitsMetadata(response, limitsToCheck)
 
 	response.OverallCode = finalCode
 	return response
@@ -279,6 +488,27 @@ func ratelimitToMetadata(req *pb.RateLimitRequest) *structpb.Struct {
 	return &structpb.Struct{Fields: fields}
 }
 
+// addLimitsMetadata copies the metadata of the applied limits into the DynamicMetadata of the
+// response, in descriptor order, then the metadata of the limits over the limit so that they win.
+func addLimitsMetadata(response *pb.RateLimitResponse, limitsToCheck []*config.RateLimit) {
+	for _, overLimit := range []bool{false, true} {
+		for i, limit := range limitsToCheck {
+			if limit == nil || len(limit.Metadata) == 0 {
+				continue
+			}
+			if overLimit != (response.Statuses[i].Code == pb.RateLimitResponse_OVER_LIMIT) {
+				continue
+			}
+			if response.DynamicMetadata == nil {
+				response.DynamicMetadata = &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+			}
+			for key, value := range limit.Metadata {
+				response.DynamicMetadata.Fields[key] = structpb.NewStringValue(value)
+			}
+		}
+	}
+}
+
 func descriptorToStruct(descriptor *ratelimitv3.RateLimitDescriptor) *structpb.Struct {
 	if descriptor == nil {
 		return nil
@@ -309,29 +539,45 @@ func descriptorToStruct(descriptor *ratelimitv3.RateLimitDescriptor) *structpb.S
 	return &structpb.Struct{Fields: fields}
 }
 
-func (this *service) rateLimitLimitHeader(descriptor *pb.RateLimitResponse_DescriptorStatus) *core.HeaderValue {
+func (this *service) rateLimitLimitHeader(snapshot *serviceConfig, descriptor *pb.RateLimitResponse_DescriptorStatus) *core.HeaderValue {
 	// Limit header only provides the mandatory part from the spec, the actual limit
 	// the optional quota policy is currently not provided
 	return &core.HeaderValue{
-		Key:   this.customHeaderLimitHeader,
+		Key:   snapshot.customHeaderLimitHeader,
 		Value: strconv.FormatUint(uint64(descriptor.CurrentLimit.RequestsPerUnit), 10),
 	}
 }
 
-func (this *service) rateLimitRemainingHeader(descriptor *pb.RateLimitResponse_DescriptorStatus) *core.HeaderValue {
+func (this *service) rateLimitRemainingHeader(snapshot *serviceConfig, descriptor *pb.RateLimitResponse_DescriptorStatus) *core.HeaderValue {
 	// How much of the limit is remaining
 	return &core.HeaderValue{
-		Key:   this.customHeaderRemainingHeader,
+		Key:   snapshot.customHeaderRemainingHeader,
 		Value: strconv.FormatUint(uint64(descriptor.LimitRemaining), 10),
 	}
 }
 
 func (this *service) rateLimitResetHeader(
-	descriptor *pb.RateLimitResponse_DescriptorStatus,
+	snapshot *serviceConfig, descriptor *pb.RateLimitResponse_DescriptorStatus, limit *config.RateLimit,
 ) *core.HeaderValue {
+	// the current limit of a limit with a unit_multiplier is reported in a unit spanning its window,
+	// the window itself is read from the limit
+	unit := descriptor.CurrentLimit.Unit
+	var unitMultiplier uint32
+	if limit != nil {
+		unit = limit.Limit.Unit
+		unitMultiplier = limit.UnitMultiplier
+	}
+	if limit != nil && limit.RequestAligned && descriptor.DurationUntilReset != nil {
+		// the window of a request aligned limit isn't aligned on the clock, its end is read from the backend
+		return &core.HeaderValue{
+			Key:   snapshot.customHeaderResetHeader,
+			Value: strconv.FormatInt(descriptor.DurationUntilReset.GetSeconds(), 10),
+		}
+	}
+	divider := utils.UnitToDividerWithMultiplier(unit, unitMultiplier)
 	return &core.HeaderValue{
-		Key:   this.customHeaderResetHeader,
-		Value: strconv.FormatInt(utils.CalculateReset(&descriptor.CurrentLimit.Unit, this.customHeaderClock).GetSeconds(), 10),
+		Key:   snapshot.customHeaderResetHeader,
+		Value: strconv.FormatInt(utils.CalculateResetWithDivider(divider, this.customHeaderClock).GetSeconds(), 10),
 	}
 }
 
@@ -348,6 +594,11 @@ func (this *service) ShouldRateLimit(
 	)
 	defer span.End()
 
+	snapshot := this.config.Load()
+	defer func() {
+		this.recordOutcome(snapshot, finalResponse, finalError)
+	}()
+
 	defer func() {
 		err := recover()
 		if err == nil {
@@ -373,31 +624,29 @@ func (this *service) ShouldRateLimit(
 		}
 	}()
 
-	response := this.shouldRateLimitWorker(ctx, request)
+	response := this.shouldRateLimitWorker(ctx, request, snapshot)
 	logger.Debugf("returning normal response: %+v", response)
 
 	return response, nil
 }
 
 func (this *service) GetCurrentConfig() (config.RateLimitConfig, bool) {
-	this.configLock.RLock()
-	defer this.configLock.RUnlock()
-	return this.config, this.globalShadowMode
+	snapshot := this.config.Load()
+	return snapshot.config, snapshot.globalShadowMode
 }
 
 func NewService(cache limiter.RateLimitCache, configProvider provider.RateLimitConfigProvider, statsManager stats.Manager,
 	health *server.HealthChecker, clock utils.TimeSource, shadowMode, forceStart bool, healthyWithAtLeastOneConfigLoad bool,
 ) RateLimitServiceServer {
 	newService := &service{
-		configLock:        sync.RWMutex{},
 		configUpdateEvent: configProvider.ConfigUpdateEvent(),
-		config:            nil,
 		cache:             cache,
 		stats:             statsManager.NewServiceStats(),
 		health:            health,
-		globalShadowMode:  shadowMode,
 		customHeaderClock: clock,
 	}
+	newService.config.Store(&serviceConfig{globalShadowMode: shadowMode})
+	newService.limitScaleFactor.Store(math.Float64bits(1))
 
 	if !forceStart {
 		logger.Info("Waiting for initial ratelimit config update event")
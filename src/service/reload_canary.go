@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+// requestOutcomes counts the outcomes of the requests served with a configuration.
+type requestOutcomes struct {
+	requests atomic.Uint64
+	// errors counts the failed requests and those without a limit for any of their descriptors.
+	errors    atomic.Uint64
+	overLimit atomic.Uint64
+}
+
+func (this *requestOutcomes) record(response *pb.RateLimitResponse, err error) {
+	if response == nil && err == nil {
+		// a panic going through
+		return
+	}
+	this.requests.Add(1)
+	if err != nil {
+		this.errors.Add(1)
+		return
+	}
+	if response.OverallCode == pb.RateLimitResponse_OVER_LIMIT {
+		this.overLimit.Add(1)
+	}
+	for _, status := range response.Statuses {
+		if status.CurrentLimit != nil {
+			return
+		}
+	}
+	this.errors.Add(1)
+}
+
+// rates returns the ratios of the errors and of the requests over the limit to the requests.
+func (this *requestOutcomes) rates() (requests uint64, errorRate float64, overLimitRate float64) {
+	requests = this.requests.Load()
+	if requests == 0 {
+		return 0, 0, 0
+	}
+	return requests, float64(this.errors.Load()) / float64(requests), float64(this.overLimit.Load()) / float64(requests)
+}
+
+// reloadCanary compares a reloaded configuration with the previous one during its bake period.
+type reloadCanary struct {
+	// previous is released once the canary is done, so that the configurations don't chain up.
+	previous atomic.Pointer[serviceConfig]
+	// bakeEnd is the end of the bake period, in unix seconds.
+	bakeEnd               int64
+	minRequests           uint64
+	maxErrorIncrease      float64
+	maxOverLimitIncrease  float64
+	baselineErrorRate     float64
+	baselineOverLimitRate float64
+	done                  atomic.Bool
+}
+
+// newReloadCanary returns the canary of a configuration replacing previous, nil if the reloads
+// aren't baked or if there is no previous configuration to roll back to.
+func newReloadCanary(s settings.Settings, previous *serviceConfig, now int64) *reloadCanary {
+	if s.ConfigCanaryBakePeriod <= 0 || previous == nil || previous.config == nil {
+		return nil
+	}
+	ret := &reloadCanary{
+		bakeEnd:              now + int64(s.ConfigCanaryBakePeriod.Round(time.Second)/time.Second),
+		minRequests:          s.ConfigCanaryMinRequests,
+		maxErrorIncrease:     s.ConfigCanaryMaxErrorIncrease,
+		maxOverLimitIncrease: s.ConfigCanaryMaxOverLimitIncrease,
+	}
+	ret.previous.Store(previous)
+	// the rates of a configuration which served too few requests are not a baseline
+	if requests, errorRate, overLimitRate := previous.outcomes.rates(); requests >= s.ConfigCanaryMinRequests {
+		ret.baselineErrorRate = errorRate
+		ret.baselineOverLimitRate = overLimitRate
+	}
+	return ret
+}
+
+// recordOutcome counts the outcome of a request served with snapshot, then rolls back to the
+// previous configuration if the outcomes of snapshot degraded during its bake period.
+func (this *service) recordOutcome(snapshot *serviceConfig, response *pb.RateLimitResponse, err error) {
+	if snapshot.outcomes == nil {
+		return
+	}
+	snapshot.outcomes.record(response, err)
+	canary := snapshot.canary
+	if canary == nil || canary.done.Load() {
+		return
+	}
+
+	if this.customHeaderClock.UnixNow() >= canary.bakeEnd {
+		if canary.done.CompareAndSwap(false, true) {
+			canary.previous.Store(nil)
+			this.stats.ConfigCanaryPassed.Inc()
+			logger.Info("the reloaded configuration passed its bake period")
+		}
+		return
+	}
+	requests, errorRate, overLimitRate := snapshot.outcomes.rates()
+	if requests < canary.minRequests {
+		return
+	}
+	if errorRate-canary.baselineErrorRate <= canary.maxErrorIncrease &&
+		overLimitRate-canary.baselineOverLimitRate <= canary.maxOverLimitIncrease {
+		return
+	}
+	if !canary.done.CompareAndSwap(false, true) {
+		return
+	}
+	previous := canary.previous.Swap(nil)
+	if !this.config.CompareAndSwap(snapshot, previous) {
+		// a newer configuration was loaded meanwhile
+		return
+	}
+	this.rolledBack.Store(snapshot)
+	this.stats.ConfigRollback.Inc()
+	this.stats.ConfigRolledBack.Set(1)
+	logger.Errorf("rolled back the reloaded configuration: %.2f of the requests failed or matched no limit "+
+		"and %.2f were over the limit, against %.2f and %.2f with the previous configuration",
+		errorRate, overLimitRate, canary.baselineErrorRate, canary.baselineOverLimitRate)
+}
+
+// refuseRolledBack returns whether newConfig is the configuration which was rolled back, which is
+// refused until the configuration changes rather than applied again by the next reload.
+func (this *service) refuseRolledBack(newConfig config.RateLimitConfig) bool {
+	rolledBack := this.rolledBack.Load()
+	if rolledBack == nil {
+		return false
+	}
+	if config.DiffConfigs(rolledBack.config, newConfig).IsEmpty() {
+		logger.Errorf("refusing the reloaded configuration, it is the one which was rolled back")
+		return true
+	}
+	this.rolledBack.Store(nil)
+	this.stats.ConfigRolledBack.Set(0)
+	return false
+}
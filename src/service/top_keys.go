@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"strings"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/topkeys"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// TopKeysSetter is implemented by the services which can track their heaviest descriptors.
+type TopKeysSetter interface {
+	// SetTopKeys counts the hits of the descriptors with a limit in tracker, nil to stop counting
+	// them. It must be called before the service is started.
+	SetTopKeys(tracker *topkeys.Tracker)
+}
+
+func (this *service) SetTopKeys(tracker *topkeys.Tracker) {
+	this.topKeys = tracker
+}
+
+// addTopKeys counts the hits of the descriptors with a limit, the queries counting no hit.
+func (this *service) addTopKeys(request *pb.RateLimitRequest, limits []*config.RateLimit) {
+	hitsAddends := utils.GetHitsAddends(request)
+	for i, limit := range limits {
+		if limit == nil || hitsAddends[i] == 0 {
+			continue
+		}
+		entries := make([]string, len(request.Descriptors[i].Entries))
+		for j, entry := range request.Descriptors[i].Entries {
+			entries[j] = entry.Key + "=" + entry.Value
+		}
+		this.topKeys.Add(request.Domain, strings.Join(entries, ","), hitsAddends[i])
+	}
+}
@@ -0,0 +1,112 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coocood/freecache"
+
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/memcached"
+	"github.com/envoyproxy/ratelimit/src/redis"
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// BackendFactory creates the rate limit cache of a BACKEND_TYPE. The local cache is nil when
+// disabled, the closer, which may be nil, is closed when the runner stops.
+type BackendFactory func(s settings.Settings, srv server.Server, localCache *freecache.Cache,
+	statsManager stats.Manager) (limiter.RateLimitCache, io.Closer, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes the cache created by factory available as BACKEND_TYPE name, so that the
+// out-of-tree backends can be selected like the builtin ones. It is meant to be called from the
+// init function of the package of the backend, and panics if the name is empty or already
+// registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if name == "" || factory == nil {
+		panic("runner: RegisterBackend with an empty name or a nil factory")
+	}
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("runner: RegisterBackend called twice for backend %s", name))
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterBackend("redis", newRedisBackend)
+	RegisterBackend("memcache", newMemcacheBackend)
+}
+
+func newRedisBackend(s settings.Settings, srv server.Server, localCache *freecache.Cache,
+	statsManager stats.Manager,
+) (limiter.RateLimitCache, io.Closer, error) {
+	cache, closer := redis.NewRateLimiterCacheImplFromSettings(
+		s,
+		localCache,
+		srv,
+		utils.NewTimeSourceImpl(),
+		rand.New(utils.NewLockedSource(time.Now().Unix())),
+		s.ExpirationJitterMaxSeconds,
+		statsManager,
+	)
+	return cache, closer, nil
+}
+
+func newMemcacheBackend(s settings.Settings, srv server.Server, localCache *freecache.Cache,
+	statsManager stats.Manager,
+) (limiter.RateLimitCache, io.Closer, error) {
+	cache := memcached.NewRateLimitCacheImplFromSettings(
+		s,
+		utils.NewTimeSourceImpl(),
+		rand.New(utils.NewLockedSource(time.Now().Unix())),
+		localCache,
+		srv.Scope(),
+		statsManager)
+	// closing the cache drains its increments, the memcache client can't be closed
+	return cache, cache.(io.Closer), nil
+}
+
+// createLimiter creates the cache of factory, or of the registered BACKEND_TYPE when it is nil.
+func createLimiter(srv server.Server, s settings.Settings, localCache *freecache.Cache, statsManager stats.Manager,
+	factory BackendFactory,
+) (limiter.RateLimitCache, io.Closer, error) {
+	if factory != nil {
+		return factory(s, srv, localCache, statsManager)
+	}
+	name := s.BackendType
+	if name == "" {
+		name = "redis"
+	}
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid setting for BackendType: %s", s.BackendType)
+	}
+	return factory(s, srv, localCache, statsManager)
+}
@@ -2,28 +2,35 @@ package runner
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/coocood/freecache"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	pb_v2 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	gostats "github.com/lyft/gostats"
 	logger "github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	"github.com/envoyproxy/ratelimit/src/canary"
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/events"
 	"github.com/envoyproxy/ratelimit/src/godogstats"
 	"github.com/envoyproxy/ratelimit/src/limiter"
-	"github.com/envoyproxy/ratelimit/src/memcached"
 	"github.com/envoyproxy/ratelimit/src/metrics"
-	"github.com/envoyproxy/ratelimit/src/redis"
+	"github.com/envoyproxy/ratelimit/src/profiling"
 	"github.com/envoyproxy/ratelimit/src/server"
 	ratelimit "github.com/envoyproxy/ratelimit/src/service"
 	"github.com/envoyproxy/ratelimit/src/settings"
 	"github.com/envoyproxy/ratelimit/src/stats"
 	"github.com/envoyproxy/ratelimit/src/stats/prom"
+	"github.com/envoyproxy/ratelimit/src/topkeys"
 	"github.com/envoyproxy/ratelimit/src/trace"
 	"github.com/envoyproxy/ratelimit/src/utils"
 )
@@ -34,104 +41,220 @@ type Runner struct {
 	srv             server.Server
 	mu              sync.Mutex
 	ratelimitCloser io.Closer
+	canary          *canary.Canary
+	profilePusher   *profiling.Pusher
+	reloader        *settings.Reloader
+	tracerProvider  *sdktrace.TracerProvider
+	options         options
+	ready           chan struct{}
+	stopped         context.Context
+	stop            context.CancelFunc
 }
 
-func NewRunner(s settings.Settings) Runner {
-	var store gostats.Store
+type options struct {
+	statsSink       gostats.Sink
+	cacheFactory    BackendFactory
+	providerFactory server.ProviderFactory
+}
+
+// Option customizes a runner created by NewRunner, for the applications embedding the service.
+type Option func(*options)
+
+// WithStatsSink flushes the stats to sink in place of the sink selected by the settings.
+func WithStatsSink(sink gostats.Sink) Option {
+	return func(o *options) {
+		o.statsSink = sink
+	}
+}
+
+// WithRateLimitCache stores the counters in the cache created by factory in place of the
+// BACKEND_TYPE one, as if factory was registered as the BACKEND_TYPE with RegisterBackend.
+func WithRateLimitCache(factory BackendFactory) Option {
+	return func(o *options) {
+		o.cacheFactory = factory
+	}
+}
+
+// WithConfigProvider loads the configuration from the provider created by factory in place of the
+// CONFIG_TYPE one.
+func WithConfigProvider(factory server.ProviderFactory) Option {
+	return func(o *options) {
+		o.providerFactory = factory
+	}
+}
+
+func NewRunner(s settings.Settings, opts ...Option) Runner {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var sink gostats.Sink
 
 	switch {
+	case o.statsSink != nil:
+		logger.Info("Stats initialized for the embedding application sink")
+		sink = o.statsSink
 	case s.DisableStats:
 		logger.Info("Stats disabled")
-		store = gostats.NewStore(gostats.NewNullSink(), false)
+		sink = gostats.NewNullSink()
 	case s.UseDogStatsd:
 		if s.UseStatsd || s.UsePrometheus {
 			logger.Fatalf("Error: unable to use more than one stats sink at the same time. Set one of USE_DOG_STATSD, USE_STATSD, USE_PROMETHEUS.")
 		}
-		sink, err := godogstats.NewSink(
+		dogStatsdSink, err := godogstats.NewSink(
 			godogstats.WithStatsdHost(s.StatsdHost),
 			godogstats.WithStatsdPort(s.StatsdPort),
-			godogstats.WithMogrifierFromEnv(s.UseDogStatsdMogrifiers))
+			godogstats.WithMogrifierFromEnv(s.UseDogStatsdMogrifiers),
+			godogstats.WithRateLimitTags(s.DogStatsdRateLimitTags))
 		if err != nil {
 			logger.Fatalf("Failed to create dogstatsd sink: %v", err)
 		}
 		logger.Info("Stats initialized for dogstatsd")
-		store = gostats.NewStore(sink, false)
+		sink = dogStatsdSink
 	case s.UseStatsd:
 		if s.UseDogStatsd || s.UsePrometheus {
 			logger.Fatalf("Error: unable to use more than one stats sink at the same time. Set one of USE_DOG_STATSD, USE_STATSD, USE_PROMETHEUS.")
 		}
 		logger.Info("Stats initialized for statsd")
-		store = gostats.NewStore(gostats.NewTCPStatsdSink(gostats.WithStatsdHost(s.StatsdHost), gostats.WithStatsdPort(s.StatsdPort)), false)
+		sink = gostats.NewTCPStatsdSink(gostats.WithStatsdHost(s.StatsdHost), gostats.WithStatsdPort(s.StatsdPort))
 	case s.UsePrometheus:
 		if s.UseDogStatsd || s.UseStatsd {
 			logger.Fatalf("Error: unable to use more than one stats sink at the same time. Set one of USE_DOG_STATSD, USE_STATSD, USE_PROMETHEUS.")
 		}
 		logger.Info("Stats initialized for Prometheus")
-		store = gostats.NewStore(prom.NewPrometheusSink(prom.WithAddr(s.PrometheusAddr),
-			prom.WithPath(s.PrometheusPath), prom.WithMapperYamlPath(s.PrometheusMapperYaml)), false)
+		sink = prom.NewPrometheusSink(prom.WithAddr(s.PrometheusAddr),
+			prom.WithPath(s.PrometheusPath), prom.WithMapperYamlPath(s.PrometheusMapperYaml))
 	default:
 		logger.Info("Stats initialized for stdout")
-		store = gostats.NewStore(gostats.NewLoggingSink(), false)
+		sink = gostats.NewLoggingSink()
 	}
 
+	// the flushed stats are kept for the /stats endpoint
+	snapshot := stats.NewSnapshotSink(sink, s.StatsSnapshotMaxNames)
+	store := gostats.NewStore(snapshot, false)
+
 	logger.Infof("Stats flush interval: %s", s.StatsFlushInterval)
 
-	go store.Start(time.NewTicker(s.StatsFlushInterval))
+	ctx, cancel := context.WithCancel(context.Background())
+	go store.StartContext(ctx, time.NewTicker(s.StatsFlushInterval))
 
 	return Runner{
-		statsManager: stats.NewStatManager(store, s),
+		statsManager: stats.NewStatManager(store, s).WithSnapshot(snapshot),
 		settings:     s,
+		options:      o,
+		ready:        make(chan struct{}),
+		stopped:      ctx,
+		stop:         cancel,
 	}
 }
 
+// Ready returns a channel closed once the service is ready, a configuration having been loaded and
+// the backend reached, which /ready also reports.
+func (runner *Runner) Ready() <-chan struct{} {
+	return runner.ready
+}
+
 func (runner *Runner) GetStatsStore() gostats.Store {
 	return runner.statsManager.GetStatsStore()
 }
 
-func createLimiter(srv server.Server, s settings.Settings, localCache *freecache.Cache, statsManager stats.Manager) (limiter.RateLimitCache, io.Closer) {
-	switch s.BackendType {
-	case "redis", "":
-		return redis.NewRateLimiterCacheImplFromSettings(
-			s,
-			localCache,
-			srv,
-			utils.NewTimeSourceImpl(),
-			rand.New(utils.NewLockedSource(time.Now().Unix())),
-			s.ExpirationJitterMaxSeconds,
-			statsManager,
-		)
-	case "memcache":
-		return memcached.NewRateLimitCacheImplFromSettings(
-			s,
-			utils.NewTimeSourceImpl(),
-			rand.New(utils.NewLockedSource(time.Now().Unix())),
-			localCache,
-			srv.Scope(),
-			statsManager), &utils.MultiCloser{} // memcache client can't be closed
-	default:
-		logger.Fatalf("Invalid setting for BackendType: %s", s.BackendType)
-		panic("This line should not be reachable")
+// Run starts the service and serves it until the process receives SIGINT or SIGTERM, the startup
+// errors are fatal.
+func (runner *Runner) Run() {
+	if err := runner.setup(); err != nil {
+		logger.Fatal(err)
 	}
+	runner.srv.Start()
 }
 
-func (runner *Runner) Run() {
+// Start starts the service for the applications embedding it. It returns once the listeners are
+// open, the service being served in the background until Shutdown, or with the error that
+// prevented the startup. Unlike Run, it doesn't stop on SIGINT or SIGTERM, which are left to the
+// application. With SETTINGS_RELOAD_FILE, SIGHUP reloads the file until Shutdown.
+func (runner *Runner) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := runner.setup(); err != nil {
+		runner.Stop()
+		return err
+	}
+	if err := runner.srv.Listen(); err != nil {
+		runner.Stop()
+		return err
+	}
+	go runner.srv.Serve()
+	return nil
+}
+
+// Shutdown stops the service started by Start, waiting for the in-flight requests to complete
+// until ctx is done.
+func (runner *Runner) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		runner.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setup creates the server and registers the service on it, the startup panics, e.g. of an
+// unreachable backend, being returned as errors.
+func (runner *Runner) setup() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to start the ratelimit service: %v", r)
+		}
+	}()
+
 	s := runner.settings
 	if s.TracingEnabled {
-		tp := trace.InitProductionTraceProvider(s.TracingExporterProtocol, s.TracingServiceName, s.TracingServiceNamespace, s.TracingServiceInstanceId, s.TracingSamplingRate)
-		defer func() {
-			if err := tp.Shutdown(context.Background()); err != nil {
-				logger.Printf("Error shutting down tracer provider: %v", err)
-			}
-		}()
+		tp, err := trace.InitProductionTraceProvider(trace.ProviderConfig{
+			Protocol:           s.TracingExporterProtocol,
+			Endpoint:           s.TracingExporterEndpoint,
+			Headers:            s.TracingExporterHeaders,
+			Insecure:           s.TracingExporterInsecure,
+			ServiceName:        s.TracingServiceName,
+			ServiceNamespace:   s.TracingServiceNamespace,
+			ServiceInstanceId:  s.TracingServiceInstanceId,
+			ResourceAttributes: s.TracingResourceAttributes,
+			Sampler:            s.TracingSampler,
+			SamplingRate:       s.TracingSamplingRate,
+		})
+		if err != nil {
+			return err
+		}
+		runner.mu.Lock()
+		runner.tracerProvider = tp
+		runner.mu.Unlock()
 	} else {
 		logger.Infof("Tracing disabled")
 	}
 
 	logLevel, err := logger.ParseLevel(s.LogLevel)
 	if err != nil {
-		logger.Fatalf("Could not parse log level. %v\n", err)
-	} else {
-		logger.SetLevel(logLevel)
+		return fmt.Errorf("could not parse log level: %w", err)
+	}
+	logger.SetLevel(logLevel)
+	if !config.IsValidCacheKeyHash(s.CacheKeyHash) {
+		return fmt.Errorf("CACHE_KEY_HASH must be one of %s, %s or %s, got %s",
+			config.CacheKeyHashNone, config.CacheKeyHashXxhash, config.CacheKeyHashSha256, s.CacheKeyHash)
+	}
+	var extAuthzDescriptors [][]server.ExtAuthzEntry
+	if s.ExtAuthzEnabled {
+		if s.ExtAuthzDomain == "" {
+			return fmt.Errorf("EXT_AUTHZ_DOMAIN must not be empty with EXT_AUTHZ_ENABLED")
+		}
+		extAuthzDescriptors, err = server.ParseExtAuthzDescriptors(s.ExtAuthzDescriptors)
+		if err != nil {
+			return fmt.Errorf("invalid EXT_AUTHZ_DESCRIPTORS: %w", err)
+		}
 	}
 	if strings.ToLower(s.LogFormat) == "json" {
 		logger.SetFormatter(&logger.JSONFormatter{
@@ -150,16 +273,95 @@ func (runner *Runner) Run() {
 
 	serverReporter := metrics.NewServerReporter(runner.statsManager.GetStatsStore().ScopeWithTags("ratelimit_server", s.ExtraTags))
 
-	srv := server.NewServer(s, "ratelimit", runner.statsManager, localCache, settings.GrpcUnaryInterceptor(serverReporter.UnaryServerInterceptor()))
+	providerFactory := runner.options.providerFactory
+	if providerFactory == nil {
+		providerFactory = server.NewProvider
+	}
+	srv, err := server.NewServerWithProvider(s, "ratelimit", runner.statsManager, localCache, providerFactory,
+		settings.GrpcUnaryInterceptor(serverReporter.UnaryServerInterceptor()))
+	if err != nil {
+		return err
+	}
 	runner.mu.Lock()
 	runner.srv = srv
 	runner.mu.Unlock()
 
-	limiter, limiterCloser := createLimiter(srv, s, localCache, runner.statsManager)
+	rateLimitCache, limiterCloser, err := createLimiter(srv, s, localCache, runner.statsManager,
+		runner.options.cacheFactory)
+	if err != nil {
+		return err
+	}
+	runner.mu.Lock()
 	runner.ratelimitCloser = limiterCloser
+	runner.mu.Unlock()
+	// the readiness only waits for the backends which can be probed
+	if prober, ok := rateLimitCache.(limiter.BackendProber); ok {
+		srv.HealthChecker().ProbeBackend()
+		go runner.probeBackend(prober, srv.HealthChecker())
+	}
+	go func() {
+		select {
+		case <-srv.HealthChecker().Ready():
+			close(runner.ready)
+		case <-runner.stopped.Done():
+		}
+	}()
+	counterReader, _ := rateLimitCache.(limiter.CounterReader)
+	penaltyBox, _ := rateLimitCache.(limiter.PenaltyBox)
+	concurrencyLimiter, _ := rateLimitCache.(limiter.ConcurrencyLimiter)
+	refunder, _ := rateLimitCache.(limiter.Refunder)
+	reserver, _ := rateLimitCache.(limiter.Reserver)
+	counterScanner, _ := rateLimitCache.(limiter.CounterScanner)
+	nearLimitRatioSetter, _ := rateLimitCache.(limiter.NearLimitRatioSetter)
+	if cacheKeyMaxLengthSetter, ok := rateLimitCache.(limiter.CacheKeyMaxLengthSetter); ok && s.CacheKeyMaxLength > 0 {
+		cacheKeyMaxLengthSetter.SetCacheKeyMaxLength(s.CacheKeyMaxLength)
+	}
+	if jitterPolicySetter, ok := rateLimitCache.(limiter.ExpirationJitterPolicySetter); ok {
+		jitterPolicy, err := limiter.NewExpirationJitterPolicy(s.ExpirationJitterPerUnit, s.ExpirationJitterPercent)
+		if err != nil {
+			return err
+		}
+		jitterPolicySetter.SetExpirationJitterPolicy(jitterPolicy)
+	}
+	if !settings.ValidLimitScaleFactor(s.LimitScaleFactor) {
+		return fmt.Errorf("LIMIT_SCALE_FACTOR must be positive and finite, got %v", s.LimitScaleFactor)
+	}
+	if s.TopKeysEnabled && (s.TopKeysCapacity <= 0 || s.TopKeysWindow < time.Second) {
+		return fmt.Errorf("TOP_KEYS_CAPACITY must be positive and TOP_KEYS_WINDOW at least 1s, got %d and %v",
+			s.TopKeysCapacity, s.TopKeysWindow)
+	}
+	if s.DuplicateDomainPolicy != "" && !config.IsDomainConflictPolicy(s.DuplicateDomainPolicy) {
+		return fmt.Errorf("DUPLICATE_DOMAIN_POLICY must be one of %s, %s or %s, got %s",
+			config.DomainConflictError, config.DomainConflictMerge, config.DomainConflictLastWins, s.DuplicateDomainPolicy)
+	}
+	if s.CanaryEnabled && s.CanaryFailureThreshold < 1 {
+		return fmt.Errorf("CANARY_FAILURE_THRESHOLD must be at least 1, got %d", s.CanaryFailureThreshold)
+	}
+	if s.EventsEnabled && s.EventsBufferSize <= 0 {
+		return fmt.Errorf("EVENTS_BUFFER_SIZE must be positive, got %d", s.EventsBufferSize)
+	}
+	if localCachePolicySetter, ok := rateLimitCache.(limiter.LocalCachePolicySetter); ok && localCache != nil {
+		localCachePolicySetter.SetLocalCachePolicy(limiter.LocalCachePolicy{
+			MinTtl:           s.LocalCacheMinTtl,
+			MaxTtl:           s.LocalCacheMaxTtl,
+			NearLimit:        s.LocalCacheNearLimit,
+			PerSecond:        s.LocalCachePerSecond,
+			PerSecondMaxKeys: s.LocalCachePerSecondMaxKeys,
+		})
+	}
+	if s.CircuitBreakerEnabled {
+		breaker := limiter.NewCircuitBreaker(srv.Scope().Scope("circuit_breaker"), s.CircuitBreakerFailureThreshold, s.CircuitBreakerOpenDuration)
+		var fallback *limiter.LocalFallback
+		if s.FailureModeLocalFallback {
+			fallback = limiter.NewLocalFallback(srv.Scope().Scope("circuit_breaker").Scope("local_fallback"), utils.NewTimeSourceImpl(),
+				s.CacheKeyPrefix, s.FailureModeInstanceCount)
+		}
+		rateLimitCache = limiter.NewCircuitBreakerCache(rateLimitCache, breaker, s.FailureModeDeny, fallback)
+	}
+	rateLimitCache = limiter.NewDeadlineCache(rateLimitCache, srv.Scope(), s.BackendDeadlineMargin, s.FailureModeDeny)
 
 	service := ratelimit.NewService(
-		limiter,
+		rateLimitCache,
 		srv.Provider(),
 		runner.statsManager,
 		srv.HealthChecker(),
@@ -168,35 +370,194 @@ func (runner *Runner) Run() {
 		s.ForceStartWithoutInitialConfig,
 		s.HealthyWithAtLeastOneConfigLoaded,
 	)
+	limitScaleFactorSetter := service.(ratelimit.LimitScaleFactorSetter)
+	limitScaleFactorSetter.SetLimitScaleFactor(s.LimitScaleFactor)
+
+	// the broker follows the near limit ratio of the reloaded settings
+	var broker *events.Broker
+	if s.EventsEnabled {
+		broker = events.NewBroker(s.NearLimitRatio, s.EventsBufferSize, utils.NewTimeSourceImpl(), srv.Scope().Scope("events"))
+		service.(ratelimit.EventsSetter).SetEvents(broker)
+		events.RegisterEventsServer(srv.GrpcServer(), broker)
+	}
+
+	if s.SettingsReloadFile != "" {
+		failureModeSetter := rateLimitCache.(limiter.FailureModeSetter)
+		defaults := settings.Tunables{
+			NearLimitRatio:   s.NearLimitRatio,
+			LogLevel:         logLevel,
+			FailureModeDeny:  s.FailureModeDeny,
+			LimitScaleFactor: s.LimitScaleFactor,
+		}
+		reloader := settings.NewReloader(srv.Scope().Scope("settings_reload"), s.SettingsReloadFile, defaults,
+			func(tunables settings.Tunables) {
+				logger.SetLevel(tunables.LogLevel)
+				if nearLimitRatioSetter != nil {
+					nearLimitRatioSetter.SetNearLimitRatio(tunables.NearLimitRatio)
+				}
+				if broker != nil {
+					broker.SetNearLimitRatio(tunables.NearLimitRatio)
+				}
+				failureModeSetter.SetFailureModeDeny(tunables.FailureModeDeny)
+				limitScaleFactorSetter.SetLimitScaleFactor(tunables.LimitScaleFactor)
+			})
+		runner.mu.Lock()
+		runner.reloader = reloader
+		runner.mu.Unlock()
+		reloader.Start(s.SettingsReloadInterval)
+	}
 
 	srv.AddDebugHttpEndpoint(
 		"/rlconfig",
-		"print out the currently loaded configuration for debugging",
+		"print out the currently loaded configuration for debugging, as a JSON descriptor tree with ?format=json",
 		func(writer http.ResponseWriter, request *http.Request) {
-			if current, _ := service.GetCurrentConfig(); current != nil {
+			current, _ := service.GetCurrentConfig()
+			if request.URL.Query().Get("format") == "json" {
+				tree := []*config.DomainDump{}
+				if current != nil {
+					tree = current.DumpTree()
+				}
+				writer.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(writer).Encode(tree); err != nil {
+					logger.Errorf("failed to write the config dump: %v", err)
+				}
+				return
+			}
+			if current != nil {
 				io.WriteString(writer, current.Dump())
 			}
 		})
 
+	srv.AddDebugHttpEndpoint(
+		"/rule_matches",
+		"print out the descriptors which matched each rule since the start, of ?domain only, the rules without matches with ?unmatched=true",
+		server.NewRuleMatchesHandler(service, runner.statsManager))
+
+	if counterReader != nil {
+		srv.AddDebugHttpEndpoint(
+			"/check",
+			"POST a ShouldRateLimit request in JSON to get the matched rules and their counters without incrementing them",
+			server.NewCheckHandler(service, counterReader))
+	}
+
+	if penaltyBox != nil {
+		srv.AddDebugHttpEndpoint(
+			"/penalty_box",
+			"POST a ShouldRateLimit request in JSON to get the bans of its descriptors, DELETE it to release them from the penalty box",
+			server.NewPenaltyBoxHandler(service, penaltyBox))
+	}
+
+	if s.TopKeysEnabled {
+		tracker := topkeys.NewTracker(s.TopKeysCapacity, s.TopKeysWindow, utils.NewTimeSourceImpl())
+		service.(ratelimit.TopKeysSetter).SetTopKeys(tracker)
+		srv.AddDebugHttpEndpoint(
+			"/topkeys",
+			"print out the heaviest descriptors of each domain with their estimated rate, of ?domain only, the ?n heaviest",
+			server.NewTopKeysHandler(tracker))
+	}
+
 	srv.AddJsonHandler(service)
+	srv.AddUsageHandler(service, counterReader, counterScanner, s.UsageMaxCounters, s.UsageMaxScans)
+	if concurrencyLimiter != nil {
+		srv.AddConcurrencyHandler(service, concurrencyLimiter)
+	}
+	if refunder != nil {
+		srv.AddRefundHandler(service, refunder)
+	}
+	if reserver != nil {
+		srv.AddReservationHandler(service, reserver, s.ReservationTtl, s.ReservationMaxTtl)
+	}
 
 	// Ratelimit is compatible with the below proto definition
 	// data-plane-api v3 rls.proto: https://github.com/envoyproxy/data-plane-api/blob/master/envoy/service/ratelimit/v3/rls.proto
-	// v2 proto is no longer supported
+	// v2 proto is only served with GRPC_V2_API_ENABLED, for the fleets migrating to v3
 	pb.RegisterRateLimitServiceServer(srv.GrpcServer(), service)
+	if s.GrpcV2ApiEnabled {
+		pb_v2.RegisterRateLimitServiceServer(srv.GrpcServer(), server.NewRateLimitServiceV2(service, srv.Scope().Scope("v2_api")))
+	}
+
+	if s.ExtAuthzEnabled {
+		auth.RegisterAuthorizationServer(srv.GrpcServer(),
+			server.NewExtAuthzServer(service, s.ExtAuthzDomain, extAuthzDescriptors, srv.Scope().Scope("ext_authz")))
+	}
+
+	if s.CanaryEnabled {
+		c := canary.NewCanary(service, srv.HealthChecker(), runner.statsManager.GetStatsStore().ScopeWithTags("ratelimit", s.ExtraTags).Scope("canary"), s)
+		runner.mu.Lock()
+		runner.canary = c
+		runner.mu.Unlock()
+		c.Start()
+	}
+
+	if s.ProfilingPushUrl != "" {
+		if s.ProfilingPushInterval <= 0 {
+			return fmt.Errorf("invalid PROFILING_PUSH_INTERVAL %s, must be positive", s.ProfilingPushInterval)
+		}
+		if s.ProfilingCpuDuration <= 0 || s.ProfilingCpuDuration >= s.ProfilingPushInterval {
+			return fmt.Errorf("invalid PROFILING_CPU_DURATION %s, must be positive and less than PROFILING_PUSH_INTERVAL",
+				s.ProfilingCpuDuration)
+		}
+		p := profiling.NewPusher(s, runner.statsManager.GetStatsStore().ScopeWithTags("ratelimit", s.ExtraTags).Scope("profiling"))
+		runner.mu.Lock()
+		runner.profilePusher = p
+		runner.mu.Unlock()
+		p.Start()
+	}
 
-	srv.Start()
+	return nil
+}
+
+// backendProbeInterval is the interval of the probes of a backend until it is reached.
+const backendProbeInterval = time.Second
+
+// probeBackend probes the backend until it is reached or the runner stops.
+func (runner *Runner) probeBackend(prober limiter.BackendProber, healthChecker *server.HealthChecker) {
+	for {
+		err := prober.ProbeBackend()
+		if err == nil {
+			healthChecker.BackendReachable()
+			return
+		}
+		logger.Warnf("the rate limit backend is not reachable: %v", err)
+		select {
+		case <-time.After(backendProbeInterval):
+		case <-runner.stopped.Done():
+			return
+		}
+	}
 }
 
 func (runner *Runner) Stop() {
 	runner.mu.Lock()
 	srv := runner.srv
+	c := runner.canary
+	p := runner.profilePusher
+	closer := runner.ratelimitCloser
+	tp := runner.tracerProvider
+	reloader := runner.reloader
 	runner.mu.Unlock()
+	if reloader != nil {
+		reloader.Stop()
+	}
+	if c != nil {
+		c.Stop()
+	}
+	if p != nil {
+		p.Stop()
+	}
 	if srv != nil {
 		srv.Stop()
 	}
 
-	if runner.ratelimitCloser != nil {
-		_ = runner.ratelimitCloser.Close()
+	if closer != nil {
+		_ = closer.Close()
+	}
+	if tp != nil {
+		if err := tp.Shutdown(context.Background()); err != nil {
+			logger.Printf("Error shutting down tracer provider: %v", err)
+		}
+	}
+	if runner.stop != nil {
+		runner.stop()
 	}
 }
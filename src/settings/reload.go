@@ -0,0 +1,190 @@
+package settings
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+)
+
+// Tunables are the settings which can be changed without a restart, by the file of
+// SETTINGS_RELOAD_FILE. The file holds KEY=VALUE lines with the same keys as the environment.
+type Tunables struct {
+	NearLimitRatio   float32
+	LogLevel         logger.Level
+	FailureModeDeny  bool
+	LimitScaleFactor float64
+}
+
+// ParseTunables returns base overridden by the KEY=VALUE lines of contents. Blank lines and lines
+// starting with # are ignored. An unknown key or an invalid value is an error.
+func ParseTunables(base Tunables, contents []byte) (Tunables, error) {
+	ret := base
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return base, fmt.Errorf("line %d: expected KEY=VALUE", lineNumber)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "NEAR_LIMIT_RATIO":
+			ratio, err := strconv.ParseFloat(value, 32)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				return base, fmt.Errorf("line %d: NEAR_LIMIT_RATIO must be in (0, 1], got %q", lineNumber, value)
+			}
+			ret.NearLimitRatio = float32(ratio)
+		case "LOG_LEVEL":
+			level, err := logger.ParseLevel(value)
+			if err != nil {
+				return base, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			ret.LogLevel = level
+		case "FAILURE_MODE_DENY":
+			deny, err := strconv.ParseBool(value)
+			if err != nil {
+				return base, fmt.Errorf("line %d: FAILURE_MODE_DENY must be a boolean, got %q", lineNumber, value)
+			}
+			ret.FailureModeDeny = deny
+		case "LIMIT_SCALE_FACTOR":
+			factor, err := strconv.ParseFloat(value, 64)
+			if err != nil || !ValidLimitScaleFactor(factor) {
+				return base, fmt.Errorf("line %d: LIMIT_SCALE_FACTOR must be positive and finite, got %q", lineNumber, value)
+			}
+			ret.LimitScaleFactor = factor
+		default:
+			return base, fmt.Errorf("line %d: %s cannot be reloaded", lineNumber, key)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// ValidLimitScaleFactor returns whether factor can scale the limits: positive, and neither NaN nor
+// infinite, which would turn every limit into 0 or the maximum.
+func ValidLimitScaleFactor(factor float64) bool {
+	return factor > 0 && !math.IsInf(factor, 1)
+}
+
+type reloadStats struct {
+	applied  gostats.Counter
+	rejected gostats.Counter
+}
+
+func newReloadStats(scope gostats.Scope) reloadStats {
+	ret := reloadStats{}
+	ret.applied = scope.NewCounter("applied")
+	ret.rejected = scope.NewCounter("rejected")
+	return ret
+}
+
+// Reloader applies the tunables of a file when it changes, and on SIGHUP. The keys missing from
+// the file take their value from the environment at startup.
+type Reloader struct {
+	mu           sync.Mutex
+	path         string
+	defaults     Tunables
+	apply        func(Tunables)
+	lastContents []byte
+	stats        reloadStats
+	started      atomic.Bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+}
+
+func NewReloader(scope gostats.Scope, path string, defaults Tunables, apply func(Tunables)) *Reloader {
+	return &Reloader{
+		path:     path,
+		defaults: defaults,
+		apply:    apply,
+		stats:    newReloadStats(scope),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Reload reads the file and applies its tunables if they are valid. Unless force, an unchanged
+// file is not applied again.
+func (this *Reloader) Reload(force bool) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	contents, err := os.ReadFile(this.path)
+	if err == nil && !force && this.lastContents != nil && bytes.Equal(contents, this.lastContents) {
+		return nil
+	}
+	var tunables Tunables
+	if err == nil {
+		tunables, err = ParseTunables(this.defaults, contents)
+	}
+	if err != nil {
+		this.stats.rejected.Inc()
+		logger.Warnf("settings reload from %s rejected: %v", this.path, err)
+		return err
+	}
+
+	this.lastContents = contents
+	this.apply(tunables)
+	this.stats.applied.Inc()
+	logger.Infof("settings reloaded from %s: %+v", this.path, tunables)
+	return nil
+}
+
+// Start applies the file, then reloads it on SIGHUP and, if pollInterval is positive, whenever
+// its contents change, until Stop is called.
+func (this *Reloader) Start(pollInterval time.Duration) {
+	this.Reload(true)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	var poll <-chan time.Time
+	var ticker *time.Ticker
+	if pollInterval > 0 {
+		ticker = time.NewTicker(pollInterval)
+		poll = ticker.C
+	}
+
+	this.started.Store(true)
+	go func() {
+		defer close(this.done)
+		defer signal.Stop(sighup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-sighup:
+				this.Reload(true)
+			case <-poll:
+				this.Reload(false)
+			case <-this.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reloads of Start, SIGHUP going back to its default handling, and waits for the
+// reload in progress.
+func (this *Reloader) Stop() {
+	this.stopOnce.Do(func() { close(this.stop) })
+	if this.started.Load() {
+		<-this.done
+	}
+}
@@ -0,0 +1,101 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTunables(t *testing.T) {
+	base := Tunables{NearLimitRatio: 0.8, LogLevel: logger.WarnLevel, FailureModeDeny: false}
+
+	tunables, err := ParseTunables(base, []byte("# tunables\nNEAR_LIMIT_RATIO=0.5\n\nLOG_LEVEL = debug\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, Tunables{NearLimitRatio: 0.5, LogLevel: logger.DebugLevel, FailureModeDeny: false}, tunables)
+
+	for _, contents := range []string{
+		"NEAR_LIMIT_RATIO=1.5",
+		"NEAR_LIMIT_RATIO=0",
+		"LOG_LEVEL=loud",
+		"FAILURE_MODE_DENY=maybe",
+		"REDIS_URL=localhost:6379",
+		"FAILURE_MODE_DENY",
+		"LIMIT_SCALE_FACTOR=0",
+		"LIMIT_SCALE_FACTOR=half",
+		"LIMIT_SCALE_FACTOR=NaN",
+		"LIMIT_SCALE_FACTOR=+Inf",
+	} {
+		tunables, err = ParseTunables(base, []byte(contents))
+		assert.NotNil(t, err, contents)
+		assert.Equal(t, base, tunables)
+	}
+
+	tunables, err = ParseTunables(base, []byte("LIMIT_SCALE_FACTOR=0.5\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, tunables.LimitScaleFactor)
+}
+
+func TestReloader(t *testing.T) {
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	path := filepath.Join(t.TempDir(), "tunables")
+	base := Tunables{NearLimitRatio: 0.8, LogLevel: logger.WarnLevel, FailureModeDeny: false}
+	var applied []Tunables
+	reloader := NewReloader(store.Scope("settings_reload"), path, base, func(tunables Tunables) {
+		applied = append(applied, tunables)
+	})
+
+	// A missing file is rejected.
+	assert.NotNil(t, reloader.Reload(false))
+	assert.EqualValues(t, 1, store.NewCounter("settings_reload.rejected").Value())
+
+	assert.Nil(t, os.WriteFile(path, []byte("FAILURE_MODE_DENY=true\n"), 0o644))
+	assert.Nil(t, reloader.Reload(false))
+	assert.Equal(t, []Tunables{{NearLimitRatio: 0.8, LogLevel: logger.WarnLevel, FailureModeDeny: true}}, applied)
+
+	// An unchanged file is only applied again when forced.
+	assert.Nil(t, reloader.Reload(false))
+	assert.Len(t, applied, 1)
+	assert.Nil(t, reloader.Reload(true))
+	assert.Len(t, applied, 2)
+	assert.EqualValues(t, 2, store.NewCounter("settings_reload.applied").Value())
+
+	// An invalid file keeps the tunables applied.
+	assert.Nil(t, os.WriteFile(path, []byte("NEAR_LIMIT_RATIO=2\n"), 0o644))
+	assert.NotNil(t, reloader.Reload(false))
+	assert.Len(t, applied, 2)
+	assert.EqualValues(t, 2, store.NewCounter("settings_reload.rejected").Value())
+
+	// The keys removed from the file go back to their startup value.
+	assert.Nil(t, os.WriteFile(path, []byte("NEAR_LIMIT_RATIO=0.9\n"), 0o644))
+	assert.Nil(t, reloader.Reload(false))
+	assert.Equal(t, Tunables{NearLimitRatio: 0.9, LogLevel: logger.WarnLevel, FailureModeDeny: false}, applied[2])
+}
+
+func TestReloaderStop(t *testing.T) {
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	path := filepath.Join(t.TempDir(), "tunables")
+	assert.Nil(t, os.WriteFile(path, []byte("NEAR_LIMIT_RATIO=0.5\n"), 0o644))
+	var applied atomic.Int32
+	reloader := NewReloader(store.Scope("settings_reload"), path, Tunables{}, func(Tunables) { applied.Add(1) })
+
+	reloader.Start(time.Millisecond)
+	assert.EqualValues(t, 1, applied.Load())
+	assert.Nil(t, os.WriteFile(path, []byte("NEAR_LIMIT_RATIO=0.6\n"), 0o644))
+	assert.Eventually(t, func() bool { return applied.Load() == 2 }, time.Second, time.Millisecond)
+
+	// The changes of the file are no longer polled once stopped.
+	reloader.Stop()
+	assert.Nil(t, os.WriteFile(path, []byte("NEAR_LIMIT_RATIO=0.7\n"), 0o644))
+	time.Sleep(20 * time.Millisecond)
+	assert.EqualValues(t, 2, applied.Load())
+
+	// Stop can be called again, and before Start.
+	reloader.Stop()
+	NewReloader(store.Scope("settings_reload"), path, Tunables{}, func(Tunables) {}).Stop()
+}
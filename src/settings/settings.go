@@ -2,6 +2,8 @@ package settings
 
 import (
 	"crypto/tls"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -26,6 +28,35 @@ type Settings struct {
 	GrpcUds  string `envconfig:"GRPC_UDS" default:""`
 	GrpcHost string `envconfig:"GRPC_HOST" default:"0.0.0.0"`
 	GrpcPort int    `envconfig:"GRPC_PORT" default:"8081"`
+	// GrpcSocketType is tcp or unix, unix listening on the socket at GrpcUds.
+	GrpcSocketType string `envconfig:"GRPC_SOCKET_TYPE" default:"tcp"`
+	// DebugSocketType is tcp or unix, unix listening on the socket at DebugUds rather than
+	// DebugHost:DebugPort. A DebugUds without a socket type is a unix domain socket as well.
+	DebugSocketType string `envconfig:"DEBUG_SOCKET_TYPE" default:"tcp"`
+	DebugUds        string `envconfig:"DEBUG_UDS" default:""`
+	// UdsFileMode are the octal permissions of the unix domain sockets, e.g. 0660 for the clients
+	// of the same group, left to the umask when empty.
+	UdsFileMode string `envconfig:"UDS_FILE_MODE" default:""`
+	// The CIDRs, or IP addresses, of the clients admitted by the gRPC and debug listeners, all when
+	// empty, and of the clients they deny, the denylist taking precedence.
+	GrpcAllowedCidrs  []string `envconfig:"GRPC_ALLOWED_CIDRS" default:""`
+	GrpcDeniedCidrs   []string `envconfig:"GRPC_DENIED_CIDRS" default:""`
+	DebugAllowedCidrs []string `envconfig:"DEBUG_ALLOWED_CIDRS" default:""`
+	DebugDeniedCidrs  []string `envconfig:"DEBUG_DENIED_CIDRS" default:""`
+	// DebugPprofEnabled serves the pprof profiles under /debug/pprof/ on the debug port. The mutex and
+	// block profiles sample the events at the given rates, see runtime.SetMutexProfileFraction and
+	// runtime.SetBlockProfileRate, and stay empty at 0.
+	DebugPprofEnabled         bool `envconfig:"DEBUG_PPROF_ENABLED" default:"true"`
+	PprofMutexProfileFraction int  `envconfig:"PPROF_MUTEX_PROFILE_FRACTION" default:"0"`
+	PprofBlockProfileRate     int  `envconfig:"PPROF_BLOCK_PROFILE_RATE" default:"0"`
+	// Continuous profiling: the CPU and heap profiles are pushed every ProfilingPushInterval to the
+	// pyroscope compatible ingestion API at ProfilingPushUrl, under the ProfilingAppName application.
+	// The CPU is profiled for the first ProfilingCpuDuration of each interval only, leaving the
+	// profiler to /debug/pprof/profile for the rest of it.
+	ProfilingPushUrl      string        `envconfig:"PROFILING_PUSH_URL" default:""`
+	ProfilingPushInterval time.Duration `envconfig:"PROFILING_PUSH_INTERVAL" default:"10s"`
+	ProfilingCpuDuration  time.Duration `envconfig:"PROFILING_CPU_DURATION" default:"5s"`
+	ProfilingAppName      string        `envconfig:"PROFILING_APP_NAME" default:"ratelimit"`
 	// GrpcServerTlsConfig configures grpc for the server
 	GrpcServerTlsConfig *tls.Config
 	// GrpcMaxConnectionAge is a duration for the maximum amount of time a connection may exist before it will be closed by sending a GoAway.
@@ -33,6 +64,19 @@ type Settings struct {
 	GrpcMaxConnectionAge time.Duration `envconfig:"GRPC_MAX_CONNECTION_AGE" default:"24h" description:"Duration a connection may exist before it will be closed by sending a GoAway."`
 	// GrpcMaxConnectionAgeGrace is an additive period after MaxConnectionAge after which the connection will be forcibly closed.
 	GrpcMaxConnectionAgeGrace time.Duration `envconfig:"GRPC_MAX_CONNECTION_AGE_GRACE" default:"1h" description:"Period after MaxConnectionAge after which the connection will be forcibly closed."`
+	// GrpcMaxConnectionIdle closes the connections without calls for this long, 0 keeps them open.
+	GrpcMaxConnectionIdle time.Duration `envconfig:"GRPC_MAX_CONNECTION_IDLE" default:"0s"`
+	// GrpcKeepaliveTime pings the client after this long without activity, and GrpcKeepaliveTimeout
+	// closes the connection if the ping is not acknowledged in time.
+	GrpcKeepaliveTime    time.Duration `envconfig:"GRPC_KEEPALIVE_TIME" default:"2h"`
+	GrpcKeepaliveTimeout time.Duration `envconfig:"GRPC_KEEPALIVE_TIMEOUT" default:"20s"`
+	// GrpcKeepaliveMinTime is the minimum interval of the client pings, the connections of the
+	// clients pinging more often are closed. GrpcKeepalivePermitWithoutStream allows the pings of
+	// the clients without calls in flight.
+	GrpcKeepaliveMinTime             time.Duration `envconfig:"GRPC_KEEPALIVE_MIN_TIME" default:"5m"`
+	GrpcKeepalivePermitWithoutStream bool          `envconfig:"GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM" default:"false"`
+	// GrpcMaxConcurrentStreams bounds the calls in flight on each connection, 0 does not bound them.
+	GrpcMaxConcurrentStreams uint32 `envconfig:"GRPC_MAX_CONCURRENT_STREAMS" default:"0"`
 	// GrpcServerUseTLS enables gprc connections to server over TLS
 	GrpcServerUseTLS bool `envconfig:"GRPC_SERVER_USE_TLS" default:"false"`
 	// Allow to set the server certificate and key for TLS connections.
@@ -45,13 +89,78 @@ type Settings struct {
 	GrpcClientTlsCACert string `envconfig:"GRPC_CLIENT_TLS_CACERT" default:""`
 	// GrpcClientTlsSAN is the SAN to validate from the client cert during mTLS auth
 	GrpcClientTlsSAN string `envconfig:"GRPC_CLIENT_TLS_SAN" default:""`
+	// GrpcClientTlsAllowedSans lists the client cert SANs allowed during mTLS auth, DNS names, URIs
+	// e.g. SPIFFE IDs, emails or IP addresses, a trailing '*' allowing a prefix.
+	GrpcClientTlsAllowedSans []string `envconfig:"GRPC_CLIENT_TLS_ALLOWED_SANS" default:""`
+	// GrpcServerTlsSdsSecretName fetches the server certificate and key from the SDS secret of this
+	// name instead of GrpcServerTlsCert and GrpcServerTlsKey. The SDS server is dialed like the xDS
+	// Management Server, at GrpcServerTlsSdsServerUrl if set or else at ConfigGrpcXdsServerUrl.
+	GrpcServerTlsSdsSecretName          string        `envconfig:"GRPC_SERVER_TLS_SDS_SECRET_NAME" default:""`
+	GrpcServerTlsSdsServerUrl           string        `envconfig:"GRPC_SERVER_TLS_SDS_SERVER_URL" default:""`
+	GrpcServerTlsSdsInitialFetchTimeout time.Duration `envconfig:"GRPC_SERVER_TLS_SDS_INITIAL_FETCH_TIMEOUT" default:"10s"`
+	// OverloadMaxInFlight bounds the ShouldRateLimit calls in flight, 0 disables the bound. A call
+	// beyond it waits up to OverloadMaxQueueWait, then it is shed with OverloadShedCode.
+	// Possible values of OverloadShedCode: "OK", "UNAVAILABLE".
+	OverloadMaxInFlight  int           `envconfig:"OVERLOAD_MAX_IN_FLIGHT" default:"0"`
+	OverloadMaxQueueWait time.Duration `envconfig:"OVERLOAD_MAX_QUEUE_WAIT" default:"0s"`
+	OverloadShedCode     string        `envconfig:"OVERLOAD_SHED_CODE" default:"UNAVAILABLE"`
+	// GrpcV2ApiEnabled registers the legacy envoy.service.ratelimit.v2 RateLimitService on the gRPC
+	// server along with the v3 one, for the fleets migrating from the v2 API.
+	GrpcV2ApiEnabled bool `envconfig:"GRPC_V2_API_ENABLED" default:"false"`
+	// ExtAuthzEnabled registers an Envoy ext_authz Authorization service on the gRPC server, whose
+	// CheckRequests are rate limited in ExtAuthzDomain with the descriptors of ExtAuthzDescriptors,
+	// e.g. "remote_address=source.address;path=request.http.path,user=request.http.headers.x-user-id".
+	ExtAuthzEnabled     bool   `envconfig:"EXT_AUTHZ_ENABLED" default:"false"`
+	ExtAuthzDomain      string `envconfig:"EXT_AUTHZ_DOMAIN" default:""`
+	ExtAuthzDescriptors string `envconfig:"EXT_AUTHZ_DESCRIPTORS" default:""`
+	// GrpcAuthApiKeys authenticates the gRPC callers by API key, a map of the caller names to their
+	// key, e.g. "tool1:key1,tool2:key2", the key being sent in the GrpcAuthApiKeyHeader metadata.
+	GrpcAuthApiKeys      map[string]string `envconfig:"GRPC_AUTH_API_KEYS" default:""`
+	GrpcAuthApiKeyHeader string            `envconfig:"GRPC_AUTH_API_KEY_HEADER" default:"x-api-key"`
+	// GrpcAuthJwksUri authenticates the gRPC callers by the JWT bearer tokens signed with the keys of
+	// this JWKS, an http(s) URL or a file, the caller being the GrpcAuthJwtCallerClaim of a token.
+	// The issuer and audience of the tokens are not checked when empty.
+	GrpcAuthJwksUri             string        `envconfig:"GRPC_AUTH_JWKS_URI" default:""`
+	GrpcAuthJwksRefreshInterval time.Duration `envconfig:"GRPC_AUTH_JWKS_REFRESH_INTERVAL" default:"5m"`
+	GrpcAuthJwtIssuer           string        `envconfig:"GRPC_AUTH_JWT_ISSUER" default:""`
+	GrpcAuthJwtAudience         string        `envconfig:"GRPC_AUTH_JWT_AUDIENCE" default:""`
+	GrpcAuthJwtCallerClaim      string        `envconfig:"GRPC_AUTH_JWT_CALLER_CLAIM" default:"sub"`
+	// CallerRateLimitPerSecond bounds the gRPC calls of each caller, the authenticated caller or
+	// else the SAN of its client certificate or else its IP address, with bursts of up to
+	// CallerRateLimitBurst calls, CallerRateLimitPerSecond when 0. 0 disables the bound.
+	CallerRateLimitPerSecond float64 `envconfig:"CALLER_RATE_LIMIT_PER_SECOND" default:"0"`
+	CallerRateLimitBurst     int     `envconfig:"CALLER_RATE_LIMIT_BURST" default:"0"`
+	// ReservationTtl is the hold of the reservations of /ratelimit/v3/reservations without a ttl
+	// parameter, ReservationMaxTtl the longest hold a reservation can ask for.
+	ReservationTtl    time.Duration `envconfig:"RESERVATION_TTL" default:"30s"`
+	ReservationMaxTtl time.Duration `envconfig:"RESERVATION_MAX_TTL" default:"10m"`
+	// TopKeysEnabled tracks the heaviest descriptors of each domain, listed on the /topkeys debug
+	// endpoint, counting the hits of TopKeysCapacity descriptors per domain over TopKeysWindow.
+	TopKeysEnabled  bool          `envconfig:"TOP_KEYS_ENABLED" default:"false"`
+	TopKeysCapacity int           `envconfig:"TOP_KEYS_CAPACITY" default:"100"`
+	TopKeysWindow   time.Duration `envconfig:"TOP_KEYS_WINDOW" default:"1m"`
+	// UsageMaxCounters is the most counters a GET of /ratelimit/v3/usage lists, and UsageMaxScans the
+	// most SCAN commands it sends, each one examining about 1000 keys.
+	UsageMaxCounters int `envconfig:"USAGE_MAX_COUNTERS" default:"1000"`
+	UsageMaxScans    int `envconfig:"USAGE_MAX_SCANS" default:"100"`
+	// EventsEnabled serves the near limit and over limit transitions of the descriptors on the
+	// ratelimit.events.v1.RateLimitEvents gRPC service, buffering EventsBufferSize events per
+	// subscriber.
+	EventsEnabled    bool `envconfig:"EVENTS_ENABLED" default:"false"`
+	EventsBufferSize int  `envconfig:"EVENTS_BUFFER_SIZE" default:"100"`
 	// Logging settings
 	LogLevel  string `envconfig:"LOG_LEVEL" default:"WARN"`
 	LogFormat string `envconfig:"LOG_FORMAT" default:"text"`
+	// RequestLogSamplesPerSecond logs up to this many ShouldRateLimit requests per second with
+	// their decisions at INFO level, whatever LogLevel is. 0 disables the sampling.
+	RequestLogSamplesPerSecond int `envconfig:"REQUEST_LOG_SAMPLES_PER_SECOND" default:"0"`
 
 	// Rate limit configuration
-	// ConfigType is the method of configuring rate limits. Possible values "FILE", "GRPC_XDS_SOTW".
+	// ConfigType is the method of configuring rate limits. Possible values "FILE", "GRPC_XDS_SOTW", "GRPC_XDS_DELTA", "KUBERNETES", "CONSUL", "OBJECT_STORE",
+	// "FILE_AND_GRPC_XDS_SOTW", "FILE_AND_GRPC_XDS_DELTA".
 	ConfigType string `envconfig:"CONFIG_TYPE" default:"FILE"`
+	// ConfigMergePrecedence is the provider whose domains win when the file and xDS configurations are merged. Possible values "XDS", "FILE".
+	ConfigMergePrecedence string `envconfig:"CONFIG_MERGE_PRECEDENCE" default:"XDS"`
 	// ForceStartWithoutInitialConfig enables start the server without initial rate limit config event
 	ForceStartWithoutInitialConfig bool `envconfig:"FORCE_START_WITHOUT_INITIAL_CONFIG" default:"false"`
 
@@ -72,6 +181,14 @@ type Settings struct {
 	// GrpcClientTlsSAN is the SAN to validate from the client cert during mTLS auth
 	ConfigGrpcXdsServerTlsSAN string `envconfig:"CONFIG_GRPC_XDS_SERVER_TLS_SAN" default:""`
 
+	// xDS config server token authentication
+	// ConfigGrpcXdsClientToken is a static bearer token sent to the xDS Management Server
+	ConfigGrpcXdsClientToken string `envconfig:"CONFIG_GRPC_XDS_CLIENT_TOKEN" default:""`
+	// ConfigGrpcXdsClientTokenFile is a file containing the bearer token, re-read every ConfigGrpcXdsClientTokenRefreshInterval.
+	// Takes precedence over ConfigGrpcXdsClientToken.
+	ConfigGrpcXdsClientTokenFile            string        `envconfig:"CONFIG_GRPC_XDS_CLIENT_TOKEN_FILE" default:""`
+	ConfigGrpcXdsClientTokenRefreshInterval time.Duration `envconfig:"CONFIG_GRPC_XDS_CLIENT_TOKEN_REFRESH_INTERVAL" default:"60s"`
+
 	// xDS client backoff configuration
 	XdsClientBackoffInitialInterval time.Duration `envconfig:"XDS_CLIENT_BACKOFF_INITIAL_INTERVAL" default:"10s"`
 	XdsClientBackoffMaxInterval     time.Duration `envconfig:"XDS_CLIENT_BACKOFF_MAX_INTERVAL" default:"60s"`
@@ -81,9 +198,45 @@ type Settings struct {
 	// xDS client gRPC options
 	XdsClientGrpcOptionsMaxMsgSizeInBytes int `envconfig:"XDS_CLIENT_MAX_MSG_SIZE_IN_BYTES" default:""`
 
+	// Kubernetes ConfigMap rate limit configuration
+	// KubernetesApiServerUrl is the Kubernetes API server. Defaults to the in-cluster API server.
+	KubernetesApiServerUrl string `envconfig:"KUBERNETES_API_SERVER_URL" default:""`
+	// KubernetesConfigNamespace is the namespace of the ConfigMaps. Defaults to the namespace of the service account.
+	KubernetesConfigNamespace      string        `envconfig:"KUBERNETES_CONFIG_NAMESPACE" default:""`
+	KubernetesConfigLabelSelector  string        `envconfig:"KUBERNETES_CONFIG_LABEL_SELECTOR" default:"ratelimit.envoyproxy.io/config=true"`
+	KubernetesTokenFile            string        `envconfig:"KUBERNETES_TOKEN_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	KubernetesCACert               string        `envconfig:"KUBERNETES_CA_CERT" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"`
+	KubernetesNamespaceFile        string        `envconfig:"KUBERNETES_NAMESPACE_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/namespace"`
+	KubernetesRetryInitialInterval time.Duration `envconfig:"KUBERNETES_RETRY_INITIAL_INTERVAL" default:"1s"`
+	KubernetesRetryMaxInterval     time.Duration `envconfig:"KUBERNETES_RETRY_MAX_INTERVAL" default:"30s"`
+
+	// Consul KV rate limit configuration
+	ConsulAddress string `envconfig:"CONSUL_ADDRESS" default:"http://localhost:8500"`
+	// ConsulKVPrefix is the key prefix watched for domain configurations, every key under it is a config file.
+	ConsulKVPrefix             string        `envconfig:"CONSUL_KV_PREFIX" default:"ratelimit/config/"`
+	ConsulToken                string        `envconfig:"CONSUL_TOKEN" default:""`
+	ConsulWaitTime             time.Duration `envconfig:"CONSUL_WAIT_TIME" default:"5m"`
+	ConsulRetryInitialInterval time.Duration `envconfig:"CONSUL_RETRY_INITIAL_INTERVAL" default:"1s"`
+	ConsulRetryMaxInterval     time.Duration `envconfig:"CONSUL_RETRY_MAX_INTERVAL" default:"30s"`
+
+	// Object store (S3/GCS) rate limit configuration
+	// ObjectStoreUrls are the config objects to poll, e.g. "s3://bucket/ratelimit/foo.yaml,gs://bucket/bar.yaml"
+	ObjectStoreUrls         []string      `envconfig:"OBJECT_STORE_URLS" default:""`
+	ObjectStorePollInterval time.Duration `envconfig:"OBJECT_STORE_POLL_INTERVAL" default:"30s"`
+	ObjectStoreS3Region     string        `envconfig:"OBJECT_STORE_S3_REGION" default:"us-east-1"`
+	// ObjectStoreS3Endpoint overrides the S3 endpoint for S3 compatible stores, objects are then addressed path-style
+	ObjectStoreS3Endpoint   string `envconfig:"OBJECT_STORE_S3_ENDPOINT" default:""`
+	ObjectStoreGcsEndpoint  string `envconfig:"OBJECT_STORE_GCS_ENDPOINT" default:"https://storage.googleapis.com"`
+	ObjectStoreGcsTokenFile string `envconfig:"OBJECT_STORE_GCS_TOKEN_FILE" default:""`
+	AwsAccessKeyId          string `envconfig:"AWS_ACCESS_KEY_ID" default:""`
+	AwsSecretAccessKey      string `envconfig:"AWS_SECRET_ACCESS_KEY" default:""`
+	AwsSessionToken         string `envconfig:"AWS_SESSION_TOKEN" default:""`
+
 	// Stats-related settings
-	UseDogStatsd           bool              `envconfig:"USE_DOG_STATSD" default:"false"`
-	UseDogStatsdMogrifiers []string          `envconfig:"USE_DOG_STATSD_MOGRIFIERS" default:""`
+	UseDogStatsd           bool     `envconfig:"USE_DOG_STATSD" default:"false"`
+	UseDogStatsdMogrifiers []string `envconfig:"USE_DOG_STATSD_MOGRIFIERS" default:""`
+	// DogStatsdRateLimitTags emits the domain and descriptor key of the rate limit stats as DogStatsD tags.
+	DogStatsdRateLimitTags bool              `envconfig:"DOG_STATSD_RATE_LIMIT_TAGS" default:"false"`
 	UseStatsd              bool              `envconfig:"USE_STATSD" default:"true"`
 	StatsdHost             string            `envconfig:"STATSD_HOST" default:"localhost"`
 	StatsdPort             int               `envconfig:"STATSD_PORT" default:"8125"`
@@ -94,13 +247,40 @@ type Settings struct {
 	PrometheusAddr         string            `envconfig:"PROMETHEUS_ADDR" default:":9090"`
 	PrometheusPath         string            `envconfig:"PROMETHEUS_PATH" default:"/metrics"`
 	PrometheusMapperYaml   string            `envconfig:"PROMETHEUS_MAPPER_YAML" default:""`
+	// StatsSnapshotMaxNames is the maximum number of stats kept for the /stats endpoint, 0 for no
+	// maximum.
+	StatsSnapshotMaxNames int `envconfig:"STATS_SNAPSHOT_MAX_NAMES" default:"10000"`
 
 	// Settings for rate limit configuration
-	RuntimePath           string `envconfig:"RUNTIME_ROOT" default:"/srv/runtime_data/current"`
-	RuntimeSubdirectory   string `envconfig:"RUNTIME_SUBDIRECTORY"`
-	RuntimeAppDirectory   string `envconfig:"RUNTIME_APPDIRECTORY" default:"config"`
-	RuntimeIgnoreDotFiles bool   `envconfig:"RUNTIME_IGNOREDOTFILES" default:"false"`
-	RuntimeWatchRoot      bool   `envconfig:"RUNTIME_WATCH_ROOT" default:"true"`
+	RuntimePath         string `envconfig:"RUNTIME_ROOT" default:"/srv/runtime_data/current"`
+	RuntimeSubdirectory string `envconfig:"RUNTIME_SUBDIRECTORY"`
+	// RuntimeSubdirectories are the comma separated subdirectories of RuntimePath whose config
+	// directories are loaded after the one of RuntimeSubdirectory, e.g. the overlays of the teams
+	// over a base config.
+	RuntimeSubdirectories []string `envconfig:"RUNTIME_SUBDIRECTORIES" default:""`
+	RuntimeAppDirectory   string   `envconfig:"RUNTIME_APPDIRECTORY" default:"config"`
+	RuntimeIgnoreDotFiles bool     `envconfig:"RUNTIME_IGNOREDOTFILES" default:"false"`
+	RuntimeWatchRoot      bool     `envconfig:"RUNTIME_WATCH_ROOT" default:"true"`
+	// ConfigChecksumManifest is the sha256sum manifest of the config files, in the config directory,
+	// which must list every config file for a reload to be applied, empty to load the files
+	// unverified. ConfigSignaturePublicKey is the PEM ed25519 public key verifying the signature of
+	// the manifest, in the file of the manifest with a .sig suffix, empty to not require one.
+	ConfigChecksumManifest   string `envconfig:"CONFIG_CHECKSUM_MANIFEST" default:""`
+	ConfigSignaturePublicKey string `envconfig:"CONFIG_SIGNATURE_PUBLIC_KEY" default:""`
+	// ConfigStrict rejects the config files with fields unknown at their level, duplicate fields or
+	// overlapping wildcard values, with the path of the error in the file.
+	ConfigStrict bool `envconfig:"CONFIG_STRICT" default:"false"`
+	// ConfigCanaryBakePeriod is how long a reloaded configuration is compared with the previous one,
+	// which is restored if the rate of failed or unmatched requests, or of requests over the limit,
+	// grows by more than ConfigCanaryMaxErrorIncrease or ConfigCanaryMaxOverLimitIncrease once
+	// ConfigCanaryMinRequests were served. 0 disables the rollbacks.
+	ConfigCanaryBakePeriod           time.Duration `envconfig:"CONFIG_CANARY_BAKE_PERIOD" default:"0"`
+	ConfigCanaryMinRequests          uint64        `envconfig:"CONFIG_CANARY_MIN_REQUESTS" default:"100"`
+	ConfigCanaryMaxErrorIncrease     float64       `envconfig:"CONFIG_CANARY_MAX_ERROR_INCREASE" default:"0.1"`
+	ConfigCanaryMaxOverLimitIncrease float64       `envconfig:"CONFIG_CANARY_MAX_OVER_LIMIT_INCREASE" default:"0.2"`
+	// FeatureFlagsDirectory is the directory of the runtime holding the feature flags, next to
+	// RUNTIME_APPDIRECTORY. The features use their default when it is not set.
+	FeatureFlagsDirectory string `envconfig:"FEATURE_FLAGS_DIRECTORY" default:""`
 
 	// Settings for all cache types
 	ExpirationJitterMaxSeconds         int64   `envconfig:"EXPIRATION_JITTER_MAX_SECONDS" default:"300"`
@@ -109,6 +289,60 @@ type Settings struct {
 	CacheKeyPrefix                     string  `envconfig:"CACHE_KEY_PREFIX" default:""`
 	BackendType                        string  `envconfig:"BACKEND_TYPE" default:"redis"`
 	StopCacheKeyIncrementWhenOverlimit bool    `envconfig:"STOP_CACHE_KEY_INCREMENT_WHEN_OVERLIMIT" default:"false"`
+	// CacheKeyHash replaces the descriptor entries of the cache keys by their hash, "xxhash" or "sha256".
+	// The rules may override it with cache_key_hash.
+	CacheKeyHash string `envconfig:"CACHE_KEY_HASH" default:""`
+	// CacheKeyMaxLength truncates the descriptor entries of the cache keys longer than it and appends
+	// their hash, 0 keeps the entries whatever their length.
+	CacheKeyMaxLength int `envconfig:"CACHE_KEY_MAX_LENGTH" default:"0"`
+	// ExpirationJitterPerUnit is the maximum expiration jitter of the limits of a unit, e.g.
+	// "second:0s,day:15m", and ExpirationJitterPercent the maximum jitter of the other units as a
+	// percentage of their window, 0 to use EXPIRATION_JITTER_MAX_SECONDS. The rules may override
+	// them with expiration_jitter.
+	ExpirationJitterPerUnit map[string]time.Duration `envconfig:"EXPIRATION_JITTER_PER_UNIT" default:""`
+	ExpirationJitterPercent float64                  `envconfig:"EXPIRATION_JITTER_PERCENT" default:"0"`
+	// LimitScaleFactor multiplies the requests per unit of every limit, e.g. 0.5 to cut the limits in
+	// half, or the inverse of the replica count to enforce the global limits on each instance. The
+	// max_in_flight of the concurrency limits is not scaled, the leases being held across instances.
+	LimitScaleFactor float64 `envconfig:"LIMIT_SCALE_FACTOR" default:"1"`
+
+	// The TTL of the over-the-limit keys of the local cache is the remaining duration of their window,
+	// bounded by LocalCacheMinTtl and LocalCacheMaxTtl, 0 for no maximum. With LocalCacheNearLimit
+	// the near-the-limit keys are also stored, and the GETs of STOP_CACHE_KEY_INCREMENT_WHEN_OVERLIMIT
+	// are only sent for them.
+	LocalCacheMinTtl    time.Duration `envconfig:"LOCAL_CACHE_MIN_TTL" default:"1s"`
+	LocalCacheMaxTtl    time.Duration `envconfig:"LOCAL_CACHE_MAX_TTL" default:"0"`
+	LocalCacheNearLimit bool          `envconfig:"LOCAL_CACHE_NEAR_LIMIT" default:"false"`
+	// With LocalCachePerSecond the keys of the limits with a window of one second are stored until the
+	// end of their window in a separate cache of at most LocalCachePerSecondMaxKeys keys, instead of
+	// churning the local cache whose TTLs are whole seconds.
+	LocalCachePerSecond        bool `envconfig:"LOCAL_CACHE_PER_SECOND" default:"false"`
+	LocalCachePerSecondMaxKeys int  `envconfig:"LOCAL_CACHE_PER_SECOND_MAX_KEYS" default:"10000"`
+
+	// Settings for the circuit breaker around the cache backend. After CircuitBreakerFailureThreshold
+	// consecutive backend failures the requests are answered without calling the backend for
+	// CircuitBreakerOpenDuration, then a single probe request checks whether the backend recovered.
+	CircuitBreakerEnabled          bool          `envconfig:"CIRCUIT_BREAKER_ENABLED" default:"false"`
+	CircuitBreakerFailureThreshold int           `envconfig:"CIRCUIT_BREAKER_FAILURE_THRESHOLD" default:"5"`
+	CircuitBreakerOpenDuration     time.Duration `envconfig:"CIRCUIT_BREAKER_OPEN_DURATION" default:"10s"`
+	// FailureModeDeny answers OVER_LIMIT instead of OK while the circuit breaker is open, and when
+	// the deadline of a request expires before the backend answers.
+	FailureModeDeny bool `envconfig:"FAILURE_MODE_DENY" default:"false"`
+	// FailureModeLocalFallback counts the hits in memory while the circuit breaker is open, each
+	// instance enforcing the limits divided by FailureModeInstanceCount. The hits are added to the
+	// backend once it recovers. Takes precedence over FailureModeDeny.
+	FailureModeLocalFallback bool `envconfig:"FAILURE_MODE_LOCAL_FALLBACK" default:"false"`
+	FailureModeInstanceCount int  `envconfig:"FAILURE_MODE_INSTANCE_COUNT" default:"1"`
+
+	// BackendDeadlineMargin aborts the backend calls this long before the deadline of the request,
+	// leaving time to answer the caller with the failure mode.
+	BackendDeadlineMargin time.Duration `envconfig:"BACKEND_DEADLINE_MARGIN" default:"0s"`
+
+	// SettingsReloadFile holds tunables (NEAR_LIMIT_RATIO, LOG_LEVEL, FAILURE_MODE_DENY,
+	// LIMIT_SCALE_FACTOR) applied without a restart: on SIGHUP, and every SettingsReloadInterval if
+	// its contents changed.
+	SettingsReloadFile     string        `envconfig:"SETTINGS_RELOAD_FILE" default:""`
+	SettingsReloadInterval time.Duration `envconfig:"SETTINGS_RELOAD_INTERVAL" default:"10s"`
 
 	// Settings for optional returning of custom headers
 	RateLimitResponseHeadersEnabled bool `envconfig:"LIMIT_RESPONSE_HEADERS_ENABLED" default:"false"`
@@ -122,6 +356,17 @@ type Settings struct {
 	// Health-check settings
 	HealthyWithAtLeastOneConfigLoaded bool `envconfig:"HEALTHY_WITH_AT_LEAST_ONE_CONFIG_LOADED" default:"false"`
 
+	// Synthetic canary settings
+	// CanaryEnabled enables a background probe issuing ShouldRateLimit against CanaryDomain.
+	CanaryEnabled          bool          `envconfig:"CANARY_ENABLED" default:"false"`
+	CanaryInterval         time.Duration `envconfig:"CANARY_INTERVAL" default:"10s"`
+	CanaryDomain           string        `envconfig:"CANARY_DOMAIN" default:"ratelimit_canary"`
+	CanaryDescriptorKey    string        `envconfig:"CANARY_DESCRIPTOR_KEY" default:"canary"`
+	CanaryDescriptorValue  string        `envconfig:"CANARY_DESCRIPTOR_VALUE" default:"probe"`
+	CanaryLatencyThreshold time.Duration `envconfig:"CANARY_LATENCY_THRESHOLD" default:"500ms"`
+	// CanaryFailureThreshold is the number of consecutive failed probes after which the service turns unhealthy.
+	CanaryFailureThreshold int `envconfig:"CANARY_FAILURE_THRESHOLD" default:"3"`
+
 	// Redis settings
 	RedisSocketType string `envconfig:"REDIS_SOCKET_TYPE" default:"unix"`
 	RedisType       string `envconfig:"REDIS_TYPE" default:"SINGLE"`
@@ -136,6 +381,10 @@ type Settings struct {
 	RedisTlsClientKey                string `envconfig:"REDIS_TLS_CLIENT_KEY" default:""`
 	RedisTlsCACert                   string `envconfig:"REDIS_TLS_CACERT" default:""`
 	RedisTlsSkipHostnameVerification bool   `envconfig:"REDIS_TLS_SKIP_HOSTNAME_VERIFICATION" default:"false"`
+	// RedisTlsServerName overrides the server name sent in the TLS SNI and verified in the server certificate,
+	// which defaults to the host of the Redis URL. RedisPerSecondTlsServerName is the one of the per second Redis.
+	RedisTlsServerName          string `envconfig:"REDIS_TLS_SERVER_NAME" default:""`
+	RedisPerSecondTlsServerName string `envconfig:"REDIS_PERSECOND_TLS_SERVER_NAME" default:""`
 
 	// RedisPipelineWindow sets the WriteFlushInterval for radix v4 connections.
 	// This controls how often buffered writes are flushed to the network connection.
@@ -190,6 +439,50 @@ type Settings struct {
 	// See RedisPoolOnEmptyBehavior for possible values and details.
 	RedisPerSecondPoolOnEmptyBehavior string `envconfig:"REDIS_PERSECOND_POOL_ON_EMPTY_BEHAVIOR" default:"WAIT"`
 
+	// RedisPipelineWorkers is the number of workers shared across requests which execute the per-key
+	// pipelines of cluster mode concurrently. 0 executes them sequentially in the request goroutine.
+	RedisPipelineWorkers int `envconfig:"REDIS_PIPELINE_WORKERS" default:"0"`
+	// RedisPipelineWorkerQueueSize bounds the pipelines waiting for a worker, requests block when it is full.
+	RedisPipelineWorkerQueueSize int `envconfig:"REDIS_PIPELINE_WORKER_QUEUE_SIZE" default:"1024"`
+
+	// RedisMaxRetries is the number of retries of a Redis command failing with a transient error
+	// (connection error, LOADING, TRYAGAIN, CLUSTERDOWN, MASTERDOWN, READONLY). 0 disables the retries.
+	RedisMaxRetries int `envconfig:"REDIS_MAX_RETRIES" default:"0"`
+	// RedisRetryBackoffMin and RedisRetryBackoffMax bound the jittered exponential backoff between retries.
+	RedisRetryBackoffMin time.Duration `envconfig:"REDIS_RETRY_BACKOFF_MIN" default:"10ms"`
+	RedisRetryBackoffMax time.Duration `envconfig:"REDIS_RETRY_BACKOFF_MAX" default:"200ms"`
+	// RedisHedgeDelay sends a second copy of the read-only GET pipelines of
+	// STOP_CACHE_KEY_INCREMENT_WHEN_OVERLIMIT which did not complete within the delay. 0 disables the hedging.
+	RedisHedgeDelay time.Duration `envconfig:"REDIS_HEDGE_DELAY" default:"0"`
+
+	// RedisClusterTopologyRefreshInterval is the interval of the Redis Cluster topology refreshes, a negative
+	// interval disables them. A MOVED redirect always refreshes the topology.
+	RedisClusterTopologyRefreshInterval time.Duration `envconfig:"REDIS_CLUSTER_TOPOLOGY_REFRESH_INTERVAL" default:"5s"`
+	// RedisClusterFailOnRedirect fails the commands redirected by MOVED or ASK instead of following the redirects.
+	RedisClusterFailOnRedirect bool `envconfig:"REDIS_CLUSTER_FAIL_ON_REDIRECT" default:"false"`
+
+	// RedisSentinelFailoverTimeout is how long a pipeline failing on a sentinel master waits for the sentinels
+	// to announce a new master, the GET pipelines being then executed again. 0 disables the failover handling.
+	RedisSentinelFailoverTimeout time.Duration `envconfig:"REDIS_SENTINEL_FAILOVER_TIMEOUT" default:"0"`
+	// RedisSentinelFailoverGrace allows the requests whose increments fail during a failover instead of failing them.
+	RedisSentinelFailoverGrace bool `envconfig:"REDIS_SENTINEL_FAILOVER_GRACE" default:"false"`
+
+	// RedisPools declares additional named Redis pools in the format "<name>=<url>;<name>=<url>".
+	// The pools share the other settings (type, auth, TLS, pool size, timeout) of the default Redis.
+	RedisPools string `envconfig:"REDIS_POOLS" default:""`
+	// RedisUnitRoutes routes the limits of a unit to a named pool, e.g. "MINUTE:pool-a,HOUR:pool-b".
+	RedisUnitRoutes map[string]string `envconfig:"REDIS_UNIT_ROUTES" default:""`
+	// RedisDomainRoutes routes all the limits of a domain to a named pool, e.g. "tenant-a:pool-a".
+	// Domain routes take precedence over unit routes.
+	RedisDomainRoutes map[string]string `envconfig:"REDIS_DOMAIN_ROUTES" default:""`
+
+	// RedisClientSideCaching tracks the over-limit keys of the local cache with Redis client-side
+	// caching so that a key modified or deleted in Redis, e.g. a manual reset, is removed from the
+	// local cache immediately. Requires LOCAL_CACHE_SIZE_IN_BYTES and REDIS_TYPE=SINGLE.
+	RedisClientSideCaching bool `envconfig:"REDIS_CLIENT_SIDE_CACHING" default:"false"`
+	// RedisClientSideCachingQueueSize bounds the over-limit keys waiting to be tracked.
+	RedisClientSideCachingQueueSize int `envconfig:"REDIS_CLIENT_SIDE_CACHING_QUEUE_SIZE" default:"1024"`
+
 	// Memcache settings
 	MemcacheHostPort []string `envconfig:"MEMCACHE_HOST_PORT" default:""`
 	// MemcacheMaxIdleConns sets the maximum number of idle TCP connections per memcached node.
@@ -206,14 +499,41 @@ type Settings struct {
 	MemcacheTlsClientKey                string `envconfig:"MEMCACHE_TLS_CLIENT_KEY" default:""`
 	MemcacheTlsCACert                   string `envconfig:"MEMCACHE_TLS_CACERT" default:""`
 	MemcacheTlsSkipHostnameVerification bool   `envconfig:"MEMCACHE_TLS_SKIP_HOSTNAME_VERIFICATION" default:"false"`
+	// MemcacheHashing selects the node of the keys, "default" hashing them modulo the number of nodes
+	// or "ketama" placing MemcacheVirtualNodes points of each node on a ring of consistent hashes. With
+	// ketama a node failing MemcacheEjectionFailures consecutive connections, 0 for never, is ejected
+	// for MemcacheEjectionDuration.
+	MemcacheHashing          string        `envconfig:"MEMCACHE_HASHING" default:"default"`
+	MemcacheVirtualNodes     int           `envconfig:"MEMCACHE_VIRTUAL_NODES" default:"160"`
+	MemcacheEjectionFailures int           `envconfig:"MEMCACHE_EJECTION_FAILURES" default:"3"`
+	MemcacheEjectionDuration time.Duration `envconfig:"MEMCACHE_EJECTION_DURATION" default:"30s"`
+	// With MemcacheSaslUsername the client speaks the binary protocol and authenticates each connection
+	// with SASL PLAIN.
+	MemcacheSaslUsername string `envconfig:"MEMCACHE_SASL_USERNAME" default:""`
+	MemcacheSaslPassword string `envconfig:"MEMCACHE_SASL_PASSWORD" default:""`
+	// With MemcacheIncrementWorkers the increments run on this number of workers, at most
+	// MemcacheIncrementQueueSize of them waiting for a worker. The increments of a full queue run in
+	// the request with "sync" or are dropped with "drop". With 0 workers they run on workers created
+	// on demand, without bound.
+	MemcacheIncrementWorkers   int    `envconfig:"MEMCACHE_INCREMENT_WORKERS" default:"0"`
+	MemcacheIncrementQueueSize int    `envconfig:"MEMCACHE_INCREMENT_QUEUE_SIZE" default:"1000"`
+	MemcacheIncrementOverflow  string `envconfig:"MEMCACHE_INCREMENT_OVERFLOW" default:"sync"`
+	// MemcacheGetFanout bounds the servers read concurrently by a multi-get, 0 for all of them.
+	MemcacheGetFanout int `envconfig:"MEMCACHE_GET_FANOUT" default:"0"`
 
 	// Should the ratelimiting be running in Global shadow-mode, ie. never report a ratelimit status, unless a rate was provided from envoy as an override
 	GlobalShadowMode bool `envconfig:"SHADOW_MODE" default:"false"`
 
 	ResponseDynamicMetadata bool `envconfig:"RESPONSE_DYNAMIC_METADATA" default:"false"`
+	// ResponseDebugTrailers answers the gRPC requests with the x-ratelimit-debug metadata with the
+	// rules, cache keys and backend latency of the decision in the trailing metadata.
+	ResponseDebugTrailers bool `envconfig:"RESPONSE_DEBUG_TRAILERS" default:"false"`
 
 	// Allow merging of multiple yaml files referencing the same domain
 	MergeDomainConfigurations bool `envconfig:"MERGE_DOMAIN_CONFIG" default:"false"`
+	// DuplicateDomainPolicy is how a domain defined by several config files is loaded: error, merge or
+	// last_wins. Empty for merge if MergeDomainConfigurations is set, error otherwise.
+	DuplicateDomainPolicy string `envconfig:"DUPLICATE_DOMAIN_POLICY" default:""`
 
 	// OTLP trace settings
 	TracingEnabled           bool   `envconfig:"TRACING_ENABLED" default:"false"`
@@ -225,6 +545,14 @@ type Settings struct {
 	// detailed setting of exporter should refer to https://opentelemetry.io/docs/reference/specification/protocol/exporter/, e.g. OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_CERTIFICATE, OTEL_EXPORTER_OTLP_TIMEOUT
 	// TracingSamplingRate defaults to 1 which amounts to using the `AlwaysSample` sampler
 	TracingSamplingRate float64 `envconfig:"TRACING_SAMPLING_RATE" default:"1"`
+	// TracingSampler is one of the values of OTEL_TRACES_SAMPLER, the ratio samplers use TracingSamplingRate
+	TracingSampler string `envconfig:"TRACING_SAMPLER" default:"parentbased_traceidratio"`
+	// TracingExporterEndpoint is a host:port or a URL, when empty OTEL_EXPORTER_OTLP_ENDPOINT is used
+	TracingExporterEndpoint string            `envconfig:"TRACING_EXPORTER_ENDPOINT" default:""`
+	TracingExporterHeaders  map[string]string `envconfig:"TRACING_EXPORTER_HEADERS" default:""`
+	TracingExporterInsecure bool              `envconfig:"TRACING_EXPORTER_INSECURE" default:"false"`
+	// TracingResourceAttributes are added to the resource of the spans, e.g. "deployment.environment:prod"
+	TracingResourceAttributes map[string]string `envconfig:"TRACING_RESOURCE_ATTRIBUTES" default:""`
 }
 
 type Option func(*Settings)
@@ -234,6 +562,8 @@ func NewSettings() Settings {
 	if err := envconfig.Process("", &s); err != nil {
 		panic(err)
 	}
+	// the hashes are compared as lowercase names, see config.IsValidCacheKeyHash
+	s.CacheKeyHash = strings.ToLower(strings.TrimSpace(s.CacheKeyHash))
 	// When we require TLS to connect to Redis, we check if we need to connect using the provided key-pair.
 	RedisTlsConfig(s.RedisTls || s.RedisPerSecondTls)(&s)
 	MemcacheTlsConfig(s.MemcacheTls)(&s)
@@ -250,6 +580,7 @@ func RedisTlsConfig(redisTls bool) Option {
 		s.RedisTlsConfig = &tls.Config{}
 		if redisTls {
 			s.RedisTlsConfig = utils.TlsConfigFromFiles(s.RedisTlsClientCert, s.RedisTlsClientKey, s.RedisTlsCACert, utils.ServerCA, s.RedisTlsSkipHostnameVerification)
+			s.RedisTlsConfig.ServerName = s.RedisTlsServerName
 		}
 	}
 }
@@ -296,3 +627,21 @@ func GrpcUnaryInterceptor(i grpc.UnaryServerInterceptor) Option {
 		s.GrpcUnaryInterceptor = i
 	}
 }
+
+// ParseRedisPools parses the named Redis pools of RedisPools, in the format "<name>=<url>;<name>=<url>".
+// The url has the same format as REDIS_URL.
+func ParseRedisPools(value string) (map[string]string, error) {
+	pools := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("invalid redis pool %q, expected <name>=<url>", entry)
+		}
+		pools[name] = url
+	}
+	return pools, nil
+}
@@ -3,6 +3,7 @@ package settings
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,6 +14,14 @@ func TestSettingsTlsConfigUnmodified(t *testing.T) {
 	assert.Nil(t, settings.RedisTlsConfig.RootCAs)
 }
 
+func TestCacheKeyHashNormalized(t *testing.T) {
+	t.Setenv("CACHE_KEY_HASH", " XXHash ")
+
+	settings := NewSettings()
+
+	assert.Equal(t, "xxhash", settings.CacheKeyHash)
+}
+
 // Tests for RedisPoolOnEmptyBehavior
 func TestRedisPoolOnEmptyBehavior_Default(t *testing.T) {
 	os.Unsetenv("REDIS_POOL_ON_EMPTY_BEHAVIOR")
@@ -93,3 +102,44 @@ func TestRedisPoolOnEmptyBehavior_IndependentConfiguration(t *testing.T) {
 	// Per-second pool configured differently
 	assert.Equal(t, "CREATE", settings.RedisPerSecondPoolOnEmptyBehavior)
 }
+
+// Tests for the gRPC keepalive settings
+func TestGrpcKeepalive_Default(t *testing.T) {
+	settings := NewSettings()
+
+	assert.Equal(t, 2*time.Hour, settings.GrpcKeepaliveTime)
+	assert.Equal(t, 20*time.Second, settings.GrpcKeepaliveTimeout)
+	assert.Equal(t, 5*time.Minute, settings.GrpcKeepaliveMinTime)
+	assert.False(t, settings.GrpcKeepalivePermitWithoutStream)
+	assert.Equal(t, uint32(0), settings.GrpcMaxConcurrentStreams)
+}
+
+func TestGrpcKeepalive_Configured(t *testing.T) {
+	os.Setenv("GRPC_KEEPALIVE_TIME", "30s")
+	os.Setenv("GRPC_KEEPALIVE_MIN_TIME", "10s")
+	os.Setenv("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM", "true")
+	os.Setenv("GRPC_MAX_CONCURRENT_STREAMS", "100")
+	defer os.Unsetenv("GRPC_KEEPALIVE_TIME")
+	defer os.Unsetenv("GRPC_KEEPALIVE_MIN_TIME")
+	defer os.Unsetenv("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM")
+	defer os.Unsetenv("GRPC_MAX_CONCURRENT_STREAMS")
+
+	settings := NewSettings()
+
+	assert.Equal(t, 30*time.Second, settings.GrpcKeepaliveTime)
+	assert.Equal(t, 10*time.Second, settings.GrpcKeepaliveMinTime)
+	assert.True(t, settings.GrpcKeepalivePermitWithoutStream)
+	assert.Equal(t, uint32(100), settings.GrpcMaxConcurrentStreams)
+}
+
+func TestTracingSampler(t *testing.T) {
+	settings := NewSettings()
+	assert.Equal(t, "parentbased_traceidratio", settings.TracingSampler)
+	assert.Equal(t, 1.0, settings.TracingSamplingRate)
+
+	t.Setenv("TRACING_SAMPLER", "traceidratio")
+	t.Setenv("TRACING_SAMPLING_RATE", "0.25")
+	settings = NewSettings()
+	assert.Equal(t, "traceidratio", settings.TracingSampler)
+	assert.Equal(t, 0.25, settings.TracingSamplingRate)
+}
@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+)
+
+// Codes of the results of the backend operations.
+const (
+	BackendOpSuccess = "success"
+	BackendOpMiss    = "miss"
+	BackendOpError   = "error"
+)
+
+// BackendOpStats counts the results of an operation of a cache backend and times it, under the
+// same names for every backend so that they can be compared: the <op> counter tagged with the code
+// of the result, success, miss or error, and the <op>_latency timer.
+type BackendOpStats struct {
+	Success gostats.Counter
+	Miss    gostats.Counter
+	Error   gostats.Counter
+	Latency gostats.Timer
+}
+
+// NewBackendOpStats creates the stats of the operation op in scope.
+func NewBackendOpStats(scope gostats.Scope, op string) BackendOpStats {
+	return BackendOpStats{
+		Success: scope.NewCounterWithTags(op, map[string]string{"code": BackendOpSuccess}),
+		Miss:    scope.NewCounterWithTags(op, map[string]string{"code": BackendOpMiss}),
+		Error:   scope.NewCounterWithTags(op, map[string]string{"code": BackendOpError}),
+		Latency: scope.NewTimer(op + "_latency"),
+	}
+}
+
+// Record counts the result of an operation started at start, an error unless err is nil, a miss
+// if miss is set, a success otherwise.
+func (this BackendOpStats) Record(start time.Time, err error, miss bool) {
+	this.Latency.AddDuration(time.Since(start))
+	switch {
+	case err != nil:
+		this.Error.Inc()
+	case miss:
+		this.Miss.Inc()
+	default:
+		this.Success.Inc()
+	}
+}
+
+// BackendOps creates the BackendOpStats of the operations of a backend on their first use, for the
+// backends whose operations are not known upfront such as the Redis commands.
+type BackendOps struct {
+	scope gostats.Scope
+	ops   sync.Map
+}
+
+func NewBackendOps(scope gostats.Scope) *BackendOps {
+	return &BackendOps{scope: scope}
+}
+
+// Op returns the stats of the operation op, its name lowercased.
+func (this *BackendOps) Op(op string) BackendOpStats {
+	if opStats, ok := this.ops.Load(op); ok {
+		return opStats.(BackendOpStats)
+	}
+	opStats, _ := this.ops.LoadOrStore(op, NewBackendOpStats(this.scope, strings.ToLower(op)))
+	return opStats.(BackendOpStats)
+}
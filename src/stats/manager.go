@@ -1,6 +1,8 @@
 package stats
 
 import (
+	"sync"
+
 	gostats "github.com/lyft/gostats"
 )
 
@@ -9,6 +11,10 @@ type Manager interface {
 	// NewStats provides a RateLimitStats structure associated with a given descriptorKey.
 	// Multiple calls with the same descriptorKey argument are guaranteed to be equivalent.
 	NewStats(descriptorKey string) RateLimitStats
+	// NewStatsWithRollups provides the RateLimitStats of a descriptorKey of a domain, whose
+	// counters also count in the rollups of the domain and of the service.
+	// Multiple calls with the same arguments are guaranteed to be equivalent.
+	NewStatsWithRollups(domain string, descriptorKey string) RateLimitStats
 	// Gets stats for a domain (when no descriptors are found)
 	// Multiple calls with the same domain argument are guaranteed to be equivalent.
 	NewDomainStats(domain string) DomainStats
@@ -27,6 +33,18 @@ type ManagerImpl struct {
 	rlStatsScope         gostats.Scope
 	serviceStatsScope    gostats.Scope
 	shouldRateLimitScope gostats.Scope
+	// rlStats and domainStats cache the stats by key, so that the stats of the descriptors resolved
+	// per request (detailed_metric, value_to_metric, unknown domains) are only built once.
+	rlStats     sync.Map
+	domainStats sync.Map
+	// rollupStats caches the stats of the rules with rollups by key, and domainRollups the
+	// rollup stats of each domain.
+	rollupStats        sync.Map
+	domainRollups      sync.Map
+	domainRollupScope  gostats.Scope
+	serviceRollupStats RateLimitStats
+	// snapshot keeps the stats flushed by the store, nil if the snapshots are not available.
+	snapshot *SnapshotSink
 }
 
 // Stats for panic recoveries.
@@ -34,6 +52,38 @@ type ManagerImpl struct {
 type ShouldRateLimitStats struct {
 	RedisError   gostats.Counter
 	ServiceError gostats.Counter
+	Timing       ShouldRateLimitTimingStats
+}
+
+// ShouldRateLimitTimingStats split the latency of ShouldRateLimit into its phases, so that a
+// regression can be localized without tracing the requests. The phases which a request or a backend
+// skips are not timed.
+type ShouldRateLimitTimingStats struct {
+	// ConfigLookup times the matching of the descriptors against the configuration.
+	ConfigLookup gostats.Timer
+	// CacheKeys times the generation of the cache keys.
+	CacheKeys gostats.Timer
+	// LocalCache times the checks of the local cache.
+	LocalCache gostats.Timer
+	// BackendPrecheck times the reads of the backend before the increment, the penalty box of the
+	// leaky buckets and the counters read with STOP_CACHE_KEY_INCREMENT_WHEN_OVERLIMIT.
+	BackendPrecheck gostats.Timer
+	// BackendIncrement times the increment of the counters in the backend.
+	BackendIncrement gostats.Timer
+	// HotKeyWait times the wait for the read of a key shared with a concurrent request.
+	HotKeyWait gostats.Timer
+}
+
+// NewShouldRateLimitTimingStats creates the timers of the phases in scope.
+func NewShouldRateLimitTimingStats(scope gostats.Scope) ShouldRateLimitTimingStats {
+	return ShouldRateLimitTimingStats{
+		ConfigLookup:     scope.NewTimer("config_lookup_latency"),
+		CacheKeys:        scope.NewTimer("cache_keys_latency"),
+		LocalCache:       scope.NewTimer("local_cache_latency"),
+		BackendPrecheck:  scope.NewTimer("backend_precheck_latency"),
+		BackendIncrement: scope.NewTimer("backend_increment_latency"),
+		HotKeyWait:       scope.NewTimer("hot_key_wait_latency"),
+	}
 }
 
 // Stats for server errors.
@@ -43,6 +93,39 @@ type ServiceStats struct {
 	ConfigLoadError   gostats.Counter
 	ShouldRateLimit   ShouldRateLimitStats
 	GlobalShadowMode  gostats.Counter
+	// CacheKeyCompressed counts the cache keys whose descriptor entries were truncated and hashed.
+	CacheKeyCompressed gostats.Counter
+	// ConfigCanaryPassed counts the reloaded configurations which baked without an error spike,
+	// ConfigRollback those rolled back to the previous configuration. ConfigRolledBack is 1 while a
+	// rolled back configuration is refused, until the configuration changes.
+	ConfigCanaryPassed gostats.Counter
+	ConfigRollback     gostats.Counter
+	ConfigRolledBack   gostats.Gauge
+	// ConfigDomainConflict counts the config files defining a domain already defined by another file.
+	ConfigDomainConflict gostats.Counter
+	ConfigDiff           ConfigDiffStats
+}
+
+// ConfigDiffStats counts the changes of the reloaded configurations by category.
+type ConfigDiffStats struct {
+	DomainsAdded   gostats.Counter
+	DomainsRemoved gostats.Counter
+	RulesAdded     gostats.Counter
+	RulesRemoved   gostats.Counter
+	LimitsChanged  gostats.Counter
+	RulesChanged   gostats.Counter
+}
+
+// NewConfigDiffStats returns the stats of the changes of the reloaded configurations in scope.
+func NewConfigDiffStats(scope gostats.Scope) ConfigDiffStats {
+	return ConfigDiffStats{
+		DomainsAdded:   scope.NewCounter("domains_added"),
+		DomainsRemoved: scope.NewCounter("domains_removed"),
+		RulesAdded:     scope.NewCounter("rules_added"),
+		RulesRemoved:   scope.NewCounter("rules_removed"),
+		LimitsChanged:  scope.NewCounter("limits_changed"),
+		RulesChanged:   scope.NewCounter("rules_changed"),
+	}
 }
 
 // Stats for an individual rate limit config entry.
@@ -54,10 +137,16 @@ type RateLimitStats struct {
 	OverLimitWithLocalCache gostats.Counter
 	WithinLimit             gostats.Counter
 	ShadowMode              gostats.Counter
+	// Matched counts the descriptors which matched the rule, whatever the key of their other stats.
+	Matched gostats.Counter
 }
 
 // Stats for a domain entry
 type DomainStats struct {
 	Key      string
 	NotFound gostats.Counter
+	// LocalCacheHit and LocalCacheMiss count the cache keys of the domain found, or not found,
+	// over the limit in the local cache.
+	LocalCacheHit  gostats.Counter
+	LocalCacheMiss gostats.Counter
 }
@@ -15,6 +15,8 @@ func NewStatManager(store gostats.Store, settings settings.Settings) *ManagerImp
 		rlStatsScope:         serviceScope.Scope("rate_limit"),
 		serviceStatsScope:    serviceScope,
 		shouldRateLimitScope: serviceScope.Scope("call.should_rate_limit"),
+		domainRollupScope:    serviceScope.Scope("domain"),
+		serviceRollupStats:   newCounters(serviceScope.Scope("all"), ""),
 	}
 }
 
@@ -22,27 +24,80 @@ func (this *ManagerImpl) GetStatsStore() gostats.Store {
 	return this.store
 }
 
+// WithSnapshot serves the snapshots of the manager from snapshot, the sink of its store.
+func (this *ManagerImpl) WithSnapshot(snapshot *SnapshotSink) *ManagerImpl {
+	this.snapshot = snapshot
+	return this
+}
+
+// Snapshot returns the stats whose name contains filter as of the last flush of the store, none if
+// the manager has no snapshot sink. The store isn't flushed, which would reset the counters of the
+// flush interval of the production sink.
+func (this *ManagerImpl) Snapshot(filter string) Snapshot {
+	if this.snapshot == nil {
+		return NewSnapshotSink(gostats.NewNullSink(), 0).Snapshot(filter)
+	}
+	return this.snapshot.Snapshot(filter)
+}
+
 // Create new rate descriptor stats for a descriptor tuple.
 // @param key supplies the fully resolved descriptor tuple.
 // @return new stats.
 func (this *ManagerImpl) NewStats(key string) RateLimitStats {
-	ret := RateLimitStats{}
+	if cached, ok := this.rlStats.Load(key); ok {
+		return cached.(RateLimitStats)
+	}
+
+	ret := this.newStats(key)
+	this.rlStats.Store(ret.Key, ret)
+	return ret
+}
+
+func (this *ManagerImpl) newStats(key string) RateLimitStats {
 	logger.Debugf("Creating stats for key: '%s'", key)
+	ret := newCounters(this.rlStatsScope, utils.SanitizeStatName(key)+".")
 	ret.Key = key
-	key = utils.SanitizeStatName(key)
-	ret.TotalHits = this.rlStatsScope.NewCounter(key + ".total_hits")
-	ret.OverLimit = this.rlStatsScope.NewCounter(key + ".over_limit")
-	ret.NearLimit = this.rlStatsScope.NewCounter(key + ".near_limit")
-	ret.OverLimitWithLocalCache = this.rlStatsScope.NewCounter(key + ".over_limit_with_local_cache")
-	ret.WithinLimit = this.rlStatsScope.NewCounter(key + ".within_limit")
-	ret.ShadowMode = this.rlStatsScope.NewCounter(key + ".shadow_mode")
+	return ret
+}
+
+// NewStatsWithRollups creates the stats of a descriptor tuple of a domain, whose counters also
+// count in the ratelimit.service.domain.DOMAIN and ratelimit.service.all rollups.
+func (this *ManagerImpl) NewStatsWithRollups(domain string, key string) RateLimitStats {
+	if cached, ok := this.rollupStats.Load(key); ok {
+		return cached.(RateLimitStats)
+	}
+
+	domainRollup, ok := this.domainRollups.Load(domain)
+	if !ok {
+		domainRollup, _ = this.domainRollups.LoadOrStore(domain, newCounters(this.domainRollupScope, utils.SanitizeStatName(domain)+"."))
+	}
+	ret := withRollups(this.NewStats(key), domainRollup.(RateLimitStats), this.serviceRollupStats)
+	this.rollupStats.Store(key, ret)
+	return ret
+}
+
+func newCounters(scope gostats.Scope, prefix string) RateLimitStats {
+	ret := RateLimitStats{}
+	ret.TotalHits = scope.NewCounter(prefix + "total_hits")
+	ret.OverLimit = scope.NewCounter(prefix + "over_limit")
+	ret.NearLimit = scope.NewCounter(prefix + "near_limit")
+	ret.OverLimitWithLocalCache = scope.NewCounter(prefix + "over_limit_with_local_cache")
+	ret.WithinLimit = scope.NewCounter(prefix + "within_limit")
+	ret.ShadowMode = scope.NewCounter(prefix + "shadow_mode")
+	ret.Matched = scope.NewCounter(prefix + "matched")
 	return ret
 }
 
 func (this *ManagerImpl) NewDomainStats(domain string) DomainStats {
+	if cached, ok := this.domainStats.Load(domain); ok {
+		return cached.(DomainStats)
+	}
+
 	ret := DomainStats{}
-	domain = utils.SanitizeStatName(domain)
-	ret.NotFound = this.rlStatsScope.NewCounter(domain + ".domain_not_found")
+	ret.NotFound = this.rlStatsScope.NewCounter(utils.SanitizeStatName(domain) + ".domain_not_found")
+	ret.LocalCacheHit = this.domainRollupScope.NewCounter(utils.SanitizeStatName(domain) + ".local_cache_hit")
+	ret.LocalCacheMiss = this.domainRollupScope.NewCounter(utils.SanitizeStatName(domain) + ".local_cache_miss")
+	this.domainStats.Store(domain, ret)
 	return ret
 }
 
@@ -50,6 +105,7 @@ func (this *ManagerImpl) NewShouldRateLimitStats() ShouldRateLimitStats {
 	ret := ShouldRateLimitStats{}
 	ret.RedisError = this.shouldRateLimitScope.NewCounter("redis_error")
 	ret.ServiceError = this.shouldRateLimitScope.NewCounter("service_error")
+	ret.Timing = NewShouldRateLimitTimingStats(this.shouldRateLimitScope)
 	return ret
 }
 
@@ -59,6 +115,12 @@ func (this *ManagerImpl) NewServiceStats() ServiceStats {
 	ret.ConfigLoadError = this.serviceStatsScope.NewCounter("config_load_error")
 	ret.ShouldRateLimit = this.NewShouldRateLimitStats()
 	ret.GlobalShadowMode = this.serviceStatsScope.NewCounter("global_shadow_mode")
+	ret.CacheKeyCompressed = this.serviceStatsScope.NewCounter("cache_key_compressed")
+	ret.ConfigCanaryPassed = this.serviceStatsScope.NewCounter("config_canary_passed")
+	ret.ConfigRollback = this.serviceStatsScope.NewCounter("config_rollback")
+	ret.ConfigRolledBack = this.serviceStatsScope.NewGauge("config_rolled_back")
+	ret.ConfigDomainConflict = this.serviceStatsScope.NewCounter("config_domain_conflict")
+	ret.ConfigDiff = NewConfigDiffStats(this.serviceStatsScope.Scope("config_diff"))
 	return ret
 }
 
@@ -0,0 +1,41 @@
+package stats
+
+import (
+	gostats "github.com/lyft/gostats"
+)
+
+// rollupCounter is the counter of a rule which also adds its hits to the counters of the domain
+// and service rollups. Set, String and Value only apply to the counter of the rule.
+type rollupCounter struct {
+	gostats.Counter
+	rollups []gostats.Counter
+}
+
+func (this *rollupCounter) Add(delta uint64) {
+	this.Counter.Add(delta)
+	for _, rollup := range this.rollups {
+		rollup.Add(delta)
+	}
+}
+
+func (this *rollupCounter) Inc() {
+	this.Add(1)
+}
+
+func withRollup(counter gostats.Counter, rollups ...gostats.Counter) gostats.Counter {
+	return &rollupCounter{Counter: counter, rollups: rollups}
+}
+
+// withRollups returns the stats of a rule whose counters also count in the rollups.
+func withRollups(ruleStats RateLimitStats, domainStats RateLimitStats, serviceStats RateLimitStats) RateLimitStats {
+	return RateLimitStats{
+		Key:                     ruleStats.Key,
+		TotalHits:               withRollup(ruleStats.TotalHits, domainStats.TotalHits, serviceStats.TotalHits),
+		OverLimit:               withRollup(ruleStats.OverLimit, domainStats.OverLimit, serviceStats.OverLimit),
+		NearLimit:               withRollup(ruleStats.NearLimit, domainStats.NearLimit, serviceStats.NearLimit),
+		OverLimitWithLocalCache: withRollup(ruleStats.OverLimitWithLocalCache, domainStats.OverLimitWithLocalCache, serviceStats.OverLimitWithLocalCache),
+		WithinLimit:             withRollup(ruleStats.WithinLimit, domainStats.WithinLimit, serviceStats.WithinLimit),
+		ShadowMode:              withRollup(ruleStats.ShadowMode, domainStats.ShadowMode, serviceStats.ShadowMode),
+		Matched:                 withRollup(ruleStats.Matched, domainStats.Matched, serviceStats.Matched),
+	}
+}
@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	gostats "github.com/lyft/gostats"
+)
+
+// Snapshot is the state of the stats as of their last flush. The counters are the totals since the
+// start of the service.
+type Snapshot struct {
+	Counters map[string]uint64        `json:"counters"`
+	Gauges   map[string]uint64        `json:"gauges"`
+	Timers   map[string]TimerSnapshot `json:"timers"`
+	// DroppedNames is the number of stats which are not kept, past the maximum number of names.
+	DroppedNames uint64 `json:"dropped_names"`
+}
+
+// TimerSnapshot summarizes the values of a timer, in the unit of the timer.
+type TimerSnapshot struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Snapshotter returns the stats whose name contains filter, all of them if filter is empty.
+type Snapshotter interface {
+	Snapshot(filter string) Snapshot
+}
+
+// SnapshotSink is a sink keeping the flushed stats for the snapshots before passing them to the
+// sink it wraps. The stats of each name are updated on their own, the flushes of different names
+// not contending, and at most maxNames names are kept.
+type SnapshotSink struct {
+	sink     gostats.Sink
+	maxNames int64
+
+	// the names kept and reserved, and the names dropped past maxNames
+	names    atomic.Int64
+	dropped  atomic.Uint64
+	counters sync.Map // name -> *atomic.Uint64
+	gauges   sync.Map // name -> *atomic.Uint64
+	timers   sync.Map // name -> *timerState
+}
+
+type timerState struct {
+	mu    sync.Mutex
+	timer TimerSnapshot
+}
+
+// NewSnapshotSink returns a sink keeping at most maxNames of the stats flushed to sink, 0 for no
+// maximum.
+func NewSnapshotSink(sink gostats.Sink, maxNames int) *SnapshotSink {
+	return &SnapshotSink{sink: sink, maxNames: int64(maxNames)}
+}
+
+// load returns the state of a name, created by newState if the maximum number of names isn't
+// reached, nil otherwise.
+func (this *SnapshotSink) load(states *sync.Map, name string, newState func() any) any {
+	if state, ok := states.Load(name); ok {
+		return state
+	}
+	if this.names.Add(1) > this.maxNames && this.maxNames > 0 {
+		this.names.Add(-1)
+		this.dropped.Add(1)
+		return nil
+	}
+	state, loaded := states.LoadOrStore(name, newState())
+	if loaded {
+		this.names.Add(-1)
+	}
+	return state
+}
+
+func newUint64() any {
+	return &atomic.Uint64{}
+}
+
+func newTimerState() any {
+	return &timerState{timer: TimerSnapshot{Min: math.Inf(1), Max: math.Inf(-1)}}
+}
+
+func (this *SnapshotSink) FlushCounter(name string, value uint64) {
+	if counter := this.load(&this.counters, name, newUint64); counter != nil {
+		counter.(*atomic.Uint64).Add(value)
+	}
+	this.sink.FlushCounter(name, value)
+}
+
+func (this *SnapshotSink) FlushGauge(name string, value uint64) {
+	if gauge := this.load(&this.gauges, name, newUint64); gauge != nil {
+		gauge.(*atomic.Uint64).Store(value)
+	}
+	this.sink.FlushGauge(name, value)
+}
+
+func (this *SnapshotSink) FlushTimer(name string, value float64) {
+	if state := this.load(&this.timers, name, newTimerState); state != nil {
+		state := state.(*timerState)
+		state.mu.Lock()
+		state.timer.Count++
+		state.timer.Sum += value
+		state.timer.Min = math.Min(state.timer.Min, value)
+		state.timer.Max = math.Max(state.timer.Max, value)
+		state.mu.Unlock()
+	}
+	this.sink.FlushTimer(name, value)
+}
+
+// Flush flushes the wrapped sink if it buffers the stats.
+func (this *SnapshotSink) Flush() {
+	if flushable, ok := this.sink.(gostats.FlushableSink); ok {
+		flushable.Flush()
+	}
+}
+
+func (this *SnapshotSink) Snapshot(filter string) Snapshot {
+	snapshot := Snapshot{
+		Counters:     map[string]uint64{},
+		Gauges:       map[string]uint64{},
+		Timers:       map[string]TimerSnapshot{},
+		DroppedNames: this.dropped.Load(),
+	}
+	this.counters.Range(func(name, counter any) bool {
+		if strings.Contains(name.(string), filter) {
+			snapshot.Counters[name.(string)] = counter.(*atomic.Uint64).Load()
+		}
+		return true
+	})
+	this.gauges.Range(func(name, gauge any) bool {
+		if strings.Contains(name.(string), filter) {
+			snapshot.Gauges[name.(string)] = gauge.(*atomic.Uint64).Load()
+		}
+		return true
+	})
+	this.timers.Range(func(name, state any) bool {
+		if strings.Contains(name.(string), filter) {
+			state := state.(*timerState)
+			state.mu.Lock()
+			snapshot.Timers[name.(string)] = state.timer
+			state.mu.Unlock()
+		}
+		return true
+	})
+	return snapshot
+}
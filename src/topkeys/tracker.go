@@ -0,0 +1,224 @@
+package topkeys
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/ratelimit/src/utils"
+)
+
+// Key is the estimated weight of a descriptor over the window of a Tracker.
+type Key struct {
+	Descriptor string `json:"descriptor"`
+	// Hits is the estimate of the hits of the window, which overestimates them by at most Error.
+	Hits  uint64 `json:"hits"`
+	Error uint64 `json:"error"`
+	// Rate is the estimate of the hits per second.
+	Rate float64 `json:"rate"`
+}
+
+// Tracker estimates the heaviest descriptors of each domain with the Space-Saving algorithm, which
+// counts the hits of at most capacity descriptors per domain: a new descriptor replaces the lightest
+// one, inheriting its hits as an error. The heavy hitters are kept whatever the number of distinct
+// descriptors. The hits are counted over a sliding window, from the hits of the current window and
+// the prorated hits of the previous one.
+type Tracker struct {
+	capacity   int
+	window     time.Duration
+	timeSource utils.TimeSource
+	domains    sync.Map
+}
+
+// NewTracker returns a tracker of capacity descriptors per domain over a window, which should
+// be of a second or more.
+func NewTracker(capacity int, window time.Duration, timeSource utils.TimeSource) *Tracker {
+	return &Tracker{capacity: capacity, window: window, timeSource: timeSource}
+}
+
+type domainKeys struct {
+	mu sync.Mutex
+	// start is the start of the current window, in unix seconds.
+	start    int64
+	current  *spaceSaving
+	previous *spaceSaving
+}
+
+// rotate moves to the window of now, the previous window being empty if it isn't the last one.
+func (this *domainKeys) rotate(now int64, window int64, capacity int) {
+	elapsed := now - this.start
+	if elapsed < window {
+		return
+	}
+	if elapsed < 2*window {
+		this.previous = this.current
+	} else {
+		this.previous = newSpaceSaving(capacity)
+	}
+	this.current = newSpaceSaving(capacity)
+	this.start = now - (now-this.start)%window
+}
+
+func (this *Tracker) windowSeconds() int64 {
+	seconds := int64(this.window / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// Add counts hits on a descriptor of a domain.
+func (this *Tracker) Add(domain string, descriptor string, hits uint64) {
+	value, ok := this.domains.Load(domain)
+	if !ok {
+		now := this.timeSource.UnixNow()
+		value, _ = this.domains.LoadOrStore(domain, &domainKeys{
+			start:    now,
+			current:  newSpaceSaving(this.capacity),
+			previous: newSpaceSaving(this.capacity),
+		})
+	}
+	keys := value.(*domainKeys)
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	keys.rotate(this.timeSource.UnixNow(), this.windowSeconds(), this.capacity)
+	keys.current.add(descriptor, hits)
+}
+
+// Domains returns the domains with counted hits, sorted.
+func (this *Tracker) Domains() []string {
+	var domains []string
+	this.domains.Range(func(key, _ interface{}) bool {
+		domains = append(domains, key.(string))
+		return true
+	})
+	sort.Strings(domains)
+	return domains
+}
+
+// Top returns the n heaviest descriptors of a domain over the window, the heaviest first.
+func (this *Tracker) Top(domain string, n int) []Key {
+	value, ok := this.domains.Load(domain)
+	if !ok {
+		return nil
+	}
+	keys := value.(*domainKeys)
+	now := this.timeSource.UnixNow()
+	window := this.windowSeconds()
+
+	keys.mu.Lock()
+	keys.rotate(now, window, this.capacity)
+	// the previous window is prorated by the part of the sliding window it still covers
+	weight := float64(window-(now-keys.start)) / float64(window)
+	estimates := make(map[string]*Key, len(keys.current.counters)+len(keys.previous.counters))
+	estimate := func(descriptor string, c *counter, weight float64) {
+		key, ok := estimates[descriptor]
+		if !ok {
+			key = &Key{Descriptor: descriptor}
+			estimates[descriptor] = key
+		}
+		key.Hits += uint64(float64(c.count) * weight)
+		key.Error += uint64(float64(c.err) * weight)
+	}
+	for descriptor, c := range keys.current.counters {
+		estimate(descriptor, c, 1)
+	}
+	for descriptor, c := range keys.previous.counters {
+		estimate(descriptor, c, weight)
+	}
+	keys.mu.Unlock()
+
+	top := make([]Key, 0, len(estimates))
+	for _, key := range estimates {
+		if key.Hits == 0 {
+			continue
+		}
+		key.Rate = float64(key.Hits) / float64(window)
+		top = append(top, *key)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Hits != top[j].Hits {
+			return top[i].Hits > top[j].Hits
+		}
+		return top[i].Descriptor < top[j].Descriptor
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+type counter struct {
+	descriptor string
+	count      uint64
+	err        uint64
+	// index is the index of the counter in the heap
+	index int
+}
+
+// spaceSaving counts the hits of at most capacity descriptors. The counters are also a min-heap
+// by count, so that the lightest one is replaced in O(log capacity).
+type spaceSaving struct {
+	capacity int
+	counters map[string]*counter
+	heap     counterHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*counter, capacity),
+		heap:     make(counterHeap, 0, capacity),
+	}
+}
+
+func (this *spaceSaving) add(descriptor string, hits uint64) {
+	if c, ok := this.counters[descriptor]; ok {
+		c.count += hits
+		heap.Fix(&this.heap, c.index)
+		return
+	}
+	if len(this.counters) < this.capacity {
+		c := &counter{descriptor: descriptor, count: hits}
+		this.counters[descriptor] = c
+		heap.Push(&this.heap, c)
+		return
+	}
+	if len(this.heap) == 0 {
+		return
+	}
+	// the new descriptor replaces the lightest one, whose hits it may have had
+	c := this.heap[0]
+	delete(this.counters, c.descriptor)
+	c.descriptor = descriptor
+	c.err = c.count
+	c.count += hits
+	this.counters[descriptor] = c
+	heap.Fix(&this.heap, 0)
+}
+
+// counterHeap is a heap.Interface of the counters, the lightest first.
+type counterHeap []*counter
+
+func (this counterHeap) Len() int           { return len(this) }
+func (this counterHeap) Less(i, j int) bool { return this[i].count < this[j].count }
+
+func (this counterHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*this)
+	*this = append(*this, c)
+}
+
+func (this *counterHeap) Pop() any {
+	old := *this
+	c := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return c
+}
@@ -2,11 +2,14 @@ package trace
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
 	logger "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
@@ -22,39 +25,58 @@ var (
 	testSpanExporterMu sync.Mutex
 )
 
-func InitProductionTraceProvider(protocol string, serviceName string, serviceNamespace string, serviceInstanceId string, samplingRate float64) *sdktrace.TracerProvider {
-	client := createClient(protocol)
+// ProviderConfig configures the OTLP exporter and the tracer provider. The unset exporter fields
+// fall back to the OTEL_EXPORTER_OTLP_* environment variables.
+type ProviderConfig struct {
+	Protocol           string
+	Endpoint           string
+	Headers            map[string]string
+	Insecure           bool
+	ServiceName        string
+	ServiceNamespace   string
+	ServiceInstanceId  string
+	ResourceAttributes map[string]string
+	Sampler            string
+	SamplingRate       float64
+}
+
+// InitProductionTraceProvider creates the tracer provider exporting to the OTLP endpoint of the
+// config and installs it as the global one, an error for an invalid config.
+func InitProductionTraceProvider(config ProviderConfig) (*sdktrace.TracerProvider, error) {
+	sampler, err := createSampler(config.Sampler, config.SamplingRate)
+	if err != nil {
+		return nil, err
+	}
+	client, err := createClient(config)
+	if err != nil {
+		return nil, err
+	}
 	exporter, err := otlptrace.New(context.Background(), client)
 	if err != nil {
-		logger.Fatalf("creating OTLP trace exporter: %v", err)
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
 	}
 
 	var useServiceInstanceId string
-	if serviceInstanceId == "" {
+	if config.ServiceInstanceId == "" {
 		intUuid, err := uuid.NewRandom()
 		if err != nil {
-			logger.Fatalf("generating random uuid for trace exporter: %v", err)
+			return nil, fmt.Errorf("generating random uuid for trace exporter: %w", err)
 		}
 		useServiceInstanceId = intUuid.String()
 	} else {
-		useServiceInstanceId = serviceInstanceId
+		useServiceInstanceId = config.ServiceInstanceId
 	}
 
-	resource := resource.NewWithAttributes(
-		semconv.SchemaURL,
-		semconv.ServiceNameKey.String(serviceName),
-		semconv.ServiceNamespaceKey.String(serviceNamespace),
+	attributes := make([]attribute.KeyValue, 0, len(config.ResourceAttributes)+3)
+	for key, value := range config.ResourceAttributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	attributes = append(attributes,
+		semconv.ServiceNameKey.String(config.ServiceName),
+		semconv.ServiceNamespaceKey.String(config.ServiceNamespace),
 		semconv.ServiceInstanceIDKey.String(useServiceInstanceId),
 	)
-
-	if err != nil {
-		logger.Fatal(err)
-	}
-	// trace if parent contains root span and is sampled
-	// otherwise only trace according to sampling rate
-	// if samplingRate >= 1, the AlwaysSample sampler is used
-	// if samplingRate <= 0, the NeverSampler sampler is used
-	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRate))
+	resource := resource.NewWithAttributes(semconv.SchemaURL, attributes...)
 
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sampler),
@@ -63,21 +85,68 @@ func InitProductionTraceProvider(protocol string, serviceName string, serviceNam
 	)
 	otel.SetTracerProvider(tp)
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
-	logger.Infof("TracerProvider initialized with following parameters: protocol: %s, serviceName: %s, serviceNamespace: %s, serviceInstanceId: %s, samplingRate: %f",
-		protocol, serviceName, serviceNamespace, useServiceInstanceId, samplingRate)
-	return tp
+	logger.Infof("TracerProvider initialized with following parameters: protocol: %s, endpoint: %s, serviceName: %s, serviceNamespace: %s, serviceInstanceId: %s, sampler: %s, samplingRate: %f",
+		config.Protocol, config.Endpoint, config.ServiceName, config.ServiceNamespace, useServiceInstanceId, config.Sampler, config.SamplingRate)
+	return tp, nil
 }
 
-func createClient(protocol string) (client otlptrace.Client) {
-	// endpoint is implicitly set by env variables, refer to https://opentelemetry.io/docs/reference/specification/protocol/exporter/
-	switch protocol {
+// createSampler returns the sampler named like the values of OTEL_TRACES_SAMPLER, the ratio
+// samplers use samplingRate. If samplingRate >= 1 the ratio sampler always samples, and if
+// samplingRate <= 0 it never samples.
+func createSampler(name string, samplingRate float64) (sdktrace.Sampler, error) {
+	switch name {
+	case "parentbased_traceidratio", "":
+		// trace if parent contains root span and is sampled
+		// otherwise only trace according to sampling rate
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRate)), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(samplingRate), nil
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	default:
+		return nil, fmt.Errorf("invalid trace sampler: %s", name)
+	}
+}
+
+func createClient(config ProviderConfig) (client otlptrace.Client, err error) {
+	// the unset options are read from the env variables, refer to https://opentelemetry.io/docs/reference/specification/protocol/exporter/
+	switch config.Protocol {
 	case "http", "":
-		client = otlptracehttp.NewClient()
+		opts := []otlptracehttp.Option{}
+		if strings.Contains(config.Endpoint, "://") {
+			opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+		} else if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
 	case "grpc":
-		client = otlptracegrpc.NewClient()
+		opts := []otlptracegrpc.Option{}
+		if strings.Contains(config.Endpoint, "://") {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(config.Endpoint))
+		} else if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(config.Headers))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
 	default:
-		logger.Fatalf("Invalid otlptrace client protocol: %s", protocol)
-		panic("Invalid otlptrace client protocol")
+		return nil, fmt.Errorf("invalid otlptrace client protocol: %s", config.Protocol)
 	}
 	return
 }
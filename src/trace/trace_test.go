@@ -0,0 +1,41 @@
+package trace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateSampler(t *testing.T) {
+	cases := []struct {
+		name         string
+		samplingRate float64
+		description  string
+	}{
+		{"", 0.5, "ParentBased{root:TraceIDRatioBased{0.5},remoteParentSampled:AlwaysOnSampler,remoteParentNotSampled:AlwaysOffSampler,localParentSampled:AlwaysOnSampler,localParentNotSampled:AlwaysOffSampler}"},
+		{"parentbased_traceidratio", 0.25, "ParentBased{root:TraceIDRatioBased{0.25},remoteParentSampled:AlwaysOnSampler,remoteParentNotSampled:AlwaysOffSampler,localParentSampled:AlwaysOnSampler,localParentNotSampled:AlwaysOffSampler}"},
+		{"traceidratio", 0.1, "TraceIDRatioBased{0.1}"},
+		// the ratio samplers always sample from a rate of 1, and never at or below 0
+		{"traceidratio", 2, "AlwaysOnSampler"},
+		{"traceidratio", -1, "TraceIDRatioBased{0}"},
+		{"always_on", 0.5, "AlwaysOnSampler"},
+		{"always_off", 0.5, "AlwaysOffSampler"},
+		{"parentbased_always_on", 0, "ParentBased{root:AlwaysOnSampler,remoteParentSampled:AlwaysOnSampler,remoteParentNotSampled:AlwaysOffSampler,localParentSampled:AlwaysOnSampler,localParentNotSampled:AlwaysOffSampler}"},
+		{"parentbased_always_off", 1, "ParentBased{root:AlwaysOffSampler,remoteParentSampled:AlwaysOnSampler,remoteParentNotSampled:AlwaysOffSampler,localParentSampled:AlwaysOnSampler,localParentNotSampled:AlwaysOffSampler}"},
+	}
+	for _, c := range cases {
+		sampler, err := createSampler(c.name, c.samplingRate)
+		assert.NoError(t, err)
+		assert.Equal(t, c.description, sampler.Description(), c.name)
+	}
+
+	_, err := createSampler("sometimes", 1)
+	assert.EqualError(t, err, "invalid trace sampler: sometimes")
+}
+
+func TestInitProductionTraceProviderInvalidConfig(t *testing.T) {
+	_, err := InitProductionTraceProvider(ProviderConfig{Sampler: "sometimes"})
+	assert.EqualError(t, err, "invalid trace sampler: sometimes")
+	_, err = InitProductionTraceProvider(ProviderConfig{Protocol: "smoke"})
+	assert.EqualError(t, err, "invalid otlptrace client protocol: smoke")
+}
@@ -14,6 +14,22 @@ type TimeSource interface {
 	UnixNow() int64
 }
 
+// Interface for a time source with a millisecond precision, used by the limiters depending on the
+// time within a second.
+type MilliTimeSource interface {
+	// @return the current unix time in milliseconds.
+	UnixMilliNow() int64
+}
+
+// UnixMilliNow returns the current unix time in milliseconds of the time source, the start of the
+// current second if it has no millisecond precision.
+func UnixMilliNow(timeSource TimeSource) int64 {
+	if milliTimeSource, ok := timeSource.(MilliTimeSource); ok {
+		return milliTimeSource.UnixMilliNow()
+	}
+	return timeSource.UnixNow() * 1000
+}
+
 // Convert a rate limit into a time divider.
 // @param unit supplies the unit to convert.
 // @return the divider to use in time computations.
@@ -38,10 +54,26 @@ func UnitToDivider(unit pb.RateLimitResponse_RateLimit_Unit) int64 {
 	panic("should not get here")
 }
 
+// Convert a rate limit of multiple units into a time divider.
+// @param unit supplies the unit to convert.
+// @param multiplier supplies the number of units of the window, 0 or 1 for a single unit.
+// @return the divider to use in time computations.
+func UnitToDividerWithMultiplier(unit pb.RateLimitResponse_RateLimit_Unit, multiplier uint32) int64 {
+	divider := UnitToDivider(unit)
+	if multiplier > 1 {
+		divider *= int64(multiplier)
+	}
+	return divider
+}
+
 func CalculateReset(unit *pb.RateLimitResponse_RateLimit_Unit, timeSource TimeSource) *durationpb.Duration {
-	sec := UnitToDivider(*unit)
+	return CalculateResetWithDivider(UnitToDivider(*unit), timeSource)
+}
+
+// CalculateResetWithDivider returns the duration until the end of the current window of divider seconds.
+func CalculateResetWithDivider(divider int64, timeSource TimeSource) *durationpb.Duration {
 	now := timeSource.UnixNow()
-	return &durationpb.Duration{Seconds: sec - now%sec}
+	return &durationpb.Duration{Seconds: divider - now%divider}
 }
 
 // Mask credentials from a redis connection string like
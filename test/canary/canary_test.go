@@ -0,0 +1,102 @@
+package canary_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/health"
+
+	"github.com/envoyproxy/ratelimit/src/canary"
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	mock_rls "github.com/envoyproxy/ratelimit/test/mocks/rls"
+)
+
+func healthStatus(hc *server.HealthChecker) int {
+	recorder := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://1.2.3.4/healthcheck", nil)
+	hc.ServeHTTP(recorder, r)
+	return recorder.Code
+}
+
+func newCanarySettings() settings.Settings {
+	s := settings.Settings{}
+	s.CanaryDomain = "ratelimit_canary"
+	s.CanaryDescriptorKey = "canary"
+	s.CanaryDescriptorValue = "probe"
+	s.CanaryInterval = time.Second
+	s.CanaryLatencyThreshold = time.Second
+	s.CanaryFailureThreshold = 2
+	return s
+}
+
+func okResponse() *pb.RateLimitResponse {
+	return &pb.RateLimitResponse{
+		OverallCode: pb.RateLimitResponse_OK,
+		Statuses:    []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}},
+	}
+}
+
+func TestCanaryFailsHealthAfterConsecutiveFailures(t *testing.T) {
+	defer signal.Reset(syscall.SIGTERM)
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	service := mock_rls.NewMockRateLimitServiceServer(controller)
+	hc := server.NewHealthChecker(health.NewServer(), "ratelimit", false)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	c := canary.NewCanary(service, hc, store, newCanarySettings())
+
+	service.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).Return(nil, errors.New("redis down"))
+	assert.Error(c.Probe())
+	assert.Equal(200, healthStatus(hc))
+
+	service.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).Return(
+		&pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_UNKNOWN}, nil)
+	assert.Error(c.Probe())
+	assert.Equal(500, healthStatus(hc))
+	assert.EqualValues(2, store.NewCounter("failure").Value())
+	assert.EqualValues(2, store.NewGauge("consecutive_failures").Value())
+
+	service.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ interface{}, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+			assert.Equal("ratelimit_canary", request.Domain)
+			assert.Equal("canary", request.Descriptors[0].Entries[0].Key)
+			assert.Equal("probe", request.Descriptors[0].Entries[0].Value)
+			return okResponse(), nil
+		})
+	assert.NoError(c.Probe())
+	assert.Equal(200, healthStatus(hc))
+	assert.EqualValues(1, store.NewCounter("success").Value())
+	assert.EqualValues(0, store.NewGauge("consecutive_failures").Value())
+}
+
+func TestCanaryLatencyThreshold(t *testing.T) {
+	defer signal.Reset(syscall.SIGTERM)
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	service := mock_rls.NewMockRateLimitServiceServer(controller)
+	hc := server.NewHealthChecker(health.NewServer(), "ratelimit", false)
+	s := newCanarySettings()
+	s.CanaryLatencyThreshold = 10 * time.Millisecond
+	c := canary.NewCanary(service, hc, gostats.NewStore(gostats.NewNullSink(), false), s)
+
+	service.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ interface{}, _ *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+			time.Sleep(20 * time.Millisecond)
+			return okResponse(), nil
+		})
+	assert.Error(c.Probe())
+}
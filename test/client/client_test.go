@@ -0,0 +1,157 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	pb_type "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyproxy/ratelimit/src/client"
+)
+
+// flakyService fails the first requests with err, then limits the requests of the domain "limited"
+// for 1.5s, and records the last request.
+type flakyService struct {
+	pb.UnimplementedRateLimitServiceServer
+	failures atomic.Int32
+	err      error
+	requests atomic.Int32
+	last     atomic.Pointer[pb.RateLimitRequest]
+}
+
+func (this *flakyService) ShouldRateLimit(_ context.Context, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+	this.requests.Add(1)
+	this.last.Store(request)
+	if this.failures.Add(-1) >= 0 {
+		return nil, this.err
+	}
+	if request.Domain == "limited" {
+		return &pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OVER_LIMIT, DurationUntilReset: durationpb.New(1500 * time.Millisecond)},
+			},
+			ResponseHeadersToAdd: []*core.HeaderValue{{Key: "x-ratelimit-remaining", Value: "0"}},
+		}, nil
+	}
+	return &pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_OK}, nil
+}
+
+func newClient(t *testing.T, service *flakyService, options client.Options) *client.Client {
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	pb.RegisterRateLimitServiceServer(grpcServer, service)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	options.DialOptions = []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+	}
+	ret, err := client.New("passthrough:///bufnet", options)
+	assert.NoError(t, err)
+	t.Cleanup(func() { ret.Close() })
+	return ret
+}
+
+func TestClientRetries(t *testing.T) {
+	assert := assert.New(t)
+	service := &flakyService{err: status.Error(codes.Unavailable, "unavailable")}
+	service.failures.Store(2)
+	c := newClient(t, service, client.Options{Timeout: time.Second, MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	allowed, err := c.Allow(context.Background(), "domain", client.Descriptor("key", "value"))
+	assert.NoError(err)
+	assert.True(allowed)
+	assert.EqualValues(3, service.requests.Load())
+
+	allowed, err = c.Allow(context.Background(), "limited", client.Descriptor("key", "value"))
+	assert.NoError(err)
+	assert.False(allowed)
+
+	// the errors of the request aren't retried
+	service = &flakyService{err: status.Error(codes.InvalidArgument, "invalid")}
+	service.failures.Store(1)
+	c = newClient(t, service, client.Options{MaxRetries: 2})
+	_, err = c.ShouldRateLimit(context.Background(), client.NewRequest("domain", 1))
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.EqualValues(1, service.requests.Load())
+
+	// the timeouts, whose hits may have been counted, are only retried with RetryTimeouts
+	service = &flakyService{err: status.Error(codes.DeadlineExceeded, "timeout")}
+	service.failures.Store(1)
+	_, err = newClient(t, service, client.Options{MaxRetries: 2}).ShouldRateLimit(context.Background(), client.NewRequest("domain", 1))
+	assert.Equal(codes.DeadlineExceeded, status.Code(err))
+	assert.EqualValues(1, service.requests.Load())
+	service.failures.Store(1)
+	_, err = newClient(t, service, client.Options{MaxRetries: 2, RetryTimeouts: true}).ShouldRateLimit(context.Background(), client.NewRequest("domain", 1))
+	assert.NoError(err)
+	assert.EqualValues(3, service.requests.Load())
+}
+
+func TestClientFailureModes(t *testing.T) {
+	assert := assert.New(t)
+	service := &flakyService{err: status.Error(codes.Unavailable, "unavailable")}
+	service.failures.Store(100)
+
+	allowed, err := newClient(t, service, client.Options{MaxRetries: 1}).Allow(context.Background(), "domain")
+	assert.Equal(codes.Unavailable, status.Code(err))
+	assert.True(allowed)
+	assert.EqualValues(2, service.requests.Load())
+
+	allowed, err = newClient(t, service, client.Options{FailureMode: client.FailClosed}).Allow(context.Background(), "domain")
+	assert.Error(err)
+	assert.False(allowed)
+
+	var fallbackRequest *pb.RateLimitRequest
+	allowed, err = newClient(t, service, client.Options{
+		FailureMode: client.FailOpen,
+		Fallback: func(request *pb.RateLimitRequest, err error) bool {
+			fallbackRequest = request
+			return false
+		},
+	}).Allow(context.Background(), "domain", client.Descriptor("key", "value"))
+	assert.Error(err)
+	assert.False(allowed)
+	assert.Equal("domain", fallbackRequest.Domain)
+
+	// a done context isn't retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newClient(t, service, client.Options{MaxRetries: 5}).ShouldRateLimit(ctx, client.NewRequest("domain", 1))
+	assert.True(errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled)
+}
+
+func TestDescriptors(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(&pb_struct.RateLimitDescriptor{Entries: []*pb_struct.RateLimitDescriptor_Entry{
+		{Key: "route", Value: "/login"}, {Key: "user_id", Value: "alice"},
+	}}, client.Descriptor("route", "/login", "user_id", "alice"))
+	assert.Panics(func() { client.Descriptor("route") })
+
+	descriptor := client.NewDescriptorBuilder().
+		Add("route", "/login").
+		AddIfSet("user_id", "").
+		AddIfSet("tenant", "acme").
+		WithLimit(10, pb_type.RateLimitUnit_MINUTE).
+		Build()
+	assert.Equal(&pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "route", Value: "/login"}, {Key: "tenant", Value: "acme"}},
+		Limit:   &pb_struct.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 10, Unit: pb_type.RateLimitUnit_MINUTE},
+	}, descriptor)
+
+	assert.Equal(&pb.RateLimitRequest{Domain: "domain", HitsAddend: 2, Descriptors: []*pb_struct.RateLimitDescriptor{descriptor}},
+		client.NewRequest("domain", 2, descriptor))
+}
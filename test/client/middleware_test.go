@@ -0,0 +1,134 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/client"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	service := &flakyService{}
+	c := newClient(t, service, client.Options{})
+	next := http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) { writer.WriteHeader(http.StatusNoContent) })
+
+	request := httptest.NewRequest(http.MethodGet, "/login?user=alice", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	recorder := httptest.NewRecorder()
+	c.HTTPMiddleware("domain", nil)(next).ServeHTTP(recorder, request)
+	assert.Equal(http.StatusNoContent, recorder.Code)
+	assert.Equal([]*pb_struct.RateLimitDescriptor{
+		client.Descriptor("method", "GET"),
+		client.Descriptor("remote_address", "10.0.0.1"),
+	}, service.last.Load().Descriptors)
+
+	// the route pattern of a ServeMux is used instead of the path
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", c.HTTPMiddleware("domain", nil)(next))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.Equal(http.StatusNoContent, recorder.Code)
+	assert.Equal(client.Descriptor("method", "GET", "pattern", "GET /users/{id}"), service.last.Load().Descriptors[0])
+
+	recorder = httptest.NewRecorder()
+	c.HTTPMiddleware("limited", nil)(next).ServeHTTP(recorder, request)
+	assert.Equal(http.StatusTooManyRequests, recorder.Code)
+	assert.Equal("2", recorder.Header().Get("Retry-After"))
+	assert.Equal("0", recorder.Header().Get("x-ratelimit-remaining"))
+
+	// the requests without descriptors aren't checked
+	requests := service.requests.Load()
+	recorder = httptest.NewRecorder()
+	c.HTTPMiddleware("limited", func(*http.Request) []*pb_struct.RateLimitDescriptor { return nil })(next).
+		ServeHTTP(recorder, request)
+	assert.Equal(http.StatusNoContent, recorder.Code)
+	assert.Equal(requests, service.requests.Load())
+}
+
+func TestMiddlewareOnError(t *testing.T) {
+	assert := assert.New(t)
+	service := &flakyService{err: status.Error(codes.Internal, "internal")}
+	service.failures.Store(2)
+	var errors []error
+	c := newClient(t, service, client.Options{
+		FailureMode: client.FailClosed,
+		OnError:     func(_ *pb.RateLimitRequest, err error) { errors = append(errors, err) },
+	})
+	next := http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) { writer.WriteHeader(http.StatusNoContent) })
+
+	recorder := httptest.NewRecorder()
+	c.HTTPMiddleware("domain", nil)(next).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(http.StatusTooManyRequests, recorder.Code)
+	assert.Len(errors, 1)
+	assert.Equal(codes.Internal, status.Code(errors[0]))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/package.Service/Method"}
+	handler := func(context.Context, interface{}) (interface{}, error) { return "response", nil }
+	_, err := c.UnaryServerInterceptor("domain", nil)(context.Background(), "request", info, handler)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.Len(errors, 2)
+
+	// the answered requests aren't reported
+	_, err = c.UnaryServerInterceptor("domain", nil)(context.Background(), "request", info, handler)
+	assert.NoError(err)
+	assert.Len(errors, 2)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	assert := assert.New(t)
+	service := &flakyService{}
+	c := newClient(t, service, client.Options{})
+	info := &grpc.UnaryServerInfo{FullMethod: "/package.Service/Method"}
+	handler := func(context.Context, interface{}) (interface{}, error) { return "response", nil }
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+
+	response, err := c.UnaryServerInterceptor("domain", nil)(ctx, "request", info, handler)
+	assert.NoError(err)
+	assert.Equal("response", response)
+	assert.Equal([]*pb_struct.RateLimitDescriptor{
+		client.Descriptor("service", "package.Service", "method", "Method"),
+		client.Descriptor("remote_address", "10.0.0.1"),
+	}, service.last.Load().Descriptors)
+
+	_, err = c.UnaryServerInterceptor("limited", nil)(ctx, "request", info, handler)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	assert := assert.New(t)
+	c := newClient(t, &flakyService{}, client.Options{})
+	info := &grpc.StreamServerInfo{FullMethod: "/package.Service/Stream"}
+	handled := false
+	handler := func(interface{}, grpc.ServerStream) error {
+		handled = true
+		return nil
+	}
+
+	assert.NoError(c.StreamServerInterceptor("domain", nil)(nil, &serverStream{}, info, handler))
+	assert.True(handled)
+
+	handled = false
+	err := c.StreamServerInterceptor("limited", nil)(nil, &serverStream{}, info, handler)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.False(handled)
+}
+
+type serverStream struct {
+	grpc.ServerStream
+}
+
+func (this *serverStream) Context() context.Context {
+	return context.Background()
+}
@@ -12,11 +12,13 @@ import (
 	"google.golang.org/grpc"
 
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretgrpc "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 )
 
 type XdsServerConfig struct {
-	Port   int
-	NodeId string
+	Port          int
+	NodeId        string
+	ServerOptions []grpc.ServerOption
 }
 
 type SetSnapshotFunc func(*cache.Snapshot)
@@ -36,12 +38,13 @@ func StartXdsSotwServer(t *testing.T, config *XdsServerConfig, initSnapshot *cac
 	}
 	srv := server.NewServer(ctx, snapCache, nil)
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(config.ServerOptions...)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
 	if err != nil {
 		t.Errorf("Error listening to port: %v: %v", config.Port, err)
 	}
 	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	secretgrpc.RegisterSecretDiscoveryServiceServer(grpcServer, srv)
 	go func() {
 		if err = grpcServer.Serve(lis); err != nil {
 			t.Error(err)
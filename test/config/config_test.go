@@ -2,8 +2,11 @@ package config_test
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/envoyproxy/ratelimit/test/common"
 
@@ -15,6 +18,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/settings"
 	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
 )
 
@@ -362,7 +366,35 @@ func TestDuplicateDomain(t *testing.T) {
 			files = append(files, loadFile("duplicate_domain.yaml")...)
 			config.NewRateLimitConfigImpl(files, mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false)
 		},
-		"duplicate_domain.yaml: duplicate domain 'test-domain' in config file")
+		"duplicate_domain.yaml: duplicate domain 'test-domain' in config file, also defined in basic_config.yaml")
+}
+
+func TestDuplicateDomainPolicy(t *testing.T) {
+	assert := assert.New(t)
+	load := func(policy string) (config.RateLimitConfig, stats.Store) {
+		files := loadFile("basic_config.yaml")
+		files = append(files, loadFile("duplicate_domain.yaml")...)
+		store := stats.NewStore(stats.NewNullSink(), false)
+		return config.NewRateLimitConfigImplWithOptions(files, mockstats.NewMockStatManager(store), false,
+			config.LoaderOptions{DuplicateDomainPolicy: policy}), store
+	}
+	limitOf := func(rlConfig config.RateLimitConfig) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain",
+			&pb_struct.RateLimitDescriptor{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1", Value: "value1"}, {Key: "subkey1", Value: "something"}}})
+	}
+
+	rlConfig, store := load(config.DomainConflictMerge)
+	assert.NotNil(limitOf(rlConfig))
+	assert.EqualValues(1, store.NewCounter("config_domain_conflict").Value())
+
+	// the domain of the last file has no descriptors
+	rlConfig, store = load(config.DomainConflictLastWins)
+	assert.Nil(limitOf(rlConfig))
+	assert.EqualValues(1, store.NewCounter("config_domain_conflict").Value())
+
+	expectConfigPanic(t, func() { load(config.DomainConflictError) },
+		"duplicate_domain.yaml: duplicate domain 'test-domain' in config file, also defined in basic_config.yaml")
+	expectConfigPanic(t, func() { load("first_wins") }, "invalid DUPLICATE_DOMAIN_POLICY 'first_wins'")
 }
 
 func TestEmptyKey(t *testing.T) {
@@ -400,6 +432,167 @@ func TestDuplicateKeyDomainMerge(t *testing.T) {
 		"merge_domain_key1.yaml: duplicate descriptor composite key 'test-domain.key1_value1'")
 }
 
+func TestBackend(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+
+	files := loadFile("backend.yaml")
+	files = append(files, loadFile("merge_domain_key2.yaml")...)
+	rlConfig := config.NewRateLimitConfigImpl(files, mockstats.NewMockStatManager(stats), true)
+
+	rl := rlConfig.GetLimit(
+		context.TODO(), "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1", Value: "value1"}},
+		})
+	assert.Equal("pool-a", rl.Backend)
+
+	// The backend applies to the limits merged from other files of the domain.
+	rl = rlConfig.GetLimit(
+		context.TODO(), "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2", Value: "value2"}},
+		})
+	assert.Equal("pool-a", rl.Backend)
+
+	rl = rlConfig.GetLimit(
+		context.TODO(), "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1", Value: "value1"}},
+			Limit:   &pb_struct.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 5, Unit: pb_type.RateLimitUnit_SECOND},
+		})
+	assert.Equal("pool-a", rl.Backend)
+}
+
+func TestDumpTree(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+
+	files := loadFile("backend.yaml")
+	files = append(files, loadFile("merge_domain_key2.yaml")...)
+	rlConfig := config.NewRateLimitConfigImpl(files, mockstats.NewMockStatManager(stats), true)
+
+	assert.Equal([]*config.DomainDump{{
+		Domain:  "test-domain",
+		Backend: "pool-a",
+		Descriptors: []*config.DescriptorDump{
+			{
+				Key:       "key1",
+				Value:     "value1",
+				RateLimit: &config.RateLimitDump{RequestsPerUnit: 10, Unit: "MINUTE", Replaces: []string{}, StatsKey: "test-domain.key1_value1"},
+			},
+			{
+				Key:       "key2",
+				Value:     "value2",
+				RateLimit: &config.RateLimitDump{RequestsPerUnit: 20, Unit: "MINUTE", Replaces: []string{}, StatsKey: "test-domain.key2_value2"},
+			},
+		},
+	}}, rlConfig.DumpTree())
+}
+
+func TestBackendConflict(t *testing.T) {
+	expectConfigPanic(
+		t,
+		func() {
+			files := loadFile("backend.yaml")
+			files = append(files, loadFile("backend_conflict.yaml")...)
+			config.NewRateLimitConfigImpl(
+				files,
+				mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), true)
+		},
+		"backend_conflict.yaml: conflicting backend 'pool-b' for domain 'test-domain'")
+}
+
+func TestUnknownBackend(t *testing.T) {
+	assert := assert.New(t)
+	load := func(backends []string) config.RateLimitConfig {
+		return config.NewRateLimitConfigImplWithOptions(loadFile("backend.yaml"),
+			mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false,
+			config.LoaderOptions{Backends: backends})
+	}
+	assert.NotNil(load([]string{"pool-a", "pool-b"}))
+	assert.NotNil(load(nil))
+	expectConfigPanic(t, func() { load([]string{"pool-b"}) }, "backend.yaml: unknown backend 'pool-a' for domain 'test-domain'")
+	expectConfigPanic(t, func() { load([]string{}) }, "backend.yaml: unknown backend 'pool-a' for domain 'test-domain'")
+
+	// the backend of the file only
+	expectConfigPanic(t, func() {
+		loadYaml("nested_backend.yaml", "domain: d\ndescriptors:\n  - key: k\n    backend: pool-a\n")
+	}, "nested_backend.yaml: config error, key 'backend' is only valid at the root of the file")
+}
+
+func TestBackendNames(t *testing.T) {
+	assert := assert.New(t)
+	s := settings.NewSettings()
+	s.BackendType = "redis"
+	s.RedisPools = "pool-a=redis-a:6379;pool-b=redis-b:6379"
+	backends := config.NewLoaderOptions(s).Backends
+	sort.Strings(backends)
+	assert.Equal([]string{"pool-a", "pool-b"}, backends)
+
+	s.BackendType = "memcache"
+	assert.Equal([]string{}, config.NewLoaderOptions(s).Backends)
+	s.BackendType = "custom"
+	assert.Nil(config.NewLoaderOptions(s).Backends)
+}
+
+func TestUnsupportedFields(t *testing.T) {
+	assert := assert.New(t)
+	s := settings.NewSettings()
+	s.BackendType = "redis"
+	assert.Nil(config.NewLoaderOptions(s).UnsupportedFields)
+	s.BackendType = "memcache"
+	options := config.NewLoaderOptions(s)
+	assert.Contains(options.UnsupportedFields, "leaky_bucket")
+
+	content := `
+domain: test-domain
+descriptors:
+  - key: key1
+    descriptors:
+      - key: key2
+        rate_limit:
+          unit: second
+          requests_per_unit: 10
+          leaky_bucket: {}
+`
+	load := func(options config.LoaderOptions) config.RateLimitConfig {
+		return config.NewRateLimitConfigImplWithOptions(
+			[]config.RateLimitConfigToLoad{{Name: "leaky.yaml", ConfigYaml: config.ConfigFileContentToYaml("leaky.yaml", content)}},
+			mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false, options)
+	}
+	assert.NotNil(load(config.LoaderOptions{}))
+	expectConfigPanic(t, func() { load(options) }, "leaky.yaml: leaky_bucket is not supported by the backend")
+
+	assert.Contains(options.UnsupportedFields, "carry_over_percent")
+	content = `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+      carry_over_percent: 20
+`
+	expectConfigPanic(t, func() { load(options) }, "leaky.yaml: carry_over_percent is not supported by the backend")
+
+	assert.Contains(options.UnsupportedFields, "penalty")
+	content = `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+      penalty:
+        over_limits: 3
+        window: 1m
+        duration: 5m
+`
+	assert.NotNil(load(config.LoaderOptions{}))
+	expectConfigPanic(t, func() { load(options) }, "leaky.yaml: penalty is not supported by the backend")
+}
+
 func TestBadLimitUnit(t *testing.T) {
 	expectConfigPanic(
 		t,
@@ -1198,6 +1391,11 @@ func TestValueToMetric_DoesNotOverrideDetailedMetric(t *testing.T) {
 
 	rl.Stats.TotalHits.Inc()
 	asrt.EqualValues(1, store.NewCounter(expectedKey+".total_hits").Value())
+
+	// the matches are counted by the rule
+	rl.Stats.Matched.Inc()
+	asrt.EqualValues(1, store.NewCounter("domain.route.http_method.subject_id.matched").Value())
+	asrt.EqualValues(0, store.NewCounter(expectedKey+".matched").Value())
 }
 
 func TestValueToMetric_WithConfiguredValues(t *testing.T) {
@@ -1979,3 +2177,1286 @@ func TestWildcardStatsBehavior(t *testing.T) {
 		asrt.Equal(rl.Stats.Key, rl.FullKey, "FullKey should match Stats.Key")
 	})
 }
+
+func loadYaml(name string, content string) config.RateLimitConfig {
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	configYaml := config.ConfigFileContentToYaml(name, content)
+	return config.NewRateLimitConfigImpl(
+		[]config.RateLimitConfigToLoad{{Name: name, ConfigYaml: configYaml}}, mockstats.NewMockStatManager(stats), false)
+}
+
+func TestMergedConfig(t *testing.T) {
+	assert := assert.New(t)
+	primary := loadYaml("xds", `
+domain: shared
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+`)
+	secondary := loadYaml("file", `
+domain: shared
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+  - key: key2
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`)
+	other := loadYaml("file", `
+domain: other
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: hour
+      requests_per_unit: 1
+`)
+
+	merged := config.NewMergedRateLimitConfig(primary, config.NewMergedRateLimitConfig(secondary, nil))
+	assert.False(merged.IsEmptyDomains())
+	limit := merged.GetLimit(context.TODO(), "shared", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.EqualValues(10, limit.Limit.RequestsPerUnit)
+	// the descriptors of the secondary configuration are not mixed into a primary domain
+	assert.Nil(merged.GetLimit(context.TODO(), "shared", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2"}},
+	}))
+	assert.NotContains(merged.Dump(), "unit=MINUTE")
+
+	merged = config.NewMergedRateLimitConfig(primary, other)
+	limit = merged.GetLimit(context.TODO(), "other", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.EqualValues(1, limit.Limit.RequestsPerUnit)
+	tree := merged.DumpTree()
+	assert.Len(tree, 2)
+	assert.Equal("other", tree[0].Domain)
+	assert.Equal("shared", tree[1].Domain)
+
+	// the domains are told apart by name, whatever their dots
+	dotted := loadYaml("file", `
+domain: shared.v2
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: hour
+      requests_per_unit: 1
+`)
+	merged = config.NewMergedRateLimitConfig(primary, dotted)
+	assert.Contains(merged.Dump(), "shared.v2.key1: unit=HOUR")
+	merged = config.NewMergedRateLimitConfig(dotted, dotted)
+	assert.Equal(dotted.Dump(), merged.Dump())
+}
+
+func TestRuleMetadataConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("metadata", `
+domain: test-domain
+descriptors:
+  - key: key1
+    detailed_metric: true
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+      metadata:
+        retry_after_hint: 60
+        plan: free
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(map[string]string{"retry_after_hint": "60", "plan": "free"}, limit.Metadata)
+	assert.Equal(limit.Metadata, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.Metadata)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("metadata: config error, metadata 'nested' must be a scalar"), func() {
+		loadYaml("metadata", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+      metadata:
+        nested:
+          key: value
+`)
+	})
+
+	// the metadata of the rate limit only
+	expectConfigPanic(t, func() {
+		loadYaml("metadata", "domain: d\ndescriptors:\n  - key: k\n    metadata:\n      plan: free\n    rate_limit:\n      unit: minute\n      requests_per_unit: 5\n")
+	}, "metadata: config error, key 'metadata' is only valid in 'rate_limit'")
+	expectConfigPanic(t, func() {
+		loadYaml("metadata", "domain: d\nmetadata:\n  plan: free\ndescriptors:\n  - key: k\n")
+	}, "metadata: config error, key 'metadata' is only valid in 'rate_limit'")
+	expectConfigPanic(t, func() {
+		loadYaml("metadata", "domain: d\ndescriptors:\n  - key: k\n    rate_limit:\n      unit: minute\n      requests_per_unit: 5\n      quota:\n        unit: day\n        requests_per_unit: 50\n        metadata:\n          plan: free\n")
+	}, "metadata: config error, key 'metadata' is only valid in 'rate_limit'")
+}
+
+func TestCacheKeyHashConfig(t *testing.T) {
+	assert := assert.New(t)
+	content := `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+  - key: key2
+    cache_key_hash: sha256
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+  - key: key3
+    cache_key_hash: none
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`
+	rlConfig := config.NewRateLimitConfigImplWithOptions(
+		[]config.RateLimitConfigToLoad{{Name: "cache_key_hash", ConfigYaml: config.ConfigFileContentToYaml("cache_key_hash", content)}},
+		mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false,
+		config.LoaderOptions{CacheKeyHash: config.CacheKeyHashXxhash})
+	getLimit := func(key string) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: key}},
+		})
+	}
+	assert.Equal(config.CacheKeyHashXxhash, getLimit("key1").CacheKeyHash)
+	assert.Equal(config.CacheKeyHashSha256, getLimit("key2").CacheKeyHash)
+	assert.Equal("", getLimit("key3").CacheKeyHash)
+
+	// the global hash is validated, none keeping the entries
+	loadWithHash := func(hash string) config.RateLimitConfig {
+		return config.NewRateLimitConfigImplWithOptions(
+			[]config.RateLimitConfigToLoad{{Name: "cache_key_hash", ConfigYaml: config.ConfigFileContentToYaml("cache_key_hash", content)}},
+			mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false,
+			config.LoaderOptions{CacheKeyHash: hash})
+	}
+	rlConfig = loadWithHash(config.CacheKeyHashNone)
+	assert.Equal("", getLimit("key1").CacheKeyHash)
+	assert.PanicsWithValue(config.RateLimitConfigError("invalid CACHE_KEY_HASH 'md5'"), func() { loadWithHash("md5") })
+
+	assert.PanicsWithValue(config.RateLimitConfigError("cache_key_hash: invalid cache_key_hash 'md5'"), func() {
+		loadYaml("cache_key_hash", `
+domain: test-domain
+descriptors:
+  - key: key1
+    cache_key_hash: md5
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`)
+	})
+}
+
+func TestUnitMultiplierCurrentLimit(t *testing.T) {
+	for _, test := range []struct {
+		unit       pb.RateLimitResponse_RateLimit_Unit
+		multiplier uint32
+		expected   pb.RateLimitResponse_RateLimit_Unit
+	}{
+		{pb.RateLimitResponse_RateLimit_SECOND, 1, pb.RateLimitResponse_RateLimit_SECOND},
+		{pb.RateLimitResponse_RateLimit_SECOND, 60, pb.RateLimitResponse_RateLimit_MINUTE},
+		{pb.RateLimitResponse_RateLimit_SECOND, 61, pb.RateLimitResponse_RateLimit_HOUR},
+		{pb.RateLimitResponse_RateLimit_MINUTE, 5, pb.RateLimitResponse_RateLimit_HOUR},
+		{pb.RateLimitResponse_RateLimit_HOUR, 24, pb.RateLimitResponse_RateLimit_DAY},
+		{pb.RateLimitResponse_RateLimit_DAY, 7, pb.RateLimitResponse_RateLimit_WEEK},
+		{pb.RateLimitResponse_RateLimit_DAY, 30, pb.RateLimitResponse_RateLimit_MONTH},
+		{pb.RateLimitResponse_RateLimit_MONTH, 6, pb.RateLimitResponse_RateLimit_YEAR},
+		{pb.RateLimitResponse_RateLimit_YEAR, 2, pb.RateLimitResponse_RateLimit_YEAR},
+	} {
+		t.Run(fmt.Sprintf("%s_%d", test.unit, test.multiplier), func(t *testing.T) {
+			limit := config.NewRateLimit(10, test.unit, mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)).NewStats("key"), false, false, "name", nil, false)
+			limit.UnitMultiplier = test.multiplier
+			currentLimit := limit.CurrentLimit()
+			assert.Equal(t, test.expected, currentLimit.Unit)
+			assert.EqualValues(t, 10, currentLimit.RequestsPerUnit)
+			assert.Equal(t, "name", currentLimit.Name)
+		})
+	}
+}
+
+func TestUnitMultiplierConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("unit_multiplier", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      unit_multiplier: 5
+      requests_per_unit: 10
+  - key: key2
+    rate_limit:
+      unit: month
+      requests_per_unit: 1000
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, limit.Limit.Unit)
+	assert.EqualValues(5, limit.UnitMultiplier)
+	assert.EqualValues(5, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.UnitMultiplier)
+
+	limit = rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2"}},
+	})
+	assert.Equal(pb.RateLimitResponse_RateLimit_MONTH, limit.Limit.Unit)
+	assert.EqualValues(0, limit.UnitMultiplier)
+	assert.Same(limit.Limit, limit.CurrentLimit())
+
+	assert.PanicsWithValue(config.RateLimitConfigError("unit_multiplier: should not specify unit_multiplier when unlimited"), func() {
+		loadYaml("unit_multiplier", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unlimited: true
+      unit_multiplier: 5
+`)
+	})
+}
+
+func TestQuotaConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("quota", `
+domain: test-domain
+descriptors:
+  - key: key1
+    shadow_mode: true
+    rate_limit:
+      unit: second
+      requests_per_unit: 100
+      quota:
+        unit: day
+        requests_per_unit: 1000000
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.EqualValues(100, limit.Limit.RequestsPerUnit)
+	assert.False(limit.IsQuota)
+	assert.EqualValues(1000000, limit.Quota.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_DAY, limit.Quota.Limit.Unit)
+	assert.True(limit.Quota.IsQuota)
+	assert.True(limit.Quota.ShadowMode)
+	assert.Equal("test-domain.key1.quota", limit.Quota.Stats.Key)
+	assert.EqualValues(1000000, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.Quota.RequestsPerUnit)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("quota: invalid quota unit 'fortnight'"), func() {
+		loadYaml("quota", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 100
+      quota:
+        unit: fortnight
+        requests_per_unit: 1000000
+`)
+	})
+}
+
+func TestCostConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("cost", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 100
+      cost: 10
+      quota:
+        unit: day
+        requests_per_unit: 1000000
+  - key: key2
+    rate_limit:
+      unit: second
+      requests_per_unit: 100
+`)
+	getLimit := func(key string) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: key}},
+		})
+	}
+	assert.EqualValues(10, getLimit("key1").Cost)
+	assert.EqualValues(10, getLimit("key1").Quota.Cost)
+	assert.EqualValues(0, getLimit("key2").Cost)
+	assert.EqualValues(10, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.Cost)
+}
+
+func TestNegativeLookups(t *testing.T) {
+	assert := assert.New(t)
+	content := `
+domain: test-domain
+descriptors:
+  - key: key1
+    value: value1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+  - key: key2
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`
+	rlConfig := loadYaml("negative_lookups", content)
+	getLimit := func(rlConfig config.RateLimitConfig, entries ...*pb_struct.RateLimitDescriptor_Entry) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{Entries: entries})
+	}
+
+	// the descriptors without limit stay without limit once remembered
+	for i := 0; i < 2; i++ {
+		assert.Nil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key1", Value: "value2"}))
+		assert.Nil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key3"}))
+		assert.NotNil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key1", Value: "value1"}))
+		assert.NotNil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key2", Value: "value2"}))
+	}
+
+	// entries whose concatenations are equal are distinct descriptors
+	assert.Nil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key", Value: "1value1"}))
+	assert.NotNil(getLimit(rlConfig, &pb_struct.RateLimitDescriptor_Entry{Key: "key1", Value: "value1"}))
+
+	// a reloaded configuration does not remember the lookups of the previous one
+	reloaded := loadYaml("negative_lookups", content+`
+  - key: key3
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`)
+	assert.NotNil(getLimit(reloaded, &pb_struct.RateLimitDescriptor_Entry{Key: "key3"}))
+}
+
+func TestScheduleConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("schedules", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 500
+      schedules:
+        - name: business_hours
+          days: mon-fri
+          start: 09:00
+          end: "18:00"
+          timezone: America/New_York
+          requests_per_unit: 100
+        - name: nightly
+          days: fri-sun
+          start: "22:00"
+          end: "06:00"
+          requests_per_unit: 1000
+  - key: key2
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      schedules:
+        - name: always
+          requests_per_unit: 20
+`)
+	getLimit := func(key string) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: key}},
+		})
+	}
+
+	// the limit and stats of the active schedule apply
+	limit := getLimit("key2")
+	assert.EqualValues(20, limit.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_SECOND, limit.Limit.Unit)
+	assert.Equal("always", limit.ActiveSchedule)
+	assert.Equal("test-domain.key2.schedule_always", limit.Stats.Key)
+	assert.Equal(limit.Stats.Key, limit.FullKey)
+
+	schedules := getLimit("key1").Schedules
+	assert.Len(schedules, 2)
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(err)
+	// Wednesday
+	assert.True(schedules[0].Contains(time.Date(2024, 5, 15, 9, 0, 0, 0, newYork)))
+	assert.True(schedules[0].Contains(time.Date(2024, 5, 15, 17, 59, 0, 0, newYork)))
+	assert.False(schedules[0].Contains(time.Date(2024, 5, 15, 18, 0, 0, 0, newYork)))
+	assert.False(schedules[0].Contains(time.Date(2024, 5, 15, 12, 59, 0, 0, time.UTC)))
+	assert.True(schedules[0].Contains(time.Date(2024, 5, 15, 13, 0, 0, 0, time.UTC)))
+	// Saturday
+	assert.False(schedules[0].Contains(time.Date(2024, 5, 18, 12, 0, 0, 0, newYork)))
+	// the window spanning midnight belongs to the day it starts on
+	assert.False(schedules[1].Contains(time.Date(2024, 5, 16, 23, 0, 0, 0, time.UTC)))
+	assert.False(schedules[1].Contains(time.Date(2024, 5, 17, 5, 0, 0, 0, time.UTC)))
+	assert.True(schedules[1].Contains(time.Date(2024, 5, 17, 23, 0, 0, 0, time.UTC)))
+	assert.True(schedules[1].Contains(time.Date(2024, 5, 20, 5, 59, 0, 0, time.UTC)))
+	assert.False(schedules[1].Contains(time.Date(2024, 5, 20, 6, 0, 0, 0, time.UTC)))
+
+	dump := rlConfig.DumpTree()[0].Descriptors[0].RateLimit
+	assert.EqualValues(500, dump.RequestsPerUnit)
+	assert.Equal("business_hours", dump.Schedules[0].Name)
+	assert.EqualValues(100, dump.Schedules[0].RequestsPerUnit)
+
+	for _, test := range []struct {
+		schedule string
+		err      string
+	}{
+		{"{name: s, days: mon-xyz}", "schedule 's': invalid day 'xyz'"},
+		{"{name: s, start: '9:00'}", "schedule 's': invalid start: '9:00' is not HH:MM"},
+		{"{name: s, end: '24:30'}", "schedule 's': invalid end: '24:30' is not a time of day"},
+		{"{name: s, start: '10:00', end: '10:00'}", "schedule 's': start and end are equal"},
+		{"{name: s, timezone: Mars/Olympus}", "schedule 's': invalid timezone 'Mars/Olympus'"},
+		{"{days: mon}", "schedule has empty name"},
+	} {
+		assert.PanicsWithValue(config.RateLimitConfigError("schedules: "+test.err), func() {
+			loadYaml("schedules", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 500
+      schedules:
+        - `+test.schedule+`
+`)
+		}, test.schedule)
+	}
+
+	assert.PanicsWithValue(config.RateLimitConfigError("schedules: duplicate schedule 's'"), func() {
+		loadYaml("schedules", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 500
+      schedules:
+        - name: s
+        - name: s
+`)
+	})
+
+	// the keys of the schedules are only valid in the schedules
+	expectConfigPanic(t, func() {
+		loadYaml("schedules", "domain: d\ndescriptors:\n  - key: k\n    rate_limit:\n      unit: second\n      requests_per_unit: 5\n      days: mon\n")
+	}, "schedules: config error, key 'days' is only valid in 'schedules'")
+	expectConfigPanic(t, func() {
+		loadYaml("schedules", "domain: d\ndescriptors:\n  - key: k\n    timezone: UTC\n")
+	}, "schedules: config error, key 'timezone' is only valid in 'schedules'")
+	expectConfigPanic(t, func() {
+		loadYaml("schedules", "domain: d\ndescriptors:\n  - key: k\n    schedules:\n      - name: s\n")
+	}, "schedules: config error, key 'schedules' is only valid in 'rate_limit'")
+}
+
+func TestReadOnlyLookup(t *testing.T) {
+	assert := assert.New(t)
+	store := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig := config.NewRateLimitConfigImpl([]config.RateLimitConfigToLoad{{Name: "read_only", ConfigYaml: config.ConfigFileContentToYaml("read_only", `
+domain: test-domain
+descriptors:
+  - key: key1
+    detailed_metric: true
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+      schedules:
+        - name: always
+          requests_per_unit: 10
+`)}}, mockstats.NewMockStatManager(store), false)
+	descriptor := &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1", Value: "value1"}},
+	}
+
+	// the limit keeps the stats of its rule
+	ctx := config.WithReadOnlyLookup(context.Background())
+	limit := rlConfig.GetLimit(ctx, "test-domain", descriptor)
+	assert.EqualValues(10, limit.Limit.RequestsPerUnit)
+	assert.Equal("always", limit.ActiveSchedule)
+	assert.Equal("test-domain.key1_value1.schedule_always", limit.FullKey)
+	assert.Equal("test-domain.key1", limit.Stats.Key)
+	assert.Nil(rlConfig.GetLimit(ctx, "unknown-domain", descriptor))
+	assert.EqualValues(0, store.NewCounter("unknown-domain.domain_not_found").Value())
+
+	limit = rlConfig.GetLimit(context.Background(), "test-domain", descriptor)
+	assert.Equal("test-domain.key1_value1.schedule_always", limit.Stats.Key)
+	assert.Nil(rlConfig.GetLimit(context.Background(), "unknown-domain", descriptor))
+	assert.EqualValues(1, store.NewCounter("unknown-domain.domain_not_found").Value())
+}
+
+type scheduleTimeSource struct {
+	now time.Time
+}
+
+func (this *scheduleTimeSource) UnixNow() int64 {
+	return this.now.Unix()
+}
+
+func TestScheduleTimeSource(t *testing.T) {
+	assert := assert.New(t)
+	timeSource := &scheduleTimeSource{}
+	name := "schedules"
+	rlConfig := config.NewRateLimitConfigImplWithOptions([]config.RateLimitConfigToLoad{{Name: name, ConfigYaml: config.ConfigFileContentToYaml(name, `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 500
+      schedules:
+        - name: business_hours
+          days: mon-fri
+          start: "09:00"
+          end: "18:00"
+          requests_per_unit: 100
+`)}}, mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false,
+		config.LoaderOptions{TimeSource: timeSource})
+	getLimit := func() *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+		})
+	}
+
+	// Wednesday
+	timeSource.now = time.Date(2024, 5, 15, 9, 0, 0, 0, time.UTC)
+	limit := getLimit()
+	assert.EqualValues(100, limit.Limit.RequestsPerUnit)
+	assert.Equal("business_hours", limit.ActiveSchedule)
+
+	timeSource.now = time.Date(2024, 5, 15, 18, 0, 0, 0, time.UTC)
+	limit = getLimit()
+	assert.EqualValues(500, limit.Limit.RequestsPerUnit)
+	assert.Equal("", limit.ActiveSchedule)
+
+	// Saturday
+	timeSource.now = time.Date(2024, 5, 18, 12, 0, 0, 0, time.UTC)
+	assert.EqualValues(500, getLimit().Limit.RequestsPerUnit)
+}
+
+func TestPenaltyConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("penalty", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      penalty:
+        over_limits: 5
+        window: 1m
+        duration: 15m
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(&config.Penalty{OverLimits: 5, Window: time.Minute, Duration: 15 * time.Minute}, limit.Penalty)
+	assert.Equal("15m0s", rlConfig.DumpTree()[0].Descriptors[0].RateLimit.Penalty.Duration)
+
+	for _, test := range []struct {
+		penalty string
+		err     string
+	}{
+		{"{window: 1m, duration: 15m}", "penalty over_limits must be positive"},
+		{"{over_limits: 5, window: 10ms, duration: 15m}", "invalid penalty window '10ms', at least 1s"},
+		{"{over_limits: 5, window: 1m, duration: forever}", "invalid penalty duration 'forever', at least 1s"},
+	} {
+		assert.PanicsWithValue(config.RateLimitConfigError("penalty: "+test.err), func() {
+			loadYaml("penalty", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      penalty: `+test.penalty+`
+`)
+		}, test.penalty)
+	}
+}
+
+func TestExpirationJitterConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("jitter", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: day
+      requests_per_unit: 10
+      expiration_jitter: 15m
+  - key: key2
+    rate_limit:
+      unit: day
+      requests_per_unit: 10
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(15*time.Minute, *limit.ExpirationJitter)
+	assert.Equal("15m0s", rlConfig.DumpTree()[0].Descriptors[0].RateLimit.ExpirationJitter)
+	limit = rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2"}},
+	})
+	assert.Nil(limit.ExpirationJitter)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("jitter: invalid expiration_jitter '-1s'"), func() {
+		loadYaml("jitter", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: day
+      requests_per_unit: 10
+      expiration_jitter: -1s
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("jitter: should not specify expiration_jitter when unlimited"), func() {
+		loadYaml("jitter", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unlimited: true
+      expiration_jitter: 1m
+`)
+	})
+}
+
+func TestWindowAlignmentConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("alignment", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+      window_alignment: request
+  - key: key2
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+      window_alignment: clock
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.True(limit.RequestAligned)
+	assert.True(rlConfig.DumpTree()[0].Descriptors[0].RateLimit.RequestAligned)
+	limit = rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2"}},
+	})
+	assert.False(limit.RequestAligned)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("alignment: invalid window_alignment 'sliding'"), func() {
+		loadYaml("alignment", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+      window_alignment: sliding
+`)
+	})
+}
+
+func TestCacheKeyVersionConfig(t *testing.T) {
+	assert := assert.New(t)
+	load := func(requestsPerUnit int, version string) *config.RateLimit {
+		rlConfig := loadYaml("version", fmt.Sprintf(`
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: %d
+      cache_key_version: %s
+      quota:
+        unit: day
+        requests_per_unit: 1000
+`, requestsPerUnit, version))
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+		})
+	}
+
+	assert.Equal("2", load(10, "2").CacheKeyVersion)
+	assert.Equal("2", load(10, "2").Quota.CacheKeyVersion)
+
+	// the automatic version only changes with the limit
+	auto := load(10, "auto")
+	assert.Len(auto.CacheKeyVersion, 8)
+	assert.Equal(auto.CacheKeyVersion, load(10, "auto").CacheKeyVersion)
+	assert.NotEqual(auto.CacheKeyVersion, load(20, "auto").CacheKeyVersion)
+	assert.NotEqual(auto.CacheKeyVersion, auto.Quota.CacheKeyVersion)
+
+	assert.PanicsWithValue(config.RateLimitConfigError(
+		"version: invalid cache_key_version 'v_1', only letters, digits, '.' and '-'"), func() {
+		load(10, "v_1")
+	})
+}
+
+func TestLeakyBucketConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("leaky", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      leaky_bucket:
+        bucket_size: 50
+  - key: key2
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      leaky_bucket: {}
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(&config.LeakyBucket{BucketSize: 50}, limit.LeakyBucket)
+	assert.EqualValues(50, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.LeakyBucket.BucketSize)
+	// the bucket holds a window of requests by default
+	limit = rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2"}},
+	})
+	assert.Equal(&config.LeakyBucket{BucketSize: 10}, limit.LeakyBucket)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("leaky: should not specify window_alignment with leaky_bucket"), func() {
+		loadYaml("leaky", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      window_alignment: request
+      leaky_bucket:
+        bucket_size: 50
+`)
+	})
+	// a bucket which never drains
+	expectConfigPanic(t, func() {
+		loadYaml("leaky", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 0
+      leaky_bucket: {}
+`)
+	}, "leaky: should not specify leaky_bucket with requests_per_unit 0")
+	expectConfigPanic(t, func() {
+		loadYaml("leaky", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      schedules:
+        - name: closed
+          requests_per_unit: 0
+      leaky_bucket: {}
+`)
+	}, "leaky: should not specify leaky_bucket with requests_per_unit 0 in schedule 'closed'")
+}
+
+func TestConcurrencyConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("concurrency", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      concurrency:
+        max_in_flight: 10
+        lease_ttl: 5m
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.Equal(&config.Concurrency{MaxInFlight: 10, LeaseTtl: 5 * time.Minute}, limit.Concurrency)
+	assert.Equal(&config.ConcurrencyDump{MaxInFlight: 10, LeaseTtl: "5m0s"},
+		rlConfig.DumpTree()[0].Descriptors[0].RateLimit.Concurrency)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("concurrency: should not specify a rate with concurrency"), func() {
+		loadYaml("concurrency", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      concurrency:
+        max_in_flight: 10
+        lease_ttl: 5m
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("concurrency: concurrency max_in_flight should be positive"), func() {
+		loadYaml("concurrency", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      concurrency:
+        lease_ttl: 5m
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("concurrency: invalid concurrency lease_ttl ''"), func() {
+		loadYaml("concurrency", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      concurrency:
+        max_in_flight: 10
+`)
+	})
+}
+
+func TestSpilloverConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: team
+    descriptors:
+      - key: user
+        rate_limit:
+          unit: second
+          requests_per_unit: 10
+          spillover:
+            - name: team_pool
+              key: team
+              unit: second
+              requests_per_unit: 100
+            - name: global_pool
+              unit: minute
+              unit_multiplier: 2
+              requests_per_unit: 1000
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "team", Value: "eng"}, {Key: "user", Value: "alice"}},
+	})
+	assert.Len(limit.Spillover, 2)
+	assert.Equal("team_pool", limit.Spillover[0].Limit.Name)
+	assert.Equal("team", limit.Spillover[0].SpilloverKey)
+	assert.EqualValues(100, limit.Spillover[0].Limit.RequestsPerUnit)
+	assert.Equal("test-domain.spillover.team_pool", limit.Spillover[0].FullKey)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, limit.Spillover[1].Limit.Unit)
+	assert.EqualValues(2, limit.Spillover[1].UnitMultiplier)
+	assert.Equal("", limit.Spillover[1].SpilloverKey)
+	assert.True(limit.SpillsOver)
+	assert.True(limit.Spillover[0].SpillsOver)
+	assert.False(limit.Spillover[1].SpillsOver)
+	dump := rlConfig.DumpTree()[0].Descriptors[0].Descriptors[0].RateLimit
+	assert.Equal("team", dump.Spillover[0].SpilloverKey)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("spillover: invalid spillover unit 'fortnight'"), func() {
+		loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      spillover:
+        - name: pool
+          unit: fortnight
+          requests_per_unit: 100
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("spillover: spillover name should not be empty"), func() {
+		loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      spillover:
+        - unit: second
+          requests_per_unit: 100
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("spillover: spillover 'pool' should not specify requests_per_unit 0"), func() {
+		loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      spillover:
+        - name: pool
+          unit: second
+          requests_per_unit: 0
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("spillover: should not specify penalty with spillover"), func() {
+		loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      penalty:
+        duration: 60s
+      spillover:
+        - name: pool
+          unit: second
+          requests_per_unit: 100
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("spillover: descriptor key 'ratelimit.spillover' is reserved"), func() {
+		loadYaml("spillover", `
+domain: test-domain
+descriptors:
+  - key: ratelimit.spillover
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+`)
+	})
+}
+
+func TestCarryOverConfig(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("carry_over", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 100
+      carry_over_percent: 20
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	assert.EqualValues(20, limit.CarryOverPercent)
+	assert.EqualValues(20, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.CarryOverPercent)
+
+	assert.PanicsWithValue(config.RateLimitConfigError("carry_over: invalid carry_over_percent 120, should be at most 100"), func() {
+		loadYaml("carry_over", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 100
+      carry_over_percent: 120
+`)
+	})
+	assert.PanicsWithValue(config.RateLimitConfigError("carry_over: should not specify carry_over_percent with window_alignment request or leaky_bucket"), func() {
+		loadYaml("carry_over", `
+domain: test-domain
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: minute
+      requests_per_unit: 100
+      window_alignment: request
+      carry_over_percent: 20
+`)
+	})
+}
+
+func TestTemplates(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig := config.NewRateLimitConfigImpl(
+		append(loadFile("templates.yaml"), loadFile("templates_domain.yaml")...), mockstats.NewMockStatManager(stats), false)
+
+	limitOf := func(entries ...[2]string) *config.RateLimit {
+		descriptor := &pb_struct.RateLimitDescriptor{}
+		for _, entry := range entries {
+			descriptor.Entries = append(descriptor.Entries, &pb_struct.RateLimitDescriptor_Entry{Key: entry[0], Value: entry[1]})
+		}
+		return rlConfig.GetLimit(context.TODO(), "test-domain", descriptor)
+	}
+
+	// the includes are expanded at any depth, the templates including other templates
+	assert.EqualValues(5, limitOf([2]string{"path", "/"}).Limit.RequestsPerUnit)
+	assert.EqualValues(10, limitOf([2]string{"path", "/"}, [2]string{"user", "alice"}).Limit.RequestsPerUnit)
+	assert.EqualValues(100, limitOf([2]string{"path", "/"}, [2]string{"user", "admin"}).Limit.RequestsPerUnit)
+	assert.EqualValues(10, limitOf([2]string{"tenant", "acme"}, [2]string{"user", "alice"}).Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, limitOf([2]string{"tenant", "acme"}, [2]string{"user", "admin"}).Limit.Unit)
+
+	// the expanded config is dumped
+	assert.Contains(rlConfig.Dump(), "test-domain.tenant_acme.user_admin: unit=MINUTE requests_per_unit=100")
+}
+
+func TestTemplateErrors(t *testing.T) {
+	load := func(files ...string) {
+		configs := []config.RateLimitConfigToLoad{}
+		for i, content := range files {
+			name := fmt.Sprintf("file%d.yaml", i)
+			configs = append(configs, config.RateLimitConfigToLoad{Name: name, ConfigYaml: config.ConfigFileContentToYaml(name, content)})
+		}
+		config.NewRateLimitConfigImpl(configs, mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false)
+	}
+	const template = "templates:\n  limited:\n    - key: user\n      rate_limit:\n        unit: second\n        requests_per_unit: 1\n"
+
+	expectConfigPanic(t, func() { load(template, template) },
+		"file1.yaml: duplicate template 'limited', also defined in file0.yaml")
+	expectConfigPanic(t, func() { load("domain: d\ndescriptors:\n  - include: missing\n") },
+		"file0.yaml: unknown template 'missing'")
+	expectConfigPanic(t, func() { load(template, "domain: d\ndescriptors:\n  - include: limited\n    key: user\n") },
+		"file1.yaml: include 'limited' must be the only field of its descriptor")
+	expectConfigPanic(t, func() {
+		load("templates:\n  a:\n    - key: k\n      descriptors:\n        - include: b\n  b:\n    - include: a\n")
+	}, "file0.yaml: template 'a' includes itself through a -> b")
+	expectConfigPanic(t, func() { load("templates:\n  a:\n    - key: k\n      bad_key: 1\n") },
+		"file0.yaml: config error, unknown key 'bad_key'")
+
+	// the expanded descriptors are validated as the other ones
+	expectConfigPanic(t, func() { load(template, "domain: d\ndescriptors:\n  - include: limited\n  - include: limited\n") },
+		"file1.yaml: duplicate descriptor composite key 'd.user'")
+}
+
+func TestStrictConfig(t *testing.T) {
+	load := func(content string) {
+		options := config.LoaderOptions{Strict: true}
+		config.NewRateLimitConfigImplWithOptions(
+			[]config.RateLimitConfigToLoad{{Name: "file.yaml", ConfigYaml: config.ConfigFileContentToYamlWithOptions("file.yaml", content, options)}},
+			mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false, options)
+	}
+
+	// the valid files load as without the strict mode
+	load("domain: d\ndescriptors:\n  - key: k\n    rate_limit: &limit\n      unit: second\n      requests_per_unit: 1\n" +
+		"      metadata:\n        tier: free\n  - key: k2\n    rate_limit:\n      <<: *limit\n      requests_per_unit: 2\n")
+	load("templates:\n  t:\n    - key: user\n      value: a*\n")
+
+	expectConfigPanic(t, func() {
+		load("domain: d\ndescriptors:\n  - key: k\n    rate_limit:\n      unit: second\n      requests_per_uint: 1\n")
+	}, "file.yaml: config error at descriptors[0].rate_limit, unknown field 'requests_per_uint', did you mean 'requests_per_unit'?")
+	// the fields known at another level are rejected too
+	expectConfigPanic(t, func() {
+		load("domain: d\nunit: second\ndescriptors:\n  - key: k\n")
+	}, "file.yaml: config error, unknown field 'unit'")
+	expectConfigPanic(t, func() {
+		load("domain: d\ndescriptors:\n  - key: k\n    descriptors:\n      - key: k2\n        key: k3\n")
+	}, "file.yaml: config error at descriptors[0].descriptors[0], duplicate field 'key'")
+	expectConfigPanic(t, func() {
+		load("domain: d\ndescriptors:\n  - key: k\n    rate_limit: second\n")
+	}, "file.yaml: config error at descriptors[0].rate_limit, expected a map")
+	expectConfigPanic(t, func() {
+		load("domain: d\ndescriptors:\n  - key: path\n    value: /api/*\n  - key: path\n    value: /api/v1/*\n")
+	}, "file.yaml: config error at descriptors[1], wildcard value '/api/v1/*' of key 'path' overlaps the value '/api/*' of descriptors[0]")
+	expectConfigPanic(t, func() {
+		load("templates:\n  t:\n    - key: user\n      value: a*\n    - key: user\n      value: ab*\n")
+	}, "file.yaml: config error at templates.t[1], wildcard value 'ab*' of key 'user' overlaps the value 'a*' of templates.t[0]")
+}
+
+// loadYamls loads a config of several files.
+func loadYamls(contents ...string) config.RateLimitConfig {
+	var files []config.RateLimitConfigToLoad
+	for i, content := range contents {
+		name := fmt.Sprintf("file%d.yaml", i)
+		files = append(files, config.RateLimitConfigToLoad{Name: name, ConfigYaml: config.ConfigFileContentToYaml(name, content)})
+	}
+	return config.NewRateLimitConfigImpl(files, mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false)), false)
+}
+
+func TestDiffConfigs(t *testing.T) {
+	assert := assert.New(t)
+	previous := loadYamls(`
+domain: kept
+descriptors:
+  - key: key1
+    value: value1
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+  - key: key2
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+  - key: key3
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+`, `domain: removed
+descriptors:
+  - key: key1
+    rate_limit:
+      unit: second
+      requests_per_unit: 1
+`)
+	next := loadYamls(`
+domain: kept
+descriptors:
+  - key: key1
+    value: value1
+    rate_limit:
+      unit: second
+      requests_per_unit: 20
+  - key: key2
+    rate_limit:
+      unit: minute
+      requests_per_unit: 5
+    shadow_mode: true
+  - key: key4
+    descriptors:
+      - key: subkey
+        rate_limit:
+          unit: hour
+          requests_per_unit: 100
+`, `domain: added
+descriptors: []
+`)
+
+	diff := config.DiffConfigs(previous, next)
+	assert.Equal([]string{"added"}, diff.DomainsAdded)
+	assert.Equal([]string{"removed"}, diff.DomainsRemoved)
+	assert.Equal([]string{"kept.key4.subkey"}, diff.RulesAdded)
+	assert.Equal([]string{"kept.key3", "removed.key1"}, diff.RulesRemoved)
+	assert.Equal([]*config.LimitChange{{Rule: "kept.key1_value1", From: "10/second", To: "20/second"}}, diff.LimitsChanged)
+	assert.Equal([]string{"kept.key2"}, diff.RulesChanged)
+	assert.False(diff.IsEmpty())
+
+	assert.True(config.DiffConfigs(next, next).IsEmpty())
+	assert.Equal([]string{"added", "kept"}, config.DiffConfigs(nil, next).DomainsAdded)
+}
+
+func TestKeySet(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("key_set.yaml", `
+domain: test-domain
+descriptors:
+  - key: route
+    descriptors:
+      - keys: [user_id, api_key]
+        rate_limit:
+          unit: minute
+          requests_per_unit: 10
+      - keys: [tenant, org]
+        value: acme*
+        rate_limit:
+          unit: second
+          requests_per_unit: 5
+`)
+	getLimit := func(key string, value string) *config.RateLimit {
+		return rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "route", Value: "/a"}, {Key: key, Value: value}},
+		})
+	}
+
+	// the keys of a set share the limit and the stats of the first key
+	user := getLimit("user_id", "alice")
+	apiKey := getLimit("api_key", "alice")
+	assert.EqualValues(10, apiKey.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.route.user_id", user.FullKey)
+	assert.Equal("test-domain.route.user_id", apiKey.FullKey)
+	assert.Nil(user.KeySetKeys)
+	assert.Equal([]string{"", "user_id"}, apiKey.KeySetKeys)
+
+	// the wildcard values match through each key
+	assert.EqualValues(5, getLimit("org", "acme-eu").Limit.RequestsPerUnit)
+	assert.Equal([]string{"", "tenant"}, getLimit("org", "acme-eu").KeySetKeys)
+	assert.Nil(getLimit("org", "other"))
+
+	// a key set is dumped once
+	tree := rlConfig.DumpTree()
+	assert.Len(tree[0].Descriptors[0].Descriptors, 2)
+	assert.Equal([]string{"tenant", "org"}, tree[0].Descriptors[0].Descriptors[0].Keys)
+	assert.Equal([]string{"user_id", "api_key"}, tree[0].Descriptors[0].Descriptors[1].Keys)
+}
+
+func TestKeySetErrors(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		message string
+	}{
+		{"domain: d\ndescriptors:\n  - key: a\n    keys: [b, c]\n", "key_set.yaml: descriptor 'a' should not specify both key and keys"},
+		{"domain: d\ndescriptors:\n  - keys: [a, a]\n", "key_set.yaml: duplicate key 'a' in keys"},
+		{"domain: d\ndescriptors:\n  - keys: [a, '']\n", "key_set.yaml: descriptor has empty key in keys"},
+		{"domain: d\ndescriptors:\n  - key: b\n  - keys: [a, b]\n", "key_set.yaml: duplicate descriptor composite key 'd.b'"},
+		{"domain: d\ndescriptors:\n  - keys: a\n", "key_set.yaml: config error, keys must be a list"},
+	} {
+		expectConfigPanic(t, func() { loadYaml("key_set.yaml", test.content) }, test.message)
+	}
+}
+
+func TestValueNormalizer(t *testing.T) {
+	assert := assert.New(t)
+	normalizer := &config.ValueNormalizer{Lowercase: true, Trim: true, IPv4Prefix: 24, IPv6Prefix: 64}
+	for value, expected := range map[string]string{
+		" Alice ":              "alice",
+		"10.1.2.3":             "10.1.2.0/24",
+		"::ffff:10.1.2.3":      "10.1.2.0/24",
+		"2001:DB8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"fe80::1%eth0":         "fe80::/64",
+		"10.1.2.3.example.com": "10.1.2.3.example.com",
+		"":                     "",
+	} {
+		assert.Equal(expected, normalizer.Normalize(value), value)
+	}
+	assert.Equal("2001:DB8::1", (&config.ValueNormalizer{IPv4Prefix: 24}).Normalize("2001:DB8::1"))
+}
+
+func TestNormalize(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("normalize.yaml", `
+domain: test-domain
+descriptors:
+  - key: remote_address
+    value_to_metric: true
+    normalize:
+      ipv4_prefix: 24
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "remote_address", Value: "10.1.2.3"}},
+	})
+	assert.Equal([]*config.ValueNormalizer{{IPv4Prefix: 24}}, limit.ValueNormalizers)
+	// the stats of the values are aggregated too
+	assert.Equal("test-domain.remote_address_10.1.2.0/24", limit.FullKey)
+	assert.Equal(&config.ValueNormalizer{IPv4Prefix: 24}, rlConfig.DumpTree()[0].Descriptors[0].Normalize)
+
+	expectConfigPanic(t, func() {
+		loadYaml("normalize.yaml", "domain: d\ndescriptors:\n  - key: a\n    normalize:\n      ipv6_prefix: 129\n")
+	}, "normalize.yaml: invalid normalize ipv6_prefix 129, should be between 0 and 128")
+}
+
+func TestShardCount(t *testing.T) {
+	assert := assert.New(t)
+	rlConfig := loadYaml("shard_count.yaml", `
+domain: test-domain
+descriptors:
+  - key: client
+    rate_limit:
+      unit: second
+      requests_per_unit: 10
+      shard_count: 64
+      quota:
+        unit: day
+        requests_per_unit: 1000
+`)
+	limit := rlConfig.GetLimit(context.TODO(), "test-domain", &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "client", Value: "alice"}},
+	})
+	assert.EqualValues(64, limit.ShardCount)
+	// the quota counts in the same buckets
+	assert.EqualValues(64, limit.Quota.ShardCount)
+	assert.EqualValues(64, rlConfig.DumpTree()[0].Descriptors[0].RateLimit.ShardCount)
+
+	expectConfigPanic(t, func() {
+		loadYaml("shard_count.yaml", "domain: d\ndescriptors:\n  - key: a\n    rate_limit:\n      unlimited: true\n      shard_count: 4\n")
+	}, "shard_count.yaml: should not specify shard_count when unlimited")
+}
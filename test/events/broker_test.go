@@ -0,0 +1,217 @@
+package events_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/events"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+	mock_utils "github.com/envoyproxy/ratelimit/test/mocks/utils"
+)
+
+type fixedTime int64
+
+func (this fixedTime) UnixNow() int64 { return int64(this) }
+
+func newLimit(requestsPerUnit uint32) *config.RateLimit {
+	limit := config.NewRateLimit(requestsPerUnit, pb.RateLimitResponse_RateLimit_MINUTE,
+		mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false)).NewStats("domain.key"), false, false, "limit", nil, false)
+	limit.FullKey = "domain.key"
+	return limit
+}
+
+func status(limit *config.RateLimit, code pb.RateLimitResponse_Code, remaining uint32) *pb.RateLimitResponse_DescriptorStatus {
+	return &pb.RateLimitResponse_DescriptorStatus{
+		Code:               code,
+		CurrentLimit:       limit.Limit,
+		LimitRemaining:     remaining,
+		DurationUntilReset: durationpb.New(30 * time.Second),
+	}
+}
+
+func TestBrokerTransitions(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	now := int64(1000)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().DoAndReturn(func() int64 { return now }).AnyTimes()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	broker := events.NewBroker(0.8, 10, timeSource, store.Scope("events"))
+
+	limit := newLimit(10)
+	descriptor := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1).Descriptors[0]
+
+	// the transitions aren't tracked without subscribers
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+	assert.EqualValues(0, store.NewCounter("events.published").Value())
+
+	subscription := broker.Subscribe("")
+	other := broker.Subscribe("other")
+	defer other.Close()
+
+	// a single event per state and window
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OK, 5))
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OK, 1))
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OK, 0))
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+
+	event := <-subscription.Events()
+	assert.Equal(events.Event{
+		Type:            events.NearLimit,
+		Domain:          "domain",
+		Descriptor:      []events.Entry{{Key: "key", Value: "value"}},
+		LimitName:       "limit",
+		RequestsPerUnit: 10,
+		Unit:            "MINUTE",
+		LimitRemaining:  1,
+		Time:            1000,
+	}, event)
+	event = <-subscription.Events()
+	assert.Equal(events.OverLimit, event.Type)
+	assert.Len(subscription.Events(), 0)
+	assert.Len(other.Events(), 0)
+
+	// the states are forgotten at the reset of the window
+	now += 30
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+	event = <-subscription.Events()
+	assert.Equal(events.OverLimit, event.Type)
+	assert.EqualValues(3, store.NewCounter("events.published").Value())
+	assert.EqualValues(2, store.NewGauge("events.subscribers").Value())
+
+	subscription.Close()
+	subscription.Close()
+	_, ok := <-subscription.Events()
+	assert.False(ok)
+	assert.EqualValues(1, store.NewGauge("events.subscribers").Value())
+}
+
+func TestBrokerDropsEventsOfSlowSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	broker := events.NewBroker(0.8, 1, fixedTime(1234), store.Scope("events"))
+	subscription := broker.Subscribe("domain")
+	defer subscription.Close()
+
+	limit := newLimit(10)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "a"}}, {{"key", "b"}}}, 1)
+	for _, descriptor := range request.Descriptors {
+		broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+	}
+
+	assert.Equal("a", (<-subscription.Events()).Descriptor[0].Value)
+	assert.EqualValues(2, store.NewCounter("events.published").Value())
+	assert.EqualValues(1, store.NewCounter("events.dropped").Value())
+}
+
+func TestBrokerNearLimitRatio(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	broker := events.NewBroker(0.8, 10, fixedTime(1234), store.Scope("events"))
+	subscription := broker.Subscribe("")
+	defer subscription.Close()
+
+	limit := newLimit(10)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "a"}}, {{"key", "b"}}}, 1)
+	// 6 hits are under a near limit ratio of 0.8, and over the reloaded ratio of 0.5
+	broker.Publish("domain", request.Descriptors[0], limit, status(limit, pb.RateLimitResponse_OK, 4))
+	assert.Len(subscription.Events(), 0)
+	broker.SetNearLimitRatio(0.5)
+	broker.Publish("domain", request.Descriptors[1], limit, status(limit, pb.RateLimitResponse_OK, 4))
+	event := <-subscription.Events()
+	assert.Equal(events.NearLimit, event.Type)
+	assert.Equal("b", event.Descriptor[0].Value)
+}
+
+func TestBrokerConcurrentSubscriptions(t *testing.T) {
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	broker := events.NewBroker(0.8, 1, fixedTime(1234), store.Scope("events"))
+	limit := newLimit(10)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "a"}}, {{"key", "b"}}}, 1)
+
+	// the subscriptions closed while events are published don't receive them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				broker.Subscribe("").Close()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, descriptor := range request.Descriptors {
+					broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+					broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OK, 10))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 0, store.NewGauge("events.subscribers").Value())
+}
+
+func TestStreamEvents(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	broker := events.NewBroker(0.8, 10, fixedTime(1234), store.Scope("events"))
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	events.RegisterEventsServer(grpcServer, broker)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := events.StreamEvents(ctx, conn, "domain")
+	assert.NoError(err)
+	assert.Eventually(func() bool { return store.NewGauge("events.subscribers").Value() == 1 }, time.Second, time.Millisecond)
+
+	limit := newLimit(10)
+	descriptor := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1).Descriptors[0]
+	broker.Publish("other", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+	broker.Publish("domain", descriptor, limit, status(limit, pb.RateLimitResponse_OVER_LIMIT, 0))
+
+	event, err := stream.Recv()
+	assert.NoError(err)
+	assert.Equal(map[string]interface{}{
+		"type":              "OVER_LIMIT",
+		"domain":            "domain",
+		"descriptor":        []interface{}{map[string]interface{}{"key": "key", "value": "value"}},
+		"limit_name":        "limit",
+		"requests_per_unit": float64(10),
+		"unit":              "MINUTE",
+		"limit_remaining":   float64(0),
+		"time":              float64(1234),
+	}, event.AsMap())
+
+	// the subscription is closed with the stream
+	cancel()
+	assert.Eventually(func() bool { return store.NewGauge("events.subscribers").Value() == 0 }, time.Second, time.Millisecond)
+}
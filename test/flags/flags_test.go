@@ -0,0 +1,44 @@
+package flags_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/flags"
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+func writeFlag(t *testing.T, path string, value string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, []byte(value), 0o644))
+}
+
+func TestStaticFlags(t *testing.T) {
+	featureFlags := flags.NewStaticFlags()
+	assert.True(t, featureFlags.Enabled(flags.RedisGetCoalescing, "domain", 100))
+	assert.False(t, featureFlags.Enabled(flags.RedisGetCoalescing, "domain", 0))
+}
+
+func TestRuntimeFlags(t *testing.T) {
+	root := t.TempDir()
+	writeFlag(t, filepath.Join(root, "features", "redis", "get_coalescing"), "0")
+	writeFlag(t, filepath.Join(root, "features", "domains", "canary.domain", "redis", "get_coalescing"), "100")
+
+	s := settings.NewSettings()
+	s.RuntimePath = root
+	s.RuntimeSubdirectory = ""
+	s.RuntimeWatchRoot = false
+	s.FeatureFlagsDirectory = "features"
+	featureFlags, err := flags.NewFlagsFromSettings(s, gostats.NewStore(gostats.NewNullSink(), false))
+	assert.NoError(t, err)
+
+	// the percentage of the feature overrides the default, the one of a domain overrides both
+	assert.False(t, featureFlags.Enabled(flags.RedisGetCoalescing, "domain", 100))
+	assert.True(t, featureFlags.Enabled(flags.RedisGetCoalescing, "canary.domain", 0))
+	// the features without key use their default
+	assert.True(t, featureFlags.Enabled("other_feature", "domain", 100))
+}
@@ -784,21 +784,17 @@ func startTestRunner(t *testing.T, s settings.Settings) *runner.Runner {
 	t.Helper()
 	runner := runner.NewRunner(s)
 
-	go func() {
-		// Catch a panic() to ensure that test name is printed.
-		// Otherwise go doesn't know what test this goroutine is
-		// associated with.
-		defer func() {
-			if r := recover(); r != nil {
-				t.Fatalf("Uncaught panic(): %v", r)
-			}
-		}()
-		runner.Run()
-	}()
-
-	// HACK: Wait for the server to come up. Make a hook that we can wait on.
 	// Increased timeout from 1s to 10s to allow for Redis cluster connection initialization
-	common.WaitForTcpPort(context.Background(), s.GrpcPort, 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := runner.Start(ctx); err != nil {
+		t.Fatalf("failed to start the runner: %v", err)
+	}
+	select {
+	case <-runner.Ready():
+	case <-ctx.Done():
+		t.Fatalf("the runner is not ready: %v", ctx.Err())
+	}
 
 	return &runner
 }
@@ -1,8 +1,10 @@
 package limiter
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 
 	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
 
@@ -56,6 +58,190 @@ func TestGenerateCacheKeysPrefix(t *testing.T) {
 	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 }
 
+func TestGenerateCacheKeysHashed(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "prefix:", sm)
+
+	generate := func(hash string, value string) string {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", value}}}, 1)
+		limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key"), false, false, "", nil, false)
+		limit.CacheKeyHash = hash
+		return baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})[0].Key
+	}
+
+	assert.Equal("prefix:domain_key_value_1234", generate("", "value"))
+	assert.Regexp("^prefix:domain_[0-9a-f]{1,16}_1234$", generate(config.CacheKeyHashXxhash, "value"))
+	assert.Regexp("^prefix:domain_[0-9a-f]{64}_1234$", generate(config.CacheKeyHashSha256, "value"))
+	assert.NotContains(generate(config.CacheKeyHashSha256, "value"), "value")
+
+	assert.Equal(generate(config.CacheKeyHashXxhash, "value"), generate(config.CacheKeyHashXxhash, "value"))
+	assert.NotEqual(generate(config.CacheKeyHashXxhash, "value"), generate(config.CacheKeyHashXxhash, "other"))
+	assert.NotEqual(generate(config.CacheKeyHashSha256, "value"), generate(config.CacheKeyHashSha256, "other"))
+}
+
+func TestGenerateCacheKeysCompressed(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "prefix:", sm)
+	baseRateLimit.SetCacheKeyMaxLength(16)
+
+	generate := func(value string) string {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", value}}}, 1)
+		limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key"), false, false, "", nil, false)}
+		return baseRateLimit.GenerateCacheKeys(request, limits, []uint64{1})[0].Key
+	}
+
+	// "key_short_value_" is 16 bytes long
+	assert.Equal("prefix:domain_key_short_value_1234", generate("short_value"))
+	assert.Equal(uint64(0), sm.NewServiceStats().CacheKeyCompressed.Value())
+
+	long := generate("/a/very/long/path/1")
+	assert.Regexp("^prefix:domain_key_/a/very/long_[0-9a-f]{1,16}_1234$", long)
+	assert.NotEqual(long, generate("/a/very/long/path/2"))
+	assert.Equal(long, generate("/a/very/long/path/1"))
+	assert.Equal(uint64(3), sm.NewServiceStats().CacheKeyCompressed.Value())
+}
+
+func TestGenerateCacheKeysUnitMultiplier(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.UnitMultiplier = 5
+
+	// the 5 minute windows start at the multiples of 300 seconds
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	assert.Equal("domain_key_value_1200", baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})[0].Key)
+	timeSource.EXPECT().UnixNow().Return(int64(1499))
+	assert.Equal("domain_key_value_1200", baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})[0].Key)
+	timeSource.EXPECT().UnixNow().Return(int64(1500))
+	assert.Equal("domain_key_value_1500", baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})[0].Key)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	limitInfo := limiter.NewRateLimitInfo(limit, 0, 1, 0, 0)
+	status := baseRateLimit.GetResponseDescriptorStatus("domain_key_value_1200", limitInfo, false, 1)
+	assert.Equal(int64(266), status.DurationUntilReset.GetSeconds())
+}
+
+func TestGenerateCacheKeysQuota(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	timeSource.EXPECT().UnixNow().Return(int64(86400))
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key", "value"}}}, 1)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	quota := config.NewRateLimit(1000, pb.RateLimitResponse_RateLimit_DAY, sm.NewStats("key_value.quota"), false, false, "", nil, false)
+	quota.IsQuota = true
+
+	// the quota counts in its own keys even when its window starts with the window of the rate
+	cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit, quota}, []uint64{1, 1})
+	assert.Equal("domain_key_value_86400", cacheKeys[0].Key)
+	assert.Equal("domain_key_value_quota_86400", cacheKeys[1].Key)
+}
+
+func TestGetHitsAddends(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}}, 2)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key2_value2"), false, false, "", nil, false),
+		nil,
+	}
+	limits[1].Cost = 10
+
+	assert.Equal([]uint64{2, 20, 2}, limiter.GetHitsAddends(request, limits))
+}
+
+func TestGenerateCacheKeysWithKeySet(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+
+	// the entry matched through the api_key of the key set counts with its first key user_id
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("domain.route.user_id"), false, false, "", nil, false)
+	limit.KeySetKeys = []string{"", "user_id"}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"route", "/a"}, {"api_key", "alice"}}}, 1)
+	cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})
+	assert.Equal("domain_route_/a_user_id_alice_1234", cacheKeys[0].Key)
+}
+
+func TestGenerateCacheKeysWithShards(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+
+	// the clients are hashed into the buckets of the last entry
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("domain.route.client"), false, false, "", nil, false)
+	limit.ShardCount = 4
+	keys := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"route", "/a"}, {"client", fmt.Sprintf("client-%d", i)}}}, 1)
+		cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})
+		assert.Regexp(`^domain_route_/a_client_shard[0-3]_1234$`, cacheKeys[0].Key)
+		keys[cacheKeys[0].Key] = true
+
+		again := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})
+		assert.Equal(cacheKeys[0].Key, again[0].Key)
+	}
+	assert.Len(keys, 4)
+}
+
+func TestGenerateCacheKeysWithValueNormalizers(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+
+	// the clients of a subnet share the cache key
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("domain.remote_address"), false, false, "", nil, false)
+	limit.ValueNormalizers = []*config.ValueNormalizer{{IPv4Prefix: 24}, {Lowercase: true}}
+	for _, address := range []string{"10.1.2.3", "10.1.2.200"} {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"remote_address", address}, {"user", "Alice"}}}, 1)
+		cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})
+		assert.Equal("domain_remote_address_10.1.2.0/24_user_alice_1234", cacheKeys[0].Key)
+	}
+}
+
 func TestGenerateCacheKeysWithShareThreshold(t *testing.T) {
 	assert := assert.New(t)
 	controller := gomock.NewController(t)
@@ -143,10 +329,16 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	defer controller.Finish()
 	localCache := freecache.NewCache(100)
 	localCache.Set([]byte("key"), []byte("value"), 100)
-	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	store := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(store)
 	baseRateLimit := limiter.NewBaseRateLimit(nil, nil, 3600, localCache, 0.8, "", sm)
 	// Returns true, as local cache contains over limit value for the key.
-	assert.Equal(true, baseRateLimit.IsOverLimitWithLocalCache("key"))
+	assert.Equal(true, baseRateLimit.IsOverLimitWithLocalCache("domain", "key"))
+	assert.Equal(false, baseRateLimit.IsOverLimitWithLocalCache("domain", "key2"))
+	assert.Equal(false, baseRateLimit.IsOverLimitWithLocalCache("other", "key2"))
+	assert.EqualValues(1, store.NewCounter("domain.local_cache_hit").Value())
+	assert.EqualValues(1, store.NewCounter("domain.local_cache_miss").Value())
+	assert.EqualValues(1, store.NewCounter("other.local_cache_miss").Value())
 }
 
 func TestNoOverLimitWithLocalCache(t *testing.T) {
@@ -156,11 +348,11 @@ func TestNoOverLimitWithLocalCache(t *testing.T) {
 	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
 	baseRateLimit := limiter.NewBaseRateLimit(nil, nil, 3600, nil, 0.8, "", sm)
 	// Returns false, as local cache is nil.
-	assert.Equal(false, baseRateLimit.IsOverLimitWithLocalCache("domain_key_value_1234"))
+	assert.Equal(false, baseRateLimit.IsOverLimitWithLocalCache("domain", "domain_key_value_1234"))
 	localCache := freecache.NewCache(100)
 	baseRateLimitWithLocalCache := limiter.NewBaseRateLimit(nil, nil, 3600, localCache, 0.8, "", sm)
 	// Returns false, as local cache does not contain value for cache key.
-	assert.Equal(false, baseRateLimitWithLocalCache.IsOverLimitWithLocalCache("domain_key_value_1234"))
+	assert.Equal(false, baseRateLimitWithLocalCache.IsOverLimitWithLocalCache("domain", "domain_key_value_1234"))
 }
 
 func TestGetResponseStatusEmptyKey(t *testing.T) {
@@ -245,6 +437,27 @@ func TestGetResponseStatusOverLimit(t *testing.T) {
 	assert.Equal(uint64(0), limits[0].Stats.ShadowMode.Value())
 }
 
+func TestGetResponseStatusOverLimitSpillsOver(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	localCache := freecache.NewCache(100)
+	sm := mockstats.NewMockStatManager(statsStore)
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, localCache, 0.8, "", sm)
+	limits := []*config.RateLimit{config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
+	limits[0].SpillsOver = true
+	limitInfo := limiter.NewRateLimitInfo(limits[0], 2, 7, 4, 5)
+	responseStatus := baseRateLimit.GetResponseDescriptorStatus("key", limitInfo, false, 1)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, responseStatus.GetCode())
+	// The over limit is left to the spillover tiers, neither recorded nor cached.
+	_, err := localCache.Get([]byte("key"))
+	assert.Equal(freecache.ErrNotFound, err)
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+}
+
 func TestGetResponseStatusOverLimitShadowMode(t *testing.T) {
 	assert := assert.New(t)
 	controller := gomock.NewController(t)
@@ -310,3 +523,216 @@ func TestGetResponseStatusBelowLimitShadowMode(t *testing.T) {
 	// No shadow_mode so, no stats change
 	assert.Equal(uint64(0), limits[0].Stats.ShadowMode.Value())
 }
+
+func TestLocalCacheTtl(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	limit := config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key_value"), false, false, "", nil, false)
+
+	ttlAt := func(now int64, policy *limiter.LocalCachePolicy) uint32 {
+		localCache := freecache.NewCache(1024 * 1024)
+		baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, localCache, 0.8, "", sm)
+		if policy != nil {
+			baseRateLimit.SetLocalCachePolicy(*policy)
+		}
+		timeSource.EXPECT().UnixNow().Return(now)
+		baseRateLimit.GetResponseDescriptorStatus("key", limiter.NewRateLimitInfo(limit, 5, 6, 0, 0), false, 1)
+		ttl, err := localCache.TTL([]byte("key"))
+		assert.NoError(err)
+		return ttl
+	}
+
+	// the entries expire at the end of their window
+	assert.EqualValues(2366, ttlAt(1234, nil))
+	assert.EqualValues(3600, ttlAt(3600, nil))
+	// the last second of the window is not cached forever
+	assert.EqualValues(1, ttlAt(3599, nil))
+	assert.EqualValues(60, ttlAt(1234, &limiter.LocalCachePolicy{MaxTtl: time.Minute}))
+	assert.EqualValues(10, ttlAt(3599, &limiter.LocalCachePolicy{MinTtl: 10 * time.Second, MaxTtl: time.Minute}))
+	assert.EqualValues(1, ttlAt(3599, &limiter.LocalCachePolicy{}))
+}
+
+func TestLocalCacheNearLimit(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	limit := config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key_value"), false, false, "", nil, false)
+	localCache := freecache.NewCache(1024 * 1024)
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, localCache, 0.8, "", sm)
+
+	// the near-the-limit keys are not stored by default
+	baseRateLimit.GetResponseDescriptorStatus("key", limiter.NewRateLimitInfo(limit, 3, 5, 0, 0), false, 1)
+	assert.False(baseRateLimit.LocalCacheStoresNearLimit())
+	assert.Equal(int64(0), localCache.EntryCount())
+
+	baseRateLimit.SetLocalCachePolicy(limiter.LocalCachePolicy{MinTtl: time.Second, NearLimit: true})
+	assert.True(baseRateLimit.LocalCacheStoresNearLimit())
+	baseRateLimit.GetResponseDescriptorStatus("far", limiter.NewRateLimitInfo(limit, 1, 2, 0, 0), false, 1)
+	assert.False(baseRateLimit.IsNearLimitWithLocalCache("far"))
+	baseRateLimit.GetResponseDescriptorStatus("key", limiter.NewRateLimitInfo(limit, 3, 5, 0, 0), false, 1)
+	assert.True(baseRateLimit.IsNearLimitWithLocalCache("key"))
+	// a near-the-limit key is still checked in the backend
+	assert.False(baseRateLimit.IsOverLimitWithLocalCache("domain", "key"))
+
+	baseRateLimit.GetResponseDescriptorStatus("key", limiter.NewRateLimitInfo(limit, 5, 6, 0, 0), false, 1)
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "key"))
+	assert.True(baseRateLimit.IsNearLimitWithLocalCache("key"))
+}
+
+func TestLocalCachePerSecond(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	store := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(store)
+	perSecond := config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)
+	perMinute := config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	localCache := freecache.NewCache(1024 * 1024)
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, localCache, 0.8, "", sm)
+	baseRateLimit.SetLocalCachePolicy(limiter.LocalCachePolicy{MinTtl: time.Second, PerSecond: true, PerSecondMaxKeys: 2})
+	nextSecond := func() time.Duration { return time.Until(time.Now().Truncate(time.Second).Add(time.Second)) }
+	if nextSecond() < 200*time.Millisecond {
+		time.Sleep(nextSecond())
+	}
+
+	// the keys of the one second windows are not stored in the local cache
+	baseRateLimit.GetResponseDescriptorStatus("second", limiter.NewRateLimitInfo(perSecond, 5, 6, 0, 0), false, 1)
+	baseRateLimit.GetResponseDescriptorStatus("minute", limiter.NewRateLimitInfo(perMinute, 5, 6, 0, 0), false, 1)
+	assert.Equal(int64(1), localCache.EntryCount())
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "second"))
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "minute"))
+	assert.EqualValues(2, store.NewCounter("domain.local_cache_hit").Value())
+
+	// the cache is bounded
+	baseRateLimit.GetResponseDescriptorStatus("second2", limiter.NewRateLimitInfo(perSecond, 5, 6, 0, 0), false, 1)
+	baseRateLimit.GetResponseDescriptorStatus("second3", limiter.NewRateLimitInfo(perSecond, 5, 6, 0, 0), false, 1)
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "second2"))
+	assert.False(baseRateLimit.IsOverLimitWithLocalCache("domain", "second3"))
+
+	// the keys expire at the end of the second of the wall clock
+	time.Sleep(nextSecond())
+	assert.False(baseRateLimit.IsOverLimitWithLocalCache("domain", "second"))
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "minute"))
+	baseRateLimit.GetResponseDescriptorStatus("second3", limiter.NewRateLimitInfo(perSecond, 5, 6, 0, 0), false, 1)
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", "second3"))
+}
+
+func TestExpirationSeconds(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	jitterSource := mock_utils.NewMockJitterRandSource(controller)
+	jitterSource.EXPECT().Int63().Return(int64(100)).AnyTimes()
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	newLimit := func(unit pb.RateLimitResponse_RateLimit_Unit) *config.RateLimit {
+		return config.NewRateLimit(5, unit, sm.NewStats("key_value"), false, false, "", nil, false)
+	}
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, rand.New(jitterSource), 3600, nil, 0.8, "", sm)
+	assert.EqualValues(60+100, baseRateLimit.ExpirationSeconds(newLimit(pb.RateLimitResponse_RateLimit_MINUTE)))
+
+	policy, err := limiter.NewExpirationJitterPolicy(map[string]time.Duration{"second": 0, "DAY": 15 * time.Minute}, 10)
+	assert.NoError(err)
+	baseRateLimit.SetExpirationJitterPolicy(policy)
+	assert.EqualValues(1, baseRateLimit.ExpirationSeconds(newLimit(pb.RateLimitResponse_RateLimit_SECOND)))
+	assert.EqualValues(86400+100, baseRateLimit.ExpirationSeconds(newLimit(pb.RateLimitResponse_RateLimit_DAY)))
+	// 10% of an hour
+	assert.EqualValues(3600+100, baseRateLimit.ExpirationSeconds(newLimit(pb.RateLimitResponse_RateLimit_HOUR)))
+	assert.EqualValues(60+100%6, baseRateLimit.ExpirationSeconds(newLimit(pb.RateLimitResponse_RateLimit_MINUTE)))
+
+	// the jitter of the rule overrides the policy
+	limit := newLimit(pb.RateLimitResponse_RateLimit_DAY)
+	jitter := 30 * time.Second
+	limit.ExpirationJitter = &jitter
+	assert.EqualValues(86400+100%30, baseRateLimit.ExpirationSeconds(limit))
+
+	_, err = limiter.NewExpirationJitterPolicy(map[string]time.Duration{"fortnight": time.Minute}, 0)
+	assert.EqualError(err, `invalid rate limit unit "fortnight" in expiration jitter`)
+	_, err = limiter.NewExpirationJitterPolicy(nil, -1)
+	assert.Error(err)
+}
+
+func TestRequestAlignedLimit(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	localCache := freecache.NewCache(1024 * 1024)
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, localCache, 0.8, "", sm)
+	limit := config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.RequestAligned = true
+
+	// the key has no window start
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit}, []uint64{1})
+	assert.Equal("domain_key_value_request", cacheKeys[0].Key)
+	assert.EqualValues(60, baseRateLimit.ExpirationSeconds(limit))
+
+	// the reset is the remaining time of the key, also the TTL of the local cache
+	limitInfo := limiter.NewRateLimitInfo(limit, 5, 6, 0, 0)
+	limitInfo.SetDurationUntilReset(1500 * time.Millisecond)
+	status := baseRateLimit.GetResponseDescriptorStatus(cacheKeys[0].Key, limitInfo, false, 1)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.EqualValues(2, status.DurationUntilReset.Seconds)
+	assert.True(baseRateLimit.IsOverLimitWithLocalCache("domain", cacheKeys[0].Key))
+	status = baseRateLimit.GetResponseDescriptorStatus(cacheKeys[0].Key, limiter.NewRateLimitInfo(limit, 0, 0, 0, 0), true, 1)
+	assert.InDelta(2, status.DurationUntilReset.Seconds, 1)
+
+	// the minimum TTL does not outlive the key, which the next window reuses
+	baseRateLimit.SetLocalCachePolicy(limiter.LocalCachePolicy{MinTtl: 10 * time.Second})
+	baseRateLimit.GetResponseDescriptorStatus("aligned", limitInfo, false, 1)
+	ttl, err := localCache.TTL([]byte("aligned"))
+	assert.NoError(err)
+	assert.EqualValues(1, ttl)
+	limitInfo.SetDurationUntilReset(500 * time.Millisecond)
+	baseRateLimit.GetResponseDescriptorStatus("expiring", limitInfo, false, 1)
+	assert.False(baseRateLimit.IsOverLimitWithLocalCache("domain", "expiring"))
+}
+
+func TestGenerateCacheKeysVersioned(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	baseRateLimit := limiter.NewBaseRateLimit(timeSource, nil, 3600, nil, 0.8, "", sm)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.CacheKeyVersion = "2"
+	limit.Quota = config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key_value.quota"), false, false, "", nil, false)
+	limit.Quota.IsQuota = true
+	limit.Quota.CacheKeyVersion = "2"
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key", "value"}}}, 1)
+	cacheKeys := baseRateLimit.GenerateCacheKeys(request, []*config.RateLimit{limit, limit.Quota}, []uint64{1, 1})
+	assert.Equal("domain_key_value_v2_1234", cacheKeys[0].Key)
+	assert.Equal("domain_key_value_v2_quota_0", cacheKeys[1].Key)
+}
+
+func TestCarryOverCredit(t *testing.T) {
+	assert := assert.New(t)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	limit := config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	assert.EqualValues(0, limiter.CarryOverCredit(limit, 10))
+
+	limit.CarryOverPercent = 20
+	// the unused requests are bounded by the percentage
+	assert.EqualValues(20, limiter.CarryOverCredit(limit, 0))
+	assert.EqualValues(15, limiter.CarryOverCredit(limit, 85))
+	assert.EqualValues(0, limiter.CarryOverCredit(limit, 100))
+	assert.EqualValues(0, limiter.CarryOverCredit(limit, 120))
+	assert.EqualValues(0, limiter.CarryOverCredit(nil, 0))
+
+	// the counters live through the next window
+	baseRateLimit := limiter.NewBaseRateLimit(nil, nil, 0, nil, 0.8, "", sm)
+	assert.EqualValues(120, baseRateLimit.ExpirationSeconds(limit))
+}
@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/redis"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_limiter "github.com/envoyproxy/ratelimit/test/mocks/limiter"
+	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+func TestCircuitBreakerCache(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	breaker := limiter.NewCircuitBreaker(statsStore.Scope("circuit_breaker"), 2, 50*time.Millisecond)
+	breakerCache := limiter.NewCircuitBreakerCache(cache, breaker, true, nil)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false), nil}
+	ok := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}, {Code: pb.RateLimitResponse_OK}}
+	fail := func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+		panic(redis.RedisError("connection refused"))
+	}
+
+	// The failures are propagated until the threshold is reached.
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(fail).Times(2)
+	assert.Panics(func() { breakerCache.DoLimit(context.Background(), request, limits) })
+	assert.Panics(func() { breakerCache.DoLimit(context.Background(), request, limits) })
+	assert.EqualValues(1, statsStore.NewCounter("circuit_breaker.opened").Value())
+	assert.EqualValues(1, statsStore.NewGauge("circuit_breaker.state").Value())
+
+	// The open circuit answers with the failure mode without calling the backend.
+	statuses := breakerCache.DoLimit(context.Background(), request, limits)
+	assert.Equal([]*pb.RateLimitResponse_DescriptorStatus{
+		{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit},
+		{Code: pb.RateLimitResponse_OK},
+	}, statuses)
+	assert.EqualValues(1, statsStore.NewCounter("circuit_breaker.short_circuited").Value())
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(fail)
+	assert.Panics(func() { breakerCache.DoLimit(context.Background(), request, limits) })
+	assert.EqualValues(1, statsStore.NewCounter("circuit_breaker.probes").Value())
+	assert.EqualValues(2, statsStore.NewCounter("circuit_breaker.opened").Value())
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, breakerCache.DoLimit(context.Background(), request, limits)[0].Code)
+
+	// A successful probe closes the circuit.
+	time.Sleep(60 * time.Millisecond)
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).Return(ok).Times(2)
+	assert.Equal(ok, breakerCache.DoLimit(context.Background(), request, limits))
+	assert.EqualValues(0, statsStore.NewGauge("circuit_breaker.state").Value())
+	assert.Equal(ok, breakerCache.DoLimit(context.Background(), request, limits))
+	assert.EqualValues(2, statsStore.NewCounter("circuit_breaker.probes").Value())
+}
+
+func TestCircuitBreakerCacheReportedErrors(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	breaker := limiter.NewCircuitBreaker(statsStore.Scope("circuit_breaker"), 1, time.Minute)
+	breakerCache := limiter.NewCircuitBreakerCache(cache, breaker, false, nil)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
+	ok := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}}
+
+	// An error handled by the cache without panicking is reported through the context.
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(ctx context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			limiter.ReportBackendError(ctx, errors.New("timeout"))
+			return ok
+		})
+	assert.Equal(ok, breakerCache.DoLimit(context.Background(), request, limits))
+	assert.EqualValues(1, statsStore.NewCounter("circuit_breaker.opened").Value())
+
+	// The failure mode allows the requests while the circuit is open.
+	assert.Equal([]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit}},
+		breakerCache.DoLimit(context.Background(), request, limits))
+}
@@ -0,0 +1,131 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/redis"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_limiter "github.com/envoyproxy/ratelimit/test/mocks/limiter"
+	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+func TestDeadlineCache(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	deadlineCache := limiter.NewDeadlineCache(cache, statsStore, 20*time.Millisecond, true)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
+	ok := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}}
+	denied := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit}}
+
+	// Without a deadline the context is passed as is.
+	ctx := context.Background()
+	cache.EXPECT().DoLimit(ctx, request, limits).Return(ok)
+	assert.Equal(ok, deadlineCache.DoLimit(ctx, request, limits))
+
+	// The backend is called with the deadline of the request minus the margin.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(backendCtx context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			deadline, _ := ctx.Deadline()
+			backendDeadline, _ := backendCtx.Deadline()
+			assert.Equal(deadline.Add(-20*time.Millisecond), backendDeadline)
+			return ok
+		})
+	assert.Equal(ok, deadlineCache.DoLimit(ctx, request, limits))
+	assert.EqualValues(0, statsStore.NewCounter("deadline_exceeded").Value())
+
+	// A backend call aborted at the deadline is answered with the failure mode.
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(backendCtx context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			<-backendCtx.Done()
+			panic(redis.RedisError(backendCtx.Err().Error()))
+		})
+	assert.Equal(denied, deadlineCache.DoLimit(ctx, request, limits))
+	assert.EqualValues(1, statsStore.NewCounter("deadline_exceeded").Value())
+
+	// A request within the margin of its deadline does not call the backend.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(denied, deadlineCache.DoLimit(ctx, request, limits))
+	assert.EqualValues(2, statsStore.NewCounter("deadline_exceeded").Value())
+
+	// The other errors are propagated.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			panic(redis.RedisError("connection refused"))
+		})
+	assert.Panics(func() { deadlineCache.DoLimit(ctx, request, limits) })
+
+	// Past the deadline, the other errors are still propagated and the replies are kept.
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(backendCtx context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			<-backendCtx.Done()
+			panic(redis.RedisError("connection refused"))
+		})
+	assert.PanicsWithValue(redis.RedisError("connection refused"), func() { deadlineCache.DoLimit(ctx, request, limits) })
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(backendCtx context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			<-backendCtx.Done()
+			return ok
+		})
+	assert.Equal(ok, deadlineCache.DoLimit(ctx, request, limits))
+	assert.EqualValues(2, statsStore.NewCounter("deadline_exceeded").Value())
+}
+
+func TestDeadlineCacheSetFailureModeDeny(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	breaker := limiter.NewCircuitBreaker(statsStore.Scope("circuit_breaker"), 1, time.Hour)
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	breakerCache := limiter.NewCircuitBreakerCache(cache, breaker, false, nil)
+	deadlineCache := limiter.NewDeadlineCache(breakerCache, statsStore, 20*time.Millisecond, false)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
+	ok := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit}}
+	denied := []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit}}
+
+	// Open the circuit.
+	cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			panic(redis.RedisError("connection refused"))
+		})
+	assert.Panics(func() { deadlineCache.DoLimit(context.Background(), request, limits) })
+	assert.Equal(ok, deadlineCache.DoLimit(context.Background(), request, limits))
+
+	// The failure mode is changed in the wrapped caches too.
+	deadlineCache.(limiter.FailureModeSetter).SetFailureModeDeny(true)
+	assert.Equal(denied, deadlineCache.DoLimit(context.Background(), request, limits))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(denied, deadlineCache.DoLimit(ctx, request, limits))
+}
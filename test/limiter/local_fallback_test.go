@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_limiter "github.com/envoyproxy/ratelimit/test/mocks/limiter"
+	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+	mock_utils "github.com/envoyproxy/ratelimit/test/mocks/utils"
+)
+
+func TestLocalFallback(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	fallback := limiter.NewLocalFallback(statsStore.Scope("local_fallback"), timeSource, "", 2)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(9, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key2_value2"), false, false, "", nil, false),
+	}
+
+	// Each of the 2 instances allows 5 hits per second, the share rounded up.
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).Times(5)
+	for i := 0; i < 4; i++ {
+		fallback.DoLimit(request, limits)
+	}
+	assert.Equal([]*pb.RateLimitResponse_DescriptorStatus{
+		{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
+		{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 5},
+	}, fallback.DoLimit(request, limits))
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	assert.Equal([]*pb.RateLimitResponse_DescriptorStatus{
+		{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit},
+		{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 4},
+	}, fallback.DoLimit(request, limits))
+	assert.EqualValues(6, statsStore.NewCounter("local_fallback.requests").Value())
+	assert.EqualValues(1, statsStore.NewCounter("local_fallback.over_limit").Value())
+
+	// The counter of the next second starts over.
+	timeSource.EXPECT().UnixNow().Return(int64(1235))
+	assert.Equal(pb.RateLimitResponse_OK, fallback.DoLimit(request, limits)[0].Code)
+
+	// Only the hits of the current windows are added to the backend.
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1236))
+	cache.EXPECT().DoLimit(gomock.Any(), &pb.RateLimitRequest{
+		Domain:      "domain",
+		Descriptors: []*pb_struct.RateLimitDescriptor{{Entries: request.Descriptors[1].Entries}},
+		HitsAddend:  7,
+	}, []*config.RateLimit{limits[1]}).Return([]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}})
+	fallback.Reconcile(context.Background(), cache)
+	assert.EqualValues(1, statsStore.NewCounter("local_fallback.reconciled").Value())
+
+	// The local counters are reset.
+	timeSource.EXPECT().UnixNow().Return(int64(1236))
+	fallback.Reconcile(context.Background(), cache)
+	assert.EqualValues(1, statsStore.NewCounter("local_fallback.reconciled").Value())
+}
+
+func TestLocalFallbackCost(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	fallback := limiter.NewLocalFallback(statsStore.Scope("local_fallback"), timeSource, "", 1)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(25, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false),
+	}
+	limits[0].Cost = 10
+
+	// Each request counts 10 hits.
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).Times(3)
+	assert.EqualValues(15, fallback.DoLimit(request, limits)[0].LimitRemaining)
+	assert.EqualValues(5, fallback.DoLimit(request, limits)[0].LimitRemaining)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, fallback.DoLimit(request, limits)[0].Code)
+
+	// The requests are reconciled, the cache applying the cost again.
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1235))
+	cache.EXPECT().DoLimit(gomock.Any(), &pb.RateLimitRequest{
+		Domain:      "domain",
+		Descriptors: []*pb_struct.RateLimitDescriptor{{Entries: request.Descriptors[0].Entries}},
+		HitsAddend:  3,
+	}, limits).Return([]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}})
+	fallback.Reconcile(context.Background(), cache)
+}
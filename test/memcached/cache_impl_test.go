@@ -6,6 +6,7 @@ package memcached_test
 
 import (
 	"context"
+	"io"
 	"math/rand"
 	"strconv"
 	"testing"
@@ -132,6 +133,79 @@ func TestMemcached(t *testing.T) {
 	cache.Flush()
 }
 
+func TestMemcachedQueryOnly(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	client := mock_memcached.NewMockClient(controller)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	cache := memcached.NewRateLimitCacheImpl(client, timeSource, nil, 0, nil, sm, 0.8, "")
+
+	// a hits addend of 0 reads the counters without incrementing or creating them
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	client.EXPECT().GetMulti([]string{"domain_key_value_1234", "domain_key2_value2_1234"}).Return(
+		getMultiResult(map[string]int{"domain_key_value_1234": 4}), nil,
+	)
+	client.EXPECT().Increment(gomock.Any(), gomock.Any()).Times(0)
+	client.EXPECT().Add(gomock.Any()).Times(0)
+
+	request := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+		[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, []uint64{0, 0})
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key2_value2"), false, false, "", nil, false),
+	}
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 6, DurationUntilReset: utils.CalculateReset(&limits[0].Limit.Unit, timeSource)},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 10, DurationUntilReset: utils.CalculateReset(&limits[1].Limit.Unit, timeSource)},
+		},
+		cache.DoLimit(context.Background(), request, limits))
+	assert.Equal(uint64(0), limits[0].Stats.TotalHits.Value())
+
+	cache.Flush()
+}
+
+func TestMemcachedRefund(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	client := mock_memcached.NewMockClient(controller)
+	store := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(store)
+	cache := memcached.NewRateLimitCacheImpl(client, timeSource, nil, 0, nil, sm, 0.8, "")
+	refunder := cache.(limiter.Refunder)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	client.EXPECT().Decrement("domain_key_value_1234", uint64(2)).Return(uint64(3), nil)
+	client.EXPECT().Decrement("domain_key2_value2_1234", uint64(2)).Return(uint64(0), nil)
+	client.EXPECT().Decrement("domain_key3_value3_1234", uint64(2)).Return(uint64(0), memcache.ErrCacheMiss)
+
+	request := common.NewRateLimitRequest("domain",
+		[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}, {{"key4", "value4"}}}, 2)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key2_value2"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key3_value3"), false, false, "", nil, false),
+		nil,
+	}
+	assert.Equal(
+		[]limiter.RefundValue{
+			{Key: "domain_key_value_1234", Value: 3, Refunded: 2},
+			{Key: "domain_key2_value2_1234", Value: 0, Refunded: 2},
+			{Key: "domain_key3_value3_1234"},
+			{},
+		},
+		refunder.RefundHits(context.Background(), request, limits, 1234))
+	assert.EqualValues(3, store.NewCounter("ratelimit.refund.refunds").Value())
+	assert.EqualValues(4, store.NewCounter("ratelimit.refund.refunded_hits").Value())
+	assert.EqualValues(2, store.NewCounter("ratelimit.refund.clamped").Value())
+}
+
 func TestMemcachedGetError(t *testing.T) {
 	assert := assert.New(t)
 	controller := gomock.NewController(t)
@@ -226,11 +300,11 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	timeSource := mock_utils.NewMockTimeSource(controller)
 	client := mock_memcached.NewMockClient(controller)
 	localCache := freecache.NewCache(100)
-	sink := &common.TestStatSink{}
+	sink := common.NewTestStatSink()
 	statsStore := stats.NewStore(sink, true)
 	sm := mockstats.NewMockStatManager(statsStore)
 	cache := memcached.NewRateLimitCacheImpl(client, timeSource, nil, 0, localCache, sm, 0.8, "")
-	localCacheStats := limiter.NewLocalCacheStats(localCache, statsStore.Scope("localcache"))
+	localCacheStats := limiter.NewLocalCacheStats(localCache, 100, statsStore.Scope("localcache"))
 
 	// Test Near Limit Stats. Under Near Limit Ratio
 	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
@@ -322,6 +396,46 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	cache.Flush()
 }
 
+func TestRequestAlignedNotLocallyCached(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	client := mock_memcached.NewMockClient(controller)
+	localCache := freecache.NewCache(100)
+	sm := mockstats.NewMockStatManager(stats.NewStore(stats.NewNullSink(), false))
+	cache := memcached.NewRateLimitCacheImpl(client, timeSource, nil, 0, localCache, sm, 0.8, "")
+
+	limit := config.NewRateLimit(2, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.RequestAligned = true
+	limits := []*config.RateLimit{limit}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+
+	// the key may expire before the end of the whole window, which only bounds the duration until reset
+	client.EXPECT().GetMulti([]string{"domain_key_value_request"}).Return(
+		getMultiResult(map[string]int{"domain_key_value_request": 2}), nil,
+	)
+	client.EXPECT().Increment("domain_key_value_request", uint64(1)).Return(uint64(3), nil)
+	status := cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.EqualValues(60, status.DurationUntilReset.Seconds)
+	cache.Flush()
+	_, err := localCache.Get([]byte("domain_key_value_request"))
+	assert.Equal(freecache.ErrNotFound, err)
+
+	// the next request reads the key, which has expired
+	client.EXPECT().GetMulti([]string{"domain_key_value_request"}).Return(getMultiResult(map[string]int{}), nil)
+	client.EXPECT().Increment("domain_key_value_request", uint64(1)).Return(uint64(0), memcache.ErrCacheMiss)
+	client.EXPECT().Add(&memcache.Item{Key: "domain_key_value_request", Value: []byte("1"), Expiration: int32(60)}).Return(nil)
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(1, status.LimitRemaining)
+	assert.EqualValues(0, limit.Stats.OverLimitWithLocalCache.Value())
+	cache.Flush()
+}
+
 func TestNearLimit(t *testing.T) {
 	assert := assert.New(t)
 	controller := gomock.NewController(t)
@@ -695,3 +809,48 @@ func getMultiResult(vals map[string]int) map[string]*memcache.Item {
 	}
 	return result
 }
+
+func TestMemcacheIncrementQueue(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	client := mock_memcached.NewMockClient(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	sm := mockstats.NewMockStatManager(statsStore)
+	cache := memcached.NewRateLimitCacheImplWithIncrementQueue(client, timeSource, nil, 0, nil, sm, 0.8, "",
+		memcached.IncrementQueueSettings{Workers: 1, Size: 1, DropOnOverflow: true}, statsStore)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
+	client.EXPECT().GetMulti([]string{"domain_key_value_1234"}).Return(nil, nil).Times(4)
+
+	// the worker is blocked by the first increment, the second waits in the queue
+	started := make(chan struct{})
+	release := make(chan struct{})
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).DoAndReturn(func(string, uint64) (uint64, error) {
+		close(started)
+		<-release
+		return uint64(1), nil
+	})
+	cache.DoLimit(context.Background(), request, limits)
+	<-started
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(2), nil)
+	cache.DoLimit(context.Background(), request, limits)
+	assert.EqualValues(1, statsStore.NewGauge("queued").Value())
+
+	// the queue is full, the third increment is dropped
+	cache.DoLimit(context.Background(), request, limits)
+	assert.EqualValues(1, statsStore.NewCounter("overflow").Value())
+	assert.EqualValues(1, statsStore.NewCounter("dropped").Value())
+
+	// closing the cache drains the queue, the next increments run in the request
+	close(release)
+	assert.NoError(cache.(io.Closer).Close())
+	assert.EqualValues(0, statsStore.NewGauge("queued").Value())
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(3), nil)
+	cache.DoLimit(context.Background(), request, limits)
+	assert.EqualValues(1, statsStore.NewCounter("dropped").Value())
+}
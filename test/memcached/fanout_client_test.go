@@ -0,0 +1,93 @@
+package memcached_test
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/memcached"
+	mock_memcached "github.com/envoyproxy/ratelimit/test/mocks/memcached"
+)
+
+func TestFanoutClient(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	selector := new(memcache.ServerList)
+	assert.NoError(selector.SetServers(ketamaServers...))
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key_%d", i)
+	}
+
+	inner := mock_memcached.NewMockClient(controller)
+	client := memcached.WithFanout(inner, selector, 1, stats.NewStore(stats.NewNullSink(), false))
+
+	// each server is read once with its keys, one server at a time
+	var inFlight atomic.Int32
+	var overlapped atomic.Bool
+	inner.EXPECT().GetMulti(gomock.Any()).DoAndReturn(func(keys []string) (map[string]*memcache.Item, error) {
+		if inFlight.Add(1) > 1 {
+			overlapped.Store(true)
+		}
+		defer inFlight.Add(-1)
+		time.Sleep(time.Millisecond)
+		server, _ := selector.PickServer(keys[0])
+		items := map[string]*memcache.Item{}
+		for _, key := range keys {
+			other, _ := selector.PickServer(key)
+			assert.Equal(server, other)
+			items[key] = &memcache.Item{Key: key}
+		}
+		return items, nil
+	}).Times(len(ketamaServers))
+
+	items, err := client.GetMulti(keys)
+	assert.NoError(err)
+	assert.Len(items, len(keys))
+	assert.False(overlapped.Load())
+
+	// the items of the other servers are returned with the error of a server
+	failing, _ := selector.PickServer(keys[0])
+	inner.EXPECT().GetMulti(gomock.Any()).DoAndReturn(func(keys []string) (map[string]*memcache.Item, error) {
+		if server, _ := selector.PickServer(keys[0]); server.String() == failing.String() {
+			return nil, errors.New("read error")
+		}
+		return map[string]*memcache.Item{keys[0]: {Key: keys[0]}}, nil
+	}).Times(len(ketamaServers))
+	items, err = client.GetMulti(keys)
+	assert.EqualError(err, "read error")
+	assert.Len(items, len(ketamaServers)-1)
+
+	_, err = client.GetMulti([]string{"a key"})
+	assert.Equal(memcache.ErrMalformedKey, err)
+}
+
+func TestFanoutClientSingleServer(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	selector := new(memcache.ServerList)
+	assert.NoError(selector.SetServers(ketamaServers[0]))
+	inner := mock_memcached.NewMockClient(controller)
+	client := memcached.WithFanout(inner, selector, 0, stats.NewStore(stats.NewNullSink(), false))
+
+	inner.EXPECT().GetMulti([]string{"a", "b"}).Return(map[string]*memcache.Item{"a": {Key: "a"}}, nil)
+	items, err := client.GetMulti([]string{"a", "b"})
+	assert.NoError(err)
+	assert.Len(items, 1)
+
+	inner.EXPECT().Increment("a", uint64(1)).Return(uint64(2), nil)
+	value, err := client.Increment("a", 1)
+	assert.NoError(err)
+	assert.EqualValues(2, value)
+}
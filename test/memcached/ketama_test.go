@@ -0,0 +1,119 @@
+package memcached_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/memcached"
+)
+
+var ketamaServers = []string{"127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211"}
+
+func pickServers(t *testing.T, selector *memcached.KetamaSelector, keys int) map[string]string {
+	picked := map[string]string{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("domain_key_value_%d", i)
+		addr, err := selector.PickServer(key)
+		assert.NoError(t, err)
+		picked[key] = addr.String()
+	}
+	return picked
+}
+
+func TestKetamaSelectorDistribution(t *testing.T) {
+	assert := assert.New(t)
+	selector := memcached.NewKetamaSelector(160, 0, 0, stats.NewStore(stats.NewNullSink(), false))
+	_, err := selector.PickServer("key")
+	assert.Error(err)
+
+	assert.NoError(selector.SetServers(ketamaServers...))
+	picked := pickServers(t, selector, 3000)
+	perServer := map[string]int{}
+	for _, addr := range picked {
+		perServer[addr]++
+	}
+	assert.Len(perServer, 3)
+	for _, count := range perServer {
+		assert.Greater(count, 600)
+	}
+
+	// removing a node only moves its keys
+	assert.NoError(selector.SetServers(ketamaServers[:2]...))
+	for key, addr := range pickServers(t, selector, 3000) {
+		if picked[key] != ketamaServers[2] {
+			assert.Equal(picked[key], addr)
+		}
+	}
+
+	var each []string
+	selector.Each(func(addr net.Addr) error {
+		each = append(each, addr.String())
+		return nil
+	})
+	assert.Equal(ketamaServers[:2], each)
+}
+
+func TestKetamaSelectorEjection(t *testing.T) {
+	assert := assert.New(t)
+	store := stats.NewStore(stats.NewNullSink(), false)
+	selector := memcached.NewKetamaSelector(160, 2, 100*time.Millisecond, store)
+	assert.NoError(selector.SetServers(ketamaServers...))
+	picked := pickServers(t, selector, 300)
+
+	dead := errors.New("connection refused")
+	dial := selector.Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == ketamaServers[0] {
+			return nil, dead
+		}
+		return nil, nil
+	})
+	// a successful connection resets the failures
+	_, err := dial(context.Background(), "tcp", ketamaServers[0])
+	assert.Equal(dead, err)
+	selector.Dialer(func(context.Context, string, string) (net.Conn, error) { return nil, nil })(
+		context.Background(), "tcp", ketamaServers[0])
+	dial(context.Background(), "tcp", ketamaServers[0])
+	dial(context.Background(), "tcp", ketamaServers[1])
+	assert.EqualValues(0, store.NewCounter("ejections").Value())
+	dial(context.Background(), "tcp", ketamaServers[0])
+	assert.EqualValues(1, store.NewCounter("ejections").Value())
+
+	// the keys of the ejected node move to the other nodes, the others stay
+	moved := 0
+	for key, addr := range pickServers(t, selector, 300) {
+		assert.NotEqual(ketamaServers[0], addr)
+		if picked[key] == ketamaServers[0] {
+			moved++
+		} else {
+			assert.Equal(picked[key], addr)
+		}
+	}
+	assert.Greater(moved, 0)
+	assert.EqualValues(moved, store.NewCounter("redistributed_keys").Value())
+
+	// the node is tried again after the ejection
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(picked, pickServers(t, selector, 300))
+}
+
+func TestKetamaSelectorAllEjected(t *testing.T) {
+	assert := assert.New(t)
+	selector := memcached.NewKetamaSelector(160, 1, time.Minute, stats.NewStore(stats.NewNullSink(), false))
+	assert.NoError(selector.SetServers(ketamaServers[:2]...))
+	picked := pickServers(t, selector, 100)
+
+	dial := selector.Dialer(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+	dial(context.Background(), "tcp", ketamaServers[0])
+	dial(context.Background(), "tcp", ketamaServers[1])
+	// the keys stay on their node
+	assert.Equal(picked, pickServers(t, selector, 100))
+}
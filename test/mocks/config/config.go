@@ -52,6 +52,20 @@ func (mr *MockRateLimitConfigMockRecorder) Dump() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dump", reflect.TypeOf((*MockRateLimitConfig)(nil).Dump))
 }
 
+// DumpTree mocks base method
+func (m *MockRateLimitConfig) DumpTree() []*config.DomainDump {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DumpTree")
+	ret0, _ := ret[0].([]*config.DomainDump)
+	return ret0
+}
+
+// DumpTree indicates an expected call of DumpTree
+func (mr *MockRateLimitConfigMockRecorder) DumpTree() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DumpTree", reflect.TypeOf((*MockRateLimitConfig)(nil).DumpTree))
+}
+
 // GetLimit mocks base method
 func (m *MockRateLimitConfig) GetLimit(arg0 context.Context, arg1 string, arg2 *envoy_extensions_common_ratelimit_v3.RateLimitDescriptor) *config.RateLimit {
 	m.ctrl.T.Helper()
@@ -5,6 +5,7 @@
 package mock_redis
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -101,16 +102,50 @@ func (mr *MockClientMockRecorder) PipeAppend(arg0, arg1, arg2, arg3 interface{},
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PipeAppend", reflect.TypeOf((*MockClient)(nil).PipeAppend), varargs...)
 }
 
+// PipeAppendScript mocks base method
+func (m *MockClient) PipeAppendScript(arg0 redis.Pipeline, arg1 interface{}, arg2, arg3 string, arg4 ...interface{}) redis.Pipeline {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1, arg2, arg3}
+	for _, a := range arg4 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "PipeAppendScript", varargs...)
+	ret0, _ := ret[0].(redis.Pipeline)
+	return ret0
+}
+
+// PipeAppendScript indicates an expected call of PipeAppendScript
+func (mr *MockClientMockRecorder) PipeAppendScript(arg0, arg1, arg2, arg3 interface{}, arg4 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1, arg2, arg3}, arg4...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PipeAppendScript", reflect.TypeOf((*MockClient)(nil).PipeAppendScript), varargs...)
+}
+
 // PipeDo mocks base method
-func (m *MockClient) PipeDo(arg0 redis.Pipeline) error {
+func (m *MockClient) PipeDo(arg0 context.Context, arg1 redis.Pipeline) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "PipeDo", arg0)
+	ret := m.ctrl.Call(m, "PipeDo", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // PipeDo indicates an expected call of PipeDo
-func (mr *MockClientMockRecorder) PipeDo(arg0 interface{}) *gomock.Call {
+func (mr *MockClientMockRecorder) PipeDo(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PipeDo", reflect.TypeOf((*MockClient)(nil).PipeDo), arg0, arg1)
+}
+
+// ScanKeys mocks base method
+func (m *MockClient) ScanKeys(arg0 context.Context, arg1 string, arg2 int, arg3 func(string) bool) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScanKeys", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ScanKeys indicates an expected call of ScanKeys
+func (mr *MockClientMockRecorder) ScanKeys(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PipeDo", reflect.TypeOf((*MockClient)(nil).PipeDo), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScanKeys", reflect.TypeOf((*MockClient)(nil).ScanKeys), arg0, arg1, arg2, arg3)
 }
@@ -21,6 +21,7 @@ func (m *MockStatManager) NewShouldRateLimitStats() stats.ShouldRateLimitStats {
 	ret := stats.ShouldRateLimitStats{}
 	ret.RedisError = s.NewCounter("redis_error")
 	ret.ServiceError = s.NewCounter("service_error")
+	ret.Timing = stats.NewShouldRateLimitTimingStats(s)
 	return ret
 }
 
@@ -30,6 +31,12 @@ func (m *MockStatManager) NewServiceStats() stats.ServiceStats {
 	ret.ConfigLoadError = m.store.NewCounter("config_load_error")
 	ret.ShouldRateLimit = m.NewShouldRateLimitStats()
 	ret.GlobalShadowMode = m.store.NewCounter("global_shadow_mode")
+	ret.CacheKeyCompressed = m.store.NewCounter("cache_key_compressed")
+	ret.ConfigCanaryPassed = m.store.NewCounter("config_canary_passed")
+	ret.ConfigRollback = m.store.NewCounter("config_rollback")
+	ret.ConfigRolledBack = m.store.NewGauge("config_rolled_back")
+	ret.ConfigDomainConflict = m.store.NewCounter("config_domain_conflict")
+	ret.ConfigDiff = stats.NewConfigDiffStats(m.store.Scope("config_diff"))
 	return ret
 }
 
@@ -44,15 +51,22 @@ func (m *MockStatManager) NewStats(key string) stats.RateLimitStats {
 	ret.OverLimitWithLocalCache = m.store.NewCounter(key + ".over_limit_with_local_cache")
 	ret.WithinLimit = m.store.NewCounter(key + ".within_limit")
 	ret.ShadowMode = m.store.NewCounter(key + ".shadow_mode")
+	ret.Matched = m.store.NewCounter(key + ".matched")
 
 	return ret
 }
 
+func (m *MockStatManager) NewStatsWithRollups(domain string, key string) stats.RateLimitStats {
+	return m.NewStats(key)
+}
+
 func (m *MockStatManager) NewDomainStats(key string) stats.DomainStats {
 	ret := stats.DomainStats{}
 	logger.Debugf("outputing test domain stats %s", key)
 	ret.Key = key
 	ret.NotFound = m.store.NewCounter(key + ".domain_not_found")
+	ret.LocalCacheHit = m.store.NewCounter(key + ".local_cache_hit")
+	ret.LocalCacheMiss = m.store.NewCounter(key + ".local_cache_miss")
 
 	return ret
 }
@@ -0,0 +1,92 @@
+package profiling_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"sync"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/profiling"
+	"github.com/envoyproxy/ratelimit/src/settings"
+)
+
+func TestPusher(t *testing.T) {
+	assert := assert.New(t)
+	var mu sync.Mutex
+	pushed := map[string]int{}
+	ingest := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal("/ingest", request.URL.Path)
+		assert.Equal("pprof", request.URL.Query().Get("format"))
+		assert.NotEmpty(body)
+		pushed[request.URL.Query().Get("name")]++
+	}))
+	defer ingest.Close()
+
+	s := settings.Settings{}
+	s.ProfilingPushUrl = ingest.URL + "/ingest"
+	s.ProfilingPushInterval = 50 * time.Millisecond
+	s.ProfilingCpuDuration = 20 * time.Millisecond
+	s.ProfilingAppName = "ratelimit"
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	pusher := profiling.NewPusher(s, store.Scope("profiling"))
+	pusher.Start()
+	assert.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pushed["ratelimit.cpu"] > 0 && pushed["ratelimit.heap"] > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	pusher.Stop()
+	assert.NotZero(store.NewCounter("profiling.push_success").Value())
+	assert.Zero(store.NewCounter("profiling.push_failure").Value())
+}
+
+func TestPusherFailure(t *testing.T) {
+	ingest := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ingest.Close()
+
+	s := settings.Settings{}
+	s.ProfilingPushUrl = ingest.URL
+	s.ProfilingPushInterval = 10 * time.Millisecond
+	s.ProfilingCpuDuration = 5 * time.Millisecond
+	s.ProfilingAppName = "ratelimit"
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	pusher := profiling.NewPusher(s, store.Scope("profiling"))
+	pusher.Start()
+	defer pusher.Stop()
+	assert.Eventually(t, func() bool {
+		return store.NewCounter("profiling.push_failure").Value() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPusherLeavesTheCpuProfiler(t *testing.T) {
+	ingest := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer ingest.Close()
+
+	s := settings.Settings{}
+	s.ProfilingPushUrl = ingest.URL
+	s.ProfilingPushInterval = time.Minute
+	s.ProfilingCpuDuration = 10 * time.Millisecond
+	s.ProfilingAppName = "ratelimit"
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	pusher := profiling.NewPusher(s, store.Scope("profiling"))
+	pusher.Start()
+	defer pusher.Stop()
+
+	// once the CPU profile is pushed the profiler is free until the next interval
+	assert.Eventually(t, func() bool {
+		return store.NewCounter("profiling.push_success").Value() >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, pprof.StartCPUProfile(io.Discard))
+	pprof.StopCPUProfile()
+}
@@ -0,0 +1,119 @@
+package provider_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeConsul struct {
+	mu       sync.Mutex
+	changed  chan struct{}
+	index    uint64
+	kv       map[string]string
+	failures int
+	token    string
+}
+
+func newFakeConsul(kv map[string]string) *fakeConsul {
+	return &fakeConsul{index: 1, kv: kv, changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) set(kv map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kv = kv
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.token = r.Header.Get("X-Consul-Token")
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path != "/v1/kv/ratelimit/" || r.URL.Query().Get("recurse") != "true" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	for index == f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			f.mu.Lock()
+			return
+		}
+		f.mu.Lock()
+	}
+
+	pairs := []map[string]interface{}{{"Key": "ratelimit/", "Value": nil}}
+	for k, v := range f.kv {
+		pairs = append(pairs, map[string]interface{}{"Key": k, "Value": []byte(v)})
+	}
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	consul := newFakeConsul(map[string]string{
+		"ratelimit/foo": "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 3\n",
+	})
+	consul.failures = 1
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	s := settings.Settings{
+		ConfigType:                 "CONSUL",
+		ConsulAddress:              server.URL,
+		ConsulKVPrefix:             "ratelimit/",
+		ConsulToken:                "secret",
+		ConsulWaitTime:             time.Minute,
+		ConsulRetryInitialInterval: time.Millisecond,
+		ConsulRetryMaxInterval:     10 * time.Millisecond,
+	}
+	statsManager := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	p := provider.NewConsulProvider(s, statsManager)
+	defer p.Stop()
+
+	// The first request fails and is retried.
+	config, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false\n", config.Dump())
+	consul.mu.Lock()
+	assert.Equal("secret", consul.token)
+	consul.mu.Unlock()
+
+	consul.set(map[string]string{
+		"ratelimit/foo": "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 5\n",
+	})
+	config, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false\n", config.Dump())
+
+	consul.set(map[string]string{"ratelimit/foo": "domain: foo\nfoo: bar\n"})
+	_, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.NotNil(err)
+}
@@ -0,0 +1,153 @@
+package provider_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+const verifiedConfig = "domain: verified\ndescriptors:\n  - key: key1\n    rate_limit:\n      unit: second\n      requests_per_unit: 5\n"
+
+func checksumLine(content string, name string) string {
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), name)
+}
+
+// loadVerified loads the files of a config directory with the manifest SHA256SUMS, verified with publicKey if set.
+func loadVerified(t *testing.T, files map[string]string, publicKey string) (config.RateLimitConfig, any, gostats.Store) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "config", "team"), 0o755))
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "config", name), []byte(content), 0o644))
+	}
+
+	s := settings.NewSettings()
+	s.RuntimePath = root
+	s.RuntimeSubdirectory = ""
+	s.RuntimeAppDirectory = "config"
+	s.RuntimeWatchRoot = false
+	s.ConfigChecksumManifest = "SHA256SUMS"
+	s.ConfigSignaturePublicKey = publicKey
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	p := provider.NewFileProvider(s, stats.NewMockStatManager(store), store)
+	conf, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	return conf, err, store
+}
+
+func TestFileProviderChecksumManifest(t *testing.T) {
+	assert := assert.New(t)
+	manifest := checksumLine(verifiedConfig, "team/verified.yaml")
+
+	conf, err, store := loadVerified(t, map[string]string{"team/verified.yaml": verifiedConfig, "SHA256SUMS": manifest}, "")
+	assert.Nil(err)
+	assert.EqualValues(5, limitOf(conf, "verified"))
+	assert.EqualValues(1, store.NewCounter("ratelimit.config_verification.verified").Value())
+
+	// a modified file, an unlisted file, a missing file and a missing manifest are rejected
+	for _, files := range []map[string]string{
+		{"team/verified.yaml": verifiedConfig + "\n", "SHA256SUMS": manifest},
+		{"team/verified.yaml": verifiedConfig, "other.yaml": verifiedConfig, "SHA256SUMS": manifest},
+		{"team/verified.yaml": verifiedConfig, "SHA256SUMS": manifest + checksumLine(verifiedConfig, "other.yaml")},
+		{"team/verified.yaml": verifiedConfig},
+	} {
+		_, err, store = loadVerified(t, files, "")
+		assert.IsType(config.RateLimitConfigError(""), err)
+		assert.EqualValues(1, store.NewCounter("ratelimit.config_verification.rejected").Value())
+	}
+}
+
+func TestFileProviderSignedManifest(t *testing.T) {
+	assert := assert.New(t)
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	publicKeyFile := filepath.Join(t.TempDir(), "public.pem")
+	assert.NoError(os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+
+	manifest := checksumLine(verifiedConfig, "verified.yaml")
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(manifest))) + "\n"
+
+	conf, err, _ := loadVerified(t, map[string]string{
+		"verified.yaml": verifiedConfig, "SHA256SUMS": manifest, "SHA256SUMS.sig": signature,
+	}, publicKeyFile)
+	assert.Nil(err)
+	assert.EqualValues(5, limitOf(conf, "verified"))
+
+	// an unsigned or modified manifest is rejected
+	_, err, _ = loadVerified(t, map[string]string{"verified.yaml": verifiedConfig, "SHA256SUMS": manifest}, publicKeyFile)
+	assert.IsType(config.RateLimitConfigError(""), err)
+	_, err, _ = loadVerified(t, map[string]string{
+		"verified.yaml": verifiedConfig, "SHA256SUMS": manifest + "\n", "SHA256SUMS.sig": signature,
+	}, publicKeyFile)
+	assert.IsType(config.RateLimitConfigError(""), err)
+}
+
+func TestFileProviderMultipleSubdirectories(t *testing.T) {
+	assert := assert.New(t)
+	load := func(trees map[string]map[string]string) (config.RateLimitConfig, any, gostats.Store) {
+		root := t.TempDir()
+		for subdirectory, files := range trees {
+			assert.NoError(os.MkdirAll(filepath.Join(root, subdirectory, "config"), 0o755))
+			for name, content := range files {
+				assert.NoError(os.WriteFile(filepath.Join(root, subdirectory, "config", name), []byte(content), 0o644))
+			}
+		}
+		s := settings.NewSettings()
+		s.RuntimePath = root
+		s.RuntimeSubdirectory = "base"
+		s.RuntimeSubdirectories = []string{"team"}
+		s.RuntimeAppDirectory = "config"
+		s.RuntimeWatchRoot = false
+		store := gostats.NewStore(gostats.NewNullSink(), false)
+		p := provider.NewFileProvider(s, stats.NewMockStatManager(store), store)
+		conf, err := (<-p.ConfigUpdateEvent()).GetConfig()
+		return conf, err, store
+	}
+	domain := func(name string, key string, requestsPerUnit int) string {
+		return fmt.Sprintf("domain: %s\ndescriptors:\n  - key: %s\n    rate_limit:\n      unit: second\n      requests_per_unit: %d\n",
+			name, key, requestsPerUnit)
+	}
+
+	conf, err, store := load(map[string]map[string]string{
+		"base": {"platform.yaml": domain("platform", "key1", 1), "shared.yaml": domain("shared", "key1", 2)},
+		"team": {"team.yaml": domain("team", "key1", 3)},
+	})
+	assert.Nil(err)
+	assert.EqualValues(1, limitOf(conf, "platform"))
+	assert.EqualValues(2, limitOf(conf, "shared"))
+	assert.EqualValues(3, limitOf(conf, "team"))
+	assert.EqualValues(2, store.NewGauge("ratelimit.config_source.base.files").Value())
+	assert.EqualValues(1, store.NewGauge("ratelimit.config_source.team.files").Value())
+
+	// a domain of several subdirectories is rejected without MERGE_DOMAIN_CONFIG, naming its subdirectory
+	_, err, _ = load(map[string]map[string]string{
+		"base": {"shared.yaml": domain("shared", "key1", 2)},
+		"team": {"shared.yaml": domain("shared", "key2", 3)},
+	})
+	assert.IsType(config.RateLimitConfigError(""), err)
+	assert.Contains(err.(error).Error(), "team/shared.yaml")
+
+	os.Setenv("MERGE_DOMAIN_CONFIG", "true")
+	defer os.Unsetenv("MERGE_DOMAIN_CONFIG")
+	conf, err, _ = load(map[string]map[string]string{
+		"base": {"shared.yaml": domain("shared", "key1", 2)},
+		"team": {"shared.yaml": domain("shared", "key2", 3)},
+	})
+	assert.Nil(err)
+	assert.EqualValues(2, limitOf(conf, "shared"))
+}
@@ -0,0 +1,108 @@
+package provider_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeKubernetesApi struct {
+	mu       sync.Mutex
+	data     map[string]string
+	version  int
+	events   chan string
+	selector string
+}
+
+func (f *fakeKubernetesApi) setData(data map[string]string) {
+	f.mu.Lock()
+	f.data = data
+	f.version++
+	f.mu.Unlock()
+	f.events <- "MODIFIED"
+}
+
+func (f *fakeKubernetesApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/namespaces/test-ns/configmaps" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	f.selector = r.URL.Query().Get("labelSelector")
+	f.mu.Unlock()
+
+	if r.URL.Query().Get("watch") != "true" {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": fmt.Sprint(f.version)},
+			"items": []interface{}{
+				map[string]interface{}{
+					"metadata": map[string]string{"name": "limits", "namespace": "test-ns"},
+					"data":     f.data,
+				},
+			},
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case eventType := <-f.events:
+		json.NewEncoder(w).Encode(map[string]string{"type": eventType})
+	case <-r.Context().Done():
+	}
+}
+
+func TestKubernetesProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &fakeKubernetesApi{
+		data: map[string]string{
+			"foo.yaml":  "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 3\n",
+			"README.md": "not a config",
+		},
+		events: make(chan string),
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	s := settings.Settings{
+		ConfigType:                    "KUBERNETES",
+		KubernetesApiServerUrl:        server.URL,
+		KubernetesConfigNamespace:     "test-ns",
+		KubernetesConfigLabelSelector: "app=ratelimit",
+	}
+	statsManager := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	p := provider.NewKubernetesProvider(s, statsManager)
+	defer p.Stop()
+
+	config, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false\n", config.Dump())
+	api.mu.Lock()
+	assert.Equal("app=ratelimit", api.selector)
+	api.mu.Unlock()
+
+	api.setData(map[string]string{
+		"foo.yaml": "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 5\n",
+	})
+	config, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false\n", config.Dump())
+
+	api.setData(map[string]string{"foo.yaml": "domain: foo\nfoo: bar\n"})
+	_, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.NotNil(err)
+}
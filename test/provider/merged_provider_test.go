@@ -0,0 +1,102 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/provider"
+	mock_provider "github.com/envoyproxy/ratelimit/test/mocks/provider"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeProvider struct {
+	events  chan provider.ConfigUpdateEvent
+	stopped bool
+}
+
+func (p *fakeProvider) ConfigUpdateEvent() <-chan provider.ConfigUpdateEvent {
+	return p.events
+}
+
+func (p *fakeProvider) Stop() {
+	p.stopped = true
+}
+
+func newConfigEvent(controller *gomock.Controller, conf config.RateLimitConfig, err any) provider.ConfigUpdateEvent {
+	event := mock_provider.NewMockConfigUpdateEvent(controller)
+	event.EXPECT().GetConfig().Return(conf, err).AnyTimes()
+	return event
+}
+
+func loadDomain(domain string, requestsPerUnit string) config.RateLimitConfig {
+	content := "domain: " + domain + "\ndescriptors:\n  - key: key1\n    rate_limit:\n      unit: second\n      requests_per_unit: " + requestsPerUnit + "\n"
+	statsManager := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	return config.NewRateLimitConfigImpl(
+		[]config.RateLimitConfigToLoad{{Name: domain, ConfigYaml: config.ConfigFileContentToYaml(domain, content)}}, statsManager, false)
+}
+
+func limitOf(conf config.RateLimitConfig, domain string) uint32 {
+	limit := conf.GetLimit(context.Background(), domain, &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1"}},
+	})
+	if limit == nil {
+		return 0
+	}
+	return limit.Limit.RequestsPerUnit
+}
+
+func TestMergedProvider(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	file := &fakeProvider{events: make(chan provider.ConfigUpdateEvent)}
+	xds := &fakeProvider{events: make(chan provider.ConfigUpdateEvent)}
+	p := provider.NewMergedProvider(file, xds, true)
+
+	file.events <- newConfigEvent(controller, loadDomain("shared", "1"), nil)
+	conf, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.EqualValues(1, limitOf(conf, "shared"))
+
+	xds.events <- newConfigEvent(controller, loadDomain("shared", "2"), nil)
+	conf, _ = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.EqualValues(2, limitOf(conf, "shared"))
+
+	// a rejected update is forwarded, and the previous configuration of the provider is kept
+	file.events <- newConfigEvent(controller, nil, config.RateLimitConfigError("bad"))
+	_, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Equal(config.RateLimitConfigError("bad"), err)
+
+	file.events <- newConfigEvent(controller, loadDomain("file_only", "3"), nil)
+	conf, _ = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.EqualValues(2, limitOf(conf, "shared"))
+	assert.EqualValues(3, limitOf(conf, "file_only"))
+
+	p.Stop()
+	assert.True(file.stopped)
+	assert.True(xds.stopped)
+}
+
+func TestMergedProvider_FilePrecedence(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	file := &fakeProvider{events: make(chan provider.ConfigUpdateEvent)}
+	xds := &fakeProvider{events: make(chan provider.ConfigUpdateEvent)}
+	p := provider.NewMergedProvider(file, xds, false)
+	defer p.Stop()
+
+	xds.events <- newConfigEvent(controller, loadDomain("shared", "2"), nil)
+	<-p.ConfigUpdateEvent()
+	file.events <- newConfigEvent(controller, loadDomain("shared", "1"), nil)
+	conf, _ := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.EqualValues(1, limitOf(conf, "shared"))
+}
@@ -0,0 +1,112 @@
+package provider_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeObjectStore struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	versions map[string]int
+	gets     int
+	notMod   int
+	auth     map[string]string
+}
+
+func (f *fakeObjectStore) set(path string, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = content
+	f.versions[path]++
+}
+
+func (f *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.auth[r.URL.Path] = r.Header.Get("Authorization")
+	content, ok := f.objects[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := fmt.Sprintf("\"%d\"", f.versions[r.URL.Path])
+	if r.Header.Get("If-None-Match") == etag {
+		f.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f.gets++
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(content))
+}
+
+func TestObjectStoreProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	store := &fakeObjectStore{
+		objects: map[string]string{
+			"/bucket/foo.yaml":     "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 3\n",
+			"/gcs-bucket/bar.yaml": "domain: bar\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 5\n",
+		},
+		versions: map[string]int{"/bucket/foo.yaml": 1, "/gcs-bucket/bar.yaml": 1},
+		auth:     map[string]string{},
+	}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	s := settings.Settings{
+		ConfigType:              "OBJECT_STORE",
+		ObjectStoreUrls:         []string{"s3://bucket/foo.yaml", "gs://gcs-bucket/bar.yaml"},
+		ObjectStorePollInterval: 10 * time.Millisecond,
+		ObjectStoreS3Region:     "eu-west-1",
+		ObjectStoreS3Endpoint:   server.URL,
+		ObjectStoreGcsEndpoint:  server.URL,
+		AwsAccessKeyId:          "AKIDEXAMPLE",
+		AwsSecretAccessKey:      "secret",
+	}
+	statsManager := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	p := provider.NewObjectStoreProvider(s, statsManager)
+	defer p.Stop()
+
+	config, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{
+		"foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false",
+		"bar.k1_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false",
+	}, strings.Split(strings.TrimSuffix(config.Dump(), "\n"), "\n"))
+
+	// Unchanged objects are not downloaded again and no config is sent.
+	time.Sleep(50 * time.Millisecond)
+	store.mu.Lock()
+	assert.Equal(2, store.gets)
+	assert.Greater(store.notMod, 0)
+	assert.True(strings.HasPrefix(store.auth["/bucket/foo.yaml"], "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+	assert.Contains(store.auth["/bucket/foo.yaml"], "/eu-west-1/s3/aws4_request")
+	assert.Empty(store.auth["/gcs-bucket/bar.yaml"])
+	store.mu.Unlock()
+
+	store.set("/bucket/foo.yaml", "domain: foo\ndescriptors:\n  - key: k1\n    value: v1\n    rate_limit:\n      unit: minute\n      requests_per_unit: 10\n")
+	config, err = (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{
+		"foo.k1_v1: unit=MINUTE requests_per_unit=10, shadow_mode: false",
+		"bar.k1_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false",
+	}, strings.Split(strings.TrimSuffix(config.Dump(), "\n"), "\n"))
+	store.mu.Lock()
+	assert.Equal(3, store.gets)
+	store.mu.Unlock()
+}
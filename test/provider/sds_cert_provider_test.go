@@ -0,0 +1,118 @@
+package provider_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/common"
+)
+
+const sdsPort = 18003
+
+func newSecretSnapshot(t *testing.T, version string, commonName string) *cache.Snapshot {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.SecretType: {
+			&tlsv3.Secret{
+				Name: "server-cert",
+				Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+					CertificateChain: &corev3.DataSource{Specifier: &corev3.DataSource_InlineBytes{
+						InlineBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+					}},
+					PrivateKey: &corev3.DataSource{Specifier: &corev3.DataSource_InlineBytes{
+						InlineBytes: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+					}},
+				}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	return snapshot
+}
+
+func currentCommonName(t *testing.T, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+	t.Helper()
+	cert, err := getCertificate(nil)
+	if err != nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestSdsCertProvider(t *testing.T) {
+	assert := assert.New(t)
+	setSnapshot, cancel := common.StartXdsSotwServer(t, &common.XdsServerConfig{Port: sdsPort, NodeId: xdsNodeId},
+		newSecretSnapshot(t, "1", "first"))
+	defer cancel()
+
+	s := settings.Settings{
+		ConfigGrpcXdsNodeId:                 xdsNodeId,
+		GrpcServerTlsSdsServerUrl:           fmt.Sprintf("localhost:%d", sdsPort),
+		GrpcServerTlsSdsInitialFetchTimeout: 5 * time.Second,
+		XdsClientBackoffInitialInterval:     100 * time.Millisecond,
+		XdsClientBackoffMaxInterval:         time.Second,
+	}
+	statsStore := gostats.NewStore(gostats.NewNullSink(), false)
+	p := provider.NewSdsCertProvider(s, statsStore, "server-cert")
+	defer p.Stop()
+
+	// the constructor waits for the first certificate
+	getCertificate := p.GetCertificateFunc()
+	assert.Equal("first", currentCommonName(t, getCertificate))
+
+	// the rotated certificate replaces the first one
+	setSnapshot(newSecretSnapshot(t, "2", "rotated"))
+	assert.Eventually(func() bool {
+		return currentCommonName(t, getCertificate) == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(2, statsStore.NewCounter("sds.update_success").Value())
+}
+
+func TestSdsCertProviderWithoutSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	s := settings.Settings{
+		ConfigGrpcXdsNodeId:                 xdsNodeId,
+		GrpcServerTlsSdsServerUrl:           fmt.Sprintf("localhost:%d", sdsPort+1),
+		GrpcServerTlsSdsInitialFetchTimeout: 100 * time.Millisecond,
+	}
+	p := provider.NewSdsCertProvider(s, gostats.NewStore(gostats.NewNullSink(), false), "server-cert")
+	defer p.Stop()
+
+	_, err := p.GetCertificateFunc()(nil)
+	assert.EqualError(err, "no certificate received from SDS for the secret 'server-cert'")
+}
@@ -0,0 +1,102 @@
+package provider_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/common"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+
+	rls_config "github.com/envoyproxy/go-control-plane/ratelimit/config/ratelimit/v3"
+)
+
+const xdsDeltaPort = 18002
+
+func deltaTestConfig(name string, key string, requestsPerUnit uint32) *rls_config.RateLimitConfig {
+	return &rls_config.RateLimitConfig{
+		Name:   name,
+		Domain: name,
+		Descriptors: []*rls_config.RateLimitDescriptor{
+			{
+				Key:   key,
+				Value: "v1",
+				RateLimit: &rls_config.RateLimitPolicy{
+					Unit:            rls_config.RateLimitUnit_MINUTE,
+					RequestsPerUnit: requestsPerUnit,
+				},
+			},
+		},
+	}
+}
+
+func TestXdsDeltaProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	initSnapshot, _ := cache.NewSnapshot("1",
+		map[resource.Type][]types.Resource{
+			resource.RateLimitConfigType: {deltaTestConfig("foo", "k1", 3)},
+		},
+	)
+	setSnapshotFunc, cancel := common.StartXdsSotwServer(t, &common.XdsServerConfig{Port: xdsDeltaPort, NodeId: xdsNodeId}, initSnapshot)
+	defer cancel()
+
+	s := settings.Settings{
+		ConfigType:             "GRPC_XDS_DELTA",
+		ConfigGrpcXdsNodeId:    xdsNodeId,
+		ConfigGrpcXdsServerUrl: fmt.Sprintf("localhost:%d", xdsDeltaPort),
+	}
+
+	statsStore := gostats.NewStore(gostats.NewNullSink(), false)
+	statsManager := stats.NewMockStatManager(statsStore)
+	p := provider.NewXdsGrpcDeltaProvider(s, statsManager)
+	defer p.Stop()
+	providerEventChan := p.ConfigUpdateEvent()
+
+	config, err := (<-providerEventChan).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false\n", config.Dump())
+	assert.EqualValues(1, statsStore.NewCounter("ratelimit.xds_delta.resources_added").Value())
+	assert.EqualValues(1, statsStore.NewGauge("ratelimit.xds_delta.resources_total").Value())
+
+	// Adding a resource only sends the new resource, the existing one is kept.
+	snapshot, _ := cache.NewSnapshot("2",
+		map[resource.Type][]types.Resource{
+			resource.RateLimitConfigType: {deltaTestConfig("foo", "k1", 3), deltaTestConfig("bar", "k2", 5)},
+		},
+	)
+	setSnapshotFunc(snapshot)
+
+	config, err = (<-providerEventChan).GetConfig()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{
+		"foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false",
+		"bar.k2_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false",
+	}, strings.Split(strings.TrimSuffix(config.Dump(), "\n"), "\n"))
+	assert.EqualValues(2, statsStore.NewCounter("ratelimit.xds_delta.resources_added").Value())
+	assert.EqualValues(2, statsStore.NewGauge("ratelimit.xds_delta.resources_total").Value())
+
+	// Removing a resource only sends its name.
+	snapshot, _ = cache.NewSnapshot("3",
+		map[resource.Type][]types.Resource{
+			resource.RateLimitConfigType: {deltaTestConfig("bar", "k2", 5)},
+		},
+	)
+	setSnapshotFunc(snapshot)
+
+	config, err = (<-providerEventChan).GetConfig()
+	assert.Nil(err)
+	assert.Equal("bar.k2_v1: unit=MINUTE requests_per_unit=5, shadow_mode: false\n", config.Dump())
+	assert.EqualValues(2, statsStore.NewCounter("ratelimit.xds_delta.resources_added").Value())
+	assert.EqualValues(1, statsStore.NewCounter("ratelimit.xds_delta.resources_removed").Value())
+	assert.EqualValues(1, statsStore.NewGauge("ratelimit.xds_delta.resources_total").Value())
+}
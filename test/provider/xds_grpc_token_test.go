@@ -0,0 +1,105 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/test/common"
+	"github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+const xdsTokenPort = 18003
+
+func TestXdsTokenCredentialsStatic(t *testing.T) {
+	assert := assert.New(t)
+
+	creds := provider.NewXdsTokenCredentials("static-token", "", time.Minute, true)
+	md, err := creds.GetRequestMetadata(context.Background())
+	assert.NoError(err)
+	assert.Equal("Bearer static-token", md["authorization"])
+	assert.True(creds.RequireTransportSecurity())
+}
+
+func TestXdsTokenCredentialsFileRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(os.WriteFile(tokenFile, []byte("token-1\n"), 0o600))
+
+	creds := provider.NewXdsTokenCredentials("", tokenFile, 10*time.Millisecond, false)
+	md, err := creds.GetRequestMetadata(context.Background())
+	assert.NoError(err)
+	assert.Equal("Bearer token-1", md["authorization"])
+
+	assert.NoError(os.WriteFile(tokenFile, []byte("token-2\n"), 0o600))
+	time.Sleep(20 * time.Millisecond)
+	md, err = creds.GetRequestMetadata(context.Background())
+	assert.NoError(err)
+	assert.Equal("Bearer token-2", md["authorization"])
+
+	// The previous token is kept while the file is unavailable.
+	assert.NoError(os.Remove(tokenFile))
+	time.Sleep(20 * time.Millisecond)
+	md, err = creds.GetRequestMetadata(context.Background())
+	assert.NoError(err)
+	assert.Equal("Bearer token-2", md["authorization"])
+}
+
+func TestXdsTokenCredentialsMissingFile(t *testing.T) {
+	creds := provider.NewXdsTokenCredentials("", filepath.Join(t.TempDir(), "missing"), time.Minute, false)
+	_, err := creds.GetRequestMetadata(context.Background())
+	assert.Error(t, err)
+}
+
+func TestXdsProviderWithToken(t *testing.T) {
+	assert := assert.New(t)
+
+	authInterceptor := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer secret" {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(srv, ss)
+	}
+	initSnapshot, _ := cache.NewSnapshot("1",
+		map[resource.Type][]types.Resource{
+			resource.RateLimitConfigType: {deltaTestConfig("foo", "k1", 3)},
+		},
+	)
+	_, cancel := common.StartXdsSotwServer(t, &common.XdsServerConfig{
+		Port:          xdsTokenPort,
+		NodeId:        xdsNodeId,
+		ServerOptions: []grpc.ServerOption{grpc.StreamInterceptor(authInterceptor)},
+	}, initSnapshot)
+	defer cancel()
+
+	s := settings.Settings{
+		ConfigType:               "GRPC_XDS_SOTW",
+		ConfigGrpcXdsNodeId:      xdsNodeId,
+		ConfigGrpcXdsServerUrl:   fmt.Sprintf("localhost:%d", xdsTokenPort),
+		ConfigGrpcXdsClientToken: "secret",
+	}
+	statsManager := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	p := provider.NewXdsGrpcSotwProvider(s, statsManager)
+	defer p.Stop()
+
+	config, err := (<-p.ConfigUpdateEvent()).GetConfig()
+	assert.Nil(err)
+	assert.Equal("foo.k1_v1: unit=MINUTE requests_per_unit=3, shadow_mode: false\n", config.Dump())
+}
@@ -0,0 +1,58 @@
+package redis_test
+
+import (
+	"testing"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/redis"
+	mock_redis "github.com/envoyproxy/ratelimit/test/mocks/redis"
+)
+
+func TestClientRouter(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	defaultClient := mock_redis.NewMockClient(controller)
+	perSecondClient := mock_redis.NewMockClient(controller)
+	minuteClient := mock_redis.NewMockClient(controller)
+	tenantClient := mock_redis.NewMockClient(controller)
+	poolClient := mock_redis.NewMockClient(controller)
+
+	router := redis.NewClientRouter(defaultClient, perSecondClient)
+	router.AddUnitRoute(pb.RateLimitResponse_RateLimit_MINUTE, minuteClient)
+	router.AddDomainRoute("tenant", tenantClient)
+	router.AddNamedPool("pool-a", poolClient)
+
+	assert.Same(perSecondClient, router.ClientFor("domain", "", pb.RateLimitResponse_RateLimit_SECOND))
+	assert.Same(minuteClient, router.ClientFor("domain", "", pb.RateLimitResponse_RateLimit_MINUTE))
+	assert.Same(defaultClient, router.ClientFor("domain", "", pb.RateLimitResponse_RateLimit_HOUR))
+	assert.Same(tenantClient, router.ClientFor("tenant", "", pb.RateLimitResponse_RateLimit_SECOND))
+	assert.Same(tenantClient, router.ClientFor("tenant", "", pb.RateLimitResponse_RateLimit_MINUTE))
+	assert.Same(poolClient, router.ClientFor("tenant", "pool-a", pb.RateLimitResponse_RateLimit_MINUTE))
+	assert.Same(poolClient, router.ClientFor("domain", "pool-a", pb.RateLimitResponse_RateLimit_SECOND))
+	assert.Same(minuteClient, router.ClientFor("domain", "pool-unknown", pb.RateLimitResponse_RateLimit_MINUTE))
+
+	router = redis.NewClientRouter(defaultClient, nil)
+	assert.Same(defaultClient, router.ClientFor("domain", "", pb.RateLimitResponse_RateLimit_SECOND))
+}
+
+func TestParseRedisPools(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(map[string]string{
+		"pool-a": "redis-a:6379",
+		"pool-b": "redis-b1:6379,redis-b2:6379",
+	}, redis.ParseRedisPools("pool-a=redis-a:6379; pool-b=redis-b1:6379,redis-b2:6379;"))
+	assert.Empty(redis.ParseRedisPools(""))
+	assert.Panics(func() { redis.ParseRedisPools("redis-a:6379") })
+}
+
+func TestParseRateLimitUnit(t *testing.T) {
+	assert.Equal(t, pb.RateLimitResponse_RateLimit_MINUTE, redis.ParseRateLimitUnit("minute"))
+	assert.Panics(t, func() { redis.ParseRateLimitUnit("UNKNOWN") })
+	assert.Panics(t, func() { redis.ParseRateLimitUnit("fortnight") })
+}
@@ -0,0 +1,162 @@
+package redis_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/coocood/freecache"
+	gostats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/redis"
+)
+
+// fakeTrackingServer implements the subset of Redis client-side caching used by ClientSideCache.
+type fakeTrackingServer struct {
+	srv        *server.Server
+	mu         sync.Mutex
+	nextId     int
+	subscriber *server.Peer
+	redirect   string
+	tracked    []string
+	markers    []string
+}
+
+func newFakeTrackingServer(t *testing.T) *fakeTrackingServer {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeTrackingServer{srv: srv}
+	srv.Register("CLIENT", func(c *server.Peer, cmd string, args []string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "ID":
+			f.nextId++
+			c.WriteInt(f.nextId)
+		case "TRACKING":
+			f.redirect = args[3]
+			c.WriteOK()
+		default:
+			c.WriteOK()
+		}
+	})
+	srv.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.subscriber = c
+		c.Block(func(w *server.Writer) {
+			w.WriteLen(3)
+			w.WriteBulk("subscribe")
+			w.WriteBulk(args[0])
+			w.WriteInt(1)
+		})
+	})
+	srv.Register("SET", func(c *server.Peer, cmd string, args []string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.markers = append(f.markers, strings.Join(args, " "))
+		c.WriteOK()
+	})
+	srv.Register("EXISTS", func(c *server.Peer, cmd string, args []string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.tracked = append(f.tracked, args[0])
+		c.WriteInt(1)
+	})
+	return f
+}
+
+func (f *fakeTrackingServer) getTracked() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.tracked...)
+}
+
+func (f *fakeTrackingServer) getMarkers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.markers...)
+}
+
+func (f *fakeTrackingServer) invalidate(keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscriber.Block(func(w *server.Writer) {
+		w.WriteLen(3)
+		w.WriteBulk("message")
+		w.WriteBulk("__redis__:invalidate")
+		if keys == nil {
+			w.WriteNull()
+		} else {
+			w.WriteStrings(keys)
+		}
+		w.Flush()
+	})
+}
+
+func TestClientSideCache(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTrackingServer(t)
+	defer fake.srv.Close()
+
+	localCache := freecache.NewCache(1024 * 1024)
+	statsStore := gostats.NewStore(gostats.NewNullSink(), false)
+	cache := redis.NewClientSideCache(statsStore.Scope("redis_client_side_cache"), localCache, radix.Dialer{}, "tcp", fake.srv.Addr().String(), 16)
+	defer cache.Close()
+
+	// The local cache is flushed once the tracking is enabled.
+	assert.Eventually(func() bool {
+		return statsStore.NewCounter("redis_client_side_cache.flushes").Value() == 1
+	}, time.Second, 10*time.Millisecond)
+	fake.mu.Lock()
+	assert.Equal("1", fake.redirect)
+	fake.mu.Unlock()
+
+	localCache.Set([]byte("domain_key_value_1200"), []byte{}, 60)
+	localCache.Set([]byte("domain_key2_value2_1200"), []byte{}, 60)
+	localCache.Set([]byte("unrelated"), []byte{}, 60)
+	cache.Track("domain_key_value_1200", 30*time.Second)
+	cache.Track("domain_key2_value2_1200", 1500*time.Millisecond)
+	cache.Track("domain_key3_value3_1200", 0)
+	assert.Eventually(func() bool {
+		return len(fake.getTracked()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// The markers of the windows are set and tracked, not the counters.
+	assert.Equal([]string{"domain_key_value_1200:over_limit", "domain_key2_value2_1200:over_limit"}, fake.getTracked())
+	assert.Equal([]string{
+		"domain_key_value_1200:over_limit 1 NX PX 30000",
+		"domain_key2_value2_1200:over_limit 1 NX PX 1500",
+	}, fake.getMarkers())
+	assert.EqualValues(2, statsStore.NewCounter("redis_client_side_cache.tracked").Value())
+
+	// A modified counter is not an invalidation of its over-limit window.
+	fake.invalidate([]string{"domain_key2_value2_1200"})
+
+	// A marker reset in Redis removes its key from the local cache.
+	fake.invalidate([]string{"domain_key_value_1200:over_limit"})
+	assert.Eventually(func() bool {
+		_, err := localCache.Get([]byte("domain_key_value_1200"))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err := localCache.Get([]byte("domain_key2_value2_1200"))
+	assert.Nil(err)
+	assert.EqualValues(1, statsStore.NewCounter("redis_client_side_cache.invalidated").Value())
+
+	// A flush of the database removes the tracked keys only.
+	fake.invalidate(nil)
+	assert.Eventually(func() bool {
+		return statsStore.NewCounter("redis_client_side_cache.flushes").Value() == 2
+	}, time.Second, 10*time.Millisecond)
+	_, err = localCache.Get([]byte("domain_key2_value2_1200"))
+	assert.NotNil(err)
+	_, err = localCache.Get([]byte("unrelated"))
+	assert.Nil(err)
+}
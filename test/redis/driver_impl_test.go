@@ -1,12 +1,23 @@
 package redis_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
 	stats "github.com/lyft/gostats"
 	"github.com/stretchr/testify/assert"
 
@@ -39,7 +50,7 @@ func testNewClientImpl(t *testing.T, pipelineWindow time.Duration, pipelineLimit
 		statsStore := stats.NewStore(stats.NewNullSink(), false)
 
 		mkRedisClient := func(auth, addr string) redis.Client {
-			return redis.NewClientImpl(statsStore, false, auth, "tcp", "single", addr, 1, pipelineWindow, pipelineLimit, nil, false, nil, 10*time.Second, "", "")
+			return redis.NewClientImpl(statsStore, false, auth, "tcp", "single", addr, 1, pipelineWindow, pipelineLimit, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
 		}
 
 		t.Run("connection refused", func(t *testing.T) {
@@ -107,6 +118,17 @@ func testNewClientImpl(t *testing.T, pipelineWindow time.Duration, pipelineLimit
 				mkRedisClient(redisAuth, redisSrv.Addr())
 			})
 		})
+
+		t.Run("auth default user password with colon", func(t *testing.T) {
+			redisSrv := mustNewRedisServer()
+			defer redisSrv.Close()
+
+			redisSrv.RequireAuth("test:pass")
+
+			assert.NotPanics(t, func() {
+				mkRedisClient("default:test:pass", redisSrv.Addr())
+			})
+		})
 	}
 }
 
@@ -115,11 +137,54 @@ func TestNewClientImpl(t *testing.T) {
 	t.Run("WithoutPipelineWindow", testNewClientImpl(t, 0, 0))
 }
 
+func TestTlsServerName(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redis.example.com"},
+		DNSNames:     []string{"redis.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	serverNames := make(chan string, 10)
+	redisSrv, err := miniredis.RunTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	assert.Nil(t, err)
+	defer redisSrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+
+	// the certificate is not valid for the address of the server
+	assert.Panics(t, func() {
+		redis.NewClientImpl(statsStore, true, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, &tls.Config{RootCAs: roots}, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	})
+	assert.Equal(t, "", <-serverNames)
+
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "redis.example.com"}
+	client := redis.NewClientImpl(statsStore, true, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, tlsConfig, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	assert.Equal(t, "redis.example.com", <-serverNames)
+}
+
 func TestDoCmd(t *testing.T) {
 	statsStore := stats.NewStore(stats.NewNullSink(), false)
 
 	mkRedisClient := func(addr string) redis.Client {
-		return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, 0, 0, nil, false, nil, 10*time.Second, "", "")
+		return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
 	}
 
 	t.Run("SETGET ok", func(t *testing.T) {
@@ -159,12 +224,54 @@ func TestDoCmd(t *testing.T) {
 	})
 }
 
+func TestBackendOpStats(t *testing.T) {
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	redisSrv := mustNewRedisServer()
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+
+	var res uint32
+	assert.Nil(t, client.DoCmd(&res, "INCRBY", "a", 1))
+	assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", 1)))
+	redisSrv.Close()
+	assert.Error(t, client.DoCmd(&res, "INCRBY", "a", 1))
+
+	// the commands and the pipelines count under the names shared with memcache
+	assert.EqualValues(t, 2, statsStore.NewCounterWithTags("incrby", map[string]string{"code": "success"}).Value())
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("incrby", map[string]string{"code": "error"}).Value())
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("pipeline", map[string]string{"code": "success"}).Value())
+}
+
+func TestBackendOpStatsPerCommand(t *testing.T) {
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+
+	var incr, found, missing uint64
+	pipeline := client.PipeAppend(redis.Pipeline{}, &incr, "INCRBY", "a", 1)
+	pipeline = client.PipeAppend(pipeline, nil, "EXPIRE", "a", 10)
+	pipeline = client.PipeAppend(pipeline, &found, "GET", "a")
+	pipeline = client.PipeAppend(pipeline, &missing, "GET", "b")
+	assert.Nil(t, client.PipeDo(context.Background(), pipeline))
+	assert.EqualValues(t, 1, found)
+	assert.EqualValues(t, 0, missing)
+	var value uint64
+	assert.Nil(t, client.DoCmd(&value, "GET", "c"))
+
+	// the commands of the pipelines count under their own name, the missing keys as misses
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("pipeline", map[string]string{"code": "success"}).Value())
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("incrby", map[string]string{"code": "success"}).Value())
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("expire", map[string]string{"code": "success"}).Value())
+	assert.EqualValues(t, 1, statsStore.NewCounterWithTags("get", map[string]string{"code": "success"}).Value())
+	assert.EqualValues(t, 2, statsStore.NewCounterWithTags("get", map[string]string{"code": "miss"}).Value())
+}
+
 func testPipeDo(t *testing.T, pipelineWindow time.Duration, pipelineLimit int) func(t *testing.T) {
 	return func(t *testing.T) {
 		statsStore := stats.NewStore(stats.NewNullSink(), false)
 
 		mkRedisClient := func(addr string) redis.Client {
-			return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, pipelineWindow, pipelineLimit, nil, false, nil, 10*time.Second, "", "")
+			return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, pipelineWindow, pipelineLimit, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
 		}
 
 		t.Run("SETGET ok", func(t *testing.T) {
@@ -178,7 +285,7 @@ func testPipeDo(t *testing.T, pipelineWindow time.Duration, pipelineLimit int) f
 			pipeline = client.PipeAppend(pipeline, nil, "SET", "foo", "bar")
 			pipeline = client.PipeAppend(pipeline, &res, "GET", "foo")
 
-			assert.Nil(t, client.PipeDo(pipeline))
+			assert.Nil(t, client.PipeDo(context.Background(), pipeline))
 			assert.Equal(t, "bar", res)
 		})
 
@@ -190,10 +297,10 @@ func testPipeDo(t *testing.T, pipelineWindow time.Duration, pipelineLimit int) f
 			var res uint32
 			hits := uint32(1)
 
-			assert.Nil(t, client.PipeDo(client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", hits)))
+			assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", hits)))
 			assert.Equal(t, hits, res)
 
-			assert.Nil(t, client.PipeDo(client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", hits)))
+			assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", hits)))
 			assert.Equal(t, uint32(2), res)
 		})
 
@@ -201,7 +308,7 @@ func testPipeDo(t *testing.T, pipelineWindow time.Duration, pipelineLimit int) f
 			redisSrv := mustNewRedisServer()
 			client := mkRedisClient(redisSrv.Addr())
 
-			assert.Nil(t, nil, client.PipeDo(client.PipeAppend(redis.Pipeline{}, nil, "SET", "foo", "bar")))
+			assert.Nil(t, nil, client.PipeDo(context.Background(), client.PipeAppend(redis.Pipeline{}, nil, "SET", "foo", "bar")))
 
 			redisSrv.Close()
 
@@ -216,7 +323,18 @@ func testPipeDo(t *testing.T, pipelineWindow time.Duration, pipelineLimit int) f
 				assert.True(t, hasConnectionError, "expected connection error, got: %s", errMsg)
 			}
 
-			expectErrContainEOF(t, client.PipeDo(client.PipeAppend(redis.Pipeline{}, nil, "GET", "foo")))
+			expectErrContainEOF(t, client.PipeDo(context.Background(), client.PipeAppend(redis.Pipeline{}, nil, "GET", "foo")))
+		})
+
+		t.Run("context done", func(t *testing.T) {
+			redisSrv := mustNewRedisServer()
+			defer redisSrv.Close()
+			client := mkRedisClient(redisSrv.Addr())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var res uint32
+			assert.ErrorIs(t, client.PipeDo(ctx, client.PipeAppend(redis.Pipeline{}, &res, "INCRBY", "a", 1)), context.Canceled)
 		})
 	}
 }
@@ -232,7 +350,7 @@ func TestPoolOnEmptyBehavior(t *testing.T) {
 
 	// Helper to create client with specific on-empty behavior
 	mkRedisClientWithBehavior := func(addr, behavior string) redis.Client {
-		return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, 0, 0, nil, false, nil, 10*time.Second, behavior, "")
+		return redis.NewClientImpl(statsStore, false, "", "tcp", "single", addr, 1, 0, 0, nil, false, nil, 10*time.Second, behavior, "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
 	}
 
 	t.Run("default behavior (empty string)", func(t *testing.T) {
@@ -356,7 +474,7 @@ func TestNewClientImplSentinel(t *testing.T) {
 	mkSentinelClient := func(auth, sentinelAuth, url string, useTls bool, timeout time.Duration) redis.Client {
 		// Pass nil for tlsConfig - we can't test TLS without a real TLS server,
 		// but we can verify the code path is executed (logs will show TLS is enabled)
-		return redis.NewClientImpl(statsStore, useTls, auth, "tcp", "sentinel", url, 1, 0, 0, nil, false, nil, timeout, "", sentinelAuth)
+		return redis.NewClientImpl(statsStore, useTls, auth, "tcp", "sentinel", url, 1, 0, 0, nil, false, nil, timeout, "", sentinelAuth, nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
 	}
 
 	t.Run("invalid url format - missing sentinel addresses", func(t *testing.T) {
@@ -488,6 +606,89 @@ func TestNewClientImplSentinel(t *testing.T) {
 	})
 }
 
+// fakeSentinel answers the sentinel commands of radix, announcing the master it is given.
+type fakeSentinel struct {
+	*miniredis.Miniredis
+	mu     sync.Mutex
+	master *miniredis.Miniredis
+}
+
+func newFakeSentinel(master *miniredis.Miniredis) *fakeSentinel {
+	sentinel := &fakeSentinel{Miniredis: mustNewRedisServer(), master: master}
+	sentinel.Server().Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		if strings.ToUpper(args[0]) != "MASTER" {
+			c.WriteLen(0)
+			return
+		}
+		sentinel.mu.Lock()
+		defer sentinel.mu.Unlock()
+		c.WriteLen(4)
+		c.WriteBulk("ip")
+		c.WriteBulk(sentinel.master.Host())
+		c.WriteBulk("port")
+		c.WriteBulk(sentinel.master.Port())
+	})
+	return sentinel
+}
+
+func (s *fakeSentinel) failover(master *miniredis.Miniredis) {
+	s.mu.Lock()
+	s.master = master
+	s.mu.Unlock()
+	s.Publish("switch-master", "mymaster")
+}
+
+func TestSentinelFailover(t *testing.T) {
+	first := mustNewRedisServer()
+	defer first.Close()
+	second := mustNewRedisServer()
+	defer second.Close()
+	sentinel := newFakeSentinel(first)
+	defer sentinel.Close()
+
+	// the demoted master fails the commands and the sentinels announce the new master
+	demote := func(master *miniredis.Miniredis, next *miniredis.Miniredis) {
+		var once sync.Once
+		master.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+			if cmd != "GET" && cmd != "INCRBY" {
+				return false
+			}
+			c.WriteError("READONLY You can't write against a read only replica.")
+			once.Do(func() { go sentinel.failover(next) })
+			return true
+		})
+	}
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	retryPolicy := redis.RetryPolicy{FailoverTimeout: 10 * time.Second, FailoverGrace: true}
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "sentinel", "mymaster,"+sentinel.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, retryPolicy, redis.ClusterPolicy{})
+	defer client.Close()
+
+	t.Run("read-only pipeline is executed on the new master", func(t *testing.T) {
+		second.Set("foo", "5")
+		demote(first, second)
+		var value uint64
+		assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &value, "GET", "foo")))
+		assert.Equal(t, uint64(5), value)
+		assert.Equal(t, uint64(1), statsStore.NewCounter("sentinel.failovers").Value())
+		assert.Equal(t, uint64(1), statsStore.NewCounter("sentinel.failover_retries").Value())
+	})
+
+	t.Run("increment is answered in grace mode", func(t *testing.T) {
+		first.Server().SetPreHook(nil)
+		demote(second, first)
+		var value uint64
+		assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &value, "INCRBY", "foo", 1)))
+		assert.Equal(t, uint64(0), value)
+		assert.Equal(t, uint64(2), statsStore.NewCounter("sentinel.failovers").Value())
+		assert.Equal(t, uint64(1), statsStore.NewCounter("sentinel.failover_graces").Value())
+		// the increment was not applied on the demoted master
+		stored, err := second.Get("foo")
+		assert.Nil(t, err)
+		assert.Equal(t, "5", stored)
+	})
+}
+
 // Helper function to check if error message contains any of the given strings
 func containsAny(s string, substrs []string) bool {
 	for _, substr := range substrs {
@@ -497,3 +698,209 @@ func containsAny(s string, substrs []string) bool {
 	}
 	return false
 }
+
+func TestClusterPipelineWithWorkerPool(t *testing.T) {
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	// miniredis answers CLUSTER SLOTS but does not know READONLY, which radix sends to cluster nodes.
+	redisSrv.Server().Register("READONLY", func(c *server.Peer, cmd string, args []string) { c.WriteOK() })
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	workerPool := redis.NewPipelineWorkerPool(statsStore.Scope("workers"), 2, 4)
+	defer workerPool.Close()
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "cluster", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", workerPool, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+
+	var pipeline redis.Pipeline
+	results := make([]uint64, 8)
+	for i := range results {
+		key := fmt.Sprintf("key%d", i)
+		pipeline = client.PipeAppend(pipeline, &results[i], "INCRBY", key, i+1)
+		pipeline = client.PipeAppend(pipeline, nil, "EXPIRE", key, 10)
+	}
+	assert.Nil(t, client.PipeDo(context.Background(), pipeline))
+
+	for i, result := range results {
+		assert.Equal(t, uint64(i+1), result)
+		value, err := redisSrv.Get(fmt.Sprintf("key%d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(i+1), value)
+	}
+	assert.Equal(t, uint64(8), statsStore.NewCounter("workers.tasks").Value())
+	assert.Equal(t, uint64(0), statsStore.NewGauge("workers.queue_depth").Value())
+}
+
+func TestClusterRedirects(t *testing.T) {
+	newNode := func() *miniredis.Miniredis {
+		node := mustNewRedisServer()
+		node.Server().Register("READONLY", func(c *server.Peer, cmd string, args []string) { c.WriteOK() })
+		return node
+	}
+	redisSrv := newNode()
+	defer redisSrv.Close()
+	target := newNode()
+	defer target.Close()
+	// the key foo is being migrated to the target node
+	redisSrv.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "INCRBY" && args[0] == "foo" {
+			c.WriteError("MOVED 12182 " + target.Addr())
+			return true
+		}
+		return false
+	})
+
+	for _, failOnRedirect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("failOnRedirect=%v", failOnRedirect), func(t *testing.T) {
+			statsStore := stats.NewStore(stats.NewNullSink(), false)
+			clusterPolicy := redis.ClusterPolicy{TopologyRefreshInterval: -1, FailOnRedirect: failOnRedirect}
+			client := redis.NewClientImpl(statsStore, false, "", "tcp", "cluster", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, clusterPolicy)
+			defer client.Close()
+			assert.Equal(t, uint64(1), statsStore.NewGauge("cluster.nodes").Value())
+			assert.Equal(t, uint64(1), statsStore.NewCounter("cluster.topology_changes").Value())
+
+			var result uint64
+			err := client.DoCmd(&result, "INCRBY", "foo", 1)
+			if failOnRedirect {
+				assert.ErrorContains(t, err, "MOVED")
+				assert.Equal(t, uint64(0), statsStore.NewCounter("cluster.moved").Value())
+				assert.Equal(t, uint64(1), statsStore.NewCounter("cluster.redirect_errors").Value())
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(1), result)
+				assert.Equal(t, uint64(1), statsStore.NewCounter("cluster.moved").Value())
+				assert.Equal(t, uint64(0), statsStore.NewCounter("cluster.redirect_errors").Value())
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	retryPolicy := redis.RetryPolicy{MaxRetries: 2, BackoffMin: time.Millisecond, BackoffMax: 2 * time.Millisecond}
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, retryPolicy, redis.ClusterPolicy{})
+	defer client.Close()
+
+	var mu sync.Mutex
+	failures := map[string]int{}
+	resets := map[string]int{}
+	redisSrv.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if resets[cmd] > 0 {
+			resets[cmd]--
+			c.Close()
+			return true
+		}
+		if failures[cmd] > 0 {
+			failures[cmd]--
+			c.WriteError("LOADING Redis is loading the dataset in memory")
+			return true
+		}
+		return false
+	})
+	setFailures := func(cmd string, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures[cmd] = n
+	}
+	setResets := func(cmd string, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		resets[cmd] = n
+	}
+
+	t.Run("transient error is retried", func(t *testing.T) {
+		setFailures("INCRBY", 2)
+		var result uint64
+		assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &result, "INCRBY", "foo", 3)))
+		assert.Equal(t, uint64(3), result)
+		assert.Equal(t, uint64(2), statsStore.NewCounter("retries").Value())
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		setFailures("INCRBY", 3)
+		assert.Contains(t, client.DoCmd(nil, "INCRBY", "foo", 1).Error(), "LOADING")
+		assert.Equal(t, uint64(4), statsStore.NewCounter("retries").Value())
+		assert.Equal(t, uint64(1), statsStore.NewCounter("retries_exhausted").Value())
+	})
+
+	t.Run("other error is not retried", func(t *testing.T) {
+		assert.NotNil(t, client.DoCmd(nil, "HSET", "foo", "bar", "baz"))
+		assert.Equal(t, uint64(4), statsStore.NewCounter("retries").Value())
+	})
+
+	t.Run("increment failing on the connection is not retried", func(t *testing.T) {
+		setResets("INCRBY", 1)
+		var result uint64
+		assert.NotNil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &result, "INCRBY", "foo", 1)))
+		assert.Equal(t, uint64(4), statsStore.NewCounter("retries").Value())
+	})
+
+	t.Run("read failing on the connection is retried", func(t *testing.T) {
+		setResets("GET", 1)
+		var result uint64
+		assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &result, "GET", "foo")))
+		assert.Equal(t, uint64(3), result)
+		assert.Equal(t, uint64(5), statsStore.NewCounter("retries").Value())
+	})
+}
+
+func TestHedgedReads(t *testing.T) {
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	redisSrv.Set("foo", "5")
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	retryPolicy := redis.RetryPolicy{HedgeDelay: 10 * time.Millisecond}
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "single", redisSrv.Addr(), 2, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, retryPolicy, redis.ClusterPolicy{})
+	defer client.Close()
+
+	var gets atomic.Int32
+	redisSrv.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" && gets.Add(1) == 1 {
+			// the first read is slower than the hedge delay
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	})
+
+	// The hedged read may share the connection of the stuck read, so which one wins is not known.
+	var result uint64
+	assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &result, "GET", "foo")))
+	assert.Equal(t, uint64(5), result)
+	assert.Equal(t, uint64(1), statsStore.NewCounter("hedges").Value())
+
+	// writes are never hedged
+	assert.Nil(t, client.PipeDo(context.Background(), client.PipeAppend(nil, &result, "INCRBY", "foo", 1)))
+	assert.Equal(t, uint64(6), result)
+	assert.Equal(t, uint64(1), statsStore.NewCounter("hedges").Value())
+}
+
+func TestPoolStats(t *testing.T) {
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	client := redis.NewClientImpl(statsStore, false, "", "tcp", "single", redisSrv.Addr(), 2, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+
+	nodeScope := statsStore.Scope("node").Scope(strings.NewReplacer(".", "_", ":", "_").Replace(redisSrv.Addr()))
+	assert.Eventually(t, func() bool { return statsStore.NewGauge("cx_active").Value() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(2), nodeScope.NewGauge("cx_active").Value())
+	assert.Equal(t, uint64(1), nodeScope.NewGauge("healthy").Value())
+
+	assert.Nil(t, client.DoCmd(nil, "SET", "foo", "bar"))
+	assert.Equal(t, uint64(0), statsStore.NewGauge("rq_active").Value())
+	assert.Equal(t, uint64(0), statsStore.NewCounter("rq_timeout").Value())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, client.PipeDo(ctx, client.PipeAppend(nil, nil, "GET", "foo")))
+	assert.Equal(t, uint64(1), statsStore.NewCounter("rq_timeout").Value())
+
+	assert.Nil(t, client.Close())
+	assert.Equal(t, uint64(0), nodeScope.NewGauge("cx_active").Value())
+	assert.Equal(t, uint64(0), nodeScope.NewGauge("healthy").Value())
+}
@@ -3,7 +3,10 @@ package redis_test
 import (
 	"context"
 	"math/rand"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/envoyproxy/ratelimit/test/mocks/stats"
 
@@ -12,6 +15,7 @@ import (
 
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	gostats "github.com/lyft/gostats"
+	gostatsMock "github.com/lyft/gostats/mock"
 
 	"github.com/envoyproxy/ratelimit/src/config"
 	"github.com/envoyproxy/ratelimit/src/limiter"
@@ -41,6 +45,22 @@ func pipeAppend(pipeline redis.Pipeline, rcv interface{}, cmd, key string, args
 	})
 }
 
+func pipeAppendScript(pipeline redis.Pipeline, rcv interface{}, script, key string, args ...interface{}) redis.Pipeline {
+	return append(pipeline, redis.PipelineAction{
+		Action: radix.FlatCmd(rcv, "EVAL", append([]interface{}{script, 1, key}, args...)...),
+		Key:    key,
+	})
+}
+
+// expectReclaimHolds expects the expired holds of the keys taken over their limit to be read, none
+// of them being held.
+func expectReclaimHolds(client *mock_redis.MockClient, keys ...string) {
+	for _, key := range keys {
+		client.EXPECT().PipeAppendScript(gomock.Any(), gomock.Any(), gomock.Any(), key+"_holds", gomock.Any(), "").DoAndReturn(pipeAppendScript)
+	}
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+}
+
 func testRedis(usePerSecondRedis bool) func(*testing.T) {
 	return func(t *testing.T) {
 		assert := assert.New(t)
@@ -69,7 +89,7 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1234", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1234", int64(1)).DoAndReturn(pipeAppend)
-		clientUsed.EXPECT().PipeDo(gomock.Any()).Return(nil)
+		clientUsed.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
 		limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
@@ -83,11 +103,12 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		assert.Equal(uint64(1), limits[0].Stats.WithinLimit.Value())
 
 		clientUsed = client
-		timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
+		timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(4)
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key2_value2_subkey2_subvalue2_1200", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 			"EXPIRE", "domain_key2_value2_subkey2_subvalue2_1200", int64(60)).DoAndReturn(pipeAppend)
-		clientUsed.EXPECT().PipeDo(gomock.Any()).Return(nil)
+		clientUsed.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+		expectReclaimHolds(clientUsed, "domain_key2_value2_subkey2_subvalue2_1200")
 
 		request = common.NewRateLimitRequestWithPerDescriptorHitsAddend(
 			"domain",
@@ -111,14 +132,14 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		assert.Equal(uint64(0), limits[1].Stats.WithinLimit.Value())
 
 		clientUsed = client
-		timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(5)
-		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key3_value3_997200", uint64(0)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
-		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
-			"EXPIRE", "domain_key3_value3_997200", int64(3600)).DoAndReturn(pipeAppend)
+		timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(6)
+		// the descriptor with a hits addend of 0 only reads its counter
+		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key3_value3_997200").SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key3_value3_subkey3_subvalue3_950400", uint64(1)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 		clientUsed.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 			"EXPIRE", "domain_key3_value3_subkey3_subvalue3_950400", int64(86400)).DoAndReturn(pipeAppend)
-		clientUsed.EXPECT().PipeDo(gomock.Any()).Return(nil)
+		clientUsed.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+		expectReclaimHolds(clientUsed, "domain_key3_value3_subkey3_subvalue3_950400")
 
 		request = common.NewRateLimitRequestWithPerDescriptorHitsAddend(
 			"domain",
@@ -199,14 +220,14 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, localCache, 0.8, "", sm, false)
 
 	localCacheScopeName := "localcache"
-	localCacheStats := limiter.NewLocalCacheStats(localCache, statsStore.Scope(localCacheScopeName))
+	localCacheStats := limiter.NewLocalCacheStats(localCache, 100, statsStore.Scope(localCacheScopeName))
 
 	// Test Near Limit Stats. Under Near Limit Ratio
 	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
 
@@ -233,7 +254,7 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -250,11 +271,12 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	t.Run("TestLocalCacheStats_1", testLocalCacheStats(localCacheScopeName, localCacheStats, statsStore, sink, 0, 2, 2, 0, 0))
 
 	// Test Over limit stats
-	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(16)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key4_value4_997200")
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -288,6 +310,11 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 
 	// Check the local cache stats.
 	t.Run("TestLocalCacheStats_3", testLocalCacheStats(localCacheScopeName, localCacheStats, statsStore, sink, 1, 3, 4, 0, 1))
+
+	// The lookups count in the local cache stats of the domain.
+	assert.Equal(uint64(1), statsStore.NewCounter("domain.local_cache_hit").Value())
+	assert.Equal(uint64(3), statsStore.NewCounter("domain.local_cache_miss").Value())
+	assert.Equal(uint64(512*1024), statsStore.NewGauge(localCacheScopeName+".memoryBytes").Value())
 }
 
 func TestNearLimit(t *testing.T) {
@@ -306,7 +333,7 @@ func TestNearLimit(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
 
@@ -329,7 +356,7 @@ func TestNearLimit(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -343,11 +370,12 @@ func TestNearLimit(t *testing.T) {
 
 	// Test Near Limit Stats. We went OVER_LIMIT, but the near_limit counter only increases
 	// when we are near limit, not after we have passed the limit.
-	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(16)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key4_value4_997200")
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -364,7 +392,7 @@ func TestNearLimit(t *testing.T) {
 	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key5_value5_1234", uint64(3)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key5_value5_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key5", "value5"}}}, 3)
 	limits = []*config.RateLimit{config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key5_value5"), false, false, "", nil, false)}
@@ -381,7 +409,7 @@ func TestNearLimit(t *testing.T) {
 	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key6_value6_1234", uint64(2)).SetArg(1, uint64(7)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key6_value6_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key6", "value6"}}}, 2)
 	limits = []*config.RateLimit{config.NewRateLimit(8, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key6_value6"), false, false, "", nil, false)}
@@ -398,7 +426,7 @@ func TestNearLimit(t *testing.T) {
 	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key7_value7_1234", uint64(3)).SetArg(1, uint64(19)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key7_value7_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key7", "value7"}}}, 3)
 	limits = []*config.RateLimit{config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key7_value7"), false, false, "", nil, false)}
@@ -412,10 +440,11 @@ func TestNearLimit(t *testing.T) {
 	assert.Equal(uint64(3), limits[0].Stats.WithinLimit.Value())
 
 	// Some of it over limit, all of it over near limit
-	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key8_value8_1234", uint64(3)).SetArg(1, uint64(22)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key8_value8_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key8_value8_1234")
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key8", "value8"}}}, 3)
 	limits = []*config.RateLimit{config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key8_value8"), false, false, "", nil, false)}
@@ -429,10 +458,11 @@ func TestNearLimit(t *testing.T) {
 	assert.Equal(uint64(0), limits[0].Stats.WithinLimit.Value())
 
 	// Some of it in all three places
-	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key9_value9_1234", uint64(7)).SetArg(1, uint64(22)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key9_value9_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key9_value9_1234")
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key9", "value9"}}}, 7)
 	limits = []*config.RateLimit{config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key9_value9"), false, false, "", nil, false)}
@@ -446,10 +476,11 @@ func TestNearLimit(t *testing.T) {
 	assert.Equal(uint64(0), limits[0].Stats.WithinLimit.Value())
 
 	// all of it over limit
-	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key10_value10_1234", uint64(3)).SetArg(1, uint64(30)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key10_value10_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key10_value10_1234")
 
 	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key10", "value10"}}}, 3)
 	limits = []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key10_value10"), false, false, "", nil, false)}
@@ -479,7 +510,7 @@ func TestRedisWithJitter(t *testing.T) {
 	jitterSource.EXPECT().Int63().Return(int64(100))
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1234", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1234", int64(101)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
 	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
@@ -507,14 +538,14 @@ func TestOverLimitWithLocalCacheShadowRule(t *testing.T) {
 	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, localCache, 0.8, "", sm, false)
 
 	localCacheScopeName := "localcache"
-	localCacheStats := limiter.NewLocalCacheStats(localCache, statsStore.Scope(localCacheScopeName))
+	localCacheStats := limiter.NewLocalCacheStats(localCache, 100, statsStore.Scope(localCacheScopeName))
 
 	// Test Near Limit Stats. Under Near Limit Ratio
 	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
 
@@ -541,7 +572,7 @@ func TestOverLimitWithLocalCacheShadowRule(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -558,11 +589,12 @@ func TestOverLimitWithLocalCacheShadowRule(t *testing.T) {
 	t.Run("TestLocalCacheStats_1", testLocalCacheStats(localCacheScopeName, localCacheStats, statsStore, sink, 0, 2, 2, 0, 0))
 
 	// Test Over limit stats
-	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(3)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(4)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(16)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key4_value4_997200")
 
 	// The result should be OK since limit is in ShadowMode
 	assert.Equal(
@@ -624,7 +656,7 @@ func TestRedisTracer(t *testing.T) {
 
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1234", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1234", int64(1)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
 
 	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
 	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)}
@@ -650,7 +682,7 @@ func TestOverLimitWithStopCacheKeyIncrementWhenOverlimitConfig(t *testing.T) {
 	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, localCache, 0.8, "", sm, true)
 
 	localCacheScopeName := "localcache"
-	localCacheStats := limiter.NewLocalCacheStats(localCache, statsStore.Scope(localCacheScopeName))
+	localCacheStats := limiter.NewLocalCacheStats(localCache, 100, statsStore.Scope(localCacheScopeName))
 
 	// Test Near Limit Stats. Under Near Limit Ratio
 	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(5)
@@ -664,7 +696,7 @@ func TestOverLimitWithStopCacheKeyIncrementWhenOverlimitConfig(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key5_value5_997200", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key5_value5_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil).Times(2)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil).Times(2)
 
 	request := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain", [][][2]string{{{"key4", "value4"}}, {{"key5", "value5"}}}, []uint64{1, 1})
 
@@ -703,7 +735,7 @@ func TestOverLimitWithStopCacheKeyIncrementWhenOverlimitConfig(t *testing.T) {
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key5_value5_997200", uint64(2)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key5_value5_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil).Times(2)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil).Times(2)
 
 	request = common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain", [][][2]string{{{"key4", "value4"}}, {{"key5", "value5"}}}, []uint64{2, 2})
 
@@ -728,16 +760,15 @@ func TestOverLimitWithStopCacheKeyIncrementWhenOverlimitConfig(t *testing.T) {
 	t.Run("TestLocalCacheStats_1", testLocalCacheStats(localCacheScopeName, localCacheStats, statsStore, sink, 0, 4, 4, 0, 0))
 
 	// Test one key is reaching to the Overlimit threshold
-	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(5)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).MaxTimes(6)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key4_value4_997200").SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key5_value5_997200").SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(0)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
-		"EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
+	// the key which is not incremented is not read again
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key5_value5_997200", uint64(2)).SetArg(1, uint64(15)).DoAndReturn(pipeAppend)
 	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(),
 		"EXPIRE", "domain_key5_value5_997200", int64(3600)).DoAndReturn(pipeAppend)
-	client.EXPECT().PipeDo(gomock.Any()).Return(nil).Times(2)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	expectReclaimHolds(client, "domain_key5_value5_997200")
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
@@ -759,3 +790,941 @@ func TestOverLimitWithStopCacheKeyIncrementWhenOverlimitConfig(t *testing.T) {
 	// Check the local cache stats.
 	t.Run("TestLocalCacheStats_2", testLocalCacheStats(localCacheScopeName, localCacheStats, statsStore, sink, 0, 6, 6, 0, 1))
 }
+
+func TestStopCacheKeyIncrementWhenOverlimitCoalescesGets(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, true)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	// Only the first request reads the key, the concurrent request shares its result.
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key4_value4_997200").SetArg(1, uint64(5)).DoAndReturn(pipeAppend).Times(1)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(6)).DoAndReturn(pipeAppend).Times(2)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend).Times(2)
+
+	getStarted := make(chan struct{})
+	releaseGet := make(chan struct{})
+	gomock.InOrder(
+		client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, redis.Pipeline) error {
+			close(getStarted)
+			<-releaseGet
+			return nil
+		}),
+		client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil).Times(2),
+	)
+
+	limits := []*config.RateLimit{
+		config.NewRateLimit(15, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key4_value4"), false, false, "", nil, false),
+	}
+	doLimit := func(done chan<- []*pb.RateLimitResponse_DescriptorStatus) {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
+		done <- cache.DoLimit(context.Background(), request, limits)
+	}
+
+	leaderDone := make(chan []*pb.RateLimitResponse_DescriptorStatus, 1)
+	followerDone := make(chan []*pb.RateLimitResponse_DescriptorStatus, 1)
+	go doLimit(leaderDone)
+	<-getStarted
+	go doLimit(followerDone)
+	// Give the second request time to join the in-flight GET.
+	time.Sleep(50 * time.Millisecond)
+	close(releaseGet)
+
+	for _, done := range []chan []*pb.RateLimitResponse_DescriptorStatus{leaderDone, followerDone} {
+		statuses := <-done
+		assert.Equal(pb.RateLimitResponse_OK, statuses[0].Code)
+		assert.Equal(uint32(9), statuses[0].LimitRemaining)
+	}
+}
+
+func TestCoalescedGetReleasesFollowers(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, true)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key4_value4_997200").DoAndReturn(pipeAppend).AnyTimes()
+
+	getStarted := make(chan struct{})
+	releaseGet := make(chan struct{})
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, redis.Pipeline) error {
+		close(getStarted)
+		<-releaseGet
+		panic("pipeline failure")
+	})
+
+	limits := []*config.RateLimit{
+		config.NewRateLimit(15, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key4_value4"), false, false, "", nil, false),
+	}
+	doLimit := func(ctx context.Context, done chan<- interface{}) {
+		defer func() { done <- recover() }()
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
+		cache.DoLimit(ctx, request, limits)
+	}
+
+	leaderDone := make(chan interface{}, 1)
+	go doLimit(context.Background(), leaderDone)
+	<-getStarted
+
+	// A follower whose context is done stops waiting for the leader.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledDone := make(chan interface{}, 1)
+	go doLimit(ctx, cancelledDone)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case r := <-cancelledDone:
+		assert.Equal(redis.RedisError(context.Canceled.Error()), r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the follower still waits after its context is done")
+	}
+
+	// The followers of a leader which panics fail with its panic.
+	followerDone := make(chan interface{}, 1)
+	go doLimit(context.Background(), followerDone)
+	time.Sleep(50 * time.Millisecond)
+	close(releaseGet)
+	assert.Equal("pipeline failure", <-leaderDone)
+	select {
+	case r := <-followerDone:
+		assert.Equal(redis.RedisError("coalesced read failed: pipeline failure"), r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the follower still waits after the leader panicked")
+	}
+}
+
+type staticFlags map[string]bool
+
+func (this staticFlags) Enabled(feature string, domain string, defaultPercentage uint64) bool {
+	return this[domain+"."+feature]
+}
+
+func TestGetCoalescingFlag(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	// the coalescing is disabled for the domain
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, true, nil,
+		staticFlags{"other.redis.get_coalescing": true})
+
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	// Each request reads the key.
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key4_value4_997200").SetArg(1, uint64(5)).DoAndReturn(pipeAppend).Times(2)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(6)).DoAndReturn(pipeAppend).Times(2)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend).Times(2)
+
+	getStarted := make(chan struct{})
+	releaseGet := make(chan struct{})
+	var pipelines int32
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, redis.Pipeline) error {
+		if atomic.AddInt32(&pipelines, 1) == 1 {
+			close(getStarted)
+			<-releaseGet
+		}
+		return nil
+	}).Times(4)
+
+	limits := []*config.RateLimit{
+		config.NewRateLimit(15, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key4_value4"), false, false, "", nil, false),
+	}
+	doLimit := func(done chan<- []*pb.RateLimitResponse_DescriptorStatus) {
+		request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
+		done <- cache.DoLimit(context.Background(), request, limits)
+	}
+
+	firstDone := make(chan []*pb.RateLimitResponse_DescriptorStatus, 1)
+	secondDone := make(chan []*pb.RateLimitResponse_DescriptorStatus, 1)
+	go doLimit(firstDone)
+	<-getStarted
+	// The second request does not wait for the GET of the first one.
+	go doLimit(secondDone)
+	assert.Equal(uint32(9), (<-secondDone)[0].LimitRemaining)
+	close(releaseGet)
+	assert.Equal(uint32(9), (<-firstDone)[0].LimitRemaining)
+}
+
+func TestRedisUnitRouting(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	minuteClient := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	router := redis.NewClientRouter(client, nil)
+	router.AddUnitRoute(pb.RateLimitResponse_RateLimit_MINUTE, minuteClient)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(router, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	minuteClient.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1200", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
+	minuteClient.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1200", int64(60)).DoAndReturn(pipeAppend)
+	minuteClient.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key2_value2_0", uint64(1)).SetArg(1, uint64(11)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key2_value2_0", int64(3600)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	expectReclaimHolds(client, "domain_key2_value2_0")
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key2_value2"), false, false, "", nil, false),
+	}
+	statuses := cache.DoLimit(context.Background(), request, limits)
+	assert.Equal(pb.RateLimitResponse_OK, statuses[0].Code)
+	assert.Equal(uint32(5), statuses[0].LimitRemaining)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, statuses[1].Code)
+}
+
+func TestRedisBackendRouting(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	poolClient := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	router := redis.NewClientRouter(client, nil)
+	router.AddNamedPool("pool-a", poolClient)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(router, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	poolClient.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1200", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
+	poolClient.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1200", int64(60)).DoAndReturn(pipeAppend)
+	poolClient.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.Backend = "pool-a"
+	statuses := cache.DoLimit(context.Background(), request, []*config.RateLimit{limit})
+	assert.Equal(pb.RateLimitResponse_OK, statuses[0].Code)
+	assert.Equal(uint32(5), statuses[0].LimitRemaining)
+}
+
+func TestRedisGetCounters(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	client := redis.NewClientImpl(gostats.NewStore(gostats.NewNullSink(), false), false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0,
+		nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	redisSrv.Set("domain_key_value_1200", "7")
+
+	redisSrv.Set("domain_key4_value4_request", "2")
+	redisSrv.SetTTL("domain_key4_value4_request", 25*time.Second)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}, {{"key4", "value4"}}}, 1)
+	aligned := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key4_value4"), false, false, "", nil, false)
+	aligned.RequestAligned = true
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key2_value2"), false, false, "", nil, false),
+		nil,
+		aligned,
+	}
+	// the expiration of the counter of a request aligned limit is read along with it
+	assert.Equal([]limiter.CounterValue{
+		{Key: "domain_key_value_1200", Value: 7},
+		{Key: "domain_key2_value2_1200", Value: 0},
+		{},
+		{Key: "domain_key4_value4_request", Value: 2, Ttl: 25 * time.Second},
+	}, cache.(limiter.CounterReader).GetCounters(context.Background(), request, limits))
+
+	// Nothing is incremented.
+	value, _ := redisSrv.Get("domain_key_value_1200")
+	assert.Equal("7", value)
+	assert.False(redisSrv.Exists("domain_key2_value2_1200"))
+}
+
+func TestPenaltyBox(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+
+	limit := config.NewRateLimit(2, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.Penalty = &config.Penalty{OverLimits: 2, Window: time.Minute, Duration: 10 * time.Minute}
+	limits := []*config.RateLimit{limit}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	doLimit := func() *pb.RateLimitResponse_DescriptorStatus {
+		return cache.DoLimit(context.Background(), request, limits)[0]
+	}
+
+	assert.Equal(pb.RateLimitResponse_OK, doLimit().Code)
+	assert.Equal(pb.RateLimitResponse_OK, doLimit().Code)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, doLimit().Code)
+	assert.Equal(time.Minute, redisSrv.TTL("domain_key_value_penalty_over_limits"))
+	assert.False(redisSrv.Exists("domain_key_value_penalty"))
+	// the second over-limit within the window places the descriptor in the penalty box
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, doLimit().Code)
+	assert.Equal(10*time.Minute, redisSrv.TTL("domain_key_value_penalty"))
+	assert.False(redisSrv.Exists("domain_key_value_penalty_over_limits"))
+
+	// the ban outlasts the window of the limit and doesn't increment the counter
+	status := doLimit()
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.EqualValues(600, status.DurationUntilReset.Seconds)
+	counter, err := redisSrv.Get("domain_key_value_997200")
+	assert.NoError(err)
+	assert.Equal("4", counter)
+
+	penaltyBox := cache.(limiter.PenaltyBox)
+	penalties := penaltyBox.GetPenalties(context.Background(), request, limits)
+	assert.Equal("domain_key_value_penalty", penalties[0].Key)
+	assert.Equal(10*time.Minute, penalties[0].Remaining)
+	assert.Equal(penalties, penaltyBox.ClearPenalties(context.Background(), request, limits))
+	assert.Zero(penaltyBox.GetPenalties(context.Background(), request, limits)[0].Remaining)
+	assert.Equal([]limiter.PenaltyValue{{}}, penaltyBox.GetPenalties(context.Background(), request, []*config.RateLimit{nil}))
+
+	// the released descriptor is limited by its counter again
+	status = doLimit()
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	counter, _ = redisSrv.Get("domain_key_value_997200")
+	assert.Equal("5", counter)
+
+	assert.EqualValues(1, store.NewCounter("ratelimit.penalty_box.banned").Value())
+	assert.EqualValues(1, store.NewCounter("ratelimit.penalty_box.rejected").Value())
+	assert.EqualValues(1, store.NewCounter("ratelimit.penalty_box.released").Value())
+	assert.EqualValues(4, limit.Stats.OverLimit.Value())
+}
+
+func TestPenaltyBoxReadsBanWithIncrement(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	client := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).AnyTimes()
+	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false)
+
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.Penalty = &config.Penalty{OverLimits: 2, Window: time.Minute, Duration: 10 * time.Minute}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+
+	// the ban of a descriptor within its limit is read in the pipeline of its increment
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "PTTL", "domain_key_value_penalty").SetArg(1, int64(-2)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1234", uint64(1)).SetArg(1, uint64(5)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1234", int64(1)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, []*config.RateLimit{limit})[0].Code)
+
+	// the hits of a banned descriptor are given back
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "PTTL", "domain_key_value_penalty").SetArg(1, int64(90000)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key_value_1234", uint64(1)).SetArg(1, uint64(6)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key_value_1234", int64(1)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	client.EXPECT().PipeAppendScript(gomock.Any(), gomock.Any(), gomock.Any(), "domain_key_value_1234", uint64(1)).DoAndReturn(pipeAppendScript)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	status := cache.DoLimit(context.Background(), request, []*config.RateLimit{limit})[0]
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.EqualValues(90, status.DurationUntilReset.Seconds)
+}
+
+func TestLocalCacheNearLimitSkipsGets(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockClient(controller)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	sm := stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	cache := redis.NewFixedRateLimitCacheImpl(client, nil, timeSource, rand.New(rand.NewSource(1)), 0, freecache.NewCache(1024*1024), 0.8, "", sm, true)
+	cache.(limiter.LocalCachePolicySetter).SetLocalCachePolicy(limiter.LocalCachePolicy{MinTtl: time.Second, NearLimit: true})
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key4", "value4"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(15, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("key4_value4"), false, false, "", nil, false),
+	}
+
+	// the key is not known to be near the limit, it is incremented without being read
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil)
+	assert.Equal(uint32(2), cache.DoLimit(context.Background(), request, limits)[0].LimitRemaining)
+
+	// the near-the-limit key is read first
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "GET", "domain_key4_value4_997200").SetArg(1, uint64(13)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "INCRBY", "domain_key4_value4_997200", uint64(1)).SetArg(1, uint64(14)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), "EXPIRE", "domain_key4_value4_997200", int64(3600)).DoAndReturn(pipeAppend)
+	client.EXPECT().PipeDo(gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	assert.Equal(uint32(1), cache.DoLimit(context.Background(), request, limits)[0].LimitRemaining)
+}
+
+func TestRequestAlignedWindow(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000000)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 300, nil, 0.8, "", sm, false, nil, nil)
+
+	limit := config.NewRateLimit(2, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.RequestAligned = true
+	limits := []*config.RateLimit{limit}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+
+	// the window starts with the first request, without jitter
+	status := cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(60, status.DurationUntilReset.Seconds)
+	assert.Equal(time.Minute, redisSrv.TTL("domain_key_value_request"))
+
+	// the next requests don't extend it
+	redisSrv.FastForward(20 * time.Second)
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(40, status.DurationUntilReset.Seconds)
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.Equal(40*time.Second, redisSrv.TTL("domain_key_value_request"))
+
+	// the window ends with the key
+	redisSrv.FastForward(40 * time.Second)
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(1, status.LimitRemaining)
+
+	// a key left without expiration gets one
+	redisSrv.Set("domain_key_value_request", "2")
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.Equal(time.Minute, redisSrv.TTL("domain_key_value_request"))
+}
+
+// milliTimeSource is a time source with a millisecond precision, set by the tests.
+type milliTimeSource struct {
+	now atomic.Int64
+}
+
+func (this *milliTimeSource) UnixNow() int64 {
+	return this.now.Load() / 1000
+}
+
+func (this *milliTimeSource) UnixMilliNow() int64 {
+	return this.now.Load()
+}
+
+func TestLeakyBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := &milliTimeSource{}
+	timeSource.now.Store(1000000000)
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+
+	// a day to drain a hit, the bucket doesn't drain during the test
+	limit := config.NewRateLimit(1, pb.RateLimitResponse_RateLimit_DAY, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.LeakyBucket = &config.LeakyBucket{BucketSize: 2}
+	limits := []*config.RateLimit{limit}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+
+	status := cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(1, status.LimitRemaining)
+	assert.EqualValues(86400, status.DurationUntilReset.Seconds)
+	assert.True(redisSrv.Exists("domain_key_value_bucket"))
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(0, status.LimitRemaining)
+	assert.EqualValues(2*86400, status.DurationUntilReset.Seconds)
+	// the rejected hit fits once a hit drained
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, status.Code)
+	assert.EqualValues(86400, status.DurationUntilReset.Seconds)
+	assert.EqualValues(3, limit.Stats.TotalHits.Value())
+	assert.EqualValues(1, limit.Stats.OverLimit.Value())
+	assert.EqualValues(2, limit.Stats.WithinLimit.Value())
+	assert.EqualValues(1, limit.Stats.NearLimit.Value())
+
+	// the bucket drains continuously
+	limit = config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, sm.NewStats("key2_value2"), false, false, "", nil, false)
+	limit.LeakyBucket = &config.LeakyBucket{BucketSize: 1}
+	limits = []*config.RateLimit{limit}
+	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key2", "value2"}}}, 1)
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	timeSource.now.Add(50)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	timeSource.now.Add(50)
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, limits)[0].Code)
+
+	// the hits which are not added to the bucket, with another key over the limit, are not counted
+	// within the limit
+	cache = redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, true, nil, nil)
+	fixed := config.NewRateLimit(1, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key3_value3"), false, false, "", nil, false)
+	limit = config.NewRateLimit(1, pb.RateLimitResponse_RateLimit_DAY, sm.NewStats("key4_value4"), false, false, "", nil, false)
+	limit.LeakyBucket = &config.LeakyBucket{BucketSize: 2}
+	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key3", "value3"}}}, 1)
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, []*config.RateLimit{fixed})[0].Code)
+	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key3", "value3"}}, {{"key4", "value4"}}}, 1)
+	statuses := cache.DoLimit(context.Background(), request, []*config.RateLimit{fixed, limit})
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, statuses[0].Code)
+	assert.Equal(pb.RateLimitResponse_OK, statuses[1].Code)
+	assert.False(redisSrv.Exists("domain_key4_value4_bucket"))
+	assert.EqualValues(0, limit.Stats.WithinLimit.Value())
+}
+
+func TestConcurrencyLeases(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := &milliTimeSource{}
+	timeSource.now.Store(1000000000)
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+	concurrencyLimiter := cache.(limiter.ConcurrencyLimiter)
+
+	limit := config.NewRateLimit(0, pb.RateLimitResponse_RateLimit_UNKNOWN, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.Concurrency = &config.Concurrency{MaxInFlight: 2, LeaseTtl: time.Minute}
+	other := config.NewRateLimit(0, pb.RateLimitResponse_RateLimit_UNKNOWN, sm.NewStats("key2_value2"), false, false, "", nil, false)
+	other.Concurrency = &config.Concurrency{MaxInFlight: 5, LeaseTtl: time.Minute}
+	limits := []*config.RateLimit{limit, other, nil}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}}, 1)
+
+	leases := concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "a")
+	assert.Equal([]limiter.LeaseValue{
+		{Key: "domain_key_value_leases", Acquired: true, InFlight: 1},
+		{Key: "domain_key2_value2_leases", Acquired: true, InFlight: 1},
+		{},
+	}, leases)
+	assert.Equal(time.Minute, redisSrv.TTL("domain_key_value_leases"))
+	// a held lease is renewed
+	leases = concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "a")
+	assert.True(leases[0].Acquired)
+	assert.EqualValues(1, leases[0].InFlight)
+	leases = concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "b")
+	assert.True(leases[0].Acquired)
+	assert.EqualValues(2, leases[0].InFlight)
+
+	// the lease is held on no descriptor if one is at its maximum
+	leases = concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "c")
+	assert.Equal([]limiter.LeaseValue{
+		{Key: "domain_key_value_leases", Acquired: false, InFlight: 2},
+		{Key: "domain_key2_value2_leases", Acquired: false, InFlight: 2},
+		{},
+	}, leases)
+	members, err := redisSrv.ZMembers("domain_key2_value2_leases")
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, members)
+	assert.EqualValues(4, limit.Stats.TotalHits.Value())
+	assert.EqualValues(1, limit.Stats.OverLimit.Value())
+	assert.EqualValues(3, limit.Stats.WithinLimit.Value())
+
+	// a released lease frees its place
+	leases = concurrencyLimiter.ReleaseLeases(context.Background(), request, limits, "a")
+	assert.EqualValues(1, leases[0].InFlight)
+	assert.EqualValues(1, leases[1].InFlight)
+	assert.True(concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "c")[0].Acquired)
+
+	// the leases expire with the time of the time source
+	redisSrv.ZAdd("domain_key_value_leases", float64(timeSource.now.Load()+1000), "expiring")
+	leases = concurrencyLimiter.ReleaseLeases(context.Background(), request, limits, "c")
+	assert.EqualValues(2, leases[0].InFlight)
+	timeSource.now.Add(1000)
+	leases = concurrencyLimiter.ReleaseLeases(context.Background(), request, limits, "b")
+	assert.EqualValues(0, leases[0].InFlight)
+
+	// in shadow mode the requests over the maximum are admitted without holding a lease
+	limit.ShadowMode = true
+	limit.Concurrency.MaxInFlight = 1
+	assert.True(concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "a")[0].Acquired)
+	leases = concurrencyLimiter.AcquireLeases(context.Background(), request, limits, "b")
+	assert.Equal(limiter.LeaseValue{Key: "domain_key_value_leases", Acquired: true, InFlight: 1}, leases[0])
+	members, err = redisSrv.ZMembers("domain_key_value_leases")
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, members)
+	assert.EqualValues(1, limit.Stats.ShadowMode.Value())
+}
+
+func TestCarryOver(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000020)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+	limit.CarryOverPercent = 20
+	limits := []*config.RateLimit{limit}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+
+	gets := func() uint64 {
+		return store.NewCounterWithTags("get", map[string]string{"code": "success"}).Value() +
+			store.NewCounterWithTags("get", map[string]string{"code": "miss"}).Value()
+	}
+
+	// the counters within the limit are admitted without reading the previous window
+	redisSrv.Set("domain_key_value_999960", "9")
+	redisSrv.Set("domain_key_value_1000020", "8")
+	status := cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(1, status.LimitRemaining)
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	assert.EqualValues(0, gets())
+
+	// 9 of the 10 requests of the previous window were used, 1 is carried over
+	assert.Equal(pb.RateLimitResponse_OK, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	assert.EqualValues(2, gets())
+	// the counters past the largest credit are rejected without reading the previous window
+	assert.Equal(pb.RateLimitResponse_OVER_LIMIT, cache.DoLimit(context.Background(), request, limits)[0].Code)
+	assert.EqualValues(2, gets())
+	// the counter lives through the next window
+	assert.Equal(120*time.Second, redisSrv.TTL("domain_key_value_1000020"))
+
+	// the credit is bounded by the percentage
+	redisSrv.Del("domain_key_value_999960")
+	redisSrv.Set("domain_key_value_1000020", "11")
+	status = cache.DoLimit(context.Background(), request, limits)[0]
+	assert.Equal(pb.RateLimitResponse_OK, status.Code)
+	assert.EqualValues(0, status.LimitRemaining)
+}
+
+func TestTimingStats(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	sink := gostatsMock.NewSink()
+	store := gostats.NewStore(sink, false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000020)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, true, nil, nil)
+
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)}
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	redisSrv.Set("domain_key_value_1000020", "9")
+	cache.DoLimit(context.Background(), request, limits)
+
+	// each phase of the request is timed once, no read was shared with another request
+	for _, phase := range []string{"cache_keys", "local_cache", "backend_precheck", "backend_increment"} {
+		sink.AssertTimerCallCount(t, "call.should_rate_limit."+phase+"_latency", 1)
+	}
+	sink.AssertTimerNotExists(t, "call.should_rate_limit.hot_key_wait_latency")
+
+	// the precheck is not timed when the backend isn't read before the increment
+	sink = gostatsMock.NewSink()
+	store = gostats.NewStore(sink, false)
+	sm = stats.NewMockStatManager(store)
+	cache = redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+	limits = []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)}
+	cache.DoLimit(context.Background(), request, limits)
+	sink.AssertTimerCallCount(t, "call.should_rate_limit.backend_increment_latency", 1)
+	sink.AssertTimerNotExists(t, "call.should_rate_limit.backend_precheck_latency")
+}
+
+func TestQueryOnly(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000020)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+
+	for _, stopIncrement := range []bool{false, true} {
+		redisSrv.FlushAll()
+		cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, stopIncrement, nil, nil)
+		fixed := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false)
+		aligned := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key2_value2"), false, false, "", nil, false)
+		aligned.RequestAligned = true
+		limits := []*config.RateLimit{fixed, aligned}
+		query := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+			[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, []uint64{0, 0})
+
+		// the keys are neither created nor extended by a query, the request aligned window is whole
+		statuses := cache.DoLimit(context.Background(), query, limits)
+		assert.EqualValues(10, statuses[0].LimitRemaining)
+		assert.EqualValues(60, statuses[0].DurationUntilReset.Seconds)
+		assert.EqualValues(10, statuses[1].LimitRemaining)
+		assert.EqualValues(60, statuses[1].DurationUntilReset.Seconds)
+		assert.Empty(redisSrv.Keys())
+
+		// the query reads the counters and the window of the hits
+		hits := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+			[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, []uint64{3, 3})
+		cache.DoLimit(context.Background(), hits, limits)
+		keys := redisSrv.Keys()
+		redisSrv.FastForward(15 * time.Second)
+		statuses = cache.DoLimit(context.Background(), query, limits)
+		assert.EqualValues(7, statuses[0].LimitRemaining)
+		assert.EqualValues(7, statuses[1].LimitRemaining)
+		assert.EqualValues(45, statuses[1].DurationUntilReset.Seconds)
+		assert.Equal(keys, redisSrv.Keys())
+		value, _ := redisSrv.Get("domain_key_value_1000020")
+		assert.Equal("3", value)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000020)).AnyTimes()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+	refunder := cache.(limiter.Refunder)
+
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key2_value2"), false, false, "", nil, false),
+		nil,
+	}
+	request := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+		[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}}, []uint64{5, 0, 1})
+	cache.DoLimit(context.Background(), request, limits)
+	redisSrv.FastForward(10 * time.Second)
+
+	// the refund keeps the expiration of the counter and a missing counter is not created
+	refund := common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+		[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}}, []uint64{2, 1, 1})
+	refunds := refunder.RefundHits(context.Background(), refund, limits, 1000020)
+	assert.Equal(limiter.RefundValue{Key: "domain_key_value_1000020", Value: 3, Refunded: 2}, refunds[0])
+	assert.Equal(limiter.RefundValue{Key: "domain_key2_value2_1000020"}, refunds[1])
+	assert.Equal(limiter.RefundValue{}, refunds[2])
+	value, err := redisSrv.Get("domain_key_value_1000020")
+	assert.NoError(err)
+	assert.Equal("3", value)
+	assert.Equal(50*time.Second, redisSrv.TTL("domain_key_value_1000020"))
+	assert.False(redisSrv.Exists("domain_key2_value2_1000020"))
+
+	// the counter is clamped at zero
+	refund = common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+		[][][2]string{{{"key", "value"}}}, []uint64{5})
+	refunds = refunder.RefundHits(context.Background(), refund, limits[:1], 1000020)
+	assert.Equal(limiter.RefundValue{Key: "domain_key_value_1000020", Value: 0, Refunded: 3}, refunds[0])
+
+	// the hits counted in the previous window are refunded to it
+	refunds = refunder.RefundHits(context.Background(), refund, limits[:1], 1000019)
+	assert.Equal(limiter.RefundValue{Key: "domain_key_value_999960"}, refunds[0])
+	assert.False(redisSrv.Exists("domain_key_value_999960"))
+
+	assert.EqualValues(4, store.NewCounter("ratelimit.refund.refunds").Value())
+	assert.EqualValues(5, store.NewCounter("ratelimit.refund.refunded_hits").Value())
+	assert.EqualValues(3, store.NewCounter("ratelimit.refund.clamped").Value())
+}
+
+func TestReservations(t *testing.T) {
+	assert := assert.New(t)
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := &milliTimeSource{}
+	timeSource.now.Store(1000020000)
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+	reserver := cache.(limiter.Reserver)
+
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key_value"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("key2_value2"), false, false, "", nil, false),
+	}
+	newRequest := func(hits ...uint64) *pb.RateLimitRequest {
+		return common.NewRateLimitRequestWithPerDescriptorHitsAddend("domain",
+			[][][2]string{{{"key", "value"}}, {{"key2", "value2"}}}, hits)
+	}
+	counter := func(key string) string {
+		value, _ := redisSrv.Get(key)
+		return value
+	}
+
+	// the hits are counted while held
+	id, holds := reserver.Reserve(context.Background(), newRequest(6, 6), limits, time.Minute)
+	reservedAt, err := limiter.ReservationTime(id)
+	assert.NoError(err)
+	assert.EqualValues(1000020, reservedAt)
+	assert.Equal([]limiter.ReservationValue{
+		{Key: "domain_key_value_1000020", Held: true, Value: 6},
+		{Key: "domain_key2_value2_1000020", Held: true, Value: 6},
+	}, holds)
+	assert.EqualValues(1, store.NewCounter("ratelimit.reservation.reserved").Value())
+
+	// a reservation is held on every descriptor or on none
+	_, holds = reserver.Reserve(context.Background(), newRequest(3, 5), limits, time.Minute)
+	assert.Equal([]limiter.ReservationValue{
+		{Key: "domain_key_value_1000020", Value: 6},
+		{Key: "domain_key2_value2_1000020", Value: 6},
+	}, holds)
+	assert.EqualValues(1, store.NewCounter("ratelimit.reservation.rejected").Value())
+	assert.EqualValues(5, limits[1].Stats.OverLimit.Value())
+
+	// the committed hits stay counted
+	holds = reserver.CommitReservation(context.Background(), newRequest(6, 6), limits, id)
+	assert.True(holds[0].Held)
+	assert.True(holds[1].Held)
+	assert.Equal("6", counter("domain_key_value_1000020"))
+	assert.EqualValues(1, store.NewCounter("ratelimit.reservation.committed").Value())
+
+	// the cancelled hits are given back
+	id, _ = reserver.Reserve(context.Background(), newRequest(2, 2), limits, time.Minute)
+	assert.Equal("8", counter("domain_key_value_1000020"))
+	holds = reserver.CancelReservation(context.Background(), newRequest(2, 2), limits, id)
+	assert.Equal([]limiter.ReservationValue{
+		{Key: "domain_key_value_1000020", Held: true, Value: 6},
+		{Key: "domain_key2_value2_1000020", Held: true, Value: 6},
+	}, holds)
+	assert.EqualValues(1, store.NewCounter("ratelimit.reservation.cancelled").Value())
+
+	// the hits of an expired hold are given back and the hold can't be committed
+	id, _ = reserver.Reserve(context.Background(), newRequest(4, 4), limits, time.Millisecond)
+	assert.Equal("10", counter("domain_key_value_1000020"))
+	timeSource.now.Add(10)
+	holds = reserver.CommitReservation(context.Background(), newRequest(4, 4), limits, id)
+	assert.Equal([]limiter.ReservationValue{
+		{Key: "domain_key_value_1000020", Value: 6},
+		{Key: "domain_key2_value2_1000020", Value: 6},
+	}, holds)
+	assert.EqualValues(1, store.NewCounter("ratelimit.reservation.expired").Value())
+
+	// the expired holds are given back by the next reservation on the counter
+	reserver.Reserve(context.Background(), newRequest(4, 4), limits, time.Millisecond)
+	timeSource.now.Add(10)
+	id, holds = reserver.Reserve(context.Background(), newRequest(4, 4), limits, time.Minute)
+	assert.True(holds[0].Held)
+	assert.EqualValues(10, holds[0].Value)
+
+	// and by the requests taking the counter over its limit
+	reserver.CancelReservation(context.Background(), newRequest(4, 4), limits, id)
+	reserver.Reserve(context.Background(), newRequest(4, 4), limits, time.Millisecond)
+	timeSource.now.Add(10)
+	statuses := cache.DoLimit(context.Background(), newRequest(1, 1), limits)
+	assert.Equal(pb.RateLimitResponse_OK, statuses[0].Code)
+	assert.EqualValues(3, statuses[0].LimitRemaining)
+	assert.Equal("7", counter("domain_key_value_1000020"))
+
+	assert.PanicsWithValue(limiter.ErrInvalidReservationId, func() {
+		reserver.CommitReservation(context.Background(), newRequest(4, 4), limits, "invalid")
+	})
+}
+
+func TestScanCounters(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	redisSrv := mustNewRedisServer()
+	defer redisSrv.Close()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), timeSource, rand.New(rand.NewSource(1)), 0, nil, 0.8, "prefix:", sm, false, nil, nil)
+	counterScanner := cache.(limiter.CounterScanner)
+
+	redisSrv.Set("prefix:domain_user_a_1000020", "3")
+	redisSrv.SetTTL("prefix:domain_user_a_1000020", 40*time.Second)
+	redisSrv.Set("prefix:domain_user_b_request", "2")
+	redisSrv.SetTTL("prefix:domain_user_b_request", 10*time.Second)
+	redisSrv.Set("prefix:domain_user_a_penalty", "1")
+	redisSrv.ZAdd("prefix:domain_user_c_leases", 1, "lease")
+	redisSrv.Set("prefix:domain_path_x_1000020", "1")
+	redisSrv.Set("prefix:other_user_a_1000020", "1")
+
+	counters := counterScanner.ScanCounters(context.Background(), "domain", "user_", 10, 10)
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Key < counters[j].Key })
+	assert.Equal([]limiter.UsageValue{
+		{Key: "prefix:domain_user_a_1000020", Value: 3, Ttl: 40 * time.Second},
+		{Key: "prefix:domain_user_b_request", Value: 2, Ttl: 10 * time.Second},
+	}, counters)
+	assert.Len(counterScanner.ScanCounters(context.Background(), "domain", "", 10, 10), 3)
+	assert.Len(counterScanner.ScanCounters(context.Background(), "domain", "", 1, 10), 1)
+	// the prefix is not a pattern
+	assert.Empty(counterScanner.ScanCounters(context.Background(), "domain", "*", 10, 10))
+	// no key is scanned without a budget
+	assert.Empty(counterScanner.ScanCounters(context.Background(), "domain", "", 10, 0))
+}
+
+func TestProbeBackend(t *testing.T) {
+	assert := assert.New(t)
+	redisSrv := mustNewRedisServer()
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	client := redis.NewClientImpl(store, false, "", "tcp", "single", redisSrv.Addr(), 1, 0, 0, nil, false, nil, 10*time.Second, "", "", nil, redis.RetryPolicy{}, redis.ClusterPolicy{})
+	defer client.Close()
+	sm := stats.NewMockStatManager(store)
+	cache := redis.NewFixedRateLimitCacheImplWithRouter(redis.NewClientRouter(client, nil), utils.NewTimeSourceImpl(), rand.New(rand.NewSource(1)), 0, nil, 0.8, "", sm, false, nil, nil)
+	prober := cache.(limiter.BackendProber)
+
+	assert.NoError(prober.ProbeBackend())
+	redisSrv.Close()
+	assert.Error(prober.ProbeBackend())
+}
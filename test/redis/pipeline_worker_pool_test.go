@@ -0,0 +1,55 @@
+package redis_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/redis"
+)
+
+func TestPipelineWorkerPoolBoundsConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	pool := redis.NewPipelineWorkerPool(statsStore, 3, 100)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	wg.Add(30)
+	for i := 0; i < 30; i++ {
+		pool.Submit(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(maxRunning, int32(3))
+	assert.Equal(uint64(30), statsStore.NewCounter("tasks").Value())
+	assert.Equal(uint64(0), statsStore.NewGauge("queue_depth").Value())
+	assert.Nil(pool.Close())
+	assert.Equal(uint64(0), statsStore.NewGauge("active_workers").Value())
+}
+
+func TestPipelineWorkerPoolCloseDrainsQueue(t *testing.T) {
+	pool := redis.NewPipelineWorkerPool(stats.NewStore(stats.NewNullSink(), false), 1, 10)
+
+	var executed int32
+	for i := 0; i < 10; i++ {
+		pool.Submit(func() { atomic.AddInt32(&executed, 1) })
+	}
+	pool.Close()
+	assert.Equal(t, int32(10), atomic.LoadInt32(&executed))
+}
@@ -0,0 +1,288 @@
+package runner_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coocood/freecache"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/service_cmd/runner"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_limiter "github.com/envoyproxy/ratelimit/test/mocks/limiter"
+)
+
+const testConfig = `
+domain: test
+descriptors:
+  - key: key
+    rate_limit:
+      unit: minute
+      requests_per_unit: 10
+`
+
+// staticProvider sends a single configuration, as an embedding application would.
+type staticProvider struct {
+	events chan provider.ConfigUpdateEvent
+}
+
+type staticEvent struct {
+	config config.RateLimitConfig
+}
+
+func (e *staticEvent) GetConfig() (config.RateLimitConfig, any) {
+	return e.config, nil
+}
+
+func newStaticProvider(s settings.Settings, statsManager stats.Manager, rootStore gostats.Store) (provider.RateLimitConfigProvider, error) {
+	p := &staticProvider{events: make(chan provider.ConfigUpdateEvent, 1)}
+	configYaml := config.ConfigFileContentToYaml("test.yaml", testConfig)
+	p.events <- &staticEvent{config: config.NewRateLimitConfigImpl(
+		[]config.RateLimitConfigToLoad{{Name: "test.yaml", ConfigYaml: configYaml}}, statsManager, false)}
+	return p, nil
+}
+
+func (p *staticProvider) ConfigUpdateEvent() <-chan provider.ConfigUpdateEvent {
+	return p.events
+}
+
+func (p *staticProvider) Stop() {}
+
+func newTestSettings() settings.Settings {
+	s := settings.NewSettings()
+	s.Host = "127.0.0.1"
+	s.Port = 18281
+	s.GrpcHost = "127.0.0.1"
+	s.GrpcPort = 18282
+	s.DebugHost = "127.0.0.1"
+	s.DebugPort = 18283
+	return s
+}
+
+func TestRunnerStartShutdown(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+	sink := common.NewTestStatSink()
+
+	s := newTestSettings()
+	r := runner.NewRunner(s,
+		runner.WithStatsSink(sink),
+		runner.WithConfigProvider(newStaticProvider),
+		runner.WithRateLimitCache(func(settings.Settings, server.Server, *freecache.Cache, stats.Manager) (limiter.RateLimitCache, io.Closer, error) {
+			return cache, nil, nil
+		}))
+	assert.NoError(r.Start(context.Background()))
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the runner is not ready")
+	}
+	ready, err := http.Get("http://127.0.0.1:18281/ready")
+	assert.NoError(err)
+	ready.Body.Close()
+	assert.Equal(http.StatusOK, ready.StatusCode)
+
+	status := &pb.RateLimitResponse_DescriptorStatus{Code: pb.RateLimitResponse_OK, LimitRemaining: 9}
+	cache.EXPECT().DoLimit(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*pb.RateLimitResponse_DescriptorStatus{status})
+
+	conn, err := grpc.Dial("127.0.0.1:18282", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(err)
+	defer conn.Close()
+	response, err := pb.NewRateLimitServiceClient(conn).ShouldRateLimit(context.Background(),
+		common.NewRateLimitRequest("test", [][][2]string{{{"key", "value"}}}, 1))
+	assert.NoError(err)
+	assert.Equal(pb.RateLimitResponse_OK, response.OverallCode)
+
+	r.GetStatsStore().Flush()
+	assert.EqualValues(1, sink.Record["ratelimit.service.config_load_success"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(r.Shutdown(ctx))
+}
+
+func TestRunnerShutdownStopsReloader(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+
+	s := newTestSettings()
+	s.SettingsReloadFile = filepath.Join(t.TempDir(), "tunables")
+	s.SettingsReloadInterval = time.Millisecond
+	assert.NoError(os.WriteFile(s.SettingsReloadFile, []byte("NEAR_LIMIT_RATIO=0.5\n"), 0o644))
+	r := runner.NewRunner(s,
+		runner.WithStatsSink(gostats.NewNullSink()),
+		runner.WithConfigProvider(newStaticProvider),
+		runner.WithRateLimitCache(func(settings.Settings, server.Server, *freecache.Cache, stats.Manager) (limiter.RateLimitCache, io.Closer, error) {
+			return cache, nil, nil
+		}))
+	assert.NoError(r.Start(context.Background()))
+	applied := r.GetStatsStore().NewCounter("ratelimit.settings_reload.applied")
+	assert.EqualValues(1, applied.Value())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(r.Shutdown(ctx))
+
+	// the file is no longer polled once the runner is shut down
+	assert.NoError(os.WriteFile(s.SettingsReloadFile, []byte("NEAR_LIMIT_RATIO=0.6\n"), 0o644))
+	time.Sleep(20 * time.Millisecond)
+	assert.EqualValues(1, applied.Value())
+}
+
+func TestRunnerStartError(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestSettings()
+	s.BackendType = "unknown"
+	r := runner.NewRunner(s, runner.WithStatsSink(gostats.NewNullSink()), runner.WithConfigProvider(newStaticProvider))
+	assert.EqualError(r.Start(context.Background()), "invalid setting for BackendType: unknown")
+}
+
+func TestRunnerInvalidSettings(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(s *settings.Settings)
+		err    string
+	}{
+		{
+			name: "canary failure threshold",
+			modify: func(s *settings.Settings) {
+				s.CanaryEnabled = true
+				s.CanaryFailureThreshold = 0
+			},
+			err: "CANARY_FAILURE_THRESHOLD must be at least 1, got 0",
+		},
+		{
+			name:   "cache key hash",
+			modify: func(s *settings.Settings) { s.CacheKeyHash = "md5" },
+			err:    "CACHE_KEY_HASH must be one of none, xxhash or sha256, got md5",
+		},
+		{
+			name:   "limit scale factor",
+			modify: func(s *settings.Settings) { s.LimitScaleFactor = math.NaN() },
+			err:    "LIMIT_SCALE_FACTOR must be positive and finite, got NaN",
+		},
+		{
+			name: "trace sampler",
+			modify: func(s *settings.Settings) {
+				s.TracingEnabled = true
+				s.TracingSampler = "sometimes"
+			},
+			err: "invalid trace sampler: sometimes",
+		},
+		{
+			name: "profiling cpu duration",
+			modify: func(s *settings.Settings) {
+				s.ProfilingPushUrl = "http://127.0.0.1:1/ingest"
+				s.ProfilingPushInterval = time.Second
+				s.ProfilingCpuDuration = time.Second
+			},
+			err: "invalid PROFILING_CPU_DURATION 1s, must be positive and less than PROFILING_PUSH_INTERVAL",
+		},
+		{
+			name: "feature flags directory",
+			modify: func(s *settings.Settings) {
+				s.RuntimePath = "/nonexistent"
+				s.RuntimeWatchRoot = false
+				s.FeatureFlagsDirectory = "flags"
+			},
+			err: "invalid FEATURE_FLAGS_DIRECTORY: unable to watch file (/nonexistent/flags): no such file or directory (syscall.Errno 0x2)",
+		},
+		{
+			name: "ext_authz domain",
+			modify: func(s *settings.Settings) {
+				s.ExtAuthzEnabled = true
+				s.ExtAuthzDescriptors = "remote_address=source.address"
+			},
+			err: "EXT_AUTHZ_DOMAIN must not be empty with EXT_AUTHZ_ENABLED",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			controller := gomock.NewController(t)
+			defer controller.Finish()
+			cache := mock_limiter.NewMockRateLimitCache(controller)
+
+			s := newTestSettings()
+			c.modify(&s)
+			r := runner.NewRunner(s,
+				runner.WithStatsSink(gostats.NewNullSink()),
+				runner.WithConfigProvider(newStaticProvider),
+				runner.WithRateLimitCache(func(settings.Settings, server.Server, *freecache.Cache, stats.Manager) (limiter.RateLimitCache, io.Closer, error) {
+					return cache, nil, nil
+				}))
+			assert.EqualError(t, r.Start(context.Background()), c.err)
+		})
+	}
+}
+
+func TestRunnerExtAuthzDomainBeforeBackend(t *testing.T) {
+	s := newTestSettings()
+	s.ExtAuthzEnabled = true
+	created := false
+	r := runner.NewRunner(s,
+		runner.WithStatsSink(gostats.NewNullSink()),
+		runner.WithConfigProvider(newStaticProvider),
+		runner.WithRateLimitCache(func(settings.Settings, server.Server, *freecache.Cache, stats.Manager) (limiter.RateLimitCache, io.Closer, error) {
+			created = true
+			return nil, nil, errors.New("unexpected backend")
+		}))
+	assert.EqualError(t, r.Start(context.Background()), "EXT_AUTHZ_DOMAIN must not be empty with EXT_AUTHZ_ENABLED")
+	assert.False(t, created)
+}
+
+func TestRunnerRegisteredBackend(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	cache := mock_limiter.NewMockRateLimitCache(controller)
+
+	var created settings.Settings
+	runner.RegisterBackend("test_backend", func(s settings.Settings, srv server.Server, localCache *freecache.Cache,
+		statsManager stats.Manager,
+	) (limiter.RateLimitCache, io.Closer, error) {
+		created = s
+		return cache, nil, nil
+	})
+	assert.Equal([]string{"memcache", "redis", "test_backend"}, runner.Backends())
+	assert.Panics(func() { runner.RegisterBackend("redis", nil) })
+	assert.Panics(func() {
+		runner.RegisterBackend("test_backend", func(settings.Settings, server.Server, *freecache.Cache,
+			stats.Manager,
+		) (limiter.RateLimitCache, io.Closer, error) {
+			return nil, nil, nil
+		})
+	})
+
+	s := newTestSettings()
+	s.BackendType = "test_backend"
+	r := runner.NewRunner(s, runner.WithStatsSink(gostats.NewNullSink()), runner.WithConfigProvider(newStaticProvider))
+	assert.NoError(r.Start(context.Background()))
+	assert.Equal("test_backend", created.BackendType)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(r.Shutdown(ctx))
+}
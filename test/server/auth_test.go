@@ -0,0 +1,310 @@
+package server_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_utils "github.com/envoyproxy/ratelimit/test/mocks/utils"
+)
+
+const authTestNow = 1700000000
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJwks(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa", "kty": "RSA", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec", "kty": "EC", "crv": "P-256",
+				"x": base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	}
+	data, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func TestJwtVerifier(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(authTestNow)).AnyTimes()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	verifier := server.NewJwtVerifier("https://issuer", "ratelimit", "sub", writeJwks(t, rsaKey, ecKey), time.Minute, timeSource)
+
+	valid := map[string]interface{}{"iss": "https://issuer", "aud": []string{"other", "ratelimit"}, "sub": "tool", "exp": authTestNow + 60}
+	caller, err := verifier.Verify(signRS256(rsaKey, "rsa", valid))
+	assert.NoError(err)
+	assert.Equal("tool", caller)
+	caller, err = verifier.Verify(signES256(ecKey, "ec", valid))
+	assert.NoError(err)
+	assert.Equal("tool", caller)
+
+	expired := map[string]interface{}{"iss": "https://issuer", "aud": "ratelimit", "sub": "tool", "exp": authTestNow}
+	_, err = verifier.Verify(signRS256(rsaKey, "rsa", expired))
+	assert.EqualError(err, "the token is expired")
+
+	otherAudience := map[string]interface{}{"iss": "https://issuer", "aud": "other", "sub": "tool", "exp": authTestNow + 60}
+	_, err = verifier.Verify(signRS256(rsaKey, "rsa", otherAudience))
+	assert.EqualError(err, "the token is not for this audience")
+
+	otherIssuer := map[string]interface{}{"iss": "https://other", "aud": "ratelimit", "sub": "tool", "exp": authTestNow + 60}
+	_, err = verifier.Verify(signRS256(rsaKey, "rsa", otherIssuer))
+	assert.EqualError(err, "unexpected token issuer 'https://other'")
+
+	// signed by another key
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = verifier.Verify(signRS256(otherKey, "rsa", valid))
+	assert.EqualError(err, "invalid token signature")
+	_, err = verifier.Verify(signRS256(otherKey, "unknown", valid))
+	assert.EqualError(err, "unknown token key 'unknown'")
+
+	// the algorithm of a token must match its key
+	forged := encodeSegment(map[string]string{"alg": "ES384", "kid": "ec"}) + "." + encodeSegment(valid) + "." +
+		base64.RawURLEncoding.EncodeToString(make([]byte, 96))
+	_, err = verifier.Verify(forged)
+	assert.EqualError(err, "the algorithm 'ES384' does not match the P-256 key")
+}
+
+func TestJwtVerifierKeyAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(authTestNow)).AnyTimes()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": "rsa", "kty": "RSA", "alg": "RS384",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+	}
+	data, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(os.WriteFile(path, data, 0o600))
+	verifier := server.NewJwtVerifier("", "", "sub", path, time.Minute, timeSource)
+
+	_, err := verifier.Verify(signRS256(rsaKey, "rsa", map[string]interface{}{"sub": "tool", "exp": authTestNow + 60}))
+	assert.EqualError(err, "the algorithm 'RS256' does not match the 'RS384' key")
+}
+
+func TestJwtVerifierFetches(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	now := int64(authTestNow)
+	timeSource.EXPECT().UnixNow().DoAndReturn(func() int64 { return atomic.LoadInt64(&now) }).AnyTimes()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, err := os.ReadFile(writeJwks(t, rsaKey, ecKey))
+	assert.NoError(err)
+	var fetches atomic.Int32
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		writer.Write(jwks)
+	}))
+	defer jwksServer.Close()
+	verifier := server.NewJwtVerifier("", "", "sub", jwksServer.URL, time.Minute, timeSource)
+
+	// the concurrent verifications share one fetch
+	token := signRS256(rsaKey, "rsa", map[string]interface{}{"sub": "tool", "exp": authTestNow + 60})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(token)
+			assert.NoError(err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(1, fetches.Load())
+
+	// the unknown keys are fetched at most once per second
+	unknown := signRS256(rsaKey, "unknown", map[string]interface{}{"sub": "tool", "exp": authTestNow + 60})
+	for i := 0; i < 3; i++ {
+		_, err = verifier.Verify(unknown)
+		assert.EqualError(err, "unknown token key 'unknown'")
+	}
+	assert.EqualValues(1, fetches.Load())
+	atomic.AddInt64(&now, 1)
+	_, err = verifier.Verify(unknown)
+	assert.EqualError(err, "unknown token key 'unknown'")
+	assert.EqualValues(2, fetches.Load())
+}
+
+func TestAuthenticator(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(authTestNow)).AnyTimes()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	verifier := server.NewJwtVerifier("", "", "sub", writeJwks(t, rsaKey, ecKey), time.Minute, timeSource)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	interceptor := server.NewAuthenticator(store.Scope("auth"), map[string]string{"tool": "secret"}, "X-Api-Key", verifier).
+		UnaryServerInterceptor()
+
+	var caller string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		caller = server.CallerFromContext(ctx)
+		return "ok", nil
+	}
+	call := func(method string, md metadata.MD) error {
+		caller = ""
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	const shouldRateLimit = "/envoy.service.ratelimit.v3.RateLimitService/ShouldRateLimit"
+
+	assert.NoError(call(shouldRateLimit, metadata.Pairs("x-api-key", "secret")))
+	assert.Equal("tool", caller)
+
+	token := signRS256(rsaKey, "rsa", map[string]interface{}{"sub": "ci", "exp": authTestNow + 60})
+	assert.NoError(call(shouldRateLimit, metadata.Pairs("authorization", "Bearer "+token)))
+	assert.Equal("ci", caller)
+
+	err := call(shouldRateLimit, metadata.Pairs("x-api-key", "wrong"))
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	err = call(shouldRateLimit, metadata.MD{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	// the health checks are not authenticated
+	assert.NoError(call("/grpc.health.v1.Health/Check", metadata.MD{}))
+
+	assert.EqualValues(1, store.NewCounter("auth.tool.authenticated").Value())
+	assert.EqualValues(1, store.NewCounter("auth.ci.authenticated").Value())
+	assert.EqualValues(2, store.NewCounter("auth.unauthenticated").Value())
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (this *fakeServerStream) Context() context.Context {
+	return this.ctx
+}
+
+func TestAuthenticatorStreams(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	interceptor := server.NewAuthenticator(store.Scope("auth"), map[string]string{"tool": "secret"}, "X-Api-Key", nil).
+		StreamServerInterceptor()
+
+	var caller string
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		caller = server.CallerFromContext(stream.Context())
+		return nil
+	}
+	call := func(method string, md metadata.MD) error {
+		caller = ""
+		stream := &fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+		return interceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: method, IsServerStream: true}, handler)
+	}
+	const streamEvents = "/ratelimit.events.v1.RateLimitEvents/StreamEvents"
+
+	assert.NoError(call(streamEvents, metadata.Pairs("x-api-key", "secret")))
+	assert.Equal("tool", caller)
+	err := call(streamEvents, metadata.MD{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	assert.NoError(call("/grpc.health.v1.Health/Watch", metadata.MD{}))
+
+	assert.EqualValues(1, store.NewCounter("auth.tool.authenticated").Value())
+	assert.EqualValues(1, store.NewCounter("auth.unauthenticated").Value())
+}
+
+func TestAuthenticatorHTTP(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	authenticator := server.NewAuthenticator(store.Scope("auth"), map[string]string{"tool": "secret"}, "X-Api-Key", nil)
+
+	var caller string
+	handler := authenticator.HTTPMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		caller = server.CallerFromContext(request.Context())
+	}))
+	call := func(path string, apiKey string) int {
+		caller = ""
+		request := httptest.NewRequest(http.MethodPost, path, nil)
+		if apiKey != "" {
+			request.Header.Set("X-Api-Key", apiKey)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(http.StatusOK, call("/ratelimit/v3/refund", "secret"))
+	assert.Equal("tool", caller)
+	assert.Equal(http.StatusUnauthorized, call("/json", "wrong"))
+	assert.Equal(http.StatusUnauthorized, call("/ratelimit/v3/usage", ""))
+	assert.Equal(http.StatusOK, call("/healthcheck", ""))
+	assert.Equal(http.StatusOK, call("/ready", ""))
+
+	assert.EqualValues(1, store.NewCounter("auth.tool.authenticated").Value())
+	assert.EqualValues(2, store.NewCounter("auth.unauthenticated").Value())
+}
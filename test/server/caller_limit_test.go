@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+)
+
+func TestCallerLimiter(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	limiter := server.NewCallerLimiter(store.Scope("caller_limit"), 1, 2).UnaryServerInterceptor()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	callFrom := func(ip string, method string) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+		_, err := limiter(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	const shouldRateLimit = "/envoy.service.ratelimit.v3.RateLimitService/ShouldRateLimit"
+
+	// the burst of a caller, then its calls are throttled
+	assert.NoError(callFrom("10.0.0.1", shouldRateLimit))
+	assert.NoError(callFrom("10.0.0.1", shouldRateLimit))
+	err := callFrom("10.0.0.1", shouldRateLimit)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.EqualError(err, "rpc error: code = ResourceExhausted desc = too many calls from 10.0.0.1")
+
+	// the other callers and the health checks are not throttled
+	assert.NoError(callFrom("10.0.0.2", shouldRateLimit))
+	assert.NoError(callFrom("10.0.0.1", "/grpc.health.v1.Health/Check"))
+
+	assert.EqualValues(1, store.NewCounter("caller_limit.throttled").Value())
+	assert.EqualValues(1, store.NewCounter("caller_limit.10_0_0_1.throttled").Value())
+}
+
+func TestCallerLimiterAuthenticatedCaller(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	authenticator := server.NewAuthenticator(store.Scope("auth"), map[string]string{"tool": "secret"}, "x-api-key", nil).
+		UnaryServerInterceptor()
+	limiter := server.NewCallerLimiter(store.Scope("caller_limit"), 1, 1).UnaryServerInterceptor()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return limiter(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/test"}, func(context.Context, interface{}) (interface{}, error) {
+			return "ok", nil
+		})
+	}
+	call := func(ip string) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-api-key", "secret"))
+		_, err := authenticator(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test"}, handler)
+		return err
+	}
+
+	// the calls of the same caller from two addresses share its rate
+	assert.NoError(call("10.0.0.1"))
+	assert.Equal(codes.ResourceExhausted, status.Code(call("10.0.0.2")))
+	assert.EqualValues(1, store.NewCounter("caller_limit.tool.throttled").Value())
+}
+
+func TestCallerLimiterTrackedCallers(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	limiter := server.NewCallerLimiter(store.Scope("caller_limit"), 1, 1).UnaryServerInterceptor()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	callFrom := func(ip net.IP) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: ip, Port: 1234}})
+		_, err := limiter(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test"}, handler)
+		return err
+	}
+
+	// the tracked callers are busy, none of them is dropped
+	for i := 0; i < 10000; i++ {
+		assert.NoError(callFrom(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))))
+	}
+	assert.Equal(codes.ResourceExhausted, status.Code(callFrom(net.IPv4(10, 0, 0, 0))))
+
+	// the new callers share the overflow bucket
+	assert.NoError(callFrom(net.IPv4(11, 0, 0, 1)))
+	assert.Equal(codes.ResourceExhausted, status.Code(callFrom(net.IPv4(11, 0, 0, 2))))
+	assert.Equal(codes.ResourceExhausted, status.Code(callFrom(net.IPv4(10, 0, 0, 0))))
+	assert.EqualValues(1, store.NewCounter("caller_limit.overflow.throttled").Value())
+	assert.EqualValues(2, store.NewCounter("caller_limit.10_0_0_0.throttled").Value())
+}
@@ -0,0 +1,104 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/redis"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type staticConfigGetter struct {
+	config config.RateLimitConfig
+}
+
+func (g staticConfigGetter) GetCurrentConfig() (config.RateLimitConfig, bool) {
+	return g.config, false
+}
+
+type counterReaderFunc func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) []limiter.CounterValue
+
+func (f counterReaderFunc) GetCounters(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.CounterValue {
+	return f(ctx, request, limits)
+}
+
+func postCheck(handler http.HandlerFunc, method string, body string) (int, string) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/check", strings.NewReader(body)))
+	resp := w.Result()
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(respBody)
+}
+
+func TestCheckHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.key_value"), false, true, "", nil, false)
+	unlimited := config.NewRateLimit(0, pb.RateLimitResponse_RateLimit_UNKNOWN, sm.NewStats("foo.key3"), true, false, "", nil, false)
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, descriptor *pb_struct.RateLimitDescriptor) *config.RateLimit {
+			switch descriptor.Entries[0].Key {
+			case "key":
+				return limit
+			case "key3":
+				return unlimited
+			}
+			return nil
+		}).AnyTimes()
+
+	var readLimits []*config.RateLimit
+	handler := server.NewCheckHandler(staticConfigGetter{rlConfig}, counterReaderFunc(
+		func(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.CounterValue {
+			readLimits = limits
+			return []limiter.CounterValue{{Key: "foo_key_value_1200", Value: 4}, {}, {}}
+		}))
+
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}]}, {"entries": [{"key": "key2", "value": "value2"}]}, {"entries": [{"key": "key3", "value": "value3"}]}]}`
+	code, resp := postCheck(handler, http.MethodPost, body)
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(`{"domain": "foo", "descriptors": [
+		{"rule": {"requests_per_unit": 10, "unit": "MINUTE", "unlimited": false, "shadow_mode": true, "detailed_metric": false, "stats_key": "foo.key_value"},
+		 "cache_key": "foo_key_value_1200", "current_value": 4},
+		{"current_value": 0},
+		{"rule": {"requests_per_unit": 0, "unit": "UNKNOWN", "unlimited": true, "shadow_mode": false, "detailed_metric": false, "stats_key": "foo.key3"},
+		 "current_value": 0}
+	]}`, resp)
+	// The unlimited rules have no counter to read.
+	assert.Equal([]*config.RateLimit{limit, nil, nil}, readLimits)
+
+	code, _ = postCheck(handler, http.MethodGet, body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+	code, _ = postCheck(handler, http.MethodPost, `{"domain": "foo"}`)
+	assert.Equal(http.StatusBadRequest, code)
+
+	// The errors of the backend are returned.
+	handler = server.NewCheckHandler(staticConfigGetter{rlConfig}, counterReaderFunc(
+		func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) []limiter.CounterValue {
+			panic(redis.RedisError("connection refused"))
+		}))
+	code, resp = postCheck(handler, http.MethodPost, body)
+	assert.Equal(http.StatusInternalServerError, code)
+	assert.Equal("connection refused\n", resp)
+
+	handler = server.NewCheckHandler(staticConfigGetter{nil}, nil)
+	code, _ = postCheck(handler, http.MethodPost, body)
+	assert.Equal(http.StatusServiceUnavailable, code)
+}
@@ -0,0 +1,109 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeConcurrencyLimiter struct {
+	leases map[string]bool
+}
+
+func (f *fakeConcurrencyLimiter) AcquireLeases(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit, leaseId string) []limiter.LeaseValue {
+	leases := make([]limiter.LeaseValue, len(limits))
+	for i, limit := range limits {
+		if limit == nil || limit.Concurrency == nil {
+			continue
+		}
+		leases[i].Key = "foo_key_value_leases"
+		if f.leases[leaseId] || uint32(len(f.leases)) < limit.Concurrency.MaxInFlight {
+			f.leases[leaseId] = true
+			leases[i].Acquired = true
+		}
+		leases[i].InFlight = uint32(len(f.leases))
+	}
+	return leases
+}
+
+func (f *fakeConcurrencyLimiter) ReleaseLeases(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit, leaseId string) []limiter.LeaseValue {
+	delete(f.leases, leaseId)
+	leases := make([]limiter.LeaseValue, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.Concurrency != nil {
+			leases[i] = limiter.LeaseValue{Key: "foo_key_value_leases", InFlight: uint32(len(f.leases))}
+		}
+	}
+	return leases
+}
+
+func requestLease(handler http.HandlerFunc, method string, leaseId string, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/ratelimit/v3/concurrency?lease_id="+leaseId, strings.NewReader(body)))
+	resp := w.Result()
+	respBody, _ := io.ReadAll(resp.Body)
+	decoded := map[string]interface{}{}
+	json.Unmarshal(respBody, &decoded)
+	return resp.StatusCode, decoded
+}
+
+func TestConcurrencyHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(0, pb.RateLimitResponse_RateLimit_UNKNOWN, sm.NewStats("foo.key_value"), false, false, "", nil, false)
+	limit.Concurrency = &config.Concurrency{MaxInFlight: 1, LeaseTtl: time.Minute}
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).Return(limit).AnyTimes()
+
+	concurrencyLimiter := &fakeConcurrencyLimiter{leases: map[string]bool{}}
+	handler := server.NewConcurrencyHandler(staticConfigGetter{rlConfig}, concurrencyLimiter)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}]}]}`
+
+	// a new lease is generated without lease_id
+	code, resp := requestLease(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(true, resp["acquired"])
+	leaseId, _ := resp["lease_id"].(string)
+	assert.NotEmpty(leaseId)
+	descriptor := resp["descriptors"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("foo_key_value_leases", descriptor["key"])
+	assert.EqualValues(1, descriptor["in_flight"])
+	assert.EqualValues(1, descriptor["max_in_flight"])
+
+	// the lease is renewed, another one is over the maximum
+	code, resp = requestLease(handler, http.MethodPost, leaseId, body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(true, resp["acquired"])
+	code, resp = requestLease(handler, http.MethodPost, "other", body)
+	assert.Equal(http.StatusTooManyRequests, code)
+	assert.Equal(false, resp["acquired"])
+
+	code, resp = requestLease(handler, http.MethodDelete, leaseId, body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(leaseId, resp["lease_id"])
+	assert.Empty(concurrencyLimiter.leases)
+
+	code, _ = requestLease(handler, http.MethodDelete, "", body)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = requestLease(handler, http.MethodGet, leaseId, body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,105 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/code"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_v3 "github.com/envoyproxy/ratelimit/test/mocks/rls"
+)
+
+func newCheckRequest(address string, path string, headers map[string]string) *auth.CheckRequest {
+	return &auth.CheckRequest{Attributes: &auth.AttributeContext{
+		Source: &auth.AttributeContext_Peer{Address: &core.Address{Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{Address: address},
+		}}},
+		Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+			Method:  "GET",
+			Path:    path,
+			Headers: headers,
+		}},
+	}}
+}
+
+func TestParseExtAuthzDescriptors(t *testing.T) {
+	assert := assert.New(t)
+
+	descriptors, err := server.ParseExtAuthzDescriptors(
+		"remote_address=source.address; generic_key=literal:api, user=request.http.headers.X-User-Id")
+	assert.NoError(err)
+	assert.Equal([][]server.ExtAuthzEntry{
+		{{Key: "remote_address", Attribute: "source.address"}},
+		{{Key: "generic_key", Attribute: "literal:api"}, {Key: "user", Attribute: "request.http.headers.X-User-Id"}},
+	}, descriptors)
+
+	_, err = server.ParseExtAuthzDescriptors("path=request.path")
+	assert.EqualError(err, "invalid ext_authz descriptor entry 'path=request.path'")
+	_, err = server.ParseExtAuthzDescriptors("")
+	assert.Error(err)
+}
+
+func TestExtAuthz(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	svc := mock_v3.NewMockRateLimitServiceServer(controller)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	descriptors, err := server.ParseExtAuthzDescriptors(
+		"remote_address=source.address;path=request.http.path,user=request.http.headers.X-User-Id")
+	assert.NoError(err)
+	authz := server.NewExtAuthzServer(svc, "edge", descriptors, store.Scope("ext_authz"))
+
+	// the descriptor of the missing header is skipped
+	svc.EXPECT().ShouldRateLimit(gomock.Any(), common.NewRateLimitRequest("edge", [][][2]string{
+		{{"remote_address", "10.0.0.1"}},
+	}, 1)).Return(&pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_OK}, nil)
+	response, err := authz.Check(context.Background(), newCheckRequest("10.0.0.1", "/api", nil))
+	assert.NoError(err)
+	assert.Equal(int32(code.Code_OK), response.Status.Code)
+	assert.NotNil(response.GetOkResponse())
+
+	// an over limit request is denied with a 429 and the rate limit headers
+	svc.EXPECT().ShouldRateLimit(gomock.Any(), &pb.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*pb_struct.RateLimitDescriptor{
+			{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "remote_address", Value: "10.0.0.1"}}},
+			{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "path", Value: "/api"}, {Key: "user", Value: "alice"}}},
+		},
+		HitsAddend: 1,
+	}).Return(&pb.RateLimitResponse{
+		OverallCode:          pb.RateLimitResponse_OVER_LIMIT,
+		ResponseHeadersToAdd: []*core.HeaderValue{{Key: "RateLimit-Remaining", Value: "0"}},
+	}, nil)
+	response, err = authz.Check(context.Background(), newCheckRequest("10.0.0.1", "/api", map[string]string{"x-user-id": "alice"}))
+	assert.NoError(err)
+	assert.Equal(int32(code.Code_RESOURCE_EXHAUSTED), response.Status.Code)
+	assert.Equal(envoy_type.StatusCode_TooManyRequests, response.GetDeniedResponse().Status.Code)
+	assert.Equal("RateLimit-Remaining", response.GetDeniedResponse().Headers[0].Header.Key)
+
+	// the errors of the service are returned to Envoy, which applies its failure mode
+	svc.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).Return(nil, errors.New("redis error"))
+	_, err = authz.Check(context.Background(), newCheckRequest("10.0.0.1", "/api", nil))
+	assert.EqualError(err, "redis error")
+
+	// a request without any descriptor is allowed without calling the service
+	response, err = authz.Check(context.Background(), newCheckRequest("", "/api", nil))
+	assert.NoError(err)
+	assert.Equal(int32(code.Code_OK), response.Status.Code)
+
+	assert.EqualValues(4, store.NewCounter("ext_authz.requests").Value())
+	assert.EqualValues(1, store.NewCounter("ext_authz.over_limit").Value())
+	assert.EqualValues(1, store.NewCounter("ext_authz.service_error").Value())
+}
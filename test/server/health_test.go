@@ -212,3 +212,63 @@ func TestGrpcHealthyWithAtLeastOneConfigLoaded(t *testing.T) {
 		t.Errorf("expected status NOT_SERVING actual %v", res.Status)
 	}
 }
+
+func TestReadiness(t *testing.T) {
+	defer signal.Reset(syscall.SIGTERM)
+
+	hc := server.NewHealthChecker(health.NewServer(), "ratelimit", false)
+
+	serveReady := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://1.2.3.4/ready", nil)
+		hc.ServeReady(recorder, r)
+		return recorder
+	}
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// healthy but neither configured nor connected
+	hc.ProbeBackend()
+	if recorder := serveReady(); recorder.Code != 503 {
+		t.Errorf("expected code 503 actual %d", recorder.Code)
+	}
+
+	hc.ConfigLoaded()
+	if recorder := serveReady(); recorder.Code != 503 {
+		t.Errorf("expected code 503 actual %d", recorder.Code)
+	}
+	if isClosed(hc.Ready()) {
+		t.Errorf("expected not ready before the backend is reached")
+	}
+
+	hc.BackendReachable()
+	if recorder := serveReady(); recorder.Code != 200 || recorder.Body.String() != "READY" {
+		t.Errorf("expected code 200 and body 'READY', got %d '%s'", recorder.Code, recorder.Body.String())
+	}
+	if !isClosed(hc.Ready()) {
+		t.Errorf("expected ready once configured and connected")
+	}
+
+	// an unhealthy component makes the service unready
+	hc.Fail(server.RedisHealthComponentName)
+	if recorder := serveReady(); recorder.Code != 503 {
+		t.Errorf("expected code 503 actual %d", recorder.Code)
+	}
+	hc.Ok(server.RedisHealthComponentName)
+	if recorder := serveReady(); recorder.Code != 200 {
+		t.Errorf("expected code 200 actual %d", recorder.Code)
+	}
+
+	// a backend which can't be probed is not waited for
+	hc = server.NewHealthChecker(health.NewServer(), "ratelimit", false)
+	hc.ConfigLoaded()
+	if !isClosed(hc.Ready()) {
+		t.Errorf("expected ready once configured without a backend probe")
+	}
+}
@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestIpFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, err := server.NewIpFilter([]string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}, []string{"10.1.0.0/16"})
+	assert.NoError(err)
+	assert.False(filter.IsEmpty())
+	assert.True(filter.Admits(tcpAddr("10.0.0.1")))
+	assert.True(filter.Admits(tcpAddr("192.168.1.10")))
+	assert.True(filter.Admits(tcpAddr("fd00::1")))
+	assert.False(filter.Admits(tcpAddr("192.168.1.11")))
+	// the denylist takes precedence over the allowlist
+	assert.False(filter.Admits(tcpAddr("10.1.2.3")))
+	// the unix domain sockets have no IP
+	assert.True(filter.Admits(&net.UnixAddr{Name: "/tmp/ratelimit.sock", Net: "unix"}))
+
+	denyOnly, err := server.NewIpFilter(nil, []string{"10.1.0.0/16"})
+	assert.NoError(err)
+	assert.True(denyOnly.Admits(tcpAddr("192.168.1.11")))
+	assert.False(denyOnly.Admits(tcpAddr("10.1.2.3")))
+
+	empty, err := server.NewIpFilter([]string{""}, nil)
+	assert.NoError(err)
+	assert.True(empty.IsEmpty())
+
+	_, err = server.NewIpFilter([]string{"10.0.0.0/33"}, nil)
+	assert.EqualError(err, "invalid CIDR '10.0.0.0/33'")
+	_, err = server.NewIpFilter(nil, []string{"localhost"})
+	assert.EqualError(err, "invalid IP address 'localhost'")
+}
+
+func TestFilteredListener(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	denied := store.NewCounter("denied")
+
+	filter, err := server.NewIpFilter(nil, []string{"127.0.0.1"})
+	assert.NoError(err)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	listener := server.NewFilteredListener(inner, filter, denied)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// the denied connection is closed by the listener
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(err)
+	assert.EqualValues(1, denied.Value())
+
+	select {
+	case <-accepted:
+		t.Error("expected the connection to be denied")
+	default:
+	}
+}
@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+)
+
+func TestOverloadManager(t *testing.T) {
+	assert := assert.New(t)
+
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	interceptor := server.NewOverloadManager(store.Scope("overload"), 1, 20*time.Millisecond, false).UnaryServerInterceptor()
+	request := &pb.RateLimitRequest{Domain: "domain"}
+	okResponse := &pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_OK}
+
+	// A call takes the only slot until it is released.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return okResponse, nil
+		})
+	}()
+	<-started
+	assert.EqualValues(1, store.NewGauge("overload.in_flight").Value())
+
+	// The calls beyond the bound are shed once the queue wait expires.
+	handler := func(context.Context, interface{}) (interface{}, error) {
+		return okResponse, nil
+	}
+	_, err := interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(codes.Unavailable, status.Code(err))
+	assert.EqualValues(1, store.NewCounter("overload.queued").Value())
+	assert.EqualValues(1, store.NewCounter("overload.shed").Value())
+
+	// The other calls are not bounded.
+	response, err := interceptor(context.Background(), &healthpb.HealthCheckRequest{}, &grpc.UnaryServerInfo{}, handler)
+	assert.Nil(err)
+	assert.Equal(okResponse, response)
+
+	// A queued call gets the slot when it is released.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+	}()
+	response, err = interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, handler)
+	assert.Nil(err)
+	assert.Equal(okResponse, response)
+	assert.EqualValues(1, store.NewCounter("overload.shed").Value())
+	<-done
+	assert.EqualValues(0, store.NewGauge("overload.in_flight").Value())
+}
+
+func TestOverloadManagerShedWithOk(t *testing.T) {
+	assert := assert.New(t)
+
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	interceptor := server.NewOverloadManager(store.Scope("overload"), 1, 0, true).UnaryServerInterceptor()
+	request := &pb.RateLimitRequest{Domain: "domain"}
+
+	response, err := interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		// The nested call is shed without waiting.
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+			t.Fatal("the call should be shed")
+			return nil, nil
+		})
+	})
+	assert.Nil(err)
+	assert.Equal(&pb.RateLimitResponse{OverallCode: pb.RateLimitResponse_OK}, response)
+	assert.EqualValues(0, store.NewCounter("overload.queued").Value())
+	assert.EqualValues(1, store.NewCounter("overload.shed").Value())
+}
@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakePenaltyBox struct {
+	banned bool
+}
+
+func (f *fakePenaltyBox) GetPenalties(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.PenaltyValue {
+	penalties := make([]limiter.PenaltyValue, len(limits))
+	for i, limit := range limits {
+		if limit != nil && limit.Penalty != nil {
+			penalties[i].Key = "foo_key_value_penalty"
+			if f.banned {
+				penalties[i].Remaining = 90 * time.Second
+			}
+		}
+	}
+	return penalties
+}
+
+func (f *fakePenaltyBox) ClearPenalties(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.PenaltyValue {
+	penalties := f.GetPenalties(ctx, request, limits)
+	f.banned = false
+	return penalties
+}
+
+func TestPenaltyBoxHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.key_value"), false, false, "", nil, false)
+	limit.Penalty = &config.Penalty{OverLimits: 3, Window: time.Minute, Duration: 5 * time.Minute}
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).Return(limit).AnyTimes()
+
+	penaltyBox := &fakePenaltyBox{banned: true}
+	handler := server.NewPenaltyBoxHandler(staticConfigGetter{rlConfig}, penaltyBox)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}]}]}`
+	expected := `{"domain": "foo", "descriptors": [
+		{"rule": {"requests_per_unit": 10, "unit": "MINUTE", "unlimited": false, "shadow_mode": false, "detailed_metric": false, "stats_key": "foo.key_value",
+		  "penalty": {"over_limits": 3, "window": "1m0s", "duration": "5m0s"}},
+		 "key": "foo_key_value_penalty", "banned": true, "remaining_seconds": 90}]}`
+
+	code, resp := postCheck(handler, http.MethodPost, body)
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(expected, resp)
+
+	// the DELETE returns the cleared ban
+	code, resp = postCheck(handler, http.MethodDelete, body)
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(expected, resp)
+	assert.False(penaltyBox.banned)
+
+	code, resp = postCheck(handler, http.MethodPost, body)
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(resp, `"banned":false`)
+
+	code, _ = postCheck(handler, http.MethodGet, body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeRefunder struct {
+	value     uint64
+	fail      bool
+	countedAt int64
+}
+
+func (f *fakeRefunder) RefundHits(_ context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, countedAt int64) []limiter.RefundValue {
+	if f.fail {
+		panic("refund failed")
+	}
+	f.countedAt = countedAt
+	refunds := make([]limiter.RefundValue, len(limits))
+	for i, limit := range limits {
+		if limit == nil {
+			continue
+		}
+		refunded := request.Descriptors[i].HitsAddend.GetValue()
+		if refunded > f.value {
+			refunded = f.value
+		}
+		f.value -= refunded
+		refunds[i] = limiter.RefundValue{Key: "foo_key_value_1234", Value: f.value, Refunded: refunded}
+	}
+	return refunds
+}
+
+func requestRefund(handler http.HandlerFunc, method string, query string, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/ratelimit/v3/refund"+query, strings.NewReader(body)))
+	resp := w.Result()
+	respBody, _ := io.ReadAll(resp.Body)
+	decoded := map[string]interface{}{}
+	json.Unmarshal(respBody, &decoded)
+	return resp.StatusCode, decoded
+}
+
+func TestRefundHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.key_value"), false, false, "", nil, false)
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).Return(limit).AnyTimes()
+
+	refunder := &fakeRefunder{value: 5}
+	handler := server.NewRefundHandler(staticConfigGetter{rlConfig}, refunder)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}], "hits_addend": 3}]}`
+
+	code, resp := requestRefund(handler, http.MethodPost, "?counted_at=1234", body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("foo", resp["domain"])
+	descriptor := resp["descriptors"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("foo_key_value_1234", descriptor["key"])
+	assert.EqualValues(2, descriptor["value"])
+	assert.EqualValues(3, descriptor["refunded"])
+	assert.NotNil(descriptor["rule"])
+	assert.EqualValues(1234, refunder.countedAt)
+
+	// the counter is clamped at zero
+	_, resp = requestRefund(handler, http.MethodPost, "?counted_at=1234", body)
+	descriptor = resp["descriptors"].([]interface{})[0].(map[string]interface{})
+	assert.EqualValues(0, descriptor["value"])
+	assert.EqualValues(2, descriptor["refunded"])
+
+	code, _ = requestRefund(handler, http.MethodGet, "?counted_at=1234", body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+
+	// the windows of the request are required
+	code, _ = requestRefund(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = requestRefund(handler, http.MethodPost, "?counted_at=yesterday", body)
+	assert.Equal(http.StatusBadRequest, code)
+
+	refunder.fail = true
+	code, _ = requestRefund(handler, http.MethodPost, "?counted_at=1234", body)
+	assert.Equal(http.StatusInternalServerError, code)
+}
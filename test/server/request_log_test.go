@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	logger "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+)
+
+func TestRequestLogSampler(t *testing.T) {
+	assert := assert.New(t)
+
+	log, hook := logtest.NewNullLogger()
+	interceptor := server.NewRequestLogSampler(2, log).UnaryServerInterceptor()
+	request := &pb.RateLimitRequest{
+		Domain: "domain",
+		Descriptors: []*pb_struct.RateLimitDescriptor{
+			{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key", Value: "value"}, {Key: "key2", Value: "value2"}}},
+			{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key3", Value: "value3"}}},
+		},
+	}
+	response := &pb.RateLimitResponse{
+		OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+		Statuses:    []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}, {Code: pb.RateLimitResponse_OVER_LIMIT}},
+	}
+	handler := func(context.Context, interface{}) (interface{}, error) {
+		return response, nil
+	}
+
+	// The other calls are not logged.
+	_, err := interceptor(context.Background(), &healthpb.HealthCheckRequest{}, &grpc.UnaryServerInfo{}, handler)
+	assert.Nil(err)
+	assert.Empty(hook.AllEntries())
+
+	resp, err := interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, handler)
+	assert.Nil(err)
+	assert.Equal(response, resp)
+	entry := hook.LastEntry()
+	assert.Equal(logger.InfoLevel, entry.Level)
+	assert.Equal("domain", entry.Data["domain"])
+	assert.Equal([]string{"key=value,key2=value2", "key3=value3"}, entry.Data["descriptors"])
+	assert.Equal("OVER_LIMIT", entry.Data["overall_code"])
+	assert.Equal([]string{"OK", "OVER_LIMIT"}, entry.Data["statuses"])
+
+	_, err = interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+		return nil, errors.New("redis down")
+	})
+	assert.NotNil(err)
+	assert.Equal("redis down", hook.LastEntry().Data["error"])
+
+	// The calls beyond the rate are not logged.
+	_, err = interceptor(context.Background(), request, &grpc.UnaryServerInfo{}, handler)
+	assert.Nil(err)
+	assert.Len(hook.AllEntries(), 2)
+}
@@ -0,0 +1,116 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type fakeReserver struct {
+	value uint64
+	holds map[string]uint64
+	ttl   time.Duration
+}
+
+func (f *fakeReserver) Reserve(_ context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, ttl time.Duration) (string, []limiter.ReservationValue) {
+	f.ttl = ttl
+	id := limiter.NewReservationId(1234)
+	hits := request.Descriptors[0].HitsAddend.GetValue()
+	held := f.value+hits <= uint64(limits[0].Limit.RequestsPerUnit)
+	if held {
+		f.value += hits
+		f.holds[id] = hits
+	}
+	return id, []limiter.ReservationValue{{Key: "foo_key_value_1234", Held: held, Value: f.value}}
+}
+
+func (f *fakeReserver) CommitReservation(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) []limiter.ReservationValue {
+	_, held := f.holds[id]
+	delete(f.holds, id)
+	return []limiter.ReservationValue{{Key: "foo_key_value_1234", Held: held, Value: f.value}}
+}
+
+func (f *fakeReserver) CancelReservation(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) []limiter.ReservationValue {
+	hits, held := f.holds[id]
+	delete(f.holds, id)
+	f.value -= hits
+	return []limiter.ReservationValue{{Key: "foo_key_value_1234", Held: held, Value: f.value}}
+}
+
+func requestReservation(handler http.HandlerFunc, method string, query string, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/ratelimit/v3/reservations?"+query, strings.NewReader(body)))
+	resp := w.Result()
+	respBody, _ := io.ReadAll(resp.Body)
+	decoded := map[string]interface{}{}
+	json.Unmarshal(respBody, &decoded)
+	return resp.StatusCode, decoded
+}
+
+func TestReservationHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.key_value"), false, false, "", nil, false)
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).Return(limit).AnyTimes()
+
+	reserver := &fakeReserver{holds: map[string]uint64{}}
+	handler := server.NewReservationHandler(staticConfigGetter{rlConfig}, reserver, 30*time.Second, time.Minute)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}], "hits_addend": 6}]}`
+
+	code, resp := requestReservation(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(true, resp["held"])
+	assert.Equal(30*time.Second, reserver.ttl)
+	reservationId, _ := resp["reservation_id"].(string)
+	descriptor := resp["descriptors"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("foo_key_value_1234", descriptor["key"])
+	assert.EqualValues(6, descriptor["value"])
+
+	// over the limit
+	code, resp = requestReservation(handler, http.MethodPost, "ttl=5s", body)
+	assert.Equal(http.StatusTooManyRequests, code)
+	assert.Equal(false, resp["held"])
+	assert.Equal(5*time.Second, reserver.ttl)
+
+	code, resp = requestReservation(handler, http.MethodPut, "reservation_id="+reservationId, body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(true, resp["held"])
+	assert.Equal(reservationId, resp["reservation_id"])
+	// a reservation is committed once
+	code, resp = requestReservation(handler, http.MethodPut, "reservation_id="+reservationId, body)
+	assert.Equal(http.StatusGone, code)
+	assert.Equal(false, resp["held"])
+
+	code, resp = requestReservation(handler, http.MethodPost, "", `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}], "hits_addend": 2}]}`)
+	assert.Equal(http.StatusOK, code)
+	code, resp = requestReservation(handler, http.MethodDelete, "reservation_id="+resp["reservation_id"].(string), body)
+	assert.Equal(http.StatusOK, code)
+	assert.EqualValues(6, reserver.value)
+
+	code, _ = requestReservation(handler, http.MethodPost, "ttl=2m", body)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = requestReservation(handler, http.MethodPut, "reservation_id=invalid", body)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = requestReservation(handler, http.MethodGet, "", body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_v3 "github.com/envoyproxy/ratelimit/test/mocks/rls"
+)
+
+func postRest(handler http.HandlerFunc, contentType, accept, body string) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, "/ratelimit/v3/should_rate_limit", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w.Result()
+}
+
+func TestRestHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	rls := mock_v3.NewMockRateLimitServiceServer(controller)
+	handler := server.NewRestHandler(rls, store.Scope("http"))
+
+	request := &pb.RateLimitRequest{
+		Domain: "foo",
+		Descriptors: []*pb_struct.RateLimitDescriptor{{
+			Entries:    []*pb_struct.RateLimitDescriptor_Entry{{Key: "key", Value: "value"}},
+			HitsAddend: wrapperspb.UInt64(3),
+		}},
+	}
+	requestMatcher := mock.MatchedBy(func(req *pb.RateLimitRequest) bool { return proto.Equal(req, request) })
+	overLimit := &pb.RateLimitResponse{
+		OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+		Statuses: []*pb.RateLimitResponse_DescriptorStatus{{
+			Code:         pb.RateLimitResponse_OVER_LIMIT,
+			CurrentLimit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: 10, Unit: pb.RateLimitResponse_RateLimit_MINUTE},
+		}},
+	}
+
+	// The full request is accepted in JSON and the full response returned, including the unset fields.
+	rls.EXPECT().ShouldRateLimit(context.Background(), requestMatcher).Return(overLimit, nil)
+	resp := postRest(handler, "application/json; charset=utf-8", "",
+		`{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}], "hits_addend": 3}]}`)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	assert.Contains(string(body), `"limitRemaining":0`)
+	assert.Contains(string(body), `"requestsPerUnit":10`)
+
+	// The protobuf binary format is negotiated.
+	encoded, _ := proto.Marshal(request)
+	rls.EXPECT().ShouldRateLimit(context.Background(), requestMatcher).Return(overLimit, nil)
+	resp = postRest(handler, "application/x-protobuf", "text/html, application/x-protobuf", string(encoded))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("application/x-protobuf", resp.Header.Get("Content-Type"))
+	var decoded pb.RateLimitResponse
+	assert.Nil(proto.Unmarshal(body, &decoded))
+	assert.True(proto.Equal(overLimit, &decoded))
+
+	assert.Equal(http.StatusUnsupportedMediaType, postRest(handler, "text/plain", "", "foo").StatusCode)
+	assert.Equal(http.StatusNotAcceptable, postRest(handler, "", "text/html", `{"domain": "foo"}`).StatusCode)
+	assert.Equal(http.StatusBadRequest, postRest(handler, "", "", "}").StatusCode)
+	assert.Equal(http.StatusBadRequest, postRest(handler, "", "", `{"domain": "foo"}`).StatusCode)
+
+	// The errors of the service are returned as unavailable.
+	rls.EXPECT().ShouldRateLimit(context.Background(), requestMatcher).Return(nil, fmt.Errorf("connection refused"))
+	resp = postRest(handler, "", "*/*", `{"domain": "foo", "descriptors": [{"entries": [{"key": "key", "value": "value"}], "hits_addend": 3}]}`)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/ratelimit/v3/should_rate_limit", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+
+	assert.EqualValues(8, store.NewCounter("http.requests").Value())
+	assert.EqualValues(2, store.NewCounter("http.over_limit").Value())
+	assert.EqualValues(5, store.NewCounter("http.bad_requests").Value())
+	assert.EqualValues(1, store.NewCounter("http.service_error").Value())
+}
@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+
+	core_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	ratelimit_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	pb_v2 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/test/common"
+	mock_v3 "github.com/envoyproxy/ratelimit/test/mocks/rls"
+)
+
+func TestRateLimitServiceV2(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	svc := mock_v3.NewMockRateLimitServiceServer(controller)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	v2 := server.NewRateLimitServiceV2(svc, store.Scope("v2_api"))
+
+	svc.EXPECT().ShouldRateLimit(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+			common.AssertProtoEqual(assert, common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 3), request)
+			return &pb.RateLimitResponse{
+				OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+				Statuses: []*pb.RateLimitResponse_DescriptorStatus{{
+					Code:               pb.RateLimitResponse_OVER_LIMIT,
+					CurrentLimit:       &pb.RateLimitResponse_RateLimit{RequestsPerUnit: 10, Unit: pb.RateLimitResponse_RateLimit_MINUTE},
+					DurationUntilReset: durationpb.New(30),
+				}},
+				ResponseHeadersToAdd: []*core.HeaderValue{{Key: "RateLimit-Remaining", Value: "0"}},
+			}, nil
+		})
+	response, err := v2.ShouldRateLimit(context.Background(), &pb_v2.RateLimitRequest{
+		Domain: "domain",
+		Descriptors: []*ratelimit_v2.RateLimitDescriptor{
+			{Entries: []*ratelimit_v2.RateLimitDescriptor_Entry{{Key: "key", Value: "value"}}},
+		},
+		HitsAddend: 3,
+	})
+	assert.NoError(err)
+
+	// the v3 only fields are dropped
+	expected := &pb_v2.RateLimitResponse{
+		OverallCode: pb_v2.RateLimitResponse_OVER_LIMIT,
+		Statuses: []*pb_v2.RateLimitResponse_DescriptorStatus{{
+			Code:         pb_v2.RateLimitResponse_OVER_LIMIT,
+			CurrentLimit: &pb_v2.RateLimitResponse_RateLimit{RequestsPerUnit: 10, Unit: pb_v2.RateLimitResponse_RateLimit_MINUTE},
+		}},
+		Headers: []*core_v2.HeaderValue{{Key: "RateLimit-Remaining", Value: "0"}},
+	}
+	common.AssertProtoEqual(assert, expected, response)
+	assert.EqualValues(1, store.NewCounter("v2_api.requests").Value())
+}
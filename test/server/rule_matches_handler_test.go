@@ -0,0 +1,65 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+func TestRuleMatchesHandler(t *testing.T) {
+	assert := assert.New(t)
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := config.NewRateLimitConfigImpl([]config.RateLimitConfigToLoad{{
+		Name: "config.yaml",
+		ConfigYaml: config.ConfigFileContentToYaml("config.yaml", `
+domain: foo
+descriptors:
+  - key: key
+    value: value
+    rate_limit:
+      name: used
+      unit: minute
+      requests_per_unit: 10
+  - key: key
+    descriptors:
+      - key: subkey
+        rate_limit:
+          unit: second
+          requests_per_unit: 1
+`),
+	}}, sm, false)
+	sm.NewStats("foo.key_value").Matched.Add(3)
+
+	get := func(target string) (int, string) {
+		w := httptest.NewRecorder()
+		server.NewRuleMatchesHandler(staticConfigGetter{rlConfig}, sm)(w, httptest.NewRequest(http.MethodGet, target, nil))
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/rule_matches")
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(`[{"domain":"foo","rules":[
+		{"rule":"foo.key.subkey","matched":0},
+		{"rule":"foo.key_value","name":"used","matched":3}]}]`, body)
+
+	code, body = get("/rule_matches?unmatched=true&domain=foo")
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(`[{"domain":"foo","rules":[{"rule":"foo.key.subkey","matched":0}]}]`, body)
+
+	_, body = get("/rule_matches?domain=bar")
+	assert.JSONEq(`[]`, body)
+
+	w := httptest.NewRecorder()
+	server.NewRuleMatchesHandler(staticConfigGetter{rlConfig}, sm)(w, httptest.NewRequest(http.MethodPost, "/rule_matches", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+}
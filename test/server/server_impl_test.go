@@ -17,8 +17,12 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	gostats "github.com/lyft/gostats"
+
 	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/settings"
 	mock_v3 "github.com/envoyproxy/ratelimit/test/mocks/rls"
+	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
 )
 
 func assertHttpResponse(t *testing.T,
@@ -84,3 +88,19 @@ func TestJsonHandler(t *testing.T) {
 	}, nil)
 	assertHttpResponse(t, handler, `{"domain": "foo"}`, 429, "application/json", `{"overallCode":"OVER_LIMIT"}`)
 }
+
+func TestNewProviderInvalidSettings(t *testing.T) {
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	statsManager := mockstats.NewMockStatManager(store)
+
+	s := settings.NewSettings()
+	s.ConfigType = "SOMEWHERE"
+	_, err := server.NewProvider(s, statsManager, store)
+	assert.EqualError(t, err, "invalid setting for ConfigType: SOMEWHERE")
+
+	s = settings.NewSettings()
+	s.ConfigType = "FILE_AND_GRPC_XDS_SOTW"
+	s.ConfigMergePrecedence = "SOMETIMES"
+	_, err = server.NewProvider(s, statsManager, store)
+	assert.EqualError(t, err, "invalid setting for ConfigMergePrecedence: SOMETIMES")
+}
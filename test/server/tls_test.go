@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+)
+
+func clientCert(t *testing.T, dnsNames []string, uris []string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		assert.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestVerifyClientSans(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	rejected := store.NewCounter("rejected")
+
+	verify := server.VerifyClientSans([]string{"envoy.internal", "spiffe://cluster.local/ns/prod/*"}, rejected)
+	verifyCert := func(cert *x509.Certificate) error {
+		return verify([][]byte{cert.Raw}, [][]*x509.Certificate{{cert}})
+	}
+
+	assert.NoError(verifyCert(clientCert(t, []string{"envoy.internal"}, nil)))
+	assert.NoError(verifyCert(clientCert(t, nil, []string{"spiffe://cluster.local/ns/prod/sa/envoy"})))
+	assert.EqualValues(0, rejected.Value())
+
+	assert.EqualError(verifyCert(clientCert(t, []string{"other.internal"}, []string{"spiffe://cluster.local/ns/dev/sa/envoy"})),
+		"client cert SANs [other.internal spiffe://cluster.local/ns/dev/sa/envoy] are not allowed")
+	assert.EqualValues(1, rejected.Value())
+
+	assert.EqualError(verify(nil, nil), "missing client cert")
+	assert.EqualValues(2, rejected.Value())
+}
@@ -0,0 +1,93 @@
+package server_test
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/provider"
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+	mockstats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+)
+
+type nullProvider struct{}
+
+func (nullProvider) ConfigUpdateEvent() <-chan provider.ConfigUpdateEvent { return nil }
+
+func (nullProvider) Stop() {}
+
+func newNullProvider(settings.Settings, stats.Manager, gostats.Store) (provider.RateLimitConfigProvider, error) {
+	return nullProvider{}, nil
+}
+
+func newUdsServer(t *testing.T, dir string) server.Server {
+	s := settings.NewSettings()
+	s.Host = "127.0.0.1"
+	s.Port = 18291
+	s.GrpcSocketType = "unix"
+	s.GrpcUds = filepath.Join(dir, "grpc.sock")
+	s.DebugSocketType = "unix"
+	s.DebugUds = filepath.Join(dir, "debug.sock")
+	s.UdsFileMode = "0660"
+	statsManager := mockstats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	srv, err := server.NewServerWithProvider(s, "ratelimit", statsManager, nil, newNullProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestUnixDomainSockets(t *testing.T) {
+	defer signal.Reset(syscall.SIGTERM)
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	// the socket of a process which did not shut down
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "grpc.sock"), Net: "unix"})
+	assert.NoError(err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := newUdsServer(t, dir)
+	assert.NoError(srv.Listen())
+	go srv.Serve()
+	defer srv.Stop()
+
+	for _, name := range []string{"grpc.sock", "debug.sock"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0o660), info.Mode().Perm(), name)
+		conn, err := net.Dial("unix", filepath.Join(dir, name))
+		assert.NoError(err)
+		conn.Close()
+	}
+
+	// the socket of a running process is not removed
+	err = newUdsServer(t, dir).Listen()
+	assert.ErrorContains(err, "is in use by another process")
+}
+
+func TestInvalidSocketType(t *testing.T) {
+	defer signal.Reset(syscall.SIGTERM)
+	assert := assert.New(t)
+
+	s := settings.NewSettings()
+	s.GrpcSocketType = "udp"
+	statsManager := mockstats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	assert.PanicsWithValue(`invalid GRPC_SOCKET_TYPE "udp", expected tcp or unix`, func() {
+		server.NewServerWithProvider(s, "ratelimit", statsManager, nil, newNullProvider)
+	})
+
+	s.GrpcSocketType = "unix"
+	assert.PanicsWithValue("GRPC_SOCKET_TYPE unix requires the socket path in GRPC_UDS", func() {
+		server.NewServerWithProvider(s, "ratelimit", statsManager, nil, newNullProvider)
+	})
+}
@@ -0,0 +1,200 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang/mock/gomock"
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/limiter"
+	"github.com/envoyproxy/ratelimit/src/server"
+	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
+	mock_stats "github.com/envoyproxy/ratelimit/test/mocks/stats"
+	mock_utils "github.com/envoyproxy/ratelimit/test/mocks/utils"
+)
+
+type fakeCounterScanner struct {
+	counters []limiter.UsageValue
+}
+
+func (f *fakeCounterScanner) ScanCounters(_ context.Context, domain string, prefix string, max int, maxScans int) []limiter.UsageValue {
+	var counters []limiter.UsageValue
+	for _, counter := range f.counters {
+		if strings.HasPrefix(counter.Key, domain+"_"+prefix) && len(counters) < max {
+			counters = append(counters, counter)
+		}
+	}
+	return counters
+}
+
+func requestUsage(handler http.HandlerFunc, method string, query string, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/ratelimit/v3/usage?"+query, strings.NewReader(body)))
+	resp := w.Result()
+	respBody, _ := io.ReadAll(resp.Body)
+	decoded := map[string]interface{}{}
+	json.Unmarshal(respBody, &decoded)
+	return resp.StatusCode, decoded
+}
+
+func TestUsageHandlerDescriptors(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.user_a"), false, false, "", nil, false)
+	over := config.NewRateLimit(2, pb.RateLimitResponse_RateLimit_HOUR, sm.NewStats("foo.user_b"), false, false, "", nil, false)
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, descriptor *pb_struct.RateLimitDescriptor) *config.RateLimit {
+			switch descriptor.Entries[0].Value {
+			case "a":
+				return limit
+			case "b":
+				return over
+			}
+			return nil
+		}).AnyTimes()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000040)).AnyTimes()
+
+	fail := false
+	counterReader := counterReaderFunc(func(_ context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.CounterValue {
+		if fail {
+			panic("connection refused")
+		}
+		counters := make([]limiter.CounterValue, len(limits))
+		for i, l := range limits {
+			switch l {
+			case limit:
+				counters[i] = limiter.CounterValue{Key: "foo_user_a_1000020", Value: 3}
+			case over:
+				counters[i] = limiter.CounterValue{Key: "foo_user_b_1000020", Value: 5}
+			}
+		}
+		return counters
+	})
+	handler := server.NewUsageHandler(staticConfigGetter{rlConfig}, counterReader, nil, 10, 10, timeSource)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "user", "value": "a"}]}, {"entries": [{"key": "user", "value": "b"}]}, {"entries": [{"key": "path", "value": "/"}]}]}`
+
+	// the counters are read, no hit is counted
+	code, resp := requestUsage(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("foo", resp["domain"])
+	descriptors := resp["descriptors"].([]interface{})
+	usage := descriptors[0].(map[string]interface{})
+	assert.Equal("OK", usage["code"])
+	assert.Equal(map[string]interface{}{"requests_per_unit": float64(10), "unit": "MINUTE"}, usage["limit"])
+	assert.EqualValues(3, usage["used"])
+	assert.EqualValues(7, usage["remaining"])
+	assert.EqualValues(40, usage["reset_seconds"])
+	usage = descriptors[1].(map[string]interface{})
+	assert.Equal("OVER_LIMIT", usage["code"])
+	assert.EqualValues(2, usage["used"])
+	assert.EqualValues(0, usage["remaining"])
+	assert.EqualValues(3600-1000040%3600, usage["reset_seconds"])
+	assert.Nil(descriptors[2].(map[string]interface{})["limit"])
+	assert.Nil(descriptors[2].(map[string]interface{})["reset_seconds"])
+	assert.EqualValues(0, sm.NewStats("foo.user_a").TotalHits.Value())
+
+	fail = true
+	code, _ = requestUsage(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusServiceUnavailable, code)
+
+	code, _ = requestUsage(handler, http.MethodPost, "", `{"domain": "foo"}`)
+	assert.Equal(http.StatusBadRequest, code)
+	// the counters can't be listed without a scanner
+	code, _ = requestUsage(handler, http.MethodGet, "domain=foo", "")
+	assert.Equal(http.StatusNotImplemented, code)
+	code, _ = requestUsage(handler, http.MethodDelete, "", body)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+
+	// nor read without a reader
+	handler = server.NewUsageHandler(staticConfigGetter{rlConfig}, nil, nil, 10, 10, timeSource)
+	code, _ = requestUsage(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusNotImplemented, code)
+}
+
+func TestUsageHandlerRequestAligned(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	sm := mock_stats.NewMockStatManager(gostats.NewStore(gostats.NewNullSink(), false))
+	rlConfig := mock_config.NewMockRateLimitConfig(controller)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, sm.NewStats("foo.user"), false, false, "", nil, false)
+	limit.RequestAligned = true
+	rlConfig.EXPECT().GetLimit(gomock.Any(), "foo", gomock.Any()).Return(limit).AnyTimes()
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000040)).AnyTimes()
+
+	counterReader := counterReaderFunc(func(_ context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []limiter.CounterValue {
+		counters := make([]limiter.CounterValue, len(limits))
+		for i, descriptor := range request.Descriptors {
+			switch descriptor.Entries[0].Value {
+			case "started":
+				counters[i] = limiter.CounterValue{Key: "foo_user_started_request", Value: 3, Ttl: 12500 * time.Millisecond}
+			case "unknown":
+				counters[i] = limiter.CounterValue{Key: "foo_user_unknown_request", Value: 3}
+			default:
+				counters[i] = limiter.CounterValue{Key: "foo_user_missing_request"}
+			}
+		}
+		return counters
+	})
+	handler := server.NewUsageHandler(staticConfigGetter{rlConfig}, counterReader, nil, 10, 10, timeSource)
+	body := `{"domain": "foo", "descriptors": [{"entries": [{"key": "user", "value": "started"}]}, {"entries": [{"key": "user", "value": "missing"}]}, {"entries": [{"key": "user", "value": "unknown"}]}]}`
+
+	// the reset is the expiration of the counter, rounded up, the whole window before the first hit,
+	// and unknown when the backend can't read the expiration
+	code, resp := requestUsage(handler, http.MethodPost, "", body)
+	assert.Equal(http.StatusOK, code)
+	descriptors := resp["descriptors"].([]interface{})
+	assert.EqualValues(13, descriptors[0].(map[string]interface{})["reset_seconds"])
+	assert.EqualValues(60, descriptors[1].(map[string]interface{})["reset_seconds"])
+	assert.Nil(descriptors[2].(map[string]interface{})["reset_seconds"])
+	assert.EqualValues(3, descriptors[2].(map[string]interface{})["used"])
+}
+
+func TestUsageHandlerCounters(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	counterScanner := &fakeCounterScanner{counters: []limiter.UsageValue{
+		{Key: "foo_user_b_1234", Value: 2, Ttl: 10 * time.Second},
+		{Key: "foo_user_a_1234", Value: 3, Ttl: 40 * time.Second},
+		{Key: "foo_path_/_1234", Value: 1, Ttl: 40 * time.Second},
+	}}
+	handler := server.NewUsageHandler(staticConfigGetter{nil}, nil, counterScanner, 2, 10, mock_utils.NewMockTimeSource(controller))
+
+	code, resp := requestUsage(handler, http.MethodGet, "domain=foo&prefix=user_", "")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]interface{}{
+		map[string]interface{}{"key": "foo_user_a_1234", "used": float64(3), "reset_seconds": float64(40)},
+		map[string]interface{}{"key": "foo_user_b_1234", "used": float64(2), "reset_seconds": float64(10)},
+	}, resp["counters"])
+
+	// the max is capped
+	_, resp = requestUsage(handler, http.MethodGet, "domain=foo&max=1", "")
+	assert.Len(resp["counters"], 1)
+	_, resp = requestUsage(handler, http.MethodGet, "domain=foo&max=10", "")
+	assert.Len(resp["counters"], 2)
+
+	code, _ = requestUsage(handler, http.MethodGet, "domain=foo&max=0", "")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = requestUsage(handler, http.MethodGet, "", "")
+	assert.Equal(http.StatusBadRequest, code)
+}
@@ -1,12 +1,15 @@
 package ratelimit_test
 
 import (
+	"fmt"
 	"math"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/envoyproxy/ratelimit/src/provider"
 	"github.com/envoyproxy/ratelimit/src/stats"
@@ -22,13 +25,17 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/envoyproxy/ratelimit/src/trace"
 
 	"github.com/envoyproxy/ratelimit/src/config"
+	"github.com/envoyproxy/ratelimit/src/events"
+	"github.com/envoyproxy/ratelimit/src/limiter"
 	"github.com/envoyproxy/ratelimit/src/redis"
 	server "github.com/envoyproxy/ratelimit/src/server"
 	ratelimit "github.com/envoyproxy/ratelimit/src/service"
+	"github.com/envoyproxy/ratelimit/src/topkeys"
 	"github.com/envoyproxy/ratelimit/test/common"
 	mock_config "github.com/envoyproxy/ratelimit/test/mocks/config"
 	mock_limiter "github.com/envoyproxy/ratelimit/test/mocks/limiter"
@@ -93,6 +100,8 @@ func commonSetup(t *testing.T) rateLimitServiceTestSuite {
 	ret.configUpdateEvent = mock_provider.NewMockConfigUpdateEvent(ret.controller)
 	// ret.configLoader = mock_config.NewMockRateLimitConfigLoader(ret.controller)
 	ret.config = mock_config.NewMockRateLimitConfig(ret.controller)
+	// the reloads diff the configurations
+	ret.config.EXPECT().DumpTree().Return(nil).AnyTimes()
 	ret.statStore = gostats.NewStore(gostats.NewNullSink(), false)
 	ret.statsManager = mock_stats.NewMockStatManager(ret.statStore)
 	ret.health = server.NewHealthChecker(health.NewServer(), "ratelimit", false)
@@ -175,6 +184,7 @@ func TestService(test *testing.T) {
 		},
 		response)
 	t.assert.Nil(err)
+	t.assert.EqualValues(1, t.statStore.NewCounter("key.matched").Value())
 
 	// Config load failure.
 	t.configUpdateEvent.EXPECT().GetConfig().DoAndReturn(func() (config.RateLimitConfig, any) {
@@ -345,6 +355,192 @@ func TestMixedRuleShadowMode(test *testing.T) {
 	t.assert.EqualValues(0, t.statStore.NewCounter("global_shadow_mode").Value())
 }
 
+func TestRuleMetadata(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest(
+		"different-domain", [][][2]string{{{"foo", "bar"}}, {{"hello", "world"}}, {{"plan", "free"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		nil,
+	}
+	limits[0].Metadata = map[string]string{"retry_after_hint": "60", "plan": "free"}
+	limits[1].Metadata = map[string]string{"retry_after_hint": "1"}
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(limits[0])
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[1]).Return(limits[1])
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[2]).Return(nil)
+	t.cache.EXPECT().DoLimit(context.Background(), request, limits).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 5},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
+		})
+	response, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+
+	// the metadata of the limit over the limit wins
+	t.assert.Equal(pb.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	t.assert.Equal("60", response.DynamicMetadata.Fields["retry_after_hint"].GetStringValue())
+	t.assert.Equal("free", response.DynamicMetadata.Fields["plan"].GetStringValue())
+}
+
+func TestQuota(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest(
+		"different-domain", [][][2]string{{{"foo", "bar"}}, {{"hello", "world"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false),
+	}
+	for _, limit := range limits {
+		limit.Quota = config.NewRateLimit(1000, pb.RateLimitResponse_RateLimit_DAY, t.statsManager.NewStats("key.quota"), false, false, "", nil, false)
+		limit.Quota.IsQuota = true
+	}
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(limits[0])
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[1]).Return(limits[1])
+
+	// the quotas are checked along with the rates in a single call
+	quotaRequest := &pb.RateLimitRequest{
+		Domain:      request.Domain,
+		Descriptors: append(request.Descriptors, request.Descriptors...),
+		HitsAddend:  request.HitsAddend,
+	}
+	t.cache.EXPECT().DoLimit(context.Background(), quotaRequest, []*config.RateLimit{limits[0], limits[1], limits[0].Quota, limits[1].Quota}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 99},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 50},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Quota.Limit, LimitRemaining: 10},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Quota.Limit, LimitRemaining: 0},
+		})
+	response, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+
+	// the most restrictive of the rate and of the quota is reported
+	common.AssertProtoEqual(
+		t.assert,
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Quota.Limit, LimitRemaining: 10},
+				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Quota.Limit, LimitRemaining: 0},
+			},
+		},
+		response)
+}
+
+func TestSpillover(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest(
+		"different-domain", [][][2]string{{{"team", "eng"}, {"user", "alice"}}, {{"team", "eng"}, {"user", "bob"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false),
+	}
+	teamPool := config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("spillover.team_pool"), false, false, "team_pool", nil, false)
+	teamPool.SpilloverKey = "team"
+	teamPool.SpillsOver = true
+	globalPool := config.NewRateLimit(1000, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("spillover.global_pool"), false, false, "global_pool", nil, false)
+	for _, limit := range limits {
+		limit.Spillover = []*config.RateLimit{teamPool, globalPool}
+		limit.SpillsOver = true
+	}
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(limits[0])
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[1]).Return(limits[1])
+
+	t.cache.EXPECT().DoLimit(context.Background(), request, limits).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0},
+		})
+	// the descriptors over their limit fall through the tiers, in order
+	teamRequest := common.NewRateLimitRequest("different-domain", [][][2]string{{{config.SpilloverDescriptorKey, "team_pool"}, {"team", "eng"}}}, 1)
+	t.cache.EXPECT().DoLimit(context.Background(), teamRequest, []*config.RateLimit{teamPool}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: teamPool.Limit, LimitRemaining: 0}})
+	globalRequest := common.NewRateLimitRequest("different-domain", [][][2]string{{{config.SpilloverDescriptorKey, "global_pool"}}}, 1)
+	t.cache.EXPECT().DoLimit(context.Background(), globalRequest, []*config.RateLimit{globalPool}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: globalPool.Limit, LimitRemaining: 600}})
+	response, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+
+	// the status of a descriptor admitted by a tier names the tier
+	common.AssertProtoEqual(
+		t.assert,
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OK,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5},
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: globalPool.Limit, LimitRemaining: 600},
+			},
+		},
+		response)
+	t.assert.Equal("global_pool", response.Statuses[1].CurrentLimit.Name)
+	// the limits a tier admitted past record no over limit
+	t.assert.EqualValues(0, limits[1].Stats.OverLimit.Value())
+	t.assert.EqualValues(0, teamPool.Stats.OverLimit.Value())
+
+	// a descriptor without the entry keying a tier skips it, the over limit being recorded once every
+	// tier rejected the request
+	request = common.NewRateLimitRequest("different-domain", [][][2]string{{{"user", "carol"}}}, 1)
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(limits[0])
+	t.cache.EXPECT().DoLimit(context.Background(), request, []*config.RateLimit{limits[0]}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}})
+	t.cache.EXPECT().DoLimit(context.Background(), globalRequest, []*config.RateLimit{globalPool}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: globalPool.Limit, LimitRemaining: 0}})
+	response, err = service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+	t.assert.Equal(pb.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	t.assert.EqualValues(1, limits[0].Stats.OverLimit.Value())
+	t.assert.EqualValues(0, teamPool.Stats.OverLimit.Value())
+}
+
+func TestLimitScaleFactor(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest("different-domain", [][][2]string{{{"foo", "bar"}}}, 1)
+	limit := config.NewRateLimit(100, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false)
+	limit.Quota = config.NewRateLimit(1000, pb.RateLimitResponse_RateLimit_DAY, t.statsManager.NewStats("key.quota"), false, false, "", nil, false)
+	small := config.NewRateLimit(1, pb.RateLimitResponse_RateLimit_SECOND, t.statsManager.NewStats("key"), false, false, "", nil, false)
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(limit)
+	t.config.EXPECT().GetLimit(context.Background(), "different-domain", request.Descriptors[0]).Return(small)
+
+	service.(ratelimit.LimitScaleFactorSetter).SetLimitScaleFactor(0.5)
+	t.cache.EXPECT().DoLimit(context.Background(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			// the quota is scaled with the limit, the configured limit is left as is
+			t.assert.EqualValues(50, limits[0].Limit.RequestsPerUnit)
+			t.assert.EqualValues(500, limits[1].Limit.RequestsPerUnit)
+			t.assert.Equal(limit.Stats, limits[0].Stats)
+			t.assert.EqualValues(100, limit.Limit.RequestsPerUnit)
+			return []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 49},
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 499},
+			}
+		})
+	response, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+	t.assert.EqualValues(50, response.Statuses[0].CurrentLimit.RequestsPerUnit)
+
+	// a scaled limit admits at least a request
+	t.cache.EXPECT().DoLimit(context.Background(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			t.assert.EqualValues(1, limits[0].Limit.RequestsPerUnit)
+			return []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit}}
+		})
+	_, err = service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+}
+
 func TestServiceWithCustomRatelimitHeaders(test *testing.T) {
 	os.Setenv("LIMIT_RESPONSE_HEADERS_ENABLED", "true")
 	os.Setenv("LIMIT_LIMIT_HEADER", "A-Ratelimit-Limit")
@@ -404,6 +600,63 @@ func TestServiceWithCustomRatelimitHeaders(test *testing.T) {
 	t.assert.Nil(err)
 }
 
+type trailerStream struct {
+	trailer metadata.MD
+}
+
+func (this *trailerStream) Method() string {
+	return "/envoy.service.ratelimit.v3.RateLimitService/ShouldRateLimit"
+}
+func (this *trailerStream) SetHeader(md metadata.MD) error  { return nil }
+func (this *trailerStream) SendHeader(md metadata.MD) error { return nil }
+func (this *trailerStream) SetTrailer(md metadata.MD) error {
+	this.trailer = metadata.Join(this.trailer, md)
+	return nil
+}
+
+func TestServiceDebugTrailers(test *testing.T) {
+	os.Setenv("RESPONSE_DEBUG_TRAILERS", "true")
+	defer os.Unsetenv("RESPONSE_DEBUG_TRAILERS")
+
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest(
+		"different-domain", [][][2]string{{{"foo", "bar"}}, {{"hello", "world"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		nil,
+	}
+	limits[0].FullKey = "different-domain.foo_bar"
+	t.config.EXPECT().GetLimit(gomock.Any(), "different-domain", request.Descriptors[0]).Return(limits[0]).Times(2)
+	t.config.EXPECT().GetLimit(gomock.Any(), "different-domain", request.Descriptors[1]).Return(limits[1]).Times(2)
+	t.cache.EXPECT().DoLimit(gomock.Any(), request, limits).DoAndReturn(
+		func(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			limiter.DecisionDebugFromContext(ctx).AddCacheKeys([]limiter.CacheKey{{Key: "different-domain_foo_bar_2220"}, {}})
+			// the later calls check the quotas or spillover tiers of the descriptors
+			limiter.DecisionDebugFromContext(ctx).AddCacheKeys([]limiter.CacheKey{{Key: "different-domain_foo_bar_quota_0"}})
+			return []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9},
+				{Code: pb.RateLimitResponse_OK},
+			}
+		}).Times(2)
+
+	// the trailers are set only if the request asks for them
+	stream := &trailerStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+	_, err := service.ShouldRateLimit(ctx, request)
+	t.assert.Nil(err)
+	t.assert.Empty(stream.trailer)
+
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-ratelimit-debug", "true"))
+	_, err = service.ShouldRateLimit(ctx, request)
+	t.assert.Nil(err)
+	t.assert.Equal([]string{"different-domain.foo_bar", ""}, stream.trailer.Get("x-ratelimit-debug-rule"))
+	t.assert.Equal([]string{"different-domain_foo_bar_2220", ""}, stream.trailer.Get("x-ratelimit-debug-cache-key"))
+	t.assert.Len(stream.trailer.Get("x-ratelimit-debug-backend-latency"), 1)
+}
+
 func TestServiceWithDefaultRatelimitHeaders(test *testing.T) {
 	os.Setenv("LIMIT_RESPONSE_HEADERS_ENABLED", "true")
 	defer func() {
@@ -665,3 +918,269 @@ func TestServiceHealthStatusAtLeastOneConfigLoaded(test *testing.T) {
 		test.Errorf("expected status NOT_SERVING actual %v", res.Status)
 	}
 }
+
+func TestServiceConfigReloadUnderLoad(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+
+	newConfig := func(requestsPerUnit int) config.RateLimitConfig {
+		yaml := config.ConfigFileContentToYaml("config.yaml", fmt.Sprintf(`
+domain: test-domain
+descriptors:
+  - key: hello
+    rate_limit:
+      unit: second
+      requests_per_unit: %d
+`, requestsPerUnit))
+		return config.NewRateLimitConfigImpl([]config.RateLimitConfigToLoad{{Name: "config.yaml", ConfigYaml: yaml}}, t.statsManager, false)
+	}
+	configs := []config.RateLimitConfig{newConfig(10), newConfig(20)}
+
+	t.configProvider.EXPECT().ConfigUpdateEvent().Return(t.configUpdateEventChan).Times(1)
+	t.configUpdateEvent.EXPECT().GetConfig().Return(configs[0], nil)
+	go func() { t.configUpdateEventChan <- t.configUpdateEvent }()
+	service := ratelimit.NewService(t.cache, t.configProvider, t.statsManager, t.health, MockClock{now: int64(2222)}, false, false, false)
+
+	t.cache.EXPECT().DoLimit(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+			if limits[0] == nil {
+				return []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK}}
+			}
+			return []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit}}
+		}).AnyTimes()
+
+	// The requests issued during the reloads always match a limit of either configuration.
+	var misses atomic.Int32
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"hello", "world"}}}, 1)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				response, err := service.ShouldRateLimit(context.Background(), request)
+				if err != nil || response.Statuses[0].CurrentLimit == nil {
+					misses.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		event := mock_provider.NewMockConfigUpdateEvent(t.controller)
+		event.EXPECT().GetConfig().Return(configs[i%2], nil)
+		service.SetConfig(event, false)
+	}
+	close(done)
+	wg.Wait()
+
+	t.assert.EqualValues(0, misses.Load())
+	t.assert.EqualValues(201, t.statStore.NewCounter("config_load_success").Value())
+}
+
+func TestServiceTopKeys(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+	tracker := topkeys.NewTracker(10, time.Minute, utils.NewTimeSourceImpl())
+	service.(ratelimit.TopKeysSetter).SetTopKeys(tracker)
+
+	request := common.NewRateLimitRequestWithPerDescriptorHitsAddend(
+		"different-domain", [][][2]string{{{"foo", "bar"}, {"user", "a"}}, {{"hello", "world"}}, {{"foo", "query"}}}, []uint64{3, 1, 0})
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		nil,
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key2"), false, false, "", nil, false),
+	}
+	for i := range limits {
+		t.config.EXPECT().GetLimit(gomock.Any(), "different-domain", request.Descriptors[i]).Return(limits[i])
+	}
+	t.cache.EXPECT().DoLimit(gomock.Any(), request, limits).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 7},
+			{Code: pb.RateLimitResponse_OK},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[2].Limit, LimitRemaining: 10},
+		})
+	_, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+
+	// the descriptors without a limit and the queries are not counted
+	top := tracker.Top("different-domain", 10)
+	t.assert.Len(top, 1)
+	t.assert.Equal("foo=bar,user=a", top[0].Descriptor)
+	t.assert.EqualValues(3, top[0].Hits)
+}
+
+func TestServiceEvents(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+	broker := events.NewBroker(0.8, 10, utils.NewTimeSourceImpl(), t.statStore.Scope("events"))
+	service.(ratelimit.EventsSetter).SetEvents(broker)
+	subscription := broker.Subscribe("different-domain")
+	defer subscription.Close()
+
+	request := common.NewRateLimitRequest(
+		"different-domain", [][][2]string{{{"foo", "bar"}}, {{"hello", "world"}}, {{"foo", "baz"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false),
+		nil,
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key2"), false, false, "", nil, false),
+	}
+	for i := range limits {
+		t.config.EXPECT().GetLimit(gomock.Any(), "different-domain", request.Descriptors[i]).Return(limits[i])
+	}
+	t.cache.EXPECT().DoLimit(gomock.Any(), request, limits).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[2].Limit, LimitRemaining: 7},
+		})
+	_, err := service.ShouldRateLimit(context.Background(), request)
+	t.assert.Nil(err)
+
+	// only the descriptors entering the near limit or over limit state are published
+	event := <-subscription.Events()
+	t.assert.Equal(events.OverLimit, event.Type)
+	t.assert.Equal([]events.Entry{{Key: "foo", Value: "bar"}}, event.Descriptor)
+	t.assert.Len(subscription.Events(), 0)
+}
+
+type settableClock struct {
+	now atomic.Int64
+}
+
+func (c *settableClock) UnixNow() int64 { return c.now.Load() }
+
+func TestServiceReloadCanary(test *testing.T) {
+	os.Setenv("CONFIG_CANARY_BAKE_PERIOD", "1m")
+	os.Setenv("CONFIG_CANARY_MIN_REQUESTS", "2")
+	defer func() {
+		os.Unsetenv("CONFIG_CANARY_BAKE_PERIOD")
+		os.Unsetenv("CONFIG_CANARY_MIN_REQUESTS")
+	}()
+
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	barrier := newBarrier()
+	clock := &settableClock{}
+	clock.now.Store(1000)
+	t.configProvider.EXPECT().ConfigUpdateEvent().Return(t.configUpdateEventChan).Times(1)
+	t.config.EXPECT().IsEmptyDomains().Return(false).AnyTimes()
+	t.configUpdateEvent.EXPECT().GetConfig().DoAndReturn(func() (config.RateLimitConfig, any) {
+		barrier.signal()
+		return t.config, nil
+	})
+	go func() { t.configUpdateEventChan <- t.configUpdateEvent }()
+	service := ratelimit.NewService(t.cache, t.configProvider, t.statsManager, t.health, clock, false, false, false)
+	barrier.wait()
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limit := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, t.statsManager.NewStats("key"), false, false, "", nil, false)
+	serve := func(conf *mock_config.MockRateLimitConfig, limit *config.RateLimit) {
+		conf.EXPECT().GetLimit(gomock.Any(), "domain", request.Descriptors[0]).Return(limit)
+		status := &pb.RateLimitResponse_DescriptorStatus{Code: pb.RateLimitResponse_OK}
+		if limit != nil {
+			status.CurrentLimit = limit.Limit
+		}
+		t.cache.EXPECT().DoLimit(gomock.Any(), request, []*config.RateLimit{limit}).Return(
+			[]*pb.RateLimitResponse_DescriptorStatus{status})
+		_, err := service.ShouldRateLimit(context.Background(), request)
+		t.assert.Nil(err)
+	}
+	reload := func(conf *mock_config.MockRateLimitConfig) {
+		t.configUpdateEvent.EXPECT().GetConfig().DoAndReturn(func() (config.RateLimitConfig, any) {
+			barrier.signal()
+			return conf, nil
+		})
+		t.configUpdateEventChan <- t.configUpdateEvent
+		barrier.wait()
+		// wait for the config to be stored after the signal of GetConfig
+		t.assert.Eventually(func() bool {
+			current, _ := service.GetCurrentConfig()
+			return current == conf
+		}, time.Second, time.Millisecond)
+	}
+	serve(t.config, limit)
+	serve(t.config, limit)
+
+	// a reload whose lookups fail is rolled back once it served the minimum requests
+	broken := mock_config.NewMockRateLimitConfig(t.controller)
+	broken.EXPECT().IsEmptyDomains().Return(false).AnyTimes()
+	broken.EXPECT().DumpTree().Return([]*config.DomainDump{{Domain: "broken"}}).AnyTimes()
+	reload(broken)
+	serve(broken, nil)
+	current, _ := service.GetCurrentConfig()
+	t.assert.Equal(broken, current)
+	serve(broken, nil)
+	current, _ = service.GetCurrentConfig()
+	t.assert.Equal(t.config, current)
+	t.assert.EqualValues(1, t.statStore.NewCounter("config_rollback").Value())
+	t.assert.EqualValues(1, t.statStore.NewGauge("config_rolled_back").Value())
+
+	// the rolled back configuration is refused when reloaded again
+	loads := t.statStore.NewCounter("config_load_success").Value()
+	brokenAgain := mock_config.NewMockRateLimitConfig(t.controller)
+	brokenAgain.EXPECT().DumpTree().Return([]*config.DomainDump{{Domain: "broken"}}).AnyTimes()
+	t.configUpdateEvent.EXPECT().GetConfig().DoAndReturn(func() (config.RateLimitConfig, any) {
+		barrier.signal()
+		return brokenAgain, nil
+	})
+	t.configUpdateEventChan <- t.configUpdateEvent
+	barrier.wait()
+
+	// a reload serving as well as the previous configuration passes its bake period
+	healthy := mock_config.NewMockRateLimitConfig(t.controller)
+	healthy.EXPECT().IsEmptyDomains().Return(false).AnyTimes()
+	healthy.EXPECT().DumpTree().Return([]*config.DomainDump{{Domain: "healthy"}}).AnyTimes()
+	reload(healthy)
+	t.assert.EqualValues(loads+1, t.statStore.NewCounter("config_load_success").Value())
+	t.assert.EqualValues(0, t.statStore.NewGauge("config_rolled_back").Value())
+	serve(healthy, limit)
+	serve(healthy, limit)
+	clock.now.Store(1060)
+	serve(healthy, nil)
+	serve(healthy, nil)
+	current, _ = service.GetCurrentConfig()
+	t.assert.Equal(healthy, current)
+	t.assert.EqualValues(1, t.statStore.NewCounter("config_canary_passed").Value())
+	t.assert.EqualValues(1, t.statStore.NewCounter("config_rollback").Value())
+}
+
+func TestServiceConfigDiff(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	reloaded := mock_config.NewMockRateLimitConfig(t.controller)
+	reloaded.EXPECT().IsEmptyDomains().Return(false).AnyTimes()
+	reloaded.EXPECT().DumpTree().Return([]*config.DomainDump{{
+		Domain: "domain",
+		Descriptors: []*config.DescriptorDump{
+			{Key: "key", Value: "value", RateLimit: &config.RateLimitDump{RequestsPerUnit: 10, Unit: "MINUTE"}},
+			{Key: "other", RateLimit: &config.RateLimitDump{RequestsPerUnit: 5, Unit: "SECOND"}},
+		},
+	}}).AnyTimes()
+	barrier := newBarrier()
+	t.configUpdateEvent.EXPECT().GetConfig().DoAndReturn(func() (config.RateLimitConfig, any) {
+		barrier.signal()
+		return reloaded, nil
+	})
+	t.configUpdateEventChan <- t.configUpdateEvent
+	barrier.wait()
+	// the config is stored after the diff is recorded
+	t.assert.Eventually(func() bool {
+		current, _ := service.GetCurrentConfig()
+		return current == reloaded
+	}, time.Second, time.Millisecond)
+
+	t.assert.EqualValues(1, t.statStore.NewCounter("config_diff.domains_added").Value())
+	t.assert.EqualValues(2, t.statStore.NewCounter("config_diff.rules_added").Value())
+	t.assert.EqualValues(0, t.statStore.NewCounter("config_diff.rules_removed").Value())
+}
@@ -0,0 +1,29 @@
+package test_stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	gostats "github.com/lyft/gostats"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+func TestBackendOpStats(t *testing.T) {
+	assert := assert.New(t)
+	store := gostats.NewStore(gostats.NewNullSink(), false)
+	ops := stats.NewBackendOps(store.Scope("backend"))
+
+	ops.Op("GET").Record(time.Now(), nil, false)
+	ops.Op("get").Record(time.Now(), nil, true)
+	ops.Op("get").Record(time.Now(), errors.New("error"), true)
+
+	counter := func(code string) uint64 {
+		return store.NewCounterWithTags("backend.get", map[string]string{"code": code}).Value()
+	}
+	assert.EqualValues(1, counter(stats.BackendOpSuccess))
+	assert.EqualValues(1, counter(stats.BackendOpMiss))
+	assert.EqualValues(1, counter(stats.BackendOpError))
+}
@@ -54,3 +54,65 @@ func TestEscapingInvalidChartersInMetricName(t *testing.T) {
 		})
 	}
 }
+
+func TestNewStatsIsCached(t *testing.T) {
+	mockSink := gostatsMock.NewSink()
+	statsManager := stats.NewStatManager(gostats.NewStore(mockSink, false), settings.Settings{})
+
+	first := statsManager.NewStats("domain.key_value")
+	first.TotalHits.Inc()
+	second := statsManager.NewStats("domain.key_value")
+	second.TotalHits.Inc()
+	assert.Equal(t, first, second)
+	assert.EqualValues(t, 2, second.TotalHits.Value())
+
+	statsManager.NewDomainStats("unknown").NotFound.Inc()
+	statsManager.NewDomainStats("unknown").NotFound.Inc()
+	statsManager.GetStatsStore().Flush()
+	mockSink.AssertCounterEquals(t, "ratelimit.service.rate_limit.unknown.domain_not_found", 2)
+}
+
+func BenchmarkNewStats(b *testing.B) {
+	statsManager := stats.NewStatManager(gostats.NewStore(gostats.NewNullSink(), false), settings.Settings{})
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("domain.key_value%d.detailed", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		statsManager.NewStats(keys[i%len(keys)]).TotalHits.Inc()
+	}
+}
+
+func BenchmarkNewDomainStats(b *testing.B) {
+	statsManager := stats.NewStatManager(gostats.NewStore(gostats.NewNullSink(), false), settings.Settings{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		statsManager.NewDomainStats("unknown").NotFound.Inc()
+	}
+}
+
+func TestNewStatsWithRollups(t *testing.T) {
+	mockSink := gostatsMock.NewSink()
+	statsManager := stats.NewStatManager(gostats.NewStore(mockSink, false), settings.Settings{})
+
+	statsManager.NewStatsWithRollups("domain1", "domain1.key_value1").TotalHits.Add(2)
+	statsManager.NewStatsWithRollups("domain1", "domain1.key_value2").OverLimit.Inc()
+	keyStats := statsManager.NewStatsWithRollups("domain2", "domain2.key")
+	keyStats.TotalHits.Inc()
+	keyStats.ShadowMode.Inc()
+	assert.EqualValues(t, 1, keyStats.TotalHits.Value())
+
+	statsManager.GetStatsStore().Flush()
+	mockSink.AssertCounterEquals(t, "ratelimit.service.rate_limit.domain1.key_value1.total_hits", 2)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.domain.domain1.total_hits", 2)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.domain.domain1.over_limit", 1)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.domain.domain2.total_hits", 1)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.domain.domain2.shadow_mode", 1)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.all.total_hits", 3)
+	mockSink.AssertCounterEquals(t, "ratelimit.service.all.over_limit", 1)
+}
@@ -0,0 +1,72 @@
+package test_stats
+
+import (
+	"testing"
+
+	gostats "github.com/lyft/gostats"
+	gostatsMock "github.com/lyft/gostats/mock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/settings"
+	"github.com/envoyproxy/ratelimit/src/stats"
+)
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	mockSink := gostatsMock.NewSink()
+	snapshot := stats.NewSnapshotSink(mockSink, 0)
+	statsManager := stats.NewStatManager(gostats.NewStore(snapshot, false), settings.Settings{}).WithSnapshot(snapshot)
+
+	ruleStats := statsManager.NewStats("foo.key_value")
+	ruleStats.TotalHits.Add(2)
+	statsManager.GetStatsStore().NewGauge("foo.gauge").Set(7)
+	timer := statsManager.GetStatsStore().NewTimer("foo.timer")
+	timer.AddValue(3)
+	timer.AddValue(1)
+
+	// the counters add up across the flushes, which still reach the wrapped sink
+	statsManager.GetStatsStore().Flush()
+	ruleStats.TotalHits.Inc()
+	statsManager.GetStatsStore().Flush()
+	all := statsManager.Snapshot("")
+	assert.EqualValues(3, all.Counters["ratelimit.service.rate_limit.foo.key_value.total_hits"])
+	assert.EqualValues(7, all.Gauges["foo.gauge"])
+	assert.Equal(stats.TimerSnapshot{Count: 2, Sum: 4, Min: 1, Max: 3}, all.Timers["foo.timer"])
+	mockSink.AssertCounterEquals(t, "ratelimit.service.rate_limit.foo.key_value.total_hits", 3)
+
+	// a snapshot doesn't flush the store, leaving the flushes to the wrapped sink
+	ruleStats.TotalHits.Inc()
+	assert.EqualValues(3, statsManager.Snapshot("").Counters["ratelimit.service.rate_limit.foo.key_value.total_hits"])
+	mockSink.AssertCounterEquals(t, "ratelimit.service.rate_limit.foo.key_value.total_hits", 3)
+
+	filtered := statsManager.Snapshot("foo.key_value")
+	assert.Equal(map[string]uint64{"ratelimit.service.rate_limit.foo.key_value.total_hits": 3}, filtered.Counters)
+	assert.Empty(filtered.Gauges)
+	assert.Empty(filtered.Timers)
+}
+
+func TestSnapshotMaxNames(t *testing.T) {
+	assert := assert.New(t)
+	mockSink := gostatsMock.NewSink()
+	snapshot := stats.NewSnapshotSink(mockSink, 2)
+	snapshot.FlushCounter("a", 1)
+	snapshot.FlushGauge("b", 2)
+	snapshot.FlushCounter("a", 1)
+	snapshot.FlushTimer("c", 3)
+	snapshot.FlushCounter("d", 4)
+
+	// the stats past the maximum are still flushed to the wrapped sink
+	all := snapshot.Snapshot("")
+	assert.Equal(map[string]uint64{"a": 2}, all.Counters)
+	assert.Equal(map[string]uint64{"b": 2}, all.Gauges)
+	assert.Empty(all.Timers)
+	assert.EqualValues(2, all.DroppedNames)
+	mockSink.AssertCounterEquals(t, "d", 4)
+	mockSink.AssertTimerCallCount(t, "c", 1)
+}
+
+func TestSnapshotWithoutSink(t *testing.T) {
+	statsManager := stats.NewStatManager(gostats.NewStore(gostats.NewNullSink(), false), settings.Settings{})
+	statsManager.NewStats("foo.key_value").TotalHits.Inc()
+	assert.Empty(t, statsManager.Snapshot("").Counters)
+}
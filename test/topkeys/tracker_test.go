@@ -0,0 +1,131 @@
+package topkeys_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/envoyproxy/ratelimit/src/server"
+	"github.com/envoyproxy/ratelimit/src/topkeys"
+	mock_utils "github.com/envoyproxy/ratelimit/test/mocks/utils"
+)
+
+func TestTrackerHeavyHitters(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000)).AnyTimes()
+	tracker := topkeys.NewTracker(5, time.Minute, timeSource)
+
+	// the descriptors with more than a fifth of the hits are kept among many light descriptors
+	for i := 0; i < 100; i++ {
+		tracker.Add("domain", "user=heavy", 5)
+		tracker.Add("domain", fmt.Sprintf("user=light%d", i), 1)
+		tracker.Add("domain", "user=medium", 2)
+	}
+	tracker.Add("other", "user=a", 1)
+
+	top := tracker.Top("domain", 2)
+	assert.Len(top, 2)
+	assert.Equal("user=heavy", top[0].Descriptor)
+	assert.EqualValues(500, top[0].Hits)
+	assert.EqualValues(0, top[0].Error)
+	assert.InDelta(500.0/60, top[0].Rate, 0.001)
+	assert.Equal("user=medium", top[1].Descriptor)
+	assert.GreaterOrEqual(top[1].Hits, uint64(200))
+	assert.LessOrEqual(top[1].Hits-top[1].Error, uint64(200))
+
+	assert.Equal([]string{"domain", "other"}, tracker.Domains())
+	assert.Nil(tracker.Top("missing", 2))
+}
+
+func TestTrackerReplacesTheLightest(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000)).AnyTimes()
+	tracker := topkeys.NewTracker(3, time.Minute, timeSource)
+
+	tracker.Add("domain", "user=a", 1)
+	tracker.Add("domain", "user=b", 3)
+	tracker.Add("domain", "user=c", 2)
+	// the counted descriptors are reordered as their hits grow
+	tracker.Add("domain", "user=a", 4)
+	// c, then d, is the lightest
+	tracker.Add("domain", "user=d", 1)
+	tracker.Add("domain", "user=e", 1)
+
+	assert.Equal([]topkeys.Key{
+		{Descriptor: "user=a", Hits: 5, Rate: 5.0 / 60},
+		{Descriptor: "user=e", Hits: 4, Error: 3, Rate: 4.0 / 60},
+		{Descriptor: "user=b", Hits: 3, Rate: 3.0 / 60},
+	}, tracker.Top("domain", 3))
+}
+
+func TestTrackerSlidingWindow(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	now := int64(1000)
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().DoAndReturn(func() int64 { return now }).AnyTimes()
+	tracker := topkeys.NewTracker(10, time.Minute, timeSource)
+
+	tracker.Add("domain", "user=a", 60)
+	// the previous window is prorated
+	now += 90
+	tracker.Add("domain", "user=b", 10)
+	top := tracker.Top("domain", 10)
+	assert.Equal([]topkeys.Key{
+		{Descriptor: "user=a", Hits: 30, Rate: 0.5},
+		{Descriptor: "user=b", Hits: 10, Rate: 10.0 / 60},
+	}, top)
+
+	// the hits older than two windows are forgotten
+	now += 120
+	assert.Empty(tracker.Top("domain", 10))
+}
+
+func TestTopKeysHandler(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	timeSource := mock_utils.NewMockTimeSource(controller)
+	timeSource.EXPECT().UnixNow().Return(int64(1000)).AnyTimes()
+	tracker := topkeys.NewTracker(10, time.Minute, timeSource)
+	tracker.Add("domain", "user=a", 6)
+	tracker.Add("domain", "user=b", 3)
+	tracker.Add("other", "user=c", 1)
+	handler := server.NewTopKeysHandler(tracker)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/topkeys?domain=domain&n=1", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`[{"domain":"domain","keys":[{"descriptor":"user=a","hits":6,"error":0,"rate":0.1}]}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/topkeys", nil))
+	assert.JSONEq(`[
+		{"domain":"domain","keys":[{"descriptor":"user=a","hits":6,"error":0,"rate":0.1},{"descriptor":"user=b","hits":3,"error":0,"rate":0.05}]},
+		{"domain":"other","keys":[{"descriptor":"user=c","hits":1,"error":0,"rate":0.016666666666666666}]}
+	]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/topkeys?domain=missing", nil))
+	assert.JSONEq(`[{"domain":"missing","keys":[]}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/topkeys?n=0", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
@@ -3,6 +3,7 @@ package utils_test
 import (
 	"testing"
 
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/envoyproxy/ratelimit/src/utils"
@@ -39,3 +40,38 @@ func TestMaskCredentialsInUrlSentinel(t *testing.T) {
 	expected = "foob@r,redis://*****@redis1:6379,redis://*****@redis2:6379"
 	assert.Equal(t, expected, utils.MaskCredentialsInUrl(url))
 }
+
+type fixedTimeSource int64
+
+func (this fixedTimeSource) UnixNow() int64 {
+	return int64(this)
+}
+
+func TestUnitToDividerWithMultiplier(t *testing.T) {
+	assert.Equal(t, int64(60), utils.UnitToDividerWithMultiplier(pb.RateLimitResponse_RateLimit_MINUTE, 0))
+	assert.Equal(t, int64(60), utils.UnitToDividerWithMultiplier(pb.RateLimitResponse_RateLimit_MINUTE, 1))
+	assert.Equal(t, int64(300), utils.UnitToDividerWithMultiplier(pb.RateLimitResponse_RateLimit_MINUTE, 5))
+	assert.Equal(t, int64(60*60*24*30), utils.UnitToDividerWithMultiplier(pb.RateLimitResponse_RateLimit_MONTH, 1))
+}
+
+type fixedMilliTimeSource int64
+
+func (this fixedMilliTimeSource) UnixNow() int64 {
+	return int64(this) / 1000
+}
+
+func (this fixedMilliTimeSource) UnixMilliNow() int64 {
+	return int64(this)
+}
+
+func TestUnixMilliNow(t *testing.T) {
+	assert.Equal(t, int64(1234567), utils.UnixMilliNow(fixedMilliTimeSource(1234567)))
+	// the time sources without a millisecond precision give the start of the second
+	assert.Equal(t, int64(1234000), utils.UnixMilliNow(fixedTimeSource(1234)))
+}
+
+func TestCalculateResetWithDivider(t *testing.T) {
+	assert.Equal(t, int64(300), utils.CalculateResetWithDivider(300, fixedTimeSource(600)).GetSeconds())
+	assert.Equal(t, int64(290), utils.CalculateResetWithDivider(300, fixedTimeSource(610)).GetSeconds())
+	assert.Equal(t, int64(50), utils.CalculateResetWithDivider(60, fixedTimeSource(610)).GetSeconds())
+}